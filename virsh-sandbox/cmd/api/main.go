@@ -13,8 +13,17 @@ import (
 	"time"
 
 	"virsh-sandbox/internal/ansible"
+	"virsh-sandbox/internal/approval"
+	"virsh-sandbox/internal/clone"
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/extract"
+	"virsh-sandbox/internal/image"
 	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/oci"
+	"virsh-sandbox/internal/podman"
+	"virsh-sandbox/internal/policy"
 	"virsh-sandbox/internal/rest"
+	"virsh-sandbox/internal/sshca"
 	"virsh-sandbox/internal/store"
 	postgresStore "virsh-sandbox/internal/store/postgres"
 	"virsh-sandbox/internal/vm"
@@ -34,6 +43,18 @@ import (
 // @tag.name Ansible
 // @tag.description Ansible playbook job management
 
+// @tag.name Images
+// @tag.description Base image catalog - import, checksum verification and conversion
+
+// @tag.name Templates
+// @tag.description Named sandbox templates (source VM, shape, network, TTL, provisioning)
+
+// @tag.name Events
+// @tag.description Lifecycle event stream and webhook subscriptions
+
+// @tag.name Approvals
+// @tag.description Human approval queue for gated operations
+
 // @tag.name Health
 // @tag.description Health check endpoints
 func main() {
@@ -55,12 +76,66 @@ func main() {
 	defaultMemMB := atoiDefault(getenv("DEFAULT_MEMORY_MB", "2048"), 2048)
 	cmdTimeout := durationFromSecondsEnv("COMMAND_TIMEOUT_SEC", 600)              // 10m default
 	ipDiscoveryTimeout := durationFromSecondsEnv("IP_DISCOVERY_TIMEOUT_SEC", 120) // 2m default
+	cloudInitTimeout := durationFromSecondsEnv("CLOUD_INIT_TIMEOUT_SEC", 600)     // 10m default
+
+	// Shape quotas; 0 means unlimited
+	maxSandboxVCPUs := atoiDefault(getenv("SANDBOX_MAX_VCPUS", "0"), 0)
+	maxSandboxMemMB := atoiDefault(getenv("SANDBOX_MAX_MEMORY_MB", "0"), 0)
+	agentVCPUQuota := atoiDefault(getenv("AGENT_VCPU_QUOTA", "0"), 0)
+	agentMemQuotaMB := atoiDefault(getenv("AGENT_MEMORY_MB_QUOTA", "0"), 0)
+
+	// Snapshot file browsing
+	fsCacheTTL := durationFromSecondsEnv("FS_BROWSE_CACHE_SEC", 60)
+	fsMaxFileBytes := int64(atoiDefault(getenv("FS_BROWSE_MAX_FILE_BYTES", "10485760"), 10<<20))
 
 	// Ansible configuration
 	ansibleInventoryPath := getenv("ANSIBLE_INVENTORY_PATH", "/ansible/inventory")
 	ansibleImage := getenv("ANSIBLE_IMAGE", "ansible-sandbox")
 	ansiblePlaybooks := strings.Split(getenv("ANSIBLE_ALLOWED_PLAYBOOKS", "ping.yml"), ",")
 
+	// Webhook delivery configuration
+	webhookMaxAttempts := atoiDefault(getenv("WEBHOOK_MAX_ATTEMPTS", "5"), 5)
+	webhookTimeout := durationFromSecondsEnv("WEBHOOK_TIMEOUT_SEC", 10)
+
+	// SSH certificate access; an empty CA key path disables it
+	sshCAKeyPath := getenv("SSH_CA_KEY_PATH", "")
+	sshCAPubKeyPath := getenv("SSH_CA_PUB_KEY_PATH", sshCAKeyPath+".pub")
+	sshCAWorkDir := getenv("SSH_CA_WORK_DIR", "/tmp/sshca")
+
+	// Command policy (optional JSON rule file)
+	policyFile := getenv("COMMAND_POLICY_FILE", "")
+
+	// Base image catalog
+	baseImageDir := getenv("BASE_IMAGE_DIR", "/var/lib/libvirt/images/base")
+	imageImportDirs := splitList(getenv("IMAGE_IMPORT_DIRS", "/var/lib/libvirt/images/import"))
+	imageImportTimeout := durationFromSecondsEnv("IMAGE_IMPORT_TIMEOUT_SEC", 3600)
+
+	// Host directory sharing (virtiofs/9p); empty disables it
+	sharedDirAllowlist := splitList(getenv("SHARED_DIR_ALLOWLIST", ""))
+
+	// VM-to-container clone jobs
+	cloneWorkDir := getenv("CLONE_WORK_DIR", "/var/lib/virsh-sandbox/clones")
+	cloneTimeout := durationFromSecondsEnv("CLONE_TIMEOUT_SEC", 3600)
+	cloneResume := boolDefault(os.Getenv("CLONE_RESUME_INTERRUPTED"), true)
+	cloneNBDLockDir := getenv("CLONE_NBD_LOCK_DIR", extract.DefaultNBDLockDir)
+	cloneImageBuilder := getenv("CLONE_IMAGE_BUILDER", clone.BuilderPodman)
+	cloneLayerCompression := getenv("CLONE_LAYER_COMPRESSION", string(oci.CompressionGzip))
+	cloneFailOnSecrets := boolDefault(os.Getenv("CLONE_FAIL_ON_SECRETS"), false)
+	cloneScanPaths := splitList(getenv("CLONE_SECRET_SCAN_PATHS", ""))
+	cloneRegistryAuthFile := getenv("CLONE_REGISTRY_AUTH_FILE", "")
+	cloneInsecureRegistries := splitList(getenv("CLONE_INSECURE_REGISTRIES", ""))
+	clonePushRegistries := splitList(getenv("CLONE_PUSH_REGISTRIES", ""))
+	cloneIncremental := boolDefault(os.Getenv("CLONE_INCREMENTAL"), false)
+	cloneMaxDeltaLayers := atoiDefault(getenv("CLONE_MAX_DELTA_LAYERS", "16"), 16)
+
+	// Container sandbox runtime (Podman)
+	containerWorkDir := getenv("CONTAINER_WORK_DIR", "/var/lib/virsh-sandbox/containers")
+	containerNetwork := getenv("CONTAINER_NETWORK", "")
+
+	// Human approval gate
+	approvalOps := approval.ParseOperations(getenv("APPROVAL_REQUIRED_OPERATIONS", ""))
+	approvalTTL := durationFromSecondsEnv("APPROVAL_TTL_SEC", 3600)
+
 	logger.Info("starting virsh-sandbox API",
 		"addr", apiAddr,
 		"db", dbURL,
@@ -92,9 +167,40 @@ func main() {
 	// Initialize libvirt manager from environment
 	lvMgr := libvirt.NewFromEnv()
 
+	// Container runtime for sandboxes created with runtime "container"
+	containerMgr := podman.NewManager(podman.ManagerConfig{
+		WorkDir: containerWorkDir,
+		Network: containerNetwork,
+	})
+
 	// Initialize domain manager for direct libvirt queries
 	domainMgr := libvirt.NewDomainManager(libvirtURI)
 
+	var cmdPolicy *policy.Engine
+	if policyFile != "" {
+		cmdPolicy, err = policy.Load(policyFile)
+		if err != nil {
+			logger.Error("failed to load command policy", "file", policyFile, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("command policy loaded", "file", policyFile)
+	}
+
+	// Lifecycle event bus and webhook delivery
+	bus := events.NewBus()
+	webhookSvc := events.NewWebhookService(st, bus, events.WebhookConfig{
+		MaxAttempts:    webhookMaxAttempts,
+		RequestTimeout: webhookTimeout,
+	}, events.WithWebhookLogger(logger))
+	go webhookSvc.Run(ctx)
+
+	// Initialize approval service
+	approvalSvc := approval.NewService(st, approval.Config{
+		Required: approvalOps,
+		TTL:      approvalTTL,
+	}, approval.WithEventPublisher(bus), approval.WithLogger(logger))
+	go approvalSvc.Run(ctx)
+
 	// Initialize VM service
 	vmSvc := vm.NewService(lvMgr, st, vm.Config{
 		Network:            network,
@@ -102,13 +208,87 @@ func main() {
 		DefaultMemoryMB:    defaultMemMB,
 		CommandTimeout:     cmdTimeout,
 		IPDiscoveryTimeout: ipDiscoveryTimeout,
-	})
+		CloudInitTimeout:   cloudInitTimeout,
+		SharedDirAllowlist: sharedDirAllowlist,
+		MaxSandboxVCPUs:    maxSandboxVCPUs,
+		MaxSandboxMemoryMB: maxSandboxMemMB,
+		AgentVCPUQuota:     agentVCPUQuota,
+		AgentMemoryMBQuota: agentMemQuotaMB,
+		FSCacheTTL:         fsCacheTTL,
+		FSMaxFileBytes:     fsMaxFileBytes,
+	}, vm.WithEventPublisher(bus), vm.WithPolicy(cmdPolicy), vm.WithContainerRuntime(containerMgr),
+		vm.WithApprovalVerifier(approvalSvc))
+
+	// Initialize base image catalog
+	imageSvc := image.NewService(st, image.Config{
+		Dir:           baseImageDir,
+		ImportDirs:    imageImportDirs,
+		ImportTimeout: imageImportTimeout,
+	}, image.WithLogger(logger))
+	if err := imageSvc.Recover(ctx); err != nil {
+		logger.Error("recover interrupted image imports", "error", err)
+	}
+
+	// Initialize VM-to-container clone service
+	var cloneRegistryAuth map[string]oci.Credentials
+	if cloneRegistryAuthFile != "" {
+		cloneRegistryAuth, err = oci.LoadAuthFile(cloneRegistryAuthFile)
+		if err != nil {
+			logger.Error("failed to load registry credentials", "file", cloneRegistryAuthFile, "error", err)
+			os.Exit(1)
+		}
+	}
+	cloneSvc := clone.NewService(domainMgr, st, clone.Config{
+		WorkDir:            cloneWorkDir,
+		Timeout:            cloneTimeout,
+		ResumeInterrupted:  cloneResume,
+		NBDLockDir:         cloneNBDLockDir,
+		ImageBuilder:       cloneImageBuilder,
+		LayerCompression:   oci.Compression(cloneLayerCompression),
+		RegistryAuth:       cloneRegistryAuth,
+		InsecureRegistries: cloneInsecureRegistries,
+		PushRegistries:     clonePushRegistries,
+		Incremental:        cloneIncremental,
+		MaxDeltaLayers:     cloneMaxDeltaLayers,
+	}, clone.WithEventPublisher(bus), clone.WithLogger(logger),
+		clone.WithSanitizer(extract.NewSanitizer(extract.SanitizerConfig{
+			SecretScanPaths: cloneScanPaths,
+			FailOnSecrets:   cloneFailOnSecrets,
+		})))
+	if err := cloneSvc.Recover(ctx); err != nil {
+		logger.Error("recover interrupted clone jobs", "error", err)
+	}
+
+	// Initialize SSH certificate access
+	var accessSvc *sshca.AccessService
+	if sshCAKeyPath != "" {
+		caCfg := sshca.DefaultConfig()
+		caCfg.CAKeyPath = sshCAKeyPath
+		caCfg.CAPubKeyPath = sshCAPubKeyPath
+		caCfg.WorkDir = sshCAWorkDir
+		ca, err := sshca.NewCA(caCfg)
+		if err == nil {
+			err = ca.Initialize(ctx)
+		}
+		if err != nil {
+			logger.Error("failed to initialize SSH CA", "key", sshCAKeyPath, "error", err)
+			os.Exit(1)
+		}
+		accessSvc = sshca.NewAccessService(ca, sshca.NewMemoryStore(), sshca.NewVMAdapter(st),
+			sshca.DefaultAccessServiceConfig(), sshca.WithAccessEventPublisher(bus))
+	}
 
 	// Initialize Ansible runner
-	ansibleRunner := ansible.NewRunner(ansibleInventoryPath, ansibleImage, ansiblePlaybooks)
+	ansibleRunner := ansible.NewRunner(ansibleInventoryPath, ansibleImage, ansiblePlaybooks,
+		ansible.WithEventPublisher(bus))
 
 	// REST server setup
-	restSrv := rest.NewServer(vmSvc, domainMgr, ansibleRunner)
+	restSrv := rest.NewServer(vmSvc, domainMgr, ansibleRunner,
+		rest.WithEventsHandler(rest.NewEventsHandler(bus, webhookSvc)),
+		rest.WithApprovals(approvalSvc),
+		rest.WithImages(imageSvc),
+		rest.WithClones(cloneSvc),
+		rest.WithAccess(accessSvc))
 
 	// Build http.Server so we can gracefully shutdown
 	httpSrv := &http.Server{
@@ -192,6 +372,18 @@ func atoiDefault(s string, def int) int {
 	return i
 }
 
+// boolDefault parses s as bool, returning def if empty or invalid.
+func boolDefault(s string, def bool) bool {
+	if s == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
 // durationFromSecondsEnv reads an environment variable name as seconds and returns a duration.
 // If missing or invalid, returns the defaultSeconds value.
 func durationFromSecondsEnv(envName string, defaultSeconds int) time.Duration {
@@ -210,3 +402,14 @@ func durationFromSecondsEnv(envName string, defaultSeconds int) time.Duration {
 	}
 	return time.Duration(sec) * time.Second
 }
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -8,6 +8,8 @@ import (
 	"sync"
 
 	"github.com/google/uuid"
+
+	"virsh-sandbox/internal/events"
 )
 
 // JobStatus represents the current state of an Ansible job.
@@ -49,21 +51,35 @@ type Runner struct {
 	allowedPlaybooks map[string]struct{}
 	inventoryPath    string
 	ansibleImage     string
+	events           events.Publisher
+}
+
+// RunnerOption configures the Runner during construction.
+type RunnerOption func(*Runner)
+
+// WithEventPublisher sets the publisher that receives job lifecycle events.
+func WithEventPublisher(p events.Publisher) RunnerOption {
+	return func(r *Runner) { r.events = p }
 }
 
 // NewRunner creates a new Ansible runner.
-func NewRunner(inventoryPath, ansibleImage string, allowedPlaybooks []string) *Runner {
+func NewRunner(inventoryPath, ansibleImage string, allowedPlaybooks []string, opts ...RunnerOption) *Runner {
 	allowed := make(map[string]struct{}, len(allowedPlaybooks))
 	for _, p := range allowedPlaybooks {
 		allowed[p] = struct{}{}
 	}
 
-	return &Runner{
+	r := &Runner{
 		jobs:             make(map[string]*Job),
 		allowedPlaybooks: allowed,
 		inventoryPath:    inventoryPath,
 		ansibleImage:     ansibleImage,
+		events:           events.Discard,
+	}
+	for _, o := range opts {
+		o(r)
 	}
+	return r
 }
 
 // CreateJob creates a new Ansible job and returns its ID.
@@ -85,6 +101,8 @@ func (r *Runner) CreateJob(req JobRequest) (*JobResponse, error) {
 	r.jobs[jobID] = job
 	r.mu.Unlock()
 
+	r.publish(context.Background(), events.TypeAnsibleJobCreated, job, nil)
+
 	return &JobResponse{
 		JobID: jobID,
 		WSURL: fmt.Sprintf("/ws/ansible/jobs/%s", jobID),
@@ -163,8 +181,10 @@ func (r *Runner) RunJob(ctx context.Context, jobID string, writer OutputWriter)
 
 	if err := cmd.Start(); err != nil {
 		r.SetJobStatus(jobID, JobStatusFailed)
+		r.publish(ctx, events.TypeAnsibleJobFailed, job, map[string]any{"error": err.Error()})
 		return fmt.Errorf("failed to start docker: %w", err)
 	}
+	r.publish(ctx, events.TypeAnsibleJobStarted, job, nil)
 
 	// Stream output line by line
 	scanner := bufio.NewScanner(stdout)
@@ -183,13 +203,30 @@ func (r *Runner) RunJob(ctx context.Context, jobID string, writer OutputWriter)
 			exitCode = exitError.ExitCode()
 		} else {
 			r.SetJobStatus(jobID, JobStatusFailed)
+			r.publish(ctx, events.TypeAnsibleJobFailed, job, map[string]any{"error": exitErr.Error()})
 			return fmt.Errorf("failed to wait for docker: %w", exitErr)
 		}
 	}
 
 	r.SetJobStatus(jobID, JobStatusFinished)
+	r.publish(ctx, events.TypeAnsibleJobFinished, job, map[string]any{"exit_code": exitCode})
 
 	_ = writer.WriteLine(fmt.Sprintf("\nJob finished (rc=%d)", exitCode))
 
 	return nil
 }
+
+// publish emits a job lifecycle event.
+func (r *Runner) publish(ctx context.Context, typ events.Type, job *Job, data map[string]any) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["vm_name"] = job.VMName
+	data["playbook"] = job.Playbook
+	data["check"] = job.Check
+	r.events.Publish(ctx, events.Event{
+		Type:  typ,
+		JobID: job.ID,
+		Data:  data,
+	})
+}
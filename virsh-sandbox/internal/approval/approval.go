@@ -0,0 +1,429 @@
+// Package approval parks sensitive sandbox operations until a human approves
+// them.
+//
+// Callers register an Executor per operation. Request persists a pending
+// approval and notifies operators through the event bus (and therefore through
+// webhooks). Approve runs the registered executor and records its outcome;
+// Deny and expiry close the request without running anything.
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/store"
+)
+
+// Operation names an operation that can be gated on approval.
+type Operation string
+
+const (
+	OpDestroySandbox Operation = "destroy_sandbox"
+	OpRevertSnapshot Operation = "revert_snapshot"
+	OpPublish        Operation = "publish"
+	OpRunCommand     Operation = "run_command"
+)
+
+var (
+	// ErrNotPending is returned when deciding an approval that is no longer pending.
+	ErrNotPending = errors.New("approval is not pending")
+
+	// ErrExpired is returned when deciding an approval past its deadline.
+	ErrExpired = errors.New("approval has expired")
+
+	// ErrNoExecutor is returned when no executor is registered for an operation.
+	ErrNoExecutor = errors.New("no executor registered for operation")
+)
+
+// Executor performs an approved operation. secrets carries values that were
+// supplied with the request but deliberately not persisted; it is nil if the
+// service restarted in between.
+type Executor func(ctx context.Context, a *store.Approval, secrets map[string]string) (any, error)
+
+// Store is the subset of store.DataStore used by the approval service.
+type Store interface {
+	CreateApproval(ctx context.Context, a *store.Approval) error
+	GetApproval(ctx context.Context, id string) (*store.Approval, error)
+	ListApprovals(ctx context.Context, filter store.ApprovalFilter, opt *store.ListOptions) ([]*store.Approval, error)
+	UpdateApproval(ctx context.Context, a *store.Approval, expect store.ApprovalStatus) error
+}
+
+// Config controls which operations require approval and how long requests wait.
+type Config struct {
+	// Required lists operations that always need approval. Commands flagged by
+	// the command policy are gated regardless of this list.
+	Required []Operation
+
+	// TTL is how long a request stays pending before it expires (default 1h).
+	TTL time.Duration
+
+	// SweepInterval is how often Run expires overdue requests (default 30s).
+	SweepInterval time.Duration
+}
+
+// Service manages approval requests.
+type Service struct {
+	store     Store
+	cfg       Config
+	events    events.Publisher
+	logger    *slog.Logger
+	timeNowFn func() time.Time
+
+	mu        sync.Mutex
+	required  map[Operation]bool
+	executors map[Operation]Executor
+	secrets   map[string]map[string]string // approval ID -> in-memory secrets
+	executing map[string]bool              // approval IDs whose executor is running and unconsumed
+}
+
+// Option configures the Service during construction.
+type Option func(*Service)
+
+// WithEventPublisher sets the publisher used to notify operators.
+func WithEventPublisher(p events.Publisher) Option {
+	return func(s *Service) { s.events = p }
+}
+
+// WithLogger overrides the logger.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Service) { s.logger = l }
+}
+
+// WithTimeNow overrides the clock (useful for tests).
+func WithTimeNow(fn func() time.Time) Option {
+	return func(s *Service) { s.timeNowFn = fn }
+}
+
+// NewService constructs an approval service.
+func NewService(st Store, cfg Config, opts ...Option) *Service {
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Hour
+	}
+	if cfg.SweepInterval <= 0 {
+		cfg.SweepInterval = 30 * time.Second
+	}
+	s := &Service{
+		store:     st,
+		cfg:       cfg,
+		events:    events.Discard,
+		logger:    slog.Default(),
+		timeNowFn: time.Now,
+		required:  make(map[Operation]bool),
+		executors: make(map[Operation]Executor),
+		secrets:   make(map[string]map[string]string),
+		executing: make(map[string]bool),
+	}
+	for _, op := range cfg.Required {
+		s.required[op] = true
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// ParseOperations parses a comma-separated operation list (e.g. from env).
+func ParseOperations(raw string) []Operation {
+	var out []Operation
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, Operation(part))
+		}
+	}
+	return out
+}
+
+// Register sets the executor for op.
+func (s *Service) Register(op Operation, fn Executor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.executors[op] = fn
+}
+
+// Requires reports whether op is configured to always need approval.
+func (s *Service) Requires(op Operation) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.required[op]
+}
+
+// Request describes an operation to park for approval.
+type Request struct {
+	Operation   Operation
+	SandboxID   string
+	JobID       string
+	RequestedBy string
+	Reason      string
+	Payload     any               // JSON-encoded and persisted; must not contain secrets
+	Secrets     map[string]string // kept in memory only and passed to the executor
+}
+
+// Request persists a pending approval and notifies operators.
+func (s *Service) Request(ctx context.Context, req Request) (*store.Approval, error) {
+	if req.Operation == "" || req.SandboxID == "" {
+		return nil, fmt.Errorf("operation and sandbox id are required")
+	}
+	s.mu.Lock()
+	_, ok := s.executors[req.Operation]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoExecutor, req.Operation)
+	}
+
+	now := s.timeNowFn().UTC()
+	a := &store.Approval{
+		ID:          fmt.Sprintf("APR-%s", id.Short()),
+		SandboxID:   req.SandboxID,
+		JobID:       req.JobID,
+		Operation:   string(req.Operation),
+		Status:      store.ApprovalStatusPending,
+		RequestedBy: req.RequestedBy,
+		Reason:      req.Reason,
+		ExpiresAt:   now.Add(s.cfg.TTL),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if req.Payload != nil {
+		b, err := json.Marshal(req.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("encode payload: %w", err)
+		}
+		tmp := string(b)
+		a.PayloadJSON = &tmp
+	}
+	if err := s.store.CreateApproval(ctx, a); err != nil {
+		return nil, fmt.Errorf("persist approval: %w", err)
+	}
+	if len(req.Secrets) > 0 {
+		s.mu.Lock()
+		s.secrets[a.ID] = req.Secrets
+		s.mu.Unlock()
+	}
+
+	s.publish(ctx, events.TypeApprovalRequested, a, map[string]any{
+		"requested_by": a.RequestedBy,
+		"reason":       a.Reason,
+		"expires_at":   a.ExpiresAt,
+	})
+	return a, nil
+}
+
+// Get returns an approval by ID.
+func (s *Service) Get(ctx context.Context, id string) (*store.Approval, error) {
+	return s.store.GetApproval(ctx, id)
+}
+
+// List returns approvals matching filter.
+func (s *Service) List(ctx context.Context, filter store.ApprovalFilter, opt *store.ListOptions) ([]*store.Approval, error) {
+	return s.store.ListApprovals(ctx, filter, opt)
+}
+
+// Approve marks a pending approval as approved and runs the operation. The
+// operation's outcome is recorded on the returned approval; a non-nil error is
+// returned only when the approval itself could not be decided or persisted.
+func (s *Service) Approve(ctx context.Context, id, decidedBy, note string) (*store.Approval, error) {
+	a, err := s.decide(ctx, id, store.ApprovalStatusApproved, decidedBy, note)
+	if err != nil {
+		return nil, err
+	}
+	s.publish(ctx, events.TypeApprovalApproved, a, map[string]any{"decided_by": decidedBy})
+
+	s.mu.Lock()
+	exec := s.executors[Operation(a.Operation)]
+	secrets := s.secrets[a.ID]
+	delete(s.secrets, a.ID)
+	s.executing[a.ID] = true
+	s.mu.Unlock()
+
+	var (
+		result  any
+		execErr error
+	)
+	if exec == nil {
+		execErr = fmt.Errorf("%w: %s", ErrNoExecutor, a.Operation)
+	} else {
+		result, execErr = exec(ctx, a, secrets)
+	}
+	s.mu.Lock()
+	delete(s.executing, a.ID)
+	s.mu.Unlock()
+
+	executedAt := s.timeNowFn().UTC()
+	a.ExecutedAt = &executedAt
+	if execErr != nil {
+		msg := execErr.Error()
+		a.Error = &msg
+	}
+	if result != nil {
+		if b, err := json.Marshal(result); err == nil {
+			tmp := string(b)
+			a.ResultJSON = &tmp
+		}
+	}
+	if err := s.store.UpdateApproval(ctx, a, store.ApprovalStatusApproved); err != nil {
+		return a, fmt.Errorf("persist approval result: %w", err)
+	}
+
+	data := map[string]any{"success": execErr == nil}
+	if execErr != nil {
+		data["error"] = execErr.Error()
+	}
+	s.publish(ctx, events.TypeApprovalExecuted, a, data)
+	return a, nil
+}
+
+// Consume checks that id is an approved op for sandboxID whose executor is
+// running, and marks it used so it authorises exactly one operation. Anything
+// else is rejected with an error wrapping store.ErrConflict.
+func (s *Service) Consume(ctx context.Context, id string, op Operation, sandboxID string) (*store.Approval, error) {
+	s.mu.Lock()
+	executing := s.executing[id]
+	delete(s.executing, id)
+	s.mu.Unlock()
+	if !executing {
+		return nil, fmt.Errorf("%w: approval %s is not being executed or was already used", store.ErrConflict, id)
+	}
+
+	a, err := s.store.GetApproval(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: approval %s: %v", store.ErrConflict, id, err)
+	}
+	switch {
+	case a.Status != store.ApprovalStatusApproved:
+		return nil, fmt.Errorf("%w: approval %s is %s", store.ErrConflict, id, a.Status)
+	case Operation(a.Operation) != op:
+		return nil, fmt.Errorf("%w: approval %s is for %s, not %s", store.ErrConflict, id, a.Operation, op)
+	case a.SandboxID != sandboxID:
+		return nil, fmt.Errorf("%w: approval %s is for sandbox %s", store.ErrConflict, id, a.SandboxID)
+	case a.ExecutedAt != nil:
+		return nil, fmt.Errorf("%w: approval %s was already used", store.ErrConflict, id)
+	}
+	return a, nil
+}
+
+// Deny marks a pending approval as denied. The operation is not run.
+func (s *Service) Deny(ctx context.Context, id, decidedBy, note string) (*store.Approval, error) {
+	a, err := s.decide(ctx, id, store.ApprovalStatusDenied, decidedBy, note)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	delete(s.secrets, a.ID)
+	s.mu.Unlock()
+	s.publish(ctx, events.TypeApprovalDenied, a, map[string]any{"decided_by": decidedBy, "note": note})
+	return a, nil
+}
+
+// ExpirePending marks overdue pending approvals as expired and returns how many
+// were expired.
+func (s *Service) ExpirePending(ctx context.Context) (int, error) {
+	pending := store.ApprovalStatusPending
+	list, err := s.store.ListApprovals(ctx, store.ApprovalFilter{Status: &pending}, nil)
+	if err != nil {
+		return 0, err
+	}
+	now := s.timeNowFn().UTC()
+	n := 0
+	for _, a := range list {
+		if now.Before(a.ExpiresAt) {
+			continue
+		}
+		if err := s.expire(ctx, a); err != nil {
+			if errors.Is(err, store.ErrConflict) {
+				continue
+			}
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Run expires overdue approvals periodically until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	t := time.NewTicker(s.cfg.SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, err := s.ExpirePending(ctx); err != nil {
+				s.logger.Error("expire approvals", "error", err)
+			} else if n > 0 {
+				s.logger.Info("expired approvals", "count", n)
+			}
+		}
+	}
+}
+
+// decide transitions a pending approval to status.
+func (s *Service) decide(ctx context.Context, id string, status store.ApprovalStatus, decidedBy, note string) (*store.Approval, error) {
+	a, err := s.store.GetApproval(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if a.Status != store.ApprovalStatusPending {
+		return nil, fmt.Errorf("%w: status is %s", ErrNotPending, a.Status)
+	}
+	now := s.timeNowFn().UTC()
+	if !now.Before(a.ExpiresAt) {
+		if err := s.expire(ctx, a); err != nil && !errors.Is(err, store.ErrConflict) {
+			return nil, err
+		}
+		return nil, ErrExpired
+	}
+
+	a.Status = status
+	a.DecidedAt = &now
+	if decidedBy != "" {
+		a.DecidedBy = &decidedBy
+	}
+	if note != "" {
+		a.DecisionNote = &note
+	}
+	if err := s.store.UpdateApproval(ctx, a, store.ApprovalStatusPending); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			return nil, fmt.Errorf("%w: decided concurrently", ErrNotPending)
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *Service) expire(ctx context.Context, a *store.Approval) error {
+	now := s.timeNowFn().UTC()
+	a.Status = store.ApprovalStatusExpired
+	a.DecidedAt = &now
+	if err := s.store.UpdateApproval(ctx, a, store.ApprovalStatusPending); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.secrets, a.ID)
+	s.mu.Unlock()
+	s.publish(ctx, events.TypeApprovalExpired, a, nil)
+	return nil
+}
+
+func (s *Service) publish(ctx context.Context, typ events.Type, a *store.Approval, data map[string]any) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["approval_id"] = a.ID
+	data["operation"] = a.Operation
+	data["status"] = string(a.Status)
+	s.events.Publish(ctx, events.Event{
+		Type:      typ,
+		SandboxID: a.SandboxID,
+		JobID:     a.JobID,
+		Data:      data,
+	})
+}
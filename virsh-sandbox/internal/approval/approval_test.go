@@ -0,0 +1,465 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/store"
+)
+
+// memStore keeps approvals in memory. UpdateApproval compares the stored
+// status like the database does.
+type memStore struct {
+	mu        sync.Mutex
+	approvals map[string]store.Approval
+}
+
+func newMemStore() *memStore { return &memStore{approvals: make(map[string]store.Approval)} }
+
+func (m *memStore) CreateApproval(_ context.Context, a *store.Approval) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.approvals[a.ID]; ok {
+		return store.ErrAlreadyExists
+	}
+	m.approvals[a.ID] = *a
+	return nil
+}
+
+func (m *memStore) GetApproval(_ context.Context, id string) (*store.Approval, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.approvals[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &a, nil
+}
+
+func (m *memStore) ListApprovals(_ context.Context, filter store.ApprovalFilter, _ *store.ListOptions) ([]*store.Approval, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*store.Approval
+	for _, a := range m.approvals {
+		if filter.Status != nil && a.Status != *filter.Status {
+			continue
+		}
+		a := a
+		out = append(out, &a)
+	}
+	return out, nil
+}
+
+func (m *memStore) UpdateApproval(_ context.Context, a *store.Approval, expect store.ApprovalStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.approvals[a.ID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	if cur.Status != expect {
+		return store.ErrConflict
+	}
+	m.approvals[a.ID] = *a
+	return nil
+}
+
+// recorder collects published events.
+type recorder struct {
+	mu     sync.Mutex
+	events []events.Type
+}
+
+func (r *recorder) Publish(_ context.Context, ev events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev.Type)
+}
+
+func (r *recorder) types() []events.Type {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]events.Type(nil), r.events...)
+}
+
+// clock is a settable time source.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestService(t *testing.T, opts ...Option) (*Service, *memStore, *clock, *recorder) {
+	t.Helper()
+	st := newMemStore()
+	clk := &clock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	rec := &recorder{}
+	svc := NewService(st, Config{TTL: time.Hour},
+		append([]Option{WithTimeNow(clk.Now), WithEventPublisher(rec)}, opts...)...)
+	return svc, st, clk, rec
+}
+
+func TestRequest(t *testing.T) {
+	svc, st, clk, rec := newTestService(t)
+	svc.Register(OpDestroySandbox, func(context.Context, *store.Approval, map[string]string) (any, error) { return nil, nil })
+
+	cases := []struct {
+		name    string
+		req     Request
+		wantErr error
+	}{
+		{"missing operation", Request{SandboxID: "SBX-1"}, nil},
+		{"missing sandbox", Request{Operation: OpDestroySandbox}, nil},
+		{"no executor", Request{Operation: OpPublish, SandboxID: "SBX-1"}, ErrNoExecutor},
+		{"unencodable payload", Request{Operation: OpDestroySandbox, SandboxID: "SBX-1", Payload: func() {}}, nil},
+	}
+	for _, c := range cases {
+		if _, err := svc.Request(context.Background(), c.req); err == nil || (c.wantErr != nil && !errors.Is(err, c.wantErr)) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.wantErr)
+		}
+	}
+	if len(st.approvals) != 0 || len(rec.types()) != 0 {
+		t.Fatalf("rejected requests left %d approvals and %d events", len(st.approvals), len(rec.types()))
+	}
+
+	a, err := svc.Request(context.Background(), Request{
+		Operation:   OpDestroySandbox,
+		SandboxID:   "SBX-1",
+		RequestedBy: "agent-1",
+		Payload:     map[string]string{"k": "v"},
+		Secrets:     map[string]string{"TOKEN": "s3cret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := st.GetApproval(context.Background(), a.ID)
+	if got.Status != store.ApprovalStatusPending || !got.ExpiresAt.Equal(clk.Now().Add(time.Hour)) ||
+		got.PayloadJSON == nil || *got.PayloadJSON != `{"k":"v"}` || got.RequestedBy != "agent-1" {
+		t.Errorf("stored approval = %+v", got)
+	}
+	if svc.secrets[a.ID]["TOKEN"] != "s3cret" {
+		t.Error("secrets were not retained in memory")
+	}
+	if ev := rec.types(); len(ev) != 1 || ev[0] != events.TypeApprovalRequested {
+		t.Errorf("events = %v", ev)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	cases := []struct {
+		name       string
+		setup      func(st *memStore, clk *clock, id string)
+		approve    bool
+		execErr    error
+		wantErr    error
+		wantStatus store.ApprovalStatus
+		wantRuns   int32
+		wantEvents []events.Type
+	}{
+		{
+			name:       "approve runs the executor",
+			approve:    true,
+			wantStatus: store.ApprovalStatusApproved,
+			wantRuns:   1,
+			wantEvents: []events.Type{events.TypeApprovalRequested, events.TypeApprovalApproved, events.TypeApprovalExecuted},
+		},
+		{
+			name:       "executor failure is recorded",
+			approve:    true,
+			execErr:    errors.New("boom"),
+			wantStatus: store.ApprovalStatusApproved,
+			wantRuns:   1,
+			wantEvents: []events.Type{events.TypeApprovalRequested, events.TypeApprovalApproved, events.TypeApprovalExecuted},
+		},
+		{
+			name:       "deny does not run",
+			wantStatus: store.ApprovalStatusDenied,
+			wantEvents: []events.Type{events.TypeApprovalRequested, events.TypeApprovalDenied},
+		},
+		{
+			name:       "expired approval cannot be approved",
+			setup:      func(_ *memStore, clk *clock, _ string) { clk.Advance(time.Hour) },
+			approve:    true,
+			wantErr:    ErrExpired,
+			wantStatus: store.ApprovalStatusExpired,
+			wantEvents: []events.Type{events.TypeApprovalRequested, events.TypeApprovalExpired},
+		},
+		{
+			name: "decided approval cannot be denied",
+			setup: func(st *memStore, _ *clock, id string) {
+				a := st.approvals[id]
+				a.Status = store.ApprovalStatusApproved
+				st.approvals[id] = a
+			},
+			wantErr:    ErrNotPending,
+			wantStatus: store.ApprovalStatusApproved,
+			wantEvents: []events.Type{events.TypeApprovalRequested},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			svc, st, clk, rec := newTestService(t)
+			var runs atomic.Int32
+			var gotSecrets map[string]string
+			svc.Register(OpRevertSnapshot, func(_ context.Context, _ *store.Approval, secrets map[string]string) (any, error) {
+				runs.Add(1)
+				gotSecrets = secrets
+				return map[string]int{"n": 1}, c.execErr
+			})
+			a, err := svc.Request(context.Background(), Request{Operation: OpRevertSnapshot, SandboxID: "SBX-1", Secrets: map[string]string{"K": "v"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.setup != nil {
+				c.setup(st, clk, a.ID)
+			}
+
+			decide := svc.Deny
+			if c.approve {
+				decide = svc.Approve
+			}
+			got, err := decide(context.Background(), a.ID, "operator", "note")
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			stored, _ := st.GetApproval(context.Background(), a.ID)
+			if stored.Status != c.wantStatus {
+				t.Errorf("status = %s, want %s", stored.Status, c.wantStatus)
+			}
+			if n := runs.Load(); n != c.wantRuns {
+				t.Errorf("executor ran %d times, want %d", n, c.wantRuns)
+			}
+			if ev := rec.types(); len(ev) != len(c.wantEvents) {
+				t.Errorf("events = %v, want %v", ev, c.wantEvents)
+			} else {
+				for i := range ev {
+					if ev[i] != c.wantEvents[i] {
+						t.Errorf("events = %v, want %v", ev, c.wantEvents)
+						break
+					}
+				}
+			}
+			if c.wantRuns == 1 {
+				if gotSecrets["K"] != "v" {
+					t.Errorf("executor secrets = %v", gotSecrets)
+				}
+				if stored.ExecutedAt == nil || stored.ResultJSON == nil || *stored.ResultJSON != `{"n":1}` {
+					t.Errorf("outcome not recorded: %+v", stored)
+				}
+				if (stored.Error != nil) != (c.execErr != nil) {
+					t.Errorf("recorded error = %v, want %v", stored.Error, c.execErr)
+				}
+			}
+			if err == nil && (got.DecidedBy == nil || *got.DecidedBy != "operator" || got.DecidedAt == nil) {
+				t.Errorf("decision not recorded: %+v", got)
+			}
+			if _, ok := svc.secrets[a.ID]; ok && !errors.Is(err, ErrNotPending) {
+				t.Error("secrets kept after the approval was closed")
+			}
+		})
+	}
+
+	svc, _, _, _ := newTestService(t)
+	if _, err := svc.Approve(context.Background(), "APR-missing", "", ""); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("approve missing: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDecideRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		svc, st, _, _ := newTestService(t)
+		var runs atomic.Int32
+		svc.Register(OpDestroySandbox, func(context.Context, *store.Approval, map[string]string) (any, error) {
+			runs.Add(1)
+			return nil, nil
+		})
+		a, err := svc.Request(context.Background(), Request{Operation: OpDestroySandbox, SandboxID: "SBX-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg    sync.WaitGroup
+			wins  atomic.Int32
+			start = make(chan struct{})
+		)
+		for j := 0; j < 8; j++ {
+			decide := svc.Approve
+			if j%2 == 1 {
+				decide = svc.Deny
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				_, err := decide(context.Background(), a.ID, "operator", "")
+				switch {
+				case err == nil:
+					wins.Add(1)
+				case !errors.Is(err, ErrNotPending):
+					t.Errorf("losing decision: err = %v, want ErrNotPending", err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if n := wins.Load(); n != 1 {
+			t.Fatalf("%d decisions succeeded, want 1", n)
+		}
+		stored, _ := st.GetApproval(context.Background(), a.ID)
+		want := int32(0)
+		if stored.Status == store.ApprovalStatusApproved {
+			want = 1
+		}
+		if n := runs.Load(); n != want {
+			t.Fatalf("executor ran %d times with final status %s", n, stored.Status)
+		}
+	}
+}
+
+func TestExpirePending(t *testing.T) {
+	svc, st, clk, rec := newTestService(t)
+	svc.Register(OpDestroySandbox, func(context.Context, *store.Approval, map[string]string) (any, error) { return nil, nil })
+	ctx := context.Background()
+
+	old, _ := svc.Request(ctx, Request{Operation: OpDestroySandbox, SandboxID: "SBX-1", Secrets: map[string]string{"K": "v"}})
+	decided, _ := svc.Request(ctx, Request{Operation: OpDestroySandbox, SandboxID: "SBX-2"})
+	if _, err := svc.Deny(ctx, decided.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(30 * time.Minute)
+	fresh, _ := svc.Request(ctx, Request{Operation: OpDestroySandbox, SandboxID: "SBX-3"})
+	clk.Advance(30 * time.Minute)
+
+	n, err := svc.ExpirePending(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("ExpirePending = %d, %v; want 1", n, err)
+	}
+	for id, want := range map[string]store.ApprovalStatus{
+		old.ID:     store.ApprovalStatusExpired,
+		decided.ID: store.ApprovalStatusDenied,
+		fresh.ID:   store.ApprovalStatusPending,
+	} {
+		if a := st.approvals[id]; a.Status != want {
+			t.Errorf("%s status = %s, want %s", id, a.Status, want)
+		}
+	}
+	if _, ok := svc.secrets[old.ID]; ok {
+		t.Error("secrets kept for an expired approval")
+	}
+	if ev := rec.types(); ev[len(ev)-1] != events.TypeApprovalExpired {
+		t.Errorf("last event = %s, want %s", ev[len(ev)-1], events.TypeApprovalExpired)
+	}
+	if n, err := svc.ExpirePending(ctx); err != nil || n != 0 {
+		t.Errorf("second ExpirePending = %d, %v; want 0", n, err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	st := newMemStore()
+	clk := &clock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	svc := NewService(st, Config{TTL: time.Minute, SweepInterval: time.Millisecond}, WithTimeNow(clk.Now))
+	svc.Register(OpDestroySandbox, func(context.Context, *store.Approval, map[string]string) (any, error) { return nil, nil })
+	a, err := svc.Request(context.Background(), Request{Operation: OpDestroySandbox, SandboxID: "SBX-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := st.GetApproval(context.Background(), a.ID)
+		if got.Status == store.ApprovalStatusExpired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Run did not expire the approval; status %s", got.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestConsume(t *testing.T) {
+	svc, _, _, _ := newTestService(t)
+	ctx := context.Background()
+
+	var errs []error
+	svc.Register(OpRunCommand, func(ctx context.Context, a *store.Approval, _ map[string]string) (any, error) {
+		_, wrongSandbox := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-2")
+		_, first := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-1")
+		_, second := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-1")
+		errs = []error{wrongSandbox, first, second}
+		return nil, nil
+	})
+	svc.Register(OpDestroySandbox, func(ctx context.Context, a *store.Approval, _ map[string]string) (any, error) {
+		_, err := svc.Consume(ctx, a.ID, OpRunCommand, a.SandboxID)
+		errs = []error{err}
+		return nil, nil
+	})
+
+	a, _ := svc.Request(ctx, Request{Operation: OpRunCommand, SandboxID: "SBX-1"})
+	if _, err := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-1"); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("pending approval: err = %v, want ErrConflict", err)
+	}
+	if _, err := svc.Approve(ctx, a.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	// The wrong sandbox is rejected and spends the approval.
+	if !errors.Is(errs[0], store.ErrConflict) || !errors.Is(errs[1], store.ErrConflict) || !errors.Is(errs[2], store.ErrConflict) {
+		t.Errorf("consume during execution = %v; want ErrConflict each", errs)
+	}
+	if _, err := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-1"); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("after execution: err = %v, want ErrConflict", err)
+	}
+
+	b, _ := svc.Request(ctx, Request{Operation: OpRunCommand, SandboxID: "SBX-1"})
+	svc.Register(OpRunCommand, func(ctx context.Context, a *store.Approval, _ map[string]string) (any, error) {
+		_, first := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-1")
+		_, second := svc.Consume(ctx, a.ID, OpRunCommand, "SBX-1")
+		errs = []error{first, second}
+		return nil, nil
+	})
+	if _, err := svc.Approve(ctx, b.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || !errors.Is(errs[1], store.ErrConflict) {
+		t.Errorf("consume twice = %v; want nil, ErrConflict", errs)
+	}
+
+	c, _ := svc.Request(ctx, Request{Operation: OpDestroySandbox, SandboxID: "SBX-1"})
+	if _, err := svc.Approve(ctx, c.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(errs[0], store.ErrConflict) {
+		t.Errorf("other operation: err = %v, want ErrConflict", errs[0])
+	}
+}
@@ -0,0 +1,970 @@
+// Package clone converts libvirt VMs into running Podman containers.
+//
+// A clone job runs the extract and podman stages in order: resolve the
+// domain, snapshot it (running VMs) or read its disk directly (stopped VMs),
+// mount the root filesystem, copy and sanitize it, archive it, build an image,
+// optionally push it to a registry, and run a container. Jobs run in the
+// background and report per-stage progress. Scratch resources (snapshot,
+// mount, copies, archive) are released when the job ends; on failure the
+// image and container are rolled back too. An image already pushed stays in
+// the registry.
+//
+// Every job is persisted as a store.WorkflowRun: stage progress, stage
+// outputs and each cleanup action are written as they happen, so a job
+// interrupted by a restart can be resumed or cleaned up (see Recover).
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/extract"
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/model"
+	"virsh-sandbox/internal/oci"
+	"virsh-sandbox/internal/podman"
+	"virsh-sandbox/internal/store"
+	"virsh-sandbox/internal/workflow"
+)
+
+// JobStatus is the overall state of a clone job.
+type JobStatus string
+
+const (
+	JobStatusPending    JobStatus = "pending"
+	JobStatusRunning    JobStatus = "running"
+	JobStatusSucceeded  JobStatus = "succeeded"
+	JobStatusFailed     JobStatus = "failed"
+	JobStatusRolledBack JobStatus = "rolled_back"
+)
+
+// StageStatus is the state of a single stage within a job.
+type StageStatus string
+
+const (
+	StageStatusPending StageStatus = "pending"
+	StageStatusRunning StageStatus = "running"
+	StageStatusDone    StageStatus = "done"
+	StageStatusFailed  StageStatus = "failed"
+
+	// StageStatusSkipped marks the stages a dry run does not execute.
+	StageStatusSkipped StageStatus = "skipped"
+)
+
+// stages lists the workflow stages in execution order.
+var stages = []string{
+	workflow.StageResolveDomain,
+	workflow.StageCreateSnapshot,
+	workflow.StageMountDisk,
+	workflow.StageSanitizeFS,
+	workflow.StageCreateArchive,
+	workflow.StageBuildImage,
+	workflow.StageRunContainer,
+	workflow.StageCleanup,
+}
+
+// jobStages returns the stages of a job, with push_image after build_image
+// when the job pushes its image.
+func jobStages(push bool) []string {
+	if !push {
+		return stages
+	}
+	out := make([]string, 0, len(stages)+1)
+	for _, name := range stages {
+		out = append(out, name)
+		if name == workflow.StageBuildImage {
+			out = append(out, workflow.StagePushImage)
+		}
+	}
+	return out
+}
+
+// StageProgress reports the progress of one stage.
+type StageProgress struct {
+	Name      string      `json:"name"`
+	Status    StageStatus `json:"status"`
+	Detail    string      `json:"detail,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	StartedAt *time.Time  `json:"started_at,omitempty"`
+	EndedAt   *time.Time  `json:"ended_at,omitempty"`
+}
+
+// Job is a VM-to-container clone run.
+type Job struct {
+	ID        string                  `json:"id"` // e.g., "CLN-1a2b3c4d"
+	VM        string                  `json:"vm"`
+	Status    JobStatus               `json:"status"`
+	Stage     string                  `json:"stage,omitempty"` // stage currently running, or the one that failed
+	Stages    []StageProgress         `json:"stages"`
+	Result    *model.CloneResult      `json:"result,omitempty"`
+	Error     *workflow.ErrorResponse `json:"error,omitempty"`
+	CreatedAt time.Time               `json:"created_at"`
+	UpdatedAt time.Time               `json:"updated_at"`
+
+	// DryRun jobs stop after sanitize_fs; Sanitize reports what each pass
+	// changed, or would have changed in a dry run.
+	DryRun   bool                 `json:"dry_run,omitempty"`
+	Sanitize []extract.PassReport `json:"sanitize,omitempty"`
+
+	// run holds the persisted outputs and cleanup actions of the job.
+	run *store.WorkflowRun
+}
+
+// clone returns a deep copy of j safe to hand to callers.
+func (j *Job) clone() *Job {
+	cp := *j
+	cp.run = nil
+	cp.Stages = append([]StageProgress(nil), j.Stages...)
+	if j.Result != nil {
+		r := *j.Result
+		cp.Result = &r
+	}
+	if j.Error != nil {
+		e := *j.Error
+		cp.Error = &e
+	}
+	return &cp
+}
+
+// Config controls where clone jobs work and how they run containers.
+type Config struct {
+	// WorkDir holds one scratch directory per job (sanitized copy, archive, build context).
+	WorkDir string
+
+	// Timeout bounds a single job from snapshot to running container (default 1h).
+	Timeout time.Duration
+
+	// Limits are applied to every container started by a job.
+	Limits podman.ResourceLimits
+
+	// PodmanPath and QemuNbdPath override the binaries looked up in PATH.
+	PodmanPath  string
+	QemuNbdPath string
+
+	// NBDLockDir holds the NBD device lock files shared by every process
+	// that clones on this host (default extract.DefaultNBDLockDir).
+	NBDLockDir string
+
+	// ResumeInterrupted lets Recover resume runs whose rootfs archive
+	// survived the restart instead of rolling them back.
+	ResumeInterrupted bool
+
+	// ImageBuilder selects how the image is built: BuilderPodman (default)
+	// runs podman build, BuilderOCI writes an OCI layout in-process and
+	// loads it, compressing the layer with LayerCompression.
+	ImageBuilder     string
+	LayerCompression oci.Compression
+
+	// RegistryAuth holds push credentials by registry host, and
+	// InsecureRegistries the hosts reached over plain HTTP.
+	RegistryAuth       map[string]oci.Credentials
+	InsecureRegistries []string
+
+	// PushRegistries lists the registries jobs may push to; "*" allows any.
+	// Empty disables pushing.
+	PushRegistries []string
+
+	// Incremental keeps a sanitized copy, a content manifest and an OCI
+	// layout per VM under WorkDir/incremental, so a repeat clone archives
+	// only what changed and adds it as a layer on the previous image. It
+	// implies the oci image builder. After MaxDeltaLayers layers (default
+	// 16) the next clone is a full one again.
+	Incremental    bool
+	MaxDeltaLayers int
+}
+
+// Image builders selectable in Config.
+const (
+	BuilderPodman = "podman"
+	BuilderOCI    = "oci"
+)
+
+// Store is the subset of store.DataStore used to persist clone runs.
+type Store interface {
+	CreateWorkflowRun(ctx context.Context, run *store.WorkflowRun) error
+	GetWorkflowRun(ctx context.Context, id string) (*store.WorkflowRun, error)
+	ListWorkflowRuns(ctx context.Context, filter store.WorkflowRunFilter, opt *store.ListOptions) ([]*store.WorkflowRun, error)
+	UpdateWorkflowRun(ctx context.Context, run *store.WorkflowRun) error
+}
+
+// Stage dependencies, satisfied by the extract, podman and libvirt types.
+type (
+	domainLookup interface {
+		LookupDomain(ctx context.Context, name string) (*libvirt.DomainInfo, error)
+	}
+	snapshotter interface {
+		PrepareExtraction(ctx context.Context, vmName string) (*extract.ExtractionPlan, error)
+		CommitSnapshot(ctx context.Context, vmName string) error
+	}
+	diskMounter interface {
+		MountDisk(ctx context.Context, diskPath, workDir string) (*extract.MountResult, error)
+		Unmount(ctx context.Context, mountPoint, nbdDevice string) error
+		Attachments() ([]extract.NBDAttachment, error)
+		Sweep(ctx context.Context) ([]extract.NBDAttachment, error)
+	}
+	fsSanitizer interface {
+		SanitizeFilesystem(ctx context.Context, sourcePath, workDir string, opts extract.SanitizeOptions) (*extract.SanitizeResult, error)
+		Validate(opts extract.SanitizeOptions) error
+		Passes() []extract.SanitizePass
+	}
+	fsArchiver interface {
+		CreateRootFSArchive(ctx context.Context, sourcePath, workDir string) (*extract.ArchiveResult, error)
+		CreateDeltaArchive(ctx context.Context, sourcePath, workDir string, delta *extract.Delta) (*extract.ArchiveResult, error)
+	}
+	imageBuilder interface {
+		BuildImage(ctx context.Context, archivePath, vmName, workDir string, opts ...podman.BuildOption) (*podman.ImageResult, error)
+		RemoveImage(ctx context.Context, imageRef string) error
+	}
+	imagePusher interface {
+		PushImage(ctx context.Context, img *podman.ImageResult, workDir string, target oci.Reference, opts oci.PushOptions) (*oci.PushResult, error)
+	}
+	containerRunner interface {
+		RunContainer(ctx context.Context, imageTag, vmName string, limits podman.ResourceLimits) (*podman.ContainerResult, error)
+		RemoveContainer(ctx context.Context, containerRef string, force bool) error
+	}
+)
+
+// Service runs and tracks clone jobs. Jobs started by this process are kept
+// in memory and written through to the store.
+type Service struct {
+	store  Store
+	cfg    Config
+	events events.Publisher
+	logger *slog.Logger
+
+	domains   domainLookup
+	snapshots snapshotter
+	mounts    diskMounter
+	sanitizer fsSanitizer
+	archiver  fsArchiver
+	builder   imageBuilder
+	pusher    imagePusher
+	runner    containerRunner
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	wg   sync.WaitGroup
+}
+
+// Option configures the Service during construction.
+type Option func(*Service)
+
+// WithEventPublisher sets the publisher that receives job lifecycle events.
+func WithEventPublisher(p events.Publisher) Option {
+	return func(s *Service) { s.events = p }
+}
+
+// WithLogger overrides the logger.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Service) { s.logger = l }
+}
+
+// WithSanitizer replaces the default sanitizer, for example one with custom
+// passes registered.
+func WithSanitizer(san *extract.Sanitizer) Option {
+	return func(s *Service) { s.sanitizer = san }
+}
+
+// StartOption configures a single clone job.
+type StartOption func(*startOptions)
+
+type startOptions struct {
+	sanitize extract.SanitizeOptions
+	push     *PushTarget
+	full     bool
+}
+
+// PushTarget is the registry image a job pushes its clone to.
+type PushTarget struct {
+	// Reference is registry/repository[:tag]. Without a tag the image's
+	// timestamp tag is used.
+	Reference string `json:"reference"`
+
+	// MountFrom is a repository on the same registry whose matching blobs
+	// are mounted rather than uploaded.
+	MountFrom string `json:"mount_from,omitempty"`
+}
+
+// WithPasses selects the sanitize passes to run, in order, instead of the
+// default ones.
+func WithPasses(names ...string) StartOption {
+	return func(o *startOptions) { o.sanitize.Passes = names }
+}
+
+// WithRules supplies the paths to drop, units to mask and files to template
+// for the rule-driven sanitize passes.
+func WithRules(rules extract.SanitizeRules) StartOption {
+	return func(o *startOptions) { o.sanitize.Rules = rules }
+}
+
+// WithDryRun makes the job report what each sanitize pass would remove or
+// modify on the mounted disk without copying it or building anything.
+func WithDryRun() StartOption {
+	return func(o *startOptions) { o.sanitize.DryRun = true }
+}
+
+// WithFailOnSecrets fails the job at sanitize_filesystem when the secret
+// scan reports findings.
+func WithFailOnSecrets() StartOption {
+	return func(o *startOptions) { o.sanitize.FailOnSecrets = true }
+}
+
+// WithFullExtraction makes an incremental clone archive the whole root
+// filesystem and start a new image, instead of a layer on the last one.
+func WithFullExtraction() StartOption {
+	return func(o *startOptions) { o.full = true }
+}
+
+// WithPush pushes the built image to target before the container is run.
+// Dry runs build nothing and ignore it.
+func WithPush(target PushTarget) StartOption {
+	return func(o *startOptions) { o.push = &target }
+}
+
+// NewService constructs a clone service that inspects domains through
+// domainMgr and persists runs to st.
+func NewService(domainMgr *libvirt.DomainManager, st Store, cfg Config, opts ...Option) *Service {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Hour
+	}
+	if cfg.Limits == (podman.ResourceLimits{}) {
+		cfg.Limits = podman.DefaultResourceLimits()
+	}
+	if cfg.MaxDeltaLayers <= 0 {
+		cfg.MaxDeltaLayers = 16
+	}
+	var builder imageBuilder = podman.NewImageBuilder(podman.ImageBuilderConfig{PodmanPath: cfg.PodmanPath})
+	if cfg.ImageBuilder == BuilderOCI || cfg.Incremental {
+		builder = podman.NewOCIImageBuilder(podman.OCIImageBuilderConfig{PodmanPath: cfg.PodmanPath, Compression: cfg.LayerCompression})
+	}
+	s := &Service{
+		store:     st,
+		cfg:       cfg,
+		events:    events.Discard,
+		logger:    slog.Default(),
+		domains:   domainMgr,
+		snapshots: extract.NewSnapshotManager(domainMgr),
+		mounts:    extract.NewMountManager(extract.MountConfig{QemuNbdPath: cfg.QemuNbdPath, LockDir: cfg.NBDLockDir}),
+		sanitizer: extract.NewSanitizer(extract.SanitizerConfig{}),
+		archiver:  extract.NewArchiver(extract.ArchiverConfig{}),
+		builder:   builder,
+		pusher: podman.NewImagePusher(podman.ImagePusherConfig{
+			PodmanPath: cfg.PodmanPath,
+			Client:     oci.NewClient(oci.ClientConfig{Auth: cfg.RegistryAuth, InsecureHosts: cfg.InsecureRegistries}),
+		}),
+		runner: podman.NewContainerRunner(podman.ContainerRunnerConfig{PodmanPath: cfg.PodmanPath}),
+		jobs:   make(map[string]*Job),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Start resolves vmName and starts a clone job for it in the background.
+// Resolution errors are returned directly as a *workflow.WorkflowError. A VM
+// that already has a pending or running job returns store.ErrConflict;
+// unknown passes, malformed rules and bad push targets return
+// store.ErrInvalid.
+func (s *Service) Start(ctx context.Context, vmName string, opts ...StartOption) (*Job, error) {
+	if vmName == "" {
+		return nil, fmt.Errorf("vm name is required: %w", store.ErrInvalid)
+	}
+	so := startOptions{sanitize: extract.SanitizeOptions{VMName: vmName}}
+	for _, o := range opts {
+		o(&so)
+	}
+	san := so.sanitize
+	if err := s.sanitizer.Validate(san); err != nil {
+		return nil, fmt.Errorf("sanitize options: %w: %w", err, store.ErrInvalid)
+	}
+	sanJSON, err := json.Marshal(san)
+	if err != nil {
+		return nil, fmt.Errorf("encode sanitize options: %w", err)
+	}
+	outputs := map[string]string{"sanitize_options": string(sanJSON)}
+	if so.push != nil && !san.DryRun {
+		if err := s.validatePush(*so.push); err != nil {
+			return nil, fmt.Errorf("push target: %w: %w", err, store.ErrInvalid)
+		}
+		pushJSON, err := json.Marshal(so.push)
+		if err != nil {
+			return nil, fmt.Errorf("encode push target: %w", err)
+		}
+		outputs["push_target"] = string(pushJSON)
+	}
+	if s.cfg.Incremental && !san.DryRun {
+		outputs["incremental"] = "true"
+		if so.full {
+			outputs["full"] = "true"
+		}
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        fmt.Sprintf("CLN-%s", id.Short()),
+		VM:        vmName,
+		Status:    JobStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+		DryRun:    san.DryRun,
+		run: &store.WorkflowRun{
+			Kind:     runKind,
+			Subject:  vmName,
+			Outputs:  outputs,
+			Attempts: 1,
+		},
+	}
+	job.run.ID = job.ID
+	for _, name := range jobStages(outputs["push_target"] != "") {
+		job.Stages = append(job.Stages, StageProgress{Name: name, Status: StageStatusPending})
+	}
+
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if j.VM == vmName && (j.Status == JobStatusPending || j.Status == JobStatusRunning) {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("vm %s already has clone job %s: %w", vmName, j.ID, store.ErrConflict)
+		}
+	}
+	s.jobs[job.ID] = job
+	run := job.record()
+	s.mu.Unlock()
+
+	if err := s.store.CreateWorkflowRun(ctx, run); err != nil {
+		s.mu.Lock()
+		delete(s.jobs, job.ID)
+		s.mu.Unlock()
+		return nil, fmt.Errorf("persist clone run: %w", err)
+	}
+
+	s.beginStage(job, workflow.StageResolveDomain)
+	info, err := s.domains.LookupDomain(ctx, vmName)
+	if err != nil {
+		werr := resolveError(err)
+		s.failStage(job, workflow.StageResolveDomain, werr)
+		s.finish(ctx, job, nil, werr)
+		return nil, werr
+	}
+	s.endStage(job, workflow.StageResolveDomain, fmt.Sprintf("state %s", info.State))
+	s.publish(ctx, events.TypeCloneJobCreated, job, nil)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		jctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.Timeout)
+		defer cancel()
+		result, err := s.run(jctx, job, "")
+		s.finish(jctx, job, result, err)
+	}()
+	return s.snapshot(job), nil
+}
+
+// validatePush checks that target names an image in a registry jobs may
+// push to.
+func (s *Service) validatePush(target PushTarget) error {
+	ref, err := oci.ParseReference(target.Reference)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(s.cfg.PushRegistries) == 0:
+		return fmt.Errorf("pushing is disabled: no push registries are configured")
+	case !slices.Contains(s.cfg.PushRegistries, "*") && !slices.Contains(s.cfg.PushRegistries, ref.Registry):
+		return fmt.Errorf("registry %s is not in the allowed push registries", ref.Registry)
+	}
+	if target.MountFrom != "" {
+		if _, err := oci.ParseReference(ref.Registry + "/" + target.MountFrom); err != nil {
+			return fmt.Errorf("mount_from: %w", err)
+		}
+	}
+	return nil
+}
+
+// Passes returns the sanitize passes jobs can select.
+func (s *Service) Passes() []extract.SanitizePass {
+	return s.sanitizer.Passes()
+}
+
+// NBDAttachments lists the NBD devices on the host that are connected or
+// locked, including those left behind by processes that died.
+func (s *Service) NBDAttachments() ([]extract.NBDAttachment, error) {
+	return s.mounts.Attachments()
+}
+
+// Wait blocks until all background jobs have finished.
+func (s *Service) Wait() {
+	s.wg.Wait()
+}
+
+// Get returns a job by ID, or store.ErrNotFound. Jobs not started by this
+// process are read from the store.
+func (s *Service) Get(ctx context.Context, id string) (*Job, error) {
+	s.mu.RLock()
+	job, ok := s.jobs[id]
+	if ok {
+		defer s.mu.RUnlock()
+		return job.clone(), nil
+	}
+	s.mu.RUnlock()
+	run, err := s.store.GetWorkflowRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if run.Kind != runKind {
+		return nil, store.ErrNotFound
+	}
+	return jobFromRun(run), nil
+}
+
+// List returns all jobs, newest first, optionally restricted to one VM.
+func (s *Service) List(ctx context.Context, vmName string) ([]*Job, error) {
+	filter := store.WorkflowRunFilter{Kind: ptr(runKind)}
+	if vmName != "" {
+		filter.Subject = &vmName
+	}
+	runs, err := s.store.ListWorkflowRuns(ctx, filter, nil)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Job, len(runs))
+	for _, run := range runs {
+		byID[run.ID] = jobFromRun(run)
+	}
+	// Live jobs are more current than their last persisted state.
+	s.mu.RLock()
+	for _, j := range s.jobs {
+		if vmName == "" || j.VM == vmName {
+			byID[j.ID] = j.clone()
+		}
+	}
+	s.mu.RUnlock()
+
+	out := make([]*Job, 0, len(byID))
+	for _, j := range byID {
+		out = append(out, j)
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].CreatedAt.After(out[k].CreatedAt) })
+	return out, nil
+}
+
+// run executes the stages after resolve_domain. Scratch resources are always
+// released; produced artifacts are rolled back only on failure. A non-empty
+// archive resumes an interrupted job from build_image with that archive.
+func (s *Service) run(ctx context.Context, job *Job, archive string) (result *model.CloneResult, err error) {
+	s.mu.Lock()
+	job.Status = JobStatusRunning
+	s.mu.Unlock()
+	s.persist(job)
+
+	scratch, rollback := s.pendingCleanups(job)
+	defer func() {
+		if err != nil {
+			if rerr := rollback.ExecuteAll(); rerr != nil {
+				s.logger.Error("clone rollback failed", "job_id", job.ID, "error", rerr)
+			}
+			if cerr := scratch.ExecuteAll(); cerr != nil {
+				s.logger.Error("clone cleanup failed", "job_id", job.ID, "error", cerr)
+			}
+		}
+	}()
+
+	if archive == "" {
+		if archive, err = s.extract(ctx, job, scratch); err != nil {
+			return nil, err
+		}
+		if job.DryRun {
+			s.cleanupStage(job, scratch)
+			return nil, nil
+		}
+	} else if rerr := rollback.ExecuteAll(); rerr != nil {
+		// Drop whatever the interrupted attempt built past the archive.
+		return nil, s.stageError(job, workflow.StageBuildImage, rerr)
+	}
+	return s.containerize(ctx, job, archive, scratch, rollback)
+}
+
+// extract runs create_snapshot through create_archive and returns the path
+// of the rootfs archive, the checkpoint an interrupted job resumes from.
+func (s *Service) extract(ctx context.Context, job *Job, scratch *workflow.CleanupStack) (string, error) {
+	workDir := filepath.Join(s.cfg.WorkDir, job.ID)
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return "", s.stageError(job, workflow.StageCreateSnapshot, err)
+	}
+	s.track(job, scratch, store.WorkflowCleanup{Action: actionRemovePath, Params: map[string]string{"path": workDir}})
+
+	s.beginStage(job, workflow.StageCreateSnapshot)
+	plan, err := s.snapshots.PrepareExtraction(ctx, job.VM)
+	if err != nil {
+		return "", s.stageError(job, workflow.StageCreateSnapshot, err)
+	}
+	detail := "offline: reading the disk directly"
+	if plan.Mode == model.ModeSnapshot {
+		s.track(job, scratch, store.WorkflowCleanup{Action: actionCommitSnapshot, Params: map[string]string{"vm": job.VM, "snapshot": plan.SnapshotName}})
+		detail = fmt.Sprintf("snapshot %s", plan.SnapshotName)
+	}
+	s.setOutput(job, "mode", plan.Mode)
+	s.endStage(job, workflow.StageCreateSnapshot, detail)
+
+	s.beginStage(job, workflow.StageMountDisk)
+	mnt, err := s.mounts.MountDisk(ctx, plan.DiskPath, workDir)
+	if err != nil {
+		return "", s.stageError(job, workflow.StageMountDisk, err)
+	}
+	s.track(job, scratch, store.WorkflowCleanup{Action: actionUnmount, Params: map[string]string{"mount_point": mnt.MountPoint, "nbd_device": mnt.NBDDevice}})
+	s.endStage(job, workflow.StageMountDisk, mountDetail(mnt))
+
+	s.beginStage(job, workflow.StageSanitizeFS)
+	var opts extract.SanitizeOptions
+	if err := json.Unmarshal([]byte(s.output(job, "sanitize_options")), &opts); err != nil {
+		return "", s.stageError(job, workflow.StageSanitizeFS, err)
+	}
+	incremental := s.output(job, "incremental") == "true"
+	if incremental {
+		// The sanitized copy is kept, so the next clone only syncs changes.
+		opts.TargetDir = filepath.Join(s.incrementalDir(job.VM), "rootfs")
+		if err := os.MkdirAll(opts.TargetDir, 0o755); err != nil {
+			return "", s.stageError(job, workflow.StageSanitizeFS, err)
+		}
+	}
+	san, err := s.sanitizer.SanitizeFilesystem(ctx, mnt.MountPoint, workDir, opts)
+	if err != nil {
+		return "", s.stageError(job, workflow.StageSanitizeFS, err)
+	}
+	if san.SanitizedPath != "" && !incremental {
+		s.track(job, scratch, store.WorkflowCleanup{Action: actionRemovePath, Params: map[string]string{"path": san.SanitizedPath}})
+	}
+	if report, err := json.Marshal(san.Passes); err == nil {
+		s.setOutput(job, "sanitize_report", string(report))
+	}
+	s.mu.Lock()
+	job.Sanitize = san.Passes
+	s.mu.Unlock()
+	if job.DryRun {
+		s.endStage(job, workflow.StageSanitizeFS, fmt.Sprintf("dry run: %d would be removed, %d modified", len(san.RemovedPaths), len(san.ModifiedPaths)))
+		for _, stage := range []string{workflow.StageCreateArchive, workflow.StageBuildImage, workflow.StageRunContainer} {
+			s.skipStage(job, stage)
+		}
+		return "", nil
+	}
+	s.endStage(job, workflow.StageSanitizeFS, fmt.Sprintf("%d removed, %d modified", len(san.RemovedPaths), len(san.ModifiedPaths)))
+
+	s.beginStage(job, workflow.StageCreateArchive)
+	var arc *extract.ArchiveResult
+	if incremental {
+		arc, detail, err = s.archiveIncremental(ctx, job, san.SanitizedPath, workDir)
+	} else {
+		arc, err = s.archiver.CreateRootFSArchive(ctx, san.SanitizedPath, workDir)
+		if err == nil {
+			detail = fmt.Sprintf("%d bytes", arc.Size)
+		}
+	}
+	if err != nil {
+		return "", s.stageError(job, workflow.StageCreateArchive, err)
+	}
+	s.track(job, scratch, store.WorkflowCleanup{Action: actionRemovePath, Params: map[string]string{"path": arc.ArchivePath}})
+	s.setOutput(job, "archive_path", arc.ArchivePath)
+	s.endStage(job, workflow.StageCreateArchive, detail)
+	return arc.ArchivePath, nil
+}
+
+// mountDetail describes the filesystems mount_disk mounted, e.g.
+// "/dev/vg0/root, /boot on /dev/nbd0p1; skipped /data".
+func mountDetail(mnt *extract.MountResult) string {
+	parts := []string{mnt.Partition}
+	for _, fs := range mnt.Mounts {
+		parts = append(parts, fmt.Sprintf("%s on %s", fs.Path, fs.Device))
+	}
+	detail := strings.Join(parts, ", ")
+	if len(mnt.Skipped) > 0 {
+		detail += "; skipped " + strings.Join(mnt.Skipped, ", ")
+	}
+	return detail
+}
+
+// containerize runs build_image, push_image (when requested), run_container
+// and cleanup.
+func (s *Service) containerize(ctx context.Context, job *Job, archive string, scratch, rollback *workflow.CleanupStack) (*model.CloneResult, error) {
+	workDir := filepath.Join(s.cfg.WorkDir, job.ID)
+
+	s.beginStage(job, workflow.StageBuildImage)
+	buildOpts := []podman.BuildOption{podman.WithLabels(map[string]string{podman.LabelExtractionMode: s.output(job, "mode")})}
+	incremental := s.output(job, "incremental") == "true"
+	if incremental {
+		more, err := s.incrementalBuildOptions(job)
+		if err != nil {
+			return nil, s.stageError(job, workflow.StageBuildImage, fmt.Errorf("incremental state: %w", err))
+		}
+		buildOpts = append(buildOpts, more...)
+	}
+	img, err := s.builder.BuildImage(ctx, archive, job.VM, workDir, buildOpts...)
+	if err != nil {
+		return nil, s.stageError(job, workflow.StageBuildImage, err)
+	}
+	if incremental {
+		if err := s.commitIncremental(job, img); err != nil {
+			// The image is fine; the next clone of the VM is a full one.
+			s.logger.Warn("failed to record incremental clone state", "job_id", job.ID, "vm", job.VM, "error", err)
+		}
+	}
+	s.track(job, rollback, store.WorkflowCleanup{Action: actionRemoveImage, Params: map[string]string{"image": img.ImageTag}, Rollback: true})
+	s.setOutput(job, "image", img.ImageTag)
+	if img.Digest != "" {
+		s.setOutput(job, "image_digest", img.Digest)
+	}
+	s.endStage(job, workflow.StageBuildImage, img.ImageTag)
+
+	if target := s.output(job, "push_target"); target != "" {
+		if err := s.push(ctx, job, img, workDir, target); err != nil {
+			return nil, err
+		}
+	}
+
+	s.beginStage(job, workflow.StageRunContainer)
+	ctr, err := s.runner.RunContainer(ctx, img.ImageTag, job.VM, s.cfg.Limits)
+	if err != nil {
+		return nil, s.stageError(job, workflow.StageRunContainer, err)
+	}
+	s.track(job, rollback, store.WorkflowCleanup{Action: actionRemoveContainer, Params: map[string]string{"container": ctr.ContainerName}, Rollback: true})
+	s.setOutput(job, "container_id", ctr.ContainerID)
+	s.setOutput(job, "container_name", ctr.ContainerName)
+	s.endStage(job, workflow.StageRunContainer, ctr.ContainerName)
+
+	// The container is up: keep the image and container, drop everything else.
+	rollback.Clear()
+	result := &model.CloneResult{
+		VM:           job.VM,
+		ContainerID:  ctr.ContainerID,
+		Image:        img.ImageTag,
+		Digest:       img.Digest,
+		BaseImage:    s.output(job, "base_image"),
+		Pushed:       s.output(job, "pushed_ref"),
+		PushedDigest: s.output(job, "pushed_digest"),
+		Mode:         s.output(job, "mode"),
+		Status:       model.StatusReady,
+	}
+	s.cleanupStage(job, scratch)
+	return result, nil
+}
+
+// push runs push_image: it pushes img to the job's target, tagged with the
+// image's own timestamp tag unless the target names one.
+func (s *Service) push(ctx context.Context, job *Job, img *podman.ImageResult, workDir, rawTarget string) error {
+	s.beginStage(job, workflow.StagePushImage)
+	var target PushTarget
+	if err := json.Unmarshal([]byte(rawTarget), &target); err != nil {
+		return s.stageError(job, workflow.StagePushImage, err)
+	}
+	ref, err := oci.ParseReference(target.Reference)
+	if err != nil {
+		return s.stageError(job, workflow.StagePushImage, err)
+	}
+	if ref.Tag == "" {
+		if i := strings.LastIndexByte(img.ImageTag, ':'); i >= 0 {
+			ref.Tag = img.ImageTag[i+1:]
+		}
+	}
+	res, err := s.pusher.PushImage(ctx, img, workDir, ref, oci.PushOptions{MountFrom: target.MountFrom})
+	if err != nil {
+		return s.stageError(job, workflow.StagePushImage, err)
+	}
+	s.setOutput(job, "pushed_ref", res.Reference)
+	s.setOutput(job, "pushed_digest", res.Digest)
+	s.endStage(job, workflow.StagePushImage, fmt.Sprintf("%s@%s: %d uploaded, %d existing, %d mounted",
+		res.Reference, res.Digest, res.Uploaded, res.Existing, res.Mounted))
+	return nil
+}
+
+// cleanupStage releases the scratch resources of a job that succeeded.
+func (s *Service) cleanupStage(job *Job, scratch *workflow.CleanupStack) {
+	s.beginStage(job, workflow.StageCleanup)
+	if cerr := scratch.ExecuteAll(); cerr != nil {
+		// The clone itself succeeded; report the leftover resources on the stage.
+		s.failStage(job, workflow.StageCleanup, workflow.NewWorkflowError(workflow.StageCleanup, workflow.ErrRollbackFailed, cerr.Error()))
+		s.logger.Error("clone cleanup failed", "job_id", job.ID, "error", cerr)
+		return
+	}
+	s.endStage(job, workflow.StageCleanup, "")
+}
+
+// finish records the outcome of job and publishes it.
+func (s *Service) finish(ctx context.Context, job *Job, result *model.CloneResult, err error) {
+	s.mu.Lock()
+	job.UpdatedAt = time.Now().UTC()
+	if err != nil {
+		job.Status = JobStatusFailed
+		var werr *workflow.WorkflowError
+		if errors.As(err, &werr) {
+			resp := werr.ToErrorResponse()
+			job.Error = &resp
+			job.Stage = werr.Stage
+		} else {
+			job.Error = &workflow.ErrorResponse{Error: err.Error()}
+		}
+	} else {
+		job.Status = JobStatusSucceeded
+		job.Result = result
+		job.Stage = ""
+	}
+	s.mu.Unlock()
+	s.persist(job)
+
+	if err != nil {
+		s.logger.Error("clone job failed", "job_id", job.ID, "vm", job.VM, "error", err)
+		s.publish(ctx, events.TypeCloneJobFailed, job, map[string]any{"error": err.Error()})
+		return
+	}
+	if result == nil {
+		s.logger.Info("clone dry run finished", "job_id", job.ID, "vm", job.VM)
+		s.publish(ctx, events.TypeCloneJobFinished, job, map[string]any{"dry_run": true})
+		return
+	}
+	s.logger.Info("clone job finished", "job_id", job.ID, "vm", job.VM, "image", result.Image, "container_id", result.ContainerID)
+	data := map[string]any{
+		"image":        result.Image,
+		"container_id": result.ContainerID,
+		"mode":         result.Mode,
+	}
+	if result.Pushed != "" {
+		data["pushed"] = result.Pushed
+		data["pushed_digest"] = result.PushedDigest
+	}
+	s.publish(ctx, events.TypeCloneJobFinished, job, data)
+}
+
+// stageError marks stage failed and returns err as a *workflow.WorkflowError.
+func (s *Service) stageError(job *Job, stage string, err error) error {
+	var werr *workflow.WorkflowError
+	if !errors.As(err, &werr) {
+		werr = workflow.NewWorkflowError(stage, stageSentinels[stage], err.Error())
+	}
+	s.failStage(job, stage, werr)
+	return werr
+}
+
+// stageSentinels maps each stage to the error reported when a dependency
+// fails without a *workflow.WorkflowError of its own.
+var stageSentinels = map[string]error{
+	workflow.StageCreateSnapshot: workflow.ErrSnapshotFailed,
+	workflow.StageMountDisk:      workflow.ErrMountFailed,
+	workflow.StageSanitizeFS:     workflow.ErrSanitizeFailed,
+	workflow.StageCreateArchive:  workflow.ErrArchiveFailed,
+	workflow.StageBuildImage:     workflow.ErrImageBuildFailed,
+	workflow.StagePushImage:      workflow.ErrPushFailed,
+	workflow.StageRunContainer:   workflow.ErrContainerCreateFailed,
+}
+
+// resolveError maps a domain lookup failure to a resolve_domain workflow error.
+func resolveError(err error) *workflow.WorkflowError {
+	switch {
+	case errors.Is(err, libvirt.ErrDomainNotFound):
+		return workflow.NewWorkflowError(workflow.StageResolveDomain, workflow.ErrDomainNotFound, err.Error())
+	case errors.Is(err, libvirt.ErrDomainTransient):
+		return workflow.NewWorkflowError(workflow.StageResolveDomain, workflow.ErrDomainTransient, err.Error())
+	case errors.Is(err, libvirt.ErrDomainUnsupported):
+		return workflow.NewWorkflowError(workflow.StageResolveDomain, workflow.ErrDomainUnsupported, err.Error())
+	default:
+		return workflow.NewWorkflowError(workflow.StageResolveDomain, err, "")
+	}
+}
+
+func (s *Service) beginStage(job *Job, stage string) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	job.Stage = stage
+	job.UpdatedAt = now
+	if p := stageOf(job, stage); p != nil {
+		p.Status = StageStatusRunning
+		p.StartedAt = &now
+	}
+	s.mu.Unlock()
+	s.persist(job)
+}
+
+func (s *Service) endStage(job *Job, stage, detail string) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	job.UpdatedAt = now
+	if p := stageOf(job, stage); p != nil {
+		p.Status = StageStatusDone
+		p.Detail = detail
+		p.EndedAt = &now
+	}
+	s.mu.Unlock()
+	s.persist(job)
+	s.publish(context.Background(), events.TypeCloneJobStage, job, map[string]any{
+		"stage":  stage,
+		"status": string(StageStatusDone),
+	})
+}
+
+func (s *Service) skipStage(job *Job, stage string) {
+	s.mu.Lock()
+	job.UpdatedAt = time.Now().UTC()
+	if p := stageOf(job, stage); p != nil {
+		p.Status = StageStatusSkipped
+		p.Detail = "dry run"
+	}
+	s.mu.Unlock()
+	s.persist(job)
+}
+
+func (s *Service) failStage(job *Job, stage string, werr *workflow.WorkflowError) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	job.UpdatedAt = now
+	if p := stageOf(job, stage); p != nil {
+		p.Status = StageStatusFailed
+		p.Error = werr.Error()
+		p.EndedAt = &now
+	}
+	s.mu.Unlock()
+	s.persist(job)
+	s.publish(context.Background(), events.TypeCloneJobStage, job, map[string]any{
+		"stage":  stage,
+		"status": string(StageStatusFailed),
+	})
+}
+
+// stageOf returns the progress entry for stage. Callers hold s.mu.
+func stageOf(job *Job, stage string) *StageProgress {
+	for i := range job.Stages {
+		if job.Stages[i].Name == stage {
+			return &job.Stages[i]
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of job taken under the lock.
+func (s *Service) snapshot(job *Job) *Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return job.clone()
+}
+
+// publish emits a job lifecycle event.
+func (s *Service) publish(ctx context.Context, typ events.Type, job *Job, data map[string]any) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["vm"] = job.VM
+	s.events.Publish(ctx, events.Event{
+		Type:  typ,
+		JobID: job.ID,
+		Data:  data,
+	})
+}
+
+func ptr[T any](v T) *T { return &v }
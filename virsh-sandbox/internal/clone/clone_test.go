@@ -0,0 +1,703 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/extract"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/model"
+	"virsh-sandbox/internal/oci"
+	"virsh-sandbox/internal/podman"
+	"virsh-sandbox/internal/store"
+	"virsh-sandbox/internal/workflow"
+)
+
+// fakeStages implements every stage dependency and records cleanups in order.
+type fakeStages struct {
+	dir       string
+	lookupErr error
+	buildErr  error
+	pushErr   error
+
+	mu        sync.Mutex
+	built     int
+	cleaned   []string
+	sanitized extract.SanitizeOptions
+	pushed    []oci.Reference
+	deltas    []*extract.Delta
+
+	// layout, when set, receives a real OCI image for every build, as the
+	// incremental builder would write.
+	layout string
+
+	// gate, when set, holds every cleanup until it is closed.
+	gate chan struct{}
+}
+
+func (f *fakeStages) cleanup(name string) {
+	if f.gate != nil {
+		<-f.gate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cleaned = append(f.cleaned, name)
+}
+
+func (f *fakeStages) LookupDomain(_ context.Context, name string) (*libvirt.DomainInfo, error) {
+	if f.lookupErr != nil {
+		return nil, f.lookupErr
+	}
+	return &libvirt.DomainInfo{Name: name, State: libvirt.DomainStateRunning, Persistent: true}, nil
+}
+
+func (f *fakeStages) PrepareExtraction(_ context.Context, vmName string) (*extract.ExtractionPlan, error) {
+	return &extract.ExtractionPlan{VMName: vmName, Mode: model.ModeSnapshot, SnapshotName: "s1", DiskPath: "/disk.qcow2"}, nil
+}
+
+func (f *fakeStages) CommitSnapshot(context.Context, string) error {
+	f.cleanup("snapshot")
+	return nil
+}
+
+func (f *fakeStages) MountDisk(context.Context, string, string) (*extract.MountResult, error) {
+	return &extract.MountResult{MountPoint: "/mnt", NBDDevice: "/dev/nbd0", Partition: "/dev/nbd0p1"}, nil
+}
+
+func (f *fakeStages) Unmount(context.Context, string, string) error {
+	f.cleanup("mount")
+	return nil
+}
+
+func (f *fakeStages) Attachments() ([]extract.NBDAttachment, error) {
+	return nil, nil
+}
+
+func (f *fakeStages) Sweep(context.Context) ([]extract.NBDAttachment, error) {
+	return nil, nil
+}
+
+func (f *fakeStages) SanitizeFilesystem(_ context.Context, _, _ string, opts extract.SanitizeOptions) (*extract.SanitizeResult, error) {
+	f.mu.Lock()
+	f.sanitized = opts
+	f.mu.Unlock()
+	report := []extract.PassReport{{Name: "drop-paths", Removed: opts.Rules.DropPaths}}
+	if opts.DryRun {
+		return &extract.SanitizeResult{Passes: report}, nil
+	}
+	if opts.TargetDir != "" {
+		return &extract.SanitizeResult{SanitizedPath: opts.TargetDir, Passes: report}, nil
+	}
+	return &extract.SanitizeResult{SanitizedPath: filepath.Join(f.dir, "sanitized"), Passes: report}, nil
+}
+
+func (f *fakeStages) Validate(opts extract.SanitizeOptions) error {
+	return extract.NewSanitizer(extract.SanitizerConfig{}).Validate(opts)
+}
+
+func (f *fakeStages) Passes() []extract.SanitizePass {
+	return extract.NewSanitizer(extract.SanitizerConfig{}).Passes()
+}
+
+func (f *fakeStages) CreateRootFSArchive(context.Context, string, string) (*extract.ArchiveResult, error) {
+	return &extract.ArchiveResult{ArchivePath: filepath.Join(f.dir, "rootfs.tar")}, nil
+}
+
+func (f *fakeStages) CreateDeltaArchive(_ context.Context, _, _ string, delta *extract.Delta) (*extract.ArchiveResult, error) {
+	f.mu.Lock()
+	f.deltas = append(f.deltas, delta)
+	f.mu.Unlock()
+	return &extract.ArchiveResult{ArchivePath: filepath.Join(f.dir, "delta.tar")}, nil
+}
+
+func (f *fakeStages) BuildImage(context.Context, string, string, string, ...podman.BuildOption) (*podman.ImageResult, error) {
+	if f.buildErr != nil {
+		return nil, f.buildErr
+	}
+	f.mu.Lock()
+	f.built++
+	n := f.built
+	f.mu.Unlock()
+	if f.layout == "" {
+		return &podman.ImageResult{ImageID: "sha256:1", ImageTag: "vmclone/vm1:t"}, nil
+	}
+	ref := fmt.Sprintf("t%d", n)
+	img, err := oci.NewWriter(oci.WriterConfig{}).WriteImage(context.Background(), f.layout, strings.NewReader(ref), oci.ImageSpec{Ref: ref})
+	if err != nil {
+		return nil, err
+	}
+	return &podman.ImageResult{ImageID: "sha256:1", ImageTag: "vmclone/vm1:" + ref, LayoutPath: f.layout, LayoutRef: ref, Layers: img.Layers}, nil
+}
+
+func (f *fakeStages) RemoveImage(context.Context, string) error {
+	f.cleanup("image")
+	return nil
+}
+
+func (f *fakeStages) PushImage(_ context.Context, _ *podman.ImageResult, _ string, target oci.Reference, _ oci.PushOptions) (*oci.PushResult, error) {
+	if f.pushErr != nil {
+		return nil, f.pushErr
+	}
+	f.mu.Lock()
+	f.pushed = append(f.pushed, target)
+	f.mu.Unlock()
+	return &oci.PushResult{Reference: target.String(), Digest: "sha256:abc", Uploaded: 2}, nil
+}
+
+func (f *fakeStages) RunContainer(context.Context, string, string, podman.ResourceLimits) (*podman.ContainerResult, error) {
+	return &podman.ContainerResult{ContainerID: "c0ffee", ContainerName: "vmclone-vm1"}, nil
+}
+
+func (f *fakeStages) RemoveContainer(context.Context, string, bool) error {
+	f.cleanup("container")
+	return nil
+}
+
+// memStore keeps workflow runs in memory, round-tripped through JSON like a database.
+type memStore struct {
+	mu   sync.Mutex
+	runs map[string][]byte
+}
+
+func newMemStore() *memStore { return &memStore{runs: map[string][]byte{}} }
+
+func (m *memStore) put(run *store.WorkflowRun) {
+	b, _ := json.Marshal(run)
+	m.runs[run.ID] = b
+}
+
+func (m *memStore) get(id string) (*store.WorkflowRun, error) {
+	b, ok := m.runs[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	var run store.WorkflowRun
+	if err := json.Unmarshal(b, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (m *memStore) CreateWorkflowRun(_ context.Context, run *store.WorkflowRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.runs[run.ID]; ok {
+		return store.ErrAlreadyExists
+	}
+	m.put(run)
+	return nil
+}
+
+func (m *memStore) GetWorkflowRun(_ context.Context, id string) (*store.WorkflowRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(id)
+}
+
+func (m *memStore) ListWorkflowRuns(_ context.Context, filter store.WorkflowRunFilter, _ *store.ListOptions) ([]*store.WorkflowRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*store.WorkflowRun
+	for id := range m.runs {
+		run, err := m.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if (filter.Kind == nil || run.Kind == *filter.Kind) &&
+			(filter.Subject == nil || run.Subject == *filter.Subject) &&
+			(filter.Status == nil || run.Status == *filter.Status) {
+			out = append(out, run)
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) UpdateWorkflowRun(_ context.Context, run *store.WorkflowRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.runs[run.ID]; !ok {
+		return store.ErrNotFound
+	}
+	m.put(run)
+	return nil
+}
+
+func newTestService(t *testing.T, f *fakeStages, st *memStore, cfg Config) *Service {
+	t.Helper()
+	if f.dir == "" {
+		f.dir = t.TempDir()
+	}
+	cfg.WorkDir = f.dir
+	s := NewService(nil, st, cfg, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))), WithEventPublisher(events.Discard))
+	s.domains, s.snapshots, s.mounts, s.sanitizer, s.archiver, s.builder, s.pusher, s.runner = f, f, f, f, f, f, f, f
+	return s
+}
+
+func TestCloneJobSucceeds(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{})
+	job, err := s.Start(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.Wait()
+
+	got, err := s.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Status != JobStatusSucceeded || got.Result == nil {
+		t.Fatalf("job = %+v, want succeeded with a result", got)
+	}
+	if got.Result.ContainerID != "c0ffee" || got.Result.Image != "vmclone/vm1:t" || got.Result.Mode != model.ModeSnapshot || got.Result.Status != model.StatusReady {
+		t.Errorf("result = %+v", got.Result)
+	}
+	for _, st := range got.Stages {
+		if st.Status != StageStatusDone {
+			t.Errorf("stage %s is %s, want done", st.Name, st.Status)
+		}
+	}
+	want := []string{"mount", "snapshot"}
+	if len(f.cleaned) != len(want) || f.cleaned[0] != want[0] || f.cleaned[1] != want[1] {
+		t.Fatalf("cleaned = %v, want %v", f.cleaned, want)
+	}
+
+	run, err := st.GetWorkflowRun(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("GetWorkflowRun: %v", err)
+	}
+	if run.Status != store.WorkflowRunSucceeded || run.Outputs["container_id"] != "c0ffee" {
+		t.Errorf("persisted run = %+v", run)
+	}
+	for _, c := range run.Cleanups {
+		if c.Done == c.Rollback {
+			t.Errorf("cleanup %s: done=%v rollback=%v, want scratch done and artifacts kept", c.Action, c.Done, c.Rollback)
+		}
+	}
+}
+
+func TestCloneJobRollsBackOnFailure(t *testing.T) {
+	f := &fakeStages{buildErr: errors.New("podman exploded")}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{})
+	job, err := s.Start(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.Wait()
+
+	got, _ := s.Get(context.Background(), job.ID)
+	if got.Status != JobStatusFailed || got.Stage != workflow.StageBuildImage {
+		t.Fatalf("job status %s at %s, want failed at %s", got.Status, got.Stage, workflow.StageBuildImage)
+	}
+	if got.Error == nil || got.Error.Error != workflow.ErrImageBuildFailed.Error() || got.Error.Detail != "podman exploded" {
+		t.Errorf("error = %+v", got.Error)
+	}
+	if len(f.cleaned) != 2 {
+		t.Errorf("cleaned = %v, want every scratch resource released", f.cleaned)
+	}
+	run, _ := st.GetWorkflowRun(context.Background(), job.ID)
+	if run.Status != store.WorkflowRunFailed || run.Stage != workflow.StageBuildImage {
+		t.Errorf("persisted run status %s at %s", run.Status, run.Stage)
+	}
+}
+
+func TestCloneStartRejectsUnknownDomain(t *testing.T) {
+	f := &fakeStages{lookupErr: libvirt.ErrDomainNotFound}
+	s := newTestService(t, f, newMemStore(), Config{})
+	_, err := s.Start(context.Background(), "missing")
+	var werr *workflow.WorkflowError
+	if !errors.As(err, &werr) || !errors.Is(err, workflow.ErrDomainNotFound) {
+		t.Fatalf("err = %v, want workflow ErrDomainNotFound", err)
+	}
+	if werr.Stage != workflow.StageResolveDomain {
+		t.Errorf("stage = %s, want %s", werr.Stage, workflow.StageResolveDomain)
+	}
+	if _, err := s.Start(context.Background(), ""); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("empty name: err = %v, want ErrInvalid", err)
+	}
+}
+
+func TestCloneDryRunReportsWithoutBuilding(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{})
+	rules := extract.SanitizeRules{DropPaths: []string{"/etc/ssh/ssh_host_*"}}
+	job, err := s.Start(context.Background(), "vm1", WithPasses("drop-paths"), WithRules(rules), WithDryRun())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.Wait()
+
+	if !f.sanitized.DryRun || len(f.sanitized.Passes) != 1 || f.sanitized.VMName != "vm1" {
+		t.Errorf("sanitize options = %+v", f.sanitized)
+	}
+	got, err := s.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Status != JobStatusSucceeded || got.Result != nil || !got.DryRun {
+		t.Fatalf("job = %+v, want a succeeded dry run without a result", got)
+	}
+	if len(got.Sanitize) != 1 || got.Sanitize[0].Removed[0] != rules.DropPaths[0] {
+		t.Errorf("sanitize report = %+v", got.Sanitize)
+	}
+	for _, p := range got.Stages {
+		want := StageStatusDone
+		switch p.Name {
+		case workflow.StageCreateArchive, workflow.StageBuildImage, workflow.StageRunContainer:
+			want = StageStatusSkipped
+		}
+		if p.Status != want {
+			t.Errorf("stage %s is %s, want %s", p.Name, p.Status, want)
+		}
+	}
+	if f.built != 0 || len(f.cleaned) != 2 {
+		t.Errorf("built %d images, cleaned %v; want none built and scratch released", f.built, f.cleaned)
+	}
+
+	run, _ := st.GetWorkflowRun(context.Background(), job.ID)
+	if j := jobFromRun(run); !j.DryRun || j.Result != nil || len(j.Sanitize) != 1 {
+		t.Errorf("persisted job = %+v", j)
+	}
+}
+
+func TestCloneStartRejectsBadSanitizeOptions(t *testing.T) {
+	s := newTestService(t, &fakeStages{}, newMemStore(), Config{})
+	_, err := s.Start(context.Background(), "vm1", WithPasses("remove-boot", "no-such-pass"))
+	if !errors.Is(err, store.ErrInvalid) || !errors.Is(err, extract.ErrUnknownPass) {
+		t.Errorf("unknown pass: err = %v, want ErrInvalid and ErrUnknownPass", err)
+	}
+	_, err = s.Start(context.Background(), "vm1", WithPasses("remove-boot"), WithRules(extract.SanitizeRules{DropPaths: []string{"/tmp/x"}}))
+	if !errors.Is(err, extract.ErrInvalidRules) {
+		t.Errorf("rules without their pass: err = %v, want ErrInvalidRules", err)
+	}
+	_, err = s.Start(context.Background(), "vm1", WithRules(extract.SanitizeRules{DropPaths: []string{"relative"}}))
+	if !errors.Is(err, extract.ErrInvalidRules) {
+		t.Errorf("relative drop path: err = %v, want ErrInvalidRules", err)
+	}
+}
+
+func TestClonePushesImage(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{PushRegistries: []string{"registry.example.com"}})
+
+	_, err := s.Start(context.Background(), "vm1", WithPush(PushTarget{Reference: "other.example.com/team/vm1"}))
+	if !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("registry not allowed: err = %v, want ErrInvalid", err)
+	}
+	_, err = s.Start(context.Background(), "vm1", WithPush(PushTarget{Reference: "team/vm1"}))
+	if !errors.Is(err, oci.ErrInvalidReference) {
+		t.Fatalf("no registry host: err = %v, want ErrInvalidReference", err)
+	}
+
+	for _, registries := range [][]string{nil, {}} {
+		closed := newTestService(t, f, st, Config{PushRegistries: registries})
+		if _, err := closed.Start(context.Background(), "vm1", WithPush(PushTarget{Reference: "registry.example.com/team/vm1"})); !errors.Is(err, store.ErrInvalid) {
+			t.Fatalf("no push registries %v: err = %v, want ErrInvalid", registries, err)
+		}
+	}
+	if err := newTestService(t, f, st, Config{PushRegistries: []string{"*"}}).validatePush(PushTarget{Reference: "other.example.com/team/vm1"}); err != nil {
+		t.Errorf("wildcard registry: %v", err)
+	}
+
+	job, err := s.Start(context.Background(), "vm1", WithPush(PushTarget{Reference: "registry.example.com/team/vm1"}))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.Wait()
+	got, err := s.Get(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Status != JobStatusSucceeded || got.Result == nil {
+		t.Fatalf("job = %+v, want succeeded with a result", got)
+	}
+	if got.Result.Pushed != "registry.example.com/team/vm1:t" || got.Result.PushedDigest != "sha256:abc" {
+		t.Errorf("result = %+v, want pushed with the image tag", got.Result)
+	}
+	var names []string
+	for _, p := range got.Stages {
+		names = append(names, p.Name)
+		if p.Status != StageStatusDone {
+			t.Errorf("stage %s is %s, want done", p.Name, p.Status)
+		}
+	}
+	if len(names) != len(stages)+1 || names[6] != workflow.StagePushImage {
+		t.Errorf("stages = %v, want push_image after build_image", names)
+	}
+
+	// A failed push rolls back the image and never runs the container.
+	f.pushErr = errors.New("registry down")
+	job, err = s.Start(context.Background(), "vm1", WithPush(PushTarget{Reference: "registry.example.com/team/vm1:v2"}))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.Wait()
+	got, _ = s.Get(context.Background(), job.ID)
+	if got.Status != JobStatusFailed || got.Stage != workflow.StagePushImage || got.Error == nil || got.Error.Error != workflow.ErrPushFailed.Error() {
+		t.Fatalf("job = %+v, want failed at push_image", got)
+	}
+	if f.cleaned[len(f.cleaned)-3] != "image" {
+		t.Errorf("cleaned = %v, want the image rolled back", f.cleaned)
+	}
+}
+
+func TestCloneIncrementalLayersOnPreviousImage(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{Incremental: true})
+	f.layout = filepath.Join(s.incrementalDir("vm1"), "layout")
+	rootfs := filepath.Join(s.incrementalDir("vm1"), "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	motd := filepath.Join(rootfs, "etc", "motd")
+
+	clone := func(opts ...StartOption) *Job {
+		t.Helper()
+		job, err := s.Start(context.Background(), "vm1", opts...)
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		s.Wait()
+		got, err := s.Get(context.Background(), job.ID)
+		if err != nil || got.Status != JobStatusSucceeded {
+			t.Fatalf("job = %+v, %v; want succeeded", got, err)
+		}
+		return got
+	}
+
+	if err := os.WriteFile(motd, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first := clone()
+	if first.Result.BaseImage != "" || len(f.deltas) != 0 {
+		t.Fatalf("first clone: base %q, %d deltas; want a full archive", first.Result.BaseImage, len(f.deltas))
+	}
+
+	if err := os.WriteFile(motd, []byte("v2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	second := clone()
+	if second.Result.BaseImage != first.Result.Image {
+		t.Errorf("second clone: base = %q, want %q", second.Result.BaseImage, first.Result.Image)
+	}
+	if len(f.deltas) != 1 || len(f.deltas[0].Changed) != 1 || f.deltas[0].Changed[0] != "/etc/motd" {
+		t.Fatalf("deltas = %+v, want /etc/motd changed", f.deltas)
+	}
+
+	third := clone(WithFullExtraction())
+	if third.Result.BaseImage != "" || len(f.deltas) != 1 {
+		t.Errorf("full clone: base %q, %d deltas; want a full archive", third.Result.BaseImage, len(f.deltas))
+	}
+	if state := s.loadIncremental("vm1"); state == nil || state.Image != third.Result.Image {
+		t.Errorf("state = %+v, want the full clone's image", state)
+	}
+}
+
+// interruptedRun returns a RUNNING run as a dead process would have left it
+// at stage, with the given stages completed.
+func interruptedRun(stage string, done []string, cleanups []store.WorkflowCleanup, outputs map[string]string) *store.WorkflowRun {
+	run := &store.WorkflowRun{
+		ID:       "CLN-dead",
+		Kind:     runKind,
+		Subject:  "vm1",
+		Status:   store.WorkflowRunRunning,
+		Stage:    stage,
+		Outputs:  outputs,
+		Cleanups: cleanups,
+		Attempts: 1,
+	}
+	for _, name := range stages {
+		st := store.WorkflowStage{Name: name, Status: string(StageStatusPending)}
+		for _, d := range done {
+			if d == name {
+				st.Status = string(StageStatusDone)
+			}
+		}
+		if name == stage {
+			st.Status = string(StageStatusRunning)
+		}
+		run.Stages = append(run.Stages, st)
+	}
+	return run
+}
+
+func TestRecoverReplaysCleanupsOfInterruptedRun(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{ResumeInterrupted: true})
+	scratch := filepath.Join(f.dir, "CLN-dead")
+	if err := os.MkdirAll(scratch, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	st.put(interruptedRun(workflow.StageSanitizeFS,
+		[]string{workflow.StageResolveDomain, workflow.StageCreateSnapshot, workflow.StageMountDisk},
+		[]store.WorkflowCleanup{
+			{Action: actionRemovePath, Params: map[string]string{"path": scratch}},
+			{Action: actionCommitSnapshot, Params: map[string]string{"vm": "vm1"}},
+			{Action: actionUnmount, Params: map[string]string{"mount_point": "/mnt", "nbd_device": "/dev/nbd0"}},
+		}, nil))
+
+	if err := s.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	s.Wait()
+
+	if len(f.cleaned) != 2 || f.cleaned[0] != "mount" || f.cleaned[1] != "snapshot" {
+		t.Errorf("cleaned = %v, want [mount snapshot]", f.cleaned)
+	}
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Errorf("scratch dir still present: %v", err)
+	}
+	run, _ := st.GetWorkflowRun(context.Background(), "CLN-dead")
+	if run.Status != store.WorkflowRunFailed || run.Error == nil || *run.Error != workflow.ErrInterrupted.Error() {
+		t.Errorf("run = %+v, want failed with %q", run, workflow.ErrInterrupted)
+	}
+	for _, c := range run.Cleanups {
+		if !c.Done {
+			t.Errorf("cleanup %s not done", c.Action)
+		}
+	}
+}
+
+func TestRecoverResumesFromArchive(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{ResumeInterrupted: true})
+	archive := filepath.Join(f.dir, "rootfs.tar")
+	if err := os.WriteFile(archive, []byte("tar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	st.put(interruptedRun(workflow.StageBuildImage,
+		[]string{workflow.StageResolveDomain, workflow.StageCreateSnapshot, workflow.StageMountDisk, workflow.StageSanitizeFS, workflow.StageCreateArchive},
+		[]store.WorkflowCleanup{
+			{Action: actionCommitSnapshot, Params: map[string]string{"vm": "vm1"}},
+			{Action: actionRemovePath, Params: map[string]string{"path": archive}},
+			{Action: actionRemoveImage, Params: map[string]string{"image": "vmclone/vm1:old"}, Rollback: true},
+		}, map[string]string{"mode": model.ModeSnapshot, "archive_path": archive}))
+
+	if err := s.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	s.Wait()
+
+	job, err := s.Get(context.Background(), "CLN-dead")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if job.Status != JobStatusSucceeded || job.Result == nil || job.Result.ContainerID != "c0ffee" {
+		t.Fatalf("job = %+v, want resumed to success", job)
+	}
+	if f.built != 1 {
+		t.Errorf("built %d images, want 1", f.built)
+	}
+	if len(f.cleaned) != 2 || f.cleaned[0] != "image" || f.cleaned[1] != "snapshot" {
+		t.Errorf("cleaned = %v, want the stale image dropped, then the snapshot committed", f.cleaned)
+	}
+	run, _ := st.GetWorkflowRun(context.Background(), "CLN-dead")
+	if run.Attempts != 2 {
+		t.Errorf("attempts = %d, want 2", run.Attempts)
+	}
+}
+
+func TestRollbackRemovesArtifactsOfFinishedRun(t *testing.T) {
+	f := &fakeStages{}
+	st := newMemStore()
+	s := newTestService(t, f, st, Config{})
+	job, err := s.Start(context.Background(), "vm1")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.Wait()
+	f.cleaned = nil
+
+	run, err := s.Rollback(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if run.Status != store.WorkflowRunRolledBack {
+		t.Errorf("status = %s, want %s", run.Status, store.WorkflowRunRolledBack)
+	}
+	if len(f.cleaned) != 2 || f.cleaned[0] != "container" || f.cleaned[1] != "image" {
+		t.Errorf("cleaned = %v, want [container image]", f.cleaned)
+	}
+	if _, err := s.Rollback(context.Background(), "CLN-missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("missing run: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRollbackConcurrent(t *testing.T) {
+	for _, held := range []bool{true, false} {
+		name := "persisted run"
+		if held {
+			name = "job in memory"
+		}
+		t.Run(name, func(t *testing.T) {
+			f := &fakeStages{}
+			st := newMemStore()
+			s := newTestService(t, f, st, Config{})
+			job, err := s.Start(context.Background(), "vm1")
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			s.Wait()
+			if !held {
+				// A fresh service only knows the run from the store.
+				s = newTestService(t, f, st, Config{})
+			}
+			f.cleaned = nil
+			f.gate = make(chan struct{})
+
+			// The winner blocks in its cleanups until the gate opens, so every
+			// other caller must be turned away while it holds the claim.
+			const n = 32
+			errs := make(chan error, n)
+			start := make(chan struct{})
+			for i := 0; i < n; i++ {
+				go func() {
+					<-start
+					_, err := s.Rollback(context.Background(), job.ID)
+					errs <- err
+				}()
+			}
+			close(start)
+			for i := 0; i < n-1; i++ {
+				select {
+				case err := <-errs:
+					if !errors.Is(err, store.ErrConflict) {
+						t.Errorf("concurrent rollback: err = %v, want ErrConflict", err)
+					}
+				case <-time.After(5 * time.Second):
+					close(f.gate)
+					t.Fatalf("only %d of %d concurrent rollbacks were refused", i, n-1)
+				}
+			}
+			close(f.gate)
+			if err := <-errs; err != nil {
+				t.Fatalf("winning rollback: %v", err)
+			}
+			if len(f.cleaned) != 2 {
+				t.Errorf("cleaned = %v, want each artifact removed once", f.cleaned)
+			}
+			run, _ := st.GetWorkflowRun(context.Background(), job.ID)
+			if run.Status != store.WorkflowRunRolledBack {
+				t.Errorf("status = %s, want %s", run.Status, store.WorkflowRunRolledBack)
+			}
+		})
+	}
+}
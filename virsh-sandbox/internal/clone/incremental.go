@@ -0,0 +1,145 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"virsh-sandbox/internal/extract"
+	"virsh-sandbox/internal/oci"
+	"virsh-sandbox/internal/podman"
+)
+
+// incrementalState is what an incremental clone leaves for the next clone of
+// the same VM: the content of the root filesystem it archived and the image
+// in the VM's layout that holds that content.
+type incrementalState struct {
+	// Ref names the image in the VM's layout; Image is its podman tag.
+	Ref    string `json:"ref"`
+	Image  string `json:"image"`
+	Layers int    `json:"layers"`
+
+	Manifest *extract.ContentManifest `json:"manifest"`
+}
+
+// incrementalDir holds the per-VM state of incremental clones: the kept
+// sanitized copy (rootfs), the OCI layout of its images (layout) and
+// state.json.
+func (s *Service) incrementalDir(vm string) string {
+	return filepath.Join(s.cfg.WorkDir, "incremental", vm)
+}
+
+// loadIncremental returns the state the last incremental clone of vm left,
+// or nil when the next clone must be a full one: there is no usable state,
+// its image is gone from the layout, or it already has MaxDeltaLayers layers.
+func (s *Service) loadIncremental(vm string) *incrementalState {
+	dir := s.incrementalDir(vm)
+	b, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil {
+		return nil
+	}
+	var st incrementalState
+	if err := json.Unmarshal(b, &st); err != nil || st.Manifest == nil || st.Ref == "" {
+		s.logger.Warn("ignoring unreadable incremental clone state", "vm", vm, "error", err)
+		return nil
+	}
+	if st.Layers >= s.cfg.MaxDeltaLayers {
+		return nil
+	}
+	idx, err := oci.ReadIndex(filepath.Join(dir, "layout"))
+	if err != nil || !slices.ContainsFunc(idx.Manifests, func(d oci.Descriptor) bool {
+		return d.Annotations[oci.AnnotationRefName] == st.Ref
+	}) {
+		return nil
+	}
+	return &st
+}
+
+// archiveIncremental runs create_archive for an incremental clone: it
+// records the content of root and archives only what changed since the last
+// clone of the VM, or everything when there is nothing to build on. It
+// returns the archive and the stage detail.
+func (s *Service) archiveIncremental(ctx context.Context, job *Job, root, workDir string) (*extract.ArchiveResult, string, error) {
+	var prev *incrementalState
+	if s.output(job, "full") != "true" {
+		prev = s.loadIncremental(job.VM)
+	}
+	var known *extract.ContentManifest
+	if prev != nil {
+		known = prev.Manifest
+	}
+	cur, err := extract.BuildContentManifest(ctx, root, known)
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := json.Marshal(cur)
+	if err != nil {
+		return nil, "", err
+	}
+	manifestPath := filepath.Join(workDir, "content.json")
+	if err := os.WriteFile(manifestPath, b, 0o644); err != nil {
+		return nil, "", err
+	}
+	s.setOutput(job, "content_manifest", manifestPath)
+
+	if prev == nil {
+		arc, err := s.archiver.CreateRootFSArchive(ctx, root, workDir)
+		if err != nil {
+			return nil, "", err
+		}
+		return arc, fmt.Sprintf("full: %d files, %d bytes", len(cur.Entries), arc.Size), nil
+	}
+	delta := prev.Manifest.Diff(cur)
+	arc, err := s.archiver.CreateDeltaArchive(ctx, root, workDir, delta)
+	if err != nil {
+		return nil, "", err
+	}
+	s.setOutput(job, "base_ref", prev.Ref)
+	s.setOutput(job, "base_image", prev.Image)
+	return arc, fmt.Sprintf("delta on %s: %d changed, %d deleted, %d bytes", prev.Image, len(delta.Changed), len(delta.Deleted), arc.Size), nil
+}
+
+// incrementalBuildOptions returns the build options that write an
+// incremental clone's image into the VM's layout, on top of the previous
+// image for a delta. A full image starts the layout over.
+func (s *Service) incrementalBuildOptions(job *Job) ([]podman.BuildOption, error) {
+	dir := s.incrementalDir(job.VM)
+	layout := filepath.Join(dir, "layout")
+	base := s.output(job, "base_ref")
+	if base == "" {
+		if err := os.Remove(filepath.Join(dir, "state.json")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := os.RemoveAll(layout); err != nil {
+			return nil, err
+		}
+		return []podman.BuildOption{podman.WithLayout(layout)}, nil
+	}
+	return []podman.BuildOption{podman.WithLayout(layout), podman.WithBase(base)}, nil
+}
+
+// commitIncremental records img and the content manifest of job as the base
+// of the next clone of the VM. The state file is replaced atomically, so it
+// never pairs a manifest with an image that does not hold it.
+func (s *Service) commitIncremental(job *Job, img *podman.ImageResult) error {
+	b, err := os.ReadFile(s.output(job, "content_manifest"))
+	if err != nil {
+		return err
+	}
+	st := incrementalState{Ref: img.LayoutRef, Image: img.ImageTag, Layers: img.Layers}
+	if err := json.Unmarshal(b, &st.Manifest); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(st); err != nil {
+		return err
+	}
+	dir := s.incrementalDir(job.VM)
+	tmp := filepath.Join(dir, ".state.json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "state.json"))
+}
@@ -0,0 +1,442 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/extract"
+	"virsh-sandbox/internal/model"
+	"virsh-sandbox/internal/store"
+	"virsh-sandbox/internal/workflow"
+)
+
+// runKind identifies clone runs among persisted workflow runs.
+const runKind = "clone"
+
+// maxAttempts bounds how often a run is started: once, plus one resume.
+const maxAttempts = 2
+
+// Cleanup actions recorded on a run. Each is replayable from its params.
+const (
+	actionRemovePath      = "remove_path"      // path
+	actionCommitSnapshot  = "commit_snapshot"  // vm, snapshot
+	actionUnmount         = "unmount"          // mount_point, nbd_device
+	actionRemoveImage     = "remove_image"     // image
+	actionRemoveContainer = "remove_container" // container
+)
+
+// Recover handles clone runs left RUNNING by a previous process. A run whose
+// rootfs archive was written and still exists is resumed from build_image if
+// Config.ResumeInterrupted is set and it has not been resumed before. Every
+// other run has its recorded cleanups replayed, newest first, and fails with
+// workflow.ErrInterrupted. NBD devices left attached by processes that died
+// are swept first. Call it once at startup before accepting requests.
+func (s *Service) Recover(ctx context.Context) error {
+	swept, err := s.mounts.Sweep(ctx)
+	if err != nil {
+		s.logger.Error("sweep stale NBD devices", "error", err)
+	}
+	for _, a := range swept {
+		s.logger.Warn("disconnected NBD device left by a dead process", "device", a.Device, "pid", a.Owner.PID, "disk", a.Owner.Disk)
+	}
+
+	runs, err := s.store.ListWorkflowRuns(ctx, store.WorkflowRunFilter{
+		Kind:   ptr(runKind),
+		Status: ptr(store.WorkflowRunRunning),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("list interrupted clone runs: %w", err)
+	}
+	for _, run := range runs {
+		job := jobFromRun(run)
+		s.mu.Lock()
+		if _, ok := s.jobs[job.ID]; ok {
+			s.mu.Unlock()
+			continue
+		}
+		s.jobs[job.ID] = job
+		s.mu.Unlock()
+
+		if p := stageOf(job, workflow.StageRunContainer); p != nil && (p.Status == StageStatusDone || p.Status == StageStatusSkipped) {
+			// The container was up (or a dry run was reported); only the
+			// scratch cleanup was cut short.
+			s.logger.Info("finishing cleanup of interrupted clone job", "job_id", job.ID, "vm", job.VM)
+			scratch, _ := s.pendingCleanups(job)
+			if cerr := scratch.ExecuteAll(); cerr != nil {
+				s.failStage(job, workflow.StageCleanup, workflow.NewWorkflowError(workflow.StageCleanup, workflow.ErrRollbackFailed, cerr.Error()))
+				s.logger.Error("clone cleanup failed", "job_id", job.ID, "error", cerr)
+			} else {
+				s.endStage(job, workflow.StageCleanup, "")
+			}
+			var result *model.CloneResult
+			if !job.DryRun {
+				result = resultFromRun(job.run)
+			}
+			s.finish(ctx, job, result, nil)
+			continue
+		}
+
+		if archive := s.checkpoint(job); archive != "" {
+			s.logger.Info("resuming interrupted clone job", "job_id", job.ID, "vm", job.VM, "stage", job.Stage)
+			s.mu.Lock()
+			job.run.Attempts++
+			s.mu.Unlock()
+			s.publish(ctx, events.TypeCloneJobResumed, job, map[string]any{"stage": job.Stage})
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				jctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.Timeout)
+				defer cancel()
+				result, err := s.run(jctx, job, archive)
+				s.finish(jctx, job, result, err)
+			}()
+			continue
+		}
+
+		s.logger.Warn("rolling back interrupted clone job", "job_id", job.ID, "vm", job.VM, "stage", job.Stage)
+		werr := workflow.NewWorkflowError(job.Stage, workflow.ErrInterrupted, "the API process exited before the job finished")
+		if job.Stage != "" {
+			s.failStage(job, job.Stage, werr)
+		}
+		if cerr := s.replay(job); cerr != nil {
+			s.logger.Error("clone cleanup failed", "job_id", job.ID, "error", cerr)
+			werr.Detail = cerr.Error()
+		}
+		s.finish(ctx, job, nil, werr)
+	}
+	return nil
+}
+
+// Rollback force-runs every pending cleanup of a run that is not executing
+// in this process, including removal of the image and container a finished
+// run produced, and marks it rolled back. Cleanups that fail stay pending, so
+// the call can be retried. Running jobs return store.ErrConflict.
+func (s *Service) Rollback(ctx context.Context, id string) (*store.WorkflowRun, error) {
+	job, err := s.claimRollback(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.replay(job)
+	s.mu.Lock()
+	job.UpdatedAt = time.Now().UTC()
+	if err != nil {
+		job.Status = JobStatusFailed
+		job.Error = &workflow.ErrorResponse{Error: workflow.ErrRollbackFailed.Error(), Detail: err.Error()}
+	} else {
+		job.Status = JobStatusRolledBack
+		job.Result = nil
+	}
+	run := job.record()
+	s.mu.Unlock()
+	s.persist(job)
+
+	if err != nil {
+		s.logger.Error("clone rollback failed", "job_id", id, "error", err)
+		return run, workflow.NewWorkflowError(workflow.StageCleanup, workflow.ErrRollbackFailed, err.Error())
+	}
+	s.logger.Info("clone job rolled back", "job_id", id, "vm", job.VM)
+	s.publish(ctx, events.TypeCloneJobRolledBack, job, nil)
+	return run, nil
+}
+
+// claimRollback marks job id as running so concurrent rollbacks and Start see
+// it as active, loading it from the store if it is not held in memory. The
+// status check and the claim happen under one lock, so of concurrent callers
+// exactly one gets the job and the others get store.ErrConflict.
+func (s *Service) claimRollback(ctx context.Context, id string) (*Job, error) {
+	s.mu.RLock()
+	_, held := s.jobs[id]
+	s.mu.RUnlock()
+	var loaded *Job
+	if !held {
+		run, err := s.store.GetWorkflowRun(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if run.Kind != runKind {
+			return nil, store.ErrNotFound
+		}
+		loaded = jobFromRun(run)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	switch {
+	case ok && (job.Status == JobStatusPending || job.Status == JobStatusRunning):
+		return nil, fmt.Errorf("clone job %s is %s: %w", id, job.Status, store.ErrConflict)
+	case !ok && loaded == nil:
+		// Dropped by a Start that failed to persist it.
+		return nil, store.ErrNotFound
+	case !ok:
+		// A persisted run is not executing here, whatever status it recorded.
+		job = loaded
+		s.jobs[id] = job
+	}
+	job.Status = JobStatusRunning
+	return job, nil
+}
+
+// GetRun returns the persisted record of a clone run, or the live state of a
+// job running in this process.
+func (s *Service) GetRun(ctx context.Context, id string) (*store.WorkflowRun, error) {
+	s.mu.RLock()
+	job, ok := s.jobs[id]
+	if ok {
+		defer s.mu.RUnlock()
+		return job.record(), nil
+	}
+	s.mu.RUnlock()
+	run, err := s.store.GetWorkflowRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if run.Kind != runKind {
+		return nil, store.ErrNotFound
+	}
+	return run, nil
+}
+
+// ListRuns returns persisted clone runs, newest first.
+func (s *Service) ListRuns(ctx context.Context, filter store.WorkflowRunFilter) ([]*store.WorkflowRun, error) {
+	filter.Kind = ptr(runKind)
+	return s.store.ListWorkflowRuns(ctx, filter, &store.ListOptions{OrderBy: "created_at", Asc: false})
+}
+
+// checkpoint returns the archive an interrupted job can resume from, or "".
+func (s *Service) checkpoint(job *Job) string {
+	if !s.cfg.ResumeInterrupted || job.run.Attempts >= maxAttempts {
+		return ""
+	}
+	if p := stageOf(job, workflow.StageCreateArchive); p == nil || p.Status != StageStatusDone {
+		return ""
+	}
+	archive := job.run.Outputs["archive_path"]
+	if archive == "" {
+		return ""
+	}
+	if _, err := os.Stat(archive); err != nil {
+		return ""
+	}
+	return archive
+}
+
+// track records c on job's run and pushes its replayable form onto stack.
+func (s *Service) track(job *Job, stack *workflow.CleanupStack, c store.WorkflowCleanup) {
+	s.mu.Lock()
+	job.run.Cleanups = append(job.run.Cleanups, c)
+	i := len(job.run.Cleanups) - 1
+	s.mu.Unlock()
+	s.persist(job)
+	stack.Push(s.cleanupAt(job, i))
+}
+
+// pendingCleanups rebuilds the scratch and rollback stacks from the cleanups
+// job recorded and has not yet completed, in registration order.
+func (s *Service) pendingCleanups(job *Job) (scratch, rollback *workflow.CleanupStack) {
+	scratch = workflow.NewCleanupStack()
+	rollback = workflow.NewCleanupStack()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, c := range job.run.Cleanups {
+		switch {
+		case c.Done:
+		case c.Rollback:
+			rollback.Push(s.cleanupAt(job, i))
+		default:
+			scratch.Push(s.cleanupAt(job, i))
+		}
+	}
+	return scratch, rollback
+}
+
+// replay runs every pending cleanup of job, newest first.
+func (s *Service) replay(job *Job) error {
+	all := workflow.NewCleanupStack()
+	s.mu.RLock()
+	for i, c := range job.run.Cleanups {
+		if !c.Done {
+			all.Push(s.cleanupAt(job, i))
+		}
+	}
+	s.mu.RUnlock()
+	return all.ExecuteAll()
+}
+
+// cleanupAt returns a CleanupFunc that runs job's i-th recorded cleanup once
+// and persists the outcome.
+func (s *Service) cleanupAt(job *Job, i int) workflow.CleanupFunc {
+	return func() error {
+		s.mu.RLock()
+		c := job.run.Cleanups[i]
+		s.mu.RUnlock()
+		if c.Done {
+			return nil
+		}
+		err := s.execCleanup(context.Background(), c)
+		s.mu.Lock()
+		if err != nil {
+			job.run.Cleanups[i].Error = err.Error()
+		} else {
+			job.run.Cleanups[i].Done = true
+			job.run.Cleanups[i].Error = ""
+		}
+		s.mu.Unlock()
+		s.persist(job)
+		return err
+	}
+}
+
+// execCleanup performs a recorded cleanup action.
+func (s *Service) execCleanup(ctx context.Context, c store.WorkflowCleanup) error {
+	switch c.Action {
+	case actionRemovePath:
+		return os.RemoveAll(c.Params["path"])
+	case actionCommitSnapshot:
+		return s.snapshots.CommitSnapshot(ctx, c.Params["vm"])
+	case actionUnmount:
+		return s.mounts.Unmount(ctx, c.Params["mount_point"], c.Params["nbd_device"])
+	case actionRemoveImage:
+		return s.builder.RemoveImage(ctx, c.Params["image"])
+	case actionRemoveContainer:
+		return s.runner.RemoveContainer(ctx, c.Params["container"], true)
+	default:
+		return fmt.Errorf("unknown cleanup action %q", c.Action)
+	}
+}
+
+func (s *Service) setOutput(job *Job, key, value string) {
+	s.mu.Lock()
+	job.run.Outputs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *Service) output(job *Job, key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return job.run.Outputs[key]
+}
+
+// persist writes job's current state to the store. Failures are logged: a
+// clone is not aborted because the database is briefly unavailable.
+func (s *Service) persist(job *Job) {
+	s.mu.RLock()
+	run := job.record()
+	s.mu.RUnlock()
+	if err := s.store.UpdateWorkflowRun(context.Background(), run); err != nil {
+		s.logger.Error("persist clone run failed", "job_id", job.ID, "error", err)
+	}
+}
+
+// record returns the persisted form of j. Callers hold s.mu.
+func (j *Job) record() *store.WorkflowRun {
+	run := *j.run
+	run.Status = runStatuses[j.Status]
+	run.Stage = j.Stage
+	run.Stages = make([]store.WorkflowStage, 0, len(j.Stages))
+	for _, p := range j.Stages {
+		run.Stages = append(run.Stages, store.WorkflowStage{
+			Name:      p.Name,
+			Status:    string(p.Status),
+			Detail:    p.Detail,
+			Error:     p.Error,
+			StartedAt: p.StartedAt,
+			EndedAt:   p.EndedAt,
+		})
+	}
+	run.Outputs = maps.Clone(j.run.Outputs)
+	run.Cleanups = append([]store.WorkflowCleanup(nil), j.run.Cleanups...)
+	run.Error, run.ErrorDetail = nil, nil
+	if j.Error != nil {
+		run.Error = ptr(j.Error.Error)
+		if j.Error.Detail != "" {
+			run.ErrorDetail = ptr(j.Error.Detail)
+		}
+	}
+	run.CreatedAt = j.CreatedAt
+	run.UpdatedAt = j.UpdatedAt
+	return &run
+}
+
+// jobFromRun rebuilds a job from its persisted run.
+func jobFromRun(run *store.WorkflowRun) *Job {
+	job := &Job{
+		ID:        run.ID,
+		VM:        run.Subject,
+		Stage:     run.Stage,
+		CreatedAt: run.CreatedAt,
+		UpdatedAt: run.UpdatedAt,
+		run:       run,
+	}
+	switch run.Status {
+	case store.WorkflowRunSucceeded:
+		job.Status = JobStatusSucceeded
+	case store.WorkflowRunFailed:
+		job.Status = JobStatusFailed
+	case store.WorkflowRunRolledBack:
+		job.Status = JobStatusRolledBack
+	default:
+		job.Status = JobStatusRunning
+	}
+	for _, st := range run.Stages {
+		job.Stages = append(job.Stages, StageProgress{
+			Name:      st.Name,
+			Status:    StageStatus(st.Status),
+			Detail:    st.Detail,
+			Error:     st.Error,
+			StartedAt: st.StartedAt,
+			EndedAt:   st.EndedAt,
+		})
+	}
+	if run.Error != nil {
+		job.Error = &workflow.ErrorResponse{Error: *run.Error}
+		if run.ErrorDetail != nil {
+			job.Error.Detail = *run.ErrorDetail
+		}
+	}
+	if run.Outputs == nil {
+		run.Outputs = map[string]string{}
+	}
+	var opts extract.SanitizeOptions
+	if err := json.Unmarshal([]byte(run.Outputs["sanitize_options"]), &opts); err == nil {
+		job.DryRun = opts.DryRun
+	}
+	if report := run.Outputs["sanitize_report"]; report != "" {
+		_ = json.Unmarshal([]byte(report), &job.Sanitize)
+	}
+	if run.Status == store.WorkflowRunSucceeded && !job.DryRun {
+		job.Result = resultFromRun(run)
+	}
+	return job
+}
+
+// resultFromRun rebuilds the CloneResult of a run from its outputs.
+func resultFromRun(run *store.WorkflowRun) *model.CloneResult {
+	return &model.CloneResult{
+		VM:           run.Subject,
+		ContainerID:  run.Outputs["container_id"],
+		Image:        run.Outputs["image"],
+		Digest:       run.Outputs["image_digest"],
+		BaseImage:    run.Outputs["base_image"],
+		Pushed:       run.Outputs["pushed_ref"],
+		PushedDigest: run.Outputs["pushed_digest"],
+		Mode:         run.Outputs["mode"],
+		Status:       model.StatusReady,
+	}
+}
+
+// runStatuses maps job statuses to persisted run statuses.
+var runStatuses = map[JobStatus]store.WorkflowRunStatus{
+	JobStatusPending:    store.WorkflowRunRunning,
+	JobStatusRunning:    store.WorkflowRunRunning,
+	JobStatusSucceeded:  store.WorkflowRunSucceeded,
+	JobStatusFailed:     store.WorkflowRunFailed,
+	JobStatusRolledBack: store.WorkflowRunRolledBack,
+}
@@ -0,0 +1,97 @@
+package diskimage
+
+import (
+	"context"
+	"io/fs"
+	"slices"
+	"time"
+)
+
+// Changes lists the paths, rooted at "/", that differ between two guest
+// filesystems, sorted.
+type Changes struct {
+	Added    []string
+	Modified []string
+	Removed  []string
+}
+
+// entryMeta is what Compare compares: the quick check rsync uses, so file
+// content is not read.
+type entryMeta struct {
+	mode  fs.FileMode
+	size  int64
+	mtime time.Time
+	uid   uint32
+	gid   uint32
+	link  string
+}
+
+// Compare lists what changed from filesystem a to b. Files are modified
+// when their type, permissions, owner, size, modification time or link
+// target differ. Directories are listed when added or removed, as is
+// everything below them, but never as modified.
+func Compare(ctx context.Context, a, b FS) (*Changes, error) {
+	before, err := walkMeta(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := walkMeta(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	c := &Changes{}
+	for p, m := range after {
+		old, ok := before[p]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, p)
+		case m.mode.IsDir() && old.mode.IsDir():
+		case m != old:
+			c.Modified = append(c.Modified, p)
+		}
+	}
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			c.Removed = append(c.Removed, p)
+		}
+	}
+	slices.Sort(c.Added)
+	slices.Sort(c.Modified)
+	slices.Sort(c.Removed)
+	return c, nil
+}
+
+// walkMeta returns the metadata of every path in fsys.
+func walkMeta(ctx context.Context, fsys FS) (map[string]entryMeta, error) {
+	out := make(map[string]entryMeta)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		m := entryMeta{mode: info.Mode(), size: info.Size(), mtime: info.ModTime()}
+		if st, ok := info.Sys().(*FileStat); ok {
+			m.uid, m.gid = st.UID, st.GID
+		}
+		if m.mode&fs.ModeSymlink != 0 {
+			if m.link, err = fsys.ReadLink(p); err != nil {
+				return err
+			}
+		}
+		if m.mode.IsDir() {
+			m.size, m.mtime = 0, time.Time{}
+		}
+		out["/"+p] = m
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,978 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ext4 superblock and inode constants.
+const (
+	ext4SuperblockOffset = 1024
+	ext4Magic            = 0xef53
+	ext4RootInode        = 2
+	ext4MaxSymlinks      = 40
+	ext4MaxExtentDepth   = 5
+
+	ext4CompatSparseSuper2 = 0x200
+
+	ext4IncompatCompression = 0x1
+	ext4IncompatFiletype    = 0x2
+	ext4IncompatRecover     = 0x4
+	ext4IncompatJournalDev  = 0x8
+	ext4IncompatMetaBG      = 0x10
+	ext4IncompatExtents     = 0x40
+	ext4Incompat64Bit       = 0x80
+	ext4IncompatMMP         = 0x100
+	ext4IncompatFlexBG      = 0x200
+	ext4IncompatEAInode     = 0x400
+	ext4IncompatDirData     = 0x1000
+	ext4IncompatCsumSeed    = 0x2000
+	ext4IncompatLargeDir    = 0x4000
+	ext4IncompatInlineData  = 0x8000
+	ext4IncompatEncrypt     = 0x10000
+	ext4IncompatCasefold    = 0x20000
+
+	ext4RoCompatSparseSuper = 0x1
+
+	ext4FlagEncrypt    = 0x800
+	ext4FlagHugeFile   = 0x40000
+	ext4FlagExtents    = 0x80000
+	ext4FlagEAInode    = 0x200000
+	ext4FlagInlineData = 0x10000000
+
+	ext4ExtentMagic = 0xf30a
+	ext4XattrMagic  = 0xea020000
+
+	// ext4InlineSize is the size of i_block, which holds inline data, fast
+	// symlinks and the root of the extent tree.
+	ext4InlineSize = 60
+)
+
+// ext4Supported lists the incompatible features the reader understands.
+// Journals are not replayed: a filesystem needing recovery reads as it
+// was last checkpointed.
+const ext4Supported = ext4IncompatFiletype | ext4IncompatRecover | ext4IncompatMetaBG |
+	ext4IncompatExtents | ext4Incompat64Bit | ext4IncompatMMP | ext4IncompatFlexBG |
+	ext4IncompatEAInode | ext4IncompatCsumSeed | ext4IncompatLargeDir |
+	ext4IncompatInlineData | ext4IncompatEncrypt | ext4IncompatCasefold
+
+// FS is a read-only guest filesystem. Paths are slash-separated and
+// unrooted, as for fs.FS; symbolic links resolve within the filesystem as
+// if it were mounted at /. Lstat and ReadLink do not follow a final link.
+type FS interface {
+	fs.ReadDirFS
+	fs.ReadFileFS
+	fs.StatFS
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+}
+
+// FileStat is the Sys value of the fs.FileInfo of guest files.
+type FileStat struct {
+	Ino   uint64
+	UID   uint32
+	GID   uint32
+	Nlink uint32
+}
+
+// Ext4 is a read-only ext2, ext3 or ext4 filesystem.
+type Ext4 struct {
+	r io.ReaderAt
+
+	blockSize      uint64
+	blocksPerGroup uint32
+	inodesPerGroup uint32
+	inodesCount    uint32
+	inodeSize      uint32
+	descSize       uint32
+	firstDataBlock uint32
+	firstMetaBG    uint32
+	compat         uint32
+	incompat       uint32
+	roCompat       uint32
+	uuid           string
+	label          string
+
+	// inodeTables holds the first block of each group's inode table.
+	inodeTables []uint64
+}
+
+var _ FS = (*Ext4)(nil)
+
+// OpenExt4 opens the ext2, ext3 or ext4 filesystem on r.
+func OpenExt4(r io.ReaderAt) (*Ext4, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, ext4SuperblockOffset); err != nil {
+		return nil, fmt.Errorf("read ext4 superblock: %w", err)
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[56:]) != ext4Magic {
+		return nil, fmt.Errorf("no ext4 superblock: %w", ErrUnsupported)
+	}
+	e := &Ext4{
+		r:              r,
+		inodesCount:    le.Uint32(sb[0:]),
+		firstDataBlock: le.Uint32(sb[20:]),
+		blocksPerGroup: le.Uint32(sb[32:]),
+		inodesPerGroup: le.Uint32(sb[40:]),
+		inodeSize:      128,
+		descSize:       32,
+		compat:         le.Uint32(sb[92:]),
+		incompat:       le.Uint32(sb[96:]),
+		roCompat:       le.Uint32(sb[100:]),
+		uuid:           formatUUID(sb[104:120]),
+		label:          string(bytes.TrimRight(sb[120:136], "\x00")),
+		firstMetaBG:    le.Uint32(sb[260:]),
+	}
+	logBlock := le.Uint32(sb[24:])
+	if logBlock > 6 {
+		return nil, fmt.Errorf("ext4 block size 2^%d: %w", 10+logBlock, ErrCorrupt)
+	}
+	e.blockSize = 1024 << logBlock
+	if le.Uint32(sb[76:]) >= 1 {
+		e.inodeSize = uint32(le.Uint16(sb[88:]))
+	}
+	if e.incompat&ext4Incompat64Bit != 0 {
+		e.descSize = uint32(le.Uint16(sb[254:]))
+	}
+	if e.incompat&ext4IncompatJournalDev != 0 {
+		return nil, fmt.Errorf("ext4 external journal device: %w", ErrUnsupported)
+	}
+	if unknown := e.incompat &^ ext4Supported; unknown != 0 {
+		return nil, fmt.Errorf("ext4 incompatible features %#x: %w", unknown, ErrUnsupported)
+	}
+	// Descriptors must tile whole blocks: descOffset divides by the number per block.
+	if e.inodeSize < 128 || e.inodeSize > uint32(e.blockSize) ||
+		e.descSize < 32 || e.descSize > uint32(e.blockSize) || e.descSize&(e.descSize-1) != 0 ||
+		e.blocksPerGroup == 0 || e.inodesPerGroup == 0 {
+		return nil, fmt.Errorf("ext4 superblock geometry: %w", ErrCorrupt)
+	}
+
+	blocks := uint64(le.Uint32(sb[4:]))
+	if e.incompat&ext4Incompat64Bit != 0 {
+		blocks |= uint64(le.Uint32(sb[336:])) << 32
+	}
+	groups := (blocks - uint64(e.firstDataBlock) + uint64(e.blocksPerGroup) - 1) / uint64(e.blocksPerGroup)
+	if groups == 0 || groups > 1<<24 {
+		return nil, fmt.Errorf("ext4 with %d block groups: %w", groups, ErrCorrupt)
+	}
+	e.inodeTables = make([]uint64, groups)
+	desc := make([]byte, e.descSize)
+	for g := range e.inodeTables {
+		if _, err := r.ReadAt(desc, int64(e.descOffset(uint32(g)))); err != nil {
+			return nil, fmt.Errorf("read ext4 group descriptor %d: %w", g, err)
+		}
+		table := uint64(le.Uint32(desc[8:]))
+		if e.descSize >= 64 {
+			table |= uint64(le.Uint32(desc[40:])) << 32
+		}
+		e.inodeTables[g] = table
+	}
+	return e, nil
+}
+
+// descOffset returns the byte offset of the descriptor of group g. With
+// meta_bg, descriptors from s_first_meta_bg on are stored in the first
+// group of each meta group rather than after the superblock.
+func (e *Ext4) descOffset(g uint32) uint64 {
+	perBlock := uint32(e.blockSize) / e.descSize
+	if e.incompat&ext4IncompatMetaBG == 0 || g/perBlock < e.firstMetaBG {
+		return (uint64(e.firstDataBlock)+1)*e.blockSize + uint64(g)*uint64(e.descSize)
+	}
+	first := g / perBlock * perBlock
+	block := uint64(e.firstDataBlock) + uint64(first)*uint64(e.blocksPerGroup)
+	if e.hasSuperblock(first) {
+		block++
+	}
+	return block*e.blockSize + uint64(g%perBlock)*uint64(e.descSize)
+}
+
+// hasSuperblock reports whether group g holds a superblock backup.
+func (e *Ext4) hasSuperblock(g uint32) bool {
+	if g <= 1 {
+		return true
+	}
+	if e.compat&ext4CompatSparseSuper2 != 0 {
+		return false // only the two groups named in the superblock
+	}
+	if e.roCompat&ext4RoCompatSparseSuper == 0 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// UUID returns the filesystem UUID, as fstab's UUID= names it.
+func (e *Ext4) UUID() string { return e.uuid }
+
+// Label returns the volume label, as fstab's LABEL= names it.
+func (e *Ext4) Label() string { return e.label }
+
+// ext4Inode is a decoded on-disk inode.
+type ext4Inode struct {
+	num   uint32
+	mode  uint16
+	uid   uint32
+	gid   uint32
+	size  int64
+	mtime time.Time
+	links uint16
+	flags uint32
+	block [ext4InlineSize]byte
+
+	blocks  uint64 // in 512-byte units
+	fileACL uint64
+	raw     []byte
+}
+
+func (ino *ext4Inode) isDir() bool     { return ino.mode&0xf000 == 0x4000 }
+func (ino *ext4Inode) isSymlink() bool { return ino.mode&0xf000 == 0xa000 }
+func (ino *ext4Inode) isRegular() bool { return ino.mode&0xf000 == 0x8000 }
+
+// readInode reads inode n.
+func (e *Ext4) readInode(n uint32) (*ext4Inode, error) {
+	if n == 0 || n > e.inodesCount {
+		return nil, fmt.Errorf("inode %d: %w", n, ErrCorrupt)
+	}
+	g := (n - 1) / e.inodesPerGroup
+	if int(g) >= len(e.inodeTables) {
+		return nil, fmt.Errorf("inode %d: %w", n, ErrCorrupt)
+	}
+	off := e.inodeTables[g]*e.blockSize + uint64((n-1)%e.inodesPerGroup)*uint64(e.inodeSize)
+	raw := make([]byte, e.inodeSize)
+	if _, err := e.r.ReadAt(raw, int64(off)); err != nil {
+		return nil, fmt.Errorf("read inode %d: %w", n, err)
+	}
+	le := binary.LittleEndian
+	ino := &ext4Inode{
+		num:     n,
+		mode:    le.Uint16(raw[0:]),
+		uid:     uint32(le.Uint16(raw[2:])) | uint32(le.Uint16(raw[120:]))<<16,
+		gid:     uint32(le.Uint16(raw[24:])) | uint32(le.Uint16(raw[122:]))<<16,
+		size:    int64(le.Uint32(raw[4:])),
+		links:   le.Uint16(raw[26:]),
+		flags:   le.Uint32(raw[32:]),
+		blocks:  uint64(le.Uint32(raw[28:])) | uint64(le.Uint16(raw[116:]))<<32,
+		fileACL: uint64(le.Uint32(raw[104:])) | uint64(le.Uint16(raw[118:]))<<32,
+		raw:     raw,
+	}
+	copy(ino.block[:], raw[40:100])
+	// Directories only use i_size_high with large_dir; ext2 stored
+	// i_dir_acl there.
+	if !ino.isDir() || e.incompat&ext4IncompatLargeDir != 0 {
+		ino.size |= int64(le.Uint32(raw[108:])) << 32
+	}
+	if ino.flags&ext4FlagHugeFile != 0 {
+		ino.blocks *= e.blockSize / 512
+	}
+	sec, nsec := int64(int32(le.Uint32(raw[16:]))), int64(0)
+	if extra := e.extraSize(ino); extra >= 12 {
+		x := le.Uint32(raw[136:])
+		sec += int64(x&3) << 32
+		nsec = int64(x >> 2)
+	}
+	ino.mtime = time.Unix(sec, nsec).UTC()
+	return ino, nil
+}
+
+// extraSize returns i_extra_isize, the size of the inode fields past the
+// first 128 bytes.
+func (e *Ext4) extraSize(ino *ext4Inode) int {
+	if e.inodeSize <= 128 {
+		return 0
+	}
+	extra := int(binary.LittleEndian.Uint16(ino.raw[128:]))
+	if 128+extra > int(e.inodeSize) {
+		return 0
+	}
+	return extra
+}
+
+// inlineXattr returns the value of the in-inode extended attribute with
+// the given name index and name, or nil.
+func (e *Ext4) inlineXattr(ino *ext4Inode, index byte, name string) []byte {
+	start := 128 + e.extraSize(ino)
+	raw := ino.raw
+	le := binary.LittleEndian
+	if e.inodeSize <= 128 || start+4 > len(raw) || le.Uint32(raw[start:]) != ext4XattrMagic {
+		return nil
+	}
+	base := start + 4
+	for off := base; off+16 <= len(raw) && le.Uint32(raw[off:]) != 0; {
+		nameLen := int(raw[off])
+		valueOff := int(le.Uint16(raw[off+2:]))
+		valueSize := int(le.Uint32(raw[off+8:]))
+		if off+16+nameLen > len(raw) {
+			return nil
+		}
+		if raw[off+1] == index && string(raw[off+16:off+16+nameLen]) == name {
+			if base+valueOff+valueSize > len(raw) {
+				return nil
+			}
+			return raw[base+valueOff : base+valueOff+valueSize]
+		}
+		off += (16 + nameLen + 3) &^ 3
+	}
+	return nil
+}
+
+// inlineData returns the content of an inode with inline data: i_block
+// followed by the system.data attribute.
+func (e *Ext4) inlineData(ino *ext4Inode) []byte {
+	data := append(ino.block[:], e.inlineXattr(ino, 7, "data")...)
+	if int64(len(data)) > ino.size {
+		data = data[:ino.size]
+	}
+	return data
+}
+
+// extent maps length blocks from logical block logical to physical.
+// Uninitialized extents read as zeros.
+type extent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+	uninit   bool
+}
+
+// extents returns the leaves of the extent tree rooted at node, in logical
+// order.
+func (e *Ext4) extents(node []byte, level int) ([]extent, error) {
+	le := binary.LittleEndian
+	if len(node) < 12 || le.Uint16(node[0:]) != ext4ExtentMagic || level > ext4MaxExtentDepth {
+		return nil, fmt.Errorf("extent tree node: %w", ErrCorrupt)
+	}
+	entries := int(le.Uint16(node[2:]))
+	depth := le.Uint16(node[6:])
+	if 12+entries*12 > len(node) {
+		return nil, fmt.Errorf("extent tree node with %d entries: %w", entries, ErrCorrupt)
+	}
+	var out []extent
+	for i := 0; i < entries; i++ {
+		ent := node[12+i*12:]
+		if depth == 0 {
+			x := extent{
+				logical:  uint64(le.Uint32(ent[0:])),
+				length:   uint64(le.Uint16(ent[4:])),
+				physical: uint64(le.Uint16(ent[6:]))<<32 | uint64(le.Uint32(ent[8:])),
+			}
+			if x.length > 32768 {
+				x.length -= 32768
+				x.uninit = true
+			}
+			out = append(out, x)
+			continue
+		}
+		child := uint64(le.Uint16(ent[8:]))<<32 | uint64(le.Uint32(ent[4:]))
+		block := make([]byte, e.blockSize)
+		if _, err := e.r.ReadAt(block, int64(child*e.blockSize)); err != nil {
+			return nil, fmt.Errorf("read extent tree block %d: %w", child, err)
+		}
+		leaves, err := e.extents(block, level+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, leaves...)
+	}
+	return out, nil
+}
+
+// fileData reads the content of an inode.
+type fileData struct {
+	e    *Ext4
+	ino  *ext4Inode
+	size int64
+
+	inline  []byte   // inline data
+	extents []extent // extent-mapped files
+
+	// indirect caches the block-map blocks of ext2/ext3 files.
+	indirect map[uint64][]byte
+}
+
+// data returns a reader over the content of ino.
+func (e *Ext4) data(ino *ext4Inode) (*fileData, error) {
+	if ino.flags&ext4FlagEncrypt != 0 {
+		return nil, fmt.Errorf("inode %d is encrypted: %w", ino.num, ErrUnsupported)
+	}
+	d := &fileData{e: e, ino: ino, size: ino.size}
+	switch {
+	case ino.flags&ext4FlagInlineData != 0:
+		d.inline = e.inlineData(ino)
+	case ino.flags&ext4FlagExtents != 0:
+		x, err := e.extents(ino.block[:], 0)
+		if err != nil {
+			return nil, fmt.Errorf("inode %d: %w", ino.num, err)
+		}
+		d.extents = x
+	default:
+		d.indirect = make(map[uint64][]byte)
+	}
+	return d, nil
+}
+
+// ReadAt reads file content at off. Holes read as zeros.
+func (d *fileData) ReadAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	var short error
+	if rest := d.size - off; int64(len(p)) > rest {
+		p, short = p[:rest], io.EOF
+	}
+	if d.inline != nil {
+		n := copy(p, d.inline[min(off, int64(len(d.inline))):])
+		clear(p[n:])
+		return len(p), short
+	}
+	bs := d.e.blockSize
+	done := 0
+	for done < len(p) {
+		pos := uint64(off) + uint64(done)
+		lblk, inBlock := pos/bs, pos%bs
+		// run is how many bytes map contiguously from pos
+		phys, run, err := d.mapBlock(lblk)
+		if err != nil {
+			return done, err
+		}
+		chunk := p[done:]
+		if n := run*bs - inBlock; uint64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if phys == 0 {
+			clear(chunk)
+		} else if _, err := d.e.r.ReadAt(chunk, int64(phys*bs+inBlock)); err != nil {
+			return done, fmt.Errorf("read inode %d block %d: %w", d.ino.num, lblk, err)
+		}
+		done += len(chunk)
+	}
+	return done, short
+}
+
+// mapBlock returns the physical block holding logical block lblk, 0 for a
+// hole, and how many blocks from lblk on map contiguously (or are holes).
+func (d *fileData) mapBlock(lblk uint64) (uint64, uint64, error) {
+	if d.indirect != nil {
+		phys, err := d.mapIndirect(lblk)
+		return phys, 1, err
+	}
+	i, found := slices.BinarySearchFunc(d.extents, lblk, func(x extent, l uint64) int {
+		switch {
+		case x.logical+x.length <= l:
+			return -1
+		case x.logical > l:
+			return 1
+		}
+		return 0
+	})
+	if !found {
+		// A hole up to the next extent.
+		if i < len(d.extents) {
+			return 0, d.extents[i].logical - lblk, nil
+		}
+		return 0, 1 << 32, nil
+	}
+	x := d.extents[i]
+	run := x.logical + x.length - lblk
+	if x.uninit {
+		return 0, run, nil
+	}
+	return x.physical + lblk - x.logical, run, nil
+}
+
+// mapIndirect maps a block through the direct, indirect, double and
+// triple indirect pointers of i_block.
+func (d *fileData) mapIndirect(lblk uint64) (uint64, error) {
+	le := binary.LittleEndian
+	ptrs := d.e.blockSize / 4
+	b := d.ino.block[:]
+	if lblk < 12 {
+		return uint64(le.Uint32(b[lblk*4:])), nil
+	}
+	lblk -= 12
+	if lblk < ptrs {
+		return d.follow(uint64(le.Uint32(b[48:])), lblk)
+	}
+	lblk -= ptrs
+	if lblk < ptrs*ptrs {
+		return d.follow(uint64(le.Uint32(b[52:])), lblk/ptrs, lblk%ptrs)
+	}
+	lblk -= ptrs * ptrs
+	if lblk < ptrs*ptrs*ptrs {
+		return d.follow(uint64(le.Uint32(b[56:])), lblk/(ptrs*ptrs), lblk/ptrs%ptrs, lblk%ptrs)
+	}
+	return 0, fmt.Errorf("inode %d: block %d beyond triple indirect: %w", d.ino.num, lblk, ErrCorrupt)
+}
+
+// follow walks indirect blocks from block, taking entry idx[i] at level i.
+func (d *fileData) follow(block uint64, idx ...uint64) (uint64, error) {
+	for _, i := range idx {
+		if block == 0 {
+			return 0, nil
+		}
+		table, ok := d.indirect[block]
+		if !ok {
+			table = make([]byte, d.e.blockSize)
+			if _, err := d.e.r.ReadAt(table, int64(block*d.e.blockSize)); err != nil {
+				return 0, fmt.Errorf("read indirect block %d: %w", block, err)
+			}
+			if len(d.indirect) >= 64 {
+				clear(d.indirect)
+			}
+			d.indirect[block] = table
+		}
+		block = uint64(binary.LittleEndian.Uint32(table[i*4:]))
+	}
+	return block, nil
+}
+
+// readAll returns the whole content of ino.
+func (e *Ext4) readAll(ino *ext4Inode) ([]byte, error) {
+	d, err := e.data(ino)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, ino.size)
+	if _, err := d.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ext4Dirent is a directory entry. typ is the dirent file type, 0 when the
+// filesystem does not record types.
+type ext4Dirent struct {
+	name string
+	ino  uint32
+	typ  uint8
+}
+
+// readDir returns the entries of directory ino, without "." and "..".
+// Hashed (htree) directories are read linearly: their index blocks look
+// like empty entries.
+func (e *Ext4) readDir(ino *ext4Inode) ([]ext4Dirent, error) {
+	if ino.flags&ext4FlagEncrypt != 0 {
+		return nil, fmt.Errorf("directory inode %d is encrypted: %w", ino.num, ErrUnsupported)
+	}
+	if ino.flags&ext4FlagInlineData != 0 {
+		// The parent inode number comes first; there is no "." entry.
+		data := e.inlineData(ino)
+		if len(data) < 4 {
+			return nil, nil
+		}
+		var out []ext4Dirent
+		for _, part := range [][]byte{data[4:min(len(data), ext4InlineSize)], data[min(len(data), ext4InlineSize):]} {
+			ents, err := e.parseDirents(part, ino.num)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ents...)
+		}
+		return out, nil
+	}
+	data, err := e.readAll(ino)
+	if err != nil {
+		return nil, err
+	}
+	var out []ext4Dirent
+	for off := uint64(0); off < uint64(len(data)); off += e.blockSize {
+		ents, err := e.parseDirents(data[off:min(off+e.blockSize, uint64(len(data)))], ino.num)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ents...)
+	}
+	return out, nil
+}
+
+// parseDirents parses the linear directory entries in b.
+func (e *Ext4) parseDirents(b []byte, dir uint32) ([]ext4Dirent, error) {
+	le := binary.LittleEndian
+	var out []ext4Dirent
+	for pos := 0; pos+8 <= len(b); {
+		inode := le.Uint32(b[pos:])
+		recLen := int(le.Uint16(b[pos+4:]))
+		if (recLen == 0 || recLen == 65535) && e.blockSize == 65536 {
+			recLen = 65536
+		}
+		nameLen := int(b[pos+6])
+		typ := b[pos+7]
+		if e.incompat&ext4IncompatFiletype == 0 {
+			nameLen |= int(typ) << 8
+			typ = 0
+		}
+		if recLen < 8 || pos+recLen > len(b) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("directory inode %d: entry at %d: %w", dir, pos, ErrCorrupt)
+		}
+		if name := string(b[pos+8 : pos+8+nameLen]); inode != 0 && name != "." && name != ".." && name != "" {
+			out = append(out, ext4Dirent{name: name, ino: inode, typ: typ})
+		}
+		pos += recLen
+	}
+	return out, nil
+}
+
+// lookup returns the inode number of name in directory ino.
+func (e *Ext4) lookup(ino *ext4Inode, name string) (uint32, bool, error) {
+	ents, err := e.readDir(ino)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, d := range ents {
+		if d.name == name {
+			return d.ino, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// readLink returns the target of symbolic link ino. Short targets are
+// stored in i_block ("fast" symlinks).
+func (e *Ext4) readLink(ino *ext4Inode) (string, error) {
+	if ino.flags&ext4FlagEncrypt != 0 {
+		return "", fmt.Errorf("symlink inode %d is encrypted: %w", ino.num, ErrUnsupported)
+	}
+	var eaBlocks uint64
+	if ino.fileACL != 0 {
+		eaBlocks = e.blockSize / 512
+	}
+	if ino.flags&(ext4FlagInlineData|ext4FlagExtents|ext4FlagEAInode) == 0 && ino.blocks-eaBlocks == 0 {
+		if ino.size > ext4InlineSize {
+			return "", fmt.Errorf("symlink inode %d: %w", ino.num, ErrCorrupt)
+		}
+		return string(ino.block[:ino.size]), nil
+	}
+	b, err := e.readAll(ino)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// resolve returns the inode name refers to. Symbolic links in leading
+// directories are always followed, a final one only with follow set.
+func (e *Ext4) resolve(op, name string, follow bool) (*ext4Inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	fail := func(err error) (*ext4Inode, error) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	stack := []uint32{ext4RootInode}
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		dir, err := e.readInode(stack[len(stack)-1])
+		if err != nil {
+			return fail(err)
+		}
+		if !dir.isDir() {
+			return fail(fmt.Errorf("not a directory: %w", fs.ErrNotExist))
+		}
+		child, ok, err := e.lookup(dir, part)
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			return fail(fs.ErrNotExist)
+		}
+		ino, err := e.readInode(child)
+		if err != nil {
+			return fail(err)
+		}
+		if ino.isSymlink() && (len(parts) > 0 || follow) {
+			if links++; links > ext4MaxSymlinks {
+				return fail(errors.New("too many levels of symbolic links"))
+			}
+			target, err := e.readLink(ino)
+			if err != nil {
+				return fail(err)
+			}
+			if strings.HasPrefix(target, "/") {
+				stack = stack[:1]
+			}
+			parts = append(strings.Split(target, "/"), parts...)
+			continue
+		}
+		stack = append(stack, child)
+	}
+	return e.readInode(stack[len(stack)-1])
+}
+
+// Open opens the named file, following symbolic links.
+func (e *Ext4) Open(name string) (fs.File, error) {
+	ino, err := e.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := &ext4FileInfo{name: path.Base(name), ino: ino}
+	if ino.isDir() {
+		return &ext4Dir{e: e, info: info}, nil
+	}
+	if !ino.isRegular() {
+		// Devices, FIFOs and sockets have no content to read.
+		return &ext4File{info: info, SectionReader: io.NewSectionReader(bytes.NewReader(nil), 0, 0)}, nil
+	}
+	d, err := e.data(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &ext4File{info: info, SectionReader: io.NewSectionReader(d, 0, ino.size)}, nil
+}
+
+// ReadFile reads the named file, following symbolic links.
+func (e *Ext4) ReadFile(name string) ([]byte, error) {
+	ino, err := e.resolve("readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if ino.isDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+	if !ino.isRegular() {
+		return nil, nil
+	}
+	b, err := e.readAll(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+// ReadDir lists the named directory, sorted by name.
+func (e *Ext4) ReadDir(name string) ([]fs.DirEntry, error) {
+	ino, err := e.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := e.dirEntries(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return ents, nil
+}
+
+// dirEntries returns the entries of directory ino sorted by name.
+func (e *Ext4) dirEntries(ino *ext4Inode) ([]fs.DirEntry, error) {
+	if !ino.isDir() {
+		return nil, errors.New("not a directory")
+	}
+	ents, err := e.readDir(ino)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]fs.DirEntry, 0, len(ents))
+	for _, d := range ents {
+		ent := &ext4DirEntry{e: e, name: d.name, ino: d.ino, typ: direntType(d.typ)}
+		if d.typ == 0 {
+			// Without dirent types the inode tells.
+			child, err := e.readInode(d.ino)
+			if err != nil {
+				return nil, err
+			}
+			ent.typ = fileMode(child.mode).Type()
+		}
+		out = append(out, ent)
+	}
+	slices.SortFunc(out, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return out, nil
+}
+
+// Stat returns information about the named file, following symbolic links.
+func (e *Ext4) Stat(name string) (fs.FileInfo, error) {
+	ino, err := e.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &ext4FileInfo{name: path.Base(name), ino: ino}, nil
+}
+
+// Lstat returns information about the named file without following a
+// final symbolic link.
+func (e *Ext4) Lstat(name string) (fs.FileInfo, error) {
+	ino, err := e.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ext4FileInfo{name: path.Base(name), ino: ino}, nil
+}
+
+// ReadLink returns the target of the named symbolic link.
+func (e *Ext4) ReadLink(name string) (string, error) {
+	ino, err := e.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !ino.isSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := e.readLink(ino)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// fileMode converts an inode mode to an fs.FileMode.
+func fileMode(m uint16) fs.FileMode {
+	mode := fs.FileMode(m & 0o777)
+	switch m & 0xf000 {
+	case 0x4000:
+		mode |= fs.ModeDir
+	case 0xa000:
+		mode |= fs.ModeSymlink
+	case 0x2000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x6000:
+		mode |= fs.ModeDevice
+	case 0x1000:
+		mode |= fs.ModeNamedPipe
+	case 0xc000:
+		mode |= fs.ModeSocket
+	}
+	if m&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// direntType converts a dirent file type to the type bits of fs.FileMode.
+func direntType(t uint8) fs.FileMode {
+	switch t {
+	case 2:
+		return fs.ModeDir
+	case 3:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case 4:
+		return fs.ModeDevice
+	case 5:
+		return fs.ModeNamedPipe
+	case 6:
+		return fs.ModeSocket
+	case 7:
+		return fs.ModeSymlink
+	}
+	return 0
+}
+
+// ext4FileInfo implements fs.FileInfo.
+type ext4FileInfo struct {
+	name string
+	ino  *ext4Inode
+}
+
+func (fi *ext4FileInfo) Name() string       { return fi.name }
+func (fi *ext4FileInfo) Size() int64        { return fi.ino.size }
+func (fi *ext4FileInfo) Mode() fs.FileMode  { return fileMode(fi.ino.mode) }
+func (fi *ext4FileInfo) ModTime() time.Time { return fi.ino.mtime }
+func (fi *ext4FileInfo) IsDir() bool        { return fi.ino.isDir() }
+func (fi *ext4FileInfo) Sys() any {
+	return &FileStat{Ino: uint64(fi.ino.num), UID: fi.ino.uid, GID: fi.ino.gid, Nlink: uint32(fi.ino.links)}
+}
+
+// ext4DirEntry implements fs.DirEntry; Info reads the inode.
+type ext4DirEntry struct {
+	e    *Ext4
+	name string
+	ino  uint32
+	typ  fs.FileMode
+}
+
+func (d *ext4DirEntry) Name() string      { return d.name }
+func (d *ext4DirEntry) IsDir() bool       { return d.typ.IsDir() }
+func (d *ext4DirEntry) Type() fs.FileMode { return d.typ }
+func (d *ext4DirEntry) Info() (fs.FileInfo, error) {
+	ino, err := d.e.readInode(d.ino)
+	if err != nil {
+		return nil, err
+	}
+	return &ext4FileInfo{name: d.name, ino: ino}, nil
+}
+
+// ext4File is an open regular file (or special file without content).
+type ext4File struct {
+	info *ext4FileInfo
+	*io.SectionReader
+}
+
+func (f *ext4File) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *ext4File) Close() error               { return nil }
+
+// ext4Dir is an open directory.
+type ext4Dir struct {
+	e       *Ext4
+	info    *ext4FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *ext4Dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *ext4Dir) Close() error               { return nil }
+
+func (d *ext4Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *ext4Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		ents, err := d.e.dirEntries(d.info.ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.info.name, Err: err}
+		}
+		d.entries, d.read = ents, true
+	}
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+// formatUUID formats a 16-byte UUID as fstab's UUID= names it.
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
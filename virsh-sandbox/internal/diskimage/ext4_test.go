@@ -0,0 +1,277 @@
+package diskimage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const (
+	testPartStart = 1 << 20
+	testPartSize  = 16 << 20
+)
+
+// writeTree creates the guest tree the ext4 tests read back.
+func writeTree(t *testing.T, dir string) {
+	t.Helper()
+	files := map[string]string{
+		"etc/os-release": "ID=test\n",
+		"etc/fstab":      "UUID=x / ext4 defaults 0 1\n",
+		"usr/lib/x":      "library\n",
+		"tiny":           "t",
+	}
+	for i := 0; i < 300; i++ {
+		files[fmt.Sprintf("many/f%03d", i)] = fmt.Sprint(i)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Large enough for double indirect blocks with 1 KiB blocks, with a hole.
+	big := make([]byte, 400<<10)
+	for i := range big {
+		big[i] = byte(i * 7 % 251)
+	}
+	clear(big[64<<10 : 192<<10])
+	if err := os.WriteFile(filepath.Join(dir, "usr/big"), big, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"link-abs":   "/etc/os-release",
+		"usr/rel":    "../etc/fstab",
+		"usr/escape": "../../../../etc/fstab",
+		"lib":        "usr/lib",
+		"long":       "/" + strings.Repeat("long-target/", 8) + "missing",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// makeDisk builds a raw disk holding one MBR partition at 1 MiB with the
+// given filesystem, populated from dir by mke2fs.
+func makeDisk(t *testing.T, dir, fsType string, opts ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("mke2fs not installed")
+	}
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(disk, mbr(testPartStart/sectorSize, testPartSize/sectorSize, 0x83), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(disk, testPartStart+testPartSize); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{"-q", "-F", "-t", fsType, "-b", "1024", "-E", fmt.Sprintf("offset=%d", testPartStart), "-d", dir}, opts...)
+	args = append(args, disk, fmt.Sprint(testPartSize/1024))
+	if out, err := exec.Command("mke2fs", args...).CombinedOutput(); err != nil {
+		t.Skipf("mke2fs: %v: %s", err, out)
+	}
+	return disk
+}
+
+// mbr returns a boot sector with one primary partition.
+func mbr(start, sectors uint32, typ byte) []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(b[440:], 0x1b2c3d4e)
+	e := b[446:]
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:], start)
+	binary.LittleEndian.PutUint32(e[12:], sectors)
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func openTestRoot(t *testing.T, disk string) FS {
+	t.Helper()
+	img, err := Open(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	fsys, part, err := OpenRoot(img, img.Size())
+	if err != nil {
+		t.Fatalf("OpenRoot: %v", err)
+	}
+	if part == nil || part.Number != 1 || part.Start != testPartStart || part.UUID != "1b2c3d4e-01" {
+		t.Fatalf("root partition = %+v", part)
+	}
+	return fsys
+}
+
+func TestExt4(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []string
+	}{
+		{"ext4", []string{"-O", "inline_data"}},
+		{"ext2", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			writeTree(t, src)
+			fsys := openTestRoot(t, makeDisk(t, src, tc.name, tc.opts...))
+
+			// Every path matches the source tree.
+			seen := 0
+			err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || p == src {
+					return err
+				}
+				seen++
+				rel, _ := filepath.Rel(src, p)
+				want, _ := os.Lstat(p)
+				got, err := fsys.Lstat(rel)
+				if err != nil {
+					t.Errorf("Lstat(%s): %v", rel, err)
+					return nil
+				}
+				if got.Mode() != want.Mode() || got.ModTime().Unix() != want.ModTime().Unix() {
+					t.Errorf("%s: mode %v mtime %v, want %v %v", rel, got.Mode(), got.ModTime(), want.Mode(), want.ModTime())
+				}
+				switch {
+				case want.Mode().IsRegular():
+					b, err := fsys.ReadFile(rel)
+					wantB, _ := os.ReadFile(p)
+					if err != nil || !bytes.Equal(b, wantB) {
+						t.Errorf("ReadFile(%s) = %d bytes, %v; want %d bytes", rel, len(b), err, len(wantB))
+					}
+				case want.Mode()&fs.ModeSymlink != 0:
+					target, err := fsys.ReadLink(rel)
+					wantT, _ := os.Readlink(p)
+					if err != nil || target != wantT {
+						t.Errorf("ReadLink(%s) = %q, %v; want %q", rel, target, err, wantT)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := fsys.ReadDir("many")
+			if err != nil || len(entries) != 300 || entries[0].Name() != "f000" || entries[299].Name() != "f299" {
+				t.Fatalf("ReadDir(many) = %d entries, %v", len(entries), err)
+			}
+
+			// Symbolic links resolve inside the guest filesystem.
+			for name, want := range map[string]string{
+				"link-abs":   "ID=test\n",
+				"usr/rel":    "UUID=x / ext4 defaults 0 1\n",
+				"usr/escape": "UUID=x / ext4 defaults 0 1\n",
+				"lib/x":      "library\n",
+			} {
+				if b, err := fsys.ReadFile(name); err != nil || string(b) != want {
+					t.Errorf("ReadFile(%s) = %q, %v; want %q", name, b, err, want)
+				}
+			}
+			if _, err := fsys.Stat("long"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat of dangling link = %v, want not exist", err)
+			}
+			if fi, err := fsys.Stat("lib"); err != nil || !fi.IsDir() {
+				t.Errorf("Stat(lib) = %v, %v; want directory", fi, err)
+			}
+			if _, err := fsys.Open("../etc"); err == nil {
+				t.Errorf("Open(../etc) succeeded")
+			}
+
+			// fstest rejects dangling links, so check a tree without one.
+			usr, err := fs.Sub(fsys, "usr")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(usr, "big", "lib/x", "rel"); err != nil {
+				t.Fatal(err)
+			}
+			if seen < 300 {
+				t.Fatalf("walked %d source paths", seen)
+			}
+		})
+	}
+}
+
+func TestExt4DescriptorSize(t *testing.T) {
+	// A 64-bit filesystem with 1 KiB blocks and a single group, whose
+	// descriptor is in block 2.
+	image := func(descSize uint16) []byte {
+		b := make([]byte, 8<<10)
+		sb := b[ext4SuperblockOffset:]
+		le := binary.LittleEndian
+		le.PutUint32(sb[0:], 16)    // inodes
+		le.PutUint32(sb[4:], 8)     // blocks
+		le.PutUint32(sb[20:], 1)    // first data block
+		le.PutUint32(sb[32:], 8192) // blocks per group
+		le.PutUint32(sb[40:], 16)   // inodes per group
+		le.PutUint16(sb[56:], ext4Magic)
+		le.PutUint32(sb[76:], 1)   // dynamic revision
+		le.PutUint16(sb[88:], 256) // inode size
+		le.PutUint32(sb[96:], ext4Incompat64Bit|ext4IncompatMetaBG)
+		le.PutUint16(sb[254:], descSize)
+		le.PutUint32(b[2048+8:], 5) // inode table
+		return b
+	}
+
+	for _, size := range []uint16{32, 64, 1024} {
+		e, err := OpenExt4(bytes.NewReader(image(size)))
+		if err != nil || e.inodeTables[0] != 5 {
+			t.Errorf("descriptor size %d: %v", size, err)
+		}
+	}
+	for _, size := range []uint16{0, 16, 48, 2048, 4096} {
+		if _, err := OpenExt4(bytes.NewReader(image(size))); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("descriptor size %d: err = %v, want ErrCorrupt", size, err)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src)
+	before := openTestRoot(t, makeDisk(t, src, "ext4"))
+
+	if err := os.WriteFile(filepath.Join(src, "etc/os-release"), []byte("ID=changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "tiny"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(src, "usr/lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "opt/app"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "opt/app/run"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	after := openTestRoot(t, makeDisk(t, src, "ext4"))
+
+	c, err := Compare(context.Background(), before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Changes{
+		Added:    []string{"/opt", "/opt/app", "/opt/app/run"},
+		Modified: []string{"/etc/os-release", "/tiny"},
+		Removed:  []string{"/usr/lib", "/usr/lib/x"},
+	}
+	if !slices.Equal(c.Added, want.Added) || !slices.Equal(c.Modified, want.Modified) || !slices.Equal(c.Removed, want.Removed) {
+		t.Fatalf("Compare = %+v, want %+v", *c, want)
+	}
+}
@@ -0,0 +1,95 @@
+package diskimage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// signature identifies a filesystem or volume format by magic bytes.
+type signature struct {
+	name  string
+	off   int64
+	magic string
+}
+
+// foreignSignatures are formats recognised only to report them as
+// unsupported.
+var foreignSignatures = []signature{
+	{"xfs", 0, "XFSB"},
+	{"btrfs", 0x10040, "_BHRfS_M"},
+	{"LVM physical volume", 512 + 24, "LVM2 001"},
+	{"LUKS", 0, "LUKS\xba\xbe"},
+	{"swap", 4096 - 10, "SWAPSPACE2"},
+	{"vfat", 0x52, "FAT32   "},
+	{"vfat", 0x36, "FAT1"},
+}
+
+// OpenFS opens the filesystem on a partition or unpartitioned disk. Only
+// ext2, ext3 and ext4 are supported; other recognised formats return an
+// error naming them that wraps ErrUnsupported.
+func OpenFS(r io.ReaderAt) (FS, error) {
+	e, err := OpenExt4(r)
+	if err == nil {
+		return e, nil
+	}
+	if !errors.Is(err, ErrUnsupported) {
+		return nil, err
+	}
+	var magic [16]byte
+	for _, s := range foreignSignatures {
+		b := magic[:len(s.magic)]
+		if _, err := r.ReadAt(b, s.off); err == nil && bytes.Equal(b, []byte(s.magic)) {
+			return nil, fmt.Errorf("%s: %w", s.name, ErrUnsupported)
+		}
+	}
+	return nil, err
+}
+
+// OpenRoot finds the guest's root filesystem on a disk: the first
+// partition, or the whole disk when it has no partition table, whose
+// filesystem holds /etc/fstab or /etc/os-release. The partition is nil for
+// an unpartitioned disk.
+func OpenRoot(disk io.ReaderAt, size int64) (FS, *Partition, error) {
+	parts, err := Partitions(disk, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(parts) == 0 {
+		fsys, err := OpenFS(io.NewSectionReader(disk, 0, size))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !looksLikeRoot(fsys) {
+			return nil, nil, fmt.Errorf("no /etc/fstab or /etc/os-release on the disk: %w", fs.ErrNotExist)
+		}
+		return fsys, nil, nil
+	}
+	var errs []error
+	for i := range parts {
+		p := &parts[i]
+		fsys, err := OpenFS(p.Section(disk))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.Number, err))
+			continue
+		}
+		if looksLikeRoot(fsys) {
+			return fsys, p, nil
+		}
+	}
+	errs = append(errs, fmt.Errorf("no partition holds /etc/fstab or /etc/os-release: %w", fs.ErrNotExist))
+	return nil, nil, errors.Join(errs...)
+}
+
+// looksLikeRoot reports whether fsys is a root filesystem, as
+// extract.MountDisk decides for mounted partitions.
+func looksLikeRoot(fsys FS) bool {
+	for _, name := range []string{"etc/fstab", "etc/os-release"} {
+		if _, err := fsys.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
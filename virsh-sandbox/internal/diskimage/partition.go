@@ -0,0 +1,228 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// sectorSize is the logical sector size assumed for partition tables, as
+// virtual disks use.
+const sectorSize = 512
+
+// maxLogicalPartitions bounds the walk of an MBR extended partition chain.
+const maxLogicalPartitions = 128
+
+// Partition is an entry of a disk's MBR or GPT partition table.
+type Partition struct {
+	// Number is the partition number as Linux numbers it: GPT entries and
+	// MBR primary partitions from 1, MBR logical partitions from 5.
+	Number int `json:"number"`
+
+	// Start and Size are in bytes.
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+
+	// Type is the GPT type GUID, or the MBR type as "0x83".
+	Type string `json:"type"`
+
+	// UUID is the GPT partition GUID (PARTUUID), or for MBR disks the
+	// disk signature and number ("1b2c3d4e-02"). Name is the GPT label.
+	UUID string `json:"uuid,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Section returns a reader over the partition's content on disk.
+func (p Partition) Section(disk io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(disk, p.Start, p.Size)
+}
+
+// Partitions reads the partition table of a disk of the given size. A disk
+// without a partition table has none and no error.
+func Partitions(disk io.ReaderAt, size int64) ([]Partition, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(mbr, 0); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read MBR: %w", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, nil
+	}
+	entries := mbrEntries(mbr)
+	for _, e := range entries {
+		if e.typ == 0xee {
+			return gptPartitions(disk, size)
+		}
+	}
+	if !validMBR(entries, size) {
+		// A boot sector of a filesystem spanning the whole disk, such as FAT.
+		return nil, nil
+	}
+
+	sig := binary.LittleEndian.Uint32(mbr[440:])
+	var parts []Partition
+	for i, e := range entries {
+		if e.sectors == 0 || e.typ == 0 {
+			continue
+		}
+		if isExtended(e.typ) {
+			logical, err := logicalPartitions(disk, int64(e.start), sig)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, logical...)
+			continue
+		}
+		parts = append(parts, mbrPartition(i+1, 0, e, sig))
+	}
+	return parts, nil
+}
+
+type mbrEntry struct {
+	status  byte
+	typ     byte
+	start   uint32 // LBA
+	sectors uint32
+}
+
+func mbrEntries(sector []byte) []mbrEntry {
+	out := make([]mbrEntry, 4)
+	for i := range out {
+		b := sector[446+16*i:]
+		out[i] = mbrEntry{
+			status:  b[0],
+			typ:     b[4],
+			start:   binary.LittleEndian.Uint32(b[8:]),
+			sectors: binary.LittleEndian.Uint32(b[12:]),
+		}
+	}
+	return out
+}
+
+// validMBR reports whether entries look like a partition table rather than
+// boot code of a filesystem.
+func validMBR(entries []mbrEntry, size int64) bool {
+	found := false
+	for _, e := range entries {
+		if e.status != 0 && e.status != 0x80 {
+			return false
+		}
+		if e.typ == 0 || e.sectors == 0 {
+			continue
+		}
+		if e.start == 0 || int64(e.start)*sectorSize >= size {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func isExtended(typ byte) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+func mbrPartition(number int, base int64, e mbrEntry, sig uint32) Partition {
+	return Partition{
+		Number: number,
+		Start:  (base + int64(e.start)) * sectorSize,
+		Size:   int64(e.sectors) * sectorSize,
+		Type:   fmt.Sprintf("0x%02x", e.typ),
+		UUID:   fmt.Sprintf("%08x-%02x", sig, number),
+	}
+}
+
+// logicalPartitions walks the chain of extended boot records starting at
+// LBA ext. Each record holds one logical partition, relative to itself, and
+// a link to the next record, relative to ext.
+func logicalPartitions(disk io.ReaderAt, ext int64, sig uint32) ([]Partition, error) {
+	var parts []Partition
+	ebr := ext
+	sector := make([]byte, sectorSize)
+	for n := 5; n < 5+maxLogicalPartitions; n++ {
+		if _, err := disk.ReadAt(sector, ebr*sectorSize); err != nil {
+			return nil, fmt.Errorf("read extended boot record: %w", err)
+		}
+		if sector[510] != 0x55 || sector[511] != 0xaa {
+			return parts, nil
+		}
+		entries := mbrEntries(sector)
+		if e := entries[0]; e.sectors > 0 && e.typ != 0 {
+			parts = append(parts, mbrPartition(n, ebr, e, sig))
+		}
+		next := entries[1]
+		if next.sectors == 0 || !isExtended(next.typ) {
+			return parts, nil
+		}
+		ebr = ext + int64(next.start)
+	}
+	return nil, fmt.Errorf("extended partition chain longer than %d: %w", maxLogicalPartitions, ErrCorrupt)
+}
+
+// gptPartitions reads the primary GPT header at LBA 1 and its entries.
+func gptPartitions(disk io.ReaderAt, size int64) ([]Partition, error) {
+	hdr := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(hdr, sectorSize); err != nil {
+		return nil, fmt.Errorf("read GPT header: %w", err)
+	}
+	if !bytes.Equal(hdr[:8], []byte("EFI PART")) {
+		return nil, fmt.Errorf("protective MBR without GPT header: %w", ErrCorrupt)
+	}
+	le := binary.LittleEndian
+	entriesLBA := int64(le.Uint64(hdr[72:]))
+	count := le.Uint32(hdr[80:])
+	entrySize := le.Uint32(hdr[84:])
+	if entrySize < 128 || count > 4096 {
+		return nil, fmt.Errorf("GPT with %d entries of %d bytes: %w", count, entrySize, ErrCorrupt)
+	}
+	table := make([]byte, int(count)*int(entrySize))
+	if _, err := disk.ReadAt(table, entriesLBA*sectorSize); err != nil {
+		return nil, fmt.Errorf("read GPT entries: %w", err)
+	}
+	var parts []Partition
+	for i := 0; i < int(count); i++ {
+		e := table[i*int(entrySize):]
+		typ := e[0:16]
+		if bytes.Equal(typ, make([]byte, 16)) {
+			continue
+		}
+		first := int64(le.Uint64(e[32:]))
+		last := int64(le.Uint64(e[40:]))
+		if last < first || last*sectorSize >= size {
+			return nil, fmt.Errorf("GPT entry %d spans LBA %d-%d: %w", i+1, first, last, ErrCorrupt)
+		}
+		parts = append(parts, Partition{
+			Number: i + 1,
+			Start:  first * sectorSize,
+			Size:   (last - first + 1) * sectorSize,
+			Type:   guid(typ),
+			UUID:   guid(e[16:32]),
+			Name:   utf16Name(e[56:128]),
+		})
+	}
+	return parts, nil
+}
+
+// guid formats a GPT GUID, whose first three fields are little-endian.
+func guid(b []byte) string {
+	le := binary.LittleEndian
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", le.Uint32(b[0:]), le.Uint16(b[4:]), le.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// utf16Name decodes a NUL-padded UTF-16LE partition name.
+func utf16Name(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return strings.TrimSpace(string(utf16.Decode(u)))
+}
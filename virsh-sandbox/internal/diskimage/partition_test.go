@@ -0,0 +1,52 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestPartitionsGPT(t *testing.T) {
+	const size = 8 << 20
+	disk := make([]byte, size)
+	copy(disk, mbr(1, size/sectorSize-1, 0xee))
+	le := binary.LittleEndian
+	hdr := disk[sectorSize:]
+	copy(hdr, "EFI PART")
+	le.PutUint64(hdr[72:], 2)
+	le.PutUint32(hdr[80:], 128)
+	le.PutUint32(hdr[84:], 128)
+
+	entries := disk[2*sectorSize:]
+	// Linux filesystem type, a partition GUID, LBA 2048-4095.
+	copy(entries[0:], []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4})
+	copy(entries[16:], []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10})
+	le.PutUint64(entries[32:], 2048)
+	le.PutUint64(entries[40:], 4095)
+	for i, c := range utf16.Encode([]rune("root")) {
+		le.PutUint16(entries[56+2*i:], c)
+	}
+
+	parts, err := Partitions(bytes.NewReader(disk), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Partition{
+		Number: 1,
+		Start:  2048 * sectorSize,
+		Size:   2048 * sectorSize,
+		Type:   "0fc63daf-8483-4772-8e79-3d69d8477de4",
+		UUID:   "04030201-0605-0807-090a-0b0c0d0e0f10",
+		Name:   "root",
+	}
+	if len(parts) != 1 || parts[0] != want {
+		t.Fatalf("Partitions = %+v, want %+v", parts, want)
+	}
+
+	// An entry past the end of the disk is rejected.
+	le.PutUint64(entries[40:], size/sectorSize)
+	if _, err := Partitions(bytes.NewReader(disk), size); err == nil {
+		t.Fatal("Partitions accepted an entry past the end of the disk")
+	}
+}
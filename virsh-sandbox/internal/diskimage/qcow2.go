@@ -0,0 +1,560 @@
+// Package diskimage reads guest disks without the host kernel: qcow2 and
+// raw images (with qcow2 backing chains and internal snapshots), MBR and GPT
+// partition tables, and ext2/3/4 filesystems. Everything is read-only and
+// unprivileged, so guest files can be listed and compared without qemu-nbd,
+// mount or CAP_SYS_ADMIN.
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnsupported is returned for image and filesystem features the
+	// readers do not implement, such as encrypted qcow2 images.
+	ErrUnsupported = errors.New("unsupported")
+
+	// ErrCorrupt is returned when on-disk structures are inconsistent.
+	ErrCorrupt = errors.New("corrupt image")
+
+	// ErrSnapshotNotFound is returned by AtSnapshot for unknown snapshots.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// qcow2Magic is "QFI\xfb".
+const qcow2Magic = 0x514649fb
+
+// maxBackingDepth bounds backing chains, which could otherwise loop.
+const maxBackingDepth = 16
+
+// qcow2 incompatible feature bits.
+const (
+	incompatDirty       = 1 << 0
+	incompatCorrupt     = 1 << 1
+	incompatDataFile    = 1 << 2
+	incompatCompression = 1 << 3
+	incompatExtendedL2  = 1 << 4
+)
+
+// Header extension types.
+const (
+	extEnd           = 0x00000000
+	extBackingFormat = 0xe2792aca
+)
+
+// Entry bits of L1 and L2 tables.
+const (
+	l1OffsetMask  = 0x00fffffffffffe00
+	l2OffsetMask  = 0x00fffffffffffe00
+	l2Compressed  = 1 << 62
+	l2ReadsZeroes = 1 << 0
+)
+
+// Snapshot is an internal snapshot stored in a qcow2 image.
+type Snapshot struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Date time.Time `json:"date"`
+
+	// DiskSize is the virtual disk size when the snapshot was taken.
+	DiskSize int64 `json:"disk_size"`
+
+	l1Offset uint64
+	l1Size   uint32
+}
+
+// Image is a read-only view of the guest-visible content of a disk image.
+// Reads of clusters a qcow2 image does not allocate fall through to its
+// backing image, or read as zeros. It is safe for concurrent use.
+type Image struct {
+	path   string
+	format string // "qcow2" or "raw"
+	f      *os.File
+	size   int64
+
+	// qcow2 only
+	clusterBits uint32
+	l2Entries   uint64 // entries per L2 table
+	extendedL2  bool
+	l1          []uint64
+	snapshots   []Snapshot
+	backing     *Image
+
+	// shared by views of the same file
+	cache *clusterCache
+	owner bool // Close closes f and the backing chain
+}
+
+// clusterCache keeps recently read L2 tables and decompressed clusters.
+type clusterCache struct {
+	mu      sync.Mutex
+	entries map[uint64][]byte
+}
+
+// maxCachedClusters bounds clusterCache.
+const maxCachedClusters = 256
+
+func (c *clusterCache) get(key uint64) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+func (c *clusterCache) put(key uint64, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedClusters {
+		clear(c.entries)
+	}
+	c.entries[key] = b
+}
+
+// Open opens the disk image at path, qcow2 or raw, with its backing chain.
+func Open(path string) (*Image, error) {
+	return open(path, "", 0)
+}
+
+func open(path, format string, depth int) (*Image, error) {
+	if depth > maxBackingDepth {
+		return nil, fmt.Errorf("%s: backing chain deeper than %d: %w", path, maxBackingDepth, ErrUnsupported)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{path: path, f: f, owner: true, cache: &clusterCache{entries: make(map[uint64][]byte)}}
+	var magic [4]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	isQcow2 := binary.BigEndian.Uint32(magic[:]) == qcow2Magic
+	if format == "qcow2" && !isQcow2 {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a qcow2 image: %w", path, ErrCorrupt)
+	}
+	if format == "raw" || !isQcow2 {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		img.format, img.size = "raw", fi.Size()
+		return img, nil
+	}
+	img.format = "qcow2"
+	if err := img.readHeader(depth); err != nil {
+		img.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return img, nil
+}
+
+// readHeader parses the qcow2 header, header extensions, active L1 table
+// and snapshot table, and opens the backing image.
+func (img *Image) readHeader(depth int) error {
+	hdr := make([]byte, 112)
+	n, err := img.f.ReadAt(hdr, 0)
+	if err != nil && n < 72 {
+		return fmt.Errorf("read header: %w", err)
+	}
+	be := binary.BigEndian
+	version := be.Uint32(hdr[4:])
+	if version != 2 && version != 3 {
+		return fmt.Errorf("qcow2 version %d: %w", version, ErrUnsupported)
+	}
+	backingOffset := be.Uint64(hdr[8:])
+	backingSize := be.Uint32(hdr[16:])
+	img.clusterBits = be.Uint32(hdr[20:])
+	img.size = int64(be.Uint64(hdr[24:]))
+	cryptMethod := be.Uint32(hdr[32:])
+	l1Size := be.Uint32(hdr[36:])
+	l1Offset := be.Uint64(hdr[40:])
+	nbSnapshots := be.Uint32(hdr[60:])
+	snapshotsOffset := be.Uint64(hdr[64:])
+
+	if img.clusterBits < 9 || img.clusterBits > 21 {
+		return fmt.Errorf("cluster bits %d: %w", img.clusterBits, ErrCorrupt)
+	}
+	if cryptMethod != 0 {
+		return fmt.Errorf("encrypted image: %w", ErrUnsupported)
+	}
+	headerLength := uint32(72)
+	if version == 3 {
+		incompat := be.Uint64(hdr[72:])
+		headerLength = be.Uint32(hdr[100:])
+		known := uint64(incompatDirty | incompatCorrupt | incompatCompression | incompatExtendedL2)
+		if incompat&incompatDataFile != 0 {
+			return fmt.Errorf("external data file: %w", ErrUnsupported)
+		}
+		if incompat&^known != 0 {
+			return fmt.Errorf("incompatible features %#x: %w", incompat&^known, ErrUnsupported)
+		}
+		if incompat&incompatCompression != 0 && headerLength > 104 && hdr[104] != 0 {
+			return fmt.Errorf("compression type %d: %w", hdr[104], ErrUnsupported)
+		}
+		img.extendedL2 = incompat&incompatExtendedL2 != 0
+	}
+	entrySize := uint64(8)
+	if img.extendedL2 {
+		entrySize = 16
+	}
+	img.l2Entries = img.clusterSize() / entrySize
+
+	if img.l1, err = img.readL1(l1Offset, l1Size); err != nil {
+		return err
+	}
+	if nbSnapshots > 0 {
+		if img.snapshots, err = img.readSnapshots(snapshotsOffset, nbSnapshots); err != nil {
+			return err
+		}
+	}
+
+	backingFormat, err := img.readExtensions(int64(headerLength))
+	if err != nil {
+		return err
+	}
+	if backingOffset != 0 && backingSize > 0 {
+		name := make([]byte, backingSize)
+		if _, err := img.f.ReadAt(name, int64(backingOffset)); err != nil {
+			return fmt.Errorf("read backing file name: %w", err)
+		}
+		backing := string(name)
+		// Protocols such as nbd: or json: name no local file.
+		if i := strings.IndexByte(backing, ':'); i > 0 && !strings.Contains(backing[:i], "/") {
+			return fmt.Errorf("backing file %q: %w", backing, ErrUnsupported)
+		}
+		if !filepath.IsAbs(backing) {
+			backing = filepath.Join(filepath.Dir(img.path), backing)
+		}
+		if img.backing, err = open(backing, backingFormat, depth+1); err != nil {
+			return fmt.Errorf("open backing file: %w", err)
+		}
+	}
+	return nil
+}
+
+// readExtensions returns the backing format from the header extensions.
+func (img *Image) readExtensions(off int64) (string, error) {
+	var format string
+	for i := 0; i < 64; i++ {
+		var h [8]byte
+		if _, err := img.f.ReadAt(h[:], off); err != nil {
+			return "", fmt.Errorf("read header extension: %w", err)
+		}
+		typ := binary.BigEndian.Uint32(h[0:])
+		length := binary.BigEndian.Uint32(h[4:])
+		if typ == extEnd {
+			return format, nil
+		}
+		if typ == extBackingFormat {
+			b := make([]byte, length)
+			if _, err := img.f.ReadAt(b, off+8); err != nil {
+				return "", fmt.Errorf("read backing format: %w", err)
+			}
+			format = string(b)
+		}
+		off += 8 + int64((length+7)&^7)
+	}
+	return format, nil
+}
+
+func (img *Image) readL1(offset uint64, size uint32) ([]uint64, error) {
+	if uint64(size)*8 > 32<<20 {
+		return nil, fmt.Errorf("L1 table of %d entries: %w", size, ErrCorrupt)
+	}
+	b := make([]byte, int(size)*8)
+	if _, err := img.f.ReadAt(b, int64(offset)); err != nil {
+		return nil, fmt.Errorf("read L1 table: %w", err)
+	}
+	l1 := make([]uint64, size)
+	for i := range l1 {
+		l1[i] = binary.BigEndian.Uint64(b[i*8:])
+	}
+	return l1, nil
+}
+
+// readSnapshots parses the snapshot table.
+func (img *Image) readSnapshots(offset uint64, count uint32) ([]Snapshot, error) {
+	be := binary.BigEndian
+	off := int64(offset)
+	var out []Snapshot
+	for i := uint32(0); i < count; i++ {
+		var h [40]byte
+		if _, err := img.f.ReadAt(h[:], off); err != nil {
+			return nil, fmt.Errorf("read snapshot table: %w", err)
+		}
+		s := Snapshot{
+			l1Offset: be.Uint64(h[0:]),
+			l1Size:   be.Uint32(h[8:]),
+			Date:     time.Unix(int64(be.Uint32(h[16:])), int64(be.Uint32(h[20:]))).UTC(),
+			DiskSize: img.size,
+		}
+		idSize := int64(be.Uint16(h[12:]))
+		nameSize := int64(be.Uint16(h[14:]))
+		extraSize := int64(be.Uint32(h[36:]))
+		rest := make([]byte, extraSize+idSize+nameSize)
+		if _, err := img.f.ReadAt(rest, off+40); err != nil {
+			return nil, fmt.Errorf("read snapshot table: %w", err)
+		}
+		if extraSize >= 16 {
+			s.DiskSize = int64(be.Uint64(rest[8:]))
+		}
+		s.ID = string(rest[extraSize : extraSize+idSize])
+		s.Name = string(rest[extraSize+idSize:])
+		out = append(out, s)
+		off += (40 + int64(len(rest)) + 7) &^ 7
+	}
+	return out, nil
+}
+
+func (img *Image) clusterSize() uint64 { return 1 << img.clusterBits }
+
+// Path returns the path of the image file.
+func (img *Image) Path() string { return img.path }
+
+// Format returns "qcow2" or "raw".
+func (img *Image) Format() string { return img.format }
+
+// Size returns the virtual size of the disk in bytes.
+func (img *Image) Size() int64 { return img.size }
+
+// Backing returns the backing image, or nil.
+func (img *Image) Backing() *Image { return img.backing }
+
+// Snapshots returns the internal snapshots of a qcow2 image.
+func (img *Image) Snapshots() []Snapshot {
+	return append([]Snapshot(nil), img.snapshots...)
+}
+
+// AtSnapshot returns a view of the disk as it was when the internal
+// snapshot with the given name or ID was taken. The view shares the image's
+// file and is valid until the image is closed.
+func (img *Image) AtSnapshot(name string) (*Image, error) {
+	for _, s := range img.snapshots {
+		if s.Name != name && s.ID != name {
+			continue
+		}
+		l1, err := img.readL1(s.l1Offset, s.l1Size)
+		if err != nil {
+			return nil, fmt.Errorf("%s: snapshot %s: %w", img.path, name, err)
+		}
+		view := *img
+		view.l1, view.size, view.owner = l1, s.DiskSize, false
+		return &view, nil
+	}
+	return nil, fmt.Errorf("%s: %q: %w", img.path, name, ErrSnapshotNotFound)
+}
+
+// OpenSnapshot opens the disk image at path as it was when its internal
+// snapshot with the given name or ID was taken, or its current state when
+// snapshot is empty.
+func OpenSnapshot(path, snapshot string) (*Image, error) {
+	img, err := Open(path)
+	if err != nil || snapshot == "" {
+		return img, err
+	}
+	view, err := img.AtSnapshot(snapshot)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	view.owner = true
+	return view, nil
+}
+
+// Close closes the image file and its backing chain. Views returned by
+// AtSnapshot share the file; closing them does nothing.
+func (img *Image) Close() error {
+	if !img.owner {
+		return nil
+	}
+	err := img.f.Close()
+	if img.backing != nil {
+		err = errors.Join(err, img.backing.Close())
+	}
+	return err
+}
+
+// ReadAt reads guest disk content at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %w", os.ErrInvalid)
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var short error
+	if rest := img.size - off; int64(len(p)) > rest {
+		p, short = p[:rest], io.EOF
+	}
+	if img.format == "raw" {
+		n, err := img.readHost(p, uint64(off))
+		if err != nil {
+			return n, err
+		}
+		return n, short
+	}
+	done := 0
+	for done < len(p) {
+		n, err := img.readCluster(p[done:], off+int64(done))
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, short
+}
+
+// readCluster reads from the cluster holding off, up to the end of the
+// cluster or of p. It returns the number of bytes read.
+func (img *Image) readCluster(p []byte, off int64) (int, error) {
+	cs := img.clusterSize()
+	inCluster := uint64(off) & (cs - 1)
+	if uint64(len(p)) > cs-inCluster {
+		p = p[:cs-inCluster]
+	}
+	entry, bitmap, err := img.l2Entry(uint64(off))
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case entry&l2Compressed != 0:
+		data, err := img.compressedCluster(entry)
+		if err != nil {
+			return 0, err
+		}
+		return copy(p, data[inCluster:]), nil
+	case !img.extendedL2:
+		host := entry & l2OffsetMask
+		switch {
+		case entry&l2ReadsZeroes != 0:
+			clear(p)
+			return len(p), nil
+		case host == 0:
+			return img.readBacking(p, off)
+		}
+		return img.readHost(p, host+inCluster)
+	}
+
+	// Extended L2 entries track 32 subclusters; read up to the end of the
+	// subcluster holding off.
+	sub := cs / 32
+	i := inCluster / sub
+	if end := sub - inCluster%sub; uint64(len(p)) > end {
+		p = p[:end]
+	}
+	switch {
+	case bitmap&(1<<(32+i)) != 0:
+		clear(p)
+		return len(p), nil
+	case bitmap&(1<<i) != 0:
+		return img.readHost(p, entry&l2OffsetMask+inCluster)
+	}
+	return img.readBacking(p, off)
+}
+
+// readHost reads p from the image file at host offset off.
+func (img *Image) readHost(p []byte, off uint64) (int, error) {
+	n, err := img.f.ReadAt(p, int64(off))
+	if err == io.EOF {
+		// Data past the end of the file reads as zeros: preallocated
+		// clusters, or a raw file truncated since it was opened.
+		clear(p[n:])
+		return len(p), nil
+	}
+	return n, err
+}
+
+// readBacking reads unallocated clusters from the backing image, or zeros.
+func (img *Image) readBacking(p []byte, off int64) (int, error) {
+	if img.backing == nil || off >= img.backing.size {
+		clear(p)
+		return len(p), nil
+	}
+	n, err := img.backing.ReadAt(p, off)
+	if err == io.EOF {
+		// A backing image smaller than this one reads as zeros past its end.
+		clear(p[n:])
+		return len(p), nil
+	}
+	return n, err
+}
+
+// l2Entry returns the L2 entry mapping the cluster holding off and, for
+// extended L2 entries, its subcluster bitmap. Unallocated clusters have a
+// zero entry.
+func (img *Image) l2Entry(off uint64) (uint64, uint64, error) {
+	cluster := off >> img.clusterBits
+	l1Index := cluster / img.l2Entries
+	if l1Index >= uint64(len(img.l1)) {
+		return 0, 0, nil
+	}
+	l2Offset := img.l1[l1Index] & l1OffsetMask
+	if l2Offset == 0 {
+		return 0, 0, nil
+	}
+	table := img.cache.get(l2Offset)
+	if table == nil {
+		table = make([]byte, img.clusterSize())
+		if _, err := img.f.ReadAt(table, int64(l2Offset)); err != nil {
+			return 0, 0, fmt.Errorf("read L2 table at %#x: %w", l2Offset, err)
+		}
+		img.cache.put(l2Offset, table)
+	}
+	i := cluster % img.l2Entries
+	if img.extendedL2 {
+		return binary.BigEndian.Uint64(table[i*16:]), binary.BigEndian.Uint64(table[i*16+8:]), nil
+	}
+	return binary.BigEndian.Uint64(table[i*8:]), 0, nil
+}
+
+// compressedCluster returns the decompressed content of the cluster a
+// compressed L2 entry describes.
+func (img *Image) compressedCluster(entry uint64) ([]byte, error) {
+	x := 62 - (img.clusterBits - 8)
+	host := entry & (1<<x - 1)
+	sectors := (entry>>x)&(1<<(img.clusterBits-8)-1) + 1
+	key := host | 1<<63 // distinct from L2 table offsets
+	if data := img.cache.get(key); data != nil {
+		return data, nil
+	}
+	compressed := make([]byte, sectors*512-host%512)
+	n, err := img.f.ReadAt(compressed, int64(host))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read compressed cluster at %#x: %w", host, err)
+	}
+	data := make([]byte, img.clusterSize())
+	r := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("decompress cluster at %#x: %w: %w", host, ErrCorrupt, err)
+	}
+	img.cache.put(key, data)
+	return data, nil
+}
+
+// BackingFile returns the backing file named in the header of the qcow2
+// image at path, resolved against the image's directory, or "" for images
+// without one.
+func BackingFile(path string) (string, error) {
+	img, err := Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	if img.backing == nil {
+		return "", nil
+	}
+	return img.backing.path, nil
+}
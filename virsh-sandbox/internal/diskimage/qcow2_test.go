@@ -0,0 +1,146 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testCluster = 1 << 16
+
+// writeQcow2 writes a four-cluster qcow2 v3 overlay on a raw backing file:
+//
+//	cluster 0: allocated ('O'), 'S' in snapshot "before"
+//	cluster 1: unallocated, read from the backing file
+//	cluster 2: reads as zeros
+//	cluster 3: compressed ('Z')
+func writeQcow2(t *testing.T, dir string) string {
+	t.Helper()
+	base := bytes.Repeat([]byte{'b'}, 4*testCluster)
+	for i := range base {
+		base[i] += byte(i / testCluster)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	be := binary.BigEndian
+	img := make([]byte, 8*testCluster)
+	hdr := img[:testCluster]
+	be.PutUint32(hdr[0:], qcow2Magic)
+	be.PutUint32(hdr[4:], 3)
+	be.PutUint64(hdr[8:], 512) // backing file name
+	be.PutUint32(hdr[16:], uint32(copy(hdr[512:], "base.raw")))
+	be.PutUint32(hdr[20:], 16)
+	be.PutUint64(hdr[24:], 4*testCluster)
+	be.PutUint32(hdr[36:], 1)             // L1 entries
+	be.PutUint64(hdr[40:], 1*testCluster) // active L1
+	be.PutUint32(hdr[60:], 1)             // snapshots
+	be.PutUint64(hdr[64:], 4*testCluster)
+	be.PutUint32(hdr[96:], 4)
+	be.PutUint32(hdr[100:], 104)
+	be.PutUint32(hdr[104:], extBackingFormat)
+	be.PutUint32(hdr[108:], uint32(copy(hdr[112:], "raw")))
+
+	// Active L1 and L2.
+	be.PutUint64(img[1*testCluster:], 2*testCluster)
+	l2 := img[2*testCluster:]
+	be.PutUint64(l2[0:], 5*testCluster)
+	be.PutUint64(l2[16:], l2ReadsZeroes)
+	copy(img[5*testCluster:6*testCluster], bytes.Repeat([]byte{'O'}, testCluster))
+
+	var z bytes.Buffer
+	w, _ := flate.NewWriter(&z, flate.BestCompression)
+	w.Write(bytes.Repeat([]byte{'Z'}, testCluster))
+	w.Close()
+	host := uint64(7 * testCluster)
+	copy(img[host:], z.Bytes())
+	sectors := uint64(z.Len()+511)/512 - 1
+	be.PutUint64(l2[24:], l2Compressed|sectors<<54|host)
+
+	// Snapshot "before": its own L1 and L2 with cluster 0 at 6C.
+	snap := img[4*testCluster:]
+	be.PutUint64(snap[0:], 3*testCluster+testCluster/2)
+	be.PutUint32(snap[8:], 1)
+	be.PutUint16(snap[12:], 1)
+	be.PutUint16(snap[14:], 6)
+	be.PutUint32(snap[36:], 16)
+	be.PutUint64(snap[48:], 4*testCluster)
+	copy(snap[56:], "1before")
+	be.PutUint64(img[3*testCluster+testCluster/2:], 3*testCluster)
+	be.PutUint64(img[3*testCluster:], 6*testCluster)
+	copy(img[6*testCluster:7*testCluster], bytes.Repeat([]byte{'S'}, testCluster))
+
+	path := filepath.Join(dir, "overlay.qcow2")
+	if err := os.WriteFile(path, img[:host+uint64(z.Len())], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestQcow2(t *testing.T) {
+	dir := t.TempDir()
+	path := writeQcow2(t, dir)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Format() != "qcow2" || img.Size() != 4*testCluster || img.Backing() == nil || img.Backing().Format() != "raw" {
+		t.Fatalf("Open = %s %d backing %v", img.Format(), img.Size(), img.Backing())
+	}
+	if b, err := BackingFile(path); err != nil || b != filepath.Join(dir, "base.raw") {
+		t.Fatalf("BackingFile = %q, %v", b, err)
+	}
+
+	check := func(t *testing.T, img *Image, want ...byte) {
+		t.Helper()
+		got := make([]byte, 4*testCluster)
+		if n, err := img.ReadAt(got, 0); err != nil || n != len(got) {
+			t.Fatalf("ReadAt = %d, %v", n, err)
+		}
+		for i, c := range want {
+			if cl := got[i*testCluster : (i+1)*testCluster]; !bytes.Equal(cl, bytes.Repeat([]byte{c}, testCluster)) {
+				t.Errorf("cluster %d starts %q, want %q", i, cl[:4], c)
+			}
+		}
+	}
+	check(t, img, 'O', 'c', 0, 'Z')
+
+	// Reads spanning clusters and the end of the disk.
+	p := make([]byte, 8)
+	if n, err := img.ReadAt(p, testCluster-4); err != nil || n != 8 || string(p) != "OOOOcccc" {
+		t.Errorf("ReadAt across clusters = %q, %v", p[:n], err)
+	}
+	if n, err := img.ReadAt(p, 4*testCluster-4); n != 4 || err == nil {
+		t.Errorf("ReadAt past end = %d, %v; want 4, EOF", n, err)
+	}
+
+	snaps := img.Snapshots()
+	if len(snaps) != 1 || snaps[0].ID != "1" || snaps[0].Name != "before" || snaps[0].DiskSize != 4*testCluster {
+		t.Fatalf("Snapshots = %+v", snaps)
+	}
+	view, err := img.AtSnapshot("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, view, 'S', 'c', 'd', 'e')
+	check(t, img, 'O', 'c', 0, 'Z')
+
+	snap, err := OpenSnapshot(path, "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, snap, 'S', 'c', 'd', 'e')
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSnapshot(path, "after"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("OpenSnapshot(after) = %v, want ErrSnapshotNotFound", err)
+	}
+}
@@ -0,0 +1,219 @@
+// Package events provides an in-process lifecycle event bus for sandboxes,
+// commands, Ansible jobs, SSH access and approvals, plus outbound webhook delivery.
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Type identifies the kind of lifecycle event.
+type Type string
+
+const (
+	// Sandbox lifecycle
+	TypeSandboxCreated    Type = "sandbox.created"
+	TypeSandboxStarting   Type = "sandbox.starting"
+	TypeSandboxRunning    Type = "sandbox.running"
+	TypeSandboxStopped    Type = "sandbox.stopped"
+	TypeSandboxDestroyed  Type = "sandbox.destroyed"
+	TypeSandboxError      Type = "sandbox.error"
+	TypeSandboxResized    Type = "sandbox.resized"
+	TypeSandboxPaused     Type = "sandbox.paused"
+	TypeSandboxResumed    Type = "sandbox.resumed"
+	TypeSandboxHibernated Type = "sandbox.hibernated"
+	TypeSandboxForked     Type = "sandbox.forked"
+	TypeSandboxPromoted   Type = "sandbox.promoted"
+
+	// Snapshots and diffs
+	TypeSnapshotCreated  Type = "snapshot.created"
+	TypeSnapshotReverted Type = "snapshot.reverted"
+	TypeDiffCreated      Type = "diff.created"
+
+	// Command execution
+	TypeCommandExited Type = "command.exited"
+
+	// Ansible jobs
+	TypeAnsibleJobCreated  Type = "ansible.job.created"
+	TypeAnsibleJobStarted  Type = "ansible.job.started"
+	TypeAnsibleJobFinished Type = "ansible.job.finished"
+	TypeAnsibleJobFailed   Type = "ansible.job.failed"
+
+	// VM-to-container clone jobs
+	TypeCloneJobCreated    Type = "clone.job.created"
+	TypeCloneJobStage      Type = "clone.job.stage"
+	TypeCloneJobFinished   Type = "clone.job.finished"
+	TypeCloneJobFailed     Type = "clone.job.failed"
+	TypeCloneJobResumed    Type = "clone.job.resumed"
+	TypeCloneJobRolledBack Type = "clone.job.rolled_back"
+
+	// SSH access
+	TypeAccessGranted  Type = "access.granted"
+	TypeAccessRevoked  Type = "access.revoked"
+	TypeSessionStarted Type = "access.session.started"
+	TypeSessionEnded   Type = "access.session.ended"
+
+	// Human approvals
+	TypeApprovalRequested Type = "approval.requested"
+	TypeApprovalApproved  Type = "approval.approved"
+	TypeApprovalDenied    Type = "approval.denied"
+	TypeApprovalExpired   Type = "approval.expired"
+	TypeApprovalExecuted  Type = "approval.executed"
+)
+
+// Event is a single lifecycle notification.
+type Event struct {
+	ID        string         `json:"id"`
+	Type      Type           `json:"type"`
+	SandboxID string         `json:"sandbox_id,omitempty"`
+	JobID     string         `json:"job_id,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// Publisher emits events. Services depend on this interface rather than on Bus
+// so that publishing can be disabled or replaced in tests.
+type Publisher interface {
+	Publish(ctx context.Context, ev Event)
+}
+
+// Discard is a Publisher that drops every event.
+var Discard Publisher = discard{}
+
+type discard struct{}
+
+func (discard) Publish(context.Context, Event) {}
+
+// Filter selects which events a subscriber receives.
+// Empty fields match everything.
+type Filter struct {
+	// Types restricts delivery to these event types. A trailing ".*" matches a prefix
+	// (e.g. "sandbox.*").
+	Types []string
+
+	// SandboxID restricts delivery to events for a single sandbox.
+	SandboxID string
+}
+
+// Matches reports whether ev passes the filter.
+func (f Filter) Matches(ev Event) bool {
+	if f.SandboxID != "" && ev.SandboxID != f.SandboxID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == "*" || t == string(ev.Type) {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, ".*"); ok && strings.HasPrefix(string(ev.Type), prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus is an in-memory fan-out event bus. Publishing never blocks: events are
+// dropped for subscribers whose buffers are full.
+type Bus struct {
+	mu        sync.RWMutex
+	subs      map[uint64]*subscription
+	nextID    uint64
+	bufSize   int
+	timeNowFn func() time.Time
+}
+
+type subscription struct {
+	filter Filter
+	ch     chan Event
+}
+
+// BusOption configures the Bus during construction.
+type BusOption func(*Bus)
+
+// WithBufferSize sets the per-subscriber channel buffer (default 64).
+func WithBufferSize(n int) BusOption {
+	return func(b *Bus) {
+		if n > 0 {
+			b.bufSize = n
+		}
+	}
+}
+
+// WithBusTimeNow overrides the clock (useful for tests).
+func WithBusTimeNow(fn func() time.Time) BusOption {
+	return func(b *Bus) { b.timeNowFn = fn }
+}
+
+// NewBus creates an event bus.
+func NewBus(opts ...BusOption) *Bus {
+	b := &Bus{
+		subs:      make(map[uint64]*subscription),
+		bufSize:   64,
+		timeNowFn: time.Now,
+	}
+	for _, o := range opts {
+		o(b)
+	}
+	return b
+}
+
+// Publish implements Publisher. Missing IDs and timestamps are filled in.
+func (b *Bus) Publish(_ context.Context, ev Event) {
+	if ev.ID == "" {
+		ev.ID = fmt.Sprintf("EVT-%s", uuid.NewString())
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = b.timeNowFn().UTC()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs {
+		if !sub.filter.Matches(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a subscriber and returns its channel along with a cancel
+// function that must be called to release the subscription.
+func (b *Bus) Subscribe(filter Filter) (<-chan Event, func()) {
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	sub := &subscription{filter: filter, ch: make(chan Event, b.bufSize)}
+	b.subs[id] = sub
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+// SubscriberCount returns the number of active subscribers.
+func (b *Bus) SubscriberCount() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+// Verify Bus implements Publisher at compile time.
+var _ Publisher = (*Bus)(nil)
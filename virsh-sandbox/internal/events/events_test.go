@@ -0,0 +1,78 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFilterMatches(t *testing.T) {
+	ev := Event{Type: TypeSandboxRunning, SandboxID: "SBX-1"}
+
+	cases := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{Types: []string{"*"}}, true},
+		{Filter{Types: []string{"sandbox.running"}}, true},
+		{Filter{Types: []string{"sandbox.*"}}, true},
+		{Filter{Types: []string{"sandbox"}}, false},
+		{Filter{Types: []string{"access.*"}}, false},
+		{Filter{SandboxID: "SBX-1"}, true},
+		{Filter{SandboxID: "SBX-2"}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Matches(ev); got != c.want {
+			t.Errorf("Filter%+v.Matches = %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestBusPublishSubscribe(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	bus := NewBus(WithBusTimeNow(func() time.Time { return now }))
+
+	ch, cancel := bus.Subscribe(Filter{Types: []string{"command.*"}})
+	defer cancel()
+
+	bus.Publish(context.Background(), Event{Type: TypeSandboxCreated})
+	bus.Publish(context.Background(), Event{Type: TypeCommandExited, SandboxID: "SBX-1"})
+
+	select {
+	case ev := <-ch:
+		if ev.Type != TypeCommandExited {
+			t.Fatalf("got event type %q, want %q", ev.Type, TypeCommandExited)
+		}
+		if ev.ID == "" {
+			t.Error("event ID was not assigned")
+		}
+		if !ev.Timestamp.Equal(now) {
+			t.Errorf("timestamp = %v, want %v", ev.Timestamp, now)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	cancel()
+	if n := bus.SubscriberCount(); n != 0 {
+		t.Errorf("SubscriberCount = %d after cancel, want 0", n)
+	}
+}
+
+func TestSign(t *testing.T) {
+	a := Sign("secret", "1700000000", []byte(`{"id":"EVT-1"}`))
+	b := Sign("secret", "1700000000", []byte(`{"id":"EVT-1"}`))
+	if a != b {
+		t.Fatalf("Sign is not deterministic: %s != %s", a, b)
+	}
+	if len(a) != 64 {
+		t.Errorf("signature length = %d, want 64 hex chars", len(a))
+	}
+	if Sign("other", "1700000000", []byte(`{"id":"EVT-1"}`)) == a {
+		t.Error("signature does not depend on secret")
+	}
+	if Sign("secret", "1700000001", []byte(`{"id":"EVT-1"}`)) == a {
+		t.Error("signature does not depend on timestamp")
+	}
+}
@@ -0,0 +1,395 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/store"
+)
+
+// Headers sent with every webhook delivery.
+const (
+	HeaderEventID   = "X-Sandbox-Event-Id"
+	HeaderEventType = "X-Sandbox-Event-Type"
+	HeaderTimestamp = "X-Sandbox-Timestamp"
+	HeaderSignature = "X-Sandbox-Signature"
+)
+
+// WebhookStore is the subset of store.DataStore used by the webhook service.
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, wh *store.Webhook) error
+	GetWebhook(ctx context.Context, id string) (*store.Webhook, error)
+	ListWebhooks(ctx context.Context, opt *store.ListOptions) ([]*store.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	SaveWebhookDelivery(ctx context.Context, d *store.WebhookDelivery) error
+	ListWebhookDeliveries(ctx context.Context, webhookID string, opt *store.ListOptions) ([]*store.WebhookDelivery, error)
+}
+
+// WebhookConfig controls webhook delivery behaviour.
+type WebhookConfig struct {
+	// MaxAttempts is the number of delivery attempts per event (default 5).
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry (default 1s).
+	// Each subsequent retry doubles the delay up to MaxBackoff.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the retry delay (default 1m).
+	MaxBackoff time.Duration
+
+	// RequestTimeout bounds a single HTTP delivery attempt (default 10s).
+	RequestTimeout time.Duration
+
+	// MaxConcurrent limits in-flight deliveries across all webhooks (default 16).
+	MaxConcurrent int
+}
+
+// WebhookService manages webhook registrations and delivers bus events to them.
+type WebhookService struct {
+	store     WebhookStore
+	bus       *Bus
+	client    *http.Client
+	cfg       WebhookConfig
+	logger    *slog.Logger
+	timeNowFn func() time.Time
+	sem       chan struct{}
+
+	// hooks caches the registrations dispatch matches events against. It
+	// is dropped whenever a webhook is registered or deleted.
+	hooksMu  sync.Mutex
+	hooks    []*store.Webhook
+	hooksGen uint64
+}
+
+// WebhookOption configures the WebhookService during construction.
+type WebhookOption func(*WebhookService)
+
+// WithHTTPClient overrides the HTTP client used for deliveries.
+func WithHTTPClient(c *http.Client) WebhookOption {
+	return func(s *WebhookService) { s.client = c }
+}
+
+// WithWebhookLogger overrides the logger.
+func WithWebhookLogger(l *slog.Logger) WebhookOption {
+	return func(s *WebhookService) { s.logger = l }
+}
+
+// WithWebhookTimeNow overrides the clock (useful for tests).
+func WithWebhookTimeNow(fn func() time.Time) WebhookOption {
+	return func(s *WebhookService) { s.timeNowFn = fn }
+}
+
+// NewWebhookService constructs a webhook service reading registrations from st
+// and consuming events from bus.
+func NewWebhookService(st WebhookStore, bus *Bus, cfg WebhookConfig, opts ...WebhookOption) *WebhookService {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 10 * time.Second
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 16
+	}
+	s := &WebhookService{
+		store:     st,
+		bus:       bus,
+		client:    &http.Client{},
+		cfg:       cfg,
+		logger:    slog.Default(),
+		timeNowFn: time.Now,
+		sem:       make(chan struct{}, cfg.MaxConcurrent),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// RegisterWebhookRequest describes a new webhook registration.
+type RegisterWebhookRequest struct {
+	URL        string
+	Secret     string // generated when empty
+	EventTypes []string
+	SandboxID  string
+}
+
+// RegisterWebhook validates and persists a webhook. The returned record carries
+// the signing secret; it is not retrievable afterwards.
+func (s *WebhookService) RegisterWebhook(ctx context.Context, req RegisterWebhookRequest) (*store.Webhook, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	secret := req.Secret
+	if secret == "" {
+		secret, err = generateSecret()
+		if err != nil {
+			return nil, fmt.Errorf("generate secret: %w", err)
+		}
+	}
+	now := s.timeNowFn().UTC()
+	wh := &store.Webhook{
+		ID:         fmt.Sprintf("WHK-%s", id.Short()),
+		URL:        req.URL,
+		Secret:     secret,
+		EventTypes: req.EventTypes,
+		Active:     true,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if req.SandboxID != "" {
+		sid := req.SandboxID
+		wh.SandboxID = &sid
+	}
+	if err := s.store.CreateWebhook(ctx, wh); err != nil {
+		return nil, fmt.Errorf("persist webhook: %w", err)
+	}
+	s.invalidateHooks()
+	return wh, nil
+}
+
+// GetWebhook returns a registered webhook.
+func (s *WebhookService) GetWebhook(ctx context.Context, id string) (*store.Webhook, error) {
+	return s.store.GetWebhook(ctx, id)
+}
+
+// ListWebhooks returns all registered webhooks.
+func (s *WebhookService) ListWebhooks(ctx context.Context, opt *store.ListOptions) ([]*store.Webhook, error) {
+	return s.store.ListWebhooks(ctx, opt)
+}
+
+// DeleteWebhook removes a webhook registration.
+func (s *WebhookService) DeleteWebhook(ctx context.Context, id string) error {
+	if err := s.store.DeleteWebhook(ctx, id); err != nil {
+		return err
+	}
+	s.invalidateHooks()
+	return nil
+}
+
+// ListDeliveries returns the delivery log for a webhook.
+func (s *WebhookService) ListDeliveries(ctx context.Context, webhookID string, opt *store.ListOptions) ([]*store.WebhookDelivery, error) {
+	return s.store.ListWebhookDeliveries(ctx, webhookID, opt)
+}
+
+// Run consumes events from the bus and dispatches them until ctx is cancelled.
+func (s *WebhookService) Run(ctx context.Context) {
+	ch, cancel := s.bus.Subscribe(Filter{})
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			s.dispatch(ctx, ev)
+		}
+	}
+}
+
+// dispatch starts a delivery for every active webhook matching ev.
+func (s *WebhookService) dispatch(ctx context.Context, ev Event) {
+	hooks, err := s.registeredHooks(ctx)
+	if err != nil {
+		s.logger.Error("list webhooks", "error", err, "event_id", ev.ID)
+		return
+	}
+	for _, wh := range hooks {
+		if !wh.Active || !webhookFilter(wh).Matches(ev) {
+			continue
+		}
+		go s.deliver(ctx, wh, ev)
+	}
+}
+
+// registeredHooks returns the cached webhook registrations, loading them from
+// the store when the cache is empty.
+func (s *WebhookService) registeredHooks(ctx context.Context) ([]*store.Webhook, error) {
+	s.hooksMu.Lock()
+	hooks, gen := s.hooks, s.hooksGen
+	s.hooksMu.Unlock()
+	if hooks != nil {
+		return hooks, nil
+	}
+
+	hooks, err := s.store.ListWebhooks(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hooks == nil {
+		hooks = []*store.Webhook{}
+	}
+	s.hooksMu.Lock()
+	// A registration changed while the list was loading; keep it uncached.
+	if s.hooksGen == gen {
+		s.hooks = hooks
+	}
+	s.hooksMu.Unlock()
+	return hooks, nil
+}
+
+// invalidateHooks drops the cached registrations.
+func (s *WebhookService) invalidateHooks() {
+	s.hooksMu.Lock()
+	s.hooks = nil
+	s.hooksGen++
+	s.hooksMu.Unlock()
+}
+
+// deliver posts ev to wh, retrying with exponential backoff and recording
+// every attempt in the delivery log.
+func (s *WebhookService) deliver(ctx context.Context, wh *store.Webhook, ev Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		s.logger.Error("marshal event", "error", err, "event_id", ev.ID)
+		return
+	}
+
+	for attempt := 1; attempt <= s.cfg.MaxAttempts; attempt++ {
+		select {
+		case s.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		status, elapsed, sendErr := s.send(ctx, wh, ev, body)
+		<-s.sem
+
+		rec := &store.WebhookDelivery{
+			ID:         fmt.Sprintf("WHD-%s", id.Short()),
+			WebhookID:  wh.ID,
+			EventID:    ev.ID,
+			EventType:  string(ev.Type),
+			Attempt:    attempt,
+			StatusCode: status,
+			Success:    sendErr == nil,
+			DurationMS: elapsed.Milliseconds(),
+			CreatedAt:  s.timeNowFn().UTC(),
+		}
+		if sendErr != nil {
+			msg := sendErr.Error()
+			rec.Error = &msg
+		}
+		if err := s.store.SaveWebhookDelivery(ctx, rec); err != nil {
+			s.logger.Error("save webhook delivery", "error", err, "webhook_id", wh.ID)
+		}
+
+		if sendErr == nil || !retryable(status) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.backoff(attempt)):
+		}
+	}
+	s.logger.Warn("webhook delivery exhausted retries", "webhook_id", wh.ID, "event_id", ev.ID)
+}
+
+// backoff returns the delay after the given failed attempt: InitialBackoff,
+// doubled for each further attempt and capped at MaxBackoff.
+func (s *WebhookService) backoff(attempt int) time.Duration {
+	d := s.cfg.InitialBackoff
+	for i := 1; i < attempt && d < s.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, s.cfg.MaxBackoff)
+}
+
+// send performs a single signed delivery attempt.
+func (s *WebhookService) send(ctx context.Context, wh *store.Webhook, ev Event, body []byte) (int, time.Duration, error) {
+	start := s.timeNowFn()
+	reqCtx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	ts := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventID, ev.ID)
+	req.Header.Set(HeaderEventType, string(ev.Type))
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(wh.Secret, ts, body))
+
+	resp, err := s.client.Do(req)
+	elapsed := s.timeNowFn().Sub(start)
+	if err != nil {
+		return 0, elapsed, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, elapsed, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, elapsed, nil
+}
+
+// Sign computes the hex HMAC-SHA256 of "<timestamp>.<body>" with secret.
+// Receivers verify a delivery by recomputing this over the X-Sandbox-Timestamp
+// header and the raw request body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryable reports whether a failed attempt with the given status should be retried.
+// Network errors (status 0), timeouts, throttling and server errors are retried;
+// other client errors are not.
+func retryable(status int) bool {
+	switch {
+	case status == 0:
+		return true
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return true
+	case status >= 500:
+		return true
+	default:
+		return false
+	}
+}
+
+func webhookFilter(wh *store.Webhook) Filter {
+	f := Filter{Types: wh.EventTypes}
+	if wh.SandboxID != nil {
+		f.SandboxID = *wh.SandboxID
+	}
+	return f
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,208 @@
+package events
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"virsh-sandbox/internal/store"
+)
+
+// memWebhookStore is an in-memory WebhookStore that counts ListWebhooks calls.
+type memWebhookStore struct {
+	mu         sync.Mutex
+	hooks      []*store.Webhook
+	deliveries []*store.WebhookDelivery
+	lists      int
+}
+
+func (m *memWebhookStore) CreateWebhook(_ context.Context, wh *store.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, wh)
+	return nil
+}
+
+func (m *memWebhookStore) GetWebhook(_ context.Context, id string) (*store.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, wh := range m.hooks {
+		if wh.ID == id {
+			return wh, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (m *memWebhookStore) ListWebhooks(context.Context, *store.ListOptions) ([]*store.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lists++
+	return append([]*store.Webhook(nil), m.hooks...), nil
+}
+
+func (m *memWebhookStore) DeleteWebhook(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, wh := range m.hooks {
+		if wh.ID == id {
+			m.hooks = append(m.hooks[:i], m.hooks[i+1:]...)
+			return nil
+		}
+	}
+	return store.ErrNotFound
+}
+
+func (m *memWebhookStore) SaveWebhookDelivery(_ context.Context, d *store.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = append(m.deliveries, d)
+	return nil
+}
+
+func (m *memWebhookStore) ListWebhookDeliveries(_ context.Context, webhookID string, _ *store.ListOptions) ([]*store.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*store.WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.WebhookID == webhookID {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// received is a request seen by statusServer.
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// statusServer answers each request with the next status in statuses,
+// repeating the last one, and reports every request it receives.
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, chan received) {
+	t.Helper()
+	var n atomic.Int32
+	reqs := make(chan received, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- received{r.Header, body}
+		w.WriteHeader(statuses[min(int(n.Add(1))-1, len(statuses)-1)])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	ev := Event{ID: "EVT-1", Type: TypeSandboxRunning, SandboxID: "SBX-1"}
+
+	cases := []struct {
+		name     string
+		statuses []int
+		want     []bool // success of each recorded attempt
+	}{
+		{"first attempt succeeds", []int{200}, []bool{true}},
+		{"retries server errors", []int{500, 503, 204}, []bool{false, false, true}},
+		{"retries throttling", []int{429, 200}, []bool{false, true}},
+		{"client error is final", []int{400, 200}, []bool{false}},
+		{"gives up after max attempts", []int{502}, []bool{false, false, false}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, reqs := statusServer(t, c.statuses...)
+			st := &memWebhookStore{}
+			svc := NewWebhookService(st, NewBus(), WebhookConfig{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     time.Millisecond,
+			})
+			wh := &store.Webhook{ID: "WHK-1", URL: srv.URL, Secret: "s3cret", Active: true}
+			svc.deliver(context.Background(), wh, ev)
+
+			got, _ := svc.ListDeliveries(context.Background(), "WHK-1", nil)
+			if len(got) != len(c.want) {
+				t.Fatalf("recorded %d attempts, want %d", len(got), len(c.want))
+			}
+			for i, d := range got {
+				if d.Attempt != i+1 || d.Success != c.want[i] || d.EventID != "EVT-1" || d.EventType != string(TypeSandboxRunning) {
+					t.Errorf("attempt %d = %+v", i+1, d)
+				}
+				if want := c.statuses[min(i, len(c.statuses)-1)]; d.StatusCode != want {
+					t.Errorf("attempt %d status = %d, want %d", i+1, d.StatusCode, want)
+				}
+				if d.Success != (d.Error == nil) {
+					t.Errorf("attempt %d success %v with error %v", i+1, d.Success, d.Error)
+				}
+			}
+
+			r := <-reqs
+			if r.header.Get(HeaderEventID) != "EVT-1" || r.header.Get(HeaderEventType) != string(TypeSandboxRunning) {
+				t.Errorf("headers = %v", r.header)
+			}
+			if sig := r.header.Get(HeaderSignature); sig != "sha256="+Sign("s3cret", r.header.Get(HeaderTimestamp), r.body) {
+				t.Errorf("signature %q does not verify", sig)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	svc := NewWebhookService(&memWebhookStore{}, NewBus(), WebhookConfig{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	})
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := svc.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestWebhookDispatchCachesRegistrations(t *testing.T) {
+	srv, reqs := statusServer(t, 200)
+	st := &memWebhookStore{}
+	svc := NewWebhookService(st, NewBus(), WebhookConfig{})
+	ctx := context.Background()
+
+	wh, err := svc.RegisterWebhook(ctx, RegisterWebhookRequest{URL: srv.URL, EventTypes: []string{"sandbox.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := func() {
+		t.Helper()
+		select {
+		case <-reqs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+	}
+
+	svc.dispatch(ctx, Event{ID: "EVT-1", Type: TypeSandboxCreated})
+	wait()
+	svc.dispatch(ctx, Event{ID: "EVT-2", Type: TypeSandboxRunning})
+	wait()
+	svc.dispatch(ctx, Event{ID: "EVT-3", Type: TypeCommandExited}) // filtered out
+	if st.lists != 1 {
+		t.Fatalf("ListWebhooks called %d times for three events, want 1", st.lists)
+	}
+
+	// Deleting the webhook drops the cache; later events reach nobody.
+	if err := svc.DeleteWebhook(ctx, wh.ID); err != nil {
+		t.Fatal(err)
+	}
+	svc.dispatch(ctx, Event{ID: "EVT-4", Type: TypeSandboxStopped})
+	if st.lists != 2 {
+		t.Fatalf("ListWebhooks called %d times after delete, want 2", st.lists)
+	}
+	select {
+	case r := <-reqs:
+		t.Fatalf("delivered %s to a deleted webhook", r.header.Get(HeaderEventID))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
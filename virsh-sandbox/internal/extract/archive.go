@@ -98,10 +98,17 @@ func (a *Archiver) createTarArchive(ctx context.Context, sourcePath, archivePath
 	// -C: change to directory before archiving
 	// .: archive current directory contents
 
-	args := []string{
-		"-cf", archivePath,
-		"--numeric-owner",
-	}
+	args := append([]string{"-cf", archivePath}, a.tarFlags(ctx)...)
+
+	// Add source directory
+	args = append(args, "-C", sourcePath, ".")
+	return a.runTar(ctx, args)
+}
+
+// tarFlags returns the ownership and metadata flags every archive is created
+// with, limited to what the installed tar supports.
+func (a *Archiver) tarFlags(ctx context.Context) []string {
+	args := []string{"--numeric-owner"}
 
 	// Check if tar supports xattrs
 	if a.supportsXattrs(ctx) {
@@ -117,10 +124,11 @@ func (a *Archiver) createTarArchive(ctx context.Context, sourcePath, archivePath
 	if a.supportsSELinux(ctx) {
 		args = append(args, "--selinux")
 	}
+	return args
+}
 
-	// Add source directory
-	args = append(args, "-C", sourcePath, ".")
-
+// runTar runs tar with args.
+func (a *Archiver) runTar(ctx context.Context, args []string) error {
 	cmd := exec.CommandContext(ctx, a.tarPath, args...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -132,6 +140,11 @@ func (a *Archiver) createTarArchive(ctx context.Context, sourcePath, archivePath
 	return nil
 }
 
+// workflowArchiveError reports a create_archive failure.
+func workflowArchiveError(detail string) error {
+	return workflow.NewWorkflowError(workflow.StageCreateArchive, workflow.ErrArchiveFailed, detail)
+}
+
 // supportsXattrs checks if tar supports --xattrs option.
 func (a *Archiver) supportsXattrs(ctx context.Context) bool {
 	cmd := exec.CommandContext(ctx, a.tarPath, "--xattrs", "--help")
@@ -0,0 +1,251 @@
+package extract
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// blockDevice is a filesystem found on an attached disk: a partition, the
+// whole device, or an LVM logical volume.
+type blockDevice struct {
+	Path      string
+	FSType    string
+	UUID      string
+	Label     string
+	PartUUID  string
+	PartLabel string
+
+	// PartNum is the partition number, 0 for whole devices and volumes.
+	PartNum int
+
+	// Size is in 512-byte sectors.
+	Size int64
+
+	// Aliases are other names of the device in the guest, such as
+	// /dev/mapper/vg-root for the logical volume /dev/vg/root.
+	Aliases []string
+}
+
+// fstabEntry is one line of a guest's /etc/fstab.
+type fstabEntry struct {
+	Spec    string
+	Target  string
+	FSType  string
+	Options []string
+}
+
+// hasOption reports whether the entry has option opt.
+func (e fstabEntry) hasOption(opt string) bool {
+	for _, o := range e.Options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// btrfsOptions returns the subvolume options to pass through when mounting
+// the entry.
+func (e fstabEntry) btrfsOptions() []string {
+	var out []string
+	for _, o := range e.Options {
+		if strings.HasPrefix(o, "subvol=") || strings.HasPrefix(o, "subvolid=") {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// localFSTypes are the fstab types mounted under the root. "auto" lets
+// mount probe the device.
+var localFSTypes = map[string]bool{
+	"ext2": true, "ext3": true, "ext4": true,
+	"xfs": true, "btrfs": true, "vfat": true,
+	"f2fs": true, "jfs": true, "reiserfs": true,
+	"auto": true,
+}
+
+// rootFSTypes are the filesystem types probed for the guest's root.
+var rootFSTypes = map[string]bool{
+	"ext2": true, "ext3": true, "ext4": true,
+	"xfs": true, "btrfs": true,
+}
+
+// parseFstab parses fstab content. Comments and malformed lines are skipped;
+// octal escapes such as \040 are decoded.
+func parseFstab(data []byte) []fstabEntry {
+	var out []fstabEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		e := fstabEntry{
+			Spec:   unescapeFstab(fields[0]),
+			Target: unescapeFstab(fields[1]),
+			FSType: fields[2],
+		}
+		if len(fields) > 3 {
+			e.Options = strings.Split(fields[3], ",")
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// unescapeFstab decodes the \ooo octal escapes fstab and /proc/mounts use
+// for whitespace and backslashes.
+func unescapeFstab(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// extraMounts returns the fstab entries to mount below the root: local
+// filesystems other than the root itself, parents before children.
+func extraMounts(entries []fstabEntry) []fstabEntry {
+	var out []fstabEntry
+	for _, e := range entries {
+		target := path.Clean(e.Target)
+		if !path.IsAbs(target) || target == "/" {
+			continue
+		}
+		if !localFSTypes[e.FSType] || e.hasOption("noauto") || e.hasOption("bind") {
+			continue
+		}
+		e.Target = target
+		out = append(out, e)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return strings.Count(out[i].Target, "/") < strings.Count(out[j].Target, "/")
+	})
+	return out
+}
+
+// guestPartition matches the partition device names a guest uses for its
+// first disk, capturing the partition number.
+var guestPartition = regexp.MustCompile(`^/dev/(?:[svh]da|xvda|nvme0n1p|mmcblk0p)(\d+)$`)
+
+// resolveSpec finds the device an fstab spec names: UUID=, LABEL=,
+// PARTUUID= and PARTLABEL= tags, their /dev/disk/by-* links, LVM paths, or a
+// partition of the guest's disk by number.
+func resolveSpec(spec string, devs []blockDevice) (blockDevice, bool) {
+	match := func(f func(blockDevice) bool) (blockDevice, bool) {
+		for _, d := range devs {
+			if f(d) {
+				return d, true
+			}
+		}
+		return blockDevice{}, false
+	}
+	key, value, tagged := strings.Cut(spec, "=")
+	if !tagged {
+		for prefix, k := range map[string]string{
+			"/dev/disk/by-uuid/":      "UUID",
+			"/dev/disk/by-label/":     "LABEL",
+			"/dev/disk/by-partuuid/":  "PARTUUID",
+			"/dev/disk/by-partlabel/": "PARTLABEL",
+		} {
+			if rest, ok := strings.CutPrefix(spec, prefix); ok {
+				key, value, tagged = k, unescapeUdev(rest), true
+			}
+		}
+	}
+	value = strings.Trim(value, `"`)
+	if tagged {
+		switch strings.ToUpper(key) {
+		case "UUID":
+			return match(func(d blockDevice) bool { return d.UUID != "" && strings.EqualFold(d.UUID, value) })
+		case "LABEL":
+			return match(func(d blockDevice) bool { return d.Label != "" && d.Label == value })
+		case "PARTUUID":
+			return match(func(d blockDevice) bool { return d.PartUUID != "" && strings.EqualFold(d.PartUUID, value) })
+		case "PARTLABEL":
+			return match(func(d blockDevice) bool { return d.PartLabel != "" && d.PartLabel == value })
+		}
+		return blockDevice{}, false
+	}
+	if d, ok := match(func(d blockDevice) bool {
+		for _, a := range d.Aliases {
+			if a == spec {
+				return true
+			}
+		}
+		return false
+	}); ok {
+		return d, true
+	}
+	if m := guestPartition.FindStringSubmatch(spec); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return match(func(d blockDevice) bool { return d.PartNum == n })
+	}
+	return blockDevice{}, false
+}
+
+// unescapeUdev decodes the \xHH escapes in /dev/disk/by-label names.
+func unescapeUdev(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// lvmAliases returns the names a guest may use for logical volume lv in
+// volume group vg.
+func lvmAliases(vg, lv string) []string {
+	esc := func(s string) string { return strings.ReplaceAll(s, "-", "--") }
+	return []string{
+		"/dev/" + vg + "/" + lv,
+		"/dev/mapper/" + esc(vg) + "-" + esc(lv),
+	}
+}
+
+// mountsUnder returns the mount points in a /proc/self/mounts table that
+// are root or below it, deepest first, once per stacked mount.
+func mountsUnder(table, root string) []string {
+	var out []string
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mp := unescapeFstab(fields[1])
+		if mp == root || strings.HasPrefix(mp, root+"/") {
+			out = append(out, mp)
+		}
+	}
+	// Later mounts stack on earlier ones: reverse, then order by depth.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return strings.Count(out[i], "/") > strings.Count(out[j], "/")
+	})
+	return out
+}
@@ -0,0 +1,91 @@
+package extract
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFstabMounts(t *testing.T) {
+	fstab := `# /etc/fstab: static file system information.
+/dev/mapper/vg--sys-root  /          ext4  defaults,errors=remount-ro 0 1
+UUID=1B2C-3D4E            /boot/efi  vfat  umask=0077 0 1
+LABEL=boot                /boot      ext4  defaults 0 2
+UUID=5a1f0c2e-9d7b-4f43-8a2b-0c3d4e5f6a7b /home btrfs subvol=@home,compress=zstd 0 0
+/dev/vg-sys/var           /var       xfs   defaults 0 2
+/dev/vdb1                 /srv/data  ext4  nofail 0 2
+/dev/disk/by-label/My\x20Logs /var/log ext4 defaults 0 2
+/dev/vda4                 none       swap  sw 0 0
+proc                      /proc      proc  defaults 0 0
+tmpfs                     /tmp       tmpfs defaults 0 0
+server:/export            /mnt/nfs   nfs   defaults 0 0
+/dev/vda5                 /mnt/usb   auto  noauto 0 0
+/srv/data                 /data      none  bind 0 0
+UUID=deadbeef             /mnt/My\040Files ext4 defaults 0 2
+`
+	devs := []blockDevice{
+		{Path: "/dev/nbd0p1", PartNum: 1, FSType: "vfat", UUID: "1B2C-3D4E"},
+		{Path: "/dev/nbd0p2", PartNum: 2, FSType: "ext4", Label: "boot"},
+		{Path: "/dev/nbd0p3", PartNum: 3, FSType: "btrfs", UUID: "5A1F0C2E-9D7B-4F43-8A2B-0C3D4E5F6A7B"},
+		{Path: "/dev/nbd0p5", PartNum: 5, FSType: "ext4", Label: "My Logs"},
+		{Path: "/dev/vg-sys/root", FSType: "ext4", Aliases: lvmAliases("vg-sys", "root")},
+		{Path: "/dev/vg-sys/var", FSType: "xfs", Aliases: lvmAliases("vg-sys", "var")},
+	}
+
+	var got []string
+	for _, e := range extraMounts(parseFstab([]byte(fstab))) {
+		dev := "-"
+		if d, ok := resolveSpec(e.Spec, devs); ok {
+			dev = d.Path
+		}
+		got = append(got, e.Target+" "+dev)
+	}
+	// Parents come before children; /srv/data is on another disk and the
+	// unescaped target has no device here.
+	want := []string{
+		"/boot /dev/nbd0p2",
+		"/home /dev/nbd0p3",
+		"/var /dev/vg-sys/var",
+		"/boot/efi /dev/nbd0p1",
+		"/srv/data -",
+		"/var/log /dev/nbd0p5",
+		"/mnt/My Files -",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mounts = %q, want %q", got, want)
+	}
+
+	if d, ok := resolveSpec("/dev/mapper/vg--sys-root", devs); !ok || d.Path != "/dev/vg-sys/root" {
+		t.Errorf("resolve mapper path = %v %v, want /dev/vg-sys/root", d.Path, ok)
+	}
+	if d, ok := resolveSpec("/dev/sda2", devs); !ok || d.Path != "/dev/nbd0p2" {
+		t.Errorf("resolve /dev/sda2 = %v %v, want /dev/nbd0p2", d.Path, ok)
+	}
+	home := parseFstab([]byte(fstab))[3]
+	if opts := home.btrfsOptions(); !reflect.DeepEqual(opts, []string{"subvol=@home"}) {
+		t.Errorf("btrfs options = %v, want [subvol=@home]", opts)
+	}
+}
+
+func TestMountsUnder(t *testing.T) {
+	table := `/dev/sda1 / ext4 rw 0 0
+/dev/nbd0p3 /work/j1/rootfs ext4 ro 0 0
+/dev/nbd0p2 /work/j1/rootfs/boot ext4 ro 0 0
+/dev/nbd0p1 /work/j1/rootfs/boot/efi vfat ro 0 0
+/dev/vg/var /work/j1/rootfs/var xfs ro 0 0
+/dev/vg/var /work/j1/rootfs/var xfs ro 0 0
+/dev/nbd1p1 /work/j1/rootfs2 ext4 ro 0 0
+/dev/nbd0p5 /work/j1/rootfs/mnt/My\040Files ext4 ro 0 0
+`
+	got := mountsUnder(table, "/work/j1/rootfs")
+	want := []string{
+		"/work/j1/rootfs/mnt/My Files",
+		"/work/j1/rootfs/boot/efi",
+		"/work/j1/rootfs/var",
+		"/work/j1/rootfs/var",
+		"/work/j1/rootfs/boot",
+		"/work/j1/rootfs",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mountsUnder = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,272 @@
+package extract
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ContentManifest records every file of an extracted root filesystem, so the
+// next extraction of the same VM can archive only what changed.
+type ContentManifest struct {
+	Created time.Time       `json:"created"`
+	Entries []ManifestEntry `json:"entries"` // sorted by Path
+}
+
+// ManifestEntry describes one file, directory or link of a root filesystem.
+type ManifestEntry struct {
+	// Path is absolute within the root filesystem; the root itself is not
+	// recorded.
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"` // Unix nanoseconds
+
+	// Hash is the SHA-256 of a regular file's content.
+	Hash string `json:"hash,omitempty"`
+
+	// Link is the target of a symbolic link.
+	Link string `json:"link,omitempty"`
+}
+
+// sameContent reports whether e and o describe the same file as far as an
+// image layer is concerned. Modification times are ignored: sanitize passes
+// rewrite files on every run without changing them.
+func (e ManifestEntry) sameContent(o ManifestEntry) bool {
+	return e.Mode == o.Mode && e.UID == o.UID && e.GID == o.GID &&
+		e.Size == o.Size && e.Hash == o.Hash && e.Link == o.Link
+}
+
+// unchanged reports whether the file behind e still looks like prev, in
+// which case prev's hash is reused instead of reading the file.
+func (e ManifestEntry) unchanged(prev ManifestEntry) bool {
+	return e.Mode == prev.Mode && e.UID == prev.UID && e.GID == prev.GID &&
+		e.Size == prev.Size && e.ModTime == prev.ModTime
+}
+
+// Delta lists the paths that differ between two content manifests.
+type Delta struct {
+	// Changed are added or modified paths, in the order they are archived.
+	Changed []string `json:"changed"`
+
+	// Deleted are paths to mask with whiteouts. Paths below a deleted
+	// directory are left out.
+	Deleted []string `json:"deleted"`
+}
+
+// BuildContentManifest walks root and records every entry below it. Regular
+// files whose size, mode, owner and modification time match their entry in
+// prev keep that entry's hash; all others are read and hashed.
+func BuildContentManifest(ctx context.Context, root string, prev *ContentManifest) (*ContentManifest, error) {
+	known := make(map[string]ManifestEntry)
+	if prev != nil {
+		for _, e := range prev.Entries {
+			known[e.Path] = e
+		}
+	}
+	m := &ContentManifest{Created: time.Now().UTC()}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p == root {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		e := ManifestEntry{
+			Path:    "/" + filepath.ToSlash(rel),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime().UnixNano(),
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			e.UID, e.GID = int(st.Uid), int(st.Gid)
+		}
+		switch {
+		case fi.Mode().IsRegular():
+			e.Size = fi.Size()
+			if old, ok := known[e.Path]; ok && old.Hash != "" && e.unchanged(old) {
+				e.Hash = old.Hash
+			} else if e.Hash, err = hashFile(p); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			if e.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("build content manifest: %w", err)
+	}
+	// WalkDir visits in lexical order per directory, which is not a global
+	// sort of the joined paths.
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	return m, nil
+}
+
+// Diff returns what changed from m to next. An entry whose type changed is
+// both deleted and changed, so a directory replaced by a file masks the
+// directory's old contents.
+func (m *ContentManifest) Diff(next *ContentManifest) *Delta {
+	old := make(map[string]ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		old[e.Path] = e
+	}
+	cur := make(map[string]ManifestEntry, len(next.Entries))
+	d := &Delta{Changed: []string{}, Deleted: []string{}}
+	for _, e := range next.Entries {
+		cur[e.Path] = e
+		o, ok := old[e.Path]
+		switch {
+		case !ok:
+			d.Changed = append(d.Changed, e.Path)
+		case o.Mode.Type() != e.Mode.Type():
+			d.Deleted = append(d.Deleted, e.Path)
+			d.Changed = append(d.Changed, e.Path)
+		case !o.sameContent(e):
+			d.Changed = append(d.Changed, e.Path)
+		}
+	}
+	deleted := make(map[string]bool)
+	for _, p := range d.Deleted {
+		deleted[p] = true
+	}
+	for _, e := range m.Entries { // sorted: parents come before children
+		if _, ok := cur[e.Path]; ok {
+			continue
+		}
+		if !underAny(e.Path, deleted) {
+			d.Deleted = append(d.Deleted, e.Path)
+		}
+		deleted[e.Path] = true
+	}
+	sort.Strings(d.Deleted)
+	return d
+}
+
+// underAny reports whether p is below one of dirs.
+func underAny(p string, dirs map[string]bool) bool {
+	for dir := path.Dir(p); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CreateDeltaArchive archives the paths delta changed under sourcePath, plus
+// an OCI whiteout (.wh.<name>) for each deleted path, as a layer to apply on
+// top of the image of the previous extraction. Entries are written with the
+// same ownership, xattr, ACL and SELinux handling as CreateRootFSArchive.
+func (a *Archiver) CreateDeltaArchive(ctx context.Context, sourcePath, workDir string, delta *Delta) (*ArchiveResult, error) {
+	fail := func(format string, args ...any) error {
+		return workflowArchiveError(fmt.Sprintf(format, args...))
+	}
+	workDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return nil, fail("failed to resolve work directory: %v", err)
+	}
+	sourcePath, err = filepath.Abs(sourcePath)
+	if err != nil {
+		return nil, fail("failed to resolve source directory: %v", err)
+	}
+
+	// Whiteouts are empty files staged under their own root and archived
+	// from there.
+	whiteouts := filepath.Join(workDir, "whiteouts")
+	if err := os.RemoveAll(whiteouts); err != nil {
+		return nil, fail("failed to clear whiteouts: %v", err)
+	}
+	if err := os.MkdirAll(whiteouts, 0o755); err != nil {
+		return nil, fail("failed to stage whiteouts: %v", err)
+	}
+	defer os.RemoveAll(whiteouts)
+	var changed, masked strings.Builder
+	for _, p := range delta.Changed {
+		changed.WriteString("." + p + "\x00")
+	}
+	for _, p := range delta.Deleted {
+		wh := path.Join(path.Dir(p), ".wh."+path.Base(p))
+		host := filepath.Join(whiteouts, filepath.FromSlash(wh))
+		if err := os.MkdirAll(filepath.Dir(host), 0o755); err != nil {
+			return nil, fail("failed to stage whiteout: %v", err)
+		}
+		if err := os.WriteFile(host, nil, 0o644); err != nil {
+			return nil, fail("failed to stage whiteout: %v", err)
+		}
+		masked.WriteString("." + wh + "\x00")
+	}
+	changedList := filepath.Join(workDir, "delta-changed.list")
+	maskedList := filepath.Join(workDir, "delta-whiteouts.list")
+	defer os.Remove(changedList)
+	defer os.Remove(maskedList)
+	if err := os.WriteFile(changedList, []byte(changed.String()), 0o644); err != nil {
+		return nil, fail("failed to write file list: %v", err)
+	}
+	if err := os.WriteFile(maskedList, []byte(masked.String()), 0o644); err != nil {
+		return nil, fail("failed to write file list: %v", err)
+	}
+
+	archivePath := filepath.Join(workDir, fmt.Sprintf("delta-%s.tar", time.Now().UTC().Format("20060102T150405Z")))
+	args := append([]string{"-cf", archivePath}, a.tarFlags(ctx)...)
+	args = append(args,
+		"--no-recursion", "--null",
+		// Whiteouts first: a path whose type changed is masked and
+		// re-added in this layer, and extractors apply entries in order.
+		"-C", whiteouts, "-T", maskedList,
+		"-C", sourcePath, "-T", changedList,
+	)
+	if err := a.runTar(ctx, args); err != nil {
+		_ = os.Remove(archivePath)
+		return nil, fail("failed to create delta archive: %v", err)
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		_ = os.Remove(archivePath)
+		return nil, fail("failed to stat archive: %v", err)
+	}
+	return &ArchiveResult{
+		ArchivePath: archivePath,
+		Size:        info.Size(),
+		Cleanup: func() error {
+			return os.Remove(archivePath)
+		},
+	}, nil
+}
@@ -0,0 +1,96 @@
+package extract
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestContentManifestDelta(t *testing.T) {
+	root := t.TempDir()
+	write := func(p, content string) {
+		t.Helper()
+		host := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(host), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(host, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("etc/hostname", "web1\n")
+	write("etc/motd", "hello\n")
+	write("opt/app/bin/run", "v1")
+	write("opt/app/lib/a.so", "a")
+	write("var/data", "dir soon")
+	if err := os.Symlink("/opt/app/bin/run", filepath.Join(root, "usr-run")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	prev, err := BuildContentManifest(ctx, root, nil)
+	if err != nil {
+		t.Fatalf("BuildContentManifest: %v", err)
+	}
+	if len(prev.Entries) != 12 {
+		t.Fatalf("entries = %d, want 12: %+v", len(prev.Entries), prev.Entries)
+	}
+
+	// Rewriting a file with the same content is not a change; editing,
+	// adding, deleting and replacing a file with a directory are.
+	write("etc/hostname", "web1\n")
+	write("etc/motd", "bye\n")
+	write("etc/new.conf", "x=1")
+	if err := os.RemoveAll(filepath.Join(root, "opt/app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "var/data")); err != nil {
+		t.Fatal(err)
+	}
+	write("var/data/file", "now a dir")
+
+	cur, err := BuildContentManifest(ctx, root, prev)
+	if err != nil {
+		t.Fatalf("BuildContentManifest: %v", err)
+	}
+	delta := prev.Diff(cur)
+	wantChanged := []string{"/etc/motd", "/etc/new.conf", "/var/data", "/var/data/file"}
+	wantDeleted := []string{"/opt/app", "/var/data"}
+	if !reflect.DeepEqual(delta.Changed, wantChanged) || !reflect.DeepEqual(delta.Deleted, wantDeleted) {
+		t.Fatalf("delta = %+v, want changed %v deleted %v", delta, wantChanged, wantDeleted)
+	}
+
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not installed")
+	}
+	arc, err := NewArchiver(ArchiverConfig{}).CreateDeltaArchive(ctx, root, t.TempDir(), delta)
+	if err != nil {
+		t.Fatalf("CreateDeltaArchive: %v", err)
+	}
+	f, err := os.Open(arc.ArchivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	want := []string{"./opt/.wh.app", "./var/.wh.data", "./etc/motd", "./etc/new.conf", "./var/data/", "./var/data/file"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("archive = %v, want %v", names, want)
+	}
+}
@@ -3,10 +3,12 @@ package extract
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,11 +22,14 @@ type MountManager struct {
 	// qemuNbdPath is the path to the qemu-nbd binary.
 	qemuNbdPath string
 
+	// lockDir holds the per-device lock files shared with other processes.
+	lockDir string
+
 	// nbdDeviceMu protects NBD device allocation.
 	nbdDeviceMu sync.Mutex
 
-	// usedNbdDevices tracks which NBD devices are currently in use.
-	usedNbdDevices map[string]bool
+	// held tracks the NBD devices this process has locked.
+	held map[string]*nbdLock
 }
 
 // MountConfig configures the mount manager.
@@ -32,6 +37,10 @@ type MountConfig struct {
 	// QemuNbdPath is the path to the qemu-nbd binary.
 	// If empty, "qemu-nbd" is looked up in PATH.
 	QemuNbdPath string
+
+	// LockDir holds the per-device lock files that keep processes from
+	// allocating the same NBD device. If empty, DefaultNBDLockDir is used.
+	LockDir string
 }
 
 // MountResult contains the result of mounting a disk image.
@@ -39,31 +48,61 @@ type MountResult struct {
 	// NBDDevice is the /dev/nbdX device the image is attached to.
 	NBDDevice string
 
-	// Partition is the partition device (e.g., /dev/nbd0p1).
+	// Partition is the device holding the root filesystem (e.g., /dev/nbd0p1
+	// or an LVM volume).
 	Partition string
 
 	// MountPoint is the path where the filesystem is mounted.
 	MountPoint string
 
+	// Mounts are the filesystems from the guest's /etc/fstab mounted below
+	// MountPoint, in mount order.
+	Mounts []FilesystemMount
+
+	// Skipped are fstab mount points whose device is not on the disk, such
+	// as filesystems on other disks of the VM.
+	Skipped []string
+
+	// VolumeGroups are the LVM volume groups activated on the disk.
+	VolumeGroups []string
+
 	// Cleanup is a function that unmounts and disconnects everything.
 	Cleanup workflow.CleanupFunc
 }
 
+// FilesystemMount is a guest filesystem mounted below the root.
+type FilesystemMount struct {
+	// Device is the host device mounted, Path where it is mounted in the
+	// guest (e.g., /var).
+	Device string
+	Path   string
+	FSType string
+}
+
 // NewMountManager creates a new MountManager with the given configuration.
 func NewMountManager(cfg MountConfig) *MountManager {
 	qemuNbdPath := cfg.QemuNbdPath
 	if qemuNbdPath == "" {
 		qemuNbdPath = "qemu-nbd"
 	}
+	lockDir := cfg.LockDir
+	if lockDir == "" {
+		lockDir = DefaultNBDLockDir
+	}
 	return &MountManager{
-		qemuNbdPath:    qemuNbdPath,
-		usedNbdDevices: make(map[string]bool),
+		qemuNbdPath: qemuNbdPath,
+		lockDir:     lockDir,
+		held:        make(map[string]*nbdLock),
 	}
 }
 
-// MountDisk attaches a disk image via qemu-nbd and mounts the root filesystem.
-// The returned MountResult contains a cleanup function that must be called
-// to unmount and disconnect the NBD device.
+// MountDisk attaches a disk image via qemu-nbd and mounts the guest's
+// filesystems read-only: it imports and activates the LVM volume groups on
+// the disk, finds the root filesystem (the one holding /etc, in a btrfs
+// subvolume if need be), then mounts the local filesystems the guest's
+// /etc/fstab lists at their places below it. The returned MountResult
+// contains a cleanup function that must be called to unmount and disconnect
+// everything.
 func (m *MountManager) MountDisk(ctx context.Context, diskPath string, workDir string) (*MountResult, error) {
 	// Verify disk exists
 	if _, err := os.Stat(diskPath); err != nil {
@@ -74,8 +113,20 @@ func (m *MountManager) MountDisk(ctx context.Context, diskPath string, workDir s
 		)
 	}
 
+	// The mount point is recorded as the device's owner and compared with
+	// the mount table, both of which need an absolute path.
+	workDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return nil, workflow.NewWorkflowError(
+			workflow.StageMountDisk,
+			workflow.ErrMountFailed,
+			fmt.Sprintf("failed to resolve work directory: %v", err),
+		)
+	}
+	mountPoint := filepath.Join(workDir, "rootfs")
+
 	// Find an available NBD device
-	nbdDevice, err := m.findAvailableNBDDevice()
+	nbdDevice, err := m.findAvailableNBDDevice(diskPath, mountPoint)
 	if err != nil {
 		return nil, workflow.NewWorkflowError(
 			workflow.StageMountDisk,
@@ -84,13 +135,6 @@ func (m *MountManager) MountDisk(ctx context.Context, diskPath string, workDir s
 		)
 	}
 
-	result := &MountResult{
-		NBDDevice: nbdDevice,
-	}
-
-	// Track cleanup steps for rollback
-	cleanups := workflow.NewCleanupStack()
-
 	// Attach the disk to NBD device
 	if err := m.attachNBD(ctx, diskPath, nbdDevice); err != nil {
 		m.releaseNBDDevice(nbdDevice)
@@ -100,151 +144,127 @@ func (m *MountManager) MountDisk(ctx context.Context, diskPath string, workDir s
 			fmt.Sprintf("failed to attach %s to %s: %v", diskPath, nbdDevice, err),
 		)
 	}
-	cleanups.Push(func() error {
-		return m.detachNBD(context.Background(), nbdDevice)
-	})
 
-	// Run partprobe to detect partitions
-	if err := m.runPartprobe(ctx, nbdDevice); err != nil {
-		_ = cleanups.ExecuteAll()
-		m.releaseNBDDevice(nbdDevice)
-		return nil, workflow.NewWorkflowError(
+	// From here on, Unmount finds and tears down whatever was set up.
+	fail := func(format string, args ...any) error {
+		_ = m.Unmount(context.Background(), mountPoint, nbdDevice)
+		return workflow.NewWorkflowError(
 			workflow.StageMountDisk,
 			workflow.ErrMountFailed,
-			fmt.Sprintf("partprobe failed: %v", err),
+			fmt.Sprintf(format, args...),
 		)
 	}
 
-	// Find the root partition
-	partition, err := m.findRootPartition(ctx, nbdDevice)
+	// Run partprobe to detect partitions
+	if err := m.runPartprobe(ctx, nbdDevice); err != nil {
+		return nil, fail("partprobe failed: %v", err)
+	}
+
+	lvmDevs := lvmDevices(nbdDevice)
+	groups, err := m.activateLVM(ctx, nbdDevice, lvmDevs)
 	if err != nil {
-		_ = cleanups.ExecuteAll()
-		m.releaseNBDDevice(nbdDevice)
-		return nil, workflow.NewWorkflowError(
-			workflow.StageMountDisk,
-			workflow.ErrMountFailed,
-			fmt.Sprintf("failed to find root partition: %v", err),
-		)
+		return nil, fail("failed to activate LVM volume groups: %v", err)
+	}
+	devs, err := m.probeDevices(ctx, nbdDevice, lvmDevs, groups)
+	if err != nil {
+		return nil, fail("failed to list filesystems: %v", err)
 	}
-	result.Partition = partition
 
 	// Create mount point
-	mountPoint := filepath.Join(workDir, "rootfs")
 	if err := os.MkdirAll(mountPoint, 0o755); err != nil {
-		_ = cleanups.ExecuteAll()
-		m.releaseNBDDevice(nbdDevice)
-		return nil, workflow.NewWorkflowError(
-			workflow.StageMountDisk,
-			workflow.ErrMountFailed,
-			fmt.Sprintf("failed to create mount point: %v", err),
-		)
+		return nil, fail("failed to create mount point: %v", err)
 	}
-	cleanups.Push(func() error {
-		return os.RemoveAll(mountPoint)
-	})
 
-	// Mount the partition read-only
-	if err := m.mountPartition(ctx, partition, mountPoint); err != nil {
-		_ = cleanups.ExecuteAll()
-		m.releaseNBDDevice(nbdDevice)
-		return nil, workflow.NewWorkflowError(
-			workflow.StageMountDisk,
-			workflow.ErrMountFailed,
-			fmt.Sprintf("failed to mount %s at %s: %v", partition, mountPoint, err),
-		)
+	root, err := m.mountRoot(ctx, devs, mountPoint)
+	if err != nil {
+		return nil, fail("failed to find root filesystem: %v", err)
 	}
-	result.MountPoint = mountPoint
-
-	// Build the final cleanup function that does everything in reverse order
-	result.Cleanup = func() error {
-		var errs []error
-
-		// Unmount filesystem
-		if err := m.unmount(context.Background(), mountPoint); err != nil {
-			errs = append(errs, fmt.Errorf("unmount %s: %w", mountPoint, err))
-		}
-
-		// Remove mount point directory
-		if err := os.RemoveAll(mountPoint); err != nil {
-			errs = append(errs, fmt.Errorf("remove mount point: %w", err))
-		}
-
-		// Detach NBD device
-		if err := m.detachNBD(context.Background(), nbdDevice); err != nil {
-			errs = append(errs, fmt.Errorf("detach NBD: %w", err))
-		}
-
-		// Release the NBD device for reuse
-		m.releaseNBDDevice(nbdDevice)
-
-		if len(errs) > 0 {
-			return fmt.Errorf("cleanup errors: %v", errs)
-		}
-		return nil
+	mounts, skipped, err := m.mountFstab(ctx, devs, mountPoint)
+	if err != nil {
+		return nil, fail("%v", err)
 	}
 
+	result := &MountResult{
+		NBDDevice:  nbdDevice,
+		Partition:  root.Path,
+		MountPoint: mountPoint,
+		Mounts:     mounts,
+		Skipped:    skipped,
+		Cleanup: func() error {
+			return m.Unmount(context.Background(), mountPoint, nbdDevice)
+		},
+	}
+	for _, g := range groups {
+		result.VolumeGroups = append(result.VolumeGroups, g.Name)
+	}
 	return result, nil
 }
 
-// findAvailableNBDDevice finds an available /dev/nbdX device.
-func (m *MountManager) findAvailableNBDDevice() (string, error) {
-	m.nbdDeviceMu.Lock()
-	defer m.nbdDeviceMu.Unlock()
-
-	// Check for nbd module
-	if _, err := os.Stat("/sys/module/nbd"); os.IsNotExist(err) {
-		return "", fmt.Errorf("nbd kernel module not loaded; run 'modprobe nbd max_part=16'")
+// Unmount unmounts everything at or below mountPoint, deepest first, removes
+// it, deactivates the LVM volume groups on nbdDevice and disconnects it. It
+// is the cleanup for MountDisk and finds what to tear down from the mount
+// table and LVM, so it only needs the values recorded in the MountResult and
+// can be replayed after a restart. The device is only disconnected while it
+// is still attached for mountPoint; one reused since is left alone.
+func (m *MountManager) Unmount(ctx context.Context, mountPoint, nbdDevice string) error {
+	var errs []error
+	if abs, err := filepath.Abs(mountPoint); err == nil {
+		mountPoint = abs
 	}
 
-	// Try to find an available NBD device (typically nbd0 through nbd15)
-	for i := 0; i < 16; i++ {
-		device := fmt.Sprintf("/dev/nbd%d", i)
-
-		// Skip if we're already using it
-		if m.usedNbdDevices[device] {
-			continue
-		}
-
-		// Check if device exists
-		if _, err := os.Stat(device); os.IsNotExist(err) {
-			continue
+	// Unmount filesystems; a replayed cleanup may find them already
+	// unmounted. When the table cannot be read, try the root anyway.
+	mounted := []string{mountPoint}
+	if table, err := os.ReadFile("/proc/self/mounts"); err == nil {
+		mounted = mountsUnder(string(table), mountPoint)
+	}
+	for _, mp := range mounted {
+		if err := m.unmount(ctx, mp); err != nil {
+			errs = append(errs, fmt.Errorf("unmount %s: %w", mp, err))
 		}
+	}
 
-		// Check if device is in use by examining its size
-		sizePath := fmt.Sprintf("/sys/block/nbd%d/size", i)
-		data, err := os.ReadFile(sizePath)
-		if err != nil {
-			continue
+	// Remove mount point directory, unless a guest filesystem is still
+	// mounted in it
+	if len(errs) == 0 {
+		if err := os.RemoveAll(mountPoint); err != nil {
+			errs = append(errs, fmt.Errorf("remove mount point: %w", err))
 		}
+	}
 
-		size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
-		if err != nil {
-			continue
+	owned, err := m.claimNBDDevice(nbdDevice, mountPoint)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("lock NBD: %w", err))
+	}
+	if owned {
+		// Deactivate volume groups so the device can be disconnected
+		if err := m.deactivateLVM(ctx, lvmDevices(nbdDevice)); err != nil {
+			errs = append(errs, fmt.Errorf("deactivate LVM: %w", err))
 		}
 
-		// Size of 0 means the device is not in use
-		if size == 0 {
-			m.usedNbdDevices[device] = true
-			return device, nil
+		// Detach NBD device, then release it for reuse. A device that
+		// stays attached keeps its owner, so a later Sweep retries.
+		if err := m.detachNBD(ctx, nbdDevice); err != nil {
+			errs = append(errs, fmt.Errorf("detach NBD: %w", err))
+		} else {
+			m.releaseNBDDevice(nbdDevice)
 		}
 	}
 
-	return "", fmt.Errorf("all NBD devices are in use")
-}
-
-// releaseNBDDevice marks an NBD device as available for reuse.
-func (m *MountManager) releaseNBDDevice(device string) {
-	m.nbdDeviceMu.Lock()
-	defer m.nbdDeviceMu.Unlock()
-	delete(m.usedNbdDevices, device)
+	if len(errs) > 0 {
+		return fmt.Errorf("cleanup errors: %v", errs)
+	}
+	return nil
 }
 
 // attachNBD attaches a disk image to an NBD device using qemu-nbd.
 func (m *MountManager) attachNBD(ctx context.Context, diskPath, nbdDevice string) error {
 	// Connect the image to the NBD device
-	// --read-only for safety, --connect to specify the device
+	// --snapshot sends writes, such as LVM renaming the guest's volume
+	// groups, to a temporary overlay dropped on disconnect, so the image is
+	// never modified; --connect to specify the device
 	args := []string{
-		"--read-only",
+		"--snapshot",
 		"--connect", nbdDevice,
 		"--format", "qcow2",
 		diskPath,
@@ -295,131 +315,337 @@ func (m *MountManager) runPartprobe(ctx context.Context, nbdDevice string) error
 	return nil
 }
 
-// findRootPartition attempts to find the root partition on the NBD device.
-// It looks for common partition layouts and returns the likely root partition.
-func (m *MountManager) findRootPartition(ctx context.Context, nbdDevice string) (string, error) {
+// volumeGroup is an LVM volume group with a physical volume on the disk.
+type volumeGroup struct {
+	// Name is the group's name in the guest. VG is the name it is activated
+	// under on the host, which differs from Name once it is imported.
+	Name string
+	VG   string
+	UUID string
+	PVs  []string
+}
+
+// lvmDevices returns nbdDevice and its partitions. LVM commands are given
+// them as --devices, so they see only the guest's physical volumes: neither
+// the host's, whose groups may share a name with the guest's, nor those of
+// other attached clones of the same image, which share their UUIDs.
+func lvmDevices(nbdDevice string) []string {
+	devs := []string{nbdDevice}
+	parts, _ := partitions(nbdDevice)
+	for _, p := range parts {
+		devs = append(devs, p.Path)
+	}
+	return devs
+}
+
+// partitions lists the partitions of nbdDevice.
+func partitions(nbdDevice string) ([]blockDevice, error) {
 	// Get the device name without /dev/ prefix
 	devName := filepath.Base(nbdDevice)
 
 	// Check for partitions in /sys/block/<device>/
 	sysPath := fmt.Sprintf("/sys/block/%s", devName)
-
 	entries, err := os.ReadDir(sysPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read %s: %w", sysPath, err)
+		return nil, fmt.Errorf("failed to read %s: %w", sysPath, err)
 	}
-
-	var partitions []string
+	var parts []blockDevice
 	for _, entry := range entries {
 		name := entry.Name()
 		// Partition entries start with the device name
-		if strings.HasPrefix(name, devName+"p") {
-			partitions = append(partitions, "/dev/"+name)
+		if num, ok := strings.CutPrefix(name, devName+"p"); ok {
+			n, _ := strconv.Atoi(num)
+			parts = append(parts, blockDevice{Path: "/dev/" + name, PartNum: n})
 		}
 	}
+	return parts, nil
+}
 
-	if len(partitions) == 0 {
-		// No partitions found, might be a whole-disk filesystem
-		// Try to mount the device directly
-		return nbdDevice, nil
-	}
-
-	// Sort partitions and try to find the root partition
-	// Typically:
-	// - p1 is often /boot or EFI on modern systems
-	// - p2 or p3 is often root
-	// We'll try to identify by checking for common root filesystem indicators
+// importedName is the name a guest volume group is imported under while
+// nbdDevice is attached. It is unique on the host as long as no host group
+// is named after an NBD device.
+func importedName(nbdDevice, vg string) string {
+	return filepath.Base(nbdDevice) + "_" + vg
+}
 
-	for _, partition := range partitions {
-		// Use blkid to check filesystem type
-		cmd := exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "TYPE", partition)
-		output, err := cmd.Output()
-		if err != nil {
+// volumeGroups lists the volume groups with a physical volume on devices.
+// Hosts without LVM tools have none.
+func (m *MountManager) volumeGroups(ctx context.Context, devices []string) ([]volumeGroup, error) {
+	if _, err := exec.LookPath("pvs"); err != nil {
+		return nil, nil
+	}
+	out, err := runCommand(ctx, "pvs", "--devices", strings.Join(devices, ","),
+		"--noheadings", "--separator", ",", "-o", "pv_name,vg_name,vg_uuid")
+	if err != nil {
+		return nil, err
+	}
+	var groups []volumeGroup
+	index := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(strings.TrimSpace(line), ",")
+		if len(f) < 3 || f[2] == "" {
 			continue
 		}
+		i, ok := index[f[2]]
+		if !ok {
+			i = len(groups)
+			index[f[2]] = i
+			groups = append(groups, volumeGroup{Name: f[1], VG: f[1], UUID: f[2]})
+		}
+		groups[i].PVs = append(groups[i].PVs, f[0])
+	}
+	return groups, nil
+}
 
-		fsType := strings.TrimSpace(string(output))
-		// Look for ext4, xfs, btrfs which are common root filesystems
-		if fsType == "ext4" || fsType == "xfs" || fsType == "btrfs" || fsType == "ext3" {
-			// This is likely the root partition
-			// We could do more checks (mount and look for /etc, /bin, etc.)
-			// but for now we'll use the first Linux filesystem we find
-			// that isn't obviously a boot partition
-			if !m.isBootPartition(ctx, partition) {
-				return partition, nil
-			}
+// activateLVM imports the volume groups on nbdDevice under the names from
+// importedName, with new UUIDs, and activates them. The renames are written
+// to qemu-nbd's temporary overlay, not to the image.
+func (m *MountManager) activateLVM(ctx context.Context, nbdDevice string, devices []string) ([]volumeGroup, error) {
+	groups, err := m.volumeGroups(ctx, devices)
+	if err != nil {
+		return nil, err
+	}
+	devList := strings.Join(devices, ",")
+	for i := range groups {
+		g := &groups[i]
+		g.VG = importedName(nbdDevice, g.Name)
+		args := append([]string{"--devices", devList, "--basevgname", g.VG}, g.PVs...)
+		if _, err := runCommand(ctx, "vgimportclone", args...); err != nil {
+			return nil, fmt.Errorf("volume group %s: %w", g.Name, err)
+		}
+		if _, err := runCommand(ctx, "vgchange", "--devices", devList, "-ay", g.VG); err != nil {
+			return nil, fmt.Errorf("volume group %s: %w", g.Name, err)
 		}
 	}
+	return groups, nil
+}
 
-	// If we couldn't find a definitive root, try the largest partition
-	if len(partitions) > 0 {
-		largest := partitions[0]
-		var largestSize int64
+// deactivateLVM deactivates the volume groups on devices.
+func (m *MountManager) deactivateLVM(ctx context.Context, devices []string) error {
+	groups, err := m.volumeGroups(ctx, devices)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, g := range groups {
+		if _, err := runCommand(ctx, "vgchange", "--devices", strings.Join(devices, ","), "-an", g.VG); err != nil {
+			errs = append(errs, fmt.Errorf("volume group %s: %w", g.VG, err))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		for _, partition := range partitions {
-			partName := filepath.Base(partition)
-			sizePath := fmt.Sprintf("/sys/block/%s/%s/size", devName, partName)
-			data, err := os.ReadFile(sizePath)
-			if err != nil {
-				continue
-			}
-			size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
-			if err != nil {
+// probeDevices lists the filesystems on nbdDevice: its partitions, or the
+// whole device when it has none, and the logical volumes of groups.
+func (m *MountManager) probeDevices(ctx context.Context, nbdDevice string, devices []string, groups []volumeGroup) ([]blockDevice, error) {
+	devs, err := partitions(nbdDevice)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		// No partitions found, might be a whole-disk filesystem
+		devs = append(devs, blockDevice{Path: nbdDevice})
+	}
+
+	for _, g := range groups {
+		out, err := runCommand(ctx, "lvs", "--devices", strings.Join(devices, ","),
+			"--noheadings", "--separator", ",", "-o", "lv_path,lv_name", g.VG)
+		if err != nil {
+			return nil, fmt.Errorf("volume group %s: %w", g.Name, err)
+		}
+		for _, line := range strings.Split(out, "\n") {
+			f := strings.Split(strings.TrimSpace(line), ",")
+			// Pools and other hidden volumes have no path
+			if len(f) < 2 || f[0] == "" {
 				continue
 			}
-			if size > largestSize {
-				largestSize = size
-				largest = partition
-			}
+			// The guest refers to the volume by its own group name
+			devs = append(devs, blockDevice{Path: f[0], Aliases: lvmAliases(g.Name, f[1])})
 		}
-		return largest, nil
 	}
 
-	return "", fmt.Errorf("no suitable partition found")
+	for i := range devs {
+		m.probeDevice(ctx, &devs[i])
+	}
+	return devs, nil
 }
 
-// isBootPartition checks if a partition appears to be a boot partition.
-func (m *MountManager) isBootPartition(ctx context.Context, partition string) bool {
-	// Check partition label or flags
-	cmd := exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "LABEL", partition)
-	output, err := cmd.Output()
-	if err == nil {
-		label := strings.ToLower(strings.TrimSpace(string(output)))
-		if strings.Contains(label, "boot") || strings.Contains(label, "efi") {
-			return true
+// probeDevice fills in the filesystem type, identifiers and size of d.
+// Devices blkid cannot identify are left without a type.
+func (m *MountManager) probeDevice(ctx context.Context, d *blockDevice) {
+	if out, err := runCommand(ctx, "blkid", "-o", "export", d.Path); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+			switch key {
+			case "TYPE":
+				d.FSType = value
+			case "UUID":
+				d.UUID = value
+			case "LABEL":
+				d.Label = value
+			case "PARTUUID":
+				d.PartUUID = value
+			case "PARTLABEL":
+				d.PartLabel = value
+			}
+		}
+	}
+	// Logical volumes are links to /dev/dm-N
+	if real, err := filepath.EvalSymlinks(d.Path); err == nil {
+		sizePath := fmt.Sprintf("/sys/class/block/%s/size", filepath.Base(real))
+		if data, err := os.ReadFile(sizePath); err == nil {
+			d.Size, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
 		}
 	}
+}
 
-	// Also check PARTLABEL for GPT partitions
-	cmd = exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "PARTLABEL", partition)
-	output, err = cmd.Output()
-	if err == nil {
-		label := strings.ToLower(strings.TrimSpace(string(output)))
+// isBootDevice reports whether d appears to be a boot or EFI partition.
+func isBootDevice(d blockDevice) bool {
+	for _, label := range []string{d.Label, d.PartLabel} {
+		label = strings.ToLower(label)
 		if strings.Contains(label, "boot") || strings.Contains(label, "efi") {
 			return true
 		}
 	}
-
 	return false
 }
 
-// mountPartition mounts a partition read-only at the specified mount point.
-func (m *MountManager) mountPartition(ctx context.Context, partition, mountPoint string) error {
-	// Mount read-only with common options
-	args := []string{
-		"-o", "ro,noatime,noexec",
-		partition,
-		mountPoint,
+// mountRoot mounts the guest's root filesystem at mountPoint. Candidates
+// are tried non-boot first, then largest first, and the first that holds
+// /etc/fstab or /etc/os-release wins. On btrfs the root may be a subvolume
+// rather than the default one (e.g. "@" or "root").
+func (m *MountManager) mountRoot(ctx context.Context, devs []blockDevice, mountPoint string) (blockDevice, error) {
+	var candidates []blockDevice
+	for _, d := range devs {
+		if rootFSTypes[d.FSType] {
+			candidates = append(candidates, d)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if bi, bj := isBootDevice(candidates[i]), isBootDevice(candidates[j]); bi != bj {
+			return bj
+		}
+		return candidates[i].Size > candidates[j].Size
+	})
+
+	var errs []error
+	for _, d := range candidates {
+		if err := m.mountFilesystem(ctx, d.Path, mountPoint, d.FSType, nil); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.Path, err))
+			continue
+		}
+		if looksLikeRoot(mountPoint) {
+			return d, nil
+		}
+		sub := ""
+		if d.FSType == "btrfs" {
+			sub = btrfsRootSubvolume(mountPoint)
+		}
+		if err := m.unmount(ctx, mountPoint); err != nil {
+			return blockDevice{}, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		if sub == "" {
+			continue
+		}
+		if err := m.mountFilesystem(ctx, d.Path, mountPoint, d.FSType, []string{"subvol=" + sub}); err != nil {
+			errs = append(errs, fmt.Errorf("%s subvolume %s: %w", d.Path, sub, err))
+			continue
+		}
+		return d, nil
+	}
+	if len(errs) > 0 {
+		return blockDevice{}, errors.Join(errs...)
 	}
+	return blockDevice{}, fmt.Errorf("no filesystem on %d devices holds /etc", len(devs))
+}
 
-	cmd := exec.CommandContext(ctx, "mount", args...)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+// looksLikeRoot reports whether the filesystem at dir is a root filesystem.
+func looksLikeRoot(dir string) bool {
+	t := &Tree{Root: dir}
+	return t.Exists("/etc/fstab") || t.Exists("/etc/os-release")
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("mount failed: %w: %s", err, stderr.String())
+// btrfsRootSubvolume returns the top-level subvolume of the btrfs
+// filesystem mounted at dir that holds the root, or "".
+func btrfsRootSubvolume(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
 	}
+	names := []string{"@", "@rootfs", "root", "rootfs"}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	for _, name := range names {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		if err == nil && fi.IsDir() && looksLikeRoot(filepath.Join(dir, name)) {
+			return name
+		}
+	}
+	return ""
+}
 
+// mountFstab mounts the local filesystems listed in the /etc/fstab of the
+// root mounted at mountPoint below it, parents first. Entries whose device is
+// not among devs are skipped and returned.
+func (m *MountManager) mountFstab(ctx context.Context, devs []blockDevice, mountPoint string) ([]FilesystemMount, []string, error) {
+	root := &Tree{Root: mountPoint}
+	data, err := root.ReadFile("/etc/fstab")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read /etc/fstab: %w", err)
+	}
+
+	var mounts []FilesystemMount
+	var skipped []string
+	for _, e := range extraMounts(parseFstab(data)) {
+		d, ok := resolveSpec(e.Spec, devs)
+		if !ok {
+			skipped = append(skipped, e.Target)
+			continue
+		}
+		// Resolve the mount point inside the guest, after the mounts
+		// above it, so no link in the image can place a mount on the host.
+		target, err := root.hostPath(e.Target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("mount point %s: %w", e.Target, err)
+		}
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			skipped = append(skipped, e.Target)
+			continue
+		}
+		fsType := d.FSType
+		if fsType == "" {
+			fsType = e.FSType
+		}
+		var extra []string
+		if fsType == "btrfs" {
+			extra = e.btrfsOptions()
+		}
+		if err := m.mountFilesystem(ctx, d.Path, target, fsType, extra); err != nil {
+			return nil, nil, fmt.Errorf("failed to mount %s at %s: %w", d.Path, e.Target, err)
+		}
+		mounts = append(mounts, FilesystemMount{Device: d.Path, Path: e.Target, FSType: fsType})
+	}
+	return mounts, skipped, nil
+}
+
+// mountFilesystem mounts a device read-only at the specified mount point,
+// with extra mount options such as a btrfs subvolume.
+func (m *MountManager) mountFilesystem(ctx context.Context, device, mountPoint, fsType string, extra []string) error {
+	// Mount read-only with common options
+	opts := append([]string{"ro", "noatime", "noexec"}, extra...)
+	args := []string{"-o", strings.Join(opts, ",")}
+	if fsType != "" && fsType != "auto" {
+		args = append(args, "-t", fsType)
+	}
+	args = append(args, device, mountPoint)
+
+	if _, err := runCommand(ctx, "mount", args...); err != nil {
+		return fmt.Errorf("mount failed: %w", err)
+	}
 	return nil
 }
 
@@ -441,3 +667,15 @@ func (m *MountManager) unmount(ctx context.Context, mountPoint string) error {
 
 	return nil
 }
+
+// runCommand runs name and returns its standard output.
+func runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
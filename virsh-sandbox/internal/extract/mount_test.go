@@ -0,0 +1,80 @@
+package extract
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeLVMScript stands in for the LVM tools: it logs each invocation to
+// calls.log next to itself, and pvs prints the file pvs.out.
+const fakeLVMScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$(basename "$0") $*" >> "$dir/calls.log"
+if [ "$(basename "$0")" = pvs ]; then cat "$dir/pvs.out"; fi
+exit 0
+`
+
+func TestActivateLVM(t *testing.T) {
+	dir := t.TempDir()
+	for _, tool := range []string{"pvs", "vgimportclone", "vgchange"} {
+		if err := os.WriteFile(filepath.Join(dir, tool), []byte(fakeLVMScript), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	pvs := "  /dev/nbd3p2,ubuntu-vg,uuid-1\n  /dev/nbd3p3,ubuntu-vg,uuid-1\n  /dev/nbd3p4,data,uuid-2\n  /dev/nbd3p1,,\n"
+	if err := os.WriteFile(filepath.Join(dir, "pvs.out"), []byte(pvs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	calls := func() []string {
+		b, _ := os.ReadFile(filepath.Join(dir, "calls.log"))
+		_ = os.Remove(filepath.Join(dir, "calls.log"))
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+
+	m := NewMountManager(MountConfig{LockDir: t.TempDir()})
+	devices := []string{"/dev/nbd3", "/dev/nbd3p1", "/dev/nbd3p2", "/dev/nbd3p3", "/dev/nbd3p4"}
+	groups, err := m.activateLVM(context.Background(), "/dev/nbd3", devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []volumeGroup{
+		{Name: "ubuntu-vg", VG: "nbd3_ubuntu-vg", UUID: "uuid-1", PVs: []string{"/dev/nbd3p2", "/dev/nbd3p3"}},
+		{Name: "data", VG: "nbd3_data", UUID: "uuid-2", PVs: []string{"/dev/nbd3p4"}},
+	}
+	if !slices.EqualFunc(groups, want, func(a, b volumeGroup) bool {
+		return a.Name == b.Name && a.VG == b.VG && a.UUID == b.UUID && slices.Equal(a.PVs, b.PVs)
+	}) {
+		t.Errorf("groups = %+v, want %+v", groups, want)
+	}
+
+	// Every command is restricted to the NBD device, and groups are
+	// renamed before they are activated.
+	devs := strings.Join(devices, ",")
+	wantCalls := []string{
+		"pvs --devices " + devs + " --noheadings --separator , -o pv_name,vg_name,vg_uuid",
+		"vgimportclone --devices " + devs + " --basevgname nbd3_ubuntu-vg /dev/nbd3p2 /dev/nbd3p3",
+		"vgchange --devices " + devs + " -ay nbd3_ubuntu-vg",
+		"vgimportclone --devices " + devs + " --basevgname nbd3_data /dev/nbd3p4",
+		"vgchange --devices " + devs + " -ay nbd3_data",
+	}
+	if got := calls(); !slices.Equal(got, wantCalls) {
+		t.Errorf("calls = %q, want %q", got, wantCalls)
+	}
+
+	// Cleanup finds the groups under their imported names.
+	pvs = "  /dev/nbd3p2,nbd3_ubuntu-vg,uuid-3\n"
+	if err := os.WriteFile(filepath.Join(dir, "pvs.out"), []byte(pvs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.deactivateLVM(context.Background(), devices); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(); len(got) != 2 || got[1] != "vgchange --devices "+devs+" -an nbd3_ubuntu-vg" {
+		t.Errorf("deactivate calls = %q", got)
+	}
+}
@@ -0,0 +1,276 @@
+package extract
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultNBDLockDir holds the per-device lock files every process
+// allocating NBD devices through a MountManager must share.
+const DefaultNBDLockDir = "/run/lock/virsh-sandbox/nbd"
+
+// maxNBDDevices is how many devices are considered (nbd0 through nbd15).
+const maxNBDDevices = 16
+
+// NBDOwner is recorded in a device's lock file by the process that attached
+// the device.
+type NBDOwner struct {
+	PID        int       `json:"pid"`
+	Disk       string    `json:"disk"`
+	MountPoint string    `json:"mount_point"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+// NBDAttachment describes an NBD device that is connected or has an owner.
+type NBDAttachment struct {
+	Device string `json:"device"`
+
+	// Connected reports whether an image is attached; PID is the qemu-nbd
+	// process serving it, 0 if unknown.
+	Connected bool  `json:"connected"`
+	PID       int   `json:"pid,omitempty"`
+	SizeBytes int64 `json:"size_bytes"`
+
+	// Locked reports whether a live process holds the device's lock. Owner
+	// is nil for devices attached outside a MountManager.
+	Locked bool      `json:"locked"`
+	Owner  *NBDOwner `json:"owner,omitempty"`
+}
+
+// Stale reports whether the process that attached the device has died
+// without releasing it.
+func (a NBDAttachment) Stale() bool {
+	return a.Owner != nil && !a.Locked
+}
+
+// nbdLock is a device lock held by this process. The lock lives as long as
+// the open file; closing it releases the device to other processes.
+type nbdLock struct {
+	f     *os.File
+	owner NBDOwner
+}
+
+// lockPath returns the lock file of device.
+func (m *MountManager) lockPath(device string) string {
+	return filepath.Join(m.lockDir, filepath.Base(device)+".lock")
+}
+
+// tryLock takes the lock of device without waiting. It returns nil when
+// another open file, in this process or another, holds it.
+func (m *MountManager) tryLock(device string) (*os.File, error) {
+	if err := os.MkdirAll(m.lockDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(m.lockPath(device), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// readOwner returns the owner recorded in a lock file, or nil when the file
+// is empty or unreadable.
+func readOwner(f *os.File) *NBDOwner {
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	var o NBDOwner
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil
+	}
+	return &o
+}
+
+// nbdState reads from sysfs whether device is connected, the pid of the
+// qemu-nbd serving it and its size. A device whose size cannot be read
+// counts as connected.
+func nbdState(device string) (connected bool, pid int, size int64) {
+	sys := filepath.Join("/sys/block", filepath.Base(device))
+	// The pid file only exists while a client is connected
+	if data, err := os.ReadFile(filepath.Join(sys, "pid")); err == nil {
+		connected = true
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	data, err := os.ReadFile(filepath.Join(sys, "size"))
+	if err != nil {
+		return true, pid, 0
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return true, pid, 0
+	}
+	// Size of 0 means the device is not in use
+	return connected || sectors > 0, pid, sectors * 512
+}
+
+// findAvailableNBDDevice finds an available /dev/nbdX device and takes its
+// lock, recording disk and mountPoint as the owner. A device is available
+// when no process holds its lock and nothing is connected to it, which also
+// rules out devices attached by hand with qemu-nbd.
+func (m *MountManager) findAvailableNBDDevice(disk, mountPoint string) (string, error) {
+	m.nbdDeviceMu.Lock()
+	defer m.nbdDeviceMu.Unlock()
+
+	// Check for nbd module
+	if _, err := os.Stat("/sys/module/nbd"); os.IsNotExist(err) {
+		return "", fmt.Errorf("nbd kernel module not loaded; run 'modprobe nbd max_part=16'")
+	}
+
+	for i := 0; i < maxNBDDevices; i++ {
+		device := fmt.Sprintf("/dev/nbd%d", i)
+
+		// Skip if we're already using it
+		if _, ok := m.held[device]; ok {
+			continue
+		}
+
+		// Check if device exists
+		if _, err := os.Stat(device); os.IsNotExist(err) {
+			continue
+		}
+
+		f, err := m.tryLock(device)
+		if err != nil {
+			return "", fmt.Errorf("lock %s: %w", device, err)
+		}
+		if f == nil {
+			continue
+		}
+		if connected, _, _ := nbdState(device); connected {
+			f.Close()
+			continue
+		}
+
+		owner := NBDOwner{PID: os.Getpid(), Disk: disk, MountPoint: mountPoint, AttachedAt: time.Now().UTC()}
+		b, err := json.Marshal(owner)
+		if err == nil {
+			if err = f.Truncate(0); err == nil {
+				_, err = f.WriteAt(b, 0)
+			}
+		}
+		if err != nil {
+			f.Close()
+			return "", fmt.Errorf("lock %s: %w", device, err)
+		}
+		m.held[device] = &nbdLock{f: f, owner: owner}
+		return device, nil
+	}
+
+	return "", fmt.Errorf("all NBD devices are in use")
+}
+
+// claimNBDDevice reports whether the cleanup of mountPoint may disconnect
+// device: this process attached it for mountPoint, or the process that did
+// has died, in which case its lock is taken over. A device now attached for
+// another mount point, or outside a MountManager, is not claimed.
+func (m *MountManager) claimNBDDevice(device, mountPoint string) (bool, error) {
+	m.nbdDeviceMu.Lock()
+	defer m.nbdDeviceMu.Unlock()
+
+	if l, ok := m.held[device]; ok {
+		return l.owner.MountPoint == mountPoint, nil
+	}
+	f, err := m.tryLock(device)
+	if err != nil || f == nil {
+		return false, err
+	}
+	owner := readOwner(f)
+	if owner == nil || owner.MountPoint != mountPoint {
+		f.Close()
+		return false, nil
+	}
+	m.held[device] = &nbdLock{f: f, owner: *owner}
+	return true, nil
+}
+
+// releaseNBDDevice clears the owner of an NBD device held by this process
+// and releases its lock for reuse.
+func (m *MountManager) releaseNBDDevice(device string) {
+	m.nbdDeviceMu.Lock()
+	defer m.nbdDeviceMu.Unlock()
+	l, ok := m.held[device]
+	if !ok {
+		return
+	}
+	// The lock file is kept: removing it would let two processes lock
+	// different files for the same device.
+	_ = l.f.Truncate(0)
+	l.f.Close()
+	delete(m.held, device)
+}
+
+// Attachments lists the NBD devices that are connected or have an owner
+// recorded in their lock file.
+func (m *MountManager) Attachments() ([]NBDAttachment, error) {
+	m.nbdDeviceMu.Lock()
+	defer m.nbdDeviceMu.Unlock()
+
+	out := []NBDAttachment{}
+	for i := 0; i < maxNBDDevices; i++ {
+		device := fmt.Sprintf("/dev/nbd%d", i)
+		if _, err := os.Stat(device); err != nil {
+			continue
+		}
+		a := NBDAttachment{Device: device}
+		a.Connected, a.PID, a.SizeBytes = nbdState(device)
+		if l, ok := m.held[device]; ok {
+			owner := l.owner
+			a.Owner, a.Locked = &owner, true
+		} else if f, err := os.Open(m.lockPath(device)); err == nil {
+			a.Owner = readOwner(f)
+			// A shared lock fails only while another process holds the
+			// exclusive one.
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); errors.Is(err, syscall.EWOULDBLOCK) {
+				a.Locked = true
+			}
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("lock %s: %w", device, err)
+		}
+		if a.Connected || a.Owner != nil {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// Sweep tears down NBD devices left attached by processes that died: it
+// unmounts what they mounted, deactivates LVM and disconnects the device, as
+// their own cleanup would have. Devices attached outside a MountManager are
+// left alone. It returns the devices swept; call it at startup.
+func (m *MountManager) Sweep(ctx context.Context) ([]NBDAttachment, error) {
+	atts, err := m.Attachments()
+	if err != nil {
+		return nil, err
+	}
+	var swept []NBDAttachment
+	var errs []error
+	for _, a := range atts {
+		if !a.Stale() {
+			continue
+		}
+		if err := m.Unmount(ctx, a.Owner.MountPoint, a.Device); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Device, err))
+			continue
+		}
+		swept = append(swept, a)
+	}
+	return swept, errors.Join(errs...)
+}
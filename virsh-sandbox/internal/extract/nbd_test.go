@@ -0,0 +1,51 @@
+package extract
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimNBDDevice(t *testing.T) {
+	dir := t.TempDir()
+	// A process that died while /dev/nbd3 was attached for job a.
+	b, err := json.Marshal(NBDOwner{PID: 1 << 22, Disk: "/var/lib/vm/a.qcow2", MountPoint: "/work/a/rootfs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nbd3.lock"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMountManager(MountConfig{LockDir: dir})
+	other := NewMountManager(MountConfig{LockDir: dir})
+
+	if ok, err := m.claimNBDDevice("/dev/nbd3", "/work/b/rootfs"); err != nil || ok {
+		t.Fatalf("claim for another mount point = %v, %v; want false", ok, err)
+	}
+	if ok, err := m.claimNBDDevice("/dev/nbd3", "/work/a/rootfs"); err != nil || !ok {
+		t.Fatalf("claim of dead owner's device = %v, %v; want true", ok, err)
+	}
+	// The lock is now held, so no other process can take the device.
+	if ok, err := other.claimNBDDevice("/dev/nbd3", "/work/a/rootfs"); err != nil || ok {
+		t.Fatalf("claim of locked device = %v, %v; want false", ok, err)
+	}
+	if f, err := other.tryLock("/dev/nbd3"); err != nil || f != nil {
+		t.Fatalf("tryLock of locked device = %v, %v; want nil", f, err)
+	}
+
+	// Releasing clears the owner: a replayed cleanup no longer matches.
+	m.releaseNBDDevice("/dev/nbd3")
+	if ok, err := other.claimNBDDevice("/dev/nbd3", "/work/a/rootfs"); err != nil || ok {
+		t.Fatalf("claim after release = %v, %v; want false", ok, err)
+	}
+	f, err := other.tryLock("/dev/nbd3")
+	if err != nil || f == nil {
+		t.Fatalf("tryLock after release = %v, %v; want lock", f, err)
+	}
+	defer f.Close()
+	if o := readOwner(f); o != nil {
+		t.Errorf("owner after release = %+v, want none", o)
+	}
+}
@@ -0,0 +1,260 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Names of the built-in sanitize passes.
+const (
+	passRemoveBoot          = "remove-boot"
+	passRemoveKernelModules = "remove-kernel-modules"
+	passClearDeviceNodes    = "clear-device-nodes"
+	passSanitizeFstab       = "sanitize-fstab"
+	passRemoveSwap          = "remove-swap"
+	passMaskUnits           = "mask-units"
+	passContainerMarker     = "container-marker"
+	passScrubIdentity       = "scrub-identity"
+	passClearHistories      = "clear-histories"
+	passClearLogs           = "clear-logs"
+	passDropPaths           = "drop-paths"
+	passTemplateFiles       = "template-files"
+	passScanSecrets         = "scan-secrets"
+)
+
+// builtinPasses returns the built-in passes in the order they run by default.
+func (s *Sanitizer) builtinPasses() []SanitizePass {
+	return []SanitizePass{
+		{
+			Name:        passRemoveBoot,
+			Description: "Remove the contents of /boot.",
+			Default:     true,
+			Run:         removeBoot,
+		},
+		{
+			Name:        passRemoveKernelModules,
+			Description: "Remove kernel modules under /lib/modules.",
+			Default:     true,
+			Run:         removeKernelModules,
+		},
+		{
+			Name:        passClearDeviceNodes,
+			Description: "Replace /dev with placeholders; the container runtime populates it.",
+			Default:     true,
+			Run:         clearDeviceNodes,
+		},
+		{
+			Name:        passSanitizeFstab,
+			Description: "Comment out all /etc/fstab entries.",
+			Default:     true,
+			Run:         sanitizeFstab,
+		},
+		{
+			Name:        passRemoveSwap,
+			Description: "Remove swap files and mask swap units.",
+			Default:     true,
+			Run:         removeSwapReferences,
+		},
+		{
+			Name:        passMaskUnits,
+			Description: "Mask systemd units that block container startup, plus rules.mask_units.",
+			Default:     true,
+			Run:         s.maskUnits,
+		},
+		{
+			Name:        passContainerMarker,
+			Description: "Create /.dockerenv and /run/.containerenv.",
+			Default:     true,
+			Run:         setContainerMarker,
+		},
+		{
+			Name:        passScrubIdentity,
+			Description: "Remove SSH host keys, /root/.ssh and cloud-init instance state, empty machine-id and lock password hashes.",
+			Default:     true,
+			Run:         scrubIdentity,
+		},
+		{
+			Name:        passClearHistories,
+			Description: "Remove shell and tool histories of root and /home users.",
+			Default:     true,
+			Run:         clearHistories,
+		},
+		{
+			Name:        passClearLogs,
+			Description: "Truncate logs under /var/log and remove rotated logs and journals.",
+			Default:     true,
+			Run:         clearLogs,
+		},
+		{
+			Name:        passDropPaths,
+			Description: "Remove the paths and globs in rules.drop_paths.",
+			Default:     true,
+			Run:         dropPaths,
+		},
+		{
+			Name:        passTemplateFiles,
+			Description: "Render rules.templates and write them into the filesystem.",
+			Default:     true,
+			Run:         templateFiles,
+		},
+		{
+			Name:        passScanSecrets,
+			Description: "Scan configuration and home directories for credentials and report them as findings.",
+			Default:     true,
+			Run:         s.scanSecrets,
+		},
+	}
+}
+
+// removeBoot removes the /boot directory contents.
+func removeBoot(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	return t.ClearDir("/boot")
+}
+
+// removeKernelModules removes kernel modules from /lib/modules.
+func removeKernelModules(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	return t.ClearDir("/lib/modules")
+}
+
+// clearDeviceNodes removes all device nodes under /dev.
+func clearDeviceNodes(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	if !t.Exists("/dev") {
+		return nil
+	}
+	if err := t.ClearDir("/dev"); err != nil {
+		return err
+	}
+	if t.DryRun {
+		return nil
+	}
+
+	// Create /dev/null, /dev/zero, /dev/random placeholders
+	// The container runtime will populate /dev properly
+	devPath, err := t.hostPath("/dev")
+	if err != nil {
+		return err
+	}
+	for _, entry := range []string{"null", "zero", "random", "urandom", "tty", "console"} {
+		f, err := os.Create(devPath + "/" + entry)
+		if err != nil {
+			continue // Non-fatal, container runtime will create these
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// sanitizeFstab comments out /etc/fstab entries.
+func sanitizeFstab(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	content, err := t.ReadFile("/etc/fstab")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Comment out all mount entries, keeping only comments
+	newLines := []string{
+		"# fstab sanitized for container usage",
+		"# Original entries commented out:",
+		"",
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			newLines = append(newLines, line)
+		} else {
+			newLines = append(newLines, "# "+line)
+		}
+	}
+	return t.WriteFile("/etc/fstab", []byte(strings.Join(newLines, "\n")), 0o644)
+}
+
+// removeSwapReferences removes swap files and masks swap units.
+func removeSwapReferences(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	if err := t.Remove("/swapfile"); err != nil {
+		return err
+	}
+	entries, err := t.ReadDir("/")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".swap") {
+			_ = t.Remove("/" + entry.Name()) // Non-fatal
+		}
+	}
+	for _, unit := range []string{"swap.target", "dev-*.swap"} {
+		_ = t.MaskUnit(unit) // Non-fatal
+	}
+	return nil
+}
+
+// maskUnits masks the configured blocking units and rules.MaskUnits.
+func (s *Sanitizer) maskUnits(ctx context.Context, t *Tree, rules SanitizeRules) error {
+	for _, unit := range s.blockingUnits {
+		_ = t.MaskUnit(unit) // Non-fatal, unit may not exist
+	}
+	for _, unit := range rules.MaskUnits {
+		if err := t.MaskUnit(unit); err != nil {
+			return fmt.Errorf("mask %s: %w", unit, err)
+		}
+	}
+	return nil
+}
+
+// setContainerMarker creates markers indicating a container environment.
+func setContainerMarker(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	// /.dockerenv for container detection
+	if err := t.WriteFile("/.dockerenv", nil, 0o644); err != nil {
+		return err
+	}
+	// /run/.containerenv for Podman detection
+	containerenv := `engine="podman"
+name="vmclone"
+`
+	return t.WriteFile("/run/.containerenv", []byte(containerenv), 0o644)
+}
+
+// dropPaths removes rules.DropPaths, expanding globs.
+func dropPaths(ctx context.Context, t *Tree, rules SanitizeRules) error {
+	for _, pattern := range rules.DropPaths {
+		matches, err := t.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("drop %s: %w", pattern, err)
+		}
+		for _, p := range matches {
+			if err := t.Remove(p); err != nil {
+				return fmt.Errorf("drop %s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// templateFiles renders rules.Templates into the tree.
+func templateFiles(ctx context.Context, t *Tree, rules SanitizeRules) error {
+	data := TemplateData{VM: t.VMName, Vars: rules.Vars}
+	for _, ft := range rules.Templates {
+		tmpl, err := parseFileTemplate(ft)
+		if err != nil {
+			return fmt.Errorf("template %s: %w", ft.Path, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("template %s: %w", ft.Path, err)
+		}
+		mode := os.FileMode(ft.Mode)
+		if mode == 0 {
+			mode = 0o644
+		}
+		if err := t.WriteFile(ft.Path, buf.Bytes(), mode); err != nil {
+			return fmt.Errorf("write %s: %w", ft.Path, err)
+		}
+	}
+	return nil
+}
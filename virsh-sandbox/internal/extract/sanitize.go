@@ -3,37 +3,332 @@ package extract
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"text/template"
 
+	"virsh-sandbox/internal/redact"
 	"virsh-sandbox/internal/workflow"
 )
 
-// Sanitizer handles filesystem sanitization for container usage.
+// Sentinel errors for sanitize options.
+var (
+	// ErrUnknownPass indicates a requested pass is not registered.
+	ErrUnknownPass = errors.New("unknown sanitize pass")
+
+	// ErrInvalidRules indicates malformed sanitize rules.
+	ErrInvalidRules = errors.New("invalid sanitize rules")
+)
+
+// SanitizePass is a named sanitization step. Run applies it to the tree; in
+// dry-run mode the tree only records what would change.
+type SanitizePass struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Default passes run when a request does not name its passes.
+	Default bool `json:"default"`
+
+	Run func(ctx context.Context, t *Tree, rules SanitizeRules) error `json:"-"`
+}
+
+// SanitizeRules are user-supplied inputs to the rule-driven passes.
+type SanitizeRules struct {
+	// DropPaths are absolute paths or glob patterns removed by drop-paths.
+	DropPaths []string `json:"drop_paths,omitempty"`
+
+	// MaskUnits are systemd units masked by mask-units in addition to the
+	// configured blocking units.
+	MaskUnits []string `json:"mask_units,omitempty"`
+
+	// Templates are files rendered and written by template-files.
+	Templates []FileTemplate `json:"templates,omitempty"`
+
+	// Vars are available to templates as {{.Vars.name}}.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// FileTemplate is a file written into the filesystem from a text/template.
+// Templates see TemplateData.
+type FileTemplate struct {
+	Path     string `json:"path"`
+	Template string `json:"template"`
+	Mode     uint32 `json:"mode,omitempty"` // default 0644
+}
+
+// TemplateData is the data FileTemplate templates are executed with.
+type TemplateData struct {
+	VM   string
+	Vars map[string]string
+}
+
+// SanitizeOptions selects the passes of one SanitizeFilesystem call.
+type SanitizeOptions struct {
+	// Passes run in the given order. Empty runs the default passes in
+	// registration order.
+	Passes []string `json:"passes,omitempty"`
+
+	Rules SanitizeRules `json:"rules"`
+
+	// DryRun reports what each pass would remove or modify on the source
+	// filesystem without copying or changing it.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// VMName is exposed to file templates.
+	VMName string `json:"vm_name,omitempty"`
+
+	// FailOnSecrets fails sanitization when the scan-secrets pass reports
+	// findings. Dry runs only report them.
+	FailOnSecrets bool `json:"fail_on_secrets,omitempty"`
+
+	// TargetDir, when set, is a directory kept between calls that the source
+	// is synchronized into instead of copied to workDir/sanitized; only what
+	// changed since the last call is transferred. It is not removed on
+	// cleanup.
+	TargetDir string `json:"target_dir,omitempty"`
+}
+
+// PassReport lists the tree paths one pass removed or modified (or would
+// have, in a dry run).
+type PassReport struct {
+	Name     string          `json:"name"`
+	Removed  []string        `json:"removed,omitempty"`
+	Modified []string        `json:"modified,omitempty"`
+	Findings []SecretFinding `json:"findings,omitempty"`
+}
+
+// SecretFinding locates a suspected credential. The secret itself is not
+// recorded.
+type SecretFinding struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line"`
+	Detector string `json:"detector"`
+}
+
+// DefaultBlockingUnits are the systemd units masked by the mask-units pass
+// unless SanitizerConfig.BlockingUnits is set. They commonly block container
+// startup or make no sense without hardware.
+var DefaultBlockingUnits = []string{
+	// Hardware/kernel related
+	"systemd-modules-load.service",
+	"systemd-sysctl.service",
+	"systemd-udevd.service",
+	"systemd-udev-trigger.service",
+	"systemd-udev-settle.service",
+	"kmod-static-nodes.service",
+	"systemd-tmpfiles-setup-dev.service",
+
+	// Filesystem related
+	"systemd-remount-fs.service",
+	"systemd-fsck@.service",
+	"systemd-fsck-root.service",
+	"local-fs.target",
+	"local-fs-pre.target",
+
+	// Network hardware related
+	"NetworkManager-wait-online.service",
+	"systemd-networkd-wait-online.service",
+
+	// Other blocking services
+	"plymouth-start.service",
+	"plymouth-quit.service",
+	"plymouth-quit-wait.service",
+	"systemd-machine-id-commit.service",
+	"systemd-firstboot.service",
+	"systemd-random-seed.service",
+
+	// Console/TTY related
+	"getty@.service",
+	"serial-getty@.service",
+	"console-getty.service",
+	"container-getty@.service",
+	"systemd-ask-password-wall.service",
+	"systemd-ask-password-console.service",
+}
+
+// Sanitizer handles filesystem sanitization for container usage. It holds a
+// registry of named passes; the built-in ones are registered by NewSanitizer
+// and more can be added with Register.
 type Sanitizer struct {
 	// verbose enables detailed logging of sanitization steps.
 	verbose bool
+
+	// blockingUnits are masked by the mask-units pass.
+	blockingUnits []string
+
+	// detectors and scanPaths drive the scan-secrets pass.
+	detectors     []redact.Rule
+	scanPaths     []string
+	failOnSecrets bool
+
+	mu     sync.RWMutex
+	passes map[string]SanitizePass
+	order  []string
 }
 
 // SanitizerConfig configures the sanitizer.
 type SanitizerConfig struct {
 	// Verbose enables detailed logging.
 	Verbose bool
+
+	// BlockingUnits replaces DefaultBlockingUnits as the units the
+	// mask-units pass always masks.
+	BlockingUnits []string
+
+	// SecretDetectors replaces redact.DefaultRules as the patterns the
+	// scan-secrets pass looks for.
+	SecretDetectors []redact.Rule
+
+	// SecretScanPaths replaces DefaultSecretScanPaths as the directories the
+	// scan-secrets pass reads.
+	SecretScanPaths []string
+
+	// FailOnSecrets sets SanitizeOptions.FailOnSecrets for every call.
+	FailOnSecrets bool
 }
 
-// NewSanitizer creates a new Sanitizer with the given configuration.
+// NewSanitizer creates a new Sanitizer with the given configuration and the
+// built-in passes registered.
 func NewSanitizer(cfg SanitizerConfig) *Sanitizer {
-	return &Sanitizer{
-		verbose: cfg.Verbose,
+	units := cfg.BlockingUnits
+	if units == nil {
+		units = DefaultBlockingUnits
+	}
+	detectors := cfg.SecretDetectors
+	if detectors == nil {
+		detectors = redact.DefaultRules()
+	}
+	scanPaths := cfg.SecretScanPaths
+	if scanPaths == nil {
+		scanPaths = DefaultSecretScanPaths
+	}
+	s := &Sanitizer{
+		verbose:       cfg.Verbose,
+		blockingUnits: append([]string(nil), units...),
+		detectors:     detectors,
+		scanPaths:     append([]string(nil), scanPaths...),
+		failOnSecrets: cfg.FailOnSecrets,
+		passes:        make(map[string]SanitizePass),
+	}
+	for _, p := range s.builtinPasses() {
+		_ = s.Register(p)
+	}
+	return s
+}
+
+// Register adds a pass to the registry. Names must be unique.
+func (s *Sanitizer) Register(p SanitizePass) error {
+	if p.Name == "" || p.Run == nil {
+		return fmt.Errorf("sanitize pass needs a name and a Run function")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.passes[p.Name]; ok {
+		return fmt.Errorf("sanitize pass %q is already registered", p.Name)
+	}
+	s.passes[p.Name] = p
+	s.order = append(s.order, p.Name)
+	return nil
+}
+
+// Passes returns the registered passes in registration order.
+func (s *Sanitizer) Passes() []SanitizePass {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]SanitizePass, 0, len(s.order))
+	for _, name := range s.order {
+		out = append(out, s.passes[name])
+	}
+	return out
+}
+
+// Validate checks that opts names registered passes and well-formed rules,
+// and that every rule is consumed by a selected pass.
+func (s *Sanitizer) Validate(opts SanitizeOptions) error {
+	passes, err := s.resolve(opts.Passes)
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool, len(passes))
+	for _, p := range passes {
+		selected[p.Name] = true
+	}
+	r := opts.Rules
+	for i, p := range r.DropPaths {
+		if !filepath.IsAbs(p) || filepath.Clean(p) == "/" {
+			return fmt.Errorf("drop_paths[%d] %q must be an absolute path other than /: %w", i, p, ErrInvalidRules)
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("drop_paths[%d] %q: %v: %w", i, p, err, ErrInvalidRules)
+		}
+	}
+	for i, u := range r.MaskUnits {
+		if u == "" || strings.ContainsAny(u, "/\x00") {
+			return fmt.Errorf("mask_units[%d] %q must be a unit name: %w", i, u, ErrInvalidRules)
+		}
 	}
+	for i, ft := range r.Templates {
+		if !filepath.IsAbs(ft.Path) || filepath.Clean(ft.Path) == "/" {
+			return fmt.Errorf("templates[%d].path %q must be an absolute file path: %w", i, ft.Path, ErrInvalidRules)
+		}
+		if ft.Mode > 0o7777 {
+			return fmt.Errorf("templates[%d].mode %o is not a permission mode: %w", i, ft.Mode, ErrInvalidRules)
+		}
+		if _, err := parseFileTemplate(ft); err != nil {
+			return fmt.Errorf("templates[%d]: %v: %w", i, err, ErrInvalidRules)
+		}
+	}
+	for pass, used := range map[string]bool{
+		passDropPaths:     len(r.DropPaths) > 0,
+		passMaskUnits:     len(r.MaskUnits) > 0,
+		passTemplateFiles: len(r.Templates) > 0,
+	} {
+		if used && !selected[pass] {
+			return fmt.Errorf("rules for pass %s, which is not selected: %w", pass, ErrInvalidRules)
+		}
+	}
+	return nil
+}
+
+// resolve returns the passes named, or the default passes if none are.
+func (s *Sanitizer) resolve(names []string) ([]SanitizePass, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(names) == 0 {
+		var out []SanitizePass
+		for _, name := range s.order {
+			if p := s.passes[name]; p.Default {
+				out = append(out, p)
+			}
+		}
+		return out, nil
+	}
+	seen := make(map[string]bool, len(names))
+	out := make([]SanitizePass, 0, len(names))
+	for _, name := range names {
+		p, ok := s.passes[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownPass, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("sanitize pass %q is listed twice: %w", name, ErrInvalidRules)
+		}
+		seen[name] = true
+		out = append(out, p)
+	}
+	return out, nil
 }
 
 // SanitizeResult contains the result of filesystem sanitization.
 type SanitizeResult struct {
-	// SanitizedPath is the path to the sanitized filesystem copy.
+	// SanitizedPath is the path to the sanitized filesystem copy. It is
+	// empty for dry runs.
 	SanitizedPath string
 
 	// RemovedPaths lists paths that were removed or neutralized.
@@ -42,81 +337,117 @@ type SanitizeResult struct {
 	// ModifiedPaths lists paths that were modified.
 	ModifiedPaths []string
 
+	// Passes reports the changes of each pass in the order they ran.
+	Passes []PassReport
+
+	// Findings lists the suspected credentials the scan reported.
+	Findings []SecretFinding
+
 	// Cleanup is a function to remove the sanitized copy.
 	Cleanup workflow.CleanupFunc
 }
 
 // SanitizeFilesystem creates a sanitized copy of the mounted filesystem
-// suitable for container usage. It removes or neutralizes:
-// - /boot directory
-// - kernel modules (/lib/modules)
-// - device nodes under /dev
-// - fstab contents
-// - swap references
-// - systemd services that block container execution
-func (s *Sanitizer) SanitizeFilesystem(ctx context.Context, sourcePath string, workDir string) (*SanitizeResult, error) {
-	// Create a working directory for the sanitized copy
-	sanitizedPath := filepath.Join(workDir, "sanitized")
-	if err := os.MkdirAll(sanitizedPath, 0o755); err != nil {
-		return nil, workflow.NewWorkflowError(
-			workflow.StageSanitizeFS,
-			workflow.ErrSanitizeFailed,
-			fmt.Sprintf("failed to create sanitized directory: %v", err),
-		)
-	}
+// suitable for container usage and runs the selected passes on it. The
+// default passes remove or neutralize:
+//   - /boot directory
+//   - kernel modules (/lib/modules)
+//   - device nodes under /dev
+//   - fstab contents
+//   - swap references
+//   - systemd services that block container execution
+//   - identity material: SSH host keys, machine-id, cloud-init instance
+//     state, /root/.ssh and password hashes
+//   - shell histories and logs
+//
+// and then scan for secrets. With opts.FailOnSecrets (or
+// SanitizerConfig.FailOnSecrets) any finding fails with
+// workflow.ErrSecretsFound.
+//
+// With opts.DryRun the source is not copied; the passes run against it
+// read-only and the result reports what each would remove or modify. With
+// opts.TargetDir the copy is synchronized into that directory and kept.
+func (s *Sanitizer) SanitizeFilesystem(ctx context.Context, sourcePath string, workDir string, opts SanitizeOptions) (*SanitizeResult, error) {
+	if err := s.Validate(opts); err != nil {
+		return nil, workflow.NewWorkflowError(workflow.StageSanitizeFS, workflow.ErrSanitizeFailed, err.Error())
+	}
+	passes, _ := s.resolve(opts.Passes)
 
 	result := &SanitizeResult{
-		SanitizedPath: sanitizedPath,
 		RemovedPaths:  make([]string, 0),
 		ModifiedPaths: make([]string, 0),
-	}
-
-	// Copy the filesystem using rsync for efficiency
-	// We exclude certain paths during copy rather than copying then deleting
-	if err := s.copyFilesystem(ctx, sourcePath, sanitizedPath); err != nil {
-		_ = os.RemoveAll(sanitizedPath)
-		return nil, workflow.NewWorkflowError(
-			workflow.StageSanitizeFS,
-			workflow.ErrSanitizeFailed,
-			fmt.Sprintf("failed to copy filesystem: %v", err),
-		)
-	}
-
-	// Apply sanitization steps
-	sanitizers := []struct {
-		name string
-		fn   func(ctx context.Context, rootPath string, result *SanitizeResult) error
-	}{
-		{"remove boot directory", s.removeBoot},
-		{"remove kernel modules", s.removeKernelModules},
-		{"clear device nodes", s.clearDeviceNodes},
-		{"sanitize fstab", s.sanitizeFstab},
-		{"remove swap references", s.removeSwapReferences},
-		{"disable blocking systemd services", s.disableBlockingServices},
-		{"set container environment marker", s.setContainerMarker},
-	}
+		Cleanup:       func() error { return nil },
+	}
+	root := sourcePath
+	if !opts.DryRun {
+		// Create a working directory for the sanitized copy
+		sanitizedPath := filepath.Join(workDir, "sanitized")
+		if opts.TargetDir != "" {
+			sanitizedPath = opts.TargetDir
+		}
+		if err := os.MkdirAll(sanitizedPath, 0o755); err != nil {
+			return nil, workflow.NewWorkflowError(
+				workflow.StageSanitizeFS,
+				workflow.ErrSanitizeFailed,
+				fmt.Sprintf("failed to create sanitized directory: %v", err),
+			)
+		}
 
-	for _, sanitizer := range sanitizers {
-		if err := sanitizer.fn(ctx, sanitizedPath, result); err != nil {
+		// Copy the filesystem using rsync for efficiency
+		// We exclude certain paths during copy rather than copying then deleting
+		if err := s.copyFilesystem(ctx, sourcePath, sanitizedPath, opts.TargetDir != ""); err != nil {
 			_ = os.RemoveAll(sanitizedPath)
 			return nil, workflow.NewWorkflowError(
 				workflow.StageSanitizeFS,
 				workflow.ErrSanitizeFailed,
-				fmt.Sprintf("%s failed: %v", sanitizer.name, err),
+				fmt.Sprintf("failed to copy filesystem: %v", err),
 			)
 		}
+		result.SanitizedPath = sanitizedPath
+		if opts.TargetDir == "" {
+			result.Cleanup = func() error {
+				return os.RemoveAll(sanitizedPath)
+			}
+		}
+		root = sanitizedPath
 	}
 
-	result.Cleanup = func() error {
-		return os.RemoveAll(sanitizedPath)
+	prior := make(map[string]bool)
+	for _, p := range passes {
+		t := &Tree{Root: root, DryRun: opts.DryRun, VMName: opts.VMName, prior: prior}
+		if err := p.Run(ctx, t, opts.Rules); err != nil {
+			_ = result.Cleanup()
+			return nil, workflow.NewWorkflowError(
+				workflow.StageSanitizeFS,
+				workflow.ErrSanitizeFailed,
+				fmt.Sprintf("%s failed: %v", p.Name, err),
+			)
+		}
+		result.Passes = append(result.Passes, PassReport{Name: p.Name, Removed: t.removed, Modified: t.modified, Findings: t.findings})
+		result.RemovedPaths = append(result.RemovedPaths, t.removed...)
+		result.ModifiedPaths = append(result.ModifiedPaths, t.modified...)
+		result.Findings = append(result.Findings, t.findings...)
+		for _, r := range t.removed {
+			prior[r] = true
+		}
 	}
 
+	if len(result.Findings) > 0 && (opts.FailOnSecrets || s.failOnSecrets) && !opts.DryRun {
+		_ = result.Cleanup()
+		return nil, workflow.NewWorkflowError(
+			workflow.StageSanitizeFS,
+			workflow.ErrSecretsFound,
+			describeFindings(result.Findings),
+		)
+	}
 	return result, nil
 }
 
 // copyFilesystem copies the source filesystem to the destination,
-// excluding paths that will be removed anyway.
-func (s *Sanitizer) copyFilesystem(ctx context.Context, src, dst string) error {
+// excluding paths that will be removed anyway. With sync, dst holds an
+// earlier copy: unchanged files are skipped and files no longer in src, or
+// excluded, are deleted.
+func (s *Sanitizer) copyFilesystem(ctx context.Context, src, dst string, sync bool) error {
 	// Use rsync for efficient copying with exclusions
 	// Exclude paths we're going to remove anyway to save time and space
 	excludes := []string{
@@ -141,6 +472,9 @@ func (s *Sanitizer) copyFilesystem(ctx context.Context, src, dst string) error {
 		"--xattrs",     // preserve extended attributes
 		"--sparse",     // handle sparse files efficiently
 	}
+	if sync {
+		args = append(args, "--delete", "--delete-excluded")
+	}
 	args = append(args, excludes...)
 	args = append(args, src+"/", dst+"/")
 
@@ -150,6 +484,15 @@ func (s *Sanitizer) copyFilesystem(ctx context.Context, src, dst string) error {
 
 	if err := cmd.Run(); err != nil {
 		// Try with cp if rsync is not available
+		if sync {
+			// cp cannot delete: start the copy over.
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+		}
 		return s.copyFilesystemFallback(ctx, src, dst)
 	}
 
@@ -176,263 +519,282 @@ func (s *Sanitizer) copyFilesystemFallback(ctx context.Context, src, dst string)
 	return nil
 }
 
-// removeBoot removes the /boot directory contents.
-func (s *Sanitizer) removeBoot(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	bootPath := filepath.Join(rootPath, "boot")
+// parseFileTemplate parses ft's template, failing on unknown keys at execution.
+func parseFileTemplate(ft FileTemplate) (*template.Template, error) {
+	return template.New(ft.Path).Option("missingkey=error").Parse(ft.Template)
+}
 
-	// Remove contents but keep the directory
-	if err := s.clearDirectory(bootPath); err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
+// maxSymlinks bounds symlink expansion when resolving tree paths.
+const maxSymlinks = 40
 
-	result.RemovedPaths = append(result.RemovedPaths, "/boot/*")
-	return nil
-}
+// Tree is the root filesystem a pass works on. Paths given to its methods are
+// absolute paths inside the tree; symlinks are resolved as if Root were /, so
+// no link in the image can redirect a change to the host. With DryRun set,
+// the mutating methods only record the change.
+type Tree struct {
+	Root   string
+	DryRun bool
 
-// removeKernelModules removes kernel modules from /lib/modules.
-func (s *Sanitizer) removeKernelModules(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	modulesPath := filepath.Join(rootPath, "lib", "modules")
+	// VMName is the name of the VM the filesystem came from.
+	VMName string
 
-	if err := s.clearDirectory(modulesPath); err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
+	removed  []string
+	modified []string
+	findings []SecretFinding
 
-	result.RemovedPaths = append(result.RemovedPaths, "/lib/modules/*")
-	return nil
+	// prior holds the paths removed by earlier passes of the same run.
+	prior map[string]bool
 }
 
-// clearDeviceNodes removes all device nodes under /dev.
-func (s *Sanitizer) clearDeviceNodes(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	devPath := filepath.Join(rootPath, "dev")
+// hostPath maps the tree path p to a host path under Root. Symlinks in the
+// directories leading to p are followed within the tree; p itself is not
+// followed, so removing or replacing a link affects the link.
+func (t *Tree) hostPath(p string) (string, error) {
+	return t.resolve(p, false)
+}
 
-	// Remove contents but keep the directory
-	if err := s.clearDirectory(devPath); err != nil {
-		if os.IsNotExist(err) {
-			return nil
+// targetPath is hostPath with p itself followed within the tree too, for
+// operations that act on what a link points to: reading, listing and
+// truncating. The host calls must not follow a link themselves.
+func (t *Tree) targetPath(p string) (string, error) {
+	return t.resolve(p, true)
+}
+
+// resolve walks p component by component under Root, expanding symlinks as
+// if Root were /. The final component is expanded only with followFinal.
+func (t *Tree) resolve(p string, followFinal bool) (string, error) {
+	rest := strings.Split(strings.TrimPrefix(filepath.Clean("/"+p), "/"), "/")
+	var resolved []string
+	links := 0
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
 		}
-		return err
+		if len(rest) == 0 && !followFinal {
+			resolved = append(resolved, part)
+			break
+		}
+		cur := filepath.Join(t.Root, filepath.Join(resolved...), part)
+		fi, err := os.Lstat(cur)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := os.Readlink(cur)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		rest = append(strings.Split(filepath.Clean(target), "/"), rest...)
 	}
+	return filepath.Join(t.Root, filepath.Join(resolved...)), nil
+}
 
-	// Create minimal /dev entries that containers expect
-	// The container runtime will populate /dev properly
-	if err := os.MkdirAll(devPath, 0o755); err != nil {
-		return err
+// Exists reports whether p exists in the tree (without following p itself).
+func (t *Tree) Exists(p string) bool {
+	hp, err := t.hostPath(p)
+	if err != nil {
+		return false
 	}
+	_, err = os.Lstat(hp)
+	return err == nil
+}
 
-	// Create /dev/null, /dev/zero, /dev/random placeholders
-	// These are symlinks that the container runtime will handle
-	devEntries := []string{"null", "zero", "random", "urandom", "tty", "console"}
-	for _, entry := range devEntries {
-		placeholder := filepath.Join(devPath, entry)
-		// Create empty placeholder files
-		f, err := os.Create(placeholder)
-		if err != nil {
-			continue // Non-fatal, container runtime will create these
-		}
-		f.Close()
+// ReadFile reads the file at p, following a link at p within the tree.
+func (t *Tree) ReadFile(p string) ([]byte, error) {
+	hp, err := t.targetPath(p)
+	if err != nil {
+		return nil, err
 	}
+	return os.ReadFile(hp)
+}
 
-	result.RemovedPaths = append(result.RemovedPaths, "/dev/*")
-	return nil
+// ReadDir lists the directory at p, following a link at p within the tree.
+func (t *Tree) ReadDir(p string) ([]os.DirEntry, error) {
+	hp, err := t.targetPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(hp)
 }
 
-// sanitizeFstab clears or comments out /etc/fstab entries.
-func (s *Sanitizer) sanitizeFstab(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	fstabPath := filepath.Join(rootPath, "etc", "fstab")
+// Glob returns the tree paths matching pattern.
+func (t *Tree) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(t.Root, filepath.Clean("/"+pattern)))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(matches))
+	for _, m := range matches {
+		rel, err := filepath.Rel(t.Root, m)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		out = append(out, "/"+rel)
+	}
+	return out, nil
+}
 
-	content, err := os.ReadFile(fstabPath)
+// Remove removes p and anything below it. Missing paths are not reported.
+func (t *Tree) Remove(p string) error {
+	hp, err := t.hostPath(p)
 	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(hp); err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-
-	// Comment out all mount entries, keeping only comments
-	lines := strings.Split(string(content), "\n")
-	var newLines []string
-	newLines = append(newLines, "# fstab sanitized for container usage")
-	newLines = append(newLines, "# Original entries commented out:")
-	newLines = append(newLines, "")
-
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-			newLines = append(newLines, line)
-		} else {
-			newLines = append(newLines, "# "+line)
+	if !t.DryRun {
+		if err := os.RemoveAll(hp); err != nil {
+			return err
 		}
 	}
-
-	if err := os.WriteFile(fstabPath, []byte(strings.Join(newLines, "\n")), 0o644); err != nil {
-		return err
-	}
-
-	result.ModifiedPaths = append(result.ModifiedPaths, "/etc/fstab")
+	t.Removed(p)
 	return nil
 }
 
-// removeSwapReferences removes or disables swap configuration.
-func (s *Sanitizer) removeSwapReferences(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	// Remove swapfile if it exists
-	swapfile := filepath.Join(rootPath, "swapfile")
-	if _, err := os.Stat(swapfile); err == nil {
-		if err := os.Remove(swapfile); err != nil {
-			return err
-		}
-		result.RemovedPaths = append(result.RemovedPaths, "/swapfile")
-	}
-
-	// Remove any .swap files in root
-	entries, err := os.ReadDir(rootPath)
+// ClearDir removes the contents of directory p but keeps the directory
+// itself. It is reported as p/*; a missing directory is not an error.
+func (t *Tree) ClearDir(p string) error {
+	hp, err := t.targetPath(p)
 	if err != nil {
 		return err
 	}
-	for _, entry := range entries {
-		if strings.HasSuffix(entry.Name(), ".swap") {
-			swapPath := filepath.Join(rootPath, entry.Name())
-			if err := os.Remove(swapPath); err != nil {
-				continue // Non-fatal
-			}
-			result.RemovedPaths = append(result.RemovedPaths, "/"+entry.Name())
+	entries, err := os.ReadDir(hp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
 	}
-
-	// Disable swap-related systemd units
-	swapUnits := []string{
-		"swap.target",
-		"dev-*.swap",
-	}
-
-	// systemdPath := filepath.Join(rootPath, "etc", "systemd", "system")
-	for _, unit := range swapUnits {
-		// unitPath := filepath.Join(systemdPath, unit)
-		// Create a masked symlink to /dev/null
-		if err := s.maskSystemdUnit(rootPath, unit); err != nil {
-			continue // Non-fatal
+	if !t.DryRun {
+		for _, entry := range entries {
+			// Try to continue with other entries
+			_ = os.RemoveAll(filepath.Join(hp, entry.Name()))
 		}
 	}
-
+	t.Removed(strings.TrimSuffix(p, "/") + "/*")
 	return nil
 }
 
-// disableBlockingServices disables systemd services that block container execution.
-func (s *Sanitizer) disableBlockingServices(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	// Services that commonly block container startup or are inappropriate
-	blockingServices := []string{
-		// Hardware/kernel related
-		"systemd-modules-load.service",
-		"systemd-sysctl.service",
-		"systemd-udevd.service",
-		"systemd-udev-trigger.service",
-		"systemd-udev-settle.service",
-		"kmod-static-nodes.service",
-		"systemd-tmpfiles-setup-dev.service",
-
-		// Filesystem related
-		"systemd-remount-fs.service",
-		"systemd-fsck@.service",
-		"systemd-fsck-root.service",
-		"local-fs.target",
-		"local-fs-pre.target",
-
-		// Network hardware related
-		"NetworkManager-wait-online.service",
-		"systemd-networkd-wait-online.service",
-
-		// Other blocking services
-		"plymouth-start.service",
-		"plymouth-quit.service",
-		"plymouth-quit-wait.service",
-		"systemd-machine-id-commit.service",
-		"systemd-firstboot.service",
-		"systemd-random-seed.service",
-
-		// Console/TTY related
-		"getty@.service",
-		"serial-getty@.service",
-		"console-getty.service",
-		"container-getty@.service",
-		"systemd-ask-password-wall.service",
-		"systemd-ask-password-console.service",
-	}
-
-	for _, service := range blockingServices {
-		if err := s.maskSystemdUnit(rootPath, service); err != nil {
-			continue // Non-fatal, service may not exist
-		}
-		result.ModifiedPaths = append(result.ModifiedPaths, "/etc/systemd/system/"+service)
+// WriteFile writes data to p, creating parent directories.
+func (t *Tree) WriteFile(p string, data []byte, perm os.FileMode) error {
+	hp, err := t.hostPath(p)
+	if err != nil {
+		return err
 	}
-
+	if !t.DryRun {
+		if err := os.MkdirAll(filepath.Dir(hp), 0o755); err != nil {
+			return err
+		}
+		// Replace rather than write through an existing symlink.
+		if fi, err := os.Lstat(hp); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(hp); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(hp, data, perm); err != nil {
+			return err
+		}
+	}
+	t.Modified(p)
 	return nil
 }
 
-// maskSystemdUnit masks a systemd unit by creating a symlink to /dev/null.
-func (s *Sanitizer) maskSystemdUnit(rootPath, unitName string) error {
-	systemdPath := filepath.Join(rootPath, "etc", "systemd", "system")
-	if err := os.MkdirAll(systemdPath, 0o755); err != nil {
+// Symlink replaces p with a symlink to target.
+func (t *Tree) Symlink(target, p string) error {
+	hp, err := t.hostPath(p)
+	if err != nil {
 		return err
 	}
-
-	unitPath := filepath.Join(systemdPath, unitName)
-
-	// Remove existing unit/symlink if present
-	_ = os.Remove(unitPath)
-
-	// Create symlink to /dev/null to mask the unit
-	return os.Symlink("/dev/null", unitPath)
+	if !t.DryRun {
+		if err := os.MkdirAll(filepath.Dir(hp), 0o755); err != nil {
+			return err
+		}
+		_ = os.Remove(hp)
+		if err := os.Symlink(target, hp); err != nil {
+			return err
+		}
+	}
+	t.Modified(p)
+	return nil
 }
 
-// setContainerMarker creates markers indicating container environment.
-func (s *Sanitizer) setContainerMarker(ctx context.Context, rootPath string, result *SanitizeResult) error {
-	// Create /run/container marker directory
-	runPath := filepath.Join(rootPath, "run")
-	if err := os.MkdirAll(runPath, 0o755); err != nil {
-		return err
-	}
+// MaskUnit masks a systemd unit by linking it to /dev/null.
+func (t *Tree) MaskUnit(unit string) error {
+	return t.Symlink("/dev/null", "/etc/systemd/system/"+unit)
+}
 
-	// Create /.dockerenv equivalent for container detection
-	dockerenvPath := filepath.Join(rootPath, ".dockerenv")
-	f, err := os.Create(dockerenvPath)
+// Walk calls fn for p and every path below it like filepath.WalkDir, in
+// lexical order and without following symlinks. fn receives tree paths. A
+// missing p is not an error.
+func (t *Tree) Walk(p string, fn func(path string, d os.DirEntry, err error) error) error {
+	hp, err := t.hostPath(p)
 	if err != nil {
 		return err
 	}
-	f.Close()
-	result.ModifiedPaths = append(result.ModifiedPaths, "/.dockerenv")
-
-	// Create /run/.containerenv for Podman detection
-	containerenvPath := filepath.Join(runPath, ".containerenv")
-	containerenvContent := `engine="podman"
-name="vmclone"
-`
-	if err := os.WriteFile(containerenvPath, []byte(containerenvContent), 0o644); err != nil {
-		return err
+	if _, err := os.Lstat(hp); os.IsNotExist(err) {
+		return nil
 	}
-	result.ModifiedPaths = append(result.ModifiedPaths, "/run/.containerenv")
-
-	return nil
+	return filepath.WalkDir(hp, func(host string, d os.DirEntry, err error) error {
+		rel, rerr := filepath.Rel(t.Root, host)
+		if rerr != nil {
+			return rerr
+		}
+		return fn("/"+filepath.ToSlash(rel), d, err)
+	})
 }
 
-// clearDirectory removes all contents of a directory but keeps the directory itself.
-func (s *Sanitizer) clearDirectory(dirPath string) error {
-	entries, err := os.ReadDir(dirPath)
+// Truncate empties the file at p, keeping its mode and ownership. A link at
+// p is followed within the tree.
+func (t *Tree) Truncate(p string) error {
+	hp, err := t.targetPath(p)
 	if err != nil {
 		return err
 	}
-
-	for _, entry := range entries {
-		entryPath := filepath.Join(dirPath, entry.Name())
-		if err := os.RemoveAll(entryPath); err != nil {
-			// Try to continue with other entries
-			continue
+	if !t.DryRun {
+		if err := os.Truncate(hp, 0); err != nil {
+			return err
 		}
 	}
-
+	t.Modified(p)
 	return nil
 }
+
+// gone reports whether an earlier pass removed p. It matters only for dry
+// runs, where removed paths are still on disk.
+func (t *Tree) gone(p string) bool {
+	for q := p; ; q = path.Dir(q) {
+		if t.prior[q] || (q != p && t.prior[q+"/*"]) {
+			return true
+		}
+		if q == "/" {
+			return false
+		}
+	}
+}
+
+// Finding records a suspected secret.
+func (t *Tree) Finding(f SecretFinding) { t.findings = append(t.findings, f) }
+
+// Removed records p as removed, for passes that change the tree directly.
+func (t *Tree) Removed(p string) { t.removed = append(t.removed, p) }
+
+// Modified records p as modified, for passes that change the tree directly.
+func (t *Tree) Modified(p string) { t.modified = append(t.modified, p) }
@@ -0,0 +1,292 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultSecretScanPaths are the directories the scan-secrets pass reads
+// unless SanitizerConfig.SecretScanPaths is set. System binaries and package
+// data are left out; credentials live in configuration and home directories.
+var DefaultSecretScanPaths = []string{
+	"/etc",
+	"/root",
+	"/home",
+	"/opt",
+	"/srv",
+	"/usr/local/etc",
+	"/var/www",
+}
+
+// maxScanFileSize bounds the files the secret scan reads.
+const maxScanFileSize = 1 << 20
+
+// historyFiles are removed from every home directory by clear-histories.
+var historyFiles = []string{
+	".bash_history",
+	".zsh_history",
+	".sh_history",
+	".ash_history",
+	".history",
+	".python_history",
+	".mysql_history",
+	".psql_history",
+	".sqlite_history",
+	".rediscli_history",
+	".node_repl_history",
+	".lesshst",
+	".viminfo",
+	".wget-hsts",
+	".local/share/fish/fish_history",
+}
+
+// rotatedLog matches rotated or compressed log files, which are removed
+// rather than truncated.
+var rotatedLog = regexp.MustCompile(`(\.[0-9]+|\.gz|\.xz|\.bz2|\.zst|\.old|-[0-9]{8})$`)
+
+// sshKeygenUnit regenerates SSH host keys on first boot of the clone.
+const sshKeygenUnit = `[Unit]
+Description=Regenerate SSH host keys removed when the image was cloned
+Before=ssh.service sshd.service
+ConditionPathExistsGlob=!/etc/ssh/ssh_host_*_key
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/ssh-keygen -A
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// scrubIdentity removes or resets the material that identifies the source
+// VM, so clones neither share its identity nor carry its credentials.
+func scrubIdentity(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	// SSH host keys; a oneshot unit regenerates them when sshd is installed.
+	keys, err := t.Glob("/etc/ssh/ssh_host_*")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := t.Remove(k); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 && t.Exists("/etc/ssh/sshd_config") {
+		if err := t.WriteFile("/etc/systemd/system/ssh-host-keygen.service", []byte(sshKeygenUnit), 0o644); err != nil {
+			return err
+		}
+		if err := t.Symlink("../ssh-host-keygen.service", "/etc/systemd/system/multi-user.target.wants/ssh-host-keygen.service"); err != nil {
+			return err
+		}
+	}
+
+	// An empty machine-id is generated on first boot.
+	if b, err := t.ReadFile("/etc/machine-id"); err == nil && len(bytes.TrimSpace(b)) > 0 {
+		if err := t.WriteFile("/etc/machine-id", nil, 0o444); err != nil {
+			return err
+		}
+	}
+	for _, p := range []string{
+		"/var/lib/dbus/machine-id",
+		"/var/lib/systemd/random-seed",
+		"/root/.ssh",
+		// cloud-init would otherwise treat the clone as an already
+		// provisioned instance of the source.
+		"/var/lib/cloud/instance",
+		"/var/lib/cloud/data",
+		"/var/lib/cloud/sem",
+	} {
+		if err := t.Remove(p); err != nil {
+			return err
+		}
+	}
+	if err := t.ClearDir("/var/lib/cloud/instances"); err != nil {
+		return err
+	}
+	return lockPasswords(t)
+}
+
+// lockPasswords replaces password hashes in /etc/shadow with "!", keeping
+// accounts but disabling password login with the source's credentials.
+func lockPasswords(t *Tree) error {
+	content, err := t.ReadFile("/etc/shadow")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lines := strings.Split(string(content), "\n")
+	changed := false
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 {
+			continue
+		}
+		hash := fields[1]
+		// "", "*", "!" and "!!" carry no hash; "!$6$..." is locked but
+		// still holds one.
+		if hash == "" || hash == "*" || hash == "!" || hash == "!!" || hash == "!*" {
+			continue
+		}
+		fields[1] = "!"
+		lines[i] = strings.Join(fields, ":")
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return t.WriteFile("/etc/shadow", []byte(strings.Join(lines, "\n")), 0o640)
+}
+
+// clearHistories removes shell and tool histories from /root and /home/*.
+func clearHistories(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	homes, err := t.Glob("/home/*")
+	if err != nil {
+		return err
+	}
+	homes = append([]string{"/root"}, homes...)
+	for _, home := range homes {
+		for _, name := range historyFiles {
+			if err := t.Remove(path.Join(home, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clearLogs truncates logs under /var/log, keeping the files services expect,
+// and removes rotated logs and journals.
+func clearLogs(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	var truncate, remove []string
+	err := t.Walk("/var/log", func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == "/var/log/journal" {
+				remove = append(remove, p+"/*")
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if rotatedLog.MatchString(d.Name()) {
+			remove = append(remove, p)
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && fi.Size() > 0 {
+			truncate = append(truncate, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range remove {
+		if strings.HasSuffix(p, "/*") {
+			err = t.ClearDir(strings.TrimSuffix(p, "/*"))
+		} else {
+			err = t.Remove(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range truncate {
+		if err := t.Truncate(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSecrets reports credentials the detectors find in text files under the
+// scan paths. Paths earlier passes removed are skipped.
+func (s *Sanitizer) scanSecrets(ctx context.Context, t *Tree, _ SanitizeRules) error {
+	for _, root := range s.scanPaths {
+		err := t.Walk(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				if os.IsPermission(err) {
+					return nil
+				}
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if t.gone(p) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if fi, err := d.Info(); err != nil || fi.Size() > maxScanFileSize {
+				return nil
+			}
+			content, err := t.ReadFile(p)
+			if err != nil {
+				return nil // unreadable files are not scanned
+			}
+			for _, f := range s.detect(p, content) {
+				t.Finding(f)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("scan %s: %w", root, err)
+		}
+	}
+	return nil
+}
+
+// detect runs the detectors over content. Binary files are skipped.
+func (s *Sanitizer) detect(p string, content []byte) []SecretFinding {
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+	seen := make(map[SecretFinding]bool)
+	var out []SecretFinding
+	for _, rule := range s.detectors {
+		for _, m := range rule.Pattern.FindAllIndex(content, -1) {
+			f := SecretFinding{Path: p, Line: 1 + bytes.Count(content[:m[0]], []byte("\n")), Detector: rule.Name}
+			if !seen[f] {
+				seen[f] = true
+				out = append(out, f)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Line < out[j].Line })
+	return out
+}
+
+// describeFindings summarizes findings for an error detail.
+func describeFindings(findings []SecretFinding) string {
+	const shown = 10
+	parts := make([]string, 0, shown)
+	for i, f := range findings {
+		if i == shown {
+			parts = append(parts, fmt.Sprintf("and %d more", len(findings)-shown))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d (%s)", f.Path, f.Line, f.Detector))
+	}
+	return fmt.Sprintf("%d suspected secret(s): %s", len(findings), strings.Join(parts, ", "))
+}
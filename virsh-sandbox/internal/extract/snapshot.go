@@ -100,14 +100,21 @@ func (m *SnapshotManager) PrepareExtraction(ctx context.Context, vmName string)
 
 	// Create cleanup function that commits the snapshot back
 	plan.Cleanup = func() error {
-		commitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-		defer cancel()
-		return m.domainMgr.BlockCommit(commitCtx, vmName, "vda", 5*time.Minute)
+		return m.CommitSnapshot(context.Background(), vmName)
 	}
 
 	return plan, nil
 }
 
+// CommitSnapshot merges the disk-only snapshot overlay of vmName back into
+// its base image and pivots the domain onto it. It is the cleanup for a
+// snapshot-mode extraction and can be replayed after a restart.
+func (m *SnapshotManager) CommitSnapshot(ctx context.Context, vmName string) error {
+	commitCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	return m.domainMgr.BlockCommit(commitCtx, vmName, "vda", 5*time.Minute)
+}
+
 // generateSnapshotName generates a unique snapshot name based on VM name and timestamp.
 func generateSnapshotName(vmName string) string {
 	return fmt.Sprintf("clone-%s-%d", vmName, time.Now().UnixNano())
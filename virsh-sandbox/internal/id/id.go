@@ -0,0 +1,18 @@
+// Package id generates the short random suffixes of resource IDs such as
+// "SBX-1a2b3c4d".
+package id
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Short returns the first group of a random UUID: eight hex characters.
+func Short() string {
+	id := uuid.NewString()
+	if i := strings.IndexByte(id, '-'); i > 0 {
+		return id[:i]
+	}
+	return id
+}
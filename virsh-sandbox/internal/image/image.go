@@ -0,0 +1,424 @@
+// Package image maintains the catalog of base disk images that sandboxes can
+// be cloned from.
+//
+// Import fetches an image from a local path or an HTTP(S) URL, verifies its
+// SHA256, inspects it with `qemu-img info` and converts it to a standalone
+// qcow2 in the base image directory with `qemu-img convert`. Imports run in the
+// background; the catalog record moves from IMPORTING to READY or FAILED.
+// Recover fails the records of imports a restart interrupted.
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/store"
+)
+
+var (
+	// ErrChecksumMismatch is returned when the imported data does not match the expected SHA256.
+	ErrChecksumMismatch = errors.New("image: sha256 mismatch")
+
+	// ErrNotReady is returned when an image is used before its import finished.
+	ErrNotReady = errors.New("image: not ready")
+
+	// ErrSourceNotAllowed is returned for local paths outside the import allowlist
+	// and for unsupported URL schemes.
+	ErrSourceNotAllowed = errors.New("image: source not allowed")
+)
+
+// nameRe restricts image names to slugs that are safe as file names.
+var nameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,62}[a-z0-9])?$`)
+
+// Store is the subset of store.DataStore used by the image catalog.
+type Store interface {
+	CreateBaseImage(ctx context.Context, img *store.BaseImage) error
+	GetBaseImage(ctx context.Context, id string) (*store.BaseImage, error)
+	ListBaseImages(ctx context.Context, filter store.BaseImageFilter, opt *store.ListOptions) ([]*store.BaseImage, error)
+	UpdateBaseImage(ctx context.Context, img *store.BaseImage) error
+	DeleteBaseImage(ctx context.Context, id string) error
+	ListSandboxes(ctx context.Context, filter store.SandboxFilter, opt *store.ListOptions) ([]*store.Sandbox, error)
+}
+
+// Config controls where images are stored and where they may be imported from.
+type Config struct {
+	// Dir is the base image directory; it must match the libvirt manager's BaseImageDir.
+	Dir string
+
+	// ImportDirs lists host directories local imports may read from. Local
+	// paths outside these directories are rejected; empty disables local imports.
+	ImportDirs []string
+
+	// QemuImgPath overrides the qemu-img binary looked up in PATH.
+	QemuImgPath string
+
+	// ImportTimeout bounds a single import including download and conversion (default 1h).
+	ImportTimeout time.Duration
+}
+
+// ImportRequest describes an image to add to the catalog.
+type ImportRequest struct {
+	Name   string       // required; unique slug, also used as the file name
+	Source string       // required; local path or http(s) URL
+	Format string       // optional; qcow2 | raw; detected when empty
+	SHA256 string       // optional; expected hex digest of the source
+	OS     store.OSInfo // optional guest OS metadata
+}
+
+// Service manages the base image catalog.
+type Service struct {
+	store      Store
+	cfg        Config
+	httpClient *http.Client
+	logger     *slog.Logger
+
+	wg sync.WaitGroup
+}
+
+// Option configures the Service during construction.
+type Option func(*Service)
+
+// WithHTTPClient overrides the client used for URL imports.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Service) { s.httpClient = c }
+}
+
+// WithLogger overrides the logger.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Service) { s.logger = l }
+}
+
+// NewService constructs an image catalog service.
+func NewService(st Store, cfg Config, opts ...Option) *Service {
+	if cfg.ImportTimeout <= 0 {
+		cfg.ImportTimeout = time.Hour
+	}
+	s := &Service{
+		store:      st,
+		cfg:        cfg,
+		httpClient: &http.Client{},
+		logger:     slog.Default(),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Import validates req, records the image as IMPORTING and fetches, verifies
+// and converts it in the background. Poll Get for the final status.
+func (s *Service) Import(ctx context.Context, req ImportRequest) (*store.BaseImage, error) {
+	if err := ValidateName(req.Name); err != nil {
+		return nil, err
+	}
+	switch req.Format {
+	case "", "qcow2", "raw":
+	default:
+		return nil, fmt.Errorf("image format %q must be qcow2 or raw: %w", req.Format, store.ErrInvalid)
+	}
+	if req.SHA256 != "" {
+		if b, err := hex.DecodeString(req.SHA256); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("sha256 must be a 64-character hex digest: %w", store.ErrInvalid)
+		}
+	}
+	if err := s.checkSource(req.Source); err != nil {
+		return nil, err
+	}
+	filename := req.Name + ".qcow2"
+	if _, err := os.Stat(filepath.Join(s.cfg.Dir, filename)); err == nil {
+		return nil, fmt.Errorf("image file %s already exists: %w", filename, store.ErrAlreadyExists)
+	}
+
+	img := &store.BaseImage{
+		ID:           fmt.Sprintf("IMG-%s", id.Short()),
+		Name:         req.Name,
+		Filename:     filename,
+		Source:       req.Source,
+		SourceFormat: req.Format,
+		OS:           req.OS,
+		Status:       store.ImageStatusImporting,
+	}
+	if err := s.store.CreateBaseImage(ctx, img); err != nil {
+		return nil, err
+	}
+
+	bg := *img // the background import must not mutate the returned record
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ictx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.ImportTimeout)
+		defer cancel()
+		s.runImport(ictx, &bg, req)
+	}()
+	return img, nil
+}
+
+// ValidateName reports whether name is usable as a catalog image name, which
+// is also its file name stem.
+func ValidateName(name string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("image name %q must be a lowercase slug (a-z, 0-9, '.', '_', '-'): %w", name, store.ErrInvalid)
+	}
+	return nil
+}
+
+// Wait blocks until all background imports have finished.
+func (s *Service) Wait() {
+	s.wg.Wait()
+}
+
+// Recover fails images left IMPORTING by a previous process, both imports and
+// promoted sandbox disks, and removes their partial files. A file that was
+// already installed is kept for Delete to remove. Call it once at startup,
+// before any import is started.
+func (s *Service) Recover(ctx context.Context) error {
+	importing := store.ImageStatusImporting
+	list, err := s.store.ListBaseImages(ctx, store.BaseImageFilter{Status: &importing}, nil)
+	if err != nil {
+		return fmt.Errorf("list importing images: %w", err)
+	}
+	var errs []error
+	for _, img := range list {
+		for _, tmp := range []string{".import-" + img.ID, img.Filename + ".part"} {
+			if err := os.Remove(filepath.Join(s.cfg.Dir, tmp)); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("image %s: %w", img.ID, err))
+			}
+		}
+		msg := "interrupted by a service restart"
+		img.Status = store.ImageStatusFailed
+		img.Error = &msg
+		if err := s.store.UpdateBaseImage(ctx, img); err != nil {
+			errs = append(errs, fmt.Errorf("image %s: %w", img.ID, err))
+			continue
+		}
+		s.logger.Warn("failed interrupted image import", "image_id", img.ID, "name", img.Name)
+	}
+	return errors.Join(errs...)
+}
+
+// Get returns a catalog image by ID.
+func (s *Service) Get(ctx context.Context, id string) (*store.BaseImage, error) {
+	return s.store.GetBaseImage(ctx, id)
+}
+
+// List returns catalog images.
+func (s *Service) List(ctx context.Context, filter store.BaseImageFilter, opt *store.ListOptions) ([]*store.BaseImage, error) {
+	return s.store.ListBaseImages(ctx, filter, opt)
+}
+
+// Delete removes an image from the catalog and the disk. Images that are still
+// importing or that back live sandboxes cannot be deleted (store.ErrConflict).
+// For an image promoted as a source VM, sandboxes cloned from that VM count
+// too; the domain itself is left defined and should be undefined first.
+func (s *Service) Delete(ctx context.Context, id string) error {
+	img, err := s.store.GetBaseImage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if img.Status == store.ImageStatusImporting {
+		return fmt.Errorf("image %s is still importing: %w", img.ID, store.ErrConflict)
+	}
+	refs := []string{img.Filename}
+	if img.Provenance != nil && img.Provenance.SourceVM != "" {
+		refs = append(refs, img.Provenance.SourceVM)
+	}
+	for _, ref := range refs {
+		users, err := s.store.ListSandboxes(ctx, store.SandboxFilter{BaseImage: &ref}, &store.ListOptions{Limit: 1})
+		if err != nil {
+			return fmt.Errorf("list sandboxes: %w", err)
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("image %s backs sandbox %s: %w", img.ID, users[0].ID, store.ErrConflict)
+		}
+	}
+	if err := os.Remove(filepath.Join(s.cfg.Dir, img.Filename)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove image file: %w", err)
+	}
+	return s.store.DeleteBaseImage(ctx, img.ID)
+}
+
+// runImport performs the import and records the outcome on img.
+func (s *Service) runImport(ctx context.Context, img *store.BaseImage, req ImportRequest) {
+	err := s.importImage(ctx, img, req)
+	if err != nil {
+		msg := err.Error()
+		img.Status = store.ImageStatusFailed
+		img.Error = &msg
+		s.logger.Error("image import failed", "image_id", img.ID, "source", img.Source, "error", err)
+	} else {
+		img.Status = store.ImageStatusReady
+		s.logger.Info("image imported", "image_id", img.ID, "filename", img.Filename, "sha256", img.SHA256)
+	}
+	if uerr := s.store.UpdateBaseImage(ctx, img); uerr != nil {
+		s.logger.Error("record image import result", "image_id", img.ID, "error", uerr)
+	}
+}
+
+func (s *Service) importImage(ctx context.Context, img *store.BaseImage, req ImportRequest) error {
+	if err := os.MkdirAll(s.cfg.Dir, 0o755); err != nil {
+		return fmt.Errorf("create image dir: %w", err)
+	}
+	tmp := filepath.Join(s.cfg.Dir, ".import-"+img.ID)
+	defer os.Remove(tmp)
+
+	sum, err := s.fetch(ctx, req.Source, tmp)
+	if err != nil {
+		return err
+	}
+	img.SHA256 = sum
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, sum) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, strings.ToLower(req.SHA256), sum)
+	}
+
+	info, err := s.inspect(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	if info.BackingFilename != "" {
+		return fmt.Errorf("image has a backing file (%s); only standalone images can be imported", info.BackingFilename)
+	}
+	switch {
+	case req.Format != "" && info.Format != req.Format:
+		return fmt.Errorf("image format is %s, expected %s", info.Format, req.Format)
+	case info.Format != "qcow2" && info.Format != "raw":
+		return fmt.Errorf("unsupported image format %q", info.Format)
+	}
+	img.SourceFormat = info.Format
+	img.VirtualSizeBytes = info.VirtualSize
+
+	dst := filepath.Join(s.cfg.Dir, img.Filename)
+	part := dst + ".part"
+	defer os.Remove(part)
+	if _, err := s.qemuImg(ctx, "convert", "-f", info.Format, "-O", "qcow2", tmp, part); err != nil {
+		return fmt.Errorf("convert: %w", err)
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return fmt.Errorf("install image: %w", err)
+	}
+	if st, err := os.Stat(dst); err == nil {
+		img.SizeBytes = st.Size()
+	}
+	return nil
+}
+
+// checkSource rejects unsupported URL schemes and local paths outside ImportDirs.
+func (s *Service) checkSource(src string) error {
+	if strings.TrimSpace(src) == "" {
+		return fmt.Errorf("source is required: %w", store.ErrInvalid)
+	}
+	if u, err := url.Parse(src); err == nil && u.Scheme != "" {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%w: scheme %q", ErrSourceNotAllowed, u.Scheme)
+		}
+		return nil
+	}
+	if !filepath.IsAbs(src) {
+		return fmt.Errorf("local source must be an absolute path: %w", store.ErrInvalid)
+	}
+	clean := filepath.Clean(src)
+	if resolved, err := filepath.EvalSymlinks(clean); err == nil {
+		clean = resolved
+	}
+	for _, dir := range s.cfg.ImportDirs {
+		dir = filepath.Clean(dir)
+		if clean == dir || strings.HasPrefix(clean, dir+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not under an allowed import directory", ErrSourceNotAllowed, src)
+}
+
+// fetch copies src (local path or URL) to dst and returns its hex SHA256.
+func (s *Service) fetch(ctx context.Context, src, dst string) (string, error) {
+	var r io.Reader
+	if u, err := url.Parse(src); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+		if err != nil {
+			return "", fmt.Errorf("build request: %w", err)
+		}
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("download: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("download: unexpected status %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return "", fmt.Errorf("open source: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("copy source: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// imageInfo is the subset of `qemu-img info --output=json` used by the catalog.
+type imageInfo struct {
+	Format          string `json:"format"`
+	VirtualSize     int64  `json:"virtual-size"`
+	BackingFilename string `json:"backing-filename"`
+}
+
+func (s *Service) inspect(ctx context.Context, path string) (imageInfo, error) {
+	out, err := s.qemuImg(ctx, "info", "--output=json", path)
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("inspect: %w", err)
+	}
+	var info imageInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return imageInfo{}, fmt.Errorf("inspect: parse qemu-img info: %w", err)
+	}
+	return info, nil
+}
+
+func (s *Service) qemuImg(ctx context.Context, args ...string) (string, error) {
+	bin := s.cfg.QemuImgPath
+	if bin == "" {
+		bin = "qemu-img"
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("qemu-img %s: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("qemu-img %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
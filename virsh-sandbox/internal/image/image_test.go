@@ -0,0 +1,239 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"virsh-sandbox/internal/store"
+)
+
+// memStore is an in-memory Store for tests.
+type memStore struct {
+	mu        sync.Mutex
+	images    map[string]*store.BaseImage
+	sandboxes []*store.Sandbox
+}
+
+func newMemStore() *memStore {
+	return &memStore{images: make(map[string]*store.BaseImage)}
+}
+
+func (m *memStore) CreateBaseImage(_ context.Context, img *store.BaseImage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp := *img
+	m.images[img.ID] = &cp
+	return nil
+}
+
+func (m *memStore) GetBaseImage(_ context.Context, id string) (*store.BaseImage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	img, ok := m.images[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cp := *img
+	return &cp, nil
+}
+
+func (m *memStore) ListBaseImages(_ context.Context, f store.BaseImageFilter, _ *store.ListOptions) ([]*store.BaseImage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*store.BaseImage
+	for _, img := range m.images {
+		if f.Status == nil || img.Status == *f.Status {
+			cp := *img
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) UpdateBaseImage(_ context.Context, img *store.BaseImage) error {
+	return m.CreateBaseImage(context.Background(), img)
+}
+
+func (m *memStore) DeleteBaseImage(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.images, id)
+	return nil
+}
+
+func (m *memStore) ListSandboxes(_ context.Context, f store.SandboxFilter, _ *store.ListOptions) ([]*store.Sandbox, error) {
+	var out []*store.Sandbox
+	for _, sb := range m.sandboxes {
+		if f.BaseImage == nil || sb.BaseImage == *f.BaseImage {
+			out = append(out, sb)
+		}
+	}
+	return out, nil
+}
+
+// fakeQemuImg writes a qemu-img stand-in that reports a raw image and copies on convert.
+func fakeQemuImg(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "qemu-img")
+	script := `#!/bin/sh
+case "$1" in
+info) echo '{"format":"raw","virtual-size":4096}' ;;
+convert) eval last=\${$#}; eval src=\${$(($#-1))}; cp "$src" "$last" ;;
+esac
+`
+	if err := os.WriteFile(p, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake qemu-img: %v", err)
+	}
+	return p
+}
+
+func TestImportFromURL(t *testing.T) {
+	payload := strings.Repeat("x", 4096)
+	sum := sha256.Sum256([]byte(payload))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+
+	st := newMemStore()
+	dir := t.TempDir()
+	svc := NewService(st, Config{Dir: dir, QemuImgPath: fakeQemuImg(t)})
+
+	img, err := svc.Import(context.Background(), ImportRequest{
+		Name:   "ubuntu-24.04",
+		Source: srv.URL + "/disk.img",
+		SHA256: hex.EncodeToString(sum[:]),
+		OS:     store.OSInfo{Distro: "ubuntu", Version: "24.04"},
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	svc.Wait()
+
+	got, err := svc.Get(context.Background(), img.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Status != store.ImageStatusReady {
+		t.Fatalf("status = %s, error = %v", got.Status, got.Error)
+	}
+	if got.SourceFormat != "raw" || got.VirtualSizeBytes != 4096 {
+		t.Errorf("format/virtual size = %s/%d, want raw/4096", got.SourceFormat, got.VirtualSizeBytes)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ubuntu-24.04.qcow2")); err != nil {
+		t.Errorf("converted image missing: %v", err)
+	}
+
+	st.sandboxes = []*store.Sandbox{{ID: "SBX-1", BaseImage: got.Filename}}
+	if err := svc.Delete(context.Background(), img.ID); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Delete in-use image: err = %v, want ErrConflict", err)
+	}
+}
+
+func TestImportChecksumMismatch(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "disk.raw")
+	if err := os.WriteFile(src, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	st := newMemStore()
+	svc := NewService(st, Config{
+		Dir:         t.TempDir(),
+		ImportDirs:  []string{filepath.Dir(src)},
+		QemuImgPath: fakeQemuImg(t),
+	})
+
+	img, err := svc.Import(context.Background(), ImportRequest{
+		Name:   "bad",
+		Source: src,
+		SHA256: strings.Repeat("0", 64),
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	svc.Wait()
+
+	got, _ := svc.Get(context.Background(), img.ID)
+	if got.Status != store.ImageStatusFailed || got.Error == nil || !strings.Contains(*got.Error, "sha256 mismatch") {
+		t.Fatalf("status = %s, error = %v; want FAILED with checksum mismatch", got.Status, got.Error)
+	}
+}
+
+func TestImportRejectsSourcesOutsideAllowlist(t *testing.T) {
+	svc := NewService(newMemStore(), Config{Dir: t.TempDir(), ImportDirs: []string{"/srv/images"}})
+	for _, src := range []string{"/etc/shadow", "/srv/images/../../etc/shadow", "file:///srv/images/a.img", "relative.img"} {
+		if _, err := svc.Import(context.Background(), ImportRequest{Name: "x", Source: src}); err == nil {
+			t.Errorf("Import(%q) succeeded, want rejection", src)
+		}
+	}
+}
+
+func TestDeleteGuardsPromotedSourceVM(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "golden.qcow2"), []byte("qcow2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	st := newMemStore()
+	st.images["IMG-1"] = &store.BaseImage{
+		ID: "IMG-1", Name: "golden", Filename: "golden.qcow2", Status: store.ImageStatusReady,
+		Provenance: &store.ImageProvenance{SandboxID: "SBX-1", SourceVM: "golden-vm"},
+	}
+	st.sandboxes = []*store.Sandbox{{ID: "SBX-2", BaseImage: "golden-vm"}}
+	svc := NewService(st, Config{Dir: dir})
+
+	if err := svc.Delete(context.Background(), "IMG-1"); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("Delete image backing source VM clones: err = %v, want ErrConflict", err)
+	}
+	st.sandboxes = nil
+	if err := svc.Delete(context.Background(), "IMG-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "golden.qcow2")); !os.IsNotExist(err) {
+		t.Errorf("image file still present: %v", err)
+	}
+}
+
+func TestRecoverFailsInterruptedImports(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{".import-IMG-1", "web.qcow2.part", "db.qcow2.part", "ready.qcow2"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := newMemStore()
+	st.images["IMG-1"] = &store.BaseImage{ID: "IMG-1", Name: "web", Filename: "web.qcow2", Status: store.ImageStatusImporting}
+	st.images["IMG-2"] = &store.BaseImage{ID: "IMG-2", Name: "db", Filename: "db.qcow2", Status: store.ImageStatusImporting,
+		Provenance: &store.ImageProvenance{SandboxID: "SBX-1"}}
+	st.images["IMG-3"] = &store.BaseImage{ID: "IMG-3", Name: "ready", Filename: "ready.qcow2", Status: store.ImageStatusReady}
+	svc := NewService(st, Config{Dir: dir})
+	ctx := context.Background()
+
+	if err := svc.Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"IMG-1", "IMG-2"} {
+		if img := st.images[id]; img.Status != store.ImageStatusFailed || img.Error == nil {
+			t.Errorf("%s = %+v, want FAILED with an error", id, img)
+		}
+	}
+	if st.images["IMG-3"].Status != store.ImageStatusReady {
+		t.Errorf("ready image changed to %s", st.images["IMG-3"].Status)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "ready.qcow2" {
+		t.Errorf("files left = %v, want only ready.qcow2", entries)
+	}
+
+	// The name is no longer held by an import that will never finish.
+	if err := svc.Delete(ctx, "IMG-1"); err != nil {
+		t.Errorf("Delete after recovery: %v", err)
+	}
+}
@@ -16,16 +16,22 @@ var ErrLibvirtNotAvailable = errors.New("libvirt support not available: rebuild
 type Manager interface {
 	// CloneVM creates a linked-clone VM from a golden base image and defines a libvirt domain for it.
 	// cpu and memoryMB are the VM shape. network is the libvirt network name (e.g., "default").
-	CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string) (DomainRef, error)
+	// Disk sizing and scratch disks are set with CloneOptions.
+	CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error)
 
 	// CloneFromVM creates a linked-clone VM from an existing VM's disk.
 	// It looks up the source VM by name in libvirt, retrieves its disk path,
 	// and creates an overlay pointing to that disk as the backing file.
-	CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string) (DomainRef, error)
+	CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error)
+
+	// CloneFromDisk creates a linked-clone VM whose overlay is backed by the
+	// qcow2 file at diskPath, such as one returned by ExportSnapshot.
+	CloneFromDisk(ctx context.Context, diskPath, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error)
 
 	// InjectSSHKey injects an SSH public key for a user into the VM disk before boot.
-	// The mechanism is determined by configuration (e.g., virt-customize or cloud-init seed).
-	InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string) error
+	// The mechanism is determined by configuration (e.g., virt-customize or cloud-init seed)
+	// unless overridden per call with WithInjectMethod.
+	InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string, opts ...InjectOption) error
 
 	// StartVM boots a defined domain.
 	StartVM(ctx context.Context, vmName string) error
@@ -33,20 +39,72 @@ type Manager interface {
 	// StopVM gracefully shuts down a domain, or forces if force is true.
 	StopVM(ctx context.Context, vmName string, force bool) error
 
-	// DestroyVM undefines the domain and removes its workspace (overlay files, domain XML, seeds).
+	// SuspendVM pauses a running domain's vCPUs; memory stays allocated.
+	SuspendVM(ctx context.Context, vmName string) error
+
+	// ResumeVM continues a domain paused by SuspendVM.
+	ResumeVM(ctx context.Context, vmName string) error
+
+	// HibernateVM saves the domain's memory state to disk (managed save) and
+	// stops it, freeing host memory. StartVM restores the saved state.
+	HibernateVM(ctx context.Context, vmName string) error
+
+	// DestroyVM undefines the domain and removes its workspace (overlay and scratch disks, domain XML, seeds).
 	// If the domain is running, it will be destroyed first.
 	DestroyVM(ctx context.Context, vmName string) error
 
-	// CreateSnapshot creates a snapshot with the given name.
+	// CreateSnapshot creates a snapshot with the given name covering every disk.
 	// If external is true, attempts a disk-only external snapshot.
 	CreateSnapshot(ctx context.Context, vmName, snapshotName string, external bool) (SnapshotRef, error)
 
+	// RevertSnapshot restores the domain to a previously created internal snapshot.
+	RevertSnapshot(ctx context.Context, vmName, snapshotName string) error
+
+	// ExportSnapshot writes an internal snapshot's disk state to a qcow2 file
+	// in the domain's job dir, backed by the same base as the domain, and
+	// returns its path. A running domain is paused while the file is written.
+	// The file is reused if it already exists and is removed with the domain
+	// by DestroyVM.
+	ExportSnapshot(ctx context.Context, vmName, snapshotName string) (string, error)
+
+	// FlattenDisk writes the domain's root disk, or the named internal snapshot
+	// of it, as a standalone qcow2 with no backing file to filename in the base
+	// image directory. With sanitize set, per-instance identity and state are
+	// removed from the copy (machine-id, SSH host keys, cloud-init state, logs)
+	// and SSH host keys are regenerated on the next first boot. A running
+	// domain is paused while its disk is read.
+	FlattenDisk(ctx context.Context, vmName, snapshotName, filename string, sanitize bool) (DiskImage, error)
+
+	// DefineVM defines a domain that boots directly from diskPath, without an
+	// overlay, so it can serve as a source VM for CloneFromVM. The domain is
+	// not started.
+	DefineVM(ctx context.Context, vmName, diskPath string, cpu, memoryMB int, network string) (DomainRef, error)
+
+	// DomainExists reports whether a domain named vmName is defined, running
+	// or not.
+	DomainExists(ctx context.Context, vmName string) (bool, error)
+
 	// DiffSnapshot prepares a plan to compare two snapshots' filesystems.
 	// The returned plan includes advice or prepared mounts where possible.
 	DiffSnapshot(ctx context.Context, vmName, fromSnapshot, toSnapshot string) (*FSComparePlan, error)
 
+	// SnapshotDisk locates the domain's root disk as it was at the named
+	// snapshot, or as it is now when snapshotName is empty, for reading with
+	// the diskimage package.
+	SnapshotDisk(ctx context.Context, vmName, snapshotName string) (DiskState, error)
+
+	// SetResources changes a domain's vCPUs and memory. With live set the change
+	// is applied to the running domain (it must fit the maximums declared at
+	// creation) and persisted; otherwise only the persistent config is updated,
+	// raising the maximums to res.MaxVCPUs/res.MaxMemoryMB, and takes effect on next boot.
+	SetResources(ctx context.Context, vmName string, res Resources, live bool) error
+
 	// GetIPAddress attempts to fetch the VM's primary IP via libvirt leases.
 	GetIPAddress(ctx context.Context, vmName string, timeout time.Duration) (string, error)
+
+	// GuestExec runs argv inside the guest through the QEMU guest agent and
+	// waits up to timeout for it to exit. It returns stdout and the exit code.
+	GuestExec(ctx context.Context, vmName string, argv []string, timeout time.Duration) (string, int, error)
 }
 
 // Config controls how the virsh-based manager interacts with the host.
@@ -56,6 +114,7 @@ type Config struct {
 	WorkDir               string // e.g., /var/lib/libvirt/images/jobs
 	DefaultNetwork        string // e.g., default
 	SSHKeyInjectMethod    string // "virt-customize" or "cloud-init"
+	SharedDirDriver       string // "virtiofs", "9p" or "auto" (virtiofs when virtiofsd is installed)
 	CloudInitMetaTemplate string // optional meta-data template for cloud-init seed
 
 	// Optional explicit paths to binaries; if empty these are looked up in PATH.
@@ -69,6 +128,124 @@ type Config struct {
 	DefaultMemoryMB int
 }
 
+// MaxScratchDisks bounds the scratch disks per domain (vdb through vdi).
+const MaxScratchDisks = 8
+
+// CloneOption configures a single CloneVM or CloneFromVM call.
+type CloneOption func(*CloneOptions)
+
+// CloneOptions holds per-call disk settings for CloneVM and CloneFromVM.
+type CloneOptions struct {
+	// RootDiskGB grows the root overlay to this virtual size (GiB) with
+	// qemu-img resize. The guest filesystem must be grown on first boot.
+	RootDiskGB int
+
+	// ScratchDisksGB adds blank qcow2 disks of these sizes (GiB), attached
+	// in order as vdb, vdc, ...
+	ScratchDisksGB []int
+
+	// Hostname, if set, is written into the new disk (virt-customize --hostname).
+	Hostname string
+
+	// MaxVCPUs and MaxMemoryMB are the maximums the running domain may be
+	// resized to with SetResources. They default to the initial shape.
+	MaxVCPUs    int
+	MaxMemoryMB int
+
+	// SharedDirs are host directories exposed to the guest as virtiofs or 9p
+	// filesystems. Callers are responsible for vetting host paths.
+	SharedDirs []SharedDir
+}
+
+// SharedDir is a host directory shared into the guest under a mount tag.
+type SharedDir struct {
+	HostPath string
+	Tag      string
+	ReadOnly bool
+
+	// GuestPath is where the guest mounts the share. The libvirt manager
+	// leaves mounting to the guest; container runtimes bind-mount here.
+	GuestPath string
+}
+
+// WithRootDiskSize sets the root disk virtual size in GiB.
+func WithRootDiskSize(gb int) CloneOption {
+	return func(o *CloneOptions) { o.RootDiskGB = gb }
+}
+
+// WithScratchDisks attaches blank disks of the given sizes in GiB.
+func WithScratchDisks(sizesGB ...int) CloneOption {
+	return func(o *CloneOptions) { o.ScratchDisksGB = sizesGB }
+}
+
+// WithHostname sets the guest hostname on the new disk.
+func WithHostname(hostname string) CloneOption {
+	return func(o *CloneOptions) { o.Hostname = hostname }
+}
+
+// WithMaxShape declares the maximum vCPUs and memory for live resizing.
+func WithMaxShape(maxVCPUs, maxMemoryMB int) CloneOption {
+	return func(o *CloneOptions) {
+		o.MaxVCPUs = maxVCPUs
+		o.MaxMemoryMB = maxMemoryMB
+	}
+}
+
+// WithSharedDirs shares host directories into the guest.
+func WithSharedDirs(dirs ...SharedDir) CloneOption {
+	return func(o *CloneOptions) { o.SharedDirs = dirs }
+}
+
+// InjectOption configures a single InjectSSHKey call.
+type InjectOption func(*InjectOptions)
+
+// InjectOptions holds per-call overrides for InjectSSHKey.
+type InjectOptions struct {
+	// Method overrides Config.SSHKeyInjectMethod ("virt-customize" or "cloud-init").
+	Method string
+
+	// UserData, if set, is the complete #cloud-config document written to the
+	// NoCloud seed instead of the default single-user one. It must include the
+	// key being injected. Only used by the cloud-init method.
+	UserData []byte
+
+	// FirstBootCommands are shell commands run once on first boot: as
+	// virt-customize --firstboot-command, or as bootcmd entries of the default
+	// cloud-init seed. Callers supplying UserData include them there.
+	FirstBootCommands []string
+}
+
+// WithInjectMethod selects the key injection mechanism for one call.
+func WithInjectMethod(method string) InjectOption {
+	return func(o *InjectOptions) { o.Method = method }
+}
+
+// WithUserData supplies the cloud-config document for the NoCloud seed.
+func WithUserData(userData []byte) InjectOption {
+	return func(o *InjectOptions) { o.UserData = userData }
+}
+
+// WithFirstBootCommands adds shell commands to run once on first boot.
+func WithFirstBootCommands(cmds ...string) InjectOption {
+	return func(o *InjectOptions) { o.FirstBootCommands = append(o.FirstBootCommands, cmds...) }
+}
+
+// Resources is a domain shape for SetResources. Zero VCPUs or MemoryMB
+// leaves that resource unchanged.
+type Resources struct {
+	VCPUs       int
+	MemoryMB    int
+	MaxVCPUs    int
+	MaxMemoryMB int
+}
+
+// DiskImage describes a disk image file written by FlattenDisk.
+type DiskImage struct {
+	Path             string
+	SizeBytes        int64
+	VirtualSizeBytes int64
+}
+
 // DomainRef is a minimal reference to a libvirt domain (VM).
 type DomainRef struct {
 	Name string
@@ -98,10 +275,22 @@ type FSComparePlan struct {
 	FromRef string
 	ToRef   string
 
+	// Disk states of the two snapshots, readable with the diskimage package
+	// without mounting; zero when the manager could not locate them.
+	FromDisk DiskState
+	ToDisk   DiskState
+
 	// Free-form notes with instructions if the manager couldn't mount automatically.
 	Notes []string
 }
 
+// DiskState locates a disk's content at a snapshot: Path is a disk image
+// and Snapshot, when set, names an internal qcow2 snapshot within it.
+type DiskState struct {
+	Path     string
+	Snapshot string
+}
+
 // VirshManager implements Manager using virsh/qemu-img/qemu-nbd/virt-customize and simple domain XML.
 // This is a stub implementation that returns errors when libvirt is not available.
 type VirshManager struct {
@@ -125,17 +314,22 @@ func NewFromEnv() *VirshManager {
 }
 
 // CloneVM is a stub that returns an error when libvirt is not available.
-func (m *VirshManager) CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string) (DomainRef, error) {
+func (m *VirshManager) CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error) {
 	return DomainRef{}, ErrLibvirtNotAvailable
 }
 
 // CloneFromVM is a stub that returns an error when libvirt is not available.
-func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string) (DomainRef, error) {
+func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error) {
+	return DomainRef{}, ErrLibvirtNotAvailable
+}
+
+// CloneFromDisk is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) CloneFromDisk(ctx context.Context, diskPath, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error) {
 	return DomainRef{}, ErrLibvirtNotAvailable
 }
 
 // InjectSSHKey is a stub that returns an error when libvirt is not available.
-func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string) error {
+func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string, opts ...InjectOption) error {
 	return ErrLibvirtNotAvailable
 }
 
@@ -144,6 +338,21 @@ func (m *VirshManager) StartVM(ctx context.Context, vmName string) error {
 	return ErrLibvirtNotAvailable
 }
 
+// SuspendVM is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) SuspendVM(ctx context.Context, vmName string) error {
+	return ErrLibvirtNotAvailable
+}
+
+// ResumeVM is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) ResumeVM(ctx context.Context, vmName string) error {
+	return ErrLibvirtNotAvailable
+}
+
+// HibernateVM is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) HibernateVM(ctx context.Context, vmName string) error {
+	return ErrLibvirtNotAvailable
+}
+
 // StopVM is a stub that returns an error when libvirt is not available.
 func (m *VirshManager) StopVM(ctx context.Context, vmName string, force bool) error {
 	return ErrLibvirtNotAvailable
@@ -159,12 +368,52 @@ func (m *VirshManager) CreateSnapshot(ctx context.Context, vmName, snapshotName
 	return SnapshotRef{}, ErrLibvirtNotAvailable
 }
 
+// RevertSnapshot is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) RevertSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return ErrLibvirtNotAvailable
+}
+
+// ExportSnapshot is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) ExportSnapshot(ctx context.Context, vmName, snapshotName string) (string, error) {
+	return "", ErrLibvirtNotAvailable
+}
+
+// FlattenDisk is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) FlattenDisk(ctx context.Context, vmName, snapshotName, filename string, sanitize bool) (DiskImage, error) {
+	return DiskImage{}, ErrLibvirtNotAvailable
+}
+
+// DefineVM is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) DefineVM(ctx context.Context, vmName, diskPath string, cpu, memoryMB int, network string) (DomainRef, error) {
+	return DomainRef{}, ErrLibvirtNotAvailable
+}
+
+// DomainExists is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) DomainExists(ctx context.Context, vmName string) (bool, error) {
+	return false, ErrLibvirtNotAvailable
+}
+
 // DiffSnapshot is a stub that returns an error when libvirt is not available.
 func (m *VirshManager) DiffSnapshot(ctx context.Context, vmName, fromSnapshot, toSnapshot string) (*FSComparePlan, error) {
 	return nil, ErrLibvirtNotAvailable
 }
 
+// SnapshotDisk is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) SnapshotDisk(ctx context.Context, vmName, snapshotName string) (DiskState, error) {
+	return DiskState{}, ErrLibvirtNotAvailable
+}
+
+// SetResources is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) SetResources(ctx context.Context, vmName string, res Resources, live bool) error {
+	return ErrLibvirtNotAvailable
+}
+
 // GetIPAddress is a stub that returns an error when libvirt is not available.
 func (m *VirshManager) GetIPAddress(ctx context.Context, vmName string, timeout time.Duration) (string, error) {
 	return "", ErrLibvirtNotAvailable
 }
+
+// GuestExec is a stub that returns an error when libvirt is not available.
+func (m *VirshManager) GuestExec(ctx context.Context, vmName string, argv []string, timeout time.Duration) (string, int, error) {
+	return "", 0, ErrLibvirtNotAvailable
+}
@@ -6,6 +6,8 @@ package libvirt
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -14,22 +16,30 @@ import (
 	"strings"
 	"text/template"
 	"time"
+
+	"virsh-sandbox/internal/diskimage"
 )
 
 // Manager defines the VM orchestration operations we support against libvirt/KVM via virsh.
 type Manager interface {
 	// CloneVM creates a linked-clone VM from a golden base image and defines a libvirt domain for it.
 	// cpu and memoryMB are the VM shape. network is the libvirt network name (e.g., "default").
-	CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string) (DomainRef, error)
+	// Disk sizing and scratch disks are set with CloneOptions.
+	CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error)
 
 	// CloneFromVM creates a linked-clone VM from an existing VM's disk.
 	// It looks up the source VM by name in libvirt, retrieves its disk path,
 	// and creates an overlay pointing to that disk as the backing file.
-	CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string) (DomainRef, error)
+	CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error)
+
+	// CloneFromDisk creates a linked-clone VM whose overlay is backed by the
+	// qcow2 file at diskPath, such as one returned by ExportSnapshot.
+	CloneFromDisk(ctx context.Context, diskPath, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error)
 
 	// InjectSSHKey injects an SSH public key for a user into the VM disk before boot.
-	// The mechanism is determined by configuration (e.g., virt-customize or cloud-init seed).
-	InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string) error
+	// The mechanism is determined by configuration (e.g., virt-customize or cloud-init seed)
+	// unless overridden per call with WithInjectMethod.
+	InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string, opts ...InjectOption) error
 
 	// StartVM boots a defined domain.
 	StartVM(ctx context.Context, vmName string) error
@@ -37,20 +47,72 @@ type Manager interface {
 	// StopVM gracefully shuts down a domain, or forces if force is true.
 	StopVM(ctx context.Context, vmName string, force bool) error
 
-	// DestroyVM undefines the domain and removes its workspace (overlay files, domain XML, seeds).
+	// SuspendVM pauses a running domain's vCPUs; memory stays allocated.
+	SuspendVM(ctx context.Context, vmName string) error
+
+	// ResumeVM continues a domain paused by SuspendVM.
+	ResumeVM(ctx context.Context, vmName string) error
+
+	// HibernateVM saves the domain's memory state to disk (managed save) and
+	// stops it, freeing host memory. StartVM restores the saved state.
+	HibernateVM(ctx context.Context, vmName string) error
+
+	// DestroyVM undefines the domain and removes its workspace (overlay and scratch disks, domain XML, seeds).
 	// If the domain is running, it will be destroyed first.
 	DestroyVM(ctx context.Context, vmName string) error
 
-	// CreateSnapshot creates a snapshot with the given name.
+	// CreateSnapshot creates a snapshot with the given name covering every disk.
 	// If external is true, attempts a disk-only external snapshot.
 	CreateSnapshot(ctx context.Context, vmName, snapshotName string, external bool) (SnapshotRef, error)
 
+	// RevertSnapshot restores the domain to a previously created internal snapshot.
+	RevertSnapshot(ctx context.Context, vmName, snapshotName string) error
+
+	// ExportSnapshot writes an internal snapshot's disk state to a qcow2 file
+	// in the domain's job dir, backed by the same base as the domain, and
+	// returns its path. A running domain is paused while the file is written.
+	// The file is reused if it already exists and is removed with the domain
+	// by DestroyVM.
+	ExportSnapshot(ctx context.Context, vmName, snapshotName string) (string, error)
+
+	// FlattenDisk writes the domain's root disk, or the named internal snapshot
+	// of it, as a standalone qcow2 with no backing file to filename in the base
+	// image directory. With sanitize set, per-instance identity and state are
+	// removed from the copy (machine-id, SSH host keys, cloud-init state, logs)
+	// and SSH host keys are regenerated on the next first boot. A running
+	// domain is paused while its disk is read.
+	FlattenDisk(ctx context.Context, vmName, snapshotName, filename string, sanitize bool) (DiskImage, error)
+
+	// DefineVM defines a domain that boots directly from diskPath, without an
+	// overlay, so it can serve as a source VM for CloneFromVM. The domain is
+	// not started.
+	DefineVM(ctx context.Context, vmName, diskPath string, cpu, memoryMB int, network string) (DomainRef, error)
+
+	// DomainExists reports whether a domain named vmName is defined, running
+	// or not.
+	DomainExists(ctx context.Context, vmName string) (bool, error)
+
 	// DiffSnapshot prepares a plan to compare two snapshots' filesystems.
 	// The returned plan includes advice or prepared mounts where possible.
 	DiffSnapshot(ctx context.Context, vmName, fromSnapshot, toSnapshot string) (*FSComparePlan, error)
 
+	// SnapshotDisk locates the domain's root disk as it was at the named
+	// snapshot, or as it is now when snapshotName is empty, for reading with
+	// the diskimage package.
+	SnapshotDisk(ctx context.Context, vmName, snapshotName string) (DiskState, error)
+
+	// SetResources changes a domain's vCPUs and memory. With live set the change
+	// is applied to the running domain (it must fit the maximums declared at
+	// creation) and persisted; otherwise only the persistent config is updated,
+	// raising the maximums to res.MaxVCPUs/res.MaxMemoryMB, and takes effect on next boot.
+	SetResources(ctx context.Context, vmName string, res Resources, live bool) error
+
 	// GetIPAddress attempts to fetch the VM's primary IP via libvirt leases.
 	GetIPAddress(ctx context.Context, vmName string, timeout time.Duration) (string, error)
+
+	// GuestExec runs argv inside the guest through the QEMU guest agent and
+	// waits up to timeout for it to exit. It returns stdout and the exit code.
+	GuestExec(ctx context.Context, vmName string, argv []string, timeout time.Duration) (string, int, error)
 }
 
 // Config controls how the virsh-based manager interacts with the host.
@@ -60,6 +122,7 @@ type Config struct {
 	WorkDir               string // e.g., /var/lib/libvirt/images/jobs
 	DefaultNetwork        string // e.g., default
 	SSHKeyInjectMethod    string // "virt-customize" or "cloud-init"
+	SharedDirDriver       string // "virtiofs", "9p" or "auto" (virtiofs when virtiofsd is installed)
 	CloudInitMetaTemplate string // optional meta-data template for cloud-init seed
 
 	// Optional explicit paths to binaries; if empty these are looked up in PATH.
@@ -73,6 +136,124 @@ type Config struct {
 	DefaultMemoryMB int
 }
 
+// MaxScratchDisks bounds the scratch disks per domain (vdb through vdi).
+const MaxScratchDisks = 8
+
+// CloneOption configures a single CloneVM or CloneFromVM call.
+type CloneOption func(*CloneOptions)
+
+// CloneOptions holds per-call disk settings for CloneVM and CloneFromVM.
+type CloneOptions struct {
+	// RootDiskGB grows the root overlay to this virtual size (GiB) with
+	// qemu-img resize. The guest filesystem must be grown on first boot.
+	RootDiskGB int
+
+	// ScratchDisksGB adds blank qcow2 disks of these sizes (GiB), attached
+	// in order as vdb, vdc, ...
+	ScratchDisksGB []int
+
+	// Hostname, if set, is written into the new disk (virt-customize --hostname).
+	Hostname string
+
+	// MaxVCPUs and MaxMemoryMB are the maximums the running domain may be
+	// resized to with SetResources. They default to the initial shape.
+	MaxVCPUs    int
+	MaxMemoryMB int
+
+	// SharedDirs are host directories exposed to the guest as virtiofs or 9p
+	// filesystems. Callers are responsible for vetting host paths.
+	SharedDirs []SharedDir
+}
+
+// SharedDir is a host directory shared into the guest under a mount tag.
+type SharedDir struct {
+	HostPath string
+	Tag      string
+	ReadOnly bool
+
+	// GuestPath is where the guest mounts the share. The libvirt manager
+	// leaves mounting to the guest; container runtimes bind-mount here.
+	GuestPath string
+}
+
+// WithRootDiskSize sets the root disk virtual size in GiB.
+func WithRootDiskSize(gb int) CloneOption {
+	return func(o *CloneOptions) { o.RootDiskGB = gb }
+}
+
+// WithScratchDisks attaches blank disks of the given sizes in GiB.
+func WithScratchDisks(sizesGB ...int) CloneOption {
+	return func(o *CloneOptions) { o.ScratchDisksGB = sizesGB }
+}
+
+// WithHostname sets the guest hostname on the new disk.
+func WithHostname(hostname string) CloneOption {
+	return func(o *CloneOptions) { o.Hostname = hostname }
+}
+
+// WithMaxShape declares the maximum vCPUs and memory for live resizing.
+func WithMaxShape(maxVCPUs, maxMemoryMB int) CloneOption {
+	return func(o *CloneOptions) {
+		o.MaxVCPUs = maxVCPUs
+		o.MaxMemoryMB = maxMemoryMB
+	}
+}
+
+// WithSharedDirs shares host directories into the guest.
+func WithSharedDirs(dirs ...SharedDir) CloneOption {
+	return func(o *CloneOptions) { o.SharedDirs = dirs }
+}
+
+// InjectOption configures a single InjectSSHKey call.
+type InjectOption func(*InjectOptions)
+
+// InjectOptions holds per-call overrides for InjectSSHKey.
+type InjectOptions struct {
+	// Method overrides Config.SSHKeyInjectMethod ("virt-customize" or "cloud-init").
+	Method string
+
+	// UserData, if set, is the complete #cloud-config document written to the
+	// NoCloud seed instead of the default single-user one. It must include the
+	// key being injected. Only used by the cloud-init method.
+	UserData []byte
+
+	// FirstBootCommands are shell commands run once on first boot: as
+	// virt-customize --firstboot-command, or as bootcmd entries of the default
+	// cloud-init seed. Callers supplying UserData include them there.
+	FirstBootCommands []string
+}
+
+// WithInjectMethod selects the key injection mechanism for one call.
+func WithInjectMethod(method string) InjectOption {
+	return func(o *InjectOptions) { o.Method = method }
+}
+
+// WithUserData supplies the cloud-config document for the NoCloud seed.
+func WithUserData(userData []byte) InjectOption {
+	return func(o *InjectOptions) { o.UserData = userData }
+}
+
+// WithFirstBootCommands adds shell commands to run once on first boot.
+func WithFirstBootCommands(cmds ...string) InjectOption {
+	return func(o *InjectOptions) { o.FirstBootCommands = append(o.FirstBootCommands, cmds...) }
+}
+
+// Resources is a domain shape for SetResources. Zero VCPUs or MemoryMB
+// leaves that resource unchanged.
+type Resources struct {
+	VCPUs       int
+	MemoryMB    int
+	MaxVCPUs    int
+	MaxMemoryMB int
+}
+
+// DiskImage describes a disk image file written by FlattenDisk.
+type DiskImage struct {
+	Path             string
+	SizeBytes        int64
+	VirtualSizeBytes int64
+}
+
 // DomainRef is a minimal reference to a libvirt domain (VM).
 type DomainRef struct {
 	Name string
@@ -102,10 +283,22 @@ type FSComparePlan struct {
 	FromRef string
 	ToRef   string
 
+	// Disk states of the two snapshots, readable with the diskimage package
+	// without mounting; zero when the manager could not locate them.
+	FromDisk DiskState
+	ToDisk   DiskState
+
 	// Free-form notes with instructions if the manager couldn't mount automatically.
 	Notes []string
 }
 
+// DiskState locates a disk's content at a snapshot: Path is a disk image
+// and Snapshot, when set, names an internal qcow2 snapshot within it.
+type DiskState struct {
+	Path     string
+	Snapshot string
+}
+
 // VirshManager implements Manager using virsh/qemu-img/qemu-nbd/virt-customize and simple domain XML.
 type VirshManager struct {
 	cfg Config
@@ -124,7 +317,7 @@ func NewVirshManager(cfg Config) *VirshManager {
 }
 
 // NewFromEnv builds a Config from environment variables and returns a manager.
-// LIBVIRT_URI, BASE_IMAGE_DIR, SANDBOX_WORKDIR, LIBVIRT_NETWORK, SSH_KEY_INJECT_METHOD
+// LIBVIRT_URI, BASE_IMAGE_DIR, SANDBOX_WORKDIR, LIBVIRT_NETWORK, SSH_KEY_INJECT_METHOD, SHARED_DIR_DRIVER
 func NewFromEnv() *VirshManager {
 	cfg := Config{
 		LibvirtURI:         getenvDefault("LIBVIRT_URI", "qemu:///system"),
@@ -132,95 +325,37 @@ func NewFromEnv() *VirshManager {
 		WorkDir:            getenvDefault("SANDBOX_WORKDIR", "/var/lib/libvirt/images/jobs"),
 		DefaultNetwork:     getenvDefault("LIBVIRT_NETWORK", "default"),
 		SSHKeyInjectMethod: getenvDefault("SSH_KEY_INJECT_METHOD", "virt-customize"),
+		SharedDirDriver:    getenvDefault("SHARED_DIR_DRIVER", "auto"),
 		DefaultVCPUs:       intFromEnv("DEFAULT_VCPUS", 2),
 		DefaultMemoryMB:    intFromEnv("DEFAULT_MEMORY_MB", 2048),
 	}
 	return NewVirshManager(cfg)
 }
 
-func (m *VirshManager) CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string) (DomainRef, error) {
+func (m *VirshManager) CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error) {
 	if newVMName == "" {
 		return DomainRef{}, fmt.Errorf("new VM name is required")
 	}
 	if baseImage == "" {
 		return DomainRef{}, fmt.Errorf("base image is required")
 	}
-	if cpu <= 0 {
-		cpu = m.cfg.DefaultVCPUs
-	}
-	if memoryMB <= 0 {
-		memoryMB = m.cfg.DefaultMemoryMB
-	}
-	if network == "" {
-		network = m.cfg.DefaultNetwork
-	}
 
 	basePath := filepath.Join(m.cfg.BaseImageDir, baseImage)
 	if _, err := os.Stat(basePath); err != nil {
 		return DomainRef{}, fmt.Errorf("base image not accessible: %s: %w", basePath, err)
 	}
-
-	jobDir := filepath.Join(m.cfg.WorkDir, newVMName)
-	if err := os.MkdirAll(jobDir, 0o755); err != nil {
-		return DomainRef{}, fmt.Errorf("create job dir: %w", err)
-	}
-
-	overlayPath := filepath.Join(jobDir, "disk-overlay.qcow2")
-	qemuImg := m.binPath("qemu-img", m.cfg.QemuImgPath)
-	if _, err := m.run(ctx, qemuImg, "create", "-f", "qcow2", "-F", "qcow2", "-b", basePath, overlayPath); err != nil {
-		return DomainRef{}, fmt.Errorf("create overlay: %w", err)
-	}
-
-	// Create minimal domain XML referencing overlay disk and network.
-	xmlPath := filepath.Join(jobDir, "domain.xml")
-	xml, err := renderDomainXML(domainXMLParams{
-		Name:      newVMName,
-		MemoryMB:  memoryMB,
-		VCPUs:     cpu,
-		DiskPath:  overlayPath,
-		Network:   network,
-		BootOrder: []string{"hd", "cdrom", "network"},
-	})
-	if err != nil {
-		return DomainRef{}, fmt.Errorf("render domain xml: %w", err)
-	}
-	if err := os.WriteFile(xmlPath, []byte(xml), 0o644); err != nil {
-		return DomainRef{}, fmt.Errorf("write domain xml: %w", err)
-	}
-
-	// virsh define
-	virsh := m.binPath("virsh", m.cfg.VirshPath)
-	if _, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "define", xmlPath); err != nil {
-		return DomainRef{}, fmt.Errorf("virsh define: %w", err)
-	}
-
-	// Fetch UUID
-	out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "domuuid", newVMName)
-	if err != nil {
-		// Best-effort: If domuuid fails, we still return Name.
-		return DomainRef{Name: newVMName}, nil
-	}
-	return DomainRef{Name: newVMName, UUID: strings.TrimSpace(out)}, nil
+	return m.cloneFromBacking(ctx, basePath, newVMName, cpu, memoryMB, network, opts)
 }
 
 // CloneFromVM creates a linked-clone VM from an existing VM's disk.
 // It looks up the source VM by name, retrieves its disk path, and creates an overlay.
-func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string) (DomainRef, error) {
+func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error) {
 	if newVMName == "" {
 		return DomainRef{}, fmt.Errorf("new VM name is required")
 	}
 	if sourceVMName == "" {
 		return DomainRef{}, fmt.Errorf("source VM name is required")
 	}
-	if cpu <= 0 {
-		cpu = m.cfg.DefaultVCPUs
-	}
-	if memoryMB <= 0 {
-		memoryMB = m.cfg.DefaultMemoryMB
-	}
-	if network == "" {
-		network = m.cfg.DefaultNetwork
-	}
 
 	// Look up the source VM's disk path using virsh domblklist
 	virsh := m.binPath("virsh", m.cfg.VirshPath)
@@ -249,6 +384,34 @@ func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName
 	if _, err := os.Stat(basePath); err != nil {
 		return DomainRef{}, fmt.Errorf("source VM disk not accessible: %s: %w", basePath, err)
 	}
+	return m.cloneFromBacking(ctx, basePath, newVMName, cpu, memoryMB, network, opts)
+}
+
+func (m *VirshManager) CloneFromDisk(ctx context.Context, diskPath, newVMName string, cpu, memoryMB int, network string, opts ...CloneOption) (DomainRef, error) {
+	if newVMName == "" {
+		return DomainRef{}, fmt.Errorf("new VM name is required")
+	}
+	if !filepath.IsAbs(diskPath) {
+		return DomainRef{}, fmt.Errorf("disk path must be absolute: %q", diskPath)
+	}
+	if _, err := os.Stat(diskPath); err != nil {
+		return DomainRef{}, fmt.Errorf("disk not accessible: %s: %w", diskPath, err)
+	}
+	return m.cloneFromBacking(ctx, diskPath, newVMName, cpu, memoryMB, network, opts)
+}
+
+// cloneFromBacking creates the job dir, an overlay backed by basePath and any
+// requested scratch disks, then defines the domain.
+func (m *VirshManager) cloneFromBacking(ctx context.Context, basePath, newVMName string, cpu, memoryMB int, network string, opts []CloneOption) (DomainRef, error) {
+	if cpu <= 0 {
+		cpu = m.cfg.DefaultVCPUs
+	}
+	if memoryMB <= 0 {
+		memoryMB = m.cfg.DefaultMemoryMB
+	}
+	if network == "" {
+		network = m.cfg.DefaultNetwork
+	}
 
 	jobDir := filepath.Join(m.cfg.WorkDir, newVMName)
 	if err := os.MkdirAll(jobDir, 0o755); err != nil {
@@ -260,17 +423,45 @@ func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName
 	if _, err := m.run(ctx, qemuImg, "create", "-f", "qcow2", "-F", "qcow2", "-b", basePath, overlayPath); err != nil {
 		return DomainRef{}, fmt.Errorf("create overlay: %w", err)
 	}
+	var co CloneOptions
+	for _, o := range opts {
+		o(&co)
+	}
+	extraDisks, err := m.prepareDisks(ctx, jobDir, overlayPath, co)
+	if err != nil {
+		return DomainRef{}, err
+	}
+	filesystems, err := m.sharedFilesystems(co.SharedDirs)
+	if err != nil {
+		return DomainRef{}, err
+	}
+	if co.Hostname != "" {
+		virtCustomize := m.binPath("virt-customize", m.cfg.VirtCustomizePath)
+		if _, err := m.run(ctx, virtCustomize, "-a", overlayPath, "--hostname", co.Hostname); err != nil {
+			return DomainRef{}, fmt.Errorf("set hostname: %w", err)
+		}
+	}
 
 	// Create minimal domain XML referencing overlay disk and network.
-	xmlPath := filepath.Join(jobDir, "domain.xml")
-	xml, err := renderDomainXML(domainXMLParams{
-		Name:      newVMName,
-		MemoryMB:  memoryMB,
-		VCPUs:     cpu,
-		DiskPath:  overlayPath,
-		Network:   network,
-		BootOrder: []string{"hd", "cdrom", "network"},
+	return m.defineDomain(ctx, jobDir, domainXMLParams{
+		Name:        newVMName,
+		MemoryMB:    memoryMB,
+		VCPUs:       cpu,
+		MaxMemoryMB: co.MaxMemoryMB,
+		MaxVCPUs:    co.MaxVCPUs,
+		DiskPath:    overlayPath,
+		ExtraDisks:  extraDisks,
+		Filesystems: filesystems,
+		Network:     network,
+		BootOrder:   []string{"hd", "cdrom", "network"},
 	})
+}
+
+// defineDomain writes the domain XML for p to jobDir and defines it.
+// No MAC address is set, so libvirt generates a fresh one for every domain.
+func (m *VirshManager) defineDomain(ctx context.Context, jobDir string, p domainXMLParams) (DomainRef, error) {
+	xmlPath := filepath.Join(jobDir, "domain.xml")
+	xml, err := renderDomainXML(p)
 	if err != nil {
 		return DomainRef{}, fmt.Errorf("render domain xml: %w", err)
 	}
@@ -279,20 +470,71 @@ func (m *VirshManager) CloneFromVM(ctx context.Context, sourceVMName, newVMName
 	}
 
 	// virsh define
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
 	if _, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "define", xmlPath); err != nil {
 		return DomainRef{}, fmt.Errorf("virsh define: %w", err)
 	}
 
 	// Fetch UUID
-	out, err = m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "domuuid", newVMName)
+	out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "domuuid", p.Name)
 	if err != nil {
 		// Best-effort: If domuuid fails, we still return Name.
-		return DomainRef{Name: newVMName}, nil
+		return DomainRef{Name: p.Name}, nil
 	}
-	return DomainRef{Name: newVMName, UUID: strings.TrimSpace(out)}, nil
+	return DomainRef{Name: p.Name, UUID: strings.TrimSpace(out)}, nil
 }
 
-func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string) error {
+func (m *VirshManager) DefineVM(ctx context.Context, vmName, diskPath string, cpu, memoryMB int, network string) (DomainRef, error) {
+	if vmName == "" {
+		return DomainRef{}, fmt.Errorf("VM name is required")
+	}
+	if !filepath.IsAbs(diskPath) {
+		return DomainRef{}, fmt.Errorf("disk path must be absolute: %q", diskPath)
+	}
+	if _, err := os.Stat(diskPath); err != nil {
+		return DomainRef{}, fmt.Errorf("disk not accessible: %s: %w", diskPath, err)
+	}
+	if cpu <= 0 {
+		cpu = m.cfg.DefaultVCPUs
+	}
+	if memoryMB <= 0 {
+		memoryMB = m.cfg.DefaultMemoryMB
+	}
+	if network == "" {
+		network = m.cfg.DefaultNetwork
+	}
+
+	// The job dir only holds the domain XML; the disk stays where it is.
+	jobDir := filepath.Join(m.cfg.WorkDir, vmName)
+	if err := os.MkdirAll(jobDir, 0o755); err != nil {
+		return DomainRef{}, fmt.Errorf("create job dir: %w", err)
+	}
+	return m.defineDomain(ctx, jobDir, domainXMLParams{
+		Name:      vmName,
+		MemoryMB:  memoryMB,
+		VCPUs:     cpu,
+		DiskPath:  diskPath,
+		Network:   network,
+		BootOrder: []string{"hd", "cdrom", "network"},
+	})
+}
+
+// DomainExists looks vmName up in the names of all defined domains.
+func (m *VirshManager) DomainExists(ctx context.Context, vmName string) (bool, error) {
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "list", "--all", "--name")
+	if err != nil {
+		return false, fmt.Errorf("list domains: %w", err)
+	}
+	for _, name := range strings.Split(out, "\n") {
+		if strings.TrimSpace(name) == vmName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string, opts ...InjectOption) error {
 	if sandboxName == "" {
 		return fmt.Errorf("sandboxName is required")
 	}
@@ -309,7 +551,15 @@ func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username,
 		return fmt.Errorf("overlay not found for VM %s: %w", sandboxName, err)
 	}
 
-	switch strings.ToLower(m.cfg.SSHKeyInjectMethod) {
+	io := InjectOptions{Method: m.cfg.SSHKeyInjectMethod}
+	for _, o := range opts {
+		o(&io)
+	}
+	if io.Method == "" {
+		io.Method = m.cfg.SSHKeyInjectMethod
+	}
+
+	switch strings.ToLower(io.Method) {
 	case "virt-customize":
 		// Requires libguestfs tools on host.
 		virtCustomize := m.binPath("virt-customize", m.cfg.VirtCustomizePath)
@@ -319,13 +569,16 @@ func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username,
 			"--run-command", fmt.Sprintf("id -u %s >/dev/null 2>&1 || useradd -m -s /bin/bash %s", shEscape(username), shEscape(username)),
 			"--ssh-inject", fmt.Sprintf("%s:string:%s", username, publicKey),
 		}
+		for _, c := range io.FirstBootCommands {
+			cmdArgs = append(cmdArgs, "--firstboot-command", c)
+		}
 		if _, err := m.run(ctx, virtCustomize, cmdArgs...); err != nil {
 			return fmt.Errorf("virt-customize inject: %w", err)
 		}
 	case "cloud-init":
 		// Build a NoCloud seed with the provided key and attach as CD-ROM.
 		seedISO := filepath.Join(jobDir, "seed.iso")
-		if err := m.buildCloudInitSeed(ctx, sandboxName, username, publicKey, seedISO); err != nil {
+		if err := m.buildCloudInitSeed(ctx, sandboxName, username, publicKey, seedISO, io.UserData, io.FirstBootCommands); err != nil {
 			return fmt.Errorf("build cloud-init seed: %w", err)
 		}
 		// Attach seed ISO to domain XML (adds a CDROM) and redefine the domain.
@@ -338,7 +591,7 @@ func (m *VirshManager) InjectSSHKey(ctx context.Context, sandboxName, username,
 			return fmt.Errorf("re-define domain with seed: %w", err)
 		}
 	default:
-		return fmt.Errorf("unsupported SSHKeyInjectMethod: %s", m.cfg.SSHKeyInjectMethod)
+		return fmt.Errorf("unsupported SSHKeyInjectMethod: %s", io.Method)
 	}
 	return nil
 }
@@ -365,6 +618,34 @@ func (m *VirshManager) StopVM(ctx context.Context, vmName string, force bool) er
 	return err
 }
 
+func (m *VirshManager) SuspendVM(ctx context.Context, vmName string) error {
+	if vmName == "" {
+		return fmt.Errorf("vmName is required")
+	}
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	_, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "suspend", vmName)
+	return err
+}
+
+func (m *VirshManager) ResumeVM(ctx context.Context, vmName string) error {
+	if vmName == "" {
+		return fmt.Errorf("vmName is required")
+	}
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	_, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "resume", vmName)
+	return err
+}
+
+func (m *VirshManager) HibernateVM(ctx context.Context, vmName string) error {
+	if vmName == "" {
+		return fmt.Errorf("vmName is required")
+	}
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	// --running makes the restore resume execution even if the domain was paused.
+	_, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "managedsave", vmName, "--running")
+	return err
+}
+
 func (m *VirshManager) DestroyVM(ctx context.Context, vmName string) error {
 	if vmName == "" {
 		return fmt.Errorf("vmName is required")
@@ -372,8 +653,8 @@ func (m *VirshManager) DestroyVM(ctx context.Context, vmName string) error {
 	virsh := m.binPath("virsh", m.cfg.VirshPath)
 	// Best-effort destroy if running
 	_, _ = m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "destroy", vmName)
-	// Undefine
-	if _, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "undefine", vmName); err != nil {
+	// Undefine, dropping any managed save image left by HibernateVM
+	if _, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "undefine", vmName, "--managed-save"); err != nil {
 		// continue to remove files even if undefine fails
 		_ = err
 	}
@@ -402,6 +683,17 @@ func (m *VirshManager) CreateSnapshot(ctx context.Context, vmName, snapshotName
 			"--disk-only", "--atomic", "--no-metadata",
 			"--diskspec", fmt.Sprintf("vda,file=%s", snapPath),
 		}
+		// Scratch disks get their own overlay so the snapshot is consistent across disks.
+		targets, err := m.diskTargets(ctx, vmName)
+		if err != nil {
+			return SnapshotRef{}, err
+		}
+		for _, t := range targets {
+			if t == "vda" {
+				continue
+			}
+			args = append(args, "--diskspec", fmt.Sprintf("%s,file=%s", t, filepath.Join(jobDir, fmt.Sprintf("snap-%s-%s.qcow2", snapshotName, t))))
+		}
 		if _, err := m.run(ctx, virsh, args...); err != nil {
 			return SnapshotRef{}, fmt.Errorf("external snapshot create: %w", err)
 		}
@@ -415,6 +707,186 @@ func (m *VirshManager) CreateSnapshot(ctx context.Context, vmName, snapshotName
 	return SnapshotRef{Name: snapshotName, Kind: "INTERNAL", Ref: snapshotName}, nil
 }
 
+func (m *VirshManager) ExportSnapshot(ctx context.Context, vmName, snapshotName string) (string, error) {
+	if vmName == "" || snapshotName == "" {
+		return "", fmt.Errorf("vmName and snapshotName are required")
+	}
+	jobDir := filepath.Join(m.cfg.WorkDir, vmName)
+	if fileExists(filepath.Join(jobDir, fmt.Sprintf("snap-%s.qcow2", snapshotName))) {
+		return "", fmt.Errorf("snapshot %s is external; only internal snapshots can be exported", snapshotName)
+	}
+	outPath := filepath.Join(jobDir, fmt.Sprintf("fork-%s.qcow2", snapshotName))
+	if fileExists(outPath) {
+		return outPath, nil
+	}
+
+	var path string
+	err := m.whilePaused(ctx, vmName, "export", func() (err error) {
+		path, err = m.exportSnapshot(ctx, jobDir, snapshotName, outPath)
+		return err
+	})
+	return path, err
+}
+
+// whilePaused runs fn with vmName paused if it is running. qemu-img must not
+// read the overlay while the guest writes to it, even with -U: cluster
+// allocations and metadata updates can land mid-copy. Pausing a running
+// domain drains and flushes its disks first. what names fn in errors.
+func (m *VirshManager) whilePaused(ctx context.Context, vmName, what string, fn func() error) error {
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	state, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "domstate", vmName)
+	if err != nil {
+		return fmt.Errorf("domain state: %w", err)
+	}
+	if strings.TrimSpace(state) != "running" {
+		return fn()
+	}
+	if err := m.SuspendVM(ctx, vmName); err != nil {
+		return fmt.Errorf("pause for %s: %w", what, err)
+	}
+	err = fn()
+	if rerr := m.ResumeVM(context.WithoutCancel(ctx), vmName); rerr != nil && err == nil {
+		err = fmt.Errorf("resume after %s: %w", what, rerr)
+	}
+	return err
+}
+
+// exportSnapshot converts snapshotName of the overlay in jobDir to outPath.
+// The domain must not be running.
+func (m *VirshManager) exportSnapshot(ctx context.Context, jobDir, snapshotName, outPath string) (string, error) {
+	overlay := filepath.Join(jobDir, "disk-overlay.qcow2")
+	qemuImg := m.binPath("qemu-img", m.cfg.QemuImgPath)
+	// -U skips the image lock a paused domain still holds.
+	out, err := m.run(ctx, qemuImg, "info", "-U", "--output=json", overlay)
+	if err != nil {
+		return "", fmt.Errorf("inspect overlay: %w", err)
+	}
+	var info struct {
+		BackingFile     string `json:"full-backing-filename"`
+		BackingFileName string `json:"backing-filename"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return "", fmt.Errorf("parse qemu-img info: %w", err)
+	}
+	backing := info.BackingFile
+	if backing == "" {
+		backing = info.BackingFileName
+	}
+
+	// Write only the clusters that differ from the backing file, so the export
+	// stays a thin layer over the same base as the sandbox.
+	tmp := outPath + ".part"
+	args := []string{"convert", "-U", "-O", "qcow2", "-l", "snapshot.name=" + snapshotName}
+	if backing != "" {
+		args = append(args, "-B", backing, "-F", "qcow2")
+	}
+	args = append(args, overlay, tmp)
+	if _, err := m.run(ctx, qemuImg, args...); err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("export snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, outPath); err != nil {
+		return "", fmt.Errorf("export snapshot: %w", err)
+	}
+	return outPath, nil
+}
+
+// sanitizeArgs are the virt-customize operations FlattenDisk applies with
+// sanitize set. Host keys are regenerated at first boot for guests without
+// cloud-init; cloud-init does the same on its own since its state is gone.
+var sanitizeArgs = []string{
+	"--truncate", "/etc/machine-id",
+	"--delete", "/var/lib/dbus/machine-id",
+	"--run-command", "rm -f /etc/ssh/ssh_host_*",
+	"--delete", "/var/lib/cloud",
+	"--run-command", "find /var/log -type f -exec truncate -s 0 {} +",
+	"--firstboot-command", "test -e /etc/ssh/ssh_host_ed25519_key || ssh-keygen -A",
+}
+
+func (m *VirshManager) FlattenDisk(ctx context.Context, vmName, snapshotName, filename string, sanitize bool) (DiskImage, error) {
+	if vmName == "" || filename == "" {
+		return DiskImage{}, fmt.Errorf("vmName and filename are required")
+	}
+	if filepath.Base(filename) != filename || strings.HasPrefix(filename, ".") {
+		return DiskImage{}, fmt.Errorf("invalid image filename %q", filename)
+	}
+	jobDir := filepath.Join(m.cfg.WorkDir, vmName)
+	if snapshotName != "" && fileExists(filepath.Join(jobDir, fmt.Sprintf("snap-%s.qcow2", snapshotName))) {
+		return DiskImage{}, fmt.Errorf("snapshot %s is external; only internal snapshots can be flattened", snapshotName)
+	}
+	outPath := filepath.Join(m.cfg.BaseImageDir, filename)
+	if fileExists(outPath) {
+		return DiskImage{}, fmt.Errorf("image file %s already exists", outPath)
+	}
+	if err := os.MkdirAll(m.cfg.BaseImageDir, 0o755); err != nil {
+		return DiskImage{}, fmt.Errorf("create base image dir: %w", err)
+	}
+
+	// Without -B, convert reads through the whole backing chain and writes
+	// every allocated cluster, so the result stands on its own.
+	overlay := filepath.Join(jobDir, "disk-overlay.qcow2")
+	qemuImg := m.binPath("qemu-img", m.cfg.QemuImgPath)
+	tmp := outPath + ".part"
+	args := []string{"convert", "-U", "-O", "qcow2"}
+	if snapshotName != "" {
+		args = append(args, "-l", "snapshot.name="+snapshotName)
+	}
+	args = append(args, overlay, tmp)
+	err := m.whilePaused(ctx, vmName, "flatten", func() error {
+		_, err := m.run(ctx, qemuImg, args...)
+		return err
+	})
+	if err != nil {
+		_ = os.Remove(tmp)
+		return DiskImage{}, fmt.Errorf("flatten disk: %w", err)
+	}
+	if sanitize {
+		virtCustomize := m.binPath("virt-customize", m.cfg.VirtCustomizePath)
+		if _, err := m.run(ctx, virtCustomize, append([]string{"-a", tmp}, sanitizeArgs...)...); err != nil {
+			_ = os.Remove(tmp)
+			return DiskImage{}, fmt.Errorf("sanitize disk: %w", err)
+		}
+	}
+
+	out, err := m.run(ctx, qemuImg, "info", "--output=json", tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return DiskImage{}, fmt.Errorf("inspect flattened disk: %w", err)
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		_ = os.Remove(tmp)
+		return DiskImage{}, fmt.Errorf("parse qemu-img info: %w", err)
+	}
+	if err := os.Rename(tmp, outPath); err != nil {
+		_ = os.Remove(tmp)
+		return DiskImage{}, fmt.Errorf("install image: %w", err)
+	}
+	img := DiskImage{Path: outPath, VirtualSizeBytes: info.VirtualSize}
+	if st, err := os.Stat(outPath); err == nil {
+		img.SizeBytes = st.Size()
+	}
+	return img, nil
+}
+
+func (m *VirshManager) RevertSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	if vmName == "" || snapshotName == "" {
+		return fmt.Errorf("vmName and snapshotName are required")
+	}
+	// External snapshots are taken with --no-metadata, so libvirt cannot revert them.
+	snapPath := filepath.Join(m.cfg.WorkDir, vmName, fmt.Sprintf("snap-%s.qcow2", snapshotName))
+	if fileExists(snapPath) {
+		return fmt.Errorf("snapshot %s is external; only internal snapshots can be reverted", snapshotName)
+	}
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	if _, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "snapshot-revert", vmName, snapshotName); err != nil {
+		return fmt.Errorf("snapshot revert: %w", err)
+	}
+	return nil
+}
+
 func (m *VirshManager) DiffSnapshot(ctx context.Context, vmName, fromSnapshot, toSnapshot string) (*FSComparePlan, error) {
 	if vmName == "" || fromSnapshot == "" || toSnapshot == "" {
 		return nil, fmt.Errorf("vmName, fromSnapshot and toSnapshot are required")
@@ -440,6 +912,16 @@ func (m *VirshManager) DiffSnapshot(ctx context.Context, vmName, fromSnapshot, t
 	if fileExists(fromPath) && fileExists(toPath) {
 		plan.FromRef = fromPath
 		plan.ToRef = toPath
+		// snap-X.qcow2 collects writes made after X, so the disk as it was
+		// at X is its backing file.
+		fromBase, fromErr := diskimage.BackingFile(fromPath)
+		toBase, toErr := diskimage.BackingFile(toPath)
+		if err := errors.Join(fromErr, toErr); err != nil {
+			plan.Notes = append(plan.Notes, fmt.Sprintf("Could not read the snapshot overlays: %v", err))
+		} else {
+			plan.FromDisk = DiskState{Path: fromBase}
+			plan.ToDisk = DiskState{Path: toBase}
+		}
 		plan.Notes = append(plan.Notes,
 			"External snapshots detected. You can mount them with qemu-nbd and diff the trees.",
 			fmt.Sprintf("sudo modprobe nbd max_part=16 && sudo qemu-nbd --connect=/dev/nbd0 %s", shEscape(fromPath)),
@@ -451,7 +933,13 @@ func (m *VirshManager) DiffSnapshot(ctx context.Context, vmName, fromSnapshot, t
 		return plan, nil
 	}
 
-	// Fallback: internal snapshots guidance.
+	// Fallback: internal snapshots, stored in the VM's overlay.
+	if overlay := filepath.Join(jobDir, "disk-overlay.qcow2"); fileExists(overlay) {
+		plan.FromRef = overlay
+		plan.ToRef = overlay
+		plan.FromDisk = DiskState{Path: overlay, Snapshot: fromSnapshot}
+		plan.ToDisk = DiskState{Path: overlay, Snapshot: toSnapshot}
+	}
 	plan.Notes = append(plan.Notes,
 		"Internal snapshots assumed. Use qemu-nbd with -s to select snapshot, then mount and diff.",
 		"For example: qemu-nbd may support --snapshot=<name> (varies by version) or use qemu-img to create temporary exports.",
@@ -460,6 +948,83 @@ func (m *VirshManager) DiffSnapshot(ctx context.Context, vmName, fromSnapshot, t
 	return plan, nil
 }
 
+func (m *VirshManager) SnapshotDisk(ctx context.Context, vmName, snapshotName string) (DiskState, error) {
+	if vmName == "" {
+		return DiskState{}, fmt.Errorf("vmName is required")
+	}
+	jobDir := filepath.Join(m.cfg.WorkDir, vmName)
+	if snapshotName == "" {
+		// The active root disk: the overlay, or the newest external snapshot.
+		virsh := m.binPath("virsh", m.cfg.VirshPath)
+		out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "domblklist", vmName, "--details")
+		if err != nil {
+			return DiskState{}, fmt.Errorf("list disks of %s: %w", vmName, err)
+		}
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[0] == "file" && fields[1] == "disk" && fields[2] == "vda" {
+				return DiskState{Path: fields[3]}, nil
+			}
+		}
+		return DiskState{}, fmt.Errorf("no vda disk found for %s", vmName)
+	}
+
+	// snap-X.qcow2 collects writes made after X; its backing file is the
+	// disk as it was at X.
+	if snapPath := filepath.Join(jobDir, fmt.Sprintf("snap-%s.qcow2", snapshotName)); fileExists(snapPath) {
+		base, err := diskimage.BackingFile(snapPath)
+		if err != nil {
+			return DiskState{}, fmt.Errorf("read external snapshot %s: %w", snapshotName, err)
+		}
+		if base == "" {
+			return DiskState{}, fmt.Errorf("external snapshot %s has no backing file", snapshotName)
+		}
+		return DiskState{Path: base}, nil
+	}
+	overlay := filepath.Join(jobDir, "disk-overlay.qcow2")
+	if !fileExists(overlay) {
+		return DiskState{}, fmt.Errorf("no overlay for %s in %s", vmName, jobDir)
+	}
+	return DiskState{Path: overlay, Snapshot: snapshotName}, nil
+}
+
+func (m *VirshManager) SetResources(ctx context.Context, vmName string, res Resources, live bool) error {
+	if vmName == "" {
+		return fmt.Errorf("vmName is required")
+	}
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	conn := []string{"--connect", m.cfg.LibvirtURI}
+	var steps [][]string
+	if live {
+		if res.VCPUs > 0 {
+			steps = append(steps, []string{"setvcpus", vmName, fmt.Sprint(res.VCPUs), "--live", "--config"})
+		}
+		if res.MemoryMB > 0 {
+			steps = append(steps, []string{"setmem", vmName, fmt.Sprintf("%dM", res.MemoryMB), "--live", "--config"})
+		}
+	} else {
+		// Raise the maximums first; the current values must not exceed them.
+		if res.MaxVCPUs > 0 {
+			steps = append(steps, []string{"setvcpus", vmName, fmt.Sprint(res.MaxVCPUs), "--config", "--maximum"})
+		}
+		if res.VCPUs > 0 {
+			steps = append(steps, []string{"setvcpus", vmName, fmt.Sprint(res.VCPUs), "--config"})
+		}
+		if res.MaxMemoryMB > 0 {
+			steps = append(steps, []string{"setmaxmem", vmName, fmt.Sprintf("%dM", res.MaxMemoryMB), "--config"})
+		}
+		if res.MemoryMB > 0 {
+			steps = append(steps, []string{"setmem", vmName, fmt.Sprintf("%dM", res.MemoryMB), "--config"})
+		}
+	}
+	for _, args := range steps {
+		if _, err := m.run(ctx, virsh, append(conn, args...)...); err != nil {
+			return fmt.Errorf("virsh %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
 func (m *VirshManager) GetIPAddress(ctx context.Context, vmName string, timeout time.Duration) (string, error) {
 	if vmName == "" {
 		return "", fmt.Errorf("vmName is required")
@@ -482,6 +1047,75 @@ func (m *VirshManager) GetIPAddress(ctx context.Context, vmName string, timeout
 	return "", errors.New("ip address not found within timeout")
 }
 
+// GuestExec runs argv through the QEMU guest agent (guest-exec) and polls
+// guest-exec-status until the process exits or timeout elapses.
+func (m *VirshManager) GuestExec(ctx context.Context, vmName string, argv []string, timeout time.Duration) (string, int, error) {
+	if vmName == "" {
+		return "", 0, fmt.Errorf("vmName is required")
+	}
+	if len(argv) == 0 {
+		return "", 0, fmt.Errorf("argv is required")
+	}
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	execReq, err := json.Marshal(map[string]any{
+		"execute": "guest-exec",
+		"arguments": map[string]any{
+			"path":           argv[0],
+			"arg":            argv[1:],
+			"capture-output": true,
+		},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "qemu-agent-command", vmName, string(execReq))
+	if err != nil {
+		return "", 0, fmt.Errorf("guest-exec: %w", err)
+	}
+	var started struct {
+		Return struct {
+			PID int `json:"pid"`
+		} `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(out), &started); err != nil {
+		return "", 0, fmt.Errorf("guest-exec: parse response: %w", err)
+	}
+
+	statusReq := fmt.Sprintf(`{"execute":"guest-exec-status","arguments":{"pid":%d}}`, started.Return.PID)
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "qemu-agent-command", vmName, statusReq)
+		if err != nil {
+			return "", 0, fmt.Errorf("guest-exec-status: %w", err)
+		}
+		var st struct {
+			Return struct {
+				Exited   bool   `json:"exited"`
+				ExitCode int    `json:"exitcode"`
+				OutData  string `json:"out-data"`
+			} `json:"return"`
+		}
+		if err := json.Unmarshal([]byte(out), &st); err != nil {
+			return "", 0, fmt.Errorf("guest-exec-status: parse response: %w", err)
+		}
+		if st.Return.Exited {
+			stdout, err := base64.StdEncoding.DecodeString(st.Return.OutData)
+			if err != nil {
+				return "", st.Return.ExitCode, fmt.Errorf("guest-exec-status: decode output: %w", err)
+			}
+			return string(stdout), st.Return.ExitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return "", 0, fmt.Errorf("guest command did not exit within %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 // --- Helpers ---
 
 func (m *VirshManager) binPath(defaultName, override string) string {
@@ -591,12 +1225,40 @@ func parseDomIfAddrIPv4(s string) string {
 // --- Domain XML rendering ---
 
 type domainXMLParams struct {
-	Name      string
-	MemoryMB  int
-	VCPUs     int
-	DiskPath  string
-	Network   string
-	BootOrder []string
+	Name        string
+	MemoryMB    int
+	VCPUs       int
+	MaxMemoryMB int // defaults to MemoryMB
+	MaxVCPUs    int // defaults to VCPUs
+	DiskPath    string
+	ExtraDisks  []domainDisk
+	Filesystems []domainFilesystem
+	Network     string
+	BootOrder   []string
+}
+
+// SharedMemory reports whether the domain needs shared memory backing, which virtiofs requires.
+func (p domainXMLParams) SharedMemory() bool {
+	for _, fs := range p.Filesystems {
+		if fs.Driver == "virtiofs" {
+			return true
+		}
+	}
+	return false
+}
+
+// domainDisk is an additional qcow2 disk attached after the root disk.
+type domainDisk struct {
+	Path   string
+	Target string // vdb, vdc, ...
+}
+
+// domainFilesystem is a host directory exposed to the guest under Tag.
+type domainFilesystem struct {
+	Driver   string // virtiofs | 9p
+	Source   string
+	Tag      string
+	ReadOnly bool
 }
 
 func renderDomainXML(p domainXMLParams) (string, error) {
@@ -604,8 +1266,15 @@ func renderDomainXML(p domainXMLParams) (string, error) {
 	const tpl = `<?xml version="1.0" encoding="utf-8"?>
 <domain type="kvm">
   <name>{{ .Name }}</name>
-  <memory unit="MiB">{{ .MemoryMB }}</memory>
-  <vcpu placement="static">{{ .VCPUs }}</vcpu>
+  <memory unit="MiB">{{ .MaxMemoryMB }}</memory>
+  <currentMemory unit="MiB">{{ .MemoryMB }}</currentMemory>
+  <vcpu placement="static" current="{{ .VCPUs }}">{{ .MaxVCPUs }}</vcpu>
+{{- if .SharedMemory }}
+  <memoryBacking>
+    <source type="memfd"/>
+    <access mode="shared"/>
+  </memoryBacking>
+{{- end }}
   <os>
     <type arch="x86_64" machine="pc-q35-6.2">hvm</type>
     <boot dev="hd"/>
@@ -623,6 +1292,25 @@ func renderDomainXML(p domainXMLParams) (string, error) {
       <source file="{{ .DiskPath }}"/>
       <target dev="vda" bus="virtio"/>
     </disk>
+{{- range .ExtraDisks }}
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2" cache="none"/>
+      <source file="{{ .Path }}"/>
+      <target dev="{{ .Target }}" bus="virtio"/>
+    </disk>
+{{- end }}
+{{- range .Filesystems }}
+    <filesystem type="mount" accessmode="{{ if eq .Driver "virtiofs" }}passthrough{{ else }}mapped{{ end }}">
+{{- if eq .Driver "virtiofs" }}
+      <driver type="virtiofs"/>
+{{- end }}
+      <source dir="{{ .Source }}"/>
+      <target dir="{{ .Tag }}"/>
+{{- if .ReadOnly }}
+      <readonly/>
+{{- end }}
+    </filesystem>
+{{- end }}
     <controller type="pci" model="pcie-root"/>
     <interface type="network">
       <source network="{{ .Network }}"/>
@@ -630,6 +1318,9 @@ func renderDomainXML(p domainXMLParams) (string, error) {
     </interface>
     <graphics type="vnc" autoport="yes" listen="0.0.0.0"/>
     <console type="pty"/>
+    <channel type="unix">
+      <target type="virtio" name="org.qemu.guest_agent.0"/>
+    </channel>
     <input type="tablet" bus="usb"/>
     <rng model="virtio">
       <backend model="random">/dev/urandom</backend>
@@ -637,6 +1328,12 @@ func renderDomainXML(p domainXMLParams) (string, error) {
   </devices>
 </domain>
 `
+	if p.MaxMemoryMB < p.MemoryMB {
+		p.MaxMemoryMB = p.MemoryMB
+	}
+	if p.MaxVCPUs < p.VCPUs {
+		p.MaxVCPUs = p.VCPUs
+	}
 	var b bytes.Buffer
 	t := template.Must(template.New("domain").Parse(tpl))
 	if err := t.Execute(&b, p); err != nil {
@@ -645,6 +1342,96 @@ func renderDomainXML(p domainXMLParams) (string, error) {
 	return b.String(), nil
 }
 
+// prepareDisks applies CloneOptions to a freshly created overlay: it grows the
+// overlay to the requested root size and creates blank scratch disks in jobDir,
+// where DestroyVM removes them with the rest of the workspace.
+func (m *VirshManager) prepareDisks(ctx context.Context, jobDir, overlayPath string, co CloneOptions) ([]domainDisk, error) {
+	if len(co.ScratchDisksGB) > MaxScratchDisks {
+		return nil, fmt.Errorf("at most %d scratch disks are supported, got %d", MaxScratchDisks, len(co.ScratchDisksGB))
+	}
+	qemuImg := m.binPath("qemu-img", m.cfg.QemuImgPath)
+	if co.RootDiskGB > 0 {
+		// qemu-img refuses to shrink without --shrink, so a size below the backing disk fails here.
+		if _, err := m.run(ctx, qemuImg, "resize", overlayPath, fmt.Sprintf("%dG", co.RootDiskGB)); err != nil {
+			return nil, fmt.Errorf("resize root disk: %w", err)
+		}
+	}
+	disks := make([]domainDisk, 0, len(co.ScratchDisksGB))
+	for i, gb := range co.ScratchDisksGB {
+		if gb <= 0 {
+			return nil, fmt.Errorf("scratch disk %d size must be positive", i)
+		}
+		target := fmt.Sprintf("vd%c", 'b'+i)
+		path := filepath.Join(jobDir, fmt.Sprintf("scratch-%s.qcow2", target))
+		if _, err := m.run(ctx, qemuImg, "create", "-f", "qcow2", path, fmt.Sprintf("%dG", gb)); err != nil {
+			return nil, fmt.Errorf("create scratch disk %s: %w", target, err)
+		}
+		disks = append(disks, domainDisk{Path: path, Target: target})
+	}
+	return disks, nil
+}
+
+// sharedFilesystems maps shared host directories to domain filesystem devices
+// using the configured driver for writable shares and 9p for read-only ones.
+func (m *VirshManager) sharedFilesystems(dirs []SharedDir) ([]domainFilesystem, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	driver, err := m.sharedDirDriver()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]domainFilesystem, 0, len(dirs))
+	for _, d := range dirs {
+		if !filepath.IsAbs(d.HostPath) || strings.ContainsAny(d.HostPath+d.Tag, "\"<>&'") {
+			return nil, fmt.Errorf("invalid shared directory %q (tag %q)", d.HostPath, d.Tag)
+		}
+		if st, err := os.Stat(d.HostPath); err != nil || !st.IsDir() {
+			return nil, fmt.Errorf("shared directory not accessible: %s", d.HostPath)
+		}
+		// libvirt rejects <readonly/> on virtiofs filesystems, so read-only shares always use 9p.
+		fsDriver := driver
+		if d.ReadOnly {
+			fsDriver = "9p"
+		}
+		out = append(out, domainFilesystem{Driver: fsDriver, Source: d.HostPath, Tag: d.Tag, ReadOnly: d.ReadOnly})
+	}
+	return out, nil
+}
+
+// sharedDirDriver resolves Config.SharedDirDriver; "auto" picks virtiofs when
+// virtiofsd is installed and falls back to 9p.
+func (m *VirshManager) sharedDirDriver() (string, error) {
+	switch d := strings.ToLower(m.cfg.SharedDirDriver); d {
+	case "virtiofs", "9p":
+		return d, nil
+	case "", "auto":
+		if hasBin("virtiofsd") || fileExists("/usr/libexec/virtiofsd") || fileExists("/usr/lib/qemu/virtiofsd") {
+			return "virtiofs", nil
+		}
+		return "9p", nil
+	default:
+		return "", fmt.Errorf("unsupported SharedDirDriver: %s", m.cfg.SharedDirDriver)
+	}
+}
+
+// diskTargets lists the target devices (vda, vdb, ...) of a domain's file-backed disks.
+func (m *VirshManager) diskTargets(ctx context.Context, vmName string) ([]string, error) {
+	virsh := m.binPath("virsh", m.cfg.VirshPath)
+	out, err := m.run(ctx, virsh, "--connect", m.cfg.LibvirtURI, "domblklist", vmName, "--details")
+	if err != nil {
+		return nil, fmt.Errorf("list disks of %s: %w", vmName, err)
+	}
+	var targets []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "file" && fields[1] == "disk" {
+			targets = append(targets, fields[2])
+		}
+	}
+	return targets, nil
+}
+
 // attachISOToDomainXML is a simple XML string replacement to add a CD-ROM pointing to seed ISO.
 // For a production system, consider parsing XML and building a proper DOM.
 func (m *VirshManager) attachISOToDomainXML(xmlPath, isoPath string) error {
@@ -669,12 +1456,15 @@ func (m *VirshManager) attachISOToDomainXML(xmlPath, isoPath string) error {
 	return os.WriteFile(xmlPath, []byte(xml), 0o644)
 }
 
-// buildCloudInitSeed creates a NoCloud seed ISO with a single user and SSH key.
+// buildCloudInitSeed creates a NoCloud seed ISO with a single user and SSH key
+// (plus bootCmds as bootcmd entries), or with the caller-supplied cloud-config
+// document when userData is non-empty.
 // Requires cloud-localds (cloud-image-utils) on the host if implemented via external tool.
 // This implementation writes user-data/meta-data and attempts to use genisoimage or mkisofs.
-func (m *VirshManager) buildCloudInitSeed(ctx context.Context, vmName, username, publicKey, outISO string) error {
+func (m *VirshManager) buildCloudInitSeed(ctx context.Context, vmName, username, publicKey, outISO string, userData []byte, bootCmds []string) error {
 	jobDir := filepath.Dir(outISO)
-	userData := fmt.Sprintf(`#cloud-config
+	if len(userData) == 0 {
+		userData = []byte(fmt.Sprintf(`#cloud-config
 users:
   - name: %s
     sudo: ALL=(ALL) NOPASSWD:ALL
@@ -682,7 +1472,15 @@ users:
     shell: /bin/bash
     ssh_authorized_keys:
       - %s
-`, username, publicKey)
+`, username, publicKey))
+		if len(bootCmds) > 0 {
+			userData = append(userData, "bootcmd:\n"...)
+			for _, c := range bootCmds {
+				q, _ := json.Marshal(c) // a JSON string is a valid YAML scalar
+				userData = append(userData, fmt.Sprintf("  - [sh, -c, %s]\n", q)...)
+			}
+		}
+	}
 
 	metaData := fmt.Sprintf(`instance-id: %s
 local-hostname: %s
@@ -690,7 +1488,7 @@ local-hostname: %s
 
 	userDataPath := filepath.Join(jobDir, "user-data")
 	metaDataPath := filepath.Join(jobDir, "meta-data")
-	if err := os.WriteFile(userDataPath, []byte(userData), 0o644); err != nil {
+	if err := os.WriteFile(userDataPath, userData, 0o644); err != nil {
 		return fmt.Errorf("write user-data: %w", err)
 	}
 	if err := os.WriteFile(metaDataPath, []byte(metaData), 0o644); err != nil {
@@ -11,6 +11,21 @@ type CloneResult struct {
 	// Image is the full image tag (e.g., "vmclone/node-c:20251215T183000Z").
 	Image string `json:"image"`
 
+	// Digest is the manifest digest of the image when it was written as an
+	// OCI layout rather than built with podman build.
+	Digest string `json:"digest,omitempty"`
+
+	// BaseImage is the image of the previous clone of the VM that an
+	// incremental clone added its changes to as a layer. It is empty when
+	// the whole root filesystem was archived.
+	BaseImage string `json:"base_image,omitempty"`
+
+	// Pushed is the registry reference the image was pushed to, and
+	// PushedDigest the manifest digest the registry stored. Both are empty
+	// unless the clone requested a push.
+	Pushed       string `json:"pushed,omitempty"`
+	PushedDigest string `json:"pushed_digest,omitempty"`
+
 	// Mode indicates the extraction method used: "snapshot" for running VMs,
 	// "offline" for stopped VMs.
 	Mode string `json:"mode"`
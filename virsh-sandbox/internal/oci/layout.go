@@ -0,0 +1,485 @@
+// Package oci writes container images in the OCI image-layout format without
+// a container engine.
+//
+// A root filesystem tar stream is compressed into a single layer blob while
+// both the compressed digest and the uncompressed diff ID are computed, so the
+// rootfs is read exactly once. The writer then adds an image config (env,
+// cmd, labels), a manifest and an index entry naming the image. The layout
+// directory can be loaded with `podman pull oci:<dir>:<ref>`, copied with
+// skopeo or pushed to a registry.
+package oci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Media types of the layout documents and blobs.
+const (
+	MediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+)
+
+// AnnotationRefName names an image within a layout's index.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// Compression selects how layer blobs are compressed.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ErrUnsupportedCompression indicates an unknown Compression.
+var ErrUnsupportedCompression = errors.New("unsupported layer compression")
+
+// Descriptor references a blob by media type, digest and size.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform describes the OS and architecture an image runs on.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// Index is the index.json of a layout.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest is an image manifest.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ImageConfig is the image configuration blob.
+type ImageConfig struct {
+	Created      time.Time       `json:"created"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// ContainerConfig holds the execution defaults of an image.
+type ContainerConfig struct {
+	Env        []string          `json:"Env,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+	StopSignal string            `json:"StopSignal,omitempty"`
+}
+
+// RootFS lists the uncompressed digests of an image's layers.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History records how a layer was created.
+type History struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// ImageSpec describes the image WriteImage produces.
+type ImageSpec struct {
+	// Ref names the image in the layout index; an existing entry with the
+	// same name is replaced.
+	Ref string
+
+	Env    []string
+	Cmd    []string
+	Labels map[string]string
+
+	// Created defaults to now; Architecture and OS to the host's.
+	Created      time.Time
+	Architecture string
+	OS           string
+
+	// CreatedBy is recorded in the layer history.
+	CreatedBy string
+
+	// Base names an image in the same layout to stack the layer on. Its
+	// layers and history are kept; Env, Cmd and Labels are replaced.
+	Base string
+}
+
+// Image is the result of writing an image into a layout.
+type Image struct {
+	// LayoutDir is the OCI layout the image was written to.
+	LayoutDir string
+
+	// Ref is the image name within the layout.
+	Ref string
+
+	Manifest Descriptor
+	Config   Descriptor
+	Layer    Descriptor
+
+	// DiffID is the digest of the uncompressed layer.
+	DiffID string
+
+	// Layers counts the image's layers, including those of its base.
+	Layers int
+}
+
+// Writer writes images into OCI layouts.
+type Writer struct {
+	compression Compression
+	gzipLevel   int
+	zstdPath    string
+	zstdLevel   int
+}
+
+// WriterConfig configures a Writer.
+type WriterConfig struct {
+	// Compression defaults to gzip.
+	Compression Compression
+
+	// GzipLevel defaults to gzip.DefaultCompression.
+	GzipLevel int
+
+	// ZstdPath is the zstd binary used for zstd layers. If empty, "zstd" is
+	// looked up in PATH.
+	ZstdPath string
+
+	// ZstdLevel defaults to 3.
+	ZstdLevel int
+}
+
+// NewWriter creates a Writer with the given configuration.
+func NewWriter(cfg WriterConfig) *Writer {
+	w := &Writer{
+		compression: cfg.Compression,
+		gzipLevel:   cfg.GzipLevel,
+		zstdPath:    cfg.ZstdPath,
+		zstdLevel:   cfg.ZstdLevel,
+	}
+	if w.compression == "" {
+		w.compression = CompressionGzip
+	}
+	if w.gzipLevel == 0 {
+		w.gzipLevel = gzip.DefaultCompression
+	}
+	if w.zstdPath == "" {
+		w.zstdPath = "zstd"
+	}
+	if w.zstdLevel == 0 {
+		w.zstdLevel = 3
+	}
+	return w
+}
+
+// WriteImage streams the rootfs tar from r into a single compressed layer
+// and writes a config, manifest and index entry for it under layoutDir,
+// creating the layout if needed. With spec.Base the layer is added on top of
+// that image instead.
+func (w *Writer) WriteImage(ctx context.Context, layoutDir string, rootfs io.Reader, spec ImageSpec) (*Image, error) {
+	if spec.Ref == "" {
+		return nil, fmt.Errorf("image ref is required")
+	}
+	if err := initLayout(layoutDir); err != nil {
+		return nil, err
+	}
+	var base Manifest
+	var baseCfg ImageConfig
+	if spec.Base != "" {
+		var err error
+		if base, baseCfg, err = readImage(layoutDir, spec.Base); err != nil {
+			return nil, fmt.Errorf("read base image: %w", err)
+		}
+	}
+
+	layer, diffID, err := w.writeLayer(ctx, layoutDir, rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("write layer: %w", err)
+	}
+
+	created := spec.Created
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	platform := Platform{Architecture: spec.Architecture, OS: spec.OS}
+	if platform.Architecture == "" {
+		platform.Architecture = runtime.GOARCH
+	}
+	if platform.OS == "" {
+		platform.OS = "linux"
+	}
+	cfg := ImageConfig{
+		Created:      created,
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		Config: ContainerConfig{
+			Env:    spec.Env,
+			Cmd:    spec.Cmd,
+			Labels: spec.Labels,
+		},
+		RootFS:  RootFS{Type: "layers", DiffIDs: append(baseCfg.RootFS.DiffIDs, diffID)},
+		History: append(baseCfg.History, History{Created: created, CreatedBy: spec.CreatedBy}),
+	}
+	cfgDesc, err := writeJSONBlob(layoutDir, MediaTypeConfig, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("write config: %w", err)
+	}
+
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        cfgDesc,
+		Layers:        append(base.Layers, layer),
+	}
+	manDesc, err := writeJSONBlob(layoutDir, MediaTypeManifest, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("write manifest: %w", err)
+	}
+	manDesc.Platform = &platform
+	manDesc.Annotations = map[string]string{AnnotationRefName: spec.Ref}
+
+	if err := addToIndex(layoutDir, manDesc); err != nil {
+		return nil, fmt.Errorf("update index: %w", err)
+	}
+	return &Image{
+		LayoutDir: layoutDir,
+		Ref:       spec.Ref,
+		Manifest:  manDesc,
+		Config:    cfgDesc,
+		Layer:     layer,
+		DiffID:    diffID,
+		Layers:    len(manifest.Layers),
+	}, nil
+}
+
+// readImage reads the manifest and config of the image named ref in a layout.
+func readImage(layoutDir, ref string) (Manifest, ImageConfig, error) {
+	var m Manifest
+	var cfg ImageConfig
+	desc, err := findManifest(layoutDir, ref)
+	if err != nil {
+		return m, cfg, err
+	}
+	b, err := os.ReadFile(BlobPath(layoutDir, desc.Digest))
+	if err != nil {
+		return m, cfg, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, cfg, fmt.Errorf("parse manifest: %w", err)
+	}
+	if b, err = os.ReadFile(BlobPath(layoutDir, m.Config.Digest)); err != nil {
+		return m, cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return m, cfg, fmt.Errorf("parse config: %w", err)
+	}
+	if len(cfg.RootFS.DiffIDs) != len(m.Layers) {
+		return m, cfg, fmt.Errorf("config lists %d layers, manifest %d", len(cfg.RootFS.DiffIDs), len(m.Layers))
+	}
+	return m, cfg, nil
+}
+
+// ReadIndex reads the index.json of a layout.
+func ReadIndex(layoutDir string) (*Index, error) {
+	b, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("parse index.json: %w", err)
+	}
+	return &idx, nil
+}
+
+// BlobPath returns the path of the blob with the given digest in a layout.
+func BlobPath(layoutDir, digest string) string {
+	algo, hexPart, ok := splitDigest(digest)
+	if !ok {
+		return filepath.Join(layoutDir, "blobs", "invalid")
+	}
+	return filepath.Join(layoutDir, "blobs", algo, hexPart)
+}
+
+// writeLayer compresses rootfs into a blob, returning its descriptor and the
+// digest of the uncompressed stream.
+func (w *Writer) writeLayer(ctx context.Context, layoutDir string, rootfs io.Reader) (Descriptor, string, error) {
+	var mediaType string
+	switch w.compression {
+	case CompressionGzip:
+		mediaType = MediaTypeLayerGzip
+	case CompressionZstd:
+		mediaType = MediaTypeLayerZstd
+	default:
+		return Descriptor{}, "", fmt.Errorf("%w: %q", ErrUnsupportedCompression, w.compression)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(layoutDir, "blobs", "sha256"), ".layer-*")
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	diffHash := sha256.New()
+	src := io.TeeReader(&ctxReader{ctx: ctx, r: rootfs}, diffHash)
+	blob := &digester{w: tmp, h: sha256.New()}
+
+	switch w.compression {
+	case CompressionGzip:
+		zw, err := gzip.NewWriterLevel(blob, w.gzipLevel)
+		if err != nil {
+			return Descriptor{}, "", err
+		}
+		if _, err := io.Copy(zw, src); err != nil {
+			return Descriptor{}, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return Descriptor{}, "", err
+		}
+	case CompressionZstd:
+		cmd := exec.CommandContext(ctx, w.zstdPath, "-q", "-c", "-T0", fmt.Sprintf("-%d", w.zstdLevel))
+		var stderr bytes.Buffer
+		cmd.Stdin = src
+		cmd.Stdout = blob
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return Descriptor{}, "", fmt.Errorf("zstd failed: %w: %s", err, stderr.String())
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return Descriptor{}, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return Descriptor{}, "", err
+	}
+
+	desc := Descriptor{MediaType: mediaType, Digest: blob.digest(), Size: blob.n}
+	if err := os.Rename(tmp.Name(), BlobPath(layoutDir, desc.Digest)); err != nil {
+		return Descriptor{}, "", err
+	}
+	return desc, "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), nil
+}
+
+// initLayout creates the oci-layout marker and blob directory.
+func initLayout(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755); err != nil {
+		return err
+	}
+	marker := filepath.Join(dir, "oci-layout")
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	return os.WriteFile(marker, []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644)
+}
+
+// writeJSONBlob stores v as a content-addressed blob.
+func writeJSONBlob(dir, mediaType string, v any) (Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	sum := sha256.Sum256(b)
+	desc := Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(b))}
+	if err := os.WriteFile(BlobPath(dir, desc.Digest), b, 0o644); err != nil {
+		return Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// addToIndex adds desc to the layout index, replacing any entry with the same
+// ref name.
+func addToIndex(dir string, desc Descriptor) error {
+	idx, err := ReadIndex(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		idx = &Index{SchemaVersion: 2, MediaType: MediaTypeIndex}
+	} else if err != nil {
+		return err
+	}
+	ref := desc.Annotations[AnnotationRefName]
+	kept := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if m.Annotations[AnnotationRefName] != ref {
+			kept = append(kept, m)
+		}
+	}
+	idx.Manifests = append(kept, desc)
+
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ".index.json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "index.json"))
+}
+
+func splitDigest(d string) (algo, hexPart string, ok bool) {
+	algo, hexPart, ok = strings.Cut(d, ":")
+	return algo, hexPart, ok && algo != "" && hexPart != ""
+}
+
+// digester writes through to w while hashing and counting.
+type digester struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.h.Write(p[:n])
+	d.n += int64(n)
+	return n, err
+}
+
+func (d *digester) digest() string {
+	return "sha256:" + hex.EncodeToString(d.h.Sum(nil))
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
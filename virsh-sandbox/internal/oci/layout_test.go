@@ -0,0 +1,176 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// rootfsTar returns a small tar stream with one file.
+func rootfsTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	body := []byte("NAME=Test\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "./etc/os-release", Mode: 0o644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// readBlob reads a blob and checks it against its descriptor.
+func readBlob(t *testing.T, dir string, d Descriptor) []byte {
+	t.Helper()
+	b, err := os.ReadFile(BlobPath(dir, d.Digest))
+	if err != nil {
+		t.Fatalf("blob %s: %v", d.Digest, err)
+	}
+	if digestOf(b) != d.Digest || int64(len(b)) != d.Size {
+		t.Fatalf("blob %s: digest %s size %d, want size %d", d.Digest, digestOf(b), len(b), d.Size)
+	}
+	return b
+}
+
+func TestWriteImageGzip(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := rootfsTar(t)
+	created := time.Date(2025, 12, 15, 18, 30, 0, 0, time.UTC)
+	w := NewWriter(WriterConfig{})
+	img, err := w.WriteImage(context.Background(), dir, bytes.NewReader(rootfs), ImageSpec{
+		Ref:     "v1",
+		Cmd:     []string{"/bin/sh"},
+		Labels:  map[string]string{"source-vm": "web1"},
+		Created: created,
+	})
+	if err != nil {
+		t.Fatalf("WriteImage: %v", err)
+	}
+	if img.DiffID != digestOf(rootfs) {
+		t.Errorf("diff id = %s, want %s", img.DiffID, digestOf(rootfs))
+	}
+	if _, err := os.Stat(dir + "/oci-layout"); err != nil {
+		t.Errorf("oci-layout marker: %v", err)
+	}
+
+	idx, err := ReadIndex(dir)
+	if err != nil {
+		t.Fatalf("ReadIndex: %v", err)
+	}
+	if len(idx.Manifests) != 1 || idx.Manifests[0].Digest != img.Manifest.Digest || idx.Manifests[0].Annotations[AnnotationRefName] != "v1" {
+		t.Fatalf("index = %+v", idx)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(readBlob(t, dir, img.Manifest), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 1 || m.Layers[0].MediaType != MediaTypeLayerGzip || m.Config.Digest != img.Config.Digest {
+		t.Fatalf("manifest = %+v", m)
+	}
+	var cfg ImageConfig
+	if err := json.Unmarshal(readBlob(t, dir, m.Config), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Created.Equal(created) || cfg.Config.Labels["source-vm"] != "web1" || len(cfg.RootFS.DiffIDs) != 1 || cfg.RootFS.DiffIDs[0] != img.DiffID {
+		t.Errorf("config = %+v", cfg)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(readBlob(t, dir, m.Layers[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(layer, rootfs) {
+		t.Errorf("layer does not decompress to the rootfs: %v", err)
+	}
+
+	// A second image with the same ref replaces the index entry.
+	if _, err := w.WriteImage(context.Background(), dir, bytes.NewReader(rootfs), ImageSpec{Ref: "v1", Cmd: []string{"/bin/bash"}}); err != nil {
+		t.Fatalf("second WriteImage: %v", err)
+	}
+	if idx, _ := ReadIndex(dir); len(idx.Manifests) != 1 {
+		t.Errorf("index has %d manifests, want 1", len(idx.Manifests))
+	}
+}
+
+func TestWriteImageZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+	dir := t.TempDir()
+	rootfs := rootfsTar(t)
+	img, err := NewWriter(WriterConfig{Compression: CompressionZstd}).WriteImage(context.Background(), dir, bytes.NewReader(rootfs), ImageSpec{Ref: "v1"})
+	if err != nil {
+		t.Fatalf("WriteImage: %v", err)
+	}
+	if img.Layer.MediaType != MediaTypeLayerZstd || img.DiffID != digestOf(rootfs) {
+		t.Errorf("layer = %+v, diff id %s", img.Layer, img.DiffID)
+	}
+	out, err := exec.Command("zstd", "-d", "-c", BlobPath(dir, img.Layer.Digest)).Output()
+	if err != nil || !bytes.Equal(out, rootfs) {
+		t.Errorf("layer does not decompress to the rootfs: %v", err)
+	}
+
+	if _, err := NewWriter(WriterConfig{Compression: "lz4"}).WriteImage(context.Background(), dir, bytes.NewReader(rootfs), ImageSpec{Ref: "v2"}); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("lz4: err = %v, want ErrUnsupportedCompression", err)
+	}
+}
+
+func TestWriteImageOnBase(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(WriterConfig{})
+	base, err := w.WriteImage(context.Background(), dir, bytes.NewReader(rootfsTar(t)), ImageSpec{Ref: "v1", Cmd: []string{"/bin/sh"}})
+	if err != nil {
+		t.Fatalf("WriteImage: %v", err)
+	}
+	delta := []byte("delta layer")
+	img, err := w.WriteImage(context.Background(), dir, bytes.NewReader(delta), ImageSpec{Ref: "v2", Base: "v1", Cmd: []string{"/bin/bash"}})
+	if err != nil {
+		t.Fatalf("WriteImage on base: %v", err)
+	}
+	if img.Layers != 2 {
+		t.Errorf("layers = %d, want 2", img.Layers)
+	}
+	var m Manifest
+	if err := json.Unmarshal(readBlob(t, dir, img.Manifest), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 2 || m.Layers[0].Digest != base.Layer.Digest || m.Layers[1].Digest != img.Layer.Digest {
+		t.Fatalf("manifest layers = %+v", m.Layers)
+	}
+	var cfg ImageConfig
+	if err := json.Unmarshal(readBlob(t, dir, m.Config), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.RootFS.DiffIDs) != 2 || cfg.RootFS.DiffIDs[1] != digestOf(delta) || len(cfg.History) != 2 || cfg.Config.Cmd[0] != "/bin/bash" {
+		t.Errorf("config = %+v", cfg)
+	}
+	if idx, _ := ReadIndex(dir); len(idx.Manifests) != 2 {
+		t.Errorf("index has %d manifests, want 2", len(idx.Manifests))
+	}
+
+	if _, err := w.WriteImage(context.Background(), dir, bytes.NewReader(delta), ImageSpec{Ref: "v3", Base: "missing"}); !errors.Is(err, ErrManifestNotFound) {
+		t.Errorf("missing base: err = %v, want ErrManifestNotFound", err)
+	}
+}
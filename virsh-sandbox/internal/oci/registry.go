@@ -0,0 +1,511 @@
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Sentinel errors for registry pushes.
+var (
+	// ErrInvalidReference indicates a malformed image reference.
+	ErrInvalidReference = errors.New("invalid image reference")
+
+	// ErrUnauthorized indicates the registry rejected the credentials.
+	ErrUnauthorized = errors.New("registry authentication failed")
+
+	// ErrManifestNotFound indicates the layout has no matching manifest.
+	ErrManifestNotFound = errors.New("manifest not found in layout")
+)
+
+// Reference names an image in a registry: registry/repository:tag.
+type Reference struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// String returns the reference as registry/repository[:tag].
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	return s
+}
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// ParseReference parses registry/repository[:tag]. The registry must be
+// explicit: a host name with a dot or port, or localhost.
+func ParseReference(s string) (Reference, error) {
+	host, rest, ok := strings.Cut(s, "/")
+	if !ok || host == "" || !(strings.ContainsAny(host, ".:") || host == "localhost") {
+		return Reference{}, fmt.Errorf("%w: %q must start with a registry host", ErrInvalidReference, s)
+	}
+	if strings.Contains(rest, "@") {
+		return Reference{}, fmt.Errorf("%w: %q: digest references cannot be pushed to", ErrInvalidReference, s)
+	}
+	ref := Reference{Registry: host, Repository: rest}
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 {
+		ref.Repository, ref.Tag = rest[:i], rest[i+1:]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("%w: tag %q", ErrInvalidReference, ref.Tag)
+		}
+	}
+	if !repositoryPattern.MatchString(ref.Repository) {
+		return Reference{}, fmt.Errorf("%w: repository %q", ErrInvalidReference, ref.Repository)
+	}
+	return ref, nil
+}
+
+// Credentials authenticate to one registry.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// LoadAuthFile reads registry credentials from a containers auth.json (as
+// written by `podman login`), keyed by registry host.
+func LoadAuthFile(path string) (map[string]Credentials, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	out := make(map[string]Credentials, len(f.Auths))
+	for host, a := range f.Auths {
+		dec, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: auth for %s: %w", path, host, err)
+		}
+		user, pass, _ := strings.Cut(string(dec), ":")
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		host, _, _ = strings.Cut(host, "/")
+		out[host] = Credentials{Username: user, Password: pass}
+	}
+	return out, nil
+}
+
+// Client pushes images from OCI layouts to registries using the OCI
+// distribution protocol. It handles anonymous, basic and bearer token auth.
+type Client struct {
+	http     *http.Client
+	auth     map[string]Credentials
+	insecure []string
+
+	mu     sync.Mutex
+	tokens map[string]string // host + scope -> bearer token
+}
+
+// ClientConfig configures a registry client.
+type ClientConfig struct {
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Auth holds credentials by registry host.
+	Auth map[string]Credentials
+
+	// InsecureHosts are reached over plain HTTP.
+	InsecureHosts []string
+}
+
+// NewClient creates a registry client with the given configuration.
+func NewClient(cfg ClientConfig) *Client {
+	hc := cfg.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{
+		http:     hc,
+		auth:     cfg.Auth,
+		insecure: cfg.InsecureHosts,
+		tokens:   make(map[string]string),
+	}
+}
+
+// PushOptions tune a single push.
+type PushOptions struct {
+	// MountFrom is a repository on the same registry whose blobs are
+	// mounted instead of uploaded when they match.
+	MountFrom string
+}
+
+// PushResult reports a completed push.
+type PushResult struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+
+	Uploaded int `json:"uploaded"` // blobs uploaded
+	Existing int `json:"existing"` // blobs the registry already had
+	Mounted  int `json:"mounted"`  // blobs mounted from MountFrom
+}
+
+// Push uploads the image named ref in layoutDir (or its only image when ref
+// is empty) to target and tags it. Blobs the repository already holds are
+// skipped and blobs in opts.MountFrom are mounted.
+func (c *Client) Push(ctx context.Context, layoutDir, ref string, target Reference, opts PushOptions) (*PushResult, error) {
+	if target.Tag == "" {
+		return nil, fmt.Errorf("%w: %s has no tag", ErrInvalidReference, target)
+	}
+	desc, err := findManifest(layoutDir, ref)
+	if err != nil {
+		return nil, err
+	}
+	manifestBytes, err := os.ReadFile(BlobPath(layoutDir, desc.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+
+	res := &PushResult{Reference: target.String()}
+	for _, blob := range append([]Descriptor{m.Config}, m.Layers...) {
+		how, err := c.pushBlob(ctx, layoutDir, target, blob, opts.MountFrom)
+		if err != nil {
+			return nil, fmt.Errorf("push blob %s: %w", blob.Digest, err)
+		}
+		switch how {
+		case blobExisting:
+			res.Existing++
+		case blobMounted:
+			res.Mounted++
+		default:
+			res.Uploaded++
+		}
+	}
+
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	resp, err := c.do(ctx, target, nil, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url(target, "manifests", target.Tag), strings.NewReader(string(manifestBytes)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		req.ContentLength = int64(len(manifestBytes))
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("put manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("put manifest: %w", registryError(resp))
+	}
+	res.Digest = desc.Digest
+	if got := resp.Header.Get("Docker-Content-Digest"); got != "" && got != desc.Digest {
+		return nil, fmt.Errorf("put manifest: registry stored digest %s, want %s", got, desc.Digest)
+	}
+	return res, nil
+}
+
+type blobResult int
+
+const (
+	blobUploaded blobResult = iota
+	blobExisting
+	blobMounted
+)
+
+// pushBlob makes blob available in target's repository: it checks for it,
+// tries a cross-repository mount, then uploads it monolithically.
+func (c *Client) pushBlob(ctx context.Context, layoutDir string, target Reference, blob Descriptor, mountFrom string) (blobResult, error) {
+	resp, err := c.do(ctx, target, nil, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, c.url(target, "blobs", blob.Digest), nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return blobExisting, nil
+	}
+
+	start := c.url(target, "blobs", "uploads/")
+	var extraScope []string
+	if mountFrom != "" && mountFrom != target.Repository {
+		start += "?" + url.Values{"mount": {blob.Digest}, "from": {mountFrom}}.Encode()
+		extraScope = []string{"repository:" + mountFrom + ":pull"}
+	}
+	resp, err = c.do(ctx, target, extraScope, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, start, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return blobMounted, nil
+	case http.StatusAccepted:
+	default:
+		return 0, fmt.Errorf("start upload: %w", registryError(resp))
+	}
+
+	loc, err := c.resolve(target, resp.Header.Get("Location"))
+	if err != nil {
+		return 0, fmt.Errorf("upload location: %w", err)
+	}
+	q := loc.Query()
+	q.Set("digest", blob.Digest)
+	loc.RawQuery = q.Encode()
+
+	resp, err = c.do(ctx, target, nil, func() (*http.Request, error) {
+		f, err := os.Open(BlobPath(layoutDir, blob.Digest))
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, loc.String(), f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = blob.Size
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("upload: %w", registryError(resp))
+	}
+	return blobUploaded, nil
+}
+
+// do sends the request built by newReq, authenticating and retrying once
+// when the registry answers 401. extraScope adds token scopes beyond push
+// access to target's repository.
+func (c *Client) do(ctx context.Context, target Reference, extraScope []string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	scope := append([]string{"repository:" + target.Repository + ":pull,push"}, extraScope...)
+	key := target.Registry + " " + strings.Join(scope, " ")
+
+	req, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req, target.Registry, key)
+	resp, err := c.http.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	if err := c.login(ctx, target.Registry, key, challenge, scope); err != nil {
+		return nil, err
+	}
+	if req, err = newReq(); err != nil {
+		return nil, err
+	}
+	c.authorize(req, target.Registry, key)
+	resp, err = c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, target.Registry)
+	}
+	return resp, nil
+}
+
+// authorize sets the cached bearer token for key, or basic credentials for
+// registries that use them.
+func (c *Client) authorize(req *http.Request, host, key string) {
+	c.mu.Lock()
+	tok, ok := c.tokens[key]
+	c.mu.Unlock()
+	switch {
+	case ok && tok != "":
+		req.Header.Set("Authorization", "Bearer "+tok)
+	case ok:
+		if cred, found := c.auth[host]; found {
+			req.SetBasicAuth(cred.Username, cred.Password)
+		}
+	}
+}
+
+// login answers an authentication challenge. Basic challenges switch host
+// to basic auth; bearer challenges fetch a token from the realm.
+func (c *Client) login(ctx context.Context, host, key, challenge string, scope []string) error {
+	scheme, params := parseChallenge(challenge)
+	cred, hasCred := c.auth[host]
+	switch scheme {
+	case "basic":
+		if !hasCred {
+			return fmt.Errorf("%w: %s requires credentials", ErrUnauthorized, host)
+		}
+		c.mu.Lock()
+		c.tokens[key] = ""
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("%w: %s: unsupported challenge %q", ErrUnauthorized, host, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("%w: %s: bad token realm %q", ErrUnauthorized, host, params["realm"])
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	for _, s := range scope {
+		q.Add("scope", s)
+	}
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if hasCred {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: token endpoint returned %s", ErrUnauthorized, host, resp.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return fmt.Errorf("fetch token: %w", err)
+	}
+	tok := tr.Token
+	if tok == "" {
+		tok = tr.AccessToken
+	}
+	if tok == "" {
+		return fmt.Errorf("%w: %s: empty token", ErrUnauthorized, host)
+	}
+	c.mu.Lock()
+	c.tokens[key] = tok
+	c.mu.Unlock()
+	return nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its lowercased scheme
+// and parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params := make(map[string]string)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		k, v, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(v, `"`) {
+			end := strings.IndexByte(v[1:], '"')
+			if end < 0 {
+				break
+			}
+			params[strings.ToLower(strings.TrimSpace(k))] = v[1 : end+1]
+			rest = v[end+2:]
+			continue
+		}
+		val, next, _ := strings.Cut(v, ",")
+		params[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(val)
+		rest = next
+	}
+	return strings.ToLower(scheme), params
+}
+
+// url returns the API URL for kind ("blobs" or "manifests") and name in
+// target's repository.
+func (c *Client) url(target Reference, kind, name string) string {
+	return c.base(target.Registry) + "/v2/" + target.Repository + "/" + kind + "/" + name
+}
+
+func (c *Client) base(host string) string {
+	if slices.Contains(c.insecure, host) {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// resolve resolves an upload Location header, which may be relative.
+func (c *Client) resolve(target Reference, loc string) (*url.URL, error) {
+	if loc == "" {
+		return nil, errors.New("registry returned no upload location")
+	}
+	base, err := url.Parse(c.base(target.Registry) + "/")
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(ref), nil
+}
+
+// findManifest returns the manifest named ref in the layout index, or the
+// only manifest when ref is empty.
+func findManifest(layoutDir, ref string) (Descriptor, error) {
+	idx, err := ReadIndex(layoutDir)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if ref == "" {
+		if len(idx.Manifests) != 1 {
+			return Descriptor{}, fmt.Errorf("%w: layout has %d images, name one", ErrManifestNotFound, len(idx.Manifests))
+		}
+		return idx.Manifests[0], nil
+	}
+	for _, m := range idx.Manifests {
+		if m.Annotations[AnnotationRefName] == ref {
+			return m, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("%w: %q", ErrManifestNotFound, ref)
+}
+
+// registryError describes an unexpected registry response.
+func registryError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var e struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &e) == nil && len(e.Errors) > 0 {
+		return fmt.Errorf("registry returned %s: %s: %s", resp.Status, e.Errors[0].Code, e.Errors[0].Message)
+	}
+	return fmt.Errorf("registry returned %s", resp.Status)
+}
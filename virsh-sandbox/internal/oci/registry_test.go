@@ -0,0 +1,194 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is a minimal registry:2 stand-in: blobs and manifests per
+// repository, monolithic uploads, cross-repository mounts and bearer tokens
+// issued to one user.
+type testRegistry struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte // repo + "@" + digest
+	manifests map[string][]byte // repo + ":" + tag
+	uploads   int
+	mounts    int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	reg := &testRegistry{t: t, blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+	reg.srv = httptest.NewServer(http.HandlerFunc(reg.serve))
+	t.Cleanup(reg.srv.Close)
+	return reg
+}
+
+func (reg *testRegistry) host() string { return strings.TrimPrefix(reg.srv.URL, "http://") }
+
+func (reg *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if u, p, ok := r.BasicAuth(); !ok || u != "alice" || p != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "tok-" + strings.Join(r.URL.Query()["scope"], "+")})
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer tok-repository:") {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, reg.srv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.HasSuffix(p, "/blobs/uploads/") && r.Method == http.MethodPost:
+		repo := strings.TrimSuffix(p, "/blobs/uploads/")
+		if d, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from"); d != "" {
+			if b, ok := reg.blobs[from+"@"+d]; ok {
+				reg.blobs[repo+"@"+d] = b
+				reg.mounts++
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/u1?state=x")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(p, "/blobs/uploads/") && r.Method == http.MethodPut:
+		repo, _, _ := strings.Cut(p, "/blobs/uploads/")
+		body, _ := io.ReadAll(r.Body)
+		d := r.URL.Query().Get("digest")
+		if r.URL.Query().Get("state") != "x" || digestOf(body) != d {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.blobs[repo+"@"+d] = body
+		reg.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(p, "/blobs/") && r.Method == http.MethodHead:
+		repo, d, _ := strings.Cut(p, "/blobs/")
+		if _, ok := reg.blobs[repo+"@"+d]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(p, "/manifests/") && r.Method == http.MethodPut:
+		repo, tag, _ := strings.Cut(p, "/manifests/")
+		body, _ := io.ReadAll(r.Body)
+		var m Manifest
+		if err := json.Unmarshal(body, &m); err != nil || r.Header.Get("Content-Type") != MediaTypeManifest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, d := range append([]Descriptor{m.Config}, m.Layers...) {
+			if _, ok := reg.blobs[repo+"@"+d.Digest]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":[{"code":"MANIFEST_BLOB_UNKNOWN","message":"blob unknown"}]}`))
+				return
+			}
+		}
+		reg.manifests[repo+":"+tag] = body
+		w.Header().Set("Docker-Content-Digest", digestOf(body))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushToRegistry(t *testing.T) {
+	reg := newTestRegistry(t)
+	dir := t.TempDir()
+	img, err := NewWriter(WriterConfig{}).WriteImage(context.Background(), dir, bytes.NewReader(rootfsTar(t)), ImageSpec{Ref: "v1"})
+	if err != nil {
+		t.Fatalf("WriteImage: %v", err)
+	}
+
+	anon := NewClient(ClientConfig{InsecureHosts: []string{reg.host()}})
+	target := Reference{Registry: reg.host(), Repository: "team/web1", Tag: "v1"}
+	if _, err := anon.Push(context.Background(), dir, "v1", target, PushOptions{}); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("anonymous push: err = %v, want ErrUnauthorized", err)
+	}
+
+	c := NewClient(ClientConfig{
+		InsecureHosts: []string{reg.host()},
+		Auth:          map[string]Credentials{reg.host(): {Username: "alice", Password: "s3cret"}},
+	})
+	res, err := c.Push(context.Background(), dir, "v1", target, PushOptions{})
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if res.Digest != img.Manifest.Digest || res.Uploaded != 2 || res.Reference != reg.host()+"/team/web1:v1" {
+		t.Errorf("result = %+v, want 2 uploads of %s", res, img.Manifest.Digest)
+	}
+	if _, ok := reg.manifests["team/web1:v1"]; !ok {
+		t.Errorf("manifest not stored: %v", reg.manifests)
+	}
+
+	// Pushing again finds every blob; pushing to another repository mounts them.
+	if res, err = c.Push(context.Background(), dir, "", Reference{Registry: reg.host(), Repository: "team/web1", Tag: "latest"}, PushOptions{}); err != nil || res.Existing != 2 || res.Uploaded != 0 {
+		t.Errorf("second push = %+v, %v; want 2 existing blobs", res, err)
+	}
+	res, err = c.Push(context.Background(), dir, "v1", Reference{Registry: reg.host(), Repository: "team/web2", Tag: "v1"}, PushOptions{MountFrom: "team/web1"})
+	if err != nil || res.Mounted != 2 || reg.uploads != 2 {
+		t.Errorf("mounted push = %+v, %v (uploads %d); want 2 mounts", res, err, reg.uploads)
+	}
+
+	if _, err := c.Push(context.Background(), dir, "nope", target, PushOptions{}); !errors.Is(err, ErrManifestNotFound) {
+		t.Errorf("unknown ref: err = %v, want ErrManifestNotFound", err)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Reference
+		ok   bool
+	}{
+		{"registry.example.com/team/web1:v1", Reference{"registry.example.com", "team/web1", "v1"}, true},
+		{"localhost:5000/web1", Reference{"localhost:5000", "web1", ""}, true},
+		{"localhost/web1:latest", Reference{"localhost", "web1", "latest"}, true},
+		{"team/web1:v1", Reference{}, false},
+		{"registry.example.com/Team/web1", Reference{}, false},
+		{"registry.example.com/web1@sha256:abc", Reference{}, false},
+		{"registry.example.com/web1:bad/tag", Reference{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseReference(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseReference(%q) = %+v, %v", tt.in, got, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("ParseReference(%q): err = %v, want ErrInvalidReference", tt.in, err)
+		}
+	}
+}
+
+func TestLoadAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(path, []byte(`{"auths":{"https://registry.example.com/v1/":{"auth":"YWxpY2U6czNjcmV0"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile: %v", err)
+	}
+	if got := auth["registry.example.com"]; got.Username != "alice" || got.Password != "s3cret" {
+		t.Errorf("auth = %+v", auth)
+	}
+}
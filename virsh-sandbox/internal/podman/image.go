@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -45,16 +46,36 @@ type ImageResult struct {
 	// ImageTag is the human-readable image tag (e.g., "vmclone/node-c:20251215T183000Z").
 	ImageTag string
 
+	// LayoutPath is the OCI layout the image was written to, LayoutRef its
+	// name in the layout index and Digest its manifest digest. All are empty
+	// for images built with podman build.
+	LayoutPath string
+	LayoutRef  string
+	Digest     string
+
+	// Layers counts the layers of an image written as an OCI layout.
+	Layers int
+
 	// Cleanup is a function to remove the image.
 	Cleanup workflow.CleanupFunc
 }
 
 // BuildImage builds a Podman image from a root filesystem archive.
-// The image is tagged as vmclone/<vmName>:<UTC timestamp>.
-func (b *ImageBuilder) BuildImage(ctx context.Context, archivePath string, vmName string, workDir string) (*ImageResult, error) {
+// The image is tagged as vmclone/<vmName>:<UTC timestamp>. WithLayout and
+// WithBase are not supported: podman build cannot apply whiteouts.
+func (b *ImageBuilder) BuildImage(ctx context.Context, archivePath string, vmName string, workDir string, opts ...BuildOption) (*ImageResult, error) {
 	// Generate image tag with timestamp
-	timestamp := time.Now().UTC().Format("20060102T150405Z")
+	now := time.Now().UTC()
+	timestamp := now.Format("20060102T150405Z")
 	imageTag := fmt.Sprintf("vmclone/%s:%s", vmName, timestamp)
+	o := resolveBuildOptions(vmName, now, opts)
+	if o.layoutDir != "" || o.base != "" {
+		return nil, workflow.NewWorkflowError(
+			workflow.StageBuildImage,
+			workflow.ErrImageBuildFailed,
+			"layered builds need the oci image builder",
+		)
+	}
 
 	// Create a temporary directory for the build context
 	buildDir := filepath.Join(workDir, "build")
@@ -95,7 +116,7 @@ func (b *ImageBuilder) BuildImage(ctx context.Context, archivePath string, vmNam
 	}
 
 	// Build the image
-	imageID, err := b.buildImage(ctx, buildDir, imageTag)
+	imageID, err := b.buildImage(ctx, buildDir, imageTag, o.labels)
 	if err != nil {
 		return nil, workflow.NewWorkflowError(
 			workflow.StageBuildImage,
@@ -132,15 +153,23 @@ CMD ["/bin/sh"]
 }
 
 // buildImage executes podman build and returns the image ID.
-func (b *ImageBuilder) buildImage(ctx context.Context, buildDir string, imageTag string) (string, error) {
+func (b *ImageBuilder) buildImage(ctx context.Context, buildDir string, imageTag string, labels map[string]string) (string, error) {
 	args := []string{
 		"build",
 		"--tag", imageTag,
 		"--file", "Containerfile",
 		"--format", "oci",
 		"--quiet",
-		buildDir,
 	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	args = append(args, buildDir)
 
 	cmd := exec.CommandContext(ctx, b.podmanPath, args...)
 	var stdout, stderr bytes.Buffer
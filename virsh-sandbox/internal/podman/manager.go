@@ -0,0 +1,525 @@
+package podman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"virsh-sandbox/internal/libvirt"
+)
+
+// ErrUnsupported is returned for Manager operations that have no container
+// equivalent, such as catalog images, disk sizing and disk flattening.
+var ErrUnsupported = errors.New("not supported by the container runtime")
+
+// snapshotTagRe matches snapshot names usable as an image tag.
+var snapshotTagRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// Manager runs sandboxes as Podman containers. It implements libvirt.Manager
+// so vm.Service drives containers and VMs through the same calls: "VM" names
+// are container names, source VMs are image references, internal snapshots
+// are images made with podman commit and external snapshots are CRIU
+// checkpoint archives.
+type Manager struct {
+	runner     *ContainerRunner
+	podmanPath string
+	cfg        ManagerConfig
+}
+
+var _ libvirt.Manager = (*Manager)(nil)
+
+// ManagerConfig configures the container-backed Manager.
+type ManagerConfig struct {
+	// PodmanPath is the path to the podman binary.
+	// If empty, "podman" is looked up in PATH.
+	PodmanPath string
+
+	// WorkDir holds per-container state: the create spec used to recreate a
+	// container on revert and exported checkpoint archives.
+	WorkDir string
+
+	// Network is the Podman network containers join. Empty uses Podman's
+	// default; libvirt network names passed by callers are ignored.
+	Network string
+
+	// SnapshotRepo is the image repository committed snapshots are tagged
+	// into as <SnapshotRepo>/<container>:<snapshot>.
+	// Defaults to "localhost/sandbox-snapshots".
+	SnapshotRepo string
+}
+
+// NewManager creates a container-backed Manager with the given configuration.
+func NewManager(cfg ManagerConfig) *Manager {
+	podmanPath := cfg.PodmanPath
+	if podmanPath == "" {
+		podmanPath = "podman"
+	}
+	if cfg.WorkDir == "" {
+		cfg.WorkDir = "/var/lib/virsh-sandbox/containers"
+	}
+	if cfg.SnapshotRepo == "" {
+		cfg.SnapshotRepo = "localhost/sandbox-snapshots"
+	}
+	return &Manager{
+		runner:     NewContainerRunner(ContainerRunnerConfig{PodmanPath: podmanPath}),
+		podmanPath: podmanPath,
+		cfg:        cfg,
+	}
+}
+
+// containerSpec is the create request persisted for a container so it can be
+// recreated from a snapshot image with the same shape and mounts.
+type containerSpec struct {
+	Image     string              `json:"image"`
+	CPU       int                 `json:"cpu"`
+	MemoryMB  int                 `json:"memory_mb"`
+	Hostname  string              `json:"hostname,omitempty"`
+	Mounts    []libvirt.SharedDir `json:"mounts,omitempty"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// CloneVM is not supported: catalog images are qcow2 disks, not container images.
+func (m *Manager) CloneVM(ctx context.Context, baseImage, newVMName string, cpu, memoryMB int, network string, opts ...libvirt.CloneOption) (libvirt.DomainRef, error) {
+	return libvirt.DomainRef{}, fmt.Errorf("clone from base image %s: %w", baseImage, ErrUnsupported)
+}
+
+// CloneFromVM creates (but does not start) a container named newVMName from
+// the image reference sourceVMName.
+func (m *Manager) CloneFromVM(ctx context.Context, sourceVMName, newVMName string, cpu, memoryMB int, network string, opts ...libvirt.CloneOption) (libvirt.DomainRef, error) {
+	return m.create(ctx, sourceVMName, newVMName, cpu, memoryMB, opts)
+}
+
+// CloneFromDisk creates a container from diskPath, which for this runtime is
+// the snapshot image reference returned by ExportSnapshot.
+func (m *Manager) CloneFromDisk(ctx context.Context, diskPath, newVMName string, cpu, memoryMB int, network string, opts ...libvirt.CloneOption) (libvirt.DomainRef, error) {
+	return m.create(ctx, diskPath, newVMName, cpu, memoryMB, opts)
+}
+
+// create validates the clone options, creates the container and records its spec.
+func (m *Manager) create(ctx context.Context, image, name string, cpu, memoryMB int, opts []libvirt.CloneOption) (libvirt.DomainRef, error) {
+	if image == "" || name == "" {
+		return libvirt.DomainRef{}, fmt.Errorf("image and container name are required")
+	}
+	var co libvirt.CloneOptions
+	for _, o := range opts {
+		o(&co)
+	}
+	if co.RootDiskGB > 0 || len(co.ScratchDisksGB) > 0 {
+		return libvirt.DomainRef{}, fmt.Errorf("disk sizing: %w", ErrUnsupported)
+	}
+	spec := containerSpec{
+		Image:     image,
+		CPU:       cpu,
+		MemoryMB:  memoryMB,
+		Hostname:  co.Hostname,
+		Mounts:    co.SharedDirs,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := os.MkdirAll(m.containerDir(name), 0o755); err != nil {
+		return libvirt.DomainRef{}, fmt.Errorf("create container dir: %w", err)
+	}
+	id, err := m.createContainer(ctx, name, spec)
+	if err != nil {
+		_ = os.RemoveAll(m.containerDir(name))
+		return libvirt.DomainRef{}, err
+	}
+	if err := m.writeSpec(name, spec); err != nil {
+		_ = m.runner.RemoveContainer(ctx, name, true)
+		_ = os.RemoveAll(m.containerDir(name))
+		return libvirt.DomainRef{}, err
+	}
+	return libvirt.DomainRef{Name: name, UUID: id}, nil
+}
+
+// createContainer runs podman create for spec and returns the container ID.
+// The container runs an interactive shell so it stays up between execs.
+func (m *Manager) createContainer(ctx context.Context, name string, spec containerSpec) (string, error) {
+	hostname := spec.Hostname
+	if hostname == "" {
+		hostname = name
+	}
+	args := []string{
+		"create",
+		"--name", name,
+		"--hostname", hostname,
+		"--label", "virsh-sandbox.sandbox=" + name,
+		"--tty",
+		"--interactive",
+	}
+	if spec.CPU > 0 {
+		args = append(args, "--cpus", fmt.Sprintf("%d", spec.CPU))
+	}
+	if spec.MemoryMB > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%dm", spec.MemoryMB))
+	}
+	if m.cfg.Network != "" {
+		args = append(args, "--network", m.cfg.Network)
+	}
+	for _, d := range spec.Mounts {
+		guest := d.GuestPath
+		if guest == "" {
+			guest = "/mnt/" + d.Tag
+		}
+		vol := d.HostPath + ":" + guest
+		if d.ReadOnly {
+			vol += ":ro"
+		}
+		args = append(args, "--volume", vol)
+	}
+	args = append(args, spec.Image, "/bin/sh")
+
+	out, err := m.podman(ctx, args...)
+	if err != nil {
+		return "", fmt.Errorf("create container: %w", err)
+	}
+	return out, nil
+}
+
+// InjectSSHKey is a no-op: commands reach containers through podman exec.
+func (m *Manager) InjectSSHKey(ctx context.Context, sandboxName, username, publicKey string, opts ...libvirt.InjectOption) error {
+	return nil
+}
+
+// StartVM starts the container, restoring it instead if HibernateVM left a
+// checkpoint.
+func (m *Manager) StartVM(ctx context.Context, vmName string) error {
+	checkpointed, err := m.inspectField(ctx, vmName, "{{.State.Checkpointed}}")
+	if err != nil {
+		return err
+	}
+	if checkpointed == "true" {
+		if _, err := m.podman(ctx, "container", "restore", vmName); err != nil {
+			return fmt.Errorf("restore container: %w", err)
+		}
+		return nil
+	}
+	return m.runner.StartContainer(ctx, vmName)
+}
+
+// StopVM stops the container, killing it immediately if force is true.
+func (m *Manager) StopVM(ctx context.Context, vmName string, force bool) error {
+	timeout := 10
+	if force {
+		timeout = 0
+	}
+	return m.runner.StopContainer(ctx, vmName, timeout)
+}
+
+// SuspendVM freezes the container's processes with podman pause.
+func (m *Manager) SuspendVM(ctx context.Context, vmName string) error {
+	if _, err := m.podman(ctx, "pause", vmName); err != nil {
+		return fmt.Errorf("pause container: %w", err)
+	}
+	return nil
+}
+
+// ResumeVM thaws a container frozen by SuspendVM.
+func (m *Manager) ResumeVM(ctx context.Context, vmName string) error {
+	if _, err := m.podman(ctx, "unpause", vmName); err != nil {
+		return fmt.Errorf("unpause container: %w", err)
+	}
+	return nil
+}
+
+// HibernateVM checkpoints the container's process state to disk with CRIU
+// and stops it. StartVM restores the checkpoint.
+func (m *Manager) HibernateVM(ctx context.Context, vmName string) error {
+	status, err := m.inspectField(ctx, vmName, "{{.State.Status}}")
+	if err != nil {
+		return err
+	}
+	if status == "paused" {
+		if err := m.ResumeVM(ctx, vmName); err != nil {
+			return err
+		}
+	}
+	if _, err := m.podman(ctx, "container", "checkpoint", vmName); err != nil {
+		return fmt.Errorf("checkpoint container: %w", err)
+	}
+	return nil
+}
+
+// DestroyVM removes the container, its snapshot images and its work dir.
+func (m *Manager) DestroyVM(ctx context.Context, vmName string) error {
+	if _, err := m.podman(ctx, "rm", "--force", "--ignore", vmName); err != nil {
+		return fmt.Errorf("remove container: %w", err)
+	}
+	out, err := m.podman(ctx, "images", "--quiet", "--filter", "reference="+m.snapshotRepo(vmName))
+	if err != nil {
+		return fmt.Errorf("list snapshot images: %w", err)
+	}
+	if ids := strings.Fields(out); len(ids) > 0 {
+		if _, err := m.podman(ctx, append([]string{"rmi", "--force"}, ids...)...); err != nil {
+			return fmt.Errorf("remove snapshot images: %w", err)
+		}
+	}
+	if err := os.RemoveAll(m.containerDir(vmName)); err != nil {
+		return fmt.Errorf("remove container dir: %w", err)
+	}
+	return nil
+}
+
+// CreateSnapshot commits the container's filesystem to an image, or with
+// external set exports a checkpoint of the running container (processes and
+// filesystem) to an archive in its work dir; the container keeps running.
+func (m *Manager) CreateSnapshot(ctx context.Context, vmName, snapshotName string, external bool) (libvirt.SnapshotRef, error) {
+	if !snapshotTagRe.MatchString(snapshotName) {
+		return libvirt.SnapshotRef{}, fmt.Errorf("snapshot name %q must be a valid image tag", snapshotName)
+	}
+	if external {
+		archive := m.checkpointArchive(vmName, snapshotName)
+		if fileExists(archive) {
+			return libvirt.SnapshotRef{}, fmt.Errorf("snapshot %s already exists", snapshotName)
+		}
+		if _, err := m.podman(ctx, "container", "checkpoint", "--leave-running", "--export", archive, vmName); err != nil {
+			return libvirt.SnapshotRef{}, fmt.Errorf("checkpoint container: %w", err)
+		}
+		return libvirt.SnapshotRef{Name: snapshotName, Kind: "EXTERNAL", Ref: archive}, nil
+	}
+	ref := m.snapshotImage(vmName, snapshotName)
+	if _, err := m.podman(ctx, "commit", vmName, ref); err != nil {
+		return libvirt.SnapshotRef{}, fmt.Errorf("commit container: %w", err)
+	}
+	return libvirt.SnapshotRef{Name: snapshotName, Kind: "INTERNAL", Ref: ref}, nil
+}
+
+// RevertSnapshot replaces the container with one restored from a checkpoint
+// archive (which resumes running) or created from a committed snapshot image
+// with the original shape and mounts (started if the old one was running).
+func (m *Manager) RevertSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	if archive := m.checkpointArchive(vmName, snapshotName); fileExists(archive) {
+		if _, err := m.podman(ctx, "rm", "--force", vmName); err != nil {
+			return fmt.Errorf("remove container: %w", err)
+		}
+		if _, err := m.podman(ctx, "container", "restore", "--import", archive, "--name", vmName); err != nil {
+			return fmt.Errorf("restore checkpoint: %w", err)
+		}
+		return nil
+	}
+
+	ref := m.snapshotImage(vmName, snapshotName)
+	if _, err := m.podman(ctx, "image", "exists", ref); err != nil {
+		return fmt.Errorf("snapshot %s not found: %w", snapshotName, err)
+	}
+	spec, err := m.readSpec(vmName)
+	if err != nil {
+		return err
+	}
+	info, err := m.runner.InspectContainer(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	if err := m.runner.RemoveContainer(ctx, vmName, true); err != nil {
+		return err
+	}
+	spec.Image = ref
+	if _, err := m.createContainer(ctx, vmName, spec); err != nil {
+		return err
+	}
+	if info.Running {
+		return m.runner.StartContainer(ctx, vmName)
+	}
+	return nil
+}
+
+// ExportSnapshot returns the image reference of a committed snapshot, which
+// CloneFromDisk accepts. The image is removed with the container by DestroyVM.
+func (m *Manager) ExportSnapshot(ctx context.Context, vmName, snapshotName string) (string, error) {
+	ref := m.snapshotImage(vmName, snapshotName)
+	if _, err := m.podman(ctx, "image", "exists", ref); err != nil {
+		return "", fmt.Errorf("snapshot %s not found: %w", snapshotName, err)
+	}
+	return ref, nil
+}
+
+// FlattenDisk is not supported: containers have no disk to flatten.
+func (m *Manager) FlattenDisk(ctx context.Context, vmName, snapshotName, filename string, sanitize bool) (libvirt.DiskImage, error) {
+	return libvirt.DiskImage{}, fmt.Errorf("flatten disk: %w", ErrUnsupported)
+}
+
+// DefineVM is not supported: containers are created from images, not disks.
+func (m *Manager) DefineVM(ctx context.Context, vmName, diskPath string, cpu, memoryMB int, network string) (libvirt.DomainRef, error) {
+	return libvirt.DomainRef{}, fmt.Errorf("define vm: %w", ErrUnsupported)
+}
+
+// DomainExists reports whether a container named vmName exists.
+func (m *Manager) DomainExists(ctx context.Context, vmName string) (bool, error) {
+	_, err := m.podman(ctx, "container", "exists", vmName)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DiffSnapshot returns the two snapshot images with instructions for
+// comparing them; nothing is mounted.
+func (m *Manager) DiffSnapshot(ctx context.Context, vmName, fromSnapshot, toSnapshot string) (*libvirt.FSComparePlan, error) {
+	from, to := m.snapshotImage(vmName, fromSnapshot), m.snapshotImage(vmName, toSnapshot)
+	return &libvirt.FSComparePlan{
+		VMName:       vmName,
+		FromSnapshot: fromSnapshot,
+		ToSnapshot:   toSnapshot,
+		FromRef:      from,
+		ToRef:        to,
+		Notes: []string{
+			fmt.Sprintf("podman image mount %s %s", from, to),
+			"compare the two mount points, then: podman image unmount " + from + " " + to,
+		},
+	}, nil
+}
+
+// SnapshotDisk is not supported: container snapshots are images, not disks.
+func (m *Manager) SnapshotDisk(ctx context.Context, vmName, snapshotName string) (libvirt.DiskState, error) {
+	return libvirt.DiskState{}, fmt.Errorf("snapshot disk: %w", ErrUnsupported)
+}
+
+// SetResources updates the container's CPU and memory limits. Containers have
+// no declared maximums, so the change always applies immediately and live is
+// ignored.
+func (m *Manager) SetResources(ctx context.Context, vmName string, res libvirt.Resources, live bool) error {
+	args := []string{"update"}
+	if res.VCPUs > 0 {
+		args = append(args, "--cpus", fmt.Sprintf("%d", res.VCPUs))
+	}
+	if res.MemoryMB > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%dm", res.MemoryMB))
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	if _, err := m.podman(ctx, append(args, vmName)...); err != nil {
+		return fmt.Errorf("update container: %w", err)
+	}
+	spec, err := m.readSpec(vmName)
+	if err != nil {
+		return err
+	}
+	if res.VCPUs > 0 {
+		spec.CPU = res.VCPUs
+	}
+	if res.MemoryMB > 0 {
+		spec.MemoryMB = res.MemoryMB
+	}
+	return m.writeSpec(vmName, spec)
+}
+
+// GetIPAddress polls the container's network settings for an IPv4 address.
+func (m *Manager) GetIPAddress(ctx context.Context, vmName string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := m.inspectField(ctx, vmName, "{{.NetworkSettings.IPAddress}} {{range .NetworkSettings.Networks}}{{.IPAddress}} {{end}}")
+		if err == nil {
+			if fields := strings.Fields(out); len(fields) > 0 {
+				return fields[0], nil
+			}
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+	return "", errors.New("ip address not found within timeout")
+}
+
+// GuestExec runs argv in the container and waits up to timeout for it to exit.
+func (m *Manager) GuestExec(ctx context.Context, vmName string, argv []string, timeout time.Duration) (string, int, error) {
+	if len(argv) == 0 {
+		return "", 0, fmt.Errorf("argv is required")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stdout, _, code, err := m.runner.ExecInContainer(ctx, vmName, argv)
+	return stdout, code, err
+}
+
+// ExecCommand runs command through /bin/sh -c in the container with env set,
+// waiting up to timeout. It is the container counterpart of running a
+// command over SSH.
+func (m *Manager) ExecCommand(ctx context.Context, vmName, command string, env map[string]string, timeout time.Duration) (string, string, int, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return m.runner.ExecInContainer(ctx, vmName, []string{"/bin/sh", "-c", command}, WithExecEnv(env))
+}
+
+// Helpers
+
+// podman runs the podman binary and returns its trimmed stdout.
+func (m *Manager) podman(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, m.podmanPath, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("podman %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// inspectField returns a Go-template field of the container's inspect output.
+func (m *Manager) inspectField(ctx context.Context, name, format string) (string, error) {
+	out, err := m.podman(ctx, "container", "inspect", "--format", format, name)
+	if err != nil {
+		return "", fmt.Errorf("inspect container: %w", err)
+	}
+	return out, nil
+}
+
+func (m *Manager) containerDir(name string) string {
+	return filepath.Join(m.cfg.WorkDir, name)
+}
+
+func (m *Manager) checkpointArchive(name, snapshotName string) string {
+	return filepath.Join(m.containerDir(name), "checkpoint-"+snapshotName+".tar.gz")
+}
+
+func (m *Manager) snapshotRepo(name string) string {
+	return m.cfg.SnapshotRepo + "/" + strings.ToLower(name)
+}
+
+func (m *Manager) snapshotImage(name, snapshotName string) string {
+	return m.snapshotRepo(name) + ":" + snapshotName
+}
+
+func (m *Manager) writeSpec(name string, spec containerSpec) error {
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal container spec: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.containerDir(name), "container.json"), b, 0o644); err != nil {
+		return fmt.Errorf("write container spec: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) readSpec(name string) (containerSpec, error) {
+	var spec containerSpec
+	b, err := os.ReadFile(filepath.Join(m.containerDir(name), "container.json"))
+	if err != nil {
+		return spec, fmt.Errorf("read container spec: %w", err)
+	}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return spec, fmt.Errorf("parse container spec: %w", err)
+	}
+	return spec, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,255 @@
+package podman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"virsh-sandbox/internal/libvirt"
+)
+
+// fakePodmanScript logs each invocation to calls.log next to itself and
+// answers from files there: status and checkpointed for container inspect
+// fields, inspect.json for inspect --format json and images for image
+// listings. A file fail-<subcommand> makes that subcommand fail.
+const fakePodmanScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/calls.log"
+if [ -f "$dir/fail-$1" ]; then echo "$1 failed" >&2; exit 125; fi
+case "$1 $2" in
+"create "*) echo c0ffee ;;
+"container inspect")
+	case "$4" in
+	*Checkpointed*) cat "$dir/checkpointed" 2>/dev/null || echo false ;;
+	*) cat "$dir/status" 2>/dev/null || echo running ;;
+	esac ;;
+"inspect --format") cat "$dir/inspect.json" ;;
+"images "*) cat "$dir/images" 2>/dev/null ;;
+esac
+exit 0
+`
+
+// fakePodman is a Manager backed by fakePodmanScript.
+type fakePodman struct {
+	*Manager
+	dir string
+}
+
+func newFakePodman(t *testing.T) *fakePodman {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "podman")
+	if err := os.WriteFile(bin, []byte(fakePodmanScript), 0o755); err != nil {
+		t.Fatalf("write fake podman: %v", err)
+	}
+	return &fakePodman{Manager: NewManager(ManagerConfig{PodmanPath: bin, WorkDir: t.TempDir()}), dir: dir}
+}
+
+// set writes a response file for the fake binary.
+func (f *fakePodman) set(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// calls returns the logged invocations and clears the log.
+func (f *fakePodman) calls(t *testing.T) []string {
+	t.Helper()
+	path := filepath.Join(f.dir, "calls.log")
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	_ = os.Remove(path)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestCreatePersistsSpec(t *testing.T) {
+	f := newFakePodman(t)
+	ctx := context.Background()
+	mounts := []libvirt.SharedDir{
+		{HostPath: "/srv/src", Tag: "src", GuestPath: "/work", ReadOnly: true},
+		{HostPath: "/srv/out", Tag: "out"},
+	}
+
+	ref, err := f.CloneFromVM(ctx, "docker.io/library/alpine:3", "sbx-1", 2, 512, "default",
+		libvirt.WithHostname("box"), libvirt.WithSharedDirs(mounts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name != "sbx-1" || ref.UUID != "c0ffee" {
+		t.Errorf("ref = %+v", ref)
+	}
+	want := "create --name sbx-1 --hostname box --label virsh-sandbox.sandbox=sbx-1 --tty --interactive --cpus 2 --memory 512m " +
+		"--volume /srv/src:/work:ro --volume /srv/out:/mnt/out docker.io/library/alpine:3 /bin/sh"
+	if got := f.calls(t); !slices.Equal(got, []string{want}) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+	spec, err := f.readSpec("sbx-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Image != "docker.io/library/alpine:3" || spec.CPU != 2 || spec.MemoryMB != 512 || spec.Hostname != "box" || !slices.Equal(spec.Mounts, mounts) {
+		t.Errorf("spec = %+v", spec)
+	}
+
+	if _, err := f.CloneFromVM(ctx, "alpine", "sbx-2", 1, 256, "", libvirt.WithScratchDisks(10)); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("scratch disks: err = %v, want ErrUnsupported", err)
+	}
+	if got := f.calls(t); got[0] != "" {
+		t.Errorf("unsupported options reached podman: %q", got)
+	}
+
+	f.set(t, "fail-create", "")
+	if _, err := f.CloneFromVM(ctx, "alpine", "sbx-3", 1, 256, ""); err == nil {
+		t.Fatal("create failure not reported")
+	}
+	if _, err := os.Stat(f.containerDir("sbx-3")); !os.IsNotExist(err) {
+		t.Errorf("container dir left behind after a failed create: %v", err)
+	}
+}
+
+func TestRevertSnapshotRecreatesFromImage(t *testing.T) {
+	ctx := context.Background()
+	for _, running := range []bool{true, false} {
+		f := newFakePodman(t)
+		if _, err := f.CloneFromVM(ctx, "alpine", "sbx-1", 2, 512, "", libvirt.WithHostname("box")); err != nil {
+			t.Fatal(err)
+		}
+		f.calls(t)
+		info, _ := json.Marshal([]map[string]any{{"Id": "c0ffee", "Name": "sbx-1", "State": map[string]any{"Running": running}}})
+		f.set(t, "inspect.json", string(info))
+
+		if err := f.RevertSnapshot(ctx, "sbx-1", "before"); err != nil {
+			t.Fatalf("running=%v: %v", running, err)
+		}
+		ref := "localhost/sandbox-snapshots/sbx-1:before"
+		want := []string{
+			"image exists " + ref,
+			"inspect --format json sbx-1",
+			"rm --force sbx-1",
+			"create --name sbx-1 --hostname box --label virsh-sandbox.sandbox=sbx-1 --tty --interactive --cpus 2 --memory 512m " + ref + " /bin/sh",
+		}
+		if running {
+			want = append(want, "start sbx-1")
+		}
+		if got := f.calls(t); !slices.Equal(got, want) {
+			t.Errorf("running=%v: calls = %q, want %q", running, got, want)
+		}
+	}
+
+	// A checkpoint archive is restored instead of an image.
+	f := newFakePodman(t)
+	if _, err := f.CloneFromVM(ctx, "alpine", "sbx-1", 1, 256, ""); err != nil {
+		t.Fatal(err)
+	}
+	f.calls(t)
+	archive := f.checkpointArchive("sbx-1", "live")
+	if err := os.WriteFile(archive, []byte("tar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RevertSnapshot(ctx, "sbx-1", "live"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"rm --force sbx-1", "container restore --import " + archive + " --name sbx-1"}
+	if got := f.calls(t); !slices.Equal(got, want) {
+		t.Errorf("checkpoint revert: calls = %q, want %q", got, want)
+	}
+}
+
+func TestHibernateVM(t *testing.T) {
+	for _, c := range []struct {
+		status string
+		want   []string
+	}{
+		{"running", []string{"container inspect --format {{.State.Status}} sbx-1", "container checkpoint sbx-1"}},
+		{"paused", []string{"container inspect --format {{.State.Status}} sbx-1", "unpause sbx-1", "container checkpoint sbx-1"}},
+	} {
+		f := newFakePodman(t)
+		f.set(t, "status", c.status)
+		if err := f.HibernateVM(context.Background(), "sbx-1"); err != nil {
+			t.Fatalf("%s: %v", c.status, err)
+		}
+		if got := f.calls(t); !slices.Equal(got, c.want) {
+			t.Errorf("%s: calls = %q, want %q", c.status, got, c.want)
+		}
+	}
+}
+
+func TestSetResources(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePodman(t)
+	if _, err := f.CloneFromVM(ctx, "alpine", "sbx-1", 2, 512, ""); err != nil {
+		t.Fatal(err)
+	}
+	f.calls(t)
+
+	cases := []struct {
+		res     libvirt.Resources
+		want    string // podman call; empty for none
+		wantCPU int
+		wantMem int
+	}{
+		{libvirt.Resources{VCPUs: 4, MemoryMB: 1024, MaxVCPUs: 8}, "update --cpus 4 --memory 1024m sbx-1", 4, 1024},
+		{libvirt.Resources{MemoryMB: 2048}, "update --memory 2048m sbx-1", 4, 2048},
+		{libvirt.Resources{}, "", 4, 2048},
+	}
+	for _, c := range cases {
+		if err := f.SetResources(ctx, "sbx-1", c.res, true); err != nil {
+			t.Fatalf("%+v: %v", c.res, err)
+		}
+		if got := f.calls(t); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%+v: calls = %q, want %q", c.res, got, c.want)
+		}
+		spec, _ := f.readSpec("sbx-1")
+		if spec.CPU != c.wantCPU || spec.MemoryMB != c.wantMem {
+			t.Errorf("%+v: spec shape = %d/%d, want %d/%d", c.res, spec.CPU, spec.MemoryMB, c.wantCPU, c.wantMem)
+		}
+	}
+
+	f.set(t, "fail-update", "")
+	if err := f.SetResources(ctx, "sbx-1", libvirt.Resources{VCPUs: 1}, true); err == nil {
+		t.Fatal("update failure not reported")
+	}
+	if spec, _ := f.readSpec("sbx-1"); spec.CPU != 4 {
+		t.Errorf("spec changed to %d vCPUs after a failed update", spec.CPU)
+	}
+}
+
+func TestDestroyVMRemovesSnapshotImages(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		images string
+		rmi    string
+	}{
+		{"1a2b\n3c4d\n", "rmi --force 1a2b 3c4d"},
+		{"", ""},
+	} {
+		f := newFakePodman(t)
+		if _, err := f.CloneFromVM(ctx, "alpine", "Sbx-1", 1, 256, ""); err != nil {
+			t.Fatal(err)
+		}
+		f.calls(t)
+		f.set(t, "images", c.images)
+
+		if err := f.DestroyVM(ctx, "Sbx-1"); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"rm --force --ignore Sbx-1", "images --quiet --filter reference=localhost/sandbox-snapshots/sbx-1"}
+		if c.rmi != "" {
+			want = append(want, c.rmi)
+		}
+		if got := f.calls(t); !slices.Equal(got, want) {
+			t.Errorf("calls = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(f.containerDir("Sbx-1")); !os.IsNotExist(err) {
+			t.Errorf("container dir not removed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package podman
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"virsh-sandbox/internal/oci"
+	"virsh-sandbox/internal/workflow"
+)
+
+// Labels set on every image built from a VM clone.
+const (
+	LabelSourceVM       = "virsh-sandbox.source-vm"
+	LabelExtractionMode = "virsh-sandbox.extraction-mode"
+	LabelCreated        = "org.opencontainers.image.created"
+)
+
+// BuildOption configures a single image build.
+type BuildOption func(*buildOptions)
+
+type buildOptions struct {
+	labels    map[string]string
+	layoutDir string
+	base      string
+}
+
+// WithLabels adds labels to the built image.
+func WithLabels(labels map[string]string) BuildOption {
+	return func(o *buildOptions) {
+		for k, v := range labels {
+			o.labels[k] = v
+		}
+	}
+}
+
+// WithLayout makes the OCI builder write into layoutDir, which is kept,
+// instead of an OCI layout under the work directory.
+func WithLayout(layoutDir string) BuildOption {
+	return func(o *buildOptions) { o.layoutDir = layoutDir }
+}
+
+// WithBase makes the OCI builder add the archive as a layer on top of the
+// image named ref in the layout set by WithLayout, instead of building a
+// single-layer image. The archive then holds only the changes, with OCI
+// whiteouts for deletions.
+func WithBase(ref string) BuildOption {
+	return func(o *buildOptions) { o.base = ref }
+}
+
+// resolveBuildOptions applies opts to the defaults for an image of vmName
+// created at created.
+func resolveBuildOptions(vmName string, created time.Time, opts []BuildOption) buildOptions {
+	o := buildOptions{labels: map[string]string{
+		LabelSourceVM: vmName,
+		LabelCreated:  created.Format(time.RFC3339),
+	}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// OCIImageBuilder builds clone images without `podman build`: it writes the
+// rootfs archive straight into an OCI layout as one compressed layer, then
+// loads the layout into local storage with `podman pull oci:`. The archive is
+// read once and never copied into a build context.
+type OCIImageBuilder struct {
+	podmanPath string
+	writer     *oci.Writer
+}
+
+// OCIImageBuilderConfig configures the OCI image builder.
+type OCIImageBuilderConfig struct {
+	// PodmanPath is the path to the podman binary.
+	// If empty, "podman" is looked up in PATH.
+	PodmanPath string
+
+	// Compression of the layer blob (default gzip).
+	Compression oci.Compression
+
+	// ZstdPath is the zstd binary used for zstd layers.
+	ZstdPath string
+}
+
+// NewOCIImageBuilder creates a new OCIImageBuilder with the given configuration.
+func NewOCIImageBuilder(cfg OCIImageBuilderConfig) *OCIImageBuilder {
+	podmanPath := cfg.PodmanPath
+	if podmanPath == "" {
+		podmanPath = "podman"
+	}
+	return &OCIImageBuilder{
+		podmanPath: podmanPath,
+		writer:     oci.NewWriter(oci.WriterConfig{Compression: cfg.Compression, ZstdPath: cfg.ZstdPath}),
+	}
+}
+
+// BuildImage writes archivePath into an OCI layout under workDir (or the one
+// set by WithLayout) and loads it as vmclone/<vmName>:<UTC timestamp>. The
+// layout is left in place (see ImageResult.LayoutPath).
+func (b *OCIImageBuilder) BuildImage(ctx context.Context, archivePath string, vmName string, workDir string, opts ...BuildOption) (*ImageResult, error) {
+	now := time.Now().UTC()
+	timestamp := now.Format("20060102T150405Z")
+	imageTag := fmt.Sprintf("vmclone/%s:%s", vmName, timestamp)
+	o := resolveBuildOptions(vmName, now, opts)
+	layoutDir := o.layoutDir
+	if layoutDir == "" {
+		layoutDir = filepath.Join(workDir, "oci")
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, workflow.NewWorkflowError(
+			workflow.StageBuildImage,
+			workflow.ErrImageBuildFailed,
+			fmt.Sprintf("failed to open archive: %v", err),
+		)
+	}
+	defer f.Close()
+
+	img, err := b.writer.WriteImage(ctx, layoutDir, f, oci.ImageSpec{
+		Ref:       timestamp,
+		Env:       []string{"container=podman"},
+		Cmd:       []string{"/bin/sh"},
+		Labels:    o.labels,
+		Created:   now,
+		CreatedBy: "virsh-sandbox clone of " + vmName,
+		Base:      o.base,
+	})
+	if err != nil {
+		return nil, workflow.NewWorkflowError(
+			workflow.StageBuildImage,
+			workflow.ErrImageBuildFailed,
+			fmt.Sprintf("failed to write OCI layout: %v", err),
+		)
+	}
+
+	imageID, err := b.load(ctx, layoutDir, img.Ref, imageTag)
+	if err != nil {
+		return nil, workflow.NewWorkflowError(
+			workflow.StageBuildImage,
+			workflow.ErrImageBuildFailed,
+			fmt.Sprintf("podman load failed: %v", err),
+		)
+	}
+
+	return &ImageResult{
+		ImageID:    imageID,
+		ImageTag:   imageTag,
+		LayoutPath: layoutDir,
+		LayoutRef:  img.Ref,
+		Digest:     img.Manifest.Digest,
+		Layers:     img.Layers,
+		Cleanup: func() error {
+			return b.RemoveImage(context.Background(), imageTag)
+		},
+	}, nil
+}
+
+// load pulls ref from the layout into local storage and tags it imageTag.
+func (b *OCIImageBuilder) load(ctx context.Context, layoutDir, ref, imageTag string) (string, error) {
+	stdout, err := b.podman(ctx, "pull", "--quiet", fmt.Sprintf("oci:%s:%s", layoutDir, ref))
+	if err != nil {
+		return "", err
+	}
+	imageID := strings.TrimSpace(stdout)
+	if _, err := b.podman(ctx, "tag", imageID, imageTag); err != nil {
+		_, _ = b.podman(context.Background(), "rmi", "--force", imageID)
+		return "", err
+	}
+	return imageID, nil
+}
+
+// RemoveImage removes a Podman image by tag or ID.
+func (b *OCIImageBuilder) RemoveImage(ctx context.Context, imageRef string) error {
+	if _, err := b.podman(ctx, "rmi", "--force", imageRef); err != nil {
+		return fmt.Errorf("image removal failed: %w", err)
+	}
+	return nil
+}
+
+func (b *OCIImageBuilder) podman(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, b.podmanPath, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("podman %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,71 @@
+package podman
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"virsh-sandbox/internal/oci"
+	"virsh-sandbox/internal/workflow"
+)
+
+// ImagePusher pushes clone images to OCI registries. Images built as an OCI
+// layout are pushed from it; images built with podman build are first
+// exported with `podman save --format oci-dir`.
+type ImagePusher struct {
+	podmanPath string
+	client     *oci.Client
+}
+
+// ImagePusherConfig configures the image pusher.
+type ImagePusherConfig struct {
+	// PodmanPath is the path to the podman binary.
+	// If empty, "podman" is looked up in PATH.
+	PodmanPath string
+
+	// Client talks to the registries. If nil, an anonymous client is used.
+	Client *oci.Client
+}
+
+// NewImagePusher creates a new ImagePusher with the given configuration.
+func NewImagePusher(cfg ImagePusherConfig) *ImagePusher {
+	podmanPath := cfg.PodmanPath
+	if podmanPath == "" {
+		podmanPath = "podman"
+	}
+	client := cfg.Client
+	if client == nil {
+		client = oci.NewClient(oci.ClientConfig{})
+	}
+	return &ImagePusher{podmanPath: podmanPath, client: client}
+}
+
+// PushImage pushes img to target. Images without a layout are exported to
+// workDir/push first; the export is removed with workDir.
+func (p *ImagePusher) PushImage(ctx context.Context, img *ImageResult, workDir string, target oci.Reference, opts oci.PushOptions) (*oci.PushResult, error) {
+	layoutDir, ref := img.LayoutPath, img.LayoutRef
+	if layoutDir == "" {
+		layoutDir, ref = filepath.Join(workDir, "push"), ""
+		if err := os.RemoveAll(layoutDir); err != nil {
+			return nil, p.fail(fmt.Sprintf("failed to clear export directory: %v", err))
+		}
+		cmd := exec.CommandContext(ctx, p.podmanPath, "save", "--format", "oci-dir", "-o", layoutDir, img.ImageTag)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, p.fail(fmt.Sprintf("podman save failed: %v: %s", err, stderr.String()))
+		}
+	}
+	res, err := p.client.Push(ctx, layoutDir, ref, target, opts)
+	if err != nil {
+		return nil, p.fail(err.Error())
+	}
+	return res, nil
+}
+
+func (p *ImagePusher) fail(detail string) error {
+	return workflow.NewWorkflowError(workflow.StagePushImage, workflow.ErrPushFailed, detail)
+}
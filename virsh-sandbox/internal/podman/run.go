@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"sort"
 	"strings"
 	"time"
 
@@ -346,9 +347,35 @@ func (r *ContainerRunner) InspectContainer(ctx context.Context, containerRef str
 	}, nil
 }
 
+// ExecOption configures a single ExecInContainer call.
+type ExecOption func(*execOptions)
+
+type execOptions struct {
+	env map[string]string
+}
+
+// WithExecEnv sets environment variables for the executed process. They are
+// passed with --env, so values do not appear in the process arguments.
+func WithExecEnv(env map[string]string) ExecOption {
+	return func(o *execOptions) { o.env = env }
+}
+
 // ExecInContainer executes a command inside a running container.
-func (r *ContainerRunner) ExecInContainer(ctx context.Context, containerRef string, command []string) (string, string, int, error) {
-	args := []string{"exec", containerRef}
+func (r *ContainerRunner) ExecInContainer(ctx context.Context, containerRef string, command []string, opts ...ExecOption) (string, string, int, error) {
+	var eo execOptions
+	for _, o := range opts {
+		o(&eo)
+	}
+	args := []string{"exec"}
+	keys := make([]string, 0, len(eo.env))
+	for k := range eo.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--env", k+"="+eo.env[k])
+	}
+	args = append(args, containerRef)
 	args = append(args, command...)
 
 	cmd := exec.CommandContext(ctx, r.podmanPath, args...)
@@ -0,0 +1,229 @@
+// Package policy evaluates declarative rules that decide whether a command may
+// run inside a sandbox.
+//
+// A policy is a JSON document with an ordered list of rules and a default
+// action. The first rule whose match block is satisfied decides the outcome:
+//
+//	{
+//	  "default_action": "allow",
+//	  "rules": [
+//	    {
+//	      "name": "no-disk-wipes",
+//	      "action": "deny",
+//	      "reason": "destructive disk operation",
+//	      "match": {"command": ["\\bmkfs(\\.|\\s)", "\\bdd\\s+.*of=/dev/"]}
+//	    },
+//	    {
+//	      "name": "prod-needs-review",
+//	      "action": "require_approval",
+//	      "match": {"labels": {"env": "prod*"}, "agent_id": ["agent-*"]}
+//	    }
+//	  ]
+//	}
+//
+// Within a match block every non-empty field must match (AND); within a list
+// any entry may match (OR). Command entries are regular expressions; agent ID,
+// source VM and label values are shell-style globs (path.Match syntax).
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+)
+
+var (
+	// ErrDenied is returned when a policy denies an operation.
+	ErrDenied = errors.New("denied by policy")
+
+	// ErrApprovalRequired is returned when a policy requires human approval.
+	ErrApprovalRequired = errors.New("approval required by policy")
+)
+
+// Action is the outcome of a policy evaluation.
+type Action string
+
+const (
+	ActionAllow           Action = "allow"
+	ActionDeny            Action = "deny"
+	ActionRequireApproval Action = "require_approval"
+)
+
+// Valid reports whether a is a known action.
+func (a Action) Valid() bool {
+	switch a {
+	case ActionAllow, ActionDeny, ActionRequireApproval:
+		return true
+	default:
+		return false
+	}
+}
+
+// Policy is the declarative rule set.
+type Policy struct {
+	// DefaultAction applies when no rule matches (default "allow").
+	DefaultAction Action `json:"default_action,omitempty"`
+	Rules         []Rule `json:"rules"`
+}
+
+// Rule is a single policy rule.
+type Rule struct {
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Match  Match  `json:"match"`
+}
+
+// Match selects the commands a rule applies to. Empty fields match anything.
+type Match struct {
+	// Command holds regular expressions matched against the command text.
+	Command []string `json:"command,omitempty"`
+
+	// AgentID holds globs matched against the ID of the agent that owns the sandbox.
+	AgentID []string `json:"agent_id,omitempty"`
+
+	// SourceVM holds globs matched against the VM the sandbox was cloned from.
+	SourceVM []string `json:"source_vm,omitempty"`
+
+	// Labels maps sandbox label keys to value globs; all must match.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Input describes the command being evaluated.
+type Input struct {
+	Command   string
+	AgentID   string
+	SourceVM  string
+	SandboxID string
+	Labels    map[string]string
+}
+
+// Decision is the result of evaluating a policy.
+type Decision struct {
+	Action Action `json:"action"`
+	Rule   string `json:"rule,omitempty"` // empty when the default action applied
+	Reason string `json:"reason,omitempty"`
+}
+
+// Engine is a compiled, immutable policy. It is safe for concurrent use.
+type Engine struct {
+	defaultAction Action
+	rules         []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	command []*regexp.Regexp
+}
+
+// New validates and compiles p.
+func New(p Policy) (*Engine, error) {
+	e := &Engine{defaultAction: p.DefaultAction}
+	if e.defaultAction == "" {
+		e.defaultAction = ActionAllow
+	}
+	if !e.defaultAction.Valid() {
+		return nil, fmt.Errorf("policy: invalid default_action %q", p.DefaultAction)
+	}
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if !r.Action.Valid() {
+			return nil, fmt.Errorf("policy: rule %q: invalid action %q", r.Name, r.Action)
+		}
+		cr := compiledRule{Rule: r}
+		for _, expr := range r.Match.Command {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("policy: rule %q: command pattern %q: %w", r.Name, expr, err)
+			}
+			cr.command = append(cr.command, re)
+		}
+		for _, g := range append(append([]string{}, r.Match.AgentID...), r.Match.SourceVM...) {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, fmt.Errorf("policy: rule %q: glob %q: %w", r.Name, g, err)
+			}
+		}
+		for k, g := range r.Match.Labels {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, fmt.Errorf("policy: rule %q: label %q glob %q: %w", r.Name, k, g, err)
+			}
+		}
+		e.rules = append(e.rules, cr)
+	}
+	return e, nil
+}
+
+// Load reads a JSON policy from file and compiles it.
+func Load(file string) (*Engine, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("policy: read %s: %w", file, err)
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("policy: parse %s: %w", file, err)
+	}
+	return New(p)
+}
+
+// Evaluate returns the decision of the first matching rule, or the default
+// action if none match. A nil Engine allows everything.
+func (e *Engine) Evaluate(in Input) Decision {
+	if e == nil {
+		return Decision{Action: ActionAllow}
+	}
+	for _, r := range e.rules {
+		if r.matches(in) {
+			return Decision{Action: r.Action, Rule: r.Name, Reason: r.Reason}
+		}
+	}
+	return Decision{Action: e.defaultAction}
+}
+
+func (r compiledRule) matches(in Input) bool {
+	if len(r.command) > 0 {
+		ok := false
+		for _, re := range r.command {
+			if re.MatchString(in.Command) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if !matchAnyGlob(r.Match.AgentID, in.AgentID) {
+		return false
+	}
+	if !matchAnyGlob(r.Match.SourceVM, in.SourceVM) {
+		return false
+	}
+	for k, g := range r.Match.Labels {
+		v, ok := in.Labels[k]
+		if !ok {
+			return false
+		}
+		if m, _ := path.Match(g, v); !m {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAnyGlob(globs []string, s string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if m, _ := path.Match(g, s); m {
+			return true
+		}
+	}
+	return false
+}
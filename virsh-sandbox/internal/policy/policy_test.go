@@ -0,0 +1,73 @@
+package policy
+
+import "testing"
+
+func TestEvaluate(t *testing.T) {
+	e, err := New(Policy{
+		DefaultAction: ActionAllow,
+		Rules: []Rule{
+			{
+				Name:   "no-disk-wipes",
+				Action: ActionDeny,
+				Reason: "destructive disk operation",
+				Match:  Match{Command: []string{`\bmkfs(\.|\s)`, `\bdd\s+.*of=/dev/`}},
+			},
+			{
+				Name:   "prod-review",
+				Action: ActionRequireApproval,
+				Match: Match{
+					AgentID: []string{"agent-*"},
+					Labels:  map[string]string{"env": "prod*"},
+				},
+			},
+			{
+				Name:   "golden-readonly",
+				Action: ActionDeny,
+				Match:  Match{SourceVM: []string{"golden-*"}, Command: []string{`^rm\s`}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		in   Input
+		want Action
+		rule string
+	}{
+		{"default", Input{Command: "ls -la", AgentID: "agent-1"}, ActionAllow, ""},
+		{"command regex", Input{Command: "sudo mkfs.ext4 /dev/vdb"}, ActionDeny, "no-disk-wipes"},
+		{"labels and agent", Input{Command: "ls", AgentID: "agent-7", Labels: map[string]string{"env": "production"}}, ActionRequireApproval, "prod-review"},
+		{"label mismatch", Input{Command: "ls", AgentID: "agent-7", Labels: map[string]string{"env": "dev"}}, ActionAllow, ""},
+		{"missing label", Input{Command: "ls", AgentID: "agent-7"}, ActionAllow, ""},
+		{"source vm", Input{Command: "rm -rf /tmp/x", SourceVM: "golden-ubuntu"}, ActionDeny, "golden-readonly"},
+		{"source vm other", Input{Command: "rm -rf /tmp/x", SourceVM: "ubuntu"}, ActionAllow, ""},
+	}
+	for _, c := range cases {
+		d := e.Evaluate(c.in)
+		if d.Action != c.want || d.Rule != c.rule {
+			t.Errorf("%s: got (%s, %q), want (%s, %q)", c.name, d.Action, d.Rule, c.want, c.rule)
+		}
+	}
+}
+
+func TestNewRejectsInvalid(t *testing.T) {
+	if _, err := New(Policy{DefaultAction: "maybe"}); err == nil {
+		t.Error("expected error for invalid default action")
+	}
+	if _, err := New(Policy{Rules: []Rule{{Name: "x", Action: "block"}}}); err == nil {
+		t.Error("expected error for invalid rule action")
+	}
+	if _, err := New(Policy{Rules: []Rule{{Name: "x", Action: ActionDeny, Match: Match{Command: []string{"("}}}}}); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestNilEngineAllows(t *testing.T) {
+	var e *Engine
+	if d := e.Evaluate(Input{Command: "anything"}); d.Action != ActionAllow {
+		t.Errorf("nil engine action = %s, want allow", d.Action)
+	}
+}
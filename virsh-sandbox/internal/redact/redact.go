@@ -0,0 +1,241 @@
+// Package redact masks secrets in command text, environment and output before
+// they are persisted or returned to API clients.
+//
+// Two mechanisms are combined: values of environment variables marked secret
+// are replaced wherever they appear, and pattern-based detectors catch common
+// credential formats (private keys, AWS keys, bearer tokens, URL passwords).
+// Every replacement is a stable placeholder such as "[REDACTED:bearer_token:1]"
+// and is recorded together with the rule that produced it.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rule names used in placeholders and in the Redacted map.
+const (
+	RuleSecretEnv          = "secret_env"
+	RulePrivateKey         = "private_key"
+	RuleAWSAccessKeyID     = "aws_access_key_id"
+	RuleAWSSecretAccessKey = "aws_secret_access_key"
+	RuleBearerToken        = "bearer_token"
+	RuleURLPassword        = "url_password"
+)
+
+// minSecretLen is the shortest env value that is masked by literal match in
+// free text. Shorter values (e.g. "1", "yes") would redact unrelated output.
+const minSecretLen = 4
+
+// Rule is a pattern-based secret detector.
+type Rule struct {
+	// Name identifies the rule in placeholders and redaction records.
+	Name string
+
+	// Pattern matches the secret and any surrounding context.
+	Pattern *regexp.Regexp
+
+	// Group selects the submatch to mask; 0 masks the whole match.
+	Group int
+}
+
+// DefaultRules returns the built-in detectors.
+func DefaultRules() []Rule {
+	return []Rule{
+		{
+			Name:    RulePrivateKey,
+			Pattern: regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`),
+		},
+		{
+			Name:    RuleAWSAccessKeyID,
+			Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA)[0-9A-Z]{16}\b`),
+		},
+		{
+			Name:    RuleAWSSecretAccessKey,
+			Pattern: regexp.MustCompile(`(?i)(aws_secret_access_key["']?\s*[=:]\s*["']?)([A-Za-z0-9/+=]{40})`),
+			Group:   2,
+		},
+		{
+			Name:    RuleBearerToken,
+			Pattern: regexp.MustCompile(`(?i)(\bbearer\s+)([A-Za-z0-9\-._~+/]{8,}=*)`),
+			Group:   2,
+		},
+		{
+			Name:    RuleURLPassword,
+			Pattern: regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.\-]*://[^\s:/@]+:)([^\s@/]+)(@)`),
+			Group:   2,
+		},
+	}
+}
+
+// DefaultSecretKeyPattern matches environment variable names that are treated
+// as secret even when the caller did not mark them explicitly.
+var DefaultSecretKeyPattern = regexp.MustCompile(`(?i)(secret|token|passw(or)?d|passwd|api_?key|private_?key|credential)`)
+
+// Redactor holds the configured detectors. It is safe for concurrent use.
+type Redactor struct {
+	rules     []Rule
+	secretKey *regexp.Regexp
+}
+
+// Option configures a Redactor.
+type Option func(*Redactor)
+
+// WithRules replaces the built-in detectors.
+func WithRules(rules ...Rule) Option {
+	return func(r *Redactor) { r.rules = rules }
+}
+
+// WithExtraRules appends detectors to the built-in set.
+func WithExtraRules(rules ...Rule) Option {
+	return func(r *Redactor) { r.rules = append(r.rules, rules...) }
+}
+
+// WithSecretKeyPattern overrides the env-name heuristic; nil disables it so
+// only explicitly marked keys are treated as secret.
+func WithSecretKeyPattern(re *regexp.Regexp) Option {
+	return func(r *Redactor) { r.secretKey = re }
+}
+
+// New creates a Redactor with the built-in detectors.
+func New(opts ...Option) *Redactor {
+	r := &Redactor{
+		rules:     DefaultRules(),
+		secretKey: DefaultSecretKeyPattern,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
+}
+
+// Session redacts a related set of strings (one command execution) so that the
+// same secret gets the same placeholder everywhere it appears.
+type Session struct {
+	r        *Redactor
+	env      map[string]string // secret value -> placeholder
+	seen     map[string]string // detector-matched value -> placeholder
+	counts   map[string]int    // rule name -> placeholders issued
+	redacted map[string]string // placeholder -> rule name
+}
+
+// NewSession starts a redaction session. Values of env entries whose key is in
+// secretKeys, or matches the secret key heuristic, are masked wherever they occur.
+func (r *Redactor) NewSession(env map[string]string, secretKeys []string) *Session {
+	s := &Session{
+		r:        r,
+		env:      make(map[string]string),
+		seen:     make(map[string]string),
+		counts:   make(map[string]int),
+		redacted: make(map[string]string),
+	}
+	marked := make(map[string]bool, len(secretKeys))
+	for _, k := range secretKeys {
+		marked[k] = true
+	}
+	for k, v := range env {
+		if v == "" {
+			continue
+		}
+		if !marked[k] && (r.secretKey == nil || !r.secretKey.MatchString(k)) {
+			continue
+		}
+		ph := fmt.Sprintf("[REDACTED:%s:%s]", RuleSecretEnv, k)
+		s.env[v] = ph
+		s.redacted[ph] = RuleSecretEnv
+	}
+	return s
+}
+
+// Env returns a copy of env with secret values replaced by placeholders and
+// detector matches masked.
+func (s *Session) Env(env map[string]string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		if ph, ok := s.env[v]; ok {
+			out[k] = ph
+			continue
+		}
+		out[k] = s.String(v)
+	}
+	return out
+}
+
+// String masks secret env values and detector matches in text.
+func (s *Session) String(text string) string {
+	if text == "" {
+		return text
+	}
+
+	// Literal secret values first, longest first so overlapping values are
+	// replaced by the most specific placeholder.
+	values := make([]string, 0, len(s.env))
+	for v := range s.env {
+		if len(v) >= minSecretLen {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		text = strings.ReplaceAll(text, v, s.env[v])
+	}
+
+	for _, rule := range s.r.rules {
+		text = s.applyRule(rule, text)
+	}
+	return text
+}
+
+// Redacted returns the placeholders issued so far mapped to the rule that
+// produced them, or nil if nothing was redacted.
+func (s *Session) Redacted() map[string]string {
+	if len(s.redacted) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(s.redacted))
+	for k, v := range s.redacted {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *Session) applyRule(rule Rule, text string) string {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[2*rule.Group], m[2*rule.Group+1]
+		if start < 0 || start < last {
+			continue
+		}
+		secret := text[start:end]
+		if strings.HasPrefix(secret, "[REDACTED:") {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(s.placeholder(rule.Name, secret))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func (s *Session) placeholder(rule, secret string) string {
+	key := rule + "\x00" + secret
+	if ph, ok := s.seen[key]; ok {
+		return ph
+	}
+	s.counts[rule]++
+	ph := fmt.Sprintf("[REDACTED:%s:%d]", rule, s.counts[rule])
+	s.seen[key] = ph
+	s.redacted[ph] = rule
+	return ph
+}
@@ -0,0 +1,364 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"virsh-sandbox/internal/approval"
+	serverError "virsh-sandbox/internal/error"
+	serverJSON "virsh-sandbox/internal/json"
+	"virsh-sandbox/internal/redact"
+	"virsh-sandbox/internal/store"
+	"virsh-sandbox/internal/vm"
+)
+
+// ApprovalsHandler exposes the pending-approval queue to operators.
+type ApprovalsHandler struct {
+	svc *approval.Service
+}
+
+// NewApprovalsHandler creates a new approvals handler.
+func NewApprovalsHandler(svc *approval.Service) *ApprovalsHandler {
+	return &ApprovalsHandler{svc: svc}
+}
+
+// RegisterRoutes registers the approval routes on the given router.
+func (h *ApprovalsHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/approvals", func(r chi.Router) {
+		r.Get("/", h.handleListApprovals)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", h.handleGetApproval)
+			r.Post("/approve", h.handleApprove)
+			r.Post("/deny", h.handleDeny)
+		})
+	})
+}
+
+// --- Request/Response DTOs ---
+
+type approvalDecisionRequest struct {
+	DecidedBy string `json:"decided_by"`     // required; operator identity
+	Note      string `json:"note,omitempty"` // optional
+}
+
+type approvalResponse struct {
+	Approval *store.Approval `json:"approval"`
+}
+
+type listApprovalsResponse struct {
+	Approvals []*store.Approval `json:"approvals"`
+	Total     int               `json:"total"`
+}
+
+// approvalPendingResponse is returned with 202 when an operation was parked.
+type approvalPendingResponse struct {
+	Approval *store.Approval `json:"approval"`
+	Command  *store.Command  `json:"command,omitempty"` // set for policy-gated commands
+	Message  string          `json:"message"`
+}
+
+// runCommandApproval is the persisted payload of a parked command. Command is
+// redacted for display and Env holds only non-secret values; the raw command
+// and secret values are kept in memory by the approval service. RunCommand
+// only honours the approval for the command whose digest is recorded here.
+type runCommandApproval struct {
+	CommandID      string            `json:"command_id"`
+	Username       string            `json:"username"`
+	PrivateKeyPath string            `json:"private_key_path"`
+	Command        string            `json:"command"`
+	CommandSHA256  string            `json:"command_sha256"`
+	TimeoutSec     int               `json:"timeout_sec,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	SecretEnv      []string          `json:"secret_env,omitempty"`
+}
+
+// commandSecret is the Secrets key holding a parked command's raw text. It is
+// not a valid environment variable name, so it cannot clash with one.
+const commandSecret = ":command"
+
+// --- Handlers ---
+
+// @Summary List approvals
+// @Description Lists approval requests, newest first
+// @Tags Approvals
+// @Produce json
+// @Param sandbox_id query string false "Filter by sandbox"
+// @Param job_id query string false "Filter by job"
+// @Param status query string false "Filter by status (PENDING, APPROVED, DENIED, EXPIRED)"
+// @Param limit query int false "Maximum number of approvals to return"
+// @Success 200 {object} listApprovalsResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listApprovals
+// @Router /v1/approvals [get]
+func (h *ApprovalsHandler) handleListApprovals(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var filter store.ApprovalFilter
+	if v := q.Get("sandbox_id"); v != "" {
+		filter.SandboxID = &v
+	}
+	if v := q.Get("job_id"); v != "" {
+		filter.JobID = &v
+	}
+	if v := q.Get("status"); v != "" {
+		st := store.ApprovalStatus(v)
+		filter.Status = &st
+	}
+	opt := &store.ListOptions{OrderBy: "created_at"}
+	if l := q.Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 {
+			opt.Limit = n
+		}
+	}
+
+	list, err := h.svc.List(r.Context(), filter, opt)
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("list approvals: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listApprovalsResponse{Approvals: list, Total: len(list)})
+}
+
+// @Summary Get approval
+// @Description Returns an approval request and, once decided, its outcome
+// @Tags Approvals
+// @Produce json
+// @Param id path string true "Approval ID"
+// @Success 200 {object} approvalResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id getApproval
+// @Router /v1/approvals/{id} [get]
+func (h *ApprovalsHandler) handleGetApproval(w http.ResponseWriter, r *http.Request) {
+	a, err := h.svc.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get approval: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, approvalResponse{Approval: a})
+}
+
+// @Summary Approve operation
+// @Description Approves a pending request and runs the parked operation. The operation's
+// @Description result or error is recorded on the returned approval.
+// @Tags Approvals
+// @Accept json
+// @Produce json
+// @Param id path string true "Approval ID"
+// @Param request body approvalDecisionRequest true "Decision"
+// @Success 200 {object} approvalResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id approveOperation
+// @Router /v1/approvals/{id}/approve [post]
+func (h *ApprovalsHandler) handleApprove(w http.ResponseWriter, r *http.Request) {
+	h.decide(w, r, h.svc.Approve)
+}
+
+// @Summary Deny operation
+// @Description Denies a pending request; the parked operation is discarded
+// @Tags Approvals
+// @Accept json
+// @Produce json
+// @Param id path string true "Approval ID"
+// @Param request body approvalDecisionRequest true "Decision"
+// @Success 200 {object} approvalResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id denyOperation
+// @Router /v1/approvals/{id}/deny [post]
+func (h *ApprovalsHandler) handleDeny(w http.ResponseWriter, r *http.Request) {
+	h.decide(w, r, h.svc.Deny)
+}
+
+func (h *ApprovalsHandler) decide(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, id, decidedBy, note string) (*store.Approval, error)) {
+	var req approvalDecisionRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.DecidedBy == "" {
+		serverError.RespondError(w, http.StatusBadRequest, errors.New("decided_by is required"))
+		return
+	}
+
+	a, err := fn(r.Context(), chi.URLParam(r, "id"), req.DecidedBy, req.Note)
+	switch {
+	case errors.Is(err, approval.ErrNotPending), errors.Is(err, approval.ErrExpired):
+		serverError.RespondError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("decide approval: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, approvalResponse{Approval: a})
+}
+
+// --- Gating ---
+
+// requestApproval parks op for the sandbox and writes a 202 response carrying
+// the pending approval.
+func (s *Server) requestApproval(w http.ResponseWriter, r *http.Request, op approval.Operation, sandboxID, reason string, payload any) {
+	sb, err := s.vmSvc.GetSandbox(r.Context(), sandboxID)
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get sandbox: %w", err))
+		return
+	}
+	a, err := s.approvals.Request(r.Context(), approval.Request{
+		Operation:   op,
+		SandboxID:   sb.ID,
+		JobID:       sb.JobID,
+		RequestedBy: sb.AgentID,
+		Reason:      reason,
+		Payload:     payload,
+	})
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("request approval: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusAccepted, approvalPendingResponse{
+		Approval: a,
+		Message:  fmt.Sprintf("%s requires approval; approve with POST /v1/approvals/%s/approve", op, a.ID),
+	})
+}
+
+// requiresApproval reports whether op must be parked before running.
+func (s *Server) requiresApproval(op approval.Operation) bool {
+	return s.approvals != nil && s.approvals.Requires(op)
+}
+
+// registerApprovalExecutors wires each gated operation to the service call
+// that performs it once approved.
+func (s *Server) registerApprovalExecutors() {
+	s.approvals.Register(approval.OpDestroySandbox, func(ctx context.Context, a *store.Approval, _ map[string]string) (any, error) {
+		return nil, s.vmSvc.DestroySandbox(ctx, a.SandboxID)
+	})
+
+	s.approvals.Register(approval.OpRevertSnapshot, func(ctx context.Context, a *store.Approval, _ map[string]string) (any, error) {
+		var p revertSnapshotRequest
+		if err := decodeApprovalPayload(a, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.vmSvc.RevertSnapshot(ctx, a.SandboxID, p.Snapshot)
+	})
+
+	s.approvals.Register(approval.OpPublish, func(ctx context.Context, a *store.Approval, _ map[string]string) (any, error) {
+		// Mirrors handlePublish until the GitOps publisher is wired.
+		return nil, errors.New("publish not implemented yet")
+	})
+
+	s.approvals.Register(approval.OpRunCommand, func(ctx context.Context, a *store.Approval, secrets map[string]string) (any, error) {
+		var p runCommandApproval
+		if err := decodeApprovalPayload(a, &p); err != nil {
+			return nil, err
+		}
+		// A command without secrets is shown as is and survives a restart.
+		command, ok := secrets[commandSecret]
+		if !ok {
+			if vm.CommandDigest(p.Command) != p.CommandSHA256 {
+				return nil, errors.New("command was not retained (service restarted); resubmit the command")
+			}
+			command = p.Command
+		}
+		env := make(map[string]string, len(p.Env)+len(secrets))
+		for k, v := range p.Env {
+			env[k] = v
+		}
+		for k, v := range secrets {
+			if k != commandSecret {
+				env[k] = v
+			}
+		}
+		for _, k := range p.SecretEnv {
+			if _, ok := env[k]; !ok {
+				return nil, fmt.Errorf("secret env %s was not retained (service restarted); resubmit the command", k)
+			}
+		}
+		cmd, err := s.vmSvc.RunCommand(ctx, a.SandboxID, p.Username, p.PrivateKeyPath, command,
+			time.Duration(p.TimeoutSec)*time.Second, env,
+			vm.WithSecretEnv(p.SecretEnv...), vm.WithApproval(a.ID))
+		if cmd == nil {
+			return nil, err
+		}
+		return map[string]any{"command_id": cmd.ID, "exit_code": cmd.ExitCode}, err
+	})
+}
+
+// parkCommand records a policy-gated command as a pending approval.
+func (s *Server) parkCommand(w http.ResponseWriter, r *http.Request, sandboxID string, req runCommandRequest, cmd *store.Command, reason string) {
+	sb, err := s.vmSvc.GetSandbox(r.Context(), sandboxID)
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get sandbox: %w", err))
+		return
+	}
+
+	marked := make(map[string]bool, len(req.SecretEnv))
+	for _, k := range req.SecretEnv {
+		marked[k] = true
+	}
+	// The command record is already redacted; the raw text stays in memory.
+	payload := runCommandApproval{
+		Username:       req.Username,
+		PrivateKeyPath: req.PrivateKeyPath,
+		CommandSHA256:  vm.CommandDigest(req.Command),
+		TimeoutSec:     req.TimeoutSec,
+	}
+	if cmd != nil {
+		payload.CommandID = cmd.ID
+		payload.Command = cmd.Command
+	} else {
+		payload.Command = redact.New().NewSession(req.Env, req.SecretEnv).String(req.Command)
+	}
+	secrets := map[string]string{commandSecret: req.Command}
+	for k, v := range req.Env {
+		if marked[k] || redact.DefaultSecretKeyPattern.MatchString(k) {
+			secrets[k] = v
+			payload.SecretEnv = append(payload.SecretEnv, k)
+			continue
+		}
+		if payload.Env == nil {
+			payload.Env = make(map[string]string)
+		}
+		payload.Env[k] = v
+	}
+
+	a, err := s.approvals.Request(r.Context(), approval.Request{
+		Operation:   approval.OpRunCommand,
+		SandboxID:   sb.ID,
+		JobID:       sb.JobID,
+		RequestedBy: sb.AgentID,
+		Reason:      reason,
+		Payload:     payload,
+		Secrets:     secrets,
+	})
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("request approval: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusAccepted, approvalPendingResponse{
+		Approval: a,
+		Command:  cmd,
+		Message:  fmt.Sprintf("command requires approval; approve with POST /v1/approvals/%s/approve", a.ID),
+	})
+}
+
+func decodeApprovalPayload(a *store.Approval, v any) error {
+	if a.PayloadJSON == nil {
+		return errors.New("approval has no payload")
+	}
+	if err := json.Unmarshal([]byte(*a.PayloadJSON), v); err != nil {
+		return fmt.Errorf("decode approval payload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"virsh-sandbox/internal/clone"
+	serverError "virsh-sandbox/internal/error"
+	"virsh-sandbox/internal/extract"
+	serverJSON "virsh-sandbox/internal/json"
+	"virsh-sandbox/internal/store"
+	"virsh-sandbox/internal/workflow"
+)
+
+// ClonesHandler exposes the VM-to-container clone workflow and its persisted runs.
+type ClonesHandler struct {
+	svc *clone.Service
+}
+
+// NewClonesHandler creates a new clones handler.
+func NewClonesHandler(svc *clone.Service) *ClonesHandler {
+	return &ClonesHandler{svc: svc}
+}
+
+// RegisterRoutes registers the clone routes on the given router.
+func (h *ClonesHandler) RegisterRoutes(r chi.Router) {
+	r.Post("/vms/{name}/clone-to-container", h.handleCloneToContainer)
+	r.Get("/sanitize-passes", h.handleListSanitizePasses)
+	r.Route("/clone-jobs", func(r chi.Router) {
+		r.Get("/", h.handleListCloneJobs)
+		r.Get("/{id}", h.handleGetCloneJob)
+	})
+	r.Route("/workflow-runs", func(r chi.Router) {
+		r.Get("/", h.handleListWorkflowRuns)
+		r.Get("/{id}", h.handleGetWorkflowRun)
+		r.Post("/{id}/rollback", h.handleRollbackWorkflowRun)
+	})
+	r.Get("/debug/nbd", h.handleListNBDAttachments)
+}
+
+// --- Request/Response DTOs ---
+
+type cloneToContainerRequest struct {
+	// Passes run in order instead of the default passes.
+	Passes []string              `json:"passes,omitempty"`
+	Rules  extract.SanitizeRules `json:"rules"`
+	DryRun bool                  `json:"dry_run,omitempty"`
+
+	// FailOnSecrets fails the job when the secret scan reports findings.
+	FailOnSecrets bool `json:"fail_on_secrets,omitempty"`
+
+	// Push pushes the built image to a registry before the container runs.
+	Push *clone.PushTarget `json:"push,omitempty"`
+
+	// Full archives the whole filesystem even when the previous clone of
+	// the VM could be layered on.
+	Full bool `json:"full,omitempty"`
+}
+
+type listSanitizePassesResponse struct {
+	Passes []extract.SanitizePass `json:"passes"`
+	Total  int                    `json:"total"`
+}
+
+type cloneJobResponse struct {
+	Job *clone.Job `json:"job"`
+}
+
+type listCloneJobsResponse struct {
+	Jobs  []*clone.Job `json:"jobs"`
+	Total int          `json:"total"`
+}
+
+type workflowRunResponse struct {
+	Run *store.WorkflowRun `json:"run"`
+}
+
+type listWorkflowRunsResponse struct {
+	Runs  []*store.WorkflowRun `json:"runs"`
+	Total int                  `json:"total"`
+}
+
+type listNBDAttachmentsResponse struct {
+	Attachments []extract.NBDAttachment `json:"attachments"`
+	Total       int                     `json:"total"`
+}
+
+// --- Handlers ---
+
+// @Summary Clone VM to container
+// @Description Starts an async job that snapshots the VM (or reads its disk when stopped), extracts and sanitizes its root filesystem, builds a Podman image and runs a container from it
+// @Description Poll the returned job for per-stage progress; on success it carries a CloneResult
+// @Description The optional body selects sanitize passes and their rules; a dry run only reports what each pass would remove or modify
+// @Description With push set, the image is pushed to that registry reference before the container runs; the registry must be allowed by CLONE_PUSH_REGISTRIES
+// @Description With incremental clones enabled, only changes since the VM's previous clone are archived as a layer on its image unless full is set
+// @Tags VMs
+// @Accept json
+// @Produce json
+// @Param name path string true "VM name"
+// @Param request body cloneToContainerRequest false "Sanitize passes, rules, dry-run, fail-on-secrets and full flags, and registry push target"
+// @Success 202 {object} cloneJobResponse
+// @Failure 400 {object} workflow.ErrorResponse
+// @Failure 404 {object} workflow.ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} workflow.ErrorResponse
+// @Id cloneVMToContainer
+// @Router /v1/vms/{name}/clone-to-container [post]
+func (h *ClonesHandler) handleCloneToContainer(w http.ResponseWriter, r *http.Request) {
+	var req cloneToContainerRequest
+	if r.ContentLength > 0 {
+		if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+			serverError.RespondError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	opts := []clone.StartOption{clone.WithRules(req.Rules)}
+	if len(req.Passes) > 0 {
+		opts = append(opts, clone.WithPasses(req.Passes...))
+	}
+	if req.DryRun {
+		opts = append(opts, clone.WithDryRun())
+	}
+	if req.FailOnSecrets {
+		opts = append(opts, clone.WithFailOnSecrets())
+	}
+	if req.Push != nil {
+		opts = append(opts, clone.WithPush(*req.Push))
+	}
+	if req.Full {
+		opts = append(opts, clone.WithFullExtraction())
+	}
+	job, err := h.svc.Start(r.Context(), chi.URLParam(r, "name"), opts...)
+	var werr *workflow.WorkflowError
+	if errors.As(err, &werr) {
+		_ = serverJSON.RespondJSON(w, statusForWorkflowError(werr), werr.ToErrorResponse())
+		return
+	}
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("clone to container: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusAccepted, cloneJobResponse{Job: job})
+}
+
+// @Summary List sanitize passes
+// @Description Lists the filesystem sanitize passes a clone job can select, in default order
+// @Tags VMs
+// @Produce json
+// @Success 200 {object} listSanitizePassesResponse
+// @Id listSanitizePasses
+// @Router /v1/sanitize-passes [get]
+func (h *ClonesHandler) handleListSanitizePasses(w http.ResponseWriter, r *http.Request) {
+	passes := h.svc.Passes()
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listSanitizePassesResponse{Passes: passes, Total: len(passes)})
+}
+
+// @Summary List clone jobs
+// @Description Lists VM-to-container clone jobs, newest first
+// @Tags VMs
+// @Produce json
+// @Param vm query string false "Filter by VM name"
+// @Success 200 {object} listCloneJobsResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listCloneJobs
+// @Router /v1/clone-jobs [get]
+func (h *ClonesHandler) handleListCloneJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.svc.List(r.Context(), r.URL.Query().Get("vm"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("list clone jobs: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listCloneJobsResponse{Jobs: jobs, Total: len(jobs)})
+}
+
+// @Summary Get clone job
+// @Description Returns a clone job with per-stage progress, its CloneResult on success or the failed stage's error
+// @Tags VMs
+// @Produce json
+// @Param id path string true "Clone job ID"
+// @Success 200 {object} cloneJobResponse
+// @Failure 404 {object} ErrorResponse
+// @Id getCloneJob
+// @Router /v1/clone-jobs/{id} [get]
+func (h *ClonesHandler) handleGetCloneJob(w http.ResponseWriter, r *http.Request) {
+	job, err := h.svc.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get clone job: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, cloneJobResponse{Job: job})
+}
+
+// @Summary List workflow runs
+// @Description Lists persisted clone workflow runs with their stages, outputs and recorded cleanup actions, newest first
+// @Tags Workflow Runs
+// @Produce json
+// @Param status query string false "Filter by status (RUNNING, SUCCEEDED, FAILED, ROLLED_BACK)"
+// @Param subject query string false "Filter by subject (VM name)"
+// @Success 200 {object} listWorkflowRunsResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listWorkflowRuns
+// @Router /v1/workflow-runs [get]
+func (h *ClonesHandler) handleListWorkflowRuns(w http.ResponseWriter, r *http.Request) {
+	var filter store.WorkflowRunFilter
+	if v := r.URL.Query().Get("status"); v != "" {
+		status := store.WorkflowRunStatus(v)
+		filter.Status = &status
+	}
+	if v := r.URL.Query().Get("subject"); v != "" {
+		filter.Subject = &v
+	}
+	runs, err := h.svc.ListRuns(r.Context(), filter)
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("list workflow runs: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listWorkflowRunsResponse{Runs: runs, Total: len(runs)})
+}
+
+// @Summary Get workflow run
+// @Description Returns a workflow run including each recorded cleanup action and whether it has completed
+// @Tags Workflow Runs
+// @Produce json
+// @Param id path string true "Run ID"
+// @Success 200 {object} workflowRunResponse
+// @Failure 404 {object} ErrorResponse
+// @Id getWorkflowRun
+// @Router /v1/workflow-runs/{id} [get]
+func (h *ClonesHandler) handleGetWorkflowRun(w http.ResponseWriter, r *http.Request) {
+	run, err := h.svc.GetRun(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get workflow run: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, workflowRunResponse{Run: run})
+}
+
+// @Summary Force-rollback workflow run
+// @Description Runs every pending cleanup of a run not executing in this process, including removing the image and container a successful run produced
+// @Description Failed cleanups stay pending so the call can be retried
+// @Tags Workflow Runs
+// @Produce json
+// @Param id path string true "Run ID"
+// @Success 200 {object} workflowRunResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} workflow.ErrorResponse
+// @Id rollbackWorkflowRun
+// @Router /v1/workflow-runs/{id}/rollback [post]
+func (h *ClonesHandler) handleRollbackWorkflowRun(w http.ResponseWriter, r *http.Request) {
+	run, err := h.svc.Rollback(r.Context(), chi.URLParam(r, "id"))
+	var werr *workflow.WorkflowError
+	if errors.As(err, &werr) {
+		_ = serverJSON.RespondJSON(w, statusForWorkflowError(werr), werr.ToErrorResponse())
+		return
+	}
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("rollback workflow run: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, workflowRunResponse{Run: run})
+}
+
+// statusForWorkflowError maps a workflow stage error to an HTTP status.
+func statusForWorkflowError(err *workflow.WorkflowError) int {
+	switch {
+	case errors.Is(err, workflow.ErrDomainNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, workflow.ErrDomainTransient), errors.Is(err, workflow.ErrDomainUnsupported):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// @Summary List NBD attachments
+// @Description Lists the host's NBD devices that are connected or locked, with the qemu-nbd pid and the disk and mount point of the owning process
+// @Description A device with an owner that is not locked was left behind by a process that died; the next startup sweeps it
+// @Tags Debug
+// @Produce json
+// @Success 200 {object} listNBDAttachmentsResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listNBDAttachments
+// @Router /v1/debug/nbd [get]
+func (h *ClonesHandler) handleListNBDAttachments(w http.ResponseWriter, r *http.Request) {
+	atts, err := h.svc.NBDAttachments()
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("list nbd attachments: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listNBDAttachmentsResponse{Attachments: atts, Total: len(atts)})
+}
@@ -0,0 +1,275 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	serverError "virsh-sandbox/internal/error"
+	"virsh-sandbox/internal/events"
+	serverJSON "virsh-sandbox/internal/json"
+	"virsh-sandbox/internal/store"
+)
+
+// sseHeartbeatInterval is how often a comment line is written to idle SSE
+// streams so that proxies do not close the connection.
+const sseHeartbeatInterval = 15 * time.Second
+
+// EventsHandler serves the lifecycle event stream and webhook management API.
+type EventsHandler struct {
+	bus      *events.Bus
+	webhooks *events.WebhookService
+}
+
+// NewEventsHandler creates a new events handler. webhooks may be nil, in which
+// case only the event stream is exposed.
+func NewEventsHandler(bus *events.Bus, webhooks *events.WebhookService) *EventsHandler {
+	return &EventsHandler{
+		bus:      bus,
+		webhooks: webhooks,
+	}
+}
+
+// RegisterRoutes registers the events and webhook routes on the given router.
+func (h *EventsHandler) RegisterRoutes(r chi.Router) {
+	r.Get("/events/stream", h.handleStream)
+
+	if h.webhooks == nil {
+		return
+	}
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Post("/", h.handleCreateWebhook)
+		r.Get("/", h.handleListWebhooks)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", h.handleGetWebhook)
+			r.Delete("/", h.handleDeleteWebhook)
+			r.Get("/deliveries", h.handleListDeliveries)
+		})
+	})
+}
+
+// --- Request/Response DTOs ---
+
+type createWebhookRequest struct {
+	URL        string   `json:"url"`                   // required; http(s) endpoint receiving POSTed events
+	Secret     string   `json:"secret,omitempty"`      // optional; generated if empty
+	EventTypes []string `json:"event_types,omitempty"` // optional; e.g. ["sandbox.*", "command.exited"]; empty = all
+	SandboxID  string   `json:"sandbox_id,omitempty"`  // optional; restrict to one sandbox
+}
+
+type createWebhookResponse struct {
+	Webhook *store.Webhook `json:"webhook"`
+	Secret  string         `json:"secret"` // returned only once; used to verify X-Sandbox-Signature
+}
+
+type getWebhookResponse struct {
+	Webhook *store.Webhook `json:"webhook"`
+}
+
+type listWebhooksResponse struct {
+	Webhooks []*store.Webhook `json:"webhooks"`
+	Total    int              `json:"total"`
+}
+
+type listDeliveriesResponse struct {
+	Deliveries []*store.WebhookDelivery `json:"deliveries"`
+	Total      int                      `json:"total"`
+}
+
+// --- Handlers ---
+
+// @Summary Stream lifecycle events
+// @Description Streams sandbox, command, Ansible job and access events as Server-Sent Events.
+// @Description Each event is sent with its type as the SSE event name and the JSON-encoded event as data.
+// @Tags Events
+// @Produce text/event-stream
+// @Param type query string false "Comma-separated event types; supports prefix wildcards such as sandbox.*"
+// @Param sandbox_id query string false "Only stream events for this sandbox"
+// @Success 200 {string} string
+// @Failure 500 {object} ErrorResponse
+// @Id streamEvents
+// @Router /v1/events/stream [get]
+func (h *EventsHandler) handleStream(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The server-wide write timeout would otherwise terminate long-lived streams.
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	filter := events.Filter{SandboxID: r.URL.Query().Get("sandbox_id")}
+	if t := r.URL.Query().Get("type"); t != "" {
+		for _, part := range strings.Split(t, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				filter.Types = append(filter.Types, part)
+			}
+		}
+	}
+
+	ch, cancel := h.bus.Subscribe(filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// @Summary Register webhook
+// @Description Registers an HTTP endpoint to receive lifecycle events. Deliveries are signed with
+// @Description HMAC-SHA256 over "<timestamp>.<body>" and retried with exponential backoff.
+// @Tags Events
+// @Accept json
+// @Produce json
+// @Param request body createWebhookRequest true "Webhook parameters"
+// @Success 201 {object} createWebhookResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id createWebhook
+// @Router /v1/webhooks [post]
+func (h *EventsHandler) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req createWebhookRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.URL == "" {
+		serverError.RespondError(w, http.StatusBadRequest, errors.New("url is required"))
+		return
+	}
+
+	wh, err := h.webhooks.RegisterWebhook(r.Context(), events.RegisterWebhookRequest{
+		URL:        req.URL,
+		Secret:     req.Secret,
+		EventTypes: req.EventTypes,
+		SandboxID:  req.SandboxID,
+	})
+	if err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, fmt.Errorf("register webhook: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusCreated, createWebhookResponse{Webhook: wh, Secret: wh.Secret})
+}
+
+// @Summary List webhooks
+// @Description Lists registered webhooks
+// @Tags Events
+// @Produce json
+// @Success 200 {object} listWebhooksResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listWebhooks
+// @Router /v1/webhooks [get]
+func (h *EventsHandler) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := h.webhooks.ListWebhooks(r.Context(), nil)
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("list webhooks: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listWebhooksResponse{Webhooks: hooks, Total: len(hooks)})
+}
+
+// @Summary Get webhook
+// @Description Returns a registered webhook
+// @Tags Events
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Success 200 {object} getWebhookResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id getWebhook
+// @Router /v1/webhooks/{id} [get]
+func (h *EventsHandler) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	wh, err := h.webhooks.GetWebhook(r.Context(), id)
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get webhook: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, getWebhookResponse{Webhook: wh})
+}
+
+// @Summary Delete webhook
+// @Description Removes a webhook registration
+// @Tags Events
+// @Param id path string true "Webhook ID"
+// @Success 204
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id deleteWebhook
+// @Router /v1/webhooks/{id} [delete]
+func (h *EventsHandler) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := h.webhooks.DeleteWebhook(r.Context(), id); err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("delete webhook: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary List webhook deliveries
+// @Description Returns the delivery log for a webhook, newest first
+// @Tags Events
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Param limit query int false "Maximum number of deliveries to return"
+// @Success 200 {object} listDeliveriesResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listWebhookDeliveries
+// @Router /v1/webhooks/{id}/deliveries [get]
+func (h *EventsHandler) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := h.webhooks.GetWebhook(r.Context(), id); err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get webhook: %w", err))
+		return
+	}
+
+	opt := &store.ListOptions{OrderBy: "created_at", Asc: false}
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 {
+			opt.Limit = n
+		}
+	}
+	deliveries, err := h.webhooks.ListDeliveries(r.Context(), id, opt)
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("list deliveries: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listDeliveriesResponse{Deliveries: deliveries, Total: len(deliveries)})
+}
@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	serverError "virsh-sandbox/internal/error"
+	"virsh-sandbox/internal/image"
+	serverJSON "virsh-sandbox/internal/json"
+	"virsh-sandbox/internal/store"
+)
+
+// ImagesHandler exposes the base image catalog.
+type ImagesHandler struct {
+	svc *image.Service
+}
+
+// NewImagesHandler creates a new images handler.
+func NewImagesHandler(svc *image.Service) *ImagesHandler {
+	return &ImagesHandler{svc: svc}
+}
+
+// RegisterRoutes registers the image catalog routes on the given router.
+func (h *ImagesHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/images", func(r chi.Router) {
+		r.Get("/", h.handleListImages)
+		r.Post("/", h.handleImportImage)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", h.handleGetImage)
+			r.Delete("/", h.handleDeleteImage)
+		})
+	})
+}
+
+// --- Request/Response DTOs ---
+
+type importImageRequest struct {
+	Name   string       `json:"name"`             // required; lowercase slug, unique
+	Source string       `json:"source"`           // required; absolute path under an import dir, or http(s) URL
+	Format string       `json:"format,omitempty"` // optional; qcow2 | raw; detected when empty
+	SHA256 string       `json:"sha256,omitempty"` // optional; expected hex digest of the source
+	OS     store.OSInfo `json:"os,omitempty"`     // optional guest OS metadata
+}
+
+type imageResponse struct {
+	Image *store.BaseImage `json:"image"`
+}
+
+type listImagesResponse struct {
+	Images []*store.BaseImage `json:"images"`
+	Total  int                `json:"total"`
+}
+
+// --- Handlers ---
+
+// @Summary List base images
+// @Description Lists catalog images ordered by name
+// @Tags Images
+// @Produce json
+// @Param status query string false "Filter by status (IMPORTING, READY, FAILED)"
+// @Param distro query string false "Filter by OS distro"
+// @Param limit query int false "Maximum number of images to return"
+// @Success 200 {object} listImagesResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listImages
+// @Router /v1/images [get]
+func (h *ImagesHandler) handleListImages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var filter store.BaseImageFilter
+	if v := q.Get("status"); v != "" {
+		st := store.ImageStatus(v)
+		filter.Status = &st
+	}
+	if v := q.Get("distro"); v != "" {
+		filter.OSDistro = &v
+	}
+	opt := &store.ListOptions{OrderBy: "name", Asc: true}
+	if l := q.Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 {
+			opt.Limit = n
+		}
+	}
+
+	list, err := h.svc.List(r.Context(), filter, opt)
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("list images: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listImagesResponse{Images: list, Total: len(list)})
+}
+
+// @Summary Import base image
+// @Description Imports a qcow2 or raw image from a local path or HTTP(S) URL, verifies its SHA256 and converts it to qcow2
+// @Description The import runs in the background; poll the image until its status is READY or FAILED
+// @Tags Images
+// @Accept json
+// @Produce json
+// @Param request body importImageRequest true "Image import parameters"
+// @Success 202 {object} imageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id importImage
+// @Router /v1/images [post]
+func (h *ImagesHandler) handleImportImage(w http.ResponseWriter, r *http.Request) {
+	var req importImageRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	img, err := h.svc.Import(r.Context(), image.ImportRequest{
+		Name:   req.Name,
+		Source: req.Source,
+		Format: req.Format,
+		SHA256: req.SHA256,
+		OS:     req.OS,
+	})
+	if errors.Is(err, image.ErrSourceNotAllowed) {
+		serverError.RespondError(w, http.StatusForbidden, fmt.Errorf("import image: %w", err))
+		return
+	}
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("import image: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusAccepted, imageResponse{Image: img})
+}
+
+// @Summary Get base image
+// @Description Returns a catalog image, including import status and checksum
+// @Tags Images
+// @Produce json
+// @Param id path string true "Image ID"
+// @Success 200 {object} imageResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id getImage
+// @Router /v1/images/{id} [get]
+func (h *ImagesHandler) handleGetImage(w http.ResponseWriter, r *http.Request) {
+	img, err := h.svc.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get image: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, imageResponse{Image: img})
+}
+
+// @Summary Delete base image
+// @Description Deletes a catalog image and its file; fails while sandboxes are backed by it
+// @Tags Images
+// @Param id path string true "Image ID"
+// @Success 204
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id deleteImage
+// @Router /v1/images/{id} [delete]
+func (h *ImagesHandler) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.Delete(r.Context(), chi.URLParam(r, "id")); err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("delete image: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,125 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	serverError "virsh-sandbox/internal/error"
+	serverJSON "virsh-sandbox/internal/json"
+	"virsh-sandbox/internal/vm"
+)
+
+// sandboxFSRoutes registers read-only file browsing of a sandbox's disk,
+// at the snapshot named in the URL or, without one, the current disk.
+func (s *Server) sandboxFSRoutes(r chi.Router) {
+	r.Get("/", s.handleListSandboxDir)
+	r.Get("/stat", s.handleStatSandboxPath)
+	r.Get("/content", s.handleReadSandboxFile)
+}
+
+// @Summary List a directory in a snapshot
+// @Description Lists a directory of the sandbox's disk as it was at the snapshot, without booting the VM. Symbolic links are followed within the guest filesystem. Use /v1/sandbox/{id}/fs for the current disk of a stopped sandbox.
+// @Tags Sandbox
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Param name path string true "Snapshot name"
+// @Param path query string false "Absolute guest path (default /)"
+// @Success 200 {object} vm.DirListing
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 501 {object} ErrorResponse
+// @Id listSnapshotDir
+// @Router /v1/sandbox/{id}/snapshots/{name}/fs [get]
+func (s *Server) handleListSandboxDir(w http.ResponseWriter, r *http.Request) {
+	id, snapshot := chi.URLParam(r, "id"), chi.URLParam(r, "name")
+	listing, err := s.vmSvc.ListSandboxDir(r.Context(), id, snapshot, r.URL.Query().Get("path"))
+	if err != nil {
+		serverError.RespondError(w, statusForFSError(err), fmt.Errorf("list directory: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listing)
+}
+
+// @Summary Stat a path in a snapshot
+// @Description Describes a path of the sandbox's disk as it was at the snapshot. A final symbolic link is not followed; its target is returned.
+// @Tags Sandbox
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Param name path string true "Snapshot name"
+// @Param path query string true "Absolute guest path"
+// @Success 200 {object} vm.FileInfo
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 501 {object} ErrorResponse
+// @Id statSnapshotPath
+// @Router /v1/sandbox/{id}/snapshots/{name}/fs/stat [get]
+func (s *Server) handleStatSandboxPath(w http.ResponseWriter, r *http.Request) {
+	id, snapshot := chi.URLParam(r, "id"), chi.URLParam(r, "name")
+	info, err := s.vmSvc.StatSandboxPath(r.Context(), id, snapshot, r.URL.Query().Get("path"))
+	if err != nil {
+		serverError.RespondError(w, statusForFSError(err), fmt.Errorf("stat: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, info)
+}
+
+// @Summary Download a file from a snapshot
+// @Description Returns the content of a regular file of the sandbox's disk as it was at the snapshot. At most FS_BROWSE_MAX_FILE_BYTES are returned per request; read larger files in ranges with offset and length. X-File-Size carries the file's full size.
+// @Tags Sandbox
+// @Produce octet-stream
+// @Param id path string true "Sandbox ID"
+// @Param name path string true "Snapshot name"
+// @Param path query string true "Absolute guest path"
+// @Param offset query int false "First byte to return"
+// @Param length query int false "Number of bytes to return (default to the end of the file)"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 501 {object} ErrorResponse
+// @Id readSnapshotFile
+// @Router /v1/sandbox/{id}/snapshots/{name}/fs/content [get]
+func (s *Server) handleReadSandboxFile(w http.ResponseWriter, r *http.Request) {
+	id, snapshot := chi.URLParam(r, "id"), chi.URLParam(r, "name")
+	q := r.URL.Query()
+	var offset, length int64
+	for name, dst := range map[string]*int64{"offset": &offset, "length": &length} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				serverError.RespondError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	content, err := s.vmSvc.ReadSandboxFile(r.Context(), id, snapshot, q.Get("path"), offset, length)
+	if err != nil {
+		serverError.RespondError(w, statusForFSError(err), fmt.Errorf("read file: %w", err))
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": content.Info.Name}))
+	h.Set("Content-Length", strconv.Itoa(len(content.Data)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-File-Size", strconv.FormatInt(content.Info.Size, 10))
+	h.Set("Last-Modified", content.Info.ModTime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(content.Data)
+}
+
+// statusForFSError maps file browsing errors to HTTP status codes.
+func statusForFSError(err error) int {
+	if errors.Is(err, vm.ErrFSUnsupported) {
+		return http.StatusNotImplemented
+	}
+	return statusForStoreError(err)
+}
@@ -11,9 +11,14 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 
 	"virsh-sandbox/internal/ansible"
+	"virsh-sandbox/internal/approval"
+	"virsh-sandbox/internal/clone"
 	serverError "virsh-sandbox/internal/error"
+	"virsh-sandbox/internal/image"
 	serverJSON "virsh-sandbox/internal/json"
 	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/policy"
+	"virsh-sandbox/internal/sshca"
 	"virsh-sandbox/internal/store"
 	"virsh-sandbox/internal/vm"
 )
@@ -24,10 +29,45 @@ type Server struct {
 	vmSvc          *vm.Service
 	domainMgr      *libvirt.DomainManager
 	ansibleHandler *ansible.Handler
+	eventsHandler  *EventsHandler
+	approvals      *approval.Service
+	images         *image.Service
+	clones         *clone.Service
+	access         *sshca.AccessService
+}
+
+// ServerOption configures optional API surfaces on the Server.
+type ServerOption func(*Server)
+
+// WithEventsHandler registers the event stream and webhook routes.
+func WithEventsHandler(h *EventsHandler) ServerOption {
+	return func(s *Server) { s.eventsHandler = h }
+}
+
+// WithApprovals enables the approval queue routes and gates configured
+// operations (and policy-flagged commands) on human approval.
+func WithApprovals(svc *approval.Service) ServerOption {
+	return func(s *Server) { s.approvals = svc }
+}
+
+// WithImages enables the base image catalog routes.
+func WithImages(svc *image.Service) ServerOption {
+	return func(s *Server) { s.images = svc }
+}
+
+// WithAccess enables the SSH certificate access routes. A nil service leaves
+// them disabled.
+func WithAccess(svc *sshca.AccessService) ServerOption {
+	return func(s *Server) { s.access = svc }
+}
+
+// WithClones enables the VM-to-container clone routes.
+func WithClones(svc *clone.Service) ServerOption {
+	return func(s *Server) { s.clones = svc }
 }
 
 // NewServer constructs a REST server with routes registered.
-func NewServer(vmSvc *vm.Service, domainMgr *libvirt.DomainManager, ansibleRunner *ansible.Runner) *Server {
+func NewServer(vmSvc *vm.Service, domainMgr *libvirt.DomainManager, ansibleRunner *ansible.Runner, opts ...ServerOption) *Server {
 	router := chi.NewRouter()
 
 	router.Use(middleware.RequestID)
@@ -45,6 +85,12 @@ func NewServer(vmSvc *vm.Service, domainMgr *libvirt.DomainManager, ansibleRunne
 		domainMgr:      domainMgr,
 		ansibleHandler: ansibleHandler,
 	}
+	for _, o := range opts {
+		o(s)
+	}
+	if s.approvals != nil {
+		s.registerApprovalExecutors()
+	}
 	s.routes()
 	return s
 }
@@ -96,9 +142,18 @@ func (s *Server) routes() {
 			r.Route("/{id}", func(r chi.Router) {
 				r.Post("/sshkey", s.handleInjectSSHKey)
 				r.Post("/start", s.handleStartSandbox)
+				r.Patch("/resources", s.handleResizeSandbox)
+				r.Post("/pause", s.handlePauseSandbox)
+				r.Post("/resume", s.handleResumeSandbox)
+				r.Post("/hibernate", s.handleHibernateSandbox)
 				r.Post("/run", s.handleRunCommand)
 				r.Post("/snapshot", s.handleCreateSnapshot)
+				r.Post("/fork", s.handleForkSandbox)
+				r.Post("/promote", s.handlePromoteSandbox)
+				r.Post("/revert", s.handleRevertSnapshot)
 				r.Post("/diff", s.handleDiffSnapshots)
+				r.Route("/fs", s.sandboxFSRoutes)
+				r.Route("/snapshots/{name}/fs", s.sandboxFSRoutes)
 
 				r.Post("/generate/{tool}", s.handleGenerate) // tool ∈ {ansible, puppet}
 				r.Post("/publish", s.handlePublish)
@@ -107,21 +162,68 @@ func (s *Server) routes() {
 			})
 		})
 
+		// Sandbox templates
+		NewTemplatesHandler(s.vmSvc).RegisterRoutes(r)
+
+		// Base image catalog
+		if s.images != nil {
+			NewImagesHandler(s.images).RegisterRoutes(r)
+		}
+
+		// VM-to-container clones
+		if s.clones != nil {
+			NewClonesHandler(s.clones).RegisterRoutes(r)
+		}
+
 		// Ansible job management
 		if s.ansibleHandler != nil {
 			s.ansibleHandler.RegisterRoutes(r)
 		}
+
+		// Human approvals
+		if s.approvals != nil {
+			NewApprovalsHandler(s.approvals).RegisterRoutes(r)
+		}
+
+		// SSH certificate access
+		if s.access != nil {
+			NewAccessHandler(s.access).RegisterRoutes(r)
+		}
+
+		// Lifecycle events and webhooks
+		if s.eventsHandler != nil {
+			s.eventsHandler.RegisterRoutes(r)
+		}
 	})
 }
 
 // --- Request/Response DTOs ---
 
 type createSandboxRequest struct {
-	SourceVMName string `json:"source_vm_name"`      // required; name of existing VM in libvirt to clone from
-	AgentID      string `json:"agent_id"`            // required
-	VMName       string `json:"vm_name,omitempty"`   // optional; generated if empty
-	CPU          int    `json:"cpu,omitempty"`       // optional; default from service config if <=0
-	MemoryMB     int    `json:"memory_mb,omitempty"` // optional; default from service config if <=0
+	SourceVMName string `json:"source_vm_name,omitempty"` // one of source_vm_name, base_image_id or template is required; existing VM in libvirt to clone from
+	BaseImageID  string `json:"base_image_id,omitempty"`  // catalog image to clone from instead of a VM
+	AgentID      string `json:"agent_id"`                 // required
+	VMName       string `json:"vm_name,omitempty"`        // optional; generated if empty
+	CPU          int    `json:"cpu,omitempty"`            // optional; default from template or service config if <=0
+	MemoryMB     int    `json:"memory_mb,omitempty"`      // optional; default from template or service config if <=0
+
+	Labels map[string]string `json:"labels,omitempty"` // optional; key/value labels used by command policies
+
+	Template   string `json:"template,omitempty"`    // optional; template name or ID; other fields override it
+	Network    string `json:"network,omitempty"`     // optional; overrides template/service network
+	TTLSeconds *int   `json:"ttl_seconds,omitempty"` // optional; overrides template TTL
+
+	CloudInit *store.CloudInitConfig `json:"cloud_init,omitempty"` // optional; merged over the template's cloud-config extras
+
+	RootDiskGB     int   `json:"root_disk_gb,omitempty"`     // optional; grow the root disk to this size (GiB)
+	ScratchDisksGB []int `json:"scratch_disks_gb,omitempty"` // optional; blank disks (GiB) attached as vdb, vdc, ...
+
+	Mounts []store.HostMount `json:"mounts,omitempty"` // optional; allowlisted host directories shared via virtiofs/9p
+
+	MaxCPU      int `json:"max_cpu,omitempty"`       // optional; vCPUs the sandbox may be resized to while running
+	MaxMemoryMB int `json:"max_memory_mb,omitempty"` // optional; memory the sandbox may be resized to while running
+
+	Runtime store.Runtime `json:"runtime,omitempty"` // optional; vm (default) or container, where source_vm_name is an image reference
 }
 
 type createSandboxResponse struct {
@@ -134,19 +236,60 @@ type injectSSHKeyRequest struct {
 }
 
 type startSandboxRequest struct {
-	WaitForIP bool `json:"wait_for_ip"` // optional; default false
+	WaitForIP        bool `json:"wait_for_ip"`         // optional; default false
+	WaitForCloudInit bool `json:"wait_for_cloud_init"` // optional; stay STARTING until cloud-init is done
+
+	// Optional SSH credentials; when set, cloud-init is polled over SSH and the
+	// template's post-boot commands are run after boot.
+	Username       string `json:"username,omitempty"`
+	PrivateKeyPath string `json:"private_key_path,omitempty"` // path on API host
+}
+
+type resizeSandboxRequest struct {
+	CPU      int `json:"cpu,omitempty"`       // optional; new vCPU count
+	MemoryMB int `json:"memory_mb,omitempty"` // optional; new memory size
+}
+
+type resizeSandboxResponse struct {
+	Sandbox *store.Sandbox `json:"sandbox"`
+	Applied string         `json:"applied"` // "live" or "next_boot"
+}
+
+type forkSandboxRequest struct {
+	Snapshot string `json:"snapshot,omitempty"` // optional; existing internal snapshot, a new one is taken if empty
+	Count    int    `json:"count,omitempty"`    // optional; number of children, default 1
+}
+
+type forkSandboxResponse struct {
+	Snapshot  *store.Snapshot  `json:"snapshot"`
+	Sandboxes []*store.Sandbox `json:"sandboxes"`
+}
+
+type promoteSandboxRequest struct {
+	Name     string       `json:"name"`                // required; catalog image name (lowercase slug)
+	Snapshot string       `json:"snapshot,omitempty"`  // optional; internal snapshot to promote instead of the current disk
+	DiffID   string       `json:"diff_id,omitempty"`   // optional; diff recorded as the image's change provenance
+	Sanitize bool         `json:"sanitize,omitempty"`  // optional; remove machine-id, SSH host keys, cloud-init state and logs
+	SourceVM string       `json:"source_vm,omitempty"` // optional; also define a libvirt domain with this name on the image
+	OS       store.OSInfo `json:"os,omitempty"`        // optional guest OS metadata
+}
+
+type sandboxStateResponse struct {
+	Sandbox *store.Sandbox `json:"sandbox"`
 }
 
 type startSandboxResponse struct {
-	IPAddress string `json:"ip_address,omitempty"`
+	IPAddress        string           `json:"ip_address,omitempty"`
+	PostBootCommands []*store.Command `json:"post_boot_commands,omitempty"`
 }
 
 type runCommandRequest struct {
-	Username       string            `json:"username"`              // required
-	PrivateKeyPath string            `json:"private_key_path"`      // required; path on API host
+	Username       string            `json:"username"`              // required for VM sandboxes
+	PrivateKeyPath string            `json:"private_key_path"`      // required for VM sandboxes; path on API host
 	Command        string            `json:"command"`               // required
 	TimeoutSec     int               `json:"timeout_sec,omitempty"` // optional; default from service config
 	Env            map[string]string `json:"env,omitempty"`         // optional
+	SecretEnv      []string          `json:"secret_env,omitempty"`  // optional; env keys whose values are redacted from the record
 }
 
 type runCommandResponse struct {
@@ -176,6 +319,10 @@ type generateResponse struct {
 	Note    string `json:"note,omitempty"`
 }
 
+type revertSnapshotRequest struct {
+	Snapshot string `json:"snapshot"` // required; snapshot name
+}
+
 type publishRequest struct {
 	JobID     string   `json:"job_id"`              // required
 	Message   string   `json:"message,omitempty"`   // optional commit/PR message
@@ -221,13 +368,21 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary Create a new sandbox
-// @Description Creates a new virtual machine sandbox by cloning from an existing VM
+// @Description Creates a new virtual machine sandbox by cloning from an existing VM or a catalog base image
+// @Description When template is set, its source VM, shape, network, TTL, labels and provisioning settings are used unless overridden in the request
+// @Description cloud_init options (packages, write_files, runcmd, users, hostname, timezone) are rendered into the NoCloud seed at key injection
+// @Description root_disk_gb grows the root disk (the guest filesystem is grown on first boot, so the SSH key must be injected before /start); scratch_disks_gb attaches blank disks as vdb, vdc, ...
+// @Description mounts share allowlisted host directories over virtiofs (9p fallback); cloud-init mounts them at guest_path on boot
+// @Description max_cpu and max_memory_mb set the headroom for live resizing; the shape is checked against quotas (403 when exceeded)
 // @Tags Sandbox
 // @Accept json
 // @Produce json
 // @Param request body createSandboxRequest true "Sandbox creation parameters"
 // @Success 201 {object} createSandboxResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Id createSandbox
 // @Router /v1/sandbox/create [post]
@@ -237,14 +392,57 @@ func (s *Server) handleCreateSandbox(w http.ResponseWriter, r *http.Request) {
 		serverError.RespondError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.SourceVMName == "" || req.AgentID == "" {
-		serverError.RespondError(w, http.StatusBadRequest, errors.New("source_vm_name and agent_id are required"))
+	if (req.SourceVMName == "" && req.BaseImageID == "" && req.Template == "") || req.AgentID == "" {
+		serverError.RespondError(w, http.StatusBadRequest, errors.New("one of source_vm_name, base_image_id or template, and agent_id are required"))
+		return
+	}
+	if req.SourceVMName != "" && req.BaseImageID != "" {
+		serverError.RespondError(w, http.StatusBadRequest, errors.New("source_vm_name and base_image_id are mutually exclusive"))
 		return
 	}
 
-	sb, err := s.vmSvc.CreateSandbox(r.Context(), req.SourceVMName, req.AgentID, req.VMName, req.CPU, req.MemoryMB)
+	opts := []vm.CreateOption{vm.WithLabels(req.Labels)}
+	if req.Template != "" {
+		opts = append(opts, vm.WithTemplate(req.Template))
+	}
+	if req.BaseImageID != "" {
+		opts = append(opts, vm.WithBaseImage(req.BaseImageID))
+	}
+	if req.Network != "" {
+		opts = append(opts, vm.WithNetwork(req.Network))
+	}
+	if req.TTLSeconds != nil {
+		opts = append(opts, vm.WithTTL(*req.TTLSeconds))
+	}
+	if req.CloudInit != nil {
+		opts = append(opts, vm.WithCloudInit(req.CloudInit))
+	}
+	if req.RootDiskGB != 0 {
+		opts = append(opts, vm.WithRootDiskSize(req.RootDiskGB))
+	}
+	if req.ScratchDisksGB != nil {
+		opts = append(opts, vm.WithScratchDisks(req.ScratchDisksGB...))
+	}
+	if len(req.Mounts) > 0 {
+		opts = append(opts, vm.WithMounts(req.Mounts...))
+	}
+	if req.MaxCPU > 0 || req.MaxMemoryMB > 0 {
+		opts = append(opts, vm.WithMaxShape(req.MaxCPU, req.MaxMemoryMB))
+	}
+	if req.Runtime != "" {
+		opts = append(opts, vm.WithRuntime(req.Runtime))
+	}
+	sb, err := s.vmSvc.CreateSandbox(r.Context(), req.SourceVMName, req.AgentID, req.VMName, req.CPU, req.MemoryMB, opts...)
+	if errors.Is(err, image.ErrNotReady) {
+		serverError.RespondError(w, http.StatusConflict, fmt.Errorf("create sandbox: %w", err))
+		return
+	}
+	if errors.Is(err, vm.ErrQuotaExceeded) {
+		serverError.RespondError(w, http.StatusForbidden, fmt.Errorf("create sandbox: %w", err))
+		return
+	}
 	if err != nil {
-		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("create sandbox: %w", err))
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("create sandbox: %w", err))
 		return
 	}
 	_ = serverJSON.RespondJSON(w, http.StatusCreated, createSandboxResponse{Sandbox: sb})
@@ -283,6 +481,9 @@ func (s *Server) handleInjectSSHKey(w http.ResponseWriter, r *http.Request) {
 
 // @Summary Start sandbox
 // @Description Starts the virtual machine sandbox
+// @Description If username and private_key_path are given, the template's post-boot commands are run once the sandbox is reachable
+// @Description With wait_for_cloud_init the sandbox stays STARTING until `cloud-init status` reports done, polled over SSH or the guest agent
+// @Description A VM sandbox with cloud_init options, mounts or root_disk_gb returns 409 until its SSH key has been injected, since they are applied with the key
 // @Tags Sandbox
 // @Accept json
 // @Produce json
@@ -290,6 +491,8 @@ func (s *Server) handleInjectSSHKey(w http.ResponseWriter, r *http.Request) {
 // @Param request body startSandboxRequest false "Start parameters"
 // @Success 200 {object} startSandboxResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Id startSandbox
 // @Router /v1/sandbox/{id}/start [post]
@@ -305,23 +508,225 @@ func (s *Server) handleStartSandbox(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ip, err := s.vmSvc.StartSandbox(r.Context(), id, req.WaitForIP)
+	var opts []vm.StartOption
+	if req.WaitForCloudInit {
+		opts = append(opts, vm.WithCloudInitWait())
+	}
+	if req.Username != "" && req.PrivateKeyPath != "" {
+		opts = append(opts, vm.WithSSHCredentials(req.Username, req.PrivateKeyPath))
+	}
+	ip, err := s.vmSvc.StartSandbox(r.Context(), id, req.WaitForIP, opts...)
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("start sandbox: %w", err))
+		return
+	}
+	resp := startSandboxResponse{IPAddress: ip}
+	if req.Username != "" && req.PrivateKeyPath != "" {
+		resp.PostBootCommands, err = s.vmSvc.RunPostBootCommands(r.Context(), id, req.Username, req.PrivateKeyPath)
+		if err != nil {
+			serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("post-boot commands: %w", err))
+			return
+		}
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, resp)
+}
+
+// @Summary Resize sandbox
+// @Description Changes the sandbox vCPUs and/or memory, subject to quotas
+// @Description A running sandbox is resized live (virsh setvcpus/setmem) when the shape fits the maximums declared at create; otherwise the persistent config is updated and the change applies on next boot
+// @Tags Sandbox
+// @Accept json
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Param request body resizeSandboxRequest true "New shape"
+// @Success 200 {object} resizeSandboxResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id resizeSandbox
+// @Router /v1/sandbox/{id}/resources [patch]
+func (s *Server) handleResizeSandbox(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req resizeSandboxRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	sb, live, err := s.vmSvc.ResizeSandbox(r.Context(), id, req.CPU, req.MemoryMB)
+	if errors.Is(err, vm.ErrQuotaExceeded) {
+		serverError.RespondError(w, http.StatusForbidden, fmt.Errorf("resize sandbox: %w", err))
+		return
+	}
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("resize sandbox: %w", err))
+		return
+	}
+	resp := resizeSandboxResponse{Sandbox: sb, Applied: "next_boot"}
+	if live {
+		resp.Applied = "live"
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, resp)
+}
+
+// @Summary Fork sandbox
+// @Description Creates count child sandboxes from a point-in-time state of the sandbox: the named internal snapshot, or a new one
+// @Description Each child gets an overlay backed by the snapshot, a new MAC address and hostname, and a record linked to the parent
+// @Description A running sandbox is paused while the snapshot is exported for the children
+// @Tags Sandbox
+// @Accept json
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Param request body forkSandboxRequest false "Fork parameters"
+// @Success 201 {object} forkSandboxResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id forkSandbox
+// @Router /v1/sandbox/{id}/fork [post]
+func (s *Server) handleForkSandbox(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	req := forkSandboxRequest{Count: 1}
+	if r.ContentLength > 0 {
+		if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+			serverError.RespondError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Count == 0 {
+			req.Count = 1
+		}
+	}
+	children, sn, err := s.vmSvc.ForkSandbox(r.Context(), id, req.Snapshot, req.Count)
+	if errors.Is(err, vm.ErrQuotaExceeded) {
+		serverError.RespondError(w, http.StatusForbidden, fmt.Errorf("fork sandbox: %w", err))
+		return
+	}
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("fork sandbox: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusCreated, forkSandboxResponse{Snapshot: sn, Sandboxes: children})
+}
+
+// @Summary Promote sandbox to base image
+// @Description Flattens the sandbox disk, or one of its internal snapshots, into a standalone image in the base image catalog
+// @Description Without a snapshot the sandbox must be CREATED or STOPPED; a running sandbox is paused while a snapshot is read. Optionally sanitizes the image and defines it as a source VM under a name no domain or sandbox uses
+// @Tags Sandbox
+// @Accept json
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Param request body promoteSandboxRequest true "Promotion parameters"
+// @Success 201 {object} imageResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id promoteSandbox
+// @Router /v1/sandbox/{id}/promote [post]
+func (s *Server) handlePromoteSandbox(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req promoteSandboxRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts := []vm.PromoteOption{vm.WithImageOS(req.OS)}
+	if req.Snapshot != "" {
+		opts = append(opts, vm.FromSnapshot(req.Snapshot))
+	}
+	if req.DiffID != "" {
+		opts = append(opts, vm.WithDiff(req.DiffID))
+	}
+	if req.Sanitize {
+		opts = append(opts, vm.WithSanitize())
+	}
+	if req.SourceVM != "" {
+		opts = append(opts, vm.AsSourceVM(req.SourceVM))
+	}
+	img, err := s.vmSvc.PromoteSandbox(r.Context(), id, req.Name, opts...)
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("promote sandbox: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusCreated, imageResponse{Image: img})
+}
+
+// @Summary Pause sandbox
+// @Description Suspends a running sandbox's vCPUs (virsh suspend); memory stays allocated and processes resume intact
+// @Tags Sandbox
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Success 200 {object} sandboxStateResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id pauseSandbox
+// @Router /v1/sandbox/{id}/pause [post]
+func (s *Server) handlePauseSandbox(w http.ResponseWriter, r *http.Request) {
+	sb, err := s.vmSvc.PauseSandbox(r.Context(), chi.URLParam(r, "id"))
 	if err != nil {
-		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("start sandbox: %w", err))
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("pause sandbox: %w", err))
 		return
 	}
-	_ = serverJSON.RespondJSON(w, http.StatusOK, startSandboxResponse{IPAddress: ip})
+	_ = serverJSON.RespondJSON(w, http.StatusOK, sandboxStateResponse{Sandbox: sb})
+}
+
+// @Summary Hibernate sandbox
+// @Description Saves a running or paused sandbox's memory state to disk (virsh managedsave) and stops it, freeing host memory
+// @Tags Sandbox
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Success 200 {object} sandboxStateResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id hibernateSandbox
+// @Router /v1/sandbox/{id}/hibernate [post]
+func (s *Server) handleHibernateSandbox(w http.ResponseWriter, r *http.Request) {
+	sb, err := s.vmSvc.HibernateSandbox(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("hibernate sandbox: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, sandboxStateResponse{Sandbox: sb})
+}
+
+// @Summary Resume sandbox
+// @Description Resumes a paused sandbox, or restores a hibernated one from its saved memory state
+// @Tags Sandbox
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Success 200 {object} sandboxStateResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id resumeSandbox
+// @Router /v1/sandbox/{id}/resume [post]
+func (s *Server) handleResumeSandbox(w http.ResponseWriter, r *http.Request) {
+	sb, err := s.vmSvc.ResumeSandbox(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("resume sandbox: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, sandboxStateResponse{Sandbox: sb})
 }
 
 // @Summary Run command in sandbox
-// @Description Executes a command inside the sandbox via SSH
+// @Description Executes a command inside the sandbox via SSH, or with podman exec for container sandboxes (which need no SSH credentials)
+// @Description Secrets in the command, env and output are redacted before the record is stored and returned
+// @Description Commands are checked against the command policy first; denied commands are recorded but not run
 // @Tags Sandbox
 // @Accept json
 // @Produce json
 // @Param id path string true "Sandbox ID"
 // @Param request body runCommandRequest true "Command execution parameters"
 // @Success 200 {object} runCommandResponse
+// @Success 202 {object} approvalPendingResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Id runSandboxCommand
 // @Router /v1/sandbox/{id}/run [post]
@@ -332,14 +737,23 @@ func (s *Server) handleRunCommand(w http.ResponseWriter, r *http.Request) {
 		serverError.RespondError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.Username == "" || req.PrivateKeyPath == "" || req.Command == "" {
-		serverError.RespondError(w, http.StatusBadRequest, errors.New("username, private_key_path and command are required"))
+	if req.Command == "" {
+		serverError.RespondError(w, http.StatusBadRequest, errors.New("command is required"))
 		return
 	}
 	timeout := time.Duration(req.TimeoutSec) * time.Second
-	cmd, err := s.vmSvc.RunCommand(r.Context(), id, req.Username, req.PrivateKeyPath, req.Command, timeout, req.Env)
+	cmd, err := s.vmSvc.RunCommand(r.Context(), id, req.Username, req.PrivateKeyPath, req.Command, timeout, req.Env,
+		vm.WithSecretEnv(req.SecretEnv...))
+	if errors.Is(err, policy.ErrApprovalRequired) && s.approvals != nil {
+		s.parkCommand(w, r, id, req, cmd, err.Error())
+		return
+	}
+	if errors.Is(err, policy.ErrDenied) || errors.Is(err, policy.ErrApprovalRequired) {
+		serverError.RespondError(w, http.StatusForbidden, fmt.Errorf("run command: %w", err))
+		return
+	}
 	if err != nil {
-		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("run command: %w", err))
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("run command: %w", err))
 		return
 	}
 	_ = serverJSON.RespondJSON(w, http.StatusOK, runCommandResponse{Command: cmd})
@@ -376,6 +790,42 @@ func (s *Server) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
 	_ = serverJSON.RespondJSON(w, http.StatusCreated, snapshotResponse{Snapshot: snap})
 }
 
+// @Summary Revert to snapshot
+// @Description Restores the sandbox to a previously created internal snapshot
+// @Tags Sandbox
+// @Accept json
+// @Produce json
+// @Param id path string true "Sandbox ID"
+// @Param request body revertSnapshotRequest true "Revert parameters"
+// @Success 204
+// @Success 202 {object} approvalPendingResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id revertSnapshot
+// @Router /v1/sandbox/{id}/revert [post]
+func (s *Server) handleRevertSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req revertSnapshotRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Snapshot == "" {
+		serverError.RespondError(w, http.StatusBadRequest, errors.New("snapshot is required"))
+		return
+	}
+	if s.requiresApproval(approval.OpRevertSnapshot) {
+		s.requestApproval(w, r, approval.OpRevertSnapshot, id, "revert requires approval", req)
+		return
+	}
+	if err := s.vmSvc.RevertSnapshot(r.Context(), id, req.Snapshot); err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("revert snapshot: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // @Summary Diff snapshots
 // @Description Computes differences between two snapshots
 // @Tags Sandbox
@@ -444,6 +894,7 @@ func (s *Server) handleGenerate(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param id path string true "Sandbox ID"
 // @Param request body publishRequest true "Publish parameters"
+// @Success 202 {object} approvalPendingResponse
 // @Success 501 {object} publishResponse
 // @Failure 400 {object} ErrorResponse
 // @Id publishChanges
@@ -458,6 +909,10 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
 		serverError.RespondError(w, http.StatusBadRequest, errors.New("job_id is required"))
 		return
 	}
+	if s.requiresApproval(approval.OpPublish) {
+		s.requestApproval(w, r, approval.OpPublish, chi.URLParam(r, "id"), "publish requires approval", req)
+		return
+	}
 	// Stub: implement when GitOps publisher is wired.
 	_ = serverJSON.RespondJSON(w, http.StatusNotImplemented, publishResponse{
 		Message: "publish not implemented yet",
@@ -497,12 +952,16 @@ func (s *Server) handleListVMs(w http.ResponseWriter, r *http.Request) {
 
 // @Summary Destroy sandbox
 // @Description Destroys the sandbox and cleans up resources
+// @Description Fails with 409 while forked children of the sandbox exist
 // @Tags Sandbox
 // @Accept json
 // @Produce json
 // @Param id path string true "Sandbox ID"
 // @Success 204
+// @Success 202 {object} approvalPendingResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Id destroySandbox
 // @Router /v1/sandbox/{id} [delete]
@@ -512,9 +971,27 @@ func (s *Server) handleDestroySandbox(w http.ResponseWriter, r *http.Request) {
 		serverError.RespondError(w, http.StatusBadRequest, errors.New("sandbox id is required"))
 		return
 	}
+	if s.requiresApproval(approval.OpDestroySandbox) {
+		s.requestApproval(w, r, approval.OpDestroySandbox, id, "destroy requires approval", nil)
+		return
+	}
 	if err := s.vmSvc.DestroySandbox(r.Context(), id); err != nil {
-		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("destroy sandbox: %w", err))
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("destroy sandbox: %w", err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// statusForStoreError maps store sentinel errors to HTTP status codes.
+func statusForStoreError(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrAlreadyExists), errors.Is(err, store.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, store.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,204 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	serverError "virsh-sandbox/internal/error"
+	serverJSON "virsh-sandbox/internal/json"
+	"virsh-sandbox/internal/store"
+	"virsh-sandbox/internal/vm"
+)
+
+// TemplatesHandler manages sandbox templates.
+type TemplatesHandler struct {
+	svc *vm.Service
+}
+
+// NewTemplatesHandler creates a new templates handler.
+func NewTemplatesHandler(svc *vm.Service) *TemplatesHandler {
+	return &TemplatesHandler{svc: svc}
+}
+
+// RegisterRoutes registers the template routes on the given router.
+func (h *TemplatesHandler) RegisterRoutes(r chi.Router) {
+	r.Route("/templates", func(r chi.Router) {
+		r.Get("/", h.handleListTemplates)
+		r.Post("/", h.handleCreateTemplate)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", h.handleGetTemplate)
+			r.Put("/", h.handleUpdateTemplate)
+			r.Delete("/", h.handleDeleteTemplate)
+		})
+	})
+}
+
+// --- Request/Response DTOs ---
+
+type templateRequest struct {
+	Name        string            `json:"name"`                    // required; lowercase slug, unique
+	Version     int               `json:"version,omitempty"`       // optional on update; must match the current version
+	Description string            `json:"description,omitempty"`   // optional
+	Runtime     store.Runtime     `json:"runtime,omitempty"`       // optional; vm (default) or container, where source_vm is an image reference
+	SourceVM    string            `json:"source_vm,omitempty"`     // one of source_vm or base_image_id is required
+	BaseImageID string            `json:"base_image_id,omitempty"` // catalog image to clone from
+	CPU         int               `json:"cpu,omitempty"`           // optional; service default if <=0
+	MemoryMB    int               `json:"memory_mb,omitempty"`     // optional; service default if <=0
+	Network     string            `json:"network,omitempty"`       // optional; libvirt network
+	TTLSeconds  *int              `json:"ttl_seconds,omitempty"`   // optional
+	Labels      map[string]string `json:"labels,omitempty"`        // optional
+
+	KeyInjectMethod  string                 `json:"key_inject_method,omitempty"`  // optional; virt-customize | cloud-init
+	CloudInit        *store.CloudInitConfig `json:"cloud_init,omitempty"`         // optional cloud-config extras
+	PostBootCommands []string               `json:"post_boot_commands,omitempty"` // optional; run after start
+
+	RootDiskGB     int   `json:"root_disk_gb,omitempty"`     // optional; root disk size (GiB)
+	ScratchDisksGB []int `json:"scratch_disks_gb,omitempty"` // optional; blank disks (GiB) attached as vdb, vdc, ...
+
+	Mounts []store.HostMount `json:"mounts,omitempty"` // optional; allowlisted host directories shared into the guest
+}
+
+type templateResponse struct {
+	Template *store.SandboxTemplate `json:"template"`
+}
+
+type listTemplatesResponse struct {
+	Templates []*store.SandboxTemplate `json:"templates"`
+	Total     int                      `json:"total"`
+}
+
+func (req templateRequest) toTemplate() *store.SandboxTemplate {
+	return &store.SandboxTemplate{
+		Name:        req.Name,
+		Version:     req.Version,
+		Description: req.Description,
+		Runtime:     req.Runtime,
+		SourceVM:    req.SourceVM,
+		BaseImageID: req.BaseImageID,
+		CPU:         req.CPU,
+		MemoryMB:    req.MemoryMB,
+		Network:     req.Network,
+		TTLSeconds:  req.TTLSeconds,
+		Labels:      req.Labels,
+		Spec: store.SandboxSpec{
+			KeyInjectMethod:  req.KeyInjectMethod,
+			CloudInit:        req.CloudInit,
+			PostBootCommands: req.PostBootCommands,
+			RootDiskGB:       req.RootDiskGB,
+			ScratchDisksGB:   req.ScratchDisksGB,
+			Mounts:           req.Mounts,
+		},
+	}
+}
+
+// --- Handlers ---
+
+// @Summary List sandbox templates
+// @Description Lists sandbox templates ordered by name
+// @Tags Templates
+// @Produce json
+// @Success 200 {object} listTemplatesResponse
+// @Failure 500 {object} ErrorResponse
+// @Id listTemplates
+// @Router /v1/templates [get]
+func (h *TemplatesHandler) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	list, err := h.svc.ListTemplates(r.Context(), &store.ListOptions{OrderBy: "name", Asc: true})
+	if err != nil {
+		serverError.RespondError(w, http.StatusInternalServerError, fmt.Errorf("list templates: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, listTemplatesResponse{Templates: list, Total: len(list)})
+}
+
+// @Summary Create sandbox template
+// @Description Creates a named template bundling source VM or base image, shape, disks, mounts, network, TTL, key injection, cloud-init extras, labels and post-boot commands
+// @Tags Templates
+// @Accept json
+// @Produce json
+// @Param request body templateRequest true "Template definition"
+// @Success 201 {object} templateResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id createTemplate
+// @Router /v1/templates [post]
+func (h *TemplatesHandler) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req templateRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	t, err := h.svc.CreateTemplate(r.Context(), req.toTemplate())
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("create template: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusCreated, templateResponse{Template: t})
+}
+
+// @Summary Get sandbox template
+// @Description Returns a template by ID or name
+// @Tags Templates
+// @Produce json
+// @Param id path string true "Template ID or name"
+// @Success 200 {object} templateResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id getTemplate
+// @Router /v1/templates/{id} [get]
+func (h *TemplatesHandler) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := h.svc.GetTemplate(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("get template: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, templateResponse{Template: t})
+}
+
+// @Summary Update sandbox template
+// @Description Replaces a template and increments its version; existing sandboxes keep the version they were created from
+// @Tags Templates
+// @Accept json
+// @Produce json
+// @Param id path string true "Template ID or name"
+// @Param request body templateRequest true "Template definition"
+// @Success 200 {object} templateResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id updateTemplate
+// @Router /v1/templates/{id} [put]
+func (h *TemplatesHandler) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req templateRequest
+	if err := serverJSON.DecodeJSON(r.Context(), r, &req); err != nil {
+		serverError.RespondError(w, http.StatusBadRequest, err)
+		return
+	}
+	t, err := h.svc.UpdateTemplate(r.Context(), chi.URLParam(r, "id"), req.toTemplate())
+	if err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("update template: %w", err))
+		return
+	}
+	_ = serverJSON.RespondJSON(w, http.StatusOK, templateResponse{Template: t})
+}
+
+// @Summary Delete sandbox template
+// @Description Deletes a template; sandboxes created from it are unaffected
+// @Tags Templates
+// @Param id path string true "Template ID or name"
+// @Success 204
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Id deleteTemplate
+// @Router /v1/templates/{id} [delete]
+func (h *TemplatesHandler) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DeleteTemplate(r.Context(), chi.URLParam(r, "id")); err != nil {
+		serverError.RespondError(w, statusForStoreError(err), fmt.Errorf("delete template: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+
+	"virsh-sandbox/internal/events"
 )
 
 // AccessService orchestrates SSH certificate-based access to sandboxes.
@@ -19,6 +21,7 @@ type AccessService struct {
 	ca        *CA
 	store     CertificateStore
 	vmLookup  VMInfoProvider
+	events    events.Publisher
 	timeNowFn func() time.Time
 	mu        sync.RWMutex
 
@@ -74,6 +77,11 @@ func WithAccessTimeNow(fn func() time.Time) AccessServiceOption {
 	return func(s *AccessService) { s.timeNowFn = fn }
 }
 
+// WithAccessEventPublisher sets the publisher that receives access lifecycle events.
+func WithAccessEventPublisher(p events.Publisher) AccessServiceOption {
+	return func(s *AccessService) { s.events = p }
+}
+
 // NewAccessService creates a new access service.
 func NewAccessService(ca *CA, store CertificateStore, vmLookup VMInfoProvider, cfg AccessServiceConfig, opts ...AccessServiceOption) *AccessService {
 	if cfg.DefaultTTL == 0 {
@@ -93,6 +101,7 @@ func NewAccessService(ca *CA, store CertificateStore, vmLookup VMInfoProvider, c
 		ca:         ca,
 		store:      store,
 		vmLookup:   vmLookup,
+		events:     events.Discard,
 		timeNowFn:  time.Now,
 		defaultTTL: cfg.DefaultTTL,
 		maxTTL:     cfg.MaxTTL,
@@ -211,6 +220,17 @@ func (s *AccessService) RequestAccess(ctx context.Context, req *AccessRequest) (
 	validUntil := cert.ValidBefore
 	ttlSeconds := int(validUntil.Sub(now).Seconds())
 
+	s.events.Publish(ctx, events.Event{
+		Type:      events.TypeAccessGranted,
+		SandboxID: req.SandboxID,
+		Timestamp: now.UTC(),
+		Data: map[string]any{
+			"certificate_id": cert.ID,
+			"user_id":        req.UserID,
+			"valid_until":    validUntil,
+		},
+	})
+
 	connectCmd := fmt.Sprintf("ssh -i /path/to/key -o CertificateFile=/path/to/key-cert.pub -o StrictHostKeyChecking=no %s@%s",
 		s.username, vmIP)
 
@@ -263,9 +283,21 @@ func (s *AccessService) RevokeAccess(ctx context.Context, certificateID, reason
 				// Log but continue
 				continue
 			}
+			s.publishSessionEnded(ctx, session, "certificate revoked: "+reason)
 		}
 	}
 
+	s.events.Publish(ctx, events.Event{
+		Type:      events.TypeAccessRevoked,
+		SandboxID: cert.SandboxID,
+		Timestamp: s.timeNowFn().UTC(),
+		Data: map[string]any{
+			"certificate_id": certificateID,
+			"user_id":        cert.UserID,
+			"reason":         reason,
+		},
+	})
+
 	return nil
 }
 
@@ -323,6 +355,18 @@ func (s *AccessService) RecordSessionStart(ctx context.Context, certificateID, s
 		// Non-fatal
 	}
 
+	s.events.Publish(ctx, events.Event{
+		Type:      events.TypeSessionStarted,
+		SandboxID: cert.SandboxID,
+		Timestamp: now.UTC(),
+		Data: map[string]any{
+			"session_id":     sessionID,
+			"certificate_id": certificateID,
+			"user_id":        cert.UserID,
+			"source_ip":      sourceIP,
+		},
+	})
+
 	return sessionID, nil
 }
 
@@ -336,7 +380,28 @@ func (s *AccessService) RecordSessionEnd(ctx context.Context, sessionID, reason
 	}
 
 	now := s.timeNowFn()
-	return s.store.EndSession(ctx, sessionID, now, reason)
+	if err := s.store.EndSession(ctx, sessionID, now, reason); err != nil {
+		return err
+	}
+	if session, err := s.store.GetSession(ctx, sessionID); err == nil {
+		s.publishSessionEnded(ctx, session, reason)
+	}
+	return nil
+}
+
+// publishSessionEnded emits an access.session.ended event for session.
+func (s *AccessService) publishSessionEnded(ctx context.Context, session *AccessSession, reason string) {
+	s.events.Publish(ctx, events.Event{
+		Type:      events.TypeSessionEnded,
+		SandboxID: session.SandboxID,
+		Timestamp: s.timeNowFn().UTC(),
+		Data: map[string]any{
+			"session_id":     session.ID,
+			"certificate_id": session.CertificateID,
+			"user_id":        session.UserID,
+			"reason":         reason,
+		},
+	})
 }
 
 // GetCertificate retrieves certificate information.
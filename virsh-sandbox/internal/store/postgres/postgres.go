@@ -125,7 +125,11 @@ func (s *postgresStore) CreateSandbox(ctx context.Context, sb *store.Sandbox) er
 	sb.CreatedAt = now
 	sb.UpdatedAt = now
 
-	if err := s.db.WithContext(ctx).Create(sandboxToModel(sb)).Error; err != nil {
+	model, err := sandboxToModel(sb)
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(model).Error; err != nil {
 		return mapDBError(err)
 	}
 	return nil
@@ -138,17 +142,17 @@ func (s *postgresStore) GetSandbox(ctx context.Context, id string) (*store.Sandb
 		First(&model).Error; err != nil {
 		return nil, mapDBError(err)
 	}
-	return sandboxFromModel(&model), nil
+	return sandboxFromModel(&model)
 }
 
 func (s *postgresStore) GetSandboxByVMName(ctx context.Context, vmName string) (*store.Sandbox, error) {
 	var model SandboxModel
 	if err := s.db.WithContext(ctx).
-		Where("vm_name = ? AND deleted_at IS NULL", vmName).
+		Where("sandbox_name = ? AND deleted_at IS NULL", vmName).
 		First(&model).Error; err != nil {
 		return nil, mapDBError(err)
 	}
-	return sandboxFromModel(&model), nil
+	return sandboxFromModel(&model)
 }
 
 func (s *postgresStore) ListSandboxes(ctx context.Context, filter store.SandboxFilter, opt *store.ListOptions) ([]*store.Sandbox, error) {
@@ -166,13 +170,19 @@ func (s *postgresStore) ListSandboxes(ctx context.Context, filter store.SandboxF
 		tx = tx.Where("state = ?", string(*filter.State))
 	}
 	if filter.VMName != nil {
-		tx = tx.Where("vm_name = ?", *filter.VMName)
+		tx = tx.Where("sandbox_name = ?", *filter.VMName)
+	}
+	if filter.Template != nil {
+		tx = tx.Where("template_name = ?", *filter.Template)
+	}
+	if filter.ParentID != nil {
+		tx = tx.Where("parent_id = ?", *filter.ParentID)
 	}
 
 	tx = applyListOptions(tx, opt, map[string]string{
 		"created_at": "created_at",
 		"updated_at": "updated_at",
-		"vm_name":    "vm_name",
+		"vm_name":    "sandbox_name",
 	})
 
 	var models []SandboxModel
@@ -182,7 +192,11 @@ func (s *postgresStore) ListSandboxes(ctx context.Context, filter store.SandboxF
 
 	out := make([]*store.Sandbox, 0, len(models))
 	for i := range models {
-		out = append(out, sandboxFromModel(&models[i]))
+		sb, err := sandboxFromModel(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sb)
 	}
 	return out, nil
 }
@@ -195,21 +209,36 @@ func (s *postgresStore) UpdateSandbox(ctx context.Context, sb *store.Sandbox) er
 		return fmt.Errorf("postgres: UpdateSandbox: %w", store.ErrInvalid)
 	}
 	sb.UpdatedAt = time.Now().UTC()
-	model := sandboxToModel(sb)
+	model, err := sandboxToModel(sb)
+	if err != nil {
+		return err
+	}
 
 	res := s.db.WithContext(ctx).
 		Model(&SandboxModel{}).
 		Where("id = ? AND deleted_at IS NULL", sb.ID).
 		Updates(map[string]any{
-			"job_id":       model.JobID,
-			"agent_id":     model.AgentID,
-			"sandbox_name": model.SandboxName,
-			"base_image":   model.BaseImage,
-			"network":      model.Network,
-			"ip":           model.IPAddress,
-			"state":        model.State,
-			"ttl_seconds":  model.TTLSeconds,
-			"updated_at":   model.UpdatedAt,
+			"job_id":           model.JobID,
+			"agent_id":         model.AgentID,
+			"sandbox_name":     model.SandboxName,
+			"base_image":       model.BaseImage,
+			"network":          model.Network,
+			"ip":               model.IPAddress,
+			"state":            model.State,
+			"ttl_seconds":      model.TTLSeconds,
+			"runtime":          model.Runtime,
+			"cpu":              model.CPU,
+			"memory_mb":        model.MemoryMB,
+			"max_cpu":          model.MaxCPU,
+			"max_memory_mb":    model.MaxMemoryMB,
+			"labels":           model.Labels,
+			"template_name":    model.TemplateName,
+			"template_version": model.TemplateVersion,
+			"spec":             model.Spec,
+			"provisioned_at":   model.ProvisionedAt,
+			"parent_id":        model.ParentID,
+			"parent_snapshot":  model.ParentSnapshot,
+			"updated_at":       model.UpdatedAt,
 		})
 
 	if err := mapDBError(res.Error); err != nil {
@@ -269,6 +298,241 @@ func (s *postgresStore) DeleteSandbox(ctx context.Context, id string) error {
 	return nil
 }
 
+// --- SandboxTemplate ---
+
+func (s *postgresStore) CreateTemplate(ctx context.Context, t *store.SandboxTemplate) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: CreateTemplate: %w", store.ErrInvalid)
+	}
+	if t == nil || t.ID == "" || t.Name == "" || (t.SourceVM == "" && t.BaseImageID == "") {
+		return fmt.Errorf("postgres: CreateTemplate: %w", store.ErrInvalid)
+	}
+	now := time.Now().UTC()
+	t.Version = 1
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	model, err := templateToModel(t)
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(model).Error; err != nil {
+		return mapDBError(err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetTemplate(ctx context.Context, id string) (*store.SandboxTemplate, error) {
+	var model SandboxTemplateModel
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&model).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return templateFromModel(&model)
+}
+
+func (s *postgresStore) GetTemplateByName(ctx context.Context, name string) (*store.SandboxTemplate, error) {
+	var model SandboxTemplateModel
+	if err := s.db.WithContext(ctx).Where("name = ?", name).First(&model).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return templateFromModel(&model)
+}
+
+func (s *postgresStore) ListTemplates(ctx context.Context, opt *store.ListOptions) ([]*store.SandboxTemplate, error) {
+	tx := s.db.WithContext(ctx).Model(&SandboxTemplateModel{})
+	tx = applyListOptions(tx, opt, map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+		"updated_at": "updated_at",
+	})
+
+	var models []SandboxTemplateModel
+	if err := tx.Find(&models).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	out := make([]*store.SandboxTemplate, 0, len(models))
+	for i := range models {
+		t, err := templateFromModel(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (s *postgresStore) UpdateTemplate(ctx context.Context, t *store.SandboxTemplate) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: UpdateTemplate: %w", store.ErrInvalid)
+	}
+	if t == nil || t.ID == "" || t.Name == "" || (t.SourceVM == "" && t.BaseImageID == "") {
+		return fmt.Errorf("postgres: UpdateTemplate: %w", store.ErrInvalid)
+	}
+	t.UpdatedAt = time.Now().UTC()
+	model, err := templateToModel(t)
+	if err != nil {
+		return err
+	}
+
+	res := s.db.WithContext(ctx).
+		Model(&SandboxTemplateModel{}).
+		Where("id = ? AND version = ?", t.ID, t.Version).
+		Updates(map[string]any{
+			"name":          model.Name,
+			"version":       t.Version + 1,
+			"description":   model.Description,
+			"runtime":       model.Runtime,
+			"source_vm":     model.SourceVM,
+			"base_image_id": model.BaseImageID,
+			"cpu":           model.CPU,
+			"memory_mb":     model.MemoryMB,
+			"network":       model.Network,
+			"ttl_seconds":   model.TTLSeconds,
+			"labels":        model.Labels,
+			"spec":          model.Spec,
+			"updated_at":    model.UpdatedAt,
+		})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.GetTemplate(ctx, t.ID); err != nil {
+			return err
+		}
+		return store.ErrConflict
+	}
+	t.Version++
+	return nil
+}
+
+func (s *postgresStore) DeleteTemplate(ctx context.Context, id string) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: DeleteTemplate: %w", store.ErrInvalid)
+	}
+	if id == "" {
+		return fmt.Errorf("postgres: DeleteTemplate: %w", store.ErrInvalid)
+	}
+	res := s.db.WithContext(ctx).Where("id = ?", id).Delete(&SandboxTemplateModel{})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// --- BaseImage ---
+
+func (s *postgresStore) CreateBaseImage(ctx context.Context, img *store.BaseImage) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: CreateBaseImage: %w", store.ErrInvalid)
+	}
+	if img == nil || img.ID == "" || img.Name == "" || img.Filename == "" || img.Status == "" {
+		return fmt.Errorf("postgres: CreateBaseImage: %w", store.ErrInvalid)
+	}
+	now := time.Now().UTC()
+	img.CreatedAt = now
+	img.UpdatedAt = now
+	model, err := baseImageToModel(img)
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(model).Error; err != nil {
+		return mapDBError(err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetBaseImage(ctx context.Context, id string) (*store.BaseImage, error) {
+	var model BaseImageModel
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&model).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return baseImageFromModel(&model)
+}
+
+func (s *postgresStore) ListBaseImages(ctx context.Context, filter store.BaseImageFilter, opt *store.ListOptions) ([]*store.BaseImage, error) {
+	tx := s.db.WithContext(ctx).Model(&BaseImageModel{})
+	if filter.Status != nil {
+		tx = tx.Where("status = ?", string(*filter.Status))
+	}
+	if filter.OSDistro != nil {
+		tx = tx.Where("os->>'distro' = ?", *filter.OSDistro)
+	}
+	tx = applyListOptions(tx, opt, map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+	})
+
+	var models []BaseImageModel
+	if err := tx.Find(&models).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	out := make([]*store.BaseImage, 0, len(models))
+	for i := range models {
+		img, err := baseImageFromModel(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, img)
+	}
+	return out, nil
+}
+
+func (s *postgresStore) UpdateBaseImage(ctx context.Context, img *store.BaseImage) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: UpdateBaseImage: %w", store.ErrInvalid)
+	}
+	if img == nil || img.ID == "" {
+		return fmt.Errorf("postgres: UpdateBaseImage: %w", store.ErrInvalid)
+	}
+	img.UpdatedAt = time.Now().UTC()
+	model, err := baseImageToModel(img)
+	if err != nil {
+		return err
+	}
+
+	res := s.db.WithContext(ctx).
+		Model(&BaseImageModel{}).
+		Where("id = ?", img.ID).
+		Updates(map[string]any{
+			"filename":           model.Filename,
+			"source_format":      model.SourceFormat,
+			"sha256":             model.SHA256,
+			"size_bytes":         model.SizeBytes,
+			"virtual_size_bytes": model.VirtualSizeBytes,
+			"os":                 model.OS,
+			"status":             model.Status,
+			"error":              model.Error,
+			"provenance":         model.Provenance,
+			"updated_at":         model.UpdatedAt,
+		})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) DeleteBaseImage(ctx context.Context, id string) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: DeleteBaseImage: %w", store.ErrInvalid)
+	}
+	if id == "" {
+		return fmt.Errorf("postgres: DeleteBaseImage: %w", store.ErrInvalid)
+	}
+	res := s.db.WithContext(ctx).Where("id = ?", id).Delete(&BaseImageModel{})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
 // --- Snapshot ---
 
 func (s *postgresStore) CreateSnapshot(ctx context.Context, sn *store.Snapshot) error {
@@ -339,7 +603,11 @@ func (s *postgresStore) SaveCommand(ctx context.Context, cmd *store.Command) err
 		cmd.EndedAt = time.Now().UTC()
 	}
 
-	if err := s.db.WithContext(ctx).Create(commandToModel(cmd)).Error; err != nil {
+	model, err := commandToModel(cmd)
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(model).Error; err != nil {
 		return mapDBError(err)
 	}
 	return nil
@@ -499,38 +767,391 @@ func (s *postgresStore) GetPublication(ctx context.Context, id string) (*store.P
 	return publicationFromModel(&model), nil
 }
 
+// --- Webhook ---
+
+func (s *postgresStore) CreateWebhook(ctx context.Context, wh *store.Webhook) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: CreateWebhook: %w", store.ErrInvalid)
+	}
+	if wh == nil || wh.ID == "" || wh.URL == "" || wh.Secret == "" {
+		return fmt.Errorf("postgres: CreateWebhook: %w", store.ErrInvalid)
+	}
+	now := time.Now().UTC()
+	if wh.CreatedAt.IsZero() {
+		wh.CreatedAt = now
+	}
+	wh.UpdatedAt = now
+	model, err := webhookToModel(wh)
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(model).Error; err != nil {
+		return mapDBError(err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetWebhook(ctx context.Context, id string) (*store.Webhook, error) {
+	var model WebhookModel
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&model).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return webhookFromModel(&model)
+}
+
+func (s *postgresStore) ListWebhooks(ctx context.Context, opt *store.ListOptions) ([]*store.Webhook, error) {
+	tx := s.db.WithContext(ctx).Model(&WebhookModel{})
+	tx = applyListOptions(tx, opt, map[string]string{
+		"created_at": "created_at",
+		"updated_at": "updated_at",
+	})
+
+	var models []WebhookModel
+	if err := tx.Find(&models).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	out := make([]*store.Webhook, 0, len(models))
+	for i := range models {
+		wh, err := webhookFromModel(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, wh)
+	}
+	return out, nil
+}
+
+func (s *postgresStore) DeleteWebhook(ctx context.Context, id string) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: DeleteWebhook: %w", store.ErrInvalid)
+	}
+	if id == "" {
+		return fmt.Errorf("postgres: DeleteWebhook: %w", store.ErrInvalid)
+	}
+	res := s.db.WithContext(ctx).Where("id = ?", id).Delete(&WebhookModel{})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (s *postgresStore) SaveWebhookDelivery(ctx context.Context, d *store.WebhookDelivery) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: SaveWebhookDelivery: %w", store.ErrInvalid)
+	}
+	if d == nil || d.ID == "" || d.WebhookID == "" || d.EventID == "" || d.EventType == "" {
+		return fmt.Errorf("postgres: SaveWebhookDelivery: %w", store.ErrInvalid)
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	if err := s.db.WithContext(ctx).Create(webhookDeliveryToModel(d)).Error; err != nil {
+		return mapDBError(err)
+	}
+	return nil
+}
+
+func (s *postgresStore) ListWebhookDeliveries(ctx context.Context, webhookID string, opt *store.ListOptions) ([]*store.WebhookDelivery, error) {
+	tx := s.db.WithContext(ctx).Model(&WebhookDeliveryModel{}).Where("webhook_id = ?", webhookID)
+	tx = applyListOptions(tx, opt, map[string]string{
+		"created_at": "created_at",
+	})
+
+	var models []WebhookDeliveryModel
+	if err := tx.Find(&models).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	out := make([]*store.WebhookDelivery, 0, len(models))
+	for i := range models {
+		out = append(out, webhookDeliveryFromModel(&models[i]))
+	}
+	return out, nil
+}
+
+// --- Approval ---
+
+func (s *postgresStore) CreateApproval(ctx context.Context, a *store.Approval) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: CreateApproval: %w", store.ErrInvalid)
+	}
+	if a == nil || a.ID == "" || a.SandboxID == "" || a.Operation == "" || a.Status == "" {
+		return fmt.Errorf("postgres: CreateApproval: %w", store.ErrInvalid)
+	}
+	now := time.Now().UTC()
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = now
+	}
+	a.UpdatedAt = now
+	if err := s.db.WithContext(ctx).Create(approvalToModel(a)).Error; err != nil {
+		return mapDBError(err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetApproval(ctx context.Context, id string) (*store.Approval, error) {
+	var model ApprovalModel
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&model).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return approvalFromModel(&model), nil
+}
+
+func (s *postgresStore) ListApprovals(ctx context.Context, filter store.ApprovalFilter, opt *store.ListOptions) ([]*store.Approval, error) {
+	tx := s.db.WithContext(ctx).Model(&ApprovalModel{})
+	if filter.SandboxID != nil {
+		tx = tx.Where("sandbox_id = ?", *filter.SandboxID)
+	}
+	if filter.JobID != nil {
+		tx = tx.Where("job_id = ?", *filter.JobID)
+	}
+	if filter.Operation != nil {
+		tx = tx.Where("operation = ?", *filter.Operation)
+	}
+	if filter.Status != nil {
+		tx = tx.Where("status = ?", string(*filter.Status))
+	}
+	tx = applyListOptions(tx, opt, map[string]string{
+		"created_at": "created_at",
+		"expires_at": "expires_at",
+	})
+
+	var models []ApprovalModel
+	if err := tx.Find(&models).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	out := make([]*store.Approval, 0, len(models))
+	for i := range models {
+		out = append(out, approvalFromModel(&models[i]))
+	}
+	return out, nil
+}
+
+func (s *postgresStore) UpdateApproval(ctx context.Context, a *store.Approval, expect store.ApprovalStatus) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: UpdateApproval: %w", store.ErrInvalid)
+	}
+	if a == nil || a.ID == "" {
+		return fmt.Errorf("postgres: UpdateApproval: %w", store.ErrInvalid)
+	}
+	a.UpdatedAt = time.Now().UTC()
+	model := approvalToModel(a)
+
+	res := s.db.WithContext(ctx).
+		Model(&ApprovalModel{}).
+		Where("id = ? AND status = ?", a.ID, string(expect)).
+		Updates(map[string]any{
+			"status":        model.Status,
+			"decided_by":    model.DecidedBy,
+			"decision_note": model.DecisionNote,
+			"decided_at":    model.DecidedAt,
+			"executed_at":   model.ExecutedAt,
+			"result":        model.ResultJSON,
+			"error":         model.Error,
+			"updated_at":    model.UpdatedAt,
+		})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.GetApproval(ctx, a.ID); err != nil {
+			return err
+		}
+		return store.ErrConflict
+	}
+	return nil
+}
+
+// --- WorkflowRun ---
+
+func (s *postgresStore) CreateWorkflowRun(ctx context.Context, run *store.WorkflowRun) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: CreateWorkflowRun: %w", store.ErrInvalid)
+	}
+	if run == nil || run.ID == "" || run.Kind == "" || run.Status == "" {
+		return fmt.Errorf("postgres: CreateWorkflowRun: %w", store.ErrInvalid)
+	}
+	now := time.Now().UTC()
+	if run.CreatedAt.IsZero() {
+		run.CreatedAt = now
+	}
+	run.UpdatedAt = now
+	model, err := workflowRunToModel(run)
+	if err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(model).Error; err != nil {
+		return mapDBError(err)
+	}
+	return nil
+}
+
+func (s *postgresStore) GetWorkflowRun(ctx context.Context, id string) (*store.WorkflowRun, error) {
+	var model WorkflowRunModel
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&model).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return workflowRunFromModel(&model)
+}
+
+func (s *postgresStore) ListWorkflowRuns(ctx context.Context, filter store.WorkflowRunFilter, opt *store.ListOptions) ([]*store.WorkflowRun, error) {
+	tx := s.db.WithContext(ctx).Model(&WorkflowRunModel{})
+	if filter.Kind != nil {
+		tx = tx.Where("kind = ?", *filter.Kind)
+	}
+	if filter.Subject != nil {
+		tx = tx.Where("subject = ?", *filter.Subject)
+	}
+	if filter.Status != nil {
+		tx = tx.Where("status = ?", string(*filter.Status))
+	}
+	tx = applyListOptions(tx, opt, map[string]string{
+		"created_at": "created_at",
+		"updated_at": "updated_at",
+	})
+
+	var models []WorkflowRunModel
+	if err := tx.Find(&models).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	out := make([]*store.WorkflowRun, 0, len(models))
+	for i := range models {
+		run, err := workflowRunFromModel(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, run)
+	}
+	return out, nil
+}
+
+func (s *postgresStore) UpdateWorkflowRun(ctx context.Context, run *store.WorkflowRun) error {
+	if s.conf.ReadOnly {
+		return fmt.Errorf("postgres: UpdateWorkflowRun: %w", store.ErrInvalid)
+	}
+	if run == nil || run.ID == "" {
+		return fmt.Errorf("postgres: UpdateWorkflowRun: %w", store.ErrInvalid)
+	}
+	run.UpdatedAt = time.Now().UTC()
+	model, err := workflowRunToModel(run)
+	if err != nil {
+		return err
+	}
+
+	res := s.db.WithContext(ctx).
+		Model(&WorkflowRunModel{}).
+		Where("id = ?", run.ID).
+		Updates(map[string]any{
+			"status":       model.Status,
+			"stage":        model.Stage,
+			"stages":       model.Stages,
+			"outputs":      model.Outputs,
+			"cleanups":     model.Cleanups,
+			"attempts":     model.Attempts,
+			"error":        model.Error,
+			"error_detail": model.ErrorDetail,
+			"updated_at":   model.UpdatedAt,
+		})
+	if err := mapDBError(res.Error); err != nil {
+		return err
+	}
+	if res.RowsAffected == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
 // --- Migration ---
 
 func (s *postgresStore) autoMigrate(ctx context.Context) error {
 	return s.db.WithContext(ctx).AutoMigrate(
 		&SandboxModel{},
+		&SandboxTemplateModel{},
+		&BaseImageModel{},
 		&SnapshotModel{},
 		&CommandModel{},
 		&DiffModel{},
 		&ChangeSetModel{},
 		&PublicationModel{},
+		&WebhookModel{},
+		&WebhookDeliveryModel{},
+		&ApprovalModel{},
+		&WorkflowRunModel{},
 	)
 }
 
 // --- Models & Converters ---
 
 type SandboxModel struct {
-	ID          string     `gorm:"primaryKey;column:id"`
-	JobID       string     `gorm:"column:job_id;not null;index"`
-	AgentID     string     `gorm:"column:agent_id;not null;index"`
-	SandboxName string     `gorm:"column:sandbox_name;not null;uniqueIndex"`
-	BaseImage   string     `gorm:"column:base_image;not null;index"`
-	Network     string     `gorm:"column:network;not null"`
-	IPAddress   *string    `gorm:"column:ip"`
-	State       string     `gorm:"column:state;not null;index"`
-	TTLSeconds  *int       `gorm:"column:ttl_seconds"`
-	CreatedAt   time.Time  `gorm:"column:created_at;not null"`
-	UpdatedAt   time.Time  `gorm:"column:updated_at;not null"`
-	DeletedAt   *time.Time `gorm:"column:deleted_at;index"`
+	ID              string         `gorm:"primaryKey;column:id"`
+	JobID           string         `gorm:"column:job_id;not null;index"`
+	AgentID         string         `gorm:"column:agent_id;not null;index"`
+	SandboxName     string         `gorm:"column:sandbox_name;not null;uniqueIndex"`
+	BaseImage       string         `gorm:"column:base_image;not null;index"`
+	Network         string         `gorm:"column:network;not null"`
+	IPAddress       *string        `gorm:"column:ip"`
+	State           string         `gorm:"column:state;not null;index"`
+	TTLSeconds      *int           `gorm:"column:ttl_seconds"`
+	Runtime         string         `gorm:"column:runtime"`
+	CPU             int            `gorm:"column:cpu"`
+	MemoryMB        int            `gorm:"column:memory_mb"`
+	MaxCPU          int            `gorm:"column:max_cpu"`
+	MaxMemoryMB     int            `gorm:"column:max_memory_mb"`
+	Labels          datatypes.JSON `gorm:"column:labels;type:jsonb"`
+	TemplateName    *string        `gorm:"column:template_name;index"`
+	TemplateVersion *int           `gorm:"column:template_version"`
+	Spec            datatypes.JSON `gorm:"column:spec;type:jsonb"`
+	ProvisionedAt   *time.Time     `gorm:"column:provisioned_at"`
+	ParentID        *string        `gorm:"column:parent_id;index"`
+	ParentSnapshot  *string        `gorm:"column:parent_snapshot"`
+	CreatedAt       time.Time      `gorm:"column:created_at;not null"`
+	UpdatedAt       time.Time      `gorm:"column:updated_at;not null"`
+	DeletedAt       *time.Time     `gorm:"column:deleted_at;index"`
 }
 
 func (SandboxModel) TableName() string { return "sandboxes" }
 
+type SandboxTemplateModel struct {
+	ID          string         `gorm:"primaryKey;column:id"`
+	Name        string         `gorm:"column:name;not null;uniqueIndex"`
+	Version     int            `gorm:"column:version;not null"`
+	Description string         `gorm:"column:description"`
+	Runtime     string         `gorm:"column:runtime"`
+	SourceVM    string         `gorm:"column:source_vm"`
+	BaseImageID string         `gorm:"column:base_image_id"`
+	CPU         int            `gorm:"column:cpu"`
+	MemoryMB    int            `gorm:"column:memory_mb"`
+	Network     string         `gorm:"column:network"`
+	TTLSeconds  *int           `gorm:"column:ttl_seconds"`
+	Labels      datatypes.JSON `gorm:"column:labels;type:jsonb"`
+	Spec        datatypes.JSON `gorm:"column:spec;type:jsonb"`
+	CreatedAt   time.Time      `gorm:"column:created_at;not null"`
+	UpdatedAt   time.Time      `gorm:"column:updated_at;not null"`
+}
+
+func (SandboxTemplateModel) TableName() string { return "sandbox_templates" }
+
+type BaseImageModel struct {
+	ID               string         `gorm:"primaryKey;column:id"`
+	Name             string         `gorm:"column:name;not null;uniqueIndex"`
+	Filename         string         `gorm:"column:filename;not null;uniqueIndex"`
+	Source           string         `gorm:"column:source;not null"`
+	SourceFormat     string         `gorm:"column:source_format"`
+	SHA256           string         `gorm:"column:sha256"`
+	SizeBytes        int64          `gorm:"column:size_bytes"`
+	VirtualSizeBytes int64          `gorm:"column:virtual_size_bytes"`
+	OS               datatypes.JSON `gorm:"column:os;type:jsonb"`
+	Status           string         `gorm:"column:status;not null;index"`
+	Error            *string        `gorm:"column:error"`
+	Provenance       datatypes.JSON `gorm:"column:provenance;type:jsonb"`
+	CreatedAt        time.Time      `gorm:"column:created_at;not null"`
+	UpdatedAt        time.Time      `gorm:"column:updated_at;not null"`
+}
+
+func (BaseImageModel) TableName() string { return "base_images" }
+
 type SnapshotModel struct {
 	ID        string    `gorm:"primaryKey;column:id"`
 	SandboxID string    `gorm:"column:sandbox_id;not null;index;index:idx_snapshots_sandbox_name,unique"`
@@ -544,15 +1165,16 @@ type SnapshotModel struct {
 func (SnapshotModel) TableName() string { return "snapshots" }
 
 type CommandModel struct {
-	ID        string    `gorm:"primaryKey;column:id"`
-	SandboxID string    `gorm:"column:sandbox_id;not null;index"`
-	Command   string    `gorm:"column:command;not null"`
-	EnvJSON   *string   `gorm:"column:env_json;type:jsonb"`
-	Stdout    string    `gorm:"column:stdout;not null"`
-	Stderr    string    `gorm:"column:stderr;not null"`
-	ExitCode  int       `gorm:"column:exit_code;not null"`
-	StartedAt time.Time `gorm:"column:started_at;not null;index"`
-	EndedAt   time.Time `gorm:"column:ended_at;not null"`
+	ID        string         `gorm:"primaryKey;column:id"`
+	SandboxID string         `gorm:"column:sandbox_id;not null;index"`
+	Command   string         `gorm:"column:command;not null"`
+	EnvJSON   *string        `gorm:"column:env_json;type:jsonb"`
+	Stdout    string         `gorm:"column:stdout;not null"`
+	Stderr    string         `gorm:"column:stderr;not null"`
+	ExitCode  int            `gorm:"column:exit_code;not null"`
+	StartedAt time.Time      `gorm:"column:started_at;not null;index"`
+	EndedAt   time.Time      `gorm:"column:ended_at;not null"`
+	Metadata  datatypes.JSON `gorm:"column:metadata;type:jsonb"`
 }
 
 func (CommandModel) TableName() string { return "commands" }
@@ -596,38 +1218,274 @@ type PublicationModel struct {
 
 func (PublicationModel) TableName() string { return "publications" }
 
-func sandboxToModel(sb *store.Sandbox) *SandboxModel {
+type WebhookModel struct {
+	ID         string         `gorm:"primaryKey;column:id"`
+	URL        string         `gorm:"column:url;not null"`
+	Secret     string         `gorm:"column:secret;not null"`
+	EventTypes datatypes.JSON `gorm:"column:event_types;type:jsonb"`
+	SandboxID  *string        `gorm:"column:sandbox_id;index"`
+	Active     bool           `gorm:"column:active;not null"`
+	CreatedAt  time.Time      `gorm:"column:created_at;not null"`
+	UpdatedAt  time.Time      `gorm:"column:updated_at;not null"`
+}
+
+func (WebhookModel) TableName() string { return "webhooks" }
+
+type WebhookDeliveryModel struct {
+	ID         string    `gorm:"primaryKey;column:id"`
+	WebhookID  string    `gorm:"column:webhook_id;not null;index"`
+	EventID    string    `gorm:"column:event_id;not null;index"`
+	EventType  string    `gorm:"column:event_type;not null"`
+	Attempt    int       `gorm:"column:attempt;not null"`
+	StatusCode int       `gorm:"column:status_code"`
+	Success    bool      `gorm:"column:success;not null"`
+	Error      *string   `gorm:"column:error"`
+	DurationMS int64     `gorm:"column:duration_ms;not null"`
+	CreatedAt  time.Time `gorm:"column:created_at;not null;index"`
+}
+
+func (WebhookDeliveryModel) TableName() string { return "webhook_deliveries" }
+
+type ApprovalModel struct {
+	ID           string     `gorm:"primaryKey;column:id"`
+	SandboxID    string     `gorm:"column:sandbox_id;not null;index"`
+	JobID        string     `gorm:"column:job_id;index"`
+	Operation    string     `gorm:"column:operation;not null"`
+	Status       string     `gorm:"column:status;not null;index"`
+	RequestedBy  string     `gorm:"column:requested_by"`
+	Reason       string     `gorm:"column:reason"`
+	PayloadJSON  *string    `gorm:"column:payload;type:jsonb"`
+	DecidedBy    *string    `gorm:"column:decided_by"`
+	DecisionNote *string    `gorm:"column:decision_note"`
+	ExpiresAt    time.Time  `gorm:"column:expires_at;not null;index"`
+	DecidedAt    *time.Time `gorm:"column:decided_at"`
+	ExecutedAt   *time.Time `gorm:"column:executed_at"`
+	ResultJSON   *string    `gorm:"column:result;type:jsonb"`
+	Error        *string    `gorm:"column:error"`
+	CreatedAt    time.Time  `gorm:"column:created_at;not null"`
+	UpdatedAt    time.Time  `gorm:"column:updated_at;not null"`
+}
+
+func (ApprovalModel) TableName() string { return "approvals" }
+
+type WorkflowRunModel struct {
+	ID          string         `gorm:"primaryKey;column:id"`
+	Kind        string         `gorm:"column:kind;not null;index"`
+	Subject     string         `gorm:"column:subject;index"`
+	Status      string         `gorm:"column:status;not null;index"`
+	Stage       string         `gorm:"column:stage"`
+	Stages      datatypes.JSON `gorm:"column:stages;type:jsonb"`
+	Outputs     datatypes.JSON `gorm:"column:outputs;type:jsonb"`
+	Cleanups    datatypes.JSON `gorm:"column:cleanups;type:jsonb"`
+	Attempts    int            `gorm:"column:attempts;not null;default:1"`
+	Error       *string        `gorm:"column:error"`
+	ErrorDetail *string        `gorm:"column:error_detail"`
+	CreatedAt   time.Time      `gorm:"column:created_at;not null"`
+	UpdatedAt   time.Time      `gorm:"column:updated_at;not null"`
+}
+
+func (WorkflowRunModel) TableName() string { return "workflow_runs" }
+
+func sandboxToModel(sb *store.Sandbox) (*SandboxModel, error) {
+	var labels, spec datatypes.JSON
+	if len(sb.Labels) > 0 {
+		b, err := json.Marshal(sb.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal sandbox labels: %w", err)
+		}
+		labels = datatypes.JSON(b)
+	}
+	if sb.Spec != nil {
+		b, err := json.Marshal(sb.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal sandbox spec: %w", err)
+		}
+		spec = datatypes.JSON(b)
+	}
 	return &SandboxModel{
-		ID:          sb.ID,
-		JobID:       sb.JobID,
-		AgentID:     sb.AgentID,
-		SandboxName: sb.SandboxName,
-		BaseImage:   sb.BaseImage,
-		Network:     sb.Network,
-		IPAddress:   copyString(sb.IPAddress),
-		State:       string(sb.State),
-		TTLSeconds:  copyInt(sb.TTLSeconds),
-		CreatedAt:   sb.CreatedAt,
-		UpdatedAt:   sb.UpdatedAt,
-		DeletedAt:   copyTime(sb.DeletedAt),
-	}
-}
-
-func sandboxFromModel(m *SandboxModel) *store.Sandbox {
-	return &store.Sandbox{
+		ID:              sb.ID,
+		JobID:           sb.JobID,
+		AgentID:         sb.AgentID,
+		SandboxName:     sb.SandboxName,
+		BaseImage:       sb.BaseImage,
+		Network:         sb.Network,
+		IPAddress:       copyString(sb.IPAddress),
+		State:           string(sb.State),
+		TTLSeconds:      copyInt(sb.TTLSeconds),
+		Runtime:         string(sb.Runtime),
+		CPU:             sb.CPU,
+		MemoryMB:        sb.MemoryMB,
+		MaxCPU:          sb.MaxCPU,
+		MaxMemoryMB:     sb.MaxMemoryMB,
+		Labels:          labels,
+		TemplateName:    copyString(sb.TemplateName),
+		TemplateVersion: copyInt(sb.TemplateVersion),
+		Spec:            spec,
+		ProvisionedAt:   copyTime(sb.ProvisionedAt),
+		ParentID:        copyString(sb.ParentID),
+		ParentSnapshot:  copyString(sb.ParentSnapshot),
+		CreatedAt:       sb.CreatedAt,
+		UpdatedAt:       sb.UpdatedAt,
+		DeletedAt:       copyTime(sb.DeletedAt),
+	}, nil
+}
+
+func sandboxFromModel(m *SandboxModel) (*store.Sandbox, error) {
+	sb := &store.Sandbox{
+		ID:              m.ID,
+		JobID:           m.JobID,
+		AgentID:         m.AgentID,
+		SandboxName:     m.SandboxName,
+		BaseImage:       m.BaseImage,
+		Network:         m.Network,
+		IPAddress:       copyString(m.IPAddress),
+		State:           store.SandboxState(m.State),
+		TTLSeconds:      copyInt(m.TTLSeconds),
+		Runtime:         store.Runtime(m.Runtime),
+		CPU:             m.CPU,
+		MemoryMB:        m.MemoryMB,
+		MaxCPU:          m.MaxCPU,
+		MaxMemoryMB:     m.MaxMemoryMB,
+		TemplateName:    copyString(m.TemplateName),
+		TemplateVersion: copyInt(m.TemplateVersion),
+		ProvisionedAt:   copyTime(m.ProvisionedAt),
+		ParentID:        copyString(m.ParentID),
+		ParentSnapshot:  copyString(m.ParentSnapshot),
+		CreatedAt:       m.CreatedAt,
+		UpdatedAt:       m.UpdatedAt,
+		DeletedAt:       copyTime(m.DeletedAt),
+	}
+	if len(m.Labels) > 0 {
+		if err := json.Unmarshal(m.Labels, &sb.Labels); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal sandbox labels: %w", err)
+		}
+	}
+	if len(m.Spec) > 0 {
+		if err := json.Unmarshal(m.Spec, &sb.Spec); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal sandbox spec: %w", err)
+		}
+	}
+	return sb, nil
+}
+
+func templateToModel(t *store.SandboxTemplate) (*SandboxTemplateModel, error) {
+	var labels datatypes.JSON
+	if len(t.Labels) > 0 {
+		b, err := json.Marshal(t.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal template labels: %w", err)
+		}
+		labels = datatypes.JSON(b)
+	}
+	spec, err := json.Marshal(t.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: marshal template spec: %w", err)
+	}
+	return &SandboxTemplateModel{
+		ID:          t.ID,
+		Name:        t.Name,
+		Version:     t.Version,
+		Description: t.Description,
+		Runtime:     string(t.Runtime),
+		SourceVM:    t.SourceVM,
+		BaseImageID: t.BaseImageID,
+		CPU:         t.CPU,
+		MemoryMB:    t.MemoryMB,
+		Network:     t.Network,
+		TTLSeconds:  copyInt(t.TTLSeconds),
+		Labels:      labels,
+		Spec:        datatypes.JSON(spec),
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}, nil
+}
+
+func templateFromModel(m *SandboxTemplateModel) (*store.SandboxTemplate, error) {
+	t := &store.SandboxTemplate{
 		ID:          m.ID,
-		JobID:       m.JobID,
-		AgentID:     m.AgentID,
-		SandboxName: m.SandboxName,
-		BaseImage:   m.BaseImage,
+		Name:        m.Name,
+		Version:     m.Version,
+		Description: m.Description,
+		Runtime:     store.Runtime(m.Runtime),
+		SourceVM:    m.SourceVM,
+		BaseImageID: m.BaseImageID,
+		CPU:         m.CPU,
+		MemoryMB:    m.MemoryMB,
 		Network:     m.Network,
-		IPAddress:   copyString(m.IPAddress),
-		State:       store.SandboxState(m.State),
 		TTLSeconds:  copyInt(m.TTLSeconds),
 		CreatedAt:   m.CreatedAt,
 		UpdatedAt:   m.UpdatedAt,
-		DeletedAt:   copyTime(m.DeletedAt),
 	}
+	if len(m.Labels) > 0 {
+		if err := json.Unmarshal(m.Labels, &t.Labels); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal template labels: %w", err)
+		}
+	}
+	if len(m.Spec) > 0 {
+		if err := json.Unmarshal(m.Spec, &t.Spec); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal template spec: %w", err)
+		}
+	}
+	return t, nil
+}
+
+func baseImageToModel(img *store.BaseImage) (*BaseImageModel, error) {
+	osInfo, err := json.Marshal(img.OS)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: marshal image os: %w", err)
+	}
+	var provenance datatypes.JSON
+	if img.Provenance != nil {
+		b, err := json.Marshal(img.Provenance)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal image provenance: %w", err)
+		}
+		provenance = datatypes.JSON(b)
+	}
+	return &BaseImageModel{
+		ID:               img.ID,
+		Name:             img.Name,
+		Filename:         img.Filename,
+		Source:           img.Source,
+		SourceFormat:     img.SourceFormat,
+		SHA256:           img.SHA256,
+		SizeBytes:        img.SizeBytes,
+		VirtualSizeBytes: img.VirtualSizeBytes,
+		OS:               datatypes.JSON(osInfo),
+		Status:           string(img.Status),
+		Error:            copyString(img.Error),
+		Provenance:       provenance,
+		CreatedAt:        img.CreatedAt,
+		UpdatedAt:        img.UpdatedAt,
+	}, nil
+}
+
+func baseImageFromModel(m *BaseImageModel) (*store.BaseImage, error) {
+	img := &store.BaseImage{
+		ID:               m.ID,
+		Name:             m.Name,
+		Filename:         m.Filename,
+		Source:           m.Source,
+		SourceFormat:     m.SourceFormat,
+		SHA256:           m.SHA256,
+		SizeBytes:        m.SizeBytes,
+		VirtualSizeBytes: m.VirtualSizeBytes,
+		Status:           store.ImageStatus(m.Status),
+		Error:            copyString(m.Error),
+		CreatedAt:        m.CreatedAt,
+		UpdatedAt:        m.UpdatedAt,
+	}
+	if len(m.OS) > 0 {
+		if err := json.Unmarshal(m.OS, &img.OS); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal image os: %w", err)
+		}
+	}
+	if len(m.Provenance) > 0 {
+		if err := json.Unmarshal(m.Provenance, &img.Provenance); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal image provenance: %w", err)
+		}
+	}
+	return img, nil
 }
 
 func snapshotToModel(sn *store.Snapshot) *SnapshotModel {
@@ -654,7 +1512,15 @@ func snapshotFromModel(m *SnapshotModel) *store.Snapshot {
 	}
 }
 
-func commandToModel(cmd *store.Command) *CommandModel {
+func commandToModel(cmd *store.Command) (*CommandModel, error) {
+	var meta datatypes.JSON
+	if cmd.Metadata != nil {
+		b, err := json.Marshal(cmd.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal command metadata: %w", err)
+		}
+		meta = datatypes.JSON(b)
+	}
 	return &CommandModel{
 		ID:        cmd.ID,
 		SandboxID: cmd.SandboxID,
@@ -665,11 +1531,12 @@ func commandToModel(cmd *store.Command) *CommandModel {
 		ExitCode:  cmd.ExitCode,
 		StartedAt: cmd.StartedAt,
 		EndedAt:   cmd.EndedAt,
-	}
+		Metadata:  meta,
+	}, nil
 }
 
 func commandFromModel(m *CommandModel) *store.Command {
-	return &store.Command{
+	cmd := &store.Command{
 		ID:        m.ID,
 		SandboxID: m.SandboxID,
 		Command:   m.Command,
@@ -680,6 +1547,13 @@ func commandFromModel(m *CommandModel) *store.Command {
 		StartedAt: m.StartedAt,
 		EndedAt:   m.EndedAt,
 	}
+	if len(m.Metadata) > 0 {
+		var meta store.CommandExecRecord
+		if err := json.Unmarshal(m.Metadata, &meta); err == nil {
+			cmd.Metadata = &meta
+		}
+	}
+	return cmd
 }
 
 func diffToModel(d *store.Diff) (*DiffModel, error) {
@@ -766,8 +1640,186 @@ func publicationFromModel(m *PublicationModel) *store.Publication {
 	}
 }
 
+func webhookToModel(wh *store.Webhook) (*WebhookModel, error) {
+	var eventTypes datatypes.JSON
+	if len(wh.EventTypes) > 0 {
+		payload, err := json.Marshal(wh.EventTypes)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal event_types: %w", err)
+		}
+		eventTypes = datatypes.JSON(payload)
+	}
+	return &WebhookModel{
+		ID:         wh.ID,
+		URL:        wh.URL,
+		Secret:     wh.Secret,
+		EventTypes: eventTypes,
+		SandboxID:  copyString(wh.SandboxID),
+		Active:     wh.Active,
+		CreatedAt:  wh.CreatedAt,
+		UpdatedAt:  wh.UpdatedAt,
+	}, nil
+}
+
+func webhookFromModel(m *WebhookModel) (*store.Webhook, error) {
+	wh := &store.Webhook{
+		ID:        m.ID,
+		URL:       m.URL,
+		Secret:    m.Secret,
+		SandboxID: copyString(m.SandboxID),
+		Active:    m.Active,
+		CreatedAt: m.CreatedAt,
+		UpdatedAt: m.UpdatedAt,
+	}
+	if len(m.EventTypes) > 0 {
+		if err := json.Unmarshal([]byte(m.EventTypes), &wh.EventTypes); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal event_types: %w", err)
+		}
+	}
+	return wh, nil
+}
+
+func webhookDeliveryToModel(d *store.WebhookDelivery) *WebhookDeliveryModel {
+	return &WebhookDeliveryModel{
+		ID:         d.ID,
+		WebhookID:  d.WebhookID,
+		EventID:    d.EventID,
+		EventType:  d.EventType,
+		Attempt:    d.Attempt,
+		StatusCode: d.StatusCode,
+		Success:    d.Success,
+		Error:      copyString(d.Error),
+		DurationMS: d.DurationMS,
+		CreatedAt:  d.CreatedAt,
+	}
+}
+
+func webhookDeliveryFromModel(m *WebhookDeliveryModel) *store.WebhookDelivery {
+	return &store.WebhookDelivery{
+		ID:         m.ID,
+		WebhookID:  m.WebhookID,
+		EventID:    m.EventID,
+		EventType:  m.EventType,
+		Attempt:    m.Attempt,
+		StatusCode: m.StatusCode,
+		Success:    m.Success,
+		Error:      copyString(m.Error),
+		DurationMS: m.DurationMS,
+		CreatedAt:  m.CreatedAt,
+	}
+}
+
+func approvalToModel(a *store.Approval) *ApprovalModel {
+	return &ApprovalModel{
+		ID:           a.ID,
+		SandboxID:    a.SandboxID,
+		JobID:        a.JobID,
+		Operation:    a.Operation,
+		Status:       string(a.Status),
+		RequestedBy:  a.RequestedBy,
+		Reason:       a.Reason,
+		PayloadJSON:  copyString(a.PayloadJSON),
+		DecidedBy:    copyString(a.DecidedBy),
+		DecisionNote: copyString(a.DecisionNote),
+		ExpiresAt:    a.ExpiresAt,
+		DecidedAt:    copyTime(a.DecidedAt),
+		ExecutedAt:   copyTime(a.ExecutedAt),
+		ResultJSON:   copyString(a.ResultJSON),
+		Error:        copyString(a.Error),
+		CreatedAt:    a.CreatedAt,
+		UpdatedAt:    a.UpdatedAt,
+	}
+}
+
+func approvalFromModel(m *ApprovalModel) *store.Approval {
+	return &store.Approval{
+		ID:           m.ID,
+		SandboxID:    m.SandboxID,
+		JobID:        m.JobID,
+		Operation:    m.Operation,
+		Status:       store.ApprovalStatus(m.Status),
+		RequestedBy:  m.RequestedBy,
+		Reason:       m.Reason,
+		PayloadJSON:  copyString(m.PayloadJSON),
+		DecidedBy:    copyString(m.DecidedBy),
+		DecisionNote: copyString(m.DecisionNote),
+		ExpiresAt:    m.ExpiresAt,
+		DecidedAt:    copyTime(m.DecidedAt),
+		ExecutedAt:   copyTime(m.ExecutedAt),
+		ResultJSON:   copyString(m.ResultJSON),
+		Error:        copyString(m.Error),
+		CreatedAt:    m.CreatedAt,
+		UpdatedAt:    m.UpdatedAt,
+	}
+}
+
 // --- Helpers ---
 
+func workflowRunToModel(run *store.WorkflowRun) (*WorkflowRunModel, error) {
+	stages, err := json.Marshal(run.Stages)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: marshal workflow stages: %w", err)
+	}
+	cleanups, err := json.Marshal(run.Cleanups)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: marshal workflow cleanups: %w", err)
+	}
+	var outputs datatypes.JSON
+	if len(run.Outputs) > 0 {
+		b, err := json.Marshal(run.Outputs)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: marshal workflow outputs: %w", err)
+		}
+		outputs = datatypes.JSON(b)
+	}
+	return &WorkflowRunModel{
+		ID:          run.ID,
+		Kind:        run.Kind,
+		Subject:     run.Subject,
+		Status:      string(run.Status),
+		Stage:       run.Stage,
+		Stages:      datatypes.JSON(stages),
+		Outputs:     outputs,
+		Cleanups:    datatypes.JSON(cleanups),
+		Attempts:    run.Attempts,
+		Error:       copyString(run.Error),
+		ErrorDetail: copyString(run.ErrorDetail),
+		CreatedAt:   run.CreatedAt,
+		UpdatedAt:   run.UpdatedAt,
+	}, nil
+}
+
+func workflowRunFromModel(m *WorkflowRunModel) (*store.WorkflowRun, error) {
+	run := &store.WorkflowRun{
+		ID:          m.ID,
+		Kind:        m.Kind,
+		Subject:     m.Subject,
+		Status:      store.WorkflowRunStatus(m.Status),
+		Stage:       m.Stage,
+		Attempts:    m.Attempts,
+		Error:       copyString(m.Error),
+		ErrorDetail: copyString(m.ErrorDetail),
+		CreatedAt:   m.CreatedAt,
+		UpdatedAt:   m.UpdatedAt,
+	}
+	if len(m.Stages) > 0 {
+		if err := json.Unmarshal(m.Stages, &run.Stages); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal workflow stages: %w", err)
+		}
+	}
+	if len(m.Outputs) > 0 {
+		if err := json.Unmarshal(m.Outputs, &run.Outputs); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal workflow outputs: %w", err)
+		}
+	}
+	if len(m.Cleanups) > 0 {
+		if err := json.Unmarshal(m.Cleanups, &run.Cleanups); err != nil {
+			return nil, fmt.Errorf("postgres: unmarshal workflow cleanups: %w", err)
+		}
+	}
+	return run, nil
+}
+
 func applyListOptions(tx *gorm.DB, opt *store.ListOptions, whitelist map[string]string) *gorm.DB {
 	orderApplied := false
 	if opt != nil {
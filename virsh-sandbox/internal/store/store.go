@@ -53,12 +53,25 @@ var (
 type SandboxState string
 
 const (
-	SandboxStateCreated   SandboxState = "CREATED"
-	SandboxStateStarting  SandboxState = "STARTING"
-	SandboxStateRunning   SandboxState = "RUNNING"
-	SandboxStateStopped   SandboxState = "STOPPED"
-	SandboxStateDestroyed SandboxState = "DESTROYED"
-	SandboxStateError     SandboxState = "ERROR"
+	SandboxStateCreated    SandboxState = "CREATED"
+	SandboxStateStarting   SandboxState = "STARTING"
+	SandboxStateRunning    SandboxState = "RUNNING"
+	SandboxStateStopped    SandboxState = "STOPPED"
+	SandboxStatePaused     SandboxState = "PAUSED"     // vCPUs suspended; memory still allocated
+	SandboxStateHibernated SandboxState = "HIBERNATED" // memory state saved to disk; host memory freed
+	SandboxStateDestroyed  SandboxState = "DESTROYED"
+	SandboxStateError      SandboxState = "ERROR"
+)
+
+// Runtime selects the backend a sandbox runs on.
+type Runtime string
+
+const (
+	// RuntimeVM runs the sandbox as a libvirt/KVM domain. It is the default
+	// for records without a runtime.
+	RuntimeVM Runtime = "vm"
+	// RuntimeContainer runs the sandbox as a Podman container.
+	RuntimeContainer Runtime = "container"
 )
 
 // SnapshotKind describes how a snapshot is taken/stored.
@@ -87,12 +100,34 @@ type Sandbox struct {
 	ID          string       `json:"id" db:"id"`                     // e.g., "SBX-0001"
 	JobID       string       `json:"job_id" db:"job_id"`             // correlation id for the end-to-end change set
 	AgentID     string       `json:"agent_id" db:"agent_id"`         // requesting agent identity
-	SandboxName string       `json:"sandbox_name" db:"sandbox_name"` // libvirt domain name
-	BaseImage   string       `json:"base_image" db:"base_image"`     // base qcow2 filename
+	SandboxName string       `json:"sandbox_name" db:"sandbox_name"` // libvirt domain or container name
+	BaseImage   string       `json:"base_image" db:"base_image"`     // base qcow2 filename, source VM or container image
 	Network     string       `json:"network" db:"network"`           // libvirt network name
 	IPAddress   *string      `json:"ip_address,omitempty" db:"ip"`   // discovered IP (if any)
 	State       SandboxState `json:"state" db:"state"`
 	TTLSeconds  *int         `json:"ttl_seconds,omitempty" db:"ttl_seconds"` // optional TTL for auto GC
+	Runtime     Runtime      `json:"runtime,omitempty" db:"runtime"`         // vm (default) or container
+
+	// Shape: configured vCPUs/memory and the maximums they may grow to while running.
+	CPU         int `json:"cpu,omitempty" db:"cpu"`
+	MemoryMB    int `json:"memory_mb,omitempty" db:"memory_mb"`
+	MaxCPU      int `json:"max_cpu,omitempty" db:"max_cpu"`
+	MaxMemoryMB int `json:"max_memory_mb,omitempty" db:"max_memory_mb"`
+
+	Labels map[string]string `json:"labels,omitempty" db:"labels"` // free-form key/value labels used by policies and filters
+
+	// Template provenance and the settings resolved from it at creation time.
+	TemplateName    *string      `json:"template_name,omitempty" db:"template_name"`
+	TemplateVersion *int         `json:"template_version,omitempty" db:"template_version"`
+	Spec            *SandboxSpec `json:"spec,omitempty" db:"spec"` // JSON-encoded provisioning settings
+
+	// ProvisionedAt is when the SSH key and any cloud-init seed were written
+	// to the sandbox's disk; nil until then.
+	ProvisionedAt *time.Time `json:"provisioned_at,omitempty" db:"provisioned_at"`
+
+	// Fork provenance: the sandbox and snapshot this sandbox was forked from.
+	ParentID       *string `json:"parent_id,omitempty" db:"parent_id"`
+	ParentSnapshot *string `json:"parent_snapshot,omitempty" db:"parent_snapshot"`
 
 	// Metadata
 	CreatedAt time.Time  `json:"created_at" db:"created_at"`
@@ -100,6 +135,134 @@ type Sandbox struct {
 	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
+// SandboxSpec holds provisioning settings that outlive CreateSandbox: they are
+// applied when the SSH key is injected and after the sandbox boots. It is copied
+// from the template so later template edits do not affect existing sandboxes.
+type SandboxSpec struct {
+	KeyInjectMethod  string           `json:"key_inject_method,omitempty"` // virt-customize | cloud-init; empty uses the host default
+	CloudInit        *CloudInitConfig `json:"cloud_init,omitempty"`
+	PostBootCommands []string         `json:"post_boot_commands,omitempty"` // run over SSH once the sandbox is reachable
+
+	RootDiskGB     int   `json:"root_disk_gb,omitempty"`     // grow the root disk to this size; 0 keeps the backing size
+	ScratchDisksGB []int `json:"scratch_disks_gb,omitempty"` // blank disks attached as vdb, vdc, ...
+
+	Mounts []HostMount `json:"mounts,omitempty"` // host directories shared into the guest
+}
+
+// HostMount shares a host directory into the sandbox over virtiofs (or 9p)
+// and mounts it in the guest through cloud-init.
+type HostMount struct {
+	HostPath  string `json:"host_path"`            // must be under an allowlisted directory
+	Tag       string `json:"tag"`                  // mount tag, unique per sandbox
+	GuestPath string `json:"guest_path,omitempty"` // defaults to /mnt/<tag>
+	ReadOnly  bool   `json:"read_only,omitempty"`
+}
+
+// CloudInitConfig lists cloud-config extras merged into the NoCloud seed.
+type CloudInitConfig struct {
+	Hostname   string          `json:"hostname,omitempty"`
+	Timezone   string          `json:"timezone,omitempty"`
+	Packages   []string        `json:"packages,omitempty"`
+	RunCmd     []string        `json:"runcmd,omitempty"`
+	WriteFiles []CloudInitFile `json:"write_files,omitempty"`
+	Users      []CloudInitUser `json:"users,omitempty"`
+}
+
+// CloudInitFile is a cloud-config write_files entry.
+type CloudInitFile struct {
+	Path        string `json:"path"`
+	Content     string `json:"content"`
+	Owner       string `json:"owner,omitempty"`       // e.g., "root:root"
+	Permissions string `json:"permissions,omitempty"` // octal string, e.g., "0644"
+}
+
+// CloudInitUser is a cloud-config users entry.
+type CloudInitUser struct {
+	Name              string   `json:"name"`
+	Groups            []string `json:"groups,omitempty"`
+	Shell             string   `json:"shell,omitempty"`
+	Sudo              string   `json:"sudo,omitempty"` // e.g., "ALL=(ALL) NOPASSWD:ALL"
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+}
+
+// SandboxTemplate is a named profile that CreateSandbox can start from.
+// Version starts at 1 and is incremented on every update.
+type SandboxTemplate struct {
+	ID          string `json:"id" db:"id"`     // e.g., "TPL-1a2b3c4d"
+	Name        string `json:"name" db:"name"` // unique
+	Version     int    `json:"version" db:"version"`
+	Description string `json:"description,omitempty" db:"description"`
+
+	Runtime     Runtime           `json:"runtime,omitempty" db:"runtime"`             // vm (default) or container
+	SourceVM    string            `json:"source_vm,omitempty" db:"source_vm"`         // VM to clone from, or image for the container runtime
+	BaseImageID string            `json:"base_image_id,omitempty" db:"base_image_id"` // catalog image to clone from instead of SourceVM
+	CPU         int               `json:"cpu,omitempty" db:"cpu"`                     // 0 = service default
+	MemoryMB    int               `json:"memory_mb,omitempty" db:"memory_mb"`         // 0 = service default
+	Network     string            `json:"network,omitempty" db:"network"`             // libvirt network; empty = service default
+	TTLSeconds  *int              `json:"ttl_seconds,omitempty" db:"ttl_seconds"`     // optional TTL for auto GC
+	Labels      map[string]string `json:"labels,omitempty" db:"labels"`               // merged under request labels
+
+	Spec SandboxSpec `json:"spec" db:"spec"` // key injection, cloud-init extras, post-boot commands
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ImageStatus tracks the import lifecycle of a base image.
+type ImageStatus string
+
+const (
+	ImageStatusImporting ImageStatus = "IMPORTING"
+	ImageStatusReady     ImageStatus = "READY"
+	ImageStatusFailed    ImageStatus = "FAILED"
+)
+
+// OSInfo describes the guest operating system of a base image.
+type OSInfo struct {
+	Family  string `json:"family,omitempty"`  // e.g., "linux"
+	Distro  string `json:"distro,omitempty"`  // e.g., "ubuntu"
+	Version string `json:"version,omitempty"` // e.g., "24.04"
+	Arch    string `json:"arch,omitempty"`    // e.g., "x86_64"
+}
+
+// BaseImage is a golden disk image in the catalog that sandboxes can be cloned from.
+type BaseImage struct {
+	ID               string      `json:"id" db:"id"`                       // e.g., "IMG-1a2b3c4d"
+	Name             string      `json:"name" db:"name"`                   // unique
+	Filename         string      `json:"filename" db:"filename"`           // qcow2 file relative to the base image dir
+	Source           string      `json:"source" db:"source"`               // local path or URL imported from
+	SourceFormat     string      `json:"source_format" db:"source_format"` // qcow2 | raw
+	SHA256           string      `json:"sha256,omitempty" db:"sha256"`     // checksum of the source as imported
+	SizeBytes        int64       `json:"size_bytes,omitempty" db:"size_bytes"`
+	VirtualSizeBytes int64       `json:"virtual_size_bytes,omitempty" db:"virtual_size_bytes"`
+	OS               OSInfo      `json:"os" db:"os"` // JSON-encoded
+	Status           ImageStatus `json:"status" db:"status"`
+	Error            *string     `json:"error,omitempty" db:"error"`
+
+	Provenance *ImageProvenance `json:"provenance,omitempty" db:"provenance"` // JSON-encoded; set for promoted sandboxes
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ImageProvenance links an image promoted from a sandbox back to its origin.
+type ImageProvenance struct {
+	SandboxID   string `json:"sandbox_id"`
+	SandboxName string `json:"sandbox_name"`
+	AgentID     string `json:"agent_id,omitempty"`
+	BaseImage   string `json:"base_image,omitempty"` // what the sandbox was cloned from
+	Snapshot    string `json:"snapshot,omitempty"`   // internal snapshot flattened; empty = disk at promotion time
+	DiffID      string `json:"diff_id,omitempty"`    // diff describing the changes the image carries
+	Sanitized   bool   `json:"sanitized"`
+	SourceVM    string `json:"source_vm,omitempty"` // libvirt domain defined on the image, if any
+}
+
+// BaseImageFilter enables scoped queries for base images.
+type BaseImageFilter struct {
+	Status   *ImageStatus
+	OSDistro *string
+}
+
 // SandboxFilter enables scoped queries for sandboxes.
 type SandboxFilter struct {
 	AgentID   *string
@@ -107,6 +270,8 @@ type SandboxFilter struct {
 	BaseImage *string
 	State     *SandboxState
 	VMName    *string
+	Template  *string
+	ParentID  *string
 }
 
 // Snapshot represents a VM snapshot reference.
@@ -133,16 +298,26 @@ type Command struct {
 	ExitCode  int                `json:"exit_code" db:"exit_code"`
 	StartedAt time.Time          `json:"started_at" db:"started_at"`
 	EndedAt   time.Time          `json:"ended_at" db:"ended_at"`
-	Metadata  *CommandExecRecord `json:"metadata,omitempty" db:"-"`
+	Metadata  *CommandExecRecord `json:"metadata,omitempty" db:"metadata"` // JSON-encoded exec details and redactions
 }
 
-// CommandExecRecord is a non-persisted helper payload commonly serialized into Metadata fields.
-// It can be persisted by serializing to JSON and storing in an auxiliary column if desired.
+// CommandExecRecord holds execution details for a Command and is persisted as JSON.
+// Redacted maps each placeholder left in the command, env or output to the rule that removed the secret.
 type CommandExecRecord struct {
 	User     string            `json:"user,omitempty"`
 	WorkDir  string            `json:"work_dir,omitempty"`
 	Timeout  *time.Duration    `json:"timeout,omitempty"`
 	Redacted map[string]string `json:"redacted,omitempty"` // placeholders for secrets redaction
+	Policy   *PolicyDecision   `json:"policy,omitempty"`   // command policy outcome evaluated before execution
+
+	ApprovalID string `json:"approval_id,omitempty"` // approval that authorised a policy-gated command
+}
+
+// PolicyDecision records the command policy outcome for a Command.
+type PolicyDecision struct {
+	Action string `json:"action"`           // allow | deny | require_approval
+	Rule   string `json:"rule,omitempty"`   // matching rule name; empty when the default applied
+	Reason string `json:"reason,omitempty"` // rule-provided explanation
 }
 
 // Diff represents a computed difference between two snapshots of a sandbox.
@@ -184,6 +359,8 @@ type ChangeDiff struct {
 	PackagesRemoved []PackageInfo    `json:"packages_removed,omitempty"`
 	ServicesChanged []ServiceChange  `json:"services_changed,omitempty"`
 	CommandsRun     []CommandSummary `json:"commands_run,omitempty"`
+	// Notes explain parts of the diff that could not be computed.
+	Notes []string `json:"notes,omitempty"`
 }
 
 // ChangeSet captures generator outputs (Ansible/Puppet) for a job.
@@ -212,6 +389,128 @@ type Publication struct {
 	UpdatedAt time.Time         `json:"updated_at" db:"updated_at"`
 }
 
+// Webhook is a registered HTTP endpoint that receives lifecycle events.
+type Webhook struct {
+	ID         string    `json:"id" db:"id"`
+	URL        string    `json:"url" db:"url"`
+	Secret     string    `json:"-" db:"secret"`                        // HMAC-SHA256 signing key; never serialized
+	EventTypes []string  `json:"event_types,omitempty" db:"-"`         // empty means all event types
+	SandboxID  *string   `json:"sandbox_id,omitempty" db:"sandbox_id"` // optional sandbox scope
+	Active     bool      `json:"active" db:"active"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// WebhookDelivery records a single delivery attempt of an event to a webhook.
+type WebhookDelivery struct {
+	ID         string    `json:"id" db:"id"`
+	WebhookID  string    `json:"webhook_id" db:"webhook_id"`
+	EventID    string    `json:"event_id" db:"event_id"`
+	EventType  string    `json:"event_type" db:"event_type"`
+	Attempt    int       `json:"attempt" db:"attempt"`
+	StatusCode int       `json:"status_code,omitempty" db:"status_code"`
+	Success    bool      `json:"success" db:"success"`
+	Error      *string   `json:"error,omitempty" db:"error"`
+	DurationMS int64     `json:"duration_ms" db:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// ApprovalStatus tracks the lifecycle of a pending-approval request.
+type ApprovalStatus string
+
+const (
+	ApprovalStatusPending  ApprovalStatus = "PENDING"
+	ApprovalStatusApproved ApprovalStatus = "APPROVED"
+	ApprovalStatusDenied   ApprovalStatus = "DENIED"
+	ApprovalStatusExpired  ApprovalStatus = "EXPIRED"
+)
+
+// Approval is a gated operation waiting for (or having received) a human decision.
+type Approval struct {
+	ID           string         `json:"id" db:"id"`                 // e.g., "APR-1a2b3c4d"
+	SandboxID    string         `json:"sandbox_id" db:"sandbox_id"` // sandbox the operation targets
+	JobID        string         `json:"job_id" db:"job_id"`         // correlation id of the sandbox job
+	Operation    string         `json:"operation" db:"operation"`   // destroy_sandbox | revert_snapshot | publish | run_command
+	Status       ApprovalStatus `json:"status" db:"status"`
+	RequestedBy  string         `json:"requested_by" db:"requested_by"`       // agent or user that triggered the request
+	Reason       string         `json:"reason,omitempty" db:"reason"`         // why approval is needed (e.g., policy rule)
+	PayloadJSON  *string        `json:"payload_json,omitempty" db:"payload"`  // operation parameters (secrets excluded)
+	DecidedBy    *string        `json:"decided_by,omitempty" db:"decided_by"` // operator who approved/denied
+	DecisionNote *string        `json:"decision_note,omitempty" db:"decision_note"`
+	ExpiresAt    time.Time      `json:"expires_at" db:"expires_at"`
+	DecidedAt    *time.Time     `json:"decided_at,omitempty" db:"decided_at"`
+	ExecutedAt   *time.Time     `json:"executed_at,omitempty" db:"executed_at"`
+	ResultJSON   *string        `json:"result_json,omitempty" db:"result"` // operation result after approval
+	Error        *string        `json:"error,omitempty" db:"error"`        // operation error after approval
+	CreatedAt    time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at" db:"updated_at"`
+}
+
+// ApprovalFilter enables scoped queries for approvals.
+type ApprovalFilter struct {
+	SandboxID *string
+	JobID     *string
+	Operation *string
+	Status    *ApprovalStatus
+}
+
+// WorkflowRunStatus tracks the lifecycle of a persisted workflow run.
+type WorkflowRunStatus string
+
+const (
+	WorkflowRunRunning    WorkflowRunStatus = "RUNNING"
+	WorkflowRunSucceeded  WorkflowRunStatus = "SUCCEEDED"
+	WorkflowRunFailed     WorkflowRunStatus = "FAILED"
+	WorkflowRunRolledBack WorkflowRunStatus = "ROLLED_BACK"
+)
+
+// WorkflowRun is the durable record of a multi-stage workflow such as a
+// VM-to-container clone. Stages and cleanup actions are written as they
+// happen, so a run interrupted by a process restart can be resumed or
+// cleaned up from the record alone.
+type WorkflowRun struct {
+	ID          string            `json:"id" db:"id"`           // e.g., "CLN-1a2b3c4d"
+	Kind        string            `json:"kind" db:"kind"`       // e.g., "clone"
+	Subject     string            `json:"subject" db:"subject"` // what the run operates on, e.g. the VM name
+	Status      WorkflowRunStatus `json:"status" db:"status"`
+	Stage       string            `json:"stage,omitempty" db:"stage"` // stage running, or the one that failed
+	Stages      []WorkflowStage   `json:"stages" db:"stages"`         // JSON-encoded
+	Outputs     map[string]string `json:"outputs,omitempty" db:"outputs"`
+	Cleanups    []WorkflowCleanup `json:"cleanups" db:"cleanups"` // JSON-encoded, in registration order
+	Attempts    int               `json:"attempts" db:"attempts"` // 1 + number of resumes
+	Error       *string           `json:"error,omitempty" db:"error"`
+	ErrorDetail *string           `json:"error_detail,omitempty" db:"error_detail"`
+	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// WorkflowStage records the progress of one stage of a run.
+type WorkflowStage struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"` // pending | running | done | failed
+	Detail    string     `json:"detail,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+// WorkflowCleanup is a cleanup action registered by a run, described by
+// data rather than a closure so it can be replayed after a restart.
+type WorkflowCleanup struct {
+	Action   string            `json:"action"` // e.g., "unmount", "commit_snapshot", "remove_path"
+	Params   map[string]string `json:"params,omitempty"`
+	Rollback bool              `json:"rollback,omitempty"` // undoes a produced artifact; run only on failure
+	Done     bool              `json:"done"`
+	Error    string            `json:"error,omitempty"` // last failed attempt
+}
+
+// WorkflowRunFilter enables scoped queries for workflow runs.
+type WorkflowRunFilter struct {
+	Kind    *string
+	Subject *string
+	Status  *WorkflowRunStatus
+}
+
 // DataStore declares data operations. This is transaction-friendly and
 // can be implemented by both the root Store and a transactional context.
 type DataStore interface {
@@ -224,6 +523,23 @@ type DataStore interface {
 	UpdateSandboxState(ctx context.Context, id string, newState SandboxState, ipAddr *string) error
 	DeleteSandbox(ctx context.Context, id string) error
 
+	// SandboxTemplate
+	CreateTemplate(ctx context.Context, t *SandboxTemplate) error
+	GetTemplate(ctx context.Context, id string) (*SandboxTemplate, error)
+	GetTemplateByName(ctx context.Context, name string) (*SandboxTemplate, error)
+	ListTemplates(ctx context.Context, opt *ListOptions) ([]*SandboxTemplate, error)
+	// UpdateTemplate persists t only if its stored version still equals
+	// t.Version, then increments t.Version; otherwise it returns ErrConflict.
+	UpdateTemplate(ctx context.Context, t *SandboxTemplate) error
+	DeleteTemplate(ctx context.Context, id string) error
+
+	// BaseImage
+	CreateBaseImage(ctx context.Context, img *BaseImage) error
+	GetBaseImage(ctx context.Context, id string) (*BaseImage, error)
+	ListBaseImages(ctx context.Context, filter BaseImageFilter, opt *ListOptions) ([]*BaseImage, error)
+	UpdateBaseImage(ctx context.Context, img *BaseImage) error
+	DeleteBaseImage(ctx context.Context, id string) error
+
 	// Snapshot
 	CreateSnapshot(ctx context.Context, sn *Snapshot) error
 	GetSnapshot(ctx context.Context, id string) (*Snapshot, error)
@@ -249,6 +565,28 @@ type DataStore interface {
 	CreatePublication(ctx context.Context, p *Publication) error
 	UpdatePublicationStatus(ctx context.Context, id string, status PublicationStatus, commitSHA, prURL, errMsg *string) error
 	GetPublication(ctx context.Context, id string) (*Publication, error)
+
+	// Webhook
+	CreateWebhook(ctx context.Context, wh *Webhook) error
+	GetWebhook(ctx context.Context, id string) (*Webhook, error)
+	ListWebhooks(ctx context.Context, opt *ListOptions) ([]*Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	SaveWebhookDelivery(ctx context.Context, d *WebhookDelivery) error
+	ListWebhookDeliveries(ctx context.Context, webhookID string, opt *ListOptions) ([]*WebhookDelivery, error)
+
+	// Approval
+	CreateApproval(ctx context.Context, a *Approval) error
+	GetApproval(ctx context.Context, id string) (*Approval, error)
+	ListApprovals(ctx context.Context, filter ApprovalFilter, opt *ListOptions) ([]*Approval, error)
+	// UpdateApproval persists a only if its stored status still equals expect;
+	// otherwise it returns ErrConflict. This serialises concurrent decisions.
+	UpdateApproval(ctx context.Context, a *Approval, expect ApprovalStatus) error
+
+	// WorkflowRun
+	CreateWorkflowRun(ctx context.Context, run *WorkflowRun) error
+	GetWorkflowRun(ctx context.Context, id string) (*WorkflowRun, error)
+	ListWorkflowRuns(ctx context.Context, filter WorkflowRunFilter, opt *ListOptions) ([]*WorkflowRun, error)
+	UpdateWorkflowRun(ctx context.Context, run *WorkflowRun) error
 }
 
 // Store is the root database handle. It can produce transactional views and
@@ -0,0 +1,169 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"virsh-sandbox/internal/store"
+)
+
+// renderUserData builds the #cloud-config document for the NoCloud seed. The
+// injected user always comes first; cfg adds users, packages, files, commands,
+// hostname and timezone, and bootCmds become bootcmd entries. The body is
+// JSON, which cloud-init accepts as YAML.
+func renderUserData(username, publicKey string, cfg *store.CloudInitConfig, bootCmds []string) ([]byte, error) {
+	users := []map[string]any{{
+		"name":                username,
+		"sudo":                "ALL=(ALL) NOPASSWD:ALL",
+		"groups":              "users, admin, sudo",
+		"shell":               "/bin/bash",
+		"ssh_authorized_keys": []string{publicKey},
+	}}
+	doc := map[string]any{}
+	if cfg != nil {
+		for _, u := range cfg.Users {
+			if u.Name == username {
+				continue // the injected user is already defined above
+			}
+			entry := map[string]any{"name": u.Name}
+			if len(u.Groups) > 0 {
+				entry["groups"] = strings.Join(u.Groups, ", ")
+			}
+			if u.Shell != "" {
+				entry["shell"] = u.Shell
+			}
+			if u.Sudo != "" {
+				entry["sudo"] = u.Sudo
+			}
+			if len(u.SSHAuthorizedKeys) > 0 {
+				entry["ssh_authorized_keys"] = u.SSHAuthorizedKeys
+			}
+			users = append(users, entry)
+		}
+		if cfg.Hostname != "" {
+			doc["hostname"] = cfg.Hostname
+			doc["preserve_hostname"] = false
+		}
+		if cfg.Timezone != "" {
+			doc["timezone"] = cfg.Timezone
+		}
+		if len(cfg.Packages) > 0 {
+			doc["package_update"] = true
+			doc["packages"] = cfg.Packages
+		}
+		if len(cfg.WriteFiles) > 0 {
+			files := make([]map[string]any, 0, len(cfg.WriteFiles))
+			for _, f := range cfg.WriteFiles {
+				entry := map[string]any{"path": f.Path, "content": f.Content}
+				if f.Owner != "" {
+					entry["owner"] = f.Owner
+				}
+				if f.Permissions != "" {
+					entry["permissions"] = f.Permissions
+				}
+				files = append(files, entry)
+			}
+			doc["write_files"] = files
+		}
+		if len(cfg.RunCmd) > 0 {
+			doc["runcmd"] = cfg.RunCmd
+		}
+	}
+	if len(bootCmds) > 0 {
+		entries := make([][]string, 0, len(bootCmds))
+		for _, c := range bootCmds {
+			entries = append(entries, []string{"sh", "-c", c})
+		}
+		doc["bootcmd"] = entries
+	}
+	doc["users"] = users
+
+	body, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), body...), nil
+}
+
+var (
+	hostnameRe    = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+	permissionsRe = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+)
+
+// validateCloudInit rejects cloud-init options that would produce a broken seed.
+func validateCloudInit(cfg *store.CloudInitConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Hostname != "" && !hostnameRe.MatchString(cfg.Hostname) {
+		return fmt.Errorf("cloud_init.hostname %q is not a valid hostname: %w", cfg.Hostname, store.ErrInvalid)
+	}
+	for i, f := range cfg.WriteFiles {
+		if !strings.HasPrefix(f.Path, "/") {
+			return fmt.Errorf("cloud_init.write_files[%d].path must be absolute: %w", i, store.ErrInvalid)
+		}
+		if f.Permissions != "" && !permissionsRe.MatchString(f.Permissions) {
+			return fmt.Errorf("cloud_init.write_files[%d].permissions %q must be octal: %w", i, f.Permissions, store.ErrInvalid)
+		}
+	}
+	for i, u := range cfg.Users {
+		if strings.TrimSpace(u.Name) == "" {
+			return fmt.Errorf("cloud_init.users[%d].name is required: %w", i, store.ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// mergeCloudInit overlays override on base: scalar fields set in override win,
+// list fields are appended.
+func mergeCloudInit(base, override *store.CloudInitConfig) *store.CloudInitConfig {
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		return base
+	}
+	out := *base
+	if override.Hostname != "" {
+		out.Hostname = override.Hostname
+	}
+	if override.Timezone != "" {
+		out.Timezone = override.Timezone
+	}
+	out.Packages = append(append([]string{}, base.Packages...), override.Packages...)
+	out.RunCmd = append(append([]string{}, base.RunCmd...), override.RunCmd...)
+	out.WriteFiles = append(append([]store.CloudInitFile{}, base.WriteFiles...), override.WriteFiles...)
+	out.Users = append(append([]store.CloudInitUser{}, base.Users...), override.Users...)
+	return &out
+}
+
+// cloudInitState is the parsed outcome of `cloud-init status`.
+type cloudInitState string
+
+const (
+	cloudInitRunning  cloudInitState = "running"
+	cloudInitDone     cloudInitState = "done"
+	cloudInitError    cloudInitState = "error"
+	cloudInitDisabled cloudInitState = "disabled"
+)
+
+// parseCloudInitStatus extracts the state from `cloud-init status` output
+// ("status: done"). Unknown or pending states ("not started") count as running.
+func parseCloudInitStatus(out string) cloudInitState {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		v, ok := strings.CutPrefix(line, "status:")
+		if !ok {
+			continue
+		}
+		switch st := cloudInitState(strings.TrimSpace(v)); st {
+		case cloudInitDone, cloudInitError, cloudInitDisabled:
+			return st
+		default:
+			return cloudInitRunning
+		}
+	}
+	return cloudInitRunning
+}
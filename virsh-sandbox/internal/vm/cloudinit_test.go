@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"virsh-sandbox/internal/store"
+)
+
+func TestRenderUserData(t *testing.T) {
+	out, err := renderUserData("ubuntu", "ssh-ed25519 AAAA test", &store.CloudInitConfig{
+		Hostname:   "box-1",
+		Packages:   []string{"jq"},
+		RunCmd:     []string{"echo hi"},
+		WriteFiles: []store.CloudInitFile{{Path: "/etc/motd", Content: "hello"}},
+		Users:      []store.CloudInitUser{{Name: "ubuntu"}, {Name: "ops", Groups: []string{"wheel"}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("renderUserData: %v", err)
+	}
+	body, ok := strings.CutPrefix(string(out), "#cloud-config\n")
+	if !ok {
+		t.Fatalf("missing #cloud-config header: %q", out)
+	}
+	var doc struct {
+		Hostname string           `json:"hostname"`
+		Packages []string         `json:"packages"`
+		RunCmd   []string         `json:"runcmd"`
+		Users    []map[string]any `json:"users"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if doc.Hostname != "box-1" || len(doc.Packages) != 1 || len(doc.RunCmd) != 1 {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+	if len(doc.Users) != 2 || doc.Users[0]["name"] != "ubuntu" || doc.Users[1]["name"] != "ops" {
+		t.Errorf("users = %v, want injected ubuntu followed by ops", doc.Users)
+	}
+}
+
+func TestParseCloudInitStatus(t *testing.T) {
+	cases := map[string]cloudInitState{
+		"status: done\n":                        cloudInitDone,
+		"status: running":                       cloudInitRunning,
+		"status: error\nextended_status: error": cloudInitError,
+		"status: disabled":                      cloudInitDisabled,
+		"status: not started":                   cloudInitRunning,
+		"":                                      cloudInitRunning,
+		"extended_status: degraded\nstatus: done\n": cloudInitDone,
+	}
+	for in, want := range cases {
+		if got := parseCloudInitStatus(in); got != want {
+			t.Errorf("parseCloudInitStatus(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestValidateCloudInit(t *testing.T) {
+	bad := []*store.CloudInitConfig{
+		{Hostname: "bad_host"},
+		{WriteFiles: []store.CloudInitFile{{Path: "relative"}}},
+		{WriteFiles: []store.CloudInitFile{{Path: "/x", Permissions: "rw"}}},
+		{Users: []store.CloudInitUser{{Name: " "}}},
+	}
+	for i, cfg := range bad {
+		if err := validateCloudInit(cfg); err == nil {
+			t.Errorf("case %d: validateCloudInit succeeded, want error", i)
+		}
+	}
+}
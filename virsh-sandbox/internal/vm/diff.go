@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"virsh-sandbox/internal/diskimage"
+	"virsh-sandbox/internal/libvirt"
+)
+
+// errNoDiskState is returned when a manager could not locate a snapshot's
+// disk, as for container sandboxes.
+var errNoDiskState = errors.New("snapshot disk not located")
+
+// diffSnapshotDisks compares the root filesystems of the two disk states of
+// plan. The images are read in-process; nothing is mounted.
+func diffSnapshotDisks(ctx context.Context, plan *libvirt.FSComparePlan) (*diskimage.Changes, error) {
+	before, err := openSnapshotRoot(plan.FromSnapshot, plan.FromDisk)
+	if err != nil {
+		return nil, err
+	}
+	defer before.img.Close()
+	after, err := openSnapshotRoot(plan.ToSnapshot, plan.ToDisk)
+	if err != nil {
+		return nil, err
+	}
+	defer after.img.Close()
+	return diskimage.Compare(ctx, before.fs, after.fs)
+}
+
+// snapshotRoot is an open snapshot disk and its root filesystem.
+type snapshotRoot struct {
+	img *diskimage.Image
+	fs  diskimage.FS
+}
+
+// openSnapshotRoot opens the root filesystem of a snapshot's disk state.
+func openSnapshotRoot(name string, disk libvirt.DiskState) (*snapshotRoot, error) {
+	if disk.Path == "" {
+		return nil, fmt.Errorf("snapshot %s: %w", name, errNoDiskState)
+	}
+	img, err := diskimage.OpenSnapshot(disk.Path, disk.Snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	fsys, _, err := diskimage.OpenRoot(img, img.Size())
+	if err != nil {
+		img.Close()
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	return &snapshotRoot{img: img, fs: fsys}, nil
+}
+
+// nonNil returns s, or an empty slice so it encodes as [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
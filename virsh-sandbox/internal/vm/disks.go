@@ -0,0 +1,42 @@
+package vm
+
+import (
+	"fmt"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// maxDiskGB caps a single root or scratch disk.
+const maxDiskGB = 4096
+
+// growRootFSMarker is created once the root filesystem has been grown.
+const growRootFSMarker = "/var/lib/virsh-sandbox/rootfs-grown"
+
+// growRootFSCommand grows the root partition and filesystem to fill a resized
+// root disk. It is run on first boot of sandboxes with a root_disk_gb; cloud-init
+// runs bootcmd entries on every boot, so growRootFSMarker makes later boots skip it.
+const growRootFSCommand = `if [ ! -e ` + growRootFSMarker + ` ]; then ` +
+	`dev=$(findmnt -no SOURCE /); ` +
+	`disk=/dev/$(lsblk -no PKNAME "$dev"); ` +
+	`part=$(cat /sys/class/block/$(basename "$dev")/partition); ` +
+	`growpart "$disk" "$part" || true; ` +
+	`resize2fs "$dev" 2>/dev/null || xfs_growfs / 2>/dev/null || true; ` +
+	`mkdir -p $(dirname ` + growRootFSMarker + `) && touch ` + growRootFSMarker + `; ` +
+	`fi`
+
+// validateDisks checks the disk sizing fields of a spec.
+func validateDisks(spec *store.SandboxSpec) error {
+	if spec.RootDiskGB < 0 || spec.RootDiskGB > maxDiskGB {
+		return fmt.Errorf("root_disk_gb must be between 0 and %d: %w", maxDiskGB, store.ErrInvalid)
+	}
+	if len(spec.ScratchDisksGB) > libvirt.MaxScratchDisks {
+		return fmt.Errorf("at most %d scratch disks are supported: %w", libvirt.MaxScratchDisks, store.ErrInvalid)
+	}
+	for i, gb := range spec.ScratchDisksGB {
+		if gb <= 0 || gb > maxDiskGB {
+			return fmt.Errorf("scratch_disks_gb[%d] must be between 1 and %d: %w", i, maxDiskGB, store.ErrInvalid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+func TestValidateDisks(t *testing.T) {
+	tooMany := make([]int, libvirt.MaxScratchDisks+1)
+	for i := range tooMany {
+		tooMany[i] = 1
+	}
+	cases := []struct {
+		name    string
+		spec    store.SandboxSpec
+		wantErr bool
+	}{
+		{"empty", store.SandboxSpec{}, false},
+		{"root and scratch", store.SandboxSpec{RootDiskGB: 40, ScratchDisksGB: []int{10, 20}}, false},
+		{"largest root", store.SandboxSpec{RootDiskGB: maxDiskGB}, false},
+		{"negative root", store.SandboxSpec{RootDiskGB: -1}, true},
+		{"root too large", store.SandboxSpec{RootDiskGB: maxDiskGB + 1}, true},
+		{"all scratch slots", store.SandboxSpec{ScratchDisksGB: tooMany[1:]}, false},
+		{"too many scratch disks", store.SandboxSpec{ScratchDisksGB: tooMany}, true},
+		{"zero scratch disk", store.SandboxSpec{ScratchDisksGB: []int{10, 0}}, true},
+		{"scratch too large", store.SandboxSpec{ScratchDisksGB: []int{maxDiskGB + 1}}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateDisks(&c.spec)
+			if c.wantErr != (err != nil) {
+				t.Fatalf("err = %v, want error %v", err, c.wantErr)
+			}
+			if err != nil && !errors.Is(err, store.ErrInvalid) {
+				t.Errorf("err = %v, want ErrInvalid", err)
+			}
+		})
+	}
+}
+
+// TestGrowRootFSCommand runs the command against stub findmnt, lsblk, cat,
+// growpart and resize2fs that log their arguments.
+func TestGrowRootFSCommand(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "calls.log")
+	stubs := map[string]string{
+		"findmnt":   "echo /dev/vda1",
+		"lsblk":     "echo vda",
+		"cat":       "echo 1",
+		"growpart":  `echo "growpart $*" >>` + logPath,
+		"resize2fs": `echo "resize2fs $*" >>` + logPath,
+	}
+	for name, body := range stubs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marker := filepath.Join(dir, "state", "rootfs-grown")
+	script := strings.ReplaceAll(growRootFSCommand, growRootFSMarker, marker)
+
+	run := func() {
+		t.Helper()
+		cmd := exec.Command(sh, "-c", script)
+		cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("run: %v\n%s", err, out)
+		}
+	}
+	run()
+	got, _ := os.ReadFile(logPath)
+	if want := "growpart /dev/vda 1\nresize2fs /dev/vda1\n"; string(got) != want {
+		t.Fatalf("first boot ran:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("marker not created: %v", err)
+	}
+
+	run()
+	if again, _ := os.ReadFile(logPath); string(again) != string(got) {
+		t.Errorf("second boot grew again:\n%s", again)
+	}
+}
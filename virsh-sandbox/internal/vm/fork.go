@@ -0,0 +1,157 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// maxForkCount bounds the children created by a single ForkSandbox call.
+const maxForkCount = 16
+
+// ForkSandbox creates count child sandboxes from a point-in-time state of the
+// parent. If snapshotName is empty a new internal snapshot is taken first;
+// otherwise the named internal snapshot is used. The snapshot is exported once
+// into the parent's job dir, pausing a running parent for the copy, and every
+// child gets a fresh overlay on top of it, its own MAC address and a hostname
+// equal to its sandbox name.
+//
+// Children inherit the parent's agent, shape, network, labels, TTL and spec
+// (scratch disks start blank), and record ParentID and ParentSnapshot. The
+// parent cannot be destroyed while children exist, since their disks are
+// backed by the export in its job dir. On error, children created so far are
+// returned along with it.
+func (s *Service) ForkSandbox(ctx context.Context, parentID, snapshotName string, count int) ([]*store.Sandbox, *store.Snapshot, error) {
+	if count < 1 || count > maxForkCount {
+		return nil, nil, fmt.Errorf("count must be between 1 and %d: %w", maxForkCount, store.ErrInvalid)
+	}
+	parent, err := s.store.GetSandbox(ctx, parentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch parent.State {
+	case store.SandboxStateDestroyed, store.SandboxStateHibernated:
+		return nil, nil, fmt.Errorf("sandbox %s is %s: %w", parent.ID, parent.State, store.ErrConflict)
+	}
+
+	var sn *store.Snapshot
+	if strings.TrimSpace(snapshotName) == "" {
+		sn, err = s.CreateSnapshot(ctx, parent.ID, fmt.Sprintf("fork-%s", id.Short()), false)
+	} else {
+		sn, err = s.store.GetSnapshotByName(ctx, parent.ID, snapshotName)
+		if err == nil && sn.Kind != store.SnapshotKindInternal {
+			err = fmt.Errorf("snapshot %s is %s; only internal snapshots can be forked: %w", sn.Name, sn.Kind, store.ErrInvalid)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	mgr, err := s.managerFor(parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	diskPath, err := mgr.ExportSnapshot(ctx, parent.SandboxName, sn.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("export snapshot: %w", err)
+	}
+
+	children := make([]*store.Sandbox, 0, count)
+	for i := 0; i < count; i++ {
+		child, err := s.createFork(ctx, mgr, parent, sn.Name, diskPath)
+		if err != nil {
+			return children, sn, fmt.Errorf("fork %d of %d: %w", i+1, count, err)
+		}
+		children = append(children, child)
+	}
+
+	ids := make([]string, 0, len(children))
+	for _, c := range children {
+		ids = append(ids, c.ID)
+	}
+	s.publish(ctx, events.TypeSandboxForked, parent, map[string]any{
+		"snapshot": sn.Name,
+		"children": ids,
+	})
+	return children, sn, nil
+}
+
+// createFork defines and records one child of parent backed by diskPath.
+func (s *Service) createFork(ctx context.Context, mgr libvirt.Manager, parent *store.Sandbox, snapshotName, diskPath string) (*store.Sandbox, error) {
+	cpu, memoryMB := parent.CPU, parent.MemoryMB
+	if cpu <= 0 {
+		cpu = s.cfg.DefaultVCPUs
+	}
+	if memoryMB <= 0 {
+		memoryMB = s.cfg.DefaultMemoryMB
+	}
+	maxCPU, maxMemoryMB := max(parent.MaxCPU, cpu), max(parent.MaxMemoryMB, memoryMB)
+	unlock := s.lockQuota(parent.AgentID)
+	defer unlock()
+	if err := s.checkQuota(ctx, parent.AgentID, "", cpu, memoryMB, maxCPU, maxMemoryMB); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("sbx-%s", id.Short())
+	cloneOpts := []libvirt.CloneOption{libvirt.WithHostname(name)}
+	if maxCPU > cpu || maxMemoryMB > memoryMB {
+		cloneOpts = append(cloneOpts, libvirt.WithMaxShape(maxCPU, maxMemoryMB))
+	}
+	var spec *store.SandboxSpec
+	if parent.Spec != nil {
+		cp := *parent.Spec
+		spec = &cp
+		// The root disk already has the parent's size; only scratch disks and mounts are recreated.
+		if len(spec.ScratchDisksGB) > 0 {
+			cloneOpts = append(cloneOpts, libvirt.WithScratchDisks(spec.ScratchDisksGB...))
+		}
+		if len(spec.Mounts) > 0 {
+			cloneOpts = append(cloneOpts, libvirt.WithSharedDirs(sharedDirs(spec.Mounts)...))
+		}
+	}
+	if _, err := mgr.CloneFromDisk(ctx, diskPath, name, cpu, memoryMB, parent.Network, cloneOpts...); err != nil {
+		return nil, fmt.Errorf("clone vm: %w", err)
+	}
+
+	now := s.timeNowFn().UTC()
+	child := &store.Sandbox{
+		ID:              fmt.Sprintf("SBX-%s", id.Short()),
+		JobID:           fmt.Sprintf("JOB-%s", id.Short()),
+		AgentID:         parent.AgentID,
+		SandboxName:     name,
+		BaseImage:       parent.BaseImage,
+		Network:         parent.Network,
+		State:           store.SandboxStateCreated,
+		TTLSeconds:      copyIntPtr(parent.TTLSeconds),
+		Runtime:         parent.Runtime,
+		CPU:             cpu,
+		MemoryMB:        memoryMB,
+		MaxCPU:          maxCPU,
+		MaxMemoryMB:     maxMemoryMB,
+		Labels:          mergeLabels(parent.Labels, nil),
+		TemplateName:    parent.TemplateName,
+		TemplateVersion: copyIntPtr(parent.TemplateVersion),
+		Spec:            spec,
+		ProvisionedAt:   parent.ProvisionedAt, // the disk already carries the parent's key and seed
+		ParentID:        &parent.ID,
+		ParentSnapshot:  &snapshotName,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := s.store.CreateSandbox(ctx, child); err != nil {
+		// Without a record nothing would ever destroy the domain.
+		_ = mgr.DestroyVM(context.WithoutCancel(ctx), name)
+		return nil, fmt.Errorf("persist sandbox: %w", err)
+	}
+	s.publish(ctx, events.TypeSandboxCreated, child, map[string]any{
+		"sandbox_name":    child.SandboxName,
+		"agent_id":        child.AgentID,
+		"parent_id":       parent.ID,
+		"parent_snapshot": snapshotName,
+	})
+	return child, nil
+}
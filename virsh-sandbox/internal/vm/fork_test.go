@@ -0,0 +1,226 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// forkManager records the snapshot, export, clone and destroy calls of a fork.
+// Clone call number failClone (1-based) fails.
+type forkManager struct {
+	libvirt.Manager
+	snapshots []string
+	exported  []string
+	clones    []string
+	hostnames []string
+	destroyed []string
+	failClone int
+}
+
+func (m *forkManager) CreateSnapshot(_ context.Context, _, name string, _ bool) (libvirt.SnapshotRef, error) {
+	m.snapshots = append(m.snapshots, name)
+	return libvirt.SnapshotRef{Name: name, Kind: "INTERNAL", Ref: name}, nil
+}
+
+func (m *forkManager) ExportSnapshot(_ context.Context, vmName, snapshotName string) (string, error) {
+	m.exported = append(m.exported, snapshotName)
+	return "/work/" + vmName + "/fork-" + snapshotName + ".qcow2", nil
+}
+
+func (m *forkManager) CloneFromDisk(_ context.Context, _, name string, _, _ int, _ string, opts ...libvirt.CloneOption) (libvirt.DomainRef, error) {
+	if len(m.clones)+1 == m.failClone {
+		return libvirt.DomainRef{}, errors.New("clone failed")
+	}
+	var co libvirt.CloneOptions
+	for _, o := range opts {
+		o(&co)
+	}
+	m.clones = append(m.clones, name)
+	m.hostnames = append(m.hostnames, co.Hostname)
+	return libvirt.DomainRef{Name: name}, nil
+}
+
+func (m *forkManager) DestroyVM(_ context.Context, name string) error {
+	m.destroyed = append(m.destroyed, name)
+	return nil
+}
+
+// failCreateStore fails every CreateSandbox.
+type failCreateStore struct{ *memStore }
+
+func (failCreateStore) CreateSandbox(context.Context, *store.Sandbox) error {
+	return errors.New("database unavailable")
+}
+
+func forkParent(state store.SandboxState) *store.Sandbox {
+	ttl := 600
+	return &store.Sandbox{
+		ID: "SBX-P", JobID: "JOB-P", AgentID: "agent-1", SandboxName: "sbx-parent", BaseImage: "base.qcow2",
+		Network: "default", State: state, CPU: 2, MemoryMB: 1024, TTLSeconds: &ttl,
+		Labels: map[string]string{"team": "infra"},
+		Spec:   &store.SandboxSpec{ScratchDisksGB: []int{5}},
+	}
+}
+
+func TestForkSandbox(t *testing.T) {
+	ctx := context.Background()
+	st := newMemStore(forkParent(store.SandboxStateRunning))
+	mgr := &forkManager{}
+	rec := &eventRecorder{}
+	svc := NewService(mgr, st, Config{}, WithEventPublisher(rec))
+
+	children, sn, err := svc.ForkSandbox(ctx, "SBX-P", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mgr.snapshots) != 1 || sn.Name != mgr.snapshots[0] || !slices.Equal(mgr.exported, mgr.snapshots) {
+		t.Fatalf("snapshots %v, exported %v, returned %+v", mgr.snapshots, mgr.exported, sn)
+	}
+	if len(children) != 2 || !slices.Equal(mgr.clones, mgr.hostnames) {
+		t.Fatalf("children %d, clones %v, hostnames %v", len(children), mgr.clones, mgr.hostnames)
+	}
+	for i, c := range children {
+		stored, err := st.GetSandbox(ctx, c.ID)
+		if err != nil {
+			t.Fatalf("child %d not stored: %v", i, err)
+		}
+		if stored.SandboxName != mgr.clones[i] || stored.AgentID != "agent-1" || stored.CPU != 2 || stored.MemoryMB != 1024 ||
+			stored.Network != "default" || stored.Labels["team"] != "infra" || *stored.TTLSeconds != 600 {
+			t.Errorf("child %d = %+v", i, stored)
+		}
+		if stored.ParentID == nil || *stored.ParentID != "SBX-P" || stored.ParentSnapshot == nil || *stored.ParentSnapshot != sn.Name {
+			t.Errorf("child %d provenance = %v, %v", i, stored.ParentID, stored.ParentSnapshot)
+		}
+		if stored.State != store.SandboxStateCreated || stored.JobID == "JOB-P" {
+			t.Errorf("child %d state %s, job %s", i, stored.State, stored.JobID)
+		}
+	}
+	last := rec.events[len(rec.events)-1]
+	if last.Type != events.TypeSandboxForked || last.SandboxID != "SBX-P" || len(last.Data["children"].([]string)) != 2 {
+		t.Errorf("last event = %+v", last)
+	}
+
+	// A named snapshot is exported as is; external snapshots are refused.
+	st.snapshots = append(st.snapshots,
+		&store.Snapshot{SandboxID: "SBX-P", Name: "golden", Kind: store.SnapshotKindInternal},
+		&store.Snapshot{SandboxID: "SBX-P", Name: "disk-only", Kind: store.SnapshotKindExternal})
+	if _, sn, err := svc.ForkSandbox(ctx, "SBX-P", "golden", 1); err != nil || sn.Name != "golden" || mgr.exported[len(mgr.exported)-1] != "golden" {
+		t.Errorf("named snapshot: %v, %+v, exported %v", err, sn, mgr.exported)
+	}
+	if _, _, err := svc.ForkSandbox(ctx, "SBX-P", "disk-only", 1); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("external snapshot: err = %v, want ErrInvalid", err)
+	}
+	if _, _, err := svc.ForkSandbox(ctx, "SBX-P", "missing", 1); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("missing snapshot: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestForkSandboxRejected(t *testing.T) {
+	cases := []struct {
+		name    string
+		state   store.SandboxState
+		count   int
+		wantErr error
+	}{
+		{"zero children", store.SandboxStateRunning, 0, store.ErrInvalid},
+		{"too many children", store.SandboxStateRunning, maxForkCount + 1, store.ErrInvalid},
+		{"destroyed parent", store.SandboxStateDestroyed, 1, store.ErrConflict},
+		{"hibernated parent", store.SandboxStateHibernated, 1, store.ErrConflict},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mgr := &forkManager{}
+			svc := NewService(mgr, newMemStore(forkParent(c.state)), Config{})
+			children, _, err := svc.ForkSandbox(context.Background(), "SBX-P", "", c.count)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			if len(children) != 0 || len(mgr.snapshots) != 0 || len(mgr.clones) != 0 {
+				t.Errorf("children %d, snapshots %v, clones %v", len(children), mgr.snapshots, mgr.clones)
+			}
+		})
+	}
+}
+
+func TestForkSandboxPartialFailure(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("quota", func(t *testing.T) {
+		// The parent uses 2 of 6 vCPUs, leaving room for two children.
+		st := newMemStore(forkParent(store.SandboxStateRunning))
+		mgr := &forkManager{}
+		svc := NewService(mgr, st, Config{AgentVCPUQuota: 6})
+		children, _, err := svc.ForkSandbox(ctx, "SBX-P", "", 3)
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("err = %v, want ErrQuotaExceeded", err)
+		}
+		if len(children) != 2 || len(mgr.clones) != 2 || len(st.sandboxes) != 3 {
+			t.Errorf("children %d, clones %d, stored %d", len(children), len(mgr.clones), len(st.sandboxes))
+		}
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		st := newMemStore(forkParent(store.SandboxStateRunning))
+		mgr := &forkManager{failClone: 2}
+		svc := NewService(mgr, st, Config{})
+		children, sn, err := svc.ForkSandbox(ctx, "SBX-P", "", 3)
+		if err == nil || sn == nil {
+			t.Fatalf("err = %v, snapshot %+v", err, sn)
+		}
+		if len(children) != 1 || children[0].SandboxName != mgr.clones[0] || len(st.sandboxes) != 2 {
+			t.Errorf("children %d, clones %v, stored %d", len(children), mgr.clones, len(st.sandboxes))
+		}
+	})
+
+	t.Run("persist", func(t *testing.T) {
+		st := failCreateStore{newMemStore(forkParent(store.SandboxStateRunning))}
+		mgr := &forkManager{}
+		svc := NewService(mgr, st, Config{})
+		children, _, err := svc.ForkSandbox(ctx, "SBX-P", "", 2)
+		if err == nil || len(children) != 0 {
+			t.Fatalf("children %d, err = %v", len(children), err)
+		}
+		if !slices.Equal(mgr.destroyed, mgr.clones) || len(mgr.clones) != 1 {
+			t.Errorf("cloned %v, destroyed %v", mgr.clones, mgr.destroyed)
+		}
+	})
+}
+
+func TestDestroySandboxWithForks(t *testing.T) {
+	ctx := context.Background()
+	parentID := "SBX-P"
+	st := newMemStore(
+		forkParent(store.SandboxStateRunning),
+		&store.Sandbox{ID: "SBX-C", SandboxName: "sbx-child", State: store.SandboxStateRunning, ParentID: &parentID},
+		&store.Sandbox{ID: "SBX-U", SandboxName: "sbx-other", State: store.SandboxStateRunning},
+	)
+	mgr := &forkManager{}
+	svc := NewService(mgr, st, Config{})
+
+	if err := svc.DestroySandbox(ctx, "SBX-P"); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("destroy forked parent: err = %v, want ErrConflict", err)
+	}
+	if len(mgr.destroyed) != 0 {
+		t.Fatalf("destroyed %v while forks were live", mgr.destroyed)
+	}
+	if err := svc.DestroySandbox(ctx, "SBX-U"); err != nil {
+		t.Fatalf("destroy unrelated sandbox: %v", err)
+	}
+
+	// Once its fork is gone the parent can be destroyed.
+	if err := svc.DestroySandbox(ctx, "SBX-C"); err != nil {
+		t.Fatalf("destroy fork: %v", err)
+	}
+	if err := svc.DestroySandbox(ctx, "SBX-P"); err != nil {
+		t.Fatalf("destroy parent without forks: %v", err)
+	}
+	if want := []string{"sbx-other", "sbx-child", "sbx-parent"}; !slices.Equal(mgr.destroyed, want) {
+		t.Errorf("destroyed %v, want %v", mgr.destroyed, want)
+	}
+}
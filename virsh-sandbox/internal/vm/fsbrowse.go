@@ -0,0 +1,370 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"virsh-sandbox/internal/diskimage"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// maxDirEntries caps the entries returned for one directory listing.
+const maxDirEntries = 10000
+
+// ErrFSUnsupported is returned when a sandbox's disk holds a filesystem or
+// image format the in-process readers do not support, such as XFS.
+var ErrFSUnsupported = errors.New("filesystem not supported for browsing")
+
+// FileInfo describes a path in a sandbox's disk.
+type FileInfo struct {
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"` // file, dir, symlink, device, fifo or socket
+	Mode       string    `json:"mode"` // permission bits in octal, e.g. "0644"
+	Size       int64     `json:"size"`
+	UID        uint32    `json:"uid"`
+	GID        uint32    `json:"gid"`
+	ModTime    time.Time `json:"mod_time"`
+	LinkTarget string    `json:"link_target,omitempty"`
+}
+
+// DirListing is a directory and its entries, sorted by name.
+type DirListing struct {
+	FileInfo
+	Entries   []FileInfo `json:"entries"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// FileContent is a byte range of a regular file.
+type FileContent struct {
+	Info   FileInfo
+	Offset int64
+	Data   []byte
+}
+
+// StatSandboxPath describes a path without following a final symbolic link.
+// An empty snapshot reads the current disk of a stopped sandbox.
+func (s *Service) StatSandboxPath(ctx context.Context, sandboxID, snapshot, name string) (*FileInfo, error) {
+	var out *FileInfo
+	err := s.withSandboxFS(ctx, sandboxID, snapshot, func(fsys diskimage.FS) error {
+		p := guestPath(name)
+		fi, err := fsys.Lstat(p)
+		if err != nil {
+			return fsError(err)
+		}
+		out = fileInfo(fsys, p, fi)
+		return nil
+	})
+	return out, err
+}
+
+// ListSandboxDir lists a directory, following symbolic links. At most
+// maxDirEntries entries are returned.
+func (s *Service) ListSandboxDir(ctx context.Context, sandboxID, snapshot, name string) (*DirListing, error) {
+	var out *DirListing
+	err := s.withSandboxFS(ctx, sandboxID, snapshot, func(fsys diskimage.FS) error {
+		p := guestPath(name)
+		fi, err := fsys.Stat(p)
+		if err != nil {
+			return fsError(err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory: %w", name, store.ErrInvalid)
+		}
+		entries, err := fsys.ReadDir(p)
+		if err != nil {
+			return fsError(err)
+		}
+		out = &DirListing{FileInfo: *fileInfo(fsys, p, fi), Entries: []FileInfo{}}
+		if len(entries) > maxDirEntries {
+			entries, out.Truncated = entries[:maxDirEntries], true
+		}
+		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			info, err := e.Info()
+			if err != nil {
+				return fsError(err)
+			}
+			out.Entries = append(out.Entries, *fileInfo(fsys, path.Join(p, e.Name()), info))
+		}
+		return nil
+	})
+	return out, err
+}
+
+// ReadSandboxFile reads length bytes of a regular file from offset,
+// following symbolic links. A length of zero reads to the end of the file.
+// The range may not exceed Config.FSMaxFileBytes.
+func (s *Service) ReadSandboxFile(ctx context.Context, sandboxID, snapshot, name string, offset, length int64) (*FileContent, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("offset and length must not be negative: %w", store.ErrInvalid)
+	}
+	var out *FileContent
+	err := s.withSandboxFS(ctx, sandboxID, snapshot, func(fsys diskimage.FS) error {
+		p := guestPath(name)
+		f, err := fsys.Open(p)
+		if err != nil {
+			return fsError(err)
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return fsError(err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file: %w", name, store.ErrInvalid)
+		}
+		n := fi.Size() - min(offset, fi.Size())
+		if length > 0 {
+			n = min(n, length)
+		}
+		if n > s.cfg.FSMaxFileBytes {
+			return fmt.Errorf("%s: %d bytes requested, at most %d may be read at once; pass offset and length: %w",
+				name, n, s.cfg.FSMaxFileBytes, store.ErrInvalid)
+		}
+		r, ok := f.(io.ReaderAt)
+		if !ok {
+			return fmt.Errorf("%s: %w", name, ErrFSUnsupported)
+		}
+		data := make([]byte, n)
+		if _, err := r.ReadAt(data, offset); err != nil && err != io.EOF {
+			return fsError(err)
+		}
+		out = &FileContent{Info: *fileInfo(fsys, p, fi), Offset: offset, Data: data}
+		return nil
+	})
+	return out, err
+}
+
+// withSandboxFS runs fn on the root filesystem of a sandbox's disk at a
+// snapshot, or its current disk when snapshot is empty.
+func (s *Service) withSandboxFS(ctx context.Context, sandboxID, snapshot string, fn func(diskimage.FS) error) error {
+	sb, err := s.store.GetSandbox(ctx, sandboxID)
+	if err != nil {
+		return err
+	}
+	if sb.Runtime == store.RuntimeContainer {
+		return fmt.Errorf("sandbox %s is a container; only VM disks can be browsed: %w", sb.ID, store.ErrInvalid)
+	}
+	if snapshot != "" {
+		if _, err := s.store.GetSnapshotByName(ctx, sb.ID, snapshot); err != nil {
+			return fmt.Errorf("snapshot %s: %w", snapshot, err)
+		}
+	} else {
+		switch sb.State {
+		case store.SandboxStateStarting, store.SandboxStateRunning, store.SandboxStatePaused:
+			return fmt.Errorf("sandbox %s is %s; stop it or browse a snapshot: %w", sb.ID, sb.State, store.ErrConflict)
+		case store.SandboxStateDestroyed:
+			return fmt.Errorf("sandbox %s is destroyed: %w", sb.ID, store.ErrNotFound)
+		}
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	disk, err := mgr.SnapshotDisk(ctx, sb.SandboxName, snapshot)
+	if err != nil {
+		return fmt.Errorf("locate disk: %w", err)
+	}
+	label := snapshot
+	if label == "" {
+		label = "current"
+	}
+	d, err := s.disks.acquire(label, disk)
+	if err != nil {
+		if errors.Is(err, diskimage.ErrUnsupported) {
+			return fmt.Errorf("%w: %w", ErrFSUnsupported, err)
+		}
+		return err
+	}
+	defer s.disks.release(disk, d)
+	return fn(d.root.fs)
+}
+
+// guestPath converts an absolute guest path to an fs.FS name.
+func guestPath(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+// fsError maps guest filesystem errors to store sentinels.
+func fsError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: %w", store.ErrNotFound, err)
+	case errors.Is(err, fs.ErrInvalid):
+		return fmt.Errorf("%w: %w", store.ErrInvalid, err)
+	case errors.Is(err, diskimage.ErrUnsupported):
+		return fmt.Errorf("%w: %w", ErrFSUnsupported, err)
+	}
+	return err
+}
+
+// fileInfo converts fi, found at p, for the API.
+func fileInfo(fsys diskimage.FS, p string, fi fs.FileInfo) *FileInfo {
+	out := &FileInfo{
+		Path:    path.Clean("/" + p),
+		Name:    path.Base("/" + p),
+		Type:    fileType(fi.Mode()),
+		Mode:    fileModeOctal(fi.Mode()),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if st, ok := fi.Sys().(*diskimage.FileStat); ok {
+		out.UID, out.GID = st.UID, st.GID
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		out.LinkTarget, _ = fsys.ReadLink(p)
+	}
+	return out
+}
+
+// fileModeOctal formats the permission, setuid, setgid and sticky bits as
+// chmod takes them.
+func fileModeOctal(m fs.FileMode) string {
+	bits := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+func fileType(m fs.FileMode) string {
+	switch {
+	case m.IsDir():
+		return "dir"
+	case m&fs.ModeSymlink != 0:
+		return "symlink"
+	case m&fs.ModeDevice != 0:
+		return "device"
+	case m&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case m&fs.ModeSocket != 0:
+		return "socket"
+	}
+	return "file"
+}
+
+// diskCache keeps snapshot disks open between browse requests. A disk is
+// closed once it has been unused for ttl, or when its image file changes.
+type diskCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	disks map[libvirt.DiskState]*cachedDisk
+}
+
+type cachedDisk struct {
+	root    *snapshotRoot
+	modTime time.Time
+	refs    int
+	timer   *time.Timer
+	stale   bool // replaced in the cache; closed on last release
+}
+
+func newDiskCache(ttl time.Duration) *diskCache {
+	return &diskCache{ttl: ttl, disks: make(map[libvirt.DiskState]*cachedDisk)}
+}
+
+// acquire returns the open root filesystem of disk, opening it if it is
+// not cached or its image changed. Callers must release it.
+func (c *diskCache) acquire(name string, disk libvirt.DiskState) (*cachedDisk, error) {
+	fi, err := os.Stat(disk.Path)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	if d := c.lookup(disk, fi.ModTime()); d != nil {
+		return d, nil
+	}
+	root, err := openSnapshotRoot(name, disk)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.lookupLocked(disk, fi.ModTime()); d != nil {
+		// Opened concurrently.
+		root.img.Close()
+		return d, nil
+	}
+	d := &cachedDisk{root: root, modTime: fi.ModTime(), refs: 1}
+	c.disks[disk] = d
+	return d, nil
+}
+
+func (c *diskCache) lookup(disk libvirt.DiskState, modTime time.Time) *cachedDisk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookupLocked(disk, modTime)
+}
+
+// lookupLocked returns a cached, current disk with a reference taken, and
+// evicts an outdated one.
+func (c *diskCache) lookupLocked(disk libvirt.DiskState, modTime time.Time) *cachedDisk {
+	d, ok := c.disks[disk]
+	if !ok {
+		return nil
+	}
+	if !d.modTime.Equal(modTime) {
+		c.evictLocked(disk, d)
+		return nil
+	}
+	d.refs++
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	return d
+}
+
+// release drops a reference; the last one starts the idle timer.
+func (c *diskCache) release(disk libvirt.DiskState, d *cachedDisk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d.refs--; d.refs > 0 {
+		return
+	}
+	if d.stale {
+		d.root.img.Close()
+		return
+	}
+	d.timer = time.AfterFunc(c.ttl, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if d.refs == 0 && c.disks[disk] == d {
+			c.evictLocked(disk, d)
+		}
+	})
+}
+
+// evictLocked removes d from the cache, closing it unless in use.
+func (c *diskCache) evictLocked(disk libvirt.DiskState, d *cachedDisk) {
+	delete(c.disks, disk)
+	d.stale = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.refs == 0 {
+		d.root.img.Close()
+	}
+}
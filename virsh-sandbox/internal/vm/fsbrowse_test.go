@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// fsStore serves the sandbox and snapshot lookups of file browsing.
+type fsStore struct {
+	store.Store
+	sandbox *store.Sandbox
+}
+
+func (f *fsStore) GetSandbox(_ context.Context, id string) (*store.Sandbox, error) {
+	if id != f.sandbox.ID {
+		return nil, store.ErrNotFound
+	}
+	return f.sandbox, nil
+}
+
+func (f *fsStore) GetSnapshotByName(_ context.Context, _, name string) (*store.Snapshot, error) {
+	if name != "snap1" {
+		return nil, store.ErrNotFound
+	}
+	return &store.Snapshot{Name: name}, nil
+}
+
+// diskManager locates every snapshot at one disk image.
+type diskManager struct {
+	libvirt.Manager
+	disk string
+}
+
+func (m diskManager) SnapshotDisk(context.Context, string, string) (libvirt.DiskState, error) {
+	return libvirt.DiskState{Path: m.disk}, nil
+}
+
+// makeExt4Disk builds an unpartitioned raw ext4 disk from dir.
+func makeExt4Disk(t *testing.T, dir string) string {
+	t.Helper()
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("mke2fs not installed")
+	}
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	if out, err := exec.Command("mke2fs", "-q", "-F", "-t", "ext4", "-d", dir, disk, "8192").CombinedOutput(); err != nil {
+		t.Skipf("mke2fs: %v: %s", err, out)
+	}
+	return disk
+}
+
+func TestReadSandboxFile(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "etc/os-release"), []byte("ID=test\nVERSION=1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/os-release", filepath.Join(src, "release")); err != nil {
+		t.Fatal(err)
+	}
+	disk := makeExt4Disk(t, src)
+
+	sb := &store.Sandbox{ID: "SBX-1", SandboxName: "sbx-1", State: store.SandboxStateRunning}
+	s := &Service{
+		mgr:   diskManager{disk: disk},
+		store: &fsStore{sandbox: sb},
+		cfg:   Config{FSMaxFileBytes: 10},
+		disks: newDiskCache(time.Minute),
+	}
+	ctx := context.Background()
+
+	c, err := s.ReadSandboxFile(ctx, "SBX-1", "snap1", "/release", 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Data) != "VERSION=1\n" || c.Info.Size != 18 || c.Info.Path != "/release" {
+		t.Fatalf("ReadSandboxFile = %q, %+v", c.Data, c.Info)
+	}
+	if _, err := s.ReadSandboxFile(ctx, "SBX-1", "snap1", "/etc/os-release", 0, 0); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("read over the size limit: err = %v, want ErrInvalid", err)
+	}
+	if _, err := s.ReadSandboxFile(ctx, "SBX-1", "snap1", "/etc", 0, 1); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("read of a directory: err = %v, want ErrInvalid", err)
+	}
+	if _, err := s.StatSandboxPath(ctx, "SBX-1", "snap1", "/../missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("stat of a missing path: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.StatSandboxPath(ctx, "SBX-1", "snap2", "/"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("unknown snapshot: err = %v, want ErrNotFound", err)
+	}
+	// The current disk of a running sandbox is not consistent.
+	if _, err := s.ListSandboxDir(ctx, "SBX-1", "", "/"); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("current disk of a running sandbox: err = %v, want ErrConflict", err)
+	}
+
+	sb.State = store.SandboxStateStopped
+	l, err := s.ListSandboxDir(ctx, "SBX-1", "", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range l.Entries {
+		names = append(names, e.Name+":"+e.Type+":"+e.LinkTarget)
+	}
+	if l.Path != "/" || len(names) != 3 || names[0] != "etc:dir:" || names[2] != "release:symlink:/etc/os-release" {
+		t.Fatalf("ListSandboxDir(/) = %s %v", l.Path, names)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "etc/os-release"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	disk := libvirt.DiskState{Path: makeExt4Disk(t, src)}
+	c := newDiskCache(20 * time.Millisecond)
+
+	a, err := c.acquire("snap", disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.acquire("snap", disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b || a.refs != 2 {
+		t.Fatalf("second acquire opened the disk again (refs %d)", a.refs)
+	}
+
+	// A changed image is reopened; the old one closes on its last release.
+	if err := os.Chtimes(disk.Path, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.acquire("snap", disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == a || !a.stale {
+		t.Fatal("changed image was not reopened")
+	}
+	c.release(disk, a)
+	c.release(disk, b)
+	c.release(disk, d)
+
+	// Idle disks are closed after the TTL.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		n := len(c.disks)
+		c.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle disk was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !d.stale {
+		t.Error("expired disk not marked closed")
+	}
+}
@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// mountTagRe limits tags to what both virtiofs (36 bytes) and 9p accept.
+var mountTagRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,36}$`)
+
+// checkMounts validates mounts, resolves their host paths and rejects any
+// outside Config.SharedDirAllowlist. Resolved paths are written back so a
+// symlink swapped in later cannot redirect the share.
+func (s *Service) checkMounts(mounts []store.HostMount) error {
+	seen := make(map[string]bool, len(mounts))
+	for i := range mounts {
+		m := &mounts[i]
+		if !mountTagRe.MatchString(m.Tag) {
+			return fmt.Errorf("mounts[%d].tag %q must be 1-36 letters, digits, '_' or '-': %w", i, m.Tag, store.ErrInvalid)
+		}
+		if seen[m.Tag] {
+			return fmt.Errorf("mounts[%d].tag %q is used twice: %w", i, m.Tag, store.ErrInvalid)
+		}
+		seen[m.Tag] = true
+		if m.GuestPath == "" {
+			m.GuestPath = "/mnt/" + m.Tag
+		}
+		if !filepath.IsAbs(m.GuestPath) || strings.ContainsAny(m.GuestPath, "'\n") {
+			return fmt.Errorf("mounts[%d].guest_path must be an absolute path without quotes: %w", i, store.ErrInvalid)
+		}
+		resolved, err := s.allowedHostPath(m.HostPath)
+		if err != nil {
+			return fmt.Errorf("mounts[%d].host_path: %w", i, err)
+		}
+		m.HostPath = resolved
+	}
+	return nil
+}
+
+// allowedHostPath resolves p and returns it if it lies within an allowlisted directory.
+func (s *Service) allowedHostPath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("%q must be absolute: %w", p, store.ErrInvalid)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(p))
+	if err != nil {
+		return "", fmt.Errorf("%q: %v: %w", p, err, store.ErrInvalid)
+	}
+	for _, dir := range s.cfg.SharedDirAllowlist {
+		dir = filepath.Clean(dir)
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		if resolved == dir || strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not under an allowed shared directory: %w", p, store.ErrInvalid)
+}
+
+// sharedDirs converts mounts to the libvirt clone option form.
+func sharedDirs(mounts []store.HostMount) []libvirt.SharedDir {
+	out := make([]libvirt.SharedDir, 0, len(mounts))
+	for _, m := range mounts {
+		out = append(out, libvirt.SharedDir{HostPath: m.HostPath, Tag: m.Tag, ReadOnly: m.ReadOnly, GuestPath: m.GuestPath})
+	}
+	return out
+}
+
+// mountCommand mounts m in the guest, trying virtiofs first and 9p second so
+// it works with whichever driver the host picked. Read-only mounts are always
+// shared over 9p and mounted as such. It is idempotent and runs as a
+// cloud-init bootcmd on every boot.
+func mountCommand(m store.HostMount) string {
+	if m.ReadOnly {
+		return fmt.Sprintf("mkdir -p '%[1]s' && (mountpoint -q '%[1]s' || mount -t 9p -o trans=virtio,version=9p2000.L,ro %[2]s '%[1]s')",
+			m.GuestPath, m.Tag)
+	}
+	return fmt.Sprintf("mkdir -p '%[1]s' && (mountpoint -q '%[1]s' || mount -t virtiofs %[2]s '%[1]s' || mount -t 9p -o trans=virtio,version=9p2000.L %[2]s '%[1]s')",
+		m.GuestPath, m.Tag)
+}
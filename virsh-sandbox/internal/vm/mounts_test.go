@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"virsh-sandbox/internal/store"
+)
+
+func TestCheckMountsAllowlist(t *testing.T) {
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	src := filepath.Join(allowed, "src")
+	if err := os.Mkdir(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	escape := filepath.Join(allowed, "escape")
+	if err := os.Symlink(outside, escape); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{cfg: Config{SharedDirAllowlist: []string{allowed}}}
+
+	mounts := []store.HostMount{{HostPath: src, Tag: "src", ReadOnly: true}}
+	if err := s.checkMounts(mounts); err != nil {
+		t.Fatalf("checkMounts: %v", err)
+	}
+	if mounts[0].GuestPath != "/mnt/src" {
+		t.Errorf("guest path = %q, want /mnt/src", mounts[0].GuestPath)
+	}
+
+	for _, m := range []store.HostMount{
+		{HostPath: outside, Tag: "out"},
+		{HostPath: escape, Tag: "link"},
+		{HostPath: filepath.Join(allowed, "..", filepath.Base(outside)), Tag: "dots"},
+		{HostPath: src, Tag: "bad tag"},
+	} {
+		if err := s.checkMounts([]store.HostMount{m}); err == nil {
+			t.Errorf("checkMounts(%+v) succeeded, want rejection", m)
+		}
+	}
+	if err := s.checkMounts([]store.HostMount{{HostPath: src, Tag: "a"}, {HostPath: src, Tag: "a"}}); err == nil {
+		t.Error("duplicate tags accepted")
+	}
+}
+
+func TestMountCommandReadOnly(t *testing.T) {
+	cmd := mountCommand(store.HostMount{Tag: "data", GuestPath: "/srv/data", ReadOnly: true})
+	if strings.Contains(cmd, "virtiofs") || !strings.Contains(cmd, "mount -t 9p -o trans=virtio,version=9p2000.L,ro data '/srv/data'") {
+		t.Errorf("mountCommand = %q", cmd)
+	}
+	cmd = mountCommand(store.HostMount{Tag: "data", GuestPath: "/srv/data"})
+	if !strings.Contains(cmd, "mount -t virtiofs data '/srv/data'") || !strings.Contains(cmd, "version=9p2000.L data") {
+		t.Errorf("mountCommand = %q", cmd)
+	}
+}
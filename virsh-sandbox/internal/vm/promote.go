@@ -0,0 +1,225 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/image"
+	"virsh-sandbox/internal/store"
+)
+
+// PromoteOption configures a single PromoteSandbox call.
+type PromoteOption func(*promoteOptions)
+
+type promoteOptions struct {
+	snapshot string
+	diffID   string
+	sanitize bool
+	sourceVM string
+	os       store.OSInfo
+}
+
+// FromSnapshot promotes the named internal snapshot instead of the current disk.
+func FromSnapshot(name string) PromoteOption {
+	return func(o *promoteOptions) { o.snapshot = name }
+}
+
+// WithDiff records the diff describing the changes the image carries. It must
+// belong to the promoted sandbox.
+func WithDiff(diffID string) PromoteOption {
+	return func(o *promoteOptions) { o.diffID = diffID }
+}
+
+// WithSanitize removes per-instance identity and state from the image.
+func WithSanitize() PromoteOption {
+	return func(o *promoteOptions) { o.sanitize = true }
+}
+
+// AsSourceVM also defines a libvirt domain named name on the image, so it
+// can be used as a source VM for CreateSandbox. The name must not be in use
+// by a domain or a sandbox.
+func AsSourceVM(name string) PromoteOption {
+	return func(o *promoteOptions) { o.sourceVM = name }
+}
+
+// WithImageOS sets the guest OS metadata of the promoted image.
+func WithImageOS(info store.OSInfo) PromoteOption {
+	return func(o *promoteOptions) { o.os = info }
+}
+
+// PromoteSandbox flattens a sandbox's disk into a standalone qcow2 and adds it
+// to the base image catalog under name, optionally sanitized and defined as a
+// source VM. The image record carries provenance linking back to the sandbox,
+// the snapshot and the diff.
+//
+// Without FromSnapshot the disk is read as it is now, so the sandbox must be
+// CREATED or STOPPED; an internal snapshot can be promoted in any state, and
+// a running sandbox is paused while its disk is read, as for ForkSandbox. The
+// record is created as IMPORTING before the disk is written, so the name is
+// reserved, and ends READY or FAILED.
+func (s *Service) PromoteSandbox(ctx context.Context, sandboxID, name string, opts ...PromoteOption) (*store.BaseImage, error) {
+	if err := image.ValidateName(name); err != nil {
+		return nil, err
+	}
+	var po promoteOptions
+	for _, o := range opts {
+		o(&po)
+	}
+	if po.sourceVM != "" {
+		if err := image.ValidateName(po.sourceVM); err != nil {
+			return nil, fmt.Errorf("source VM: %w", err)
+		}
+	}
+
+	var (
+		sb  *store.Sandbox
+		err error
+	)
+	if po.snapshot == "" {
+		sb, err = s.sandboxInState(ctx, sandboxID, store.SandboxStateCreated, store.SandboxStateStopped)
+	} else {
+		sb, err = s.store.GetSandbox(ctx, sandboxID)
+		if err == nil && sb.State == store.SandboxStateDestroyed {
+			err = fmt.Errorf("sandbox %s is %s: %w", sb.ID, sb.State, store.ErrConflict)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sb.Runtime == store.RuntimeContainer {
+		return nil, fmt.Errorf("sandbox %s is a container; only VM sandboxes can be promoted: %w", sb.ID, store.ErrInvalid)
+	}
+	if po.snapshot != "" {
+		sn, err := s.store.GetSnapshotByName(ctx, sb.ID, po.snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %q: %w", po.snapshot, err)
+		}
+		if sn.Kind != store.SnapshotKindInternal {
+			return nil, fmt.Errorf("snapshot %s is %s; only internal snapshots can be promoted: %w", sn.Name, sn.Kind, store.ErrInvalid)
+		}
+	}
+	if po.diffID != "" {
+		d, err := s.store.GetDiff(ctx, po.diffID)
+		if err != nil {
+			return nil, fmt.Errorf("diff %q: %w", po.diffID, err)
+		}
+		if d.SandboxID != sb.ID {
+			return nil, fmt.Errorf("diff %s belongs to sandbox %s: %w", d.ID, d.SandboxID, store.ErrInvalid)
+		}
+	}
+
+	if po.sourceVM != "" {
+		if err := s.checkSourceVMFree(ctx, sb, po.sourceVM); err != nil {
+			return nil, err
+		}
+	}
+
+	img := &store.BaseImage{
+		ID:           fmt.Sprintf("IMG-%s", id.Short()),
+		Name:         name,
+		Filename:     name + ".qcow2",
+		Source:       "sandbox:" + sb.ID,
+		SourceFormat: "qcow2",
+		OS:           po.os,
+		Status:       store.ImageStatusImporting,
+		Provenance: &store.ImageProvenance{
+			SandboxID:   sb.ID,
+			SandboxName: sb.SandboxName,
+			AgentID:     sb.AgentID,
+			BaseImage:   sb.BaseImage,
+			Snapshot:    po.snapshot,
+			DiffID:      po.diffID,
+			Sanitized:   po.sanitize,
+			SourceVM:    po.sourceVM,
+		},
+	}
+	if err := s.store.CreateBaseImage(ctx, img); err != nil {
+		return nil, err
+	}
+
+	if err := s.promoteDisk(ctx, sb, img, po); err != nil {
+		msg := err.Error()
+		img.Status = store.ImageStatusFailed
+		img.Error = &msg
+		if uerr := s.store.UpdateBaseImage(ctx, img); uerr != nil {
+			return nil, fmt.Errorf("%w (record failure: %v)", err, uerr)
+		}
+		return img, err
+	}
+	img.Status = store.ImageStatusReady
+	if err := s.store.UpdateBaseImage(ctx, img); err != nil {
+		return nil, err
+	}
+
+	data := map[string]any{
+		"image_id":  img.ID,
+		"name":      img.Name,
+		"sanitized": po.sanitize,
+	}
+	if po.snapshot != "" {
+		data["snapshot"] = po.snapshot
+	}
+	if po.diffID != "" {
+		data["diff_id"] = po.diffID
+	}
+	if po.sourceVM != "" {
+		data["source_vm"] = po.sourceVM
+	}
+	s.publish(ctx, events.TypeSandboxPromoted, sb, data)
+	return img, nil
+}
+
+// checkSourceVMFree returns store.ErrConflict if a sandbox or a domain already
+// uses name: defining a domain under an existing name redefines it in place,
+// repointing it at the promoted disk.
+func (s *Service) checkSourceVMFree(ctx context.Context, sb *store.Sandbox, name string) error {
+	users, err := s.store.ListSandboxes(ctx, store.SandboxFilter{VMName: &name}, &store.ListOptions{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("list sandboxes: %w", err)
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("source VM name %s is used by sandbox %s: %w", name, users[0].ID, store.ErrConflict)
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	exists, err := mgr.DomainExists(ctx, name)
+	if err != nil {
+		return fmt.Errorf("look up domain %s: %w", name, err)
+	}
+	if exists {
+		return fmt.Errorf("domain %s already exists: %w", name, store.ErrConflict)
+	}
+	return nil
+}
+
+// promoteDisk writes img's file from sb's disk and defines the source VM, if requested.
+func (s *Service) promoteDisk(ctx context.Context, sb *store.Sandbox, img *store.BaseImage, po promoteOptions) error {
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	disk, err := mgr.FlattenDisk(ctx, sb.SandboxName, po.snapshot, img.Filename, po.sanitize)
+	if err != nil {
+		return fmt.Errorf("flatten disk: %w", err)
+	}
+	img.SizeBytes = disk.SizeBytes
+	img.VirtualSizeBytes = disk.VirtualSizeBytes
+	if po.sourceVM == "" {
+		return nil
+	}
+	cpu, memoryMB := sb.CPU, sb.MemoryMB
+	if cpu <= 0 {
+		cpu = s.cfg.DefaultVCPUs
+	}
+	if memoryMB <= 0 {
+		memoryMB = s.cfg.DefaultMemoryMB
+	}
+	if _, err := mgr.DefineVM(ctx, po.sourceVM, disk.Path, cpu, memoryMB, sb.Network); err != nil {
+		return fmt.Errorf("define source VM: %w", err)
+	}
+	return nil
+}
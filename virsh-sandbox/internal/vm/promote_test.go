@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// imageStore adds base images and diffs to memStore. created records each
+// image's status when it was first stored.
+type imageStore struct {
+	*memStore
+	images  map[string]*store.BaseImage
+	created []store.ImageStatus
+	diffs   map[string]*store.Diff
+}
+
+func newImageStore(sandboxes ...*store.Sandbox) *imageStore {
+	return &imageStore{memStore: newMemStore(sandboxes...), images: make(map[string]*store.BaseImage), diffs: make(map[string]*store.Diff)}
+}
+
+func (m *imageStore) CreateBaseImage(_ context.Context, img *store.BaseImage) error {
+	for _, cur := range m.images {
+		if cur.Name == img.Name {
+			return store.ErrAlreadyExists
+		}
+	}
+	cp := *img
+	m.images[img.ID] = &cp
+	m.created = append(m.created, img.Status)
+	return nil
+}
+
+func (m *imageStore) UpdateBaseImage(_ context.Context, img *store.BaseImage) error {
+	if _, ok := m.images[img.ID]; !ok {
+		return store.ErrNotFound
+	}
+	cp := *img
+	m.images[img.ID] = &cp
+	return nil
+}
+
+func (m *imageStore) GetDiff(_ context.Context, id string) (*store.Diff, error) {
+	d, ok := m.diffs[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return d, nil
+}
+
+// promoteManager records FlattenDisk and DefineVM calls; FlattenDisk fails
+// with err when it is set. domains are the names DomainExists knows.
+type promoteManager struct {
+	libvirt.Manager
+	flattened []string // "vm snapshot filename sanitize"
+	defined   []string // "vm diskPath"
+	domains   []string
+	err       error
+}
+
+func (m *promoteManager) DomainExists(_ context.Context, name string) (bool, error) {
+	return slices.Contains(m.domains, name), nil
+}
+
+func (m *promoteManager) FlattenDisk(_ context.Context, vmName, snapshotName, filename string, sanitize bool) (libvirt.DiskImage, error) {
+	call := vmName + " " + snapshotName + " " + filename
+	if sanitize {
+		call += " sanitize"
+	}
+	m.flattened = append(m.flattened, call)
+	if m.err != nil {
+		return libvirt.DiskImage{}, m.err
+	}
+	return libvirt.DiskImage{Path: "/images/" + filename, SizeBytes: 1 << 30, VirtualSizeBytes: 10 << 30}, nil
+}
+
+func (m *promoteManager) DefineVM(_ context.Context, vmName, diskPath string, _, _ int, _ string) (libvirt.DomainRef, error) {
+	m.defined = append(m.defined, vmName+" "+diskPath)
+	return libvirt.DomainRef{Name: vmName}, nil
+}
+
+func TestPromoteSandbox(t *testing.T) {
+	ctx := context.Background()
+	sandbox := func(state store.SandboxState) *store.Sandbox {
+		return &store.Sandbox{ID: "SBX-1", AgentID: "agent-1", SandboxName: "sbx-1", BaseImage: "base.qcow2", State: state}
+	}
+
+	t.Run("current disk", func(t *testing.T) {
+		st := newImageStore(sandbox(store.SandboxStateStopped))
+		st.diffs["DIF-1"] = &store.Diff{ID: "DIF-1", SandboxID: "SBX-1"}
+		mgr := &promoteManager{}
+		rec := &eventRecorder{}
+		svc := NewService(mgr, st, Config{}, WithEventPublisher(rec))
+
+		img, err := svc.PromoteSandbox(ctx, "SBX-1", "web-golden", WithDiff("DIF-1"), WithSanitize(), AsSourceVM("web-src"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(st.created) != 1 || st.created[0] != store.ImageStatusImporting {
+			t.Errorf("created with status %v, want IMPORTING", st.created)
+		}
+		stored := st.images[img.ID]
+		if stored.Status != store.ImageStatusReady || stored.Filename != "web-golden.qcow2" || stored.SizeBytes != 1<<30 || stored.Source != "sandbox:SBX-1" {
+			t.Errorf("image = %+v", stored)
+		}
+		p := stored.Provenance
+		if p == nil || p.SandboxID != "SBX-1" || p.SandboxName != "sbx-1" || p.AgentID != "agent-1" || p.BaseImage != "base.qcow2" ||
+			p.DiffID != "DIF-1" || !p.Sanitized || p.SourceVM != "web-src" || p.Snapshot != "" {
+			t.Errorf("provenance = %+v", p)
+		}
+		if len(mgr.flattened) != 1 || mgr.flattened[0] != "sbx-1  web-golden.qcow2 sanitize" {
+			t.Errorf("flattened %q", mgr.flattened)
+		}
+		if len(mgr.defined) != 1 || mgr.defined[0] != "web-src /images/web-golden.qcow2" {
+			t.Errorf("defined %q", mgr.defined)
+		}
+		if len(rec.events) != 1 || rec.events[0].Type != events.TypeSandboxPromoted || rec.events[0].Data["image_id"] != img.ID {
+			t.Errorf("events = %+v", rec.events)
+		}
+
+		if _, err := svc.PromoteSandbox(ctx, "SBX-1", "web-golden"); !errors.Is(err, store.ErrAlreadyExists) {
+			t.Errorf("duplicate name: err = %v, want ErrAlreadyExists", err)
+		}
+	})
+
+	t.Run("flatten failure", func(t *testing.T) {
+		st := newImageStore(sandbox(store.SandboxStateCreated))
+		mgr := &promoteManager{err: errors.New("disk full")}
+		rec := &eventRecorder{}
+		svc := NewService(mgr, st, Config{}, WithEventPublisher(rec))
+
+		img, err := svc.PromoteSandbox(ctx, "SBX-1", "broken")
+		if !errors.Is(err, mgr.err) || img == nil {
+			t.Fatalf("img %v, err = %v", img, err)
+		}
+		stored := st.images[img.ID]
+		if stored.Status != store.ImageStatusFailed || stored.Error == nil {
+			t.Errorf("image = %+v, want FAILED with an error", stored)
+		}
+		if len(rec.events) != 0 {
+			t.Errorf("published %d events for a failed promote", len(rec.events))
+		}
+	})
+
+	t.Run("source VM name in use", func(t *testing.T) {
+		for _, name := range []string{"golden", "sbx-other"} {
+			st := newImageStore(sandbox(store.SandboxStateStopped), &store.Sandbox{ID: "SBX-2", SandboxName: "sbx-other"})
+			mgr := &promoteManager{domains: []string{"golden", "sbx-1", "sbx-other"}}
+			svc := NewService(mgr, st, Config{})
+
+			if _, err := svc.PromoteSandbox(ctx, "SBX-1", "img", AsSourceVM(name)); !errors.Is(err, store.ErrConflict) {
+				t.Fatalf("%s: err = %v, want ErrConflict", name, err)
+			}
+			if len(st.images) != 0 || len(mgr.flattened) != 0 || len(mgr.defined) != 0 {
+				t.Errorf("%s: stored %d images, flattened %v, defined %v", name, len(st.images), mgr.flattened, mgr.defined)
+			}
+		}
+	})
+
+	cases := []struct {
+		name    string
+		state   store.SandboxState
+		runtime store.Runtime
+		opts    []PromoteOption
+		wantErr error
+	}{
+		{"running without snapshot", store.SandboxStateRunning, "", nil, store.ErrConflict},
+		{"paused without snapshot", store.SandboxStatePaused, "", nil, store.ErrConflict},
+		{"running from snapshot", store.SandboxStateRunning, "", []PromoteOption{FromSnapshot("golden")}, nil},
+		{"destroyed from snapshot", store.SandboxStateDestroyed, "", []PromoteOption{FromSnapshot("golden")}, store.ErrConflict},
+		{"external snapshot", store.SandboxStateRunning, "", []PromoteOption{FromSnapshot("disk-only")}, store.ErrInvalid},
+		{"missing snapshot", store.SandboxStateRunning, "", []PromoteOption{FromSnapshot("missing")}, store.ErrNotFound},
+		{"container", store.SandboxStateStopped, store.RuntimeContainer, nil, store.ErrInvalid},
+		{"diff of another sandbox", store.SandboxStateStopped, "", []PromoteOption{WithDiff("DIF-2")}, store.ErrInvalid},
+		{"unknown diff", store.SandboxStateStopped, "", []PromoteOption{WithDiff("DIF-404")}, store.ErrNotFound},
+		{"invalid source VM name", store.SandboxStateStopped, "", []PromoteOption{AsSourceVM("Bad Name")}, store.ErrInvalid},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sb := sandbox(c.state)
+			sb.Runtime = c.runtime
+			st := newImageStore(sb)
+			st.snapshots = []*store.Snapshot{
+				{SandboxID: "SBX-1", Name: "golden", Kind: store.SnapshotKindInternal},
+				{SandboxID: "SBX-1", Name: "disk-only", Kind: store.SnapshotKindExternal},
+			}
+			st.diffs["DIF-2"] = &store.Diff{ID: "DIF-2", SandboxID: "SBX-2"}
+			mgr := &promoteManager{}
+			svc := NewService(mgr, st, Config{})
+
+			img, err := svc.PromoteSandbox(ctx, "SBX-1", "img", c.opts...)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			if c.wantErr != nil {
+				if len(st.images) != 0 || len(mgr.flattened) != 0 {
+					t.Errorf("rejected promote stored %d images and flattened %v", len(st.images), mgr.flattened)
+				}
+				return
+			}
+			if img.Provenance.Snapshot != "golden" || mgr.flattened[0] != "sbx-1 golden img.qcow2" {
+				t.Errorf("provenance %+v, flattened %q", img.Provenance, mgr.flattened)
+			}
+		})
+	}
+}
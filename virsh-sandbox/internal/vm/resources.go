@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// ErrQuotaExceeded is returned when a create or resize would exceed a
+// per-sandbox or per-agent quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// agentLocks serializes quota-checked changes per agent, so that two creates
+// or resizes cannot both pass checkQuota against the same totals.
+type agentLocks struct {
+	mu    sync.Mutex
+	locks map[string]*agentLock
+}
+
+type agentLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until agentID's lock is held and returns its release function.
+func (l *agentLocks) lock(agentID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*agentLock)
+	}
+	al := l.locks[agentID]
+	if al == nil {
+		al = &agentLock{}
+		l.locks[agentID] = al
+	}
+	al.refs++
+	l.mu.Unlock()
+
+	al.Lock()
+	return func() {
+		al.Unlock()
+		l.mu.Lock()
+		if al.refs--; al.refs == 0 {
+			delete(l.locks, agentID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// lockQuota holds agentID's quota lock until the returned function is called.
+// Callers hold it from checkQuota until the new shape is stored. Without
+// agent quotas there is nothing to race on and it does not block.
+func (s *Service) lockQuota(agentID string) func() {
+	if s.cfg.AgentVCPUQuota <= 0 && s.cfg.AgentMemoryMBQuota <= 0 {
+		return func() {}
+	}
+	return s.quotaLocks.lock(agentID)
+}
+
+// checkQuota verifies a sandbox shape against Config quotas. The agent totals
+// include every live sandbox of agentID except excludeID (the one being resized).
+func (s *Service) checkQuota(ctx context.Context, agentID, excludeID string, cpu, memoryMB, maxCPU, maxMemoryMB int) error {
+	if s.cfg.MaxSandboxVCPUs > 0 && maxCPU > s.cfg.MaxSandboxVCPUs {
+		return fmt.Errorf("%d vCPUs exceeds the per-sandbox limit of %d: %w", maxCPU, s.cfg.MaxSandboxVCPUs, ErrQuotaExceeded)
+	}
+	if s.cfg.MaxSandboxMemoryMB > 0 && maxMemoryMB > s.cfg.MaxSandboxMemoryMB {
+		return fmt.Errorf("%d MB memory exceeds the per-sandbox limit of %d MB: %w", maxMemoryMB, s.cfg.MaxSandboxMemoryMB, ErrQuotaExceeded)
+	}
+	if s.cfg.AgentVCPUQuota <= 0 && s.cfg.AgentMemoryMBQuota <= 0 {
+		return nil
+	}
+	list, err := s.store.ListSandboxes(ctx, store.SandboxFilter{AgentID: &agentID}, nil)
+	if err != nil {
+		return fmt.Errorf("list agent sandboxes: %w", err)
+	}
+	usedCPU, usedMem := cpu, memoryMB
+	for _, sb := range list {
+		if sb.ID == excludeID || sb.State == store.SandboxStateDestroyed {
+			continue
+		}
+		// Sandboxes created before shapes were recorded count the defaults, as in ResizeSandbox.
+		cpu, mem := sb.CPU, sb.MemoryMB
+		if cpu == 0 {
+			cpu = s.cfg.DefaultVCPUs
+		}
+		if mem == 0 {
+			mem = s.cfg.DefaultMemoryMB
+		}
+		usedCPU += cpu
+		usedMem += mem
+	}
+	if s.cfg.AgentVCPUQuota > 0 && usedCPU > s.cfg.AgentVCPUQuota {
+		return fmt.Errorf("agent %s would use %d vCPUs, quota is %d: %w", agentID, usedCPU, s.cfg.AgentVCPUQuota, ErrQuotaExceeded)
+	}
+	if s.cfg.AgentMemoryMBQuota > 0 && usedMem > s.cfg.AgentMemoryMBQuota {
+		return fmt.Errorf("agent %s would use %d MB memory, quota is %d MB: %w", agentID, usedMem, s.cfg.AgentMemoryMBQuota, ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// ResizeSandbox changes a sandbox's vCPUs and/or memory; zero leaves a value
+// unchanged. A running sandbox is resized live when the new shape fits the
+// maximums declared at creation. Otherwise the persistent domain config is
+// updated (raising the maximums) and the change applies on the next boot.
+// It reports whether the change was applied live.
+func (s *Service) ResizeSandbox(ctx context.Context, sandboxID string, cpu, memoryMB int) (*store.Sandbox, bool, error) {
+	if cpu < 0 || memoryMB < 0 || (cpu == 0 && memoryMB == 0) {
+		return nil, false, fmt.Errorf("cpu or memory_mb must be positive: %w", store.ErrInvalid)
+	}
+	sb, err := s.store.GetSandbox(ctx, sandboxID)
+	if err != nil {
+		return nil, false, err
+	}
+	switch sb.State {
+	case store.SandboxStateDestroyed, store.SandboxStateHibernated:
+		// A managed save must be restored with the shape it was saved with.
+		return nil, false, fmt.Errorf("sandbox %s is %s: %w", sb.ID, sb.State, store.ErrConflict)
+	}
+
+	// Sandboxes created before shapes were recorded fall back to the defaults.
+	curCPU, curMem := sb.CPU, sb.MemoryMB
+	if curCPU == 0 {
+		curCPU = s.cfg.DefaultVCPUs
+	}
+	if curMem == 0 {
+		curMem = s.cfg.DefaultMemoryMB
+	}
+	newCPU, newMem := curCPU, curMem
+	if cpu > 0 {
+		newCPU = cpu
+	}
+	if memoryMB > 0 {
+		newMem = memoryMB
+	}
+	maxCPU, maxMem := max(sb.MaxCPU, curCPU), max(sb.MaxMemoryMB, curMem)
+	running := sb.State == store.SandboxStateRunning || sb.State == store.SandboxStateStarting || sb.State == store.SandboxStatePaused
+	live := running && newCPU <= maxCPU && newMem <= maxMem
+	maxCPU, maxMem = max(maxCPU, newCPU), max(maxMem, newMem)
+
+	unlock := s.lockQuota(sb.AgentID)
+	defer unlock()
+	if err := s.checkQuota(ctx, sb.AgentID, sb.ID, newCPU, newMem, maxCPU, maxMem); err != nil {
+		return nil, false, err
+	}
+
+	res := libvirt.Resources{VCPUs: cpu, MemoryMB: memoryMB}
+	if !live {
+		res.MaxVCPUs, res.MaxMemoryMB = maxCPU, maxMem
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := mgr.SetResources(ctx, sb.SandboxName, res, live); err != nil {
+		return nil, false, fmt.Errorf("set resources: %w", err)
+	}
+
+	sb.CPU, sb.MemoryMB = newCPU, newMem
+	sb.MaxCPU, sb.MaxMemoryMB = maxCPU, maxMem
+	sb.UpdatedAt = s.timeNowFn().UTC()
+	if err := s.store.UpdateSandbox(ctx, sb); err != nil {
+		return nil, false, err
+	}
+	s.publish(ctx, events.TypeSandboxResized, sb, map[string]any{
+		"cpu":       newCPU,
+		"memory_mb": newMem,
+		"live":      live,
+	})
+	return sb, live, nil
+}
@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// listStore serves ListSandboxes from memory; other Store methods are not used.
+type listStore struct {
+	store.Store
+	sandboxes []*store.Sandbox
+}
+
+func (l *listStore) ListSandboxes(context.Context, store.SandboxFilter, *store.ListOptions) ([]*store.Sandbox, error) {
+	return l.sandboxes, nil
+}
+
+func TestCheckQuota(t *testing.T) {
+	st := &listStore{sandboxes: []*store.Sandbox{
+		{ID: "SBX-1", CPU: 4, MemoryMB: 4096, State: store.SandboxStateRunning},
+		{ID: "SBX-2", CPU: 8, MemoryMB: 8192, State: store.SandboxStateDestroyed},
+	}}
+	s := &Service{store: st, cfg: Config{MaxSandboxVCPUs: 8, AgentVCPUQuota: 8, AgentMemoryMBQuota: 8192}}
+	ctx := context.Background()
+
+	if err := s.checkQuota(ctx, "agent", "", 4, 4096, 4, 4096); err != nil {
+		t.Errorf("within quota: %v", err)
+	}
+	if err := s.checkQuota(ctx, "agent", "", 5, 1024, 5, 1024); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("agent vCPU quota: err = %v, want ErrQuotaExceeded", err)
+	}
+	if err := s.checkQuota(ctx, "agent", "", 2, 1024, 16, 1024); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("per-sandbox max: err = %v, want ErrQuotaExceeded", err)
+	}
+	// Resizing SBX-1 itself does not count its current shape twice.
+	if err := s.checkQuota(ctx, "agent", "SBX-1", 8, 8192, 8, 8192); err != nil {
+		t.Errorf("resize within quota: %v", err)
+	}
+
+	// A sandbox without a recorded shape counts the defaults.
+	st.sandboxes = append(st.sandboxes, &store.Sandbox{ID: "SBX-3", State: store.SandboxStateRunning})
+	s.cfg.DefaultVCPUs, s.cfg.DefaultMemoryMB = 2, 2048
+	if err := s.checkQuota(ctx, "agent", "", 2, 2048, 2, 2048); err != nil {
+		t.Errorf("within quota with a default-shaped sandbox: %v", err)
+	}
+	if err := s.checkQuota(ctx, "agent", "", 3, 2048, 3, 2048); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("default shape not counted: err = %v, want ErrQuotaExceeded", err)
+	}
+}
+
+// slowCloner is a goroutine-safe CloneFromVM that takes long enough for
+// concurrent creates to overlap.
+type slowCloner struct {
+	libvirt.Manager
+	mu    sync.Mutex
+	names []string
+}
+
+func (c *slowCloner) CloneFromVM(_ context.Context, _, name string, _, _ int, _ string, _ ...libvirt.CloneOption) (libvirt.DomainRef, error) {
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = append(c.names, name)
+	return libvirt.DomainRef{Name: name}, nil
+}
+
+func TestCreateSandboxQuotaRace(t *testing.T) {
+	mgr := &slowCloner{}
+	st := newMemStore()
+	svc := NewService(mgr, st, Config{AgentVCPUQuota: 4})
+	ctx := context.Background()
+
+	const n = 8
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := svc.CreateSandbox(ctx, "golden", "agent-1", fmt.Sprintf("sbx-%d", i), 2, 512)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrQuotaExceeded):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if created != 2 || len(mgr.names) != 2 {
+		t.Errorf("created %d sandboxes (%d clones) with room for 2", created, len(mgr.names))
+	}
+
+	// Other agents are not held up by agent-1's quota.
+	if _, err := svc.CreateSandbox(ctx, "golden", "agent-2", "sbx-other", 2, 512); err != nil {
+		t.Errorf("other agent: %v", err)
+	}
+	if len(svc.quotaLocks.locks) != 0 {
+		t.Errorf("%d agent locks left behind", len(svc.quotaLocks.locks))
+	}
+}
@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// WithContainerRuntime sets the manager that runs sandboxes created with the
+// container runtime. Without it such sandboxes are rejected.
+func WithContainerRuntime(mgr libvirt.Manager) Option {
+	return func(s *Service) { s.containers = mgr }
+}
+
+// WithRuntime selects the runtime of the new sandbox, overriding the
+// template's. For the container runtime the source is an image reference.
+func WithRuntime(rt store.Runtime) CreateOption {
+	return func(o *createOptions) { o.runtime = rt }
+}
+
+// commandExecer is implemented by runtimes that run commands directly rather
+// than over SSH, such as the Podman container manager.
+type commandExecer interface {
+	ExecCommand(ctx context.Context, name, command string, env map[string]string, timeout time.Duration) (stdout, stderr string, exitCode int, err error)
+}
+
+// managerFor returns the manager for sb's runtime.
+func (s *Service) managerFor(sb *store.Sandbox) (libvirt.Manager, error) {
+	if sb.Runtime != store.RuntimeContainer {
+		return s.mgr, nil
+	}
+	if s.containers == nil {
+		return nil, fmt.Errorf("sandbox %s uses the container runtime, which is not configured: %w", sb.ID, store.ErrInvalid)
+	}
+	return s.containers, nil
+}
+
+// checkRuntime validates rt and the settings a container sandbox cannot use:
+// catalog images, disk sizing and cloud-init.
+func (s *Service) checkRuntime(rt store.Runtime, imageID string, spec *store.SandboxSpec) error {
+	switch rt {
+	case store.RuntimeVM:
+		return nil
+	case store.RuntimeContainer:
+	default:
+		return fmt.Errorf("runtime %q must be %q or %q: %w", rt, store.RuntimeVM, store.RuntimeContainer, store.ErrInvalid)
+	}
+	if s.containers == nil {
+		return fmt.Errorf("the container runtime is not configured: %w", store.ErrInvalid)
+	}
+	if imageID != "" {
+		return fmt.Errorf("container sandboxes run an image reference, not a base image: %w", store.ErrInvalid)
+	}
+	if spec != nil && (spec.RootDiskGB > 0 || len(spec.ScratchDisksGB) > 0) {
+		return fmt.Errorf("container sandboxes have no disks to size: %w", store.ErrInvalid)
+	}
+	if spec != nil && spec.CloudInit != nil {
+		return fmt.Errorf("container sandboxes do not run cloud-init: %w", store.ErrInvalid)
+	}
+	return nil
+}
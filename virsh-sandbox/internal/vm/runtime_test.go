@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// nopManager satisfies libvirt.Manager; its methods are not called.
+type nopManager struct{ libvirt.Manager }
+
+func TestCheckRuntime(t *testing.T) {
+	s := &Service{}
+	if err := s.checkRuntime(store.RuntimeVM, "IMG-1", &store.SandboxSpec{RootDiskGB: 20}); err != nil {
+		t.Errorf("vm runtime: %v", err)
+	}
+	if err := s.checkRuntime(store.RuntimeContainer, "", nil); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("container runtime not configured: err = %v, want ErrInvalid", err)
+	}
+	if err := s.checkRuntime("lxc", "", nil); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("unknown runtime: err = %v, want ErrInvalid", err)
+	}
+
+	s.containers = nopManager{}
+	if err := s.checkRuntime(store.RuntimeContainer, "", &store.SandboxSpec{Mounts: []store.HostMount{{Tag: "src"}}}); err != nil {
+		t.Errorf("container with mounts: %v", err)
+	}
+	for name, tc := range map[string]struct {
+		imageID string
+		spec    *store.SandboxSpec
+	}{
+		"base image":    {imageID: "IMG-1"},
+		"scratch disks": {spec: &store.SandboxSpec{ScratchDisksGB: []int{10}}},
+		"cloud-init":    {spec: &store.SandboxSpec{CloudInit: &store.CloudInitConfig{}}},
+	} {
+		if err := s.checkRuntime(store.RuntimeContainer, tc.imageID, tc.spec); !errors.Is(err, store.ErrInvalid) {
+			t.Errorf("%s: err = %v, want ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestManagerFor(t *testing.T) {
+	vmMgr, ctrMgr := nopManager{}, &nopManager{}
+	s := &Service{mgr: vmMgr}
+
+	if _, err := s.managerFor(&store.Sandbox{ID: "SBX-1", Runtime: store.RuntimeContainer}); !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("container runtime not configured: err = %v, want ErrInvalid", err)
+	}
+	s.containers = ctrMgr
+	for rt, want := range map[store.Runtime]libvirt.Manager{"": vmMgr, store.RuntimeVM: vmMgr, store.RuntimeContainer: ctrMgr} {
+		got, err := s.managerFor(&store.Sandbox{Runtime: rt})
+		if err != nil {
+			t.Fatalf("runtime %q: %v", rt, err)
+		}
+		if got != want {
+			t.Errorf("runtime %q: got %T, want %T", rt, got, want)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package vm
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +12,14 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
-
+	"virsh-sandbox/internal/approval"
+	"virsh-sandbox/internal/diskimage"
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/image"
 	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/policy"
+	"virsh-sandbox/internal/redact"
 	"virsh-sandbox/internal/store"
 )
 
@@ -20,11 +27,18 @@ import (
 // It represents the main application layer for sandbox lifecycle, command exec,
 // snapshotting, diffing, and artifact generation orchestration.
 type Service struct {
-	mgr       libvirt.Manager
-	store     store.Store
-	ssh       SSHRunner
-	cfg       Config
-	timeNowFn func() time.Time
+	mgr        libvirt.Manager
+	containers libvirt.Manager
+	store      store.Store
+	ssh        SSHRunner
+	events     events.Publisher
+	redactor   *redact.Redactor
+	policy     *policy.Engine
+	approvals  ApprovalVerifier
+	disks      *diskCache
+	quotaLocks agentLocks
+	cfg        Config
+	timeNowFn  func() time.Time
 }
 
 // Config controls default VM parameters and timeouts used by the service.
@@ -41,6 +55,27 @@ type Config struct {
 
 	// IPDiscoveryTimeout controls how long StartSandbox waits for the VM IP (when requested).
 	IPDiscoveryTimeout time.Duration
+
+	// CloudInitTimeout controls how long StartSandbox waits for cloud-init to finish (when requested).
+	CloudInitTimeout time.Duration
+
+	// SharedDirAllowlist lists host directories that may be shared into
+	// sandboxes. Empty disables host directory sharing.
+	SharedDirAllowlist []string
+
+	// Quotas, enforced on create and resize; zero means unlimited.
+	// MaxSandboxVCPUs and MaxSandboxMemoryMB cap one sandbox's shape including
+	// its live-resize maximums. AgentVCPUQuota and AgentMemoryMBQuota cap the
+	// summed shape of an agent's sandboxes.
+	MaxSandboxVCPUs    int
+	MaxSandboxMemoryMB int
+	AgentVCPUQuota     int
+	AgentMemoryMBQuota int
+
+	// FSCacheTTL is how long a disk opened to browse a sandbox's files stays
+	// open after its last use. FSMaxFileBytes caps one file read.
+	FSCacheTTL     time.Duration
+	FSMaxFileBytes int64
 }
 
 // Option configures the Service during construction.
@@ -51,6 +86,35 @@ func WithSSHRunner(r SSHRunner) Option {
 	return func(s *Service) { s.ssh = r }
 }
 
+// WithEventPublisher sets the publisher that receives sandbox lifecycle events.
+func WithEventPublisher(p events.Publisher) Option {
+	return func(s *Service) { s.events = p }
+}
+
+// WithRedactor overrides the secret redactor applied to command records.
+func WithRedactor(r *redact.Redactor) Option {
+	return func(s *Service) { s.redactor = r }
+}
+
+// WithPolicy sets the command policy evaluated before every RunCommand.
+// A nil engine (the default) allows all commands.
+func WithPolicy(p *policy.Engine) Option {
+	return func(s *Service) { s.policy = p }
+}
+
+// ApprovalVerifier authorises commands run under an approval. Consume must
+// accept each approval at most once and return it only if it is an approved
+// op for sandboxID; other approvals are rejected with store.ErrConflict.
+type ApprovalVerifier interface {
+	Consume(ctx context.Context, id string, op approval.Operation, sandboxID string) (*store.Approval, error)
+}
+
+// WithApprovalVerifier sets the verifier for approvals passed to RunCommand
+// with WithApproval. Without one, such commands are rejected.
+func WithApprovalVerifier(v ApprovalVerifier) Option {
+	return func(s *Service) { s.approvals = v }
+}
+
 // WithTimeNow overrides the clock (useful for tests).
 func WithTimeNow(fn func() time.Time) Option {
 	return func(s *Service) { s.timeNowFn = fn }
@@ -70,11 +134,23 @@ func NewService(mgr libvirt.Manager, st store.Store, cfg Config, opts ...Option)
 	if cfg.IPDiscoveryTimeout <= 0 {
 		cfg.IPDiscoveryTimeout = 2 * time.Minute
 	}
+	if cfg.CloudInitTimeout <= 0 {
+		cfg.CloudInitTimeout = 10 * time.Minute
+	}
+	if cfg.FSCacheTTL <= 0 {
+		cfg.FSCacheTTL = time.Minute
+	}
+	if cfg.FSMaxFileBytes <= 0 {
+		cfg.FSMaxFileBytes = 10 << 20
+	}
 	s := &Service{
 		mgr:       mgr,
 		store:     st,
 		cfg:       cfg,
 		ssh:       &DefaultSSHRunner{},
+		events:    events.Discard,
+		redactor:  redact.New(),
+		disks:     newDiskCache(cfg.FSCacheTTL),
 		timeNowFn: time.Now,
 	}
 	for _, o := range opts {
@@ -83,53 +159,307 @@ func NewService(mgr libvirt.Manager, st store.Store, cfg Config, opts ...Option)
 	return s
 }
 
-// CreateSandbox clones a VM from an existing VM and persists a Sandbox record.
+// CreateOption configures a single CreateSandbox call.
+type CreateOption func(*createOptions)
+
+type createOptions struct {
+	labels      map[string]string
+	template    string
+	baseImageID string
+	network     string
+	ttlSeconds  *int
+	cloudInit   *store.CloudInitConfig
+	rootDiskGB  int
+	scratchGB   []int
+	mounts      []store.HostMount
+	maxCPU      int
+	maxMemoryMB int
+	runtime     store.Runtime
+}
+
+// WithLabels attaches key/value labels to the new sandbox. When a template is
+// used they are merged over the template's labels.
+func WithLabels(labels map[string]string) CreateOption {
+	return func(o *createOptions) { o.labels = labels }
+}
+
+// WithTemplate creates the sandbox from the named template. Non-zero arguments
+// and options passed to CreateSandbox override the template's values.
+func WithTemplate(name string) CreateOption {
+	return func(o *createOptions) { o.template = name }
+}
+
+// WithBaseImage clones the sandbox from a READY catalog image instead of an
+// existing VM. It cannot be combined with a source VM name.
+func WithBaseImage(id string) CreateOption {
+	return func(o *createOptions) { o.baseImageID = id }
+}
+
+// WithNetwork overrides the libvirt network the sandbox is attached to.
+func WithNetwork(network string) CreateOption {
+	return func(o *createOptions) { o.network = network }
+}
+
+// WithTTL sets the sandbox TTL in seconds.
+func WithTTL(seconds int) CreateOption {
+	return func(o *createOptions) { o.ttlSeconds = &seconds }
+}
+
+// WithCloudInit adds cloud-config options (packages, files, commands, users,
+// hostname, timezone) to the sandbox's NoCloud seed. They are merged over the
+// template's options and require the cloud-init key injection method.
+func WithCloudInit(cfg *store.CloudInitConfig) CreateOption {
+	return func(o *createOptions) { o.cloudInit = cfg }
+}
+
+// WithRootDiskSize grows the sandbox root disk to gb GiB; the guest root
+// filesystem is grown on first boot.
+func WithRootDiskSize(gb int) CreateOption {
+	return func(o *createOptions) { o.rootDiskGB = gb }
+}
+
+// WithScratchDisks attaches blank disks of the given sizes (GiB) as vdb, vdc, ...
+// and replaces any scratch disks listed by the template.
+func WithScratchDisks(sizesGB ...int) CreateOption {
+	return func(o *createOptions) { o.scratchGB = sizesGB }
+}
+
+// WithMounts shares host directories into the sandbox in addition to the
+// template's mounts. Host paths must be under Config.SharedDirAllowlist, and
+// mounting requires the cloud-init key injection method.
+func WithMounts(mounts ...store.HostMount) CreateOption {
+	return func(o *createOptions) { o.mounts = mounts }
+}
+
+// WithMaxShape declares the vCPUs and memory the sandbox may be resized to
+// while running. They default to the initial shape.
+func WithMaxShape(maxCPU, maxMemoryMB int) CreateOption {
+	return func(o *createOptions) {
+		o.maxCPU = maxCPU
+		o.maxMemoryMB = maxMemoryMB
+	}
+}
+
+// CreateSandbox clones a VM from an existing VM or a catalog base image and
+// persists a Sandbox record. With the container runtime (WithRuntime or the
+// template's) it creates a container from an image instead.
 //
-// sourceSandboxName is the name of the existing VM in libvirt to clone from.
+// sourceSandboxName is the name of the existing VM in libvirt to clone from,
+// or the image reference for the container runtime; it may be empty when
+// WithBaseImage is used or WithTemplate supplies a source.
 // SandboxName is optional; if empty, a name will be generated.
-// cpu and memoryMB are optional; if <=0 the service defaults are used.
-func (s *Service) CreateSandbox(ctx context.Context, sourceSandboxName, agentID, sandboxName string, cpu, memoryMB int) (*store.Sandbox, error) {
-	if strings.TrimSpace(sourceSandboxName) == "" {
-		return nil, fmt.Errorf("sourceSandboxName is required")
-	}
+// cpu and memoryMB are optional; if <=0 the template or service defaults are used.
+func (s *Service) CreateSandbox(ctx context.Context, sourceSandboxName, agentID, sandboxName string, cpu, memoryMB int, opts ...CreateOption) (*store.Sandbox, error) {
 	if strings.TrimSpace(agentID) == "" {
 		return nil, fmt.Errorf("agentID is required")
 	}
+	var co createOptions
+	for _, o := range opts {
+		o(&co)
+	}
+	if sourceSandboxName != "" && co.baseImageID != "" {
+		return nil, fmt.Errorf("source VM and base image are mutually exclusive: %w", store.ErrInvalid)
+	}
+	imageID := co.baseImageID
+
+	network := s.cfg.Network
+	labels := co.labels
+	runtime := store.RuntimeVM
+	var (
+		ttl  *int
+		spec *store.SandboxSpec
+		tpl  *store.SandboxTemplate
+	)
+	if co.template != "" {
+		var err error
+		tpl, err = s.GetTemplate(ctx, co.template)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", co.template, err)
+		}
+		if sourceSandboxName == "" && imageID == "" {
+			sourceSandboxName, imageID = tpl.SourceVM, tpl.BaseImageID
+		}
+		if cpu <= 0 {
+			cpu = tpl.CPU
+		}
+		if memoryMB <= 0 {
+			memoryMB = tpl.MemoryMB
+		}
+		if tpl.Network != "" {
+			network = tpl.Network
+		}
+		if tpl.Runtime != "" {
+			runtime = tpl.Runtime
+		}
+		ttl = copyIntPtr(tpl.TTLSeconds)
+		labels = mergeLabels(tpl.Labels, co.labels)
+		tspec := tpl.Spec
+		spec = &tspec
+	}
+	if co.network != "" {
+		network = co.network
+	}
+	if co.runtime != "" {
+		runtime = co.runtime
+	}
+	if co.ttlSeconds != nil {
+		ttl = copyIntPtr(co.ttlSeconds)
+	}
+	if co.cloudInit != nil {
+		if spec == nil {
+			spec = &store.SandboxSpec{}
+		}
+		spec.CloudInit = mergeCloudInit(spec.CloudInit, co.cloudInit)
+	}
+	if co.rootDiskGB != 0 || co.scratchGB != nil {
+		if spec == nil {
+			spec = &store.SandboxSpec{}
+		}
+		if co.rootDiskGB != 0 {
+			spec.RootDiskGB = co.rootDiskGB
+		}
+		if co.scratchGB != nil {
+			spec.ScratchDisksGB = append([]int(nil), co.scratchGB...)
+		}
+	}
+	if len(co.mounts) > 0 {
+		if spec == nil {
+			spec = &store.SandboxSpec{}
+		}
+		spec.Mounts = append(append([]store.HostMount(nil), spec.Mounts...), co.mounts...)
+	}
+	if spec != nil {
+		if err := validateDisks(spec); err != nil {
+			return nil, err
+		}
+		if err := s.checkMounts(spec.Mounts); err != nil {
+			return nil, err
+		}
+		if err := validateCloudInit(spec.CloudInit); err != nil {
+			return nil, err
+		}
+		// Containers bind-mount shares themselves.
+		if runtime == store.RuntimeVM && (spec.CloudInit != nil || len(spec.Mounts) > 0) && strings.EqualFold(spec.KeyInjectMethod, "virt-customize") {
+			return nil, fmt.Errorf("cloud-init options and mounts require the cloud-init key injection method: %w", store.ErrInvalid)
+		}
+	}
+	if err := s.checkRuntime(runtime, imageID, spec); err != nil {
+		return nil, err
+	}
+	mgr := s.mgr
+	if runtime == store.RuntimeContainer {
+		mgr = s.containers
+	}
+
+	var img *store.BaseImage
+	if imageID != "" {
+		var err error
+		img, err = s.store.GetBaseImage(ctx, imageID)
+		if err != nil {
+			return nil, fmt.Errorf("base image %q: %w", imageID, err)
+		}
+		if img.Status != store.ImageStatusReady {
+			return nil, fmt.Errorf("base image %s is %s: %w", img.ID, img.Status, image.ErrNotReady)
+		}
+	} else if strings.TrimSpace(sourceSandboxName) == "" {
+		return nil, fmt.Errorf("sourceSandboxName or base image is required")
+	}
 	if cpu <= 0 {
 		cpu = s.cfg.DefaultVCPUs
 	}
 	if memoryMB <= 0 {
 		memoryMB = s.cfg.DefaultMemoryMB
 	}
+	maxCPU, maxMemoryMB := max(co.maxCPU, cpu), max(co.maxMemoryMB, memoryMB)
+	unlock := s.lockQuota(agentID)
+	defer unlock()
+	if err := s.checkQuota(ctx, agentID, "", cpu, memoryMB, maxCPU, maxMemoryMB); err != nil {
+		return nil, err
+	}
 	if sandboxName == "" {
-		sandboxName = fmt.Sprintf("sbx-%s", shortID())
+		sandboxName = fmt.Sprintf("sbx-%s", id.Short())
 	}
 
-	jobID := fmt.Sprintf("JOB-%s", shortID())
+	jobID := fmt.Sprintf("JOB-%s", id.Short())
 
-	// Create the VM via libvirt manager by cloning from existing VM
-	_, err := s.mgr.CloneFromVM(ctx, sourceSandboxName, sandboxName, cpu, memoryMB, s.cfg.Network)
+	// Create the VM via libvirt manager, either from a catalog image or by
+	// cloning an existing VM's disk.
+	baseImage := sourceSandboxName // Store the source VM name for reference
+	var cloneOpts []libvirt.CloneOption
+	if maxCPU > cpu || maxMemoryMB > memoryMB {
+		cloneOpts = append(cloneOpts, libvirt.WithMaxShape(maxCPU, maxMemoryMB))
+	}
+	if spec != nil {
+		if spec.RootDiskGB > 0 {
+			cloneOpts = append(cloneOpts, libvirt.WithRootDiskSize(spec.RootDiskGB))
+		}
+		if len(spec.ScratchDisksGB) > 0 {
+			cloneOpts = append(cloneOpts, libvirt.WithScratchDisks(spec.ScratchDisksGB...))
+		}
+		if len(spec.Mounts) > 0 {
+			cloneOpts = append(cloneOpts, libvirt.WithSharedDirs(sharedDirs(spec.Mounts)...))
+		}
+	}
+	var err error
+	if img != nil {
+		baseImage = img.Filename
+		_, err = mgr.CloneVM(ctx, img.Filename, sandboxName, cpu, memoryMB, network, cloneOpts...)
+	} else {
+		_, err = mgr.CloneFromVM(ctx, sourceSandboxName, sandboxName, cpu, memoryMB, network, cloneOpts...)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("clone vm: %w", err)
 	}
 
 	sb := &store.Sandbox{
-		ID:          fmt.Sprintf("SBX-%s", shortID()),
+		ID:          fmt.Sprintf("SBX-%s", id.Short()),
 		JobID:       jobID,
 		AgentID:     agentID,
 		SandboxName: sandboxName,
-		BaseImage:   sourceSandboxName, // Store the source VM name for reference
-		Network:     s.cfg.Network,
+		BaseImage:   baseImage,
+		Network:     network,
 		State:       store.SandboxStateCreated,
+		TTLSeconds:  ttl,
+		Runtime:     runtime,
+		CPU:         cpu,
+		MemoryMB:    memoryMB,
+		MaxCPU:      maxCPU,
+		MaxMemoryMB: maxMemoryMB,
+		Labels:      labels,
+		Spec:        spec,
 		CreatedAt:   s.timeNowFn().UTC(),
 		UpdatedAt:   s.timeNowFn().UTC(),
 	}
+	if tpl != nil {
+		sb.TemplateName = &tpl.Name
+		sb.TemplateVersion = &tpl.Version
+	}
 	if err := s.store.CreateSandbox(ctx, sb); err != nil {
 		return nil, fmt.Errorf("persist sandbox: %w", err)
 	}
+	data := map[string]any{
+		"sandbox_name": sb.SandboxName,
+		"agent_id":     agentID,
+		"runtime":      string(runtime),
+	}
+	if img != nil {
+		data["base_image_id"] = img.ID
+	} else {
+		data["source_vm"] = sourceSandboxName
+	}
+	if tpl != nil {
+		data["template"] = tpl.Name
+		data["template_version"] = tpl.Version
+	}
+	s.publish(ctx, events.TypeSandboxCreated, sb, data)
 	return sb, nil
 }
 
+// GetSandbox returns a sandbox by ID.
+func (s *Service) GetSandbox(ctx context.Context, sandboxID string) (*store.Sandbox, error) {
+	return s.store.GetSandbox(ctx, sandboxID)
+}
+
 func (s *Service) GetSandboxes(ctx context.Context, filter store.SandboxFilter, opts *store.ListOptions) ([]*store.Sandbox, error) {
 	return s.store.ListSandboxes(ctx, filter, opts)
 }
@@ -149,26 +479,99 @@ func (s *Service) InjectSSHKey(ctx context.Context, sandboxID, username, publicK
 	if err != nil {
 		return err
 	}
-	if err := s.mgr.InjectSSHKey(ctx, sb.SandboxName, username, publicKey); err != nil {
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	var injectOpts []libvirt.InjectOption
+	if sb.Spec != nil && sb.Spec.KeyInjectMethod != "" {
+		injectOpts = append(injectOpts, libvirt.WithInjectMethod(sb.Spec.KeyInjectMethod))
+	}
+	var bootCmds []string
+	if sb.Spec != nil && sb.Spec.RootDiskGB > 0 {
+		bootCmds = []string{growRootFSCommand}
+		injectOpts = append(injectOpts, libvirt.WithFirstBootCommands(bootCmds...))
+	}
+	if sb.Spec != nil {
+		for _, m := range sb.Spec.Mounts {
+			bootCmds = append(bootCmds, mountCommand(m))
+		}
+	}
+	if sb.Spec != nil && (sb.Spec.CloudInit != nil || len(sb.Spec.Mounts) > 0) {
+		userData, err := renderUserData(username, publicKey, sb.Spec.CloudInit, bootCmds)
+		if err != nil {
+			return fmt.Errorf("render cloud-init user-data: %w", err)
+		}
+		injectOpts = append(injectOpts, libvirt.WithInjectMethod("cloud-init"), libvirt.WithUserData(userData))
+	}
+	if err := mgr.InjectSSHKey(ctx, sb.SandboxName, username, publicKey, injectOpts...); err != nil {
 		return fmt.Errorf("inject ssh key: %w", err)
 	}
-	sb.UpdatedAt = s.timeNowFn().UTC()
+	now := s.timeNowFn().UTC()
+	sb.ProvisionedAt = &now
+	sb.UpdatedAt = now
 	return s.store.UpdateSandbox(ctx, sb)
 }
 
-// StartSandbox boots the VM and optionally waits for IP discovery.
+// needsSeed reports whether sb has settings that only reach the guest through
+// InjectSSHKey: cloud-init options and mounts in the seed it writes, and the
+// root filesystem grow among its first-boot commands.
+func needsSeed(sb *store.Sandbox) bool {
+	return sb.Runtime != store.RuntimeContainer && sb.Spec != nil &&
+		(sb.Spec.CloudInit != nil || len(sb.Spec.Mounts) > 0 || sb.Spec.RootDiskGB > 0)
+}
+
+// StartOption configures a single StartSandbox call.
+type StartOption func(*startOptions)
+
+type startOptions struct {
+	waitCloudInit  bool
+	username       string
+	privateKeyPath string
+}
+
+// WithCloudInitWait keeps the sandbox in STARTING until `cloud-init status`
+// reports done (or disabled). The status is polled over SSH when
+// WithSSHCredentials is given, and through the QEMU guest agent otherwise.
+func WithCloudInitWait() StartOption {
+	return func(o *startOptions) { o.waitCloudInit = true }
+}
+
+// WithSSHCredentials sets the SSH user and private key path used by StartSandbox.
+func WithSSHCredentials(username, privateKeyPath string) StartOption {
+	return func(o *startOptions) {
+		o.username = username
+		o.privateKeyPath = privateKeyPath
+	}
+}
+
+// StartSandbox boots the VM and optionally waits for IP discovery and cloud-init.
 // Returns the discovered IP if waitForIP is true and discovery succeeds (empty string otherwise).
-func (s *Service) StartSandbox(ctx context.Context, sandboxID string, waitForIP bool) (string, error) {
+// A VM whose cloud-init options or mounts are only written with its SSH key
+// is not started before InjectSSHKey; store.ErrConflict is returned instead.
+func (s *Service) StartSandbox(ctx context.Context, sandboxID string, waitForIP bool, opts ...StartOption) (string, error) {
 	if strings.TrimSpace(sandboxID) == "" {
 		return "", fmt.Errorf("sandboxID is required")
 	}
+	var so startOptions
+	for _, o := range opts {
+		o(&so)
+	}
 	sb, err := s.store.GetSandbox(ctx, sandboxID)
 	if err != nil {
 		return "", err
 	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return "", err
+	}
+	if needsSeed(sb) && sb.ProvisionedAt == nil {
+		return "", fmt.Errorf("sandbox %s has cloud-init options, mounts or a root disk size that are applied with its SSH key; inject the key before starting it: %w", sb.ID, store.ErrConflict)
+	}
 
-	if err := s.mgr.StartVM(ctx, sb.SandboxName); err != nil {
+	if err := mgr.StartVM(ctx, sb.SandboxName); err != nil {
 		_ = s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateError, nil)
+		s.publish(ctx, events.TypeSandboxError, sb, map[string]any{"error": err.Error()})
 		return "", fmt.Errorf("start vm: %w", err)
 	}
 
@@ -176,27 +579,115 @@ func (s *Service) StartSandbox(ctx context.Context, sandboxID string, waitForIP
 	if err := s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateStarting, nil); err != nil {
 		return "", err
 	}
+	s.publish(ctx, events.TypeSandboxStarting, sb, nil)
 
 	var ip string
 	if waitForIP {
-		ip, err = s.mgr.GetIPAddress(ctx, sb.SandboxName, s.cfg.IPDiscoveryTimeout)
+		ip, err = mgr.GetIPAddress(ctx, sb.SandboxName, s.cfg.IPDiscoveryTimeout)
 		if err != nil {
 			// Still mark as running even if we couldn't discover the IP
 			_ = s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateRunning, nil)
+			s.publish(ctx, events.TypeSandboxRunning, sb, nil)
 			return "", fmt.Errorf("get ip: %w", err)
 		}
-		if err := s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateRunning, &ip); err != nil {
-			return "", err
-		}
-	} else {
-		if err := s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateRunning, nil); err != nil {
-			return "", err
+	}
+
+	// Containers do not run cloud-init; there is nothing to wait for.
+	if so.waitCloudInit && sb.Runtime != store.RuntimeContainer {
+		ip, err = s.waitForCloudInit(ctx, sb, ip, so)
+		if err != nil {
+			_ = s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateError, ipOrNil(ip))
+			s.publish(ctx, events.TypeSandboxError, sb, map[string]any{"error": err.Error()})
+			return ip, fmt.Errorf("wait for cloud-init: %w", err)
 		}
 	}
 
+	if err := s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateRunning, ipOrNil(ip)); err != nil {
+		return "", err
+	}
+	s.publish(ctx, events.TypeSandboxRunning, sb, map[string]any{"ip_address": ip})
+
 	return ip, nil
 }
 
+// cloudInitPollInterval is the delay between `cloud-init status` probes.
+const cloudInitPollInterval = 5 * time.Second
+
+// waitForCloudInit polls `cloud-init status` until it reports done or disabled,
+// fails on error, and gives up after Config.CloudInitTimeout. Probe failures
+// (SSH not up yet, guest agent not connected) are retried. It returns the IP,
+// discovering it first when polling over SSH.
+func (s *Service) waitForCloudInit(ctx context.Context, sb *store.Sandbox, ip string, so startOptions) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.CloudInitTimeout)
+	defer cancel()
+	useSSH := so.username != "" && so.privateKeyPath != ""
+
+	var lastErr error
+	for {
+		var (
+			out string
+			err error
+		)
+		switch {
+		case useSSH && ip == "":
+			ip, err = s.mgr.GetIPAddress(ctx, sb.SandboxName, s.cfg.IPDiscoveryTimeout)
+		case useSSH:
+			out, _, _, err = s.ssh.Run(ctx, ip, so.username, so.privateKeyPath, "cloud-init status", 30*time.Second, nil)
+			if out != "" {
+				err = nil // cloud-init status exits non-zero for error/degraded; the output decides
+			}
+		default:
+			out, _, err = s.mgr.GuestExec(ctx, sb.SandboxName, []string{"cloud-init", "status"}, 30*time.Second)
+		}
+		if err != nil {
+			lastErr = err
+		} else if out != "" {
+			switch parseCloudInitStatus(out) {
+			case cloudInitDone, cloudInitDisabled:
+				return ip, nil
+			case cloudInitError:
+				return ip, fmt.Errorf("cloud-init reported an error: %s", strings.TrimSpace(out))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return ip, fmt.Errorf("cloud-init not done after %s: %w", s.cfg.CloudInitTimeout, lastErr)
+			}
+			return ip, fmt.Errorf("cloud-init not done after %s", s.cfg.CloudInitTimeout)
+		case <-time.After(cloudInitPollInterval):
+		}
+	}
+}
+
+// RunPostBootCommands runs the sandbox's post-boot commands (from its template)
+// in order over SSH, stopping at the first failure. Each command goes through
+// RunCommand, so policy checks, redaction and persistence apply.
+func (s *Service) RunPostBootCommands(ctx context.Context, sandboxID, username, privateKeyPath string) ([]*store.Command, error) {
+	sb, err := s.store.GetSandbox(ctx, sandboxID)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Spec == nil || len(sb.Spec.PostBootCommands) == 0 {
+		return nil, nil
+	}
+	var out []*store.Command
+	for i, c := range sb.Spec.PostBootCommands {
+		cmd, err := s.RunCommand(ctx, sb.ID, username, privateKeyPath, c, 0, nil)
+		if cmd != nil {
+			out = append(out, cmd)
+		}
+		if err != nil {
+			return out, fmt.Errorf("post-boot command %d: %w", i+1, err)
+		}
+		if cmd.ExitCode != 0 {
+			return out, fmt.Errorf("post-boot command %d exited with code %d", i+1, cmd.ExitCode)
+		}
+	}
+	return out, nil
+}
+
 // StopSandbox gracefully shuts down the VM or forces if force is true.
 func (s *Service) StopSandbox(ctx context.Context, sandboxID string, force bool) error {
 	if strings.TrimSpace(sandboxID) == "" {
@@ -206,14 +697,107 @@ func (s *Service) StopSandbox(ctx context.Context, sandboxID string, force bool)
 	if err != nil {
 		return err
 	}
-	if err := s.mgr.StopVM(ctx, sb.SandboxName, force); err != nil {
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	if err := mgr.StopVM(ctx, sb.SandboxName, force); err != nil {
 		return fmt.Errorf("stop vm: %w", err)
 	}
-	return s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateStopped, sb.IPAddress)
+	if err := s.store.UpdateSandboxState(ctx, sb.ID, store.SandboxStateStopped, sb.IPAddress); err != nil {
+		return err
+	}
+	s.publish(ctx, events.TypeSandboxStopped, sb, map[string]any{"force": force})
+	return nil
+}
+
+// PauseSandbox suspends a running sandbox's vCPUs. Memory stays allocated, so
+// ResumeSandbox continues it instantly with processes intact.
+func (s *Service) PauseSandbox(ctx context.Context, sandboxID string) (*store.Sandbox, error) {
+	sb, err := s.sandboxInState(ctx, sandboxID, store.SandboxStateRunning)
+	if err != nil {
+		return nil, err
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.SuspendVM(ctx, sb.SandboxName); err != nil {
+		return nil, fmt.Errorf("suspend vm: %w", err)
+	}
+	return s.transition(ctx, sb, store.SandboxStatePaused, events.TypeSandboxPaused)
+}
+
+// HibernateSandbox saves a running or paused sandbox's memory state to disk
+// and stops the domain, freeing host memory. ResumeSandbox restores it.
+func (s *Service) HibernateSandbox(ctx context.Context, sandboxID string) (*store.Sandbox, error) {
+	sb, err := s.sandboxInState(ctx, sandboxID, store.SandboxStateRunning, store.SandboxStatePaused)
+	if err != nil {
+		return nil, err
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.HibernateVM(ctx, sb.SandboxName); err != nil {
+		return nil, fmt.Errorf("hibernate vm: %w", err)
+	}
+	return s.transition(ctx, sb, store.SandboxStateHibernated, events.TypeSandboxHibernated)
+}
+
+// ResumeSandbox continues a paused sandbox or restores a hibernated one from
+// its saved memory state.
+func (s *Service) ResumeSandbox(ctx context.Context, sandboxID string) (*store.Sandbox, error) {
+	sb, err := s.sandboxInState(ctx, sandboxID, store.SandboxStatePaused, store.SandboxStateHibernated)
+	if err != nil {
+		return nil, err
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return nil, err
+	}
+	if sb.State == store.SandboxStateHibernated {
+		err = mgr.StartVM(ctx, sb.SandboxName) // restores the managed save
+	} else {
+		err = mgr.ResumeVM(ctx, sb.SandboxName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resume vm: %w", err)
+	}
+	return s.transition(ctx, sb, store.SandboxStateRunning, events.TypeSandboxResumed)
+}
+
+// sandboxInState loads a sandbox and returns store.ErrConflict unless it is in one of states.
+func (s *Service) sandboxInState(ctx context.Context, sandboxID string, states ...store.SandboxState) (*store.Sandbox, error) {
+	if strings.TrimSpace(sandboxID) == "" {
+		return nil, fmt.Errorf("sandboxID is required")
+	}
+	sb, err := s.store.GetSandbox(ctx, sandboxID)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range states {
+		if sb.State == st {
+			return sb, nil
+		}
+	}
+	return nil, fmt.Errorf("sandbox %s is %s: %w", sb.ID, sb.State, store.ErrConflict)
+}
+
+// transition records a new sandbox state, keeping the IP, and publishes typ.
+func (s *Service) transition(ctx context.Context, sb *store.Sandbox, state store.SandboxState, typ events.Type) (*store.Sandbox, error) {
+	from := sb.State
+	if err := s.store.UpdateSandboxState(ctx, sb.ID, state, sb.IPAddress); err != nil {
+		return nil, err
+	}
+	sb.State = state
+	s.publish(ctx, typ, sb, map[string]any{"from": string(from)})
+	return sb, nil
 }
 
 // DestroySandbox forcibly destroys and undefines the VM and removes its workspace.
-// The sandbox is then soft-deleted from the store.
+// The sandbox is then soft-deleted from the store. Sandboxes with live forks
+// return store.ErrConflict.
 func (s *Service) DestroySandbox(ctx context.Context, sandboxID string) error {
 	if strings.TrimSpace(sandboxID) == "" {
 		return fmt.Errorf("sandboxID is required")
@@ -222,10 +806,26 @@ func (s *Service) DestroySandbox(ctx context.Context, sandboxID string) error {
 	if err != nil {
 		return err
 	}
-	if err := s.mgr.DestroyVM(ctx, sb.SandboxName); err != nil {
+	// Forked children are backed by a snapshot export in this sandbox's job dir.
+	children, err := s.store.ListSandboxes(ctx, store.SandboxFilter{ParentID: &sb.ID}, nil)
+	if err != nil {
+		return fmt.Errorf("list forks: %w", err)
+	}
+	if len(children) > 0 {
+		return fmt.Errorf("sandbox %s has %d forked children; destroy them first: %w", sb.ID, len(children), store.ErrConflict)
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	if err := mgr.DestroyVM(ctx, sb.SandboxName); err != nil {
 		return fmt.Errorf("destroy vm: %w", err)
 	}
-	return s.store.DeleteSandbox(ctx, sandboxID)
+	if err := s.store.DeleteSandbox(ctx, sandboxID); err != nil {
+		return err
+	}
+	s.publish(ctx, events.TypeSandboxDestroyed, sb, nil)
+	return nil
 }
 
 // CreateSnapshot creates a snapshot and persists a Snapshot record.
@@ -237,12 +837,16 @@ func (s *Service) CreateSnapshot(ctx context.Context, sandboxID, name string, ex
 	if err != nil {
 		return nil, err
 	}
-	ref, err := s.mgr.CreateSnapshot(ctx, sb.SandboxName, name, external)
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := mgr.CreateSnapshot(ctx, sb.SandboxName, name, external)
 	if err != nil {
 		return nil, fmt.Errorf("create snapshot: %w", err)
 	}
 	sn := &store.Snapshot{
-		ID:        fmt.Sprintf("SNP-%s", shortID()),
+		ID:        fmt.Sprintf("SNP-%s", id.Short()),
 		SandboxID: sb.ID,
 		Name:      ref.Name,
 		Kind:      snapshotKindFromString(ref.Kind),
@@ -252,13 +856,48 @@ func (s *Service) CreateSnapshot(ctx context.Context, sandboxID, name string, ex
 	if err := s.store.CreateSnapshot(ctx, sn); err != nil {
 		return nil, err
 	}
+	s.publish(ctx, events.TypeSnapshotCreated, sb, map[string]any{
+		"snapshot_id": sn.ID,
+		"name":        sn.Name,
+		"kind":        string(sn.Kind),
+	})
 	return sn, nil
 }
 
+// RevertSnapshot restores the sandbox to a previously created snapshot.
+func (s *Service) RevertSnapshot(ctx context.Context, sandboxID, name string) error {
+	if strings.TrimSpace(sandboxID) == "" || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("sandboxID and name are required")
+	}
+	sb, err := s.store.GetSandbox(ctx, sandboxID)
+	if err != nil {
+		return err
+	}
+	sn, err := s.store.GetSnapshotByName(ctx, sb.ID, name)
+	if err != nil {
+		return err
+	}
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return err
+	}
+	if err := mgr.RevertSnapshot(ctx, sb.SandboxName, sn.Name); err != nil {
+		return fmt.Errorf("revert snapshot: %w", err)
+	}
+	sb.UpdatedAt = s.timeNowFn().UTC()
+	if err := s.store.UpdateSandbox(ctx, sb); err != nil {
+		return err
+	}
+	s.publish(ctx, events.TypeSnapshotReverted, sb, map[string]any{
+		"snapshot_id": sn.ID,
+		"name":        sn.Name,
+	})
+	return nil
+}
+
 // DiffSnapshots computes a normalized change set between two snapshots and persists a Diff.
-// Note: This implementation currently aggregates command history into CommandsRun and
-// leaves file/package/service diffs empty. A dedicated diff engine should populate these fields
-// by mounting snapshots and computing differences.
+// Files are compared by reading both snapshots' disks directly, without mounting them;
+// CommandsRun aggregates command history. Package and service diffs are left empty.
 func (s *Service) DiffSnapshots(ctx context.Context, sandboxID, from, to string) (*store.Diff, error) {
 	if strings.TrimSpace(sandboxID) == "" || strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
 		return nil, fmt.Errorf("sandboxID, from, to are required")
@@ -268,8 +907,21 @@ func (s *Service) DiffSnapshots(ctx context.Context, sandboxID, from, to string)
 		return nil, err
 	}
 
-	// Best-effort: get a plan (notes/instructions) from manager; ignore failure.
-	_, _ = s.mgr.DiffSnapshot(ctx, sb.SandboxName, from, to)
+	// Best-effort: file changes are left empty, with a note, when the
+	// snapshots' disks cannot be read.
+	files := &diskimage.Changes{}
+	var notes []string
+	if mgr, err := s.managerFor(sb); err == nil {
+		if plan, err := mgr.DiffSnapshot(ctx, sb.SandboxName, from, to); err == nil {
+			if files, err = diffSnapshotDisks(ctx, plan); err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				files = &diskimage.Changes{}
+				notes = append(notes, fmt.Sprintf("file changes unavailable: %v", err))
+			}
+		}
+	}
 
 	// For now, compose CommandsRun from command history as partial diff signal.
 	cmds, err := s.store.ListCommands(ctx, sandboxID, &store.ListOptions{OrderBy: "started_at", Asc: true})
@@ -286,99 +938,268 @@ func (s *Service) DiffSnapshots(ctx context.Context, sandboxID, from, to string)
 	}
 
 	diff := &store.Diff{
-		ID:           fmt.Sprintf("DIF-%s", shortID()),
+		ID:           fmt.Sprintf("DIF-%s", id.Short()),
 		SandboxID:    sandboxID,
 		FromSnapshot: from,
 		ToSnapshot:   to,
 		DiffJSON: store.ChangeDiff{
-			FilesModified:   []string{},
-			FilesAdded:      []string{},
-			FilesRemoved:    []string{},
+			FilesModified:   nonNil(files.Modified),
+			FilesAdded:      nonNil(files.Added),
+			FilesRemoved:    nonNil(files.Removed),
 			PackagesAdded:   []store.PackageInfo{},
 			PackagesRemoved: []store.PackageInfo{},
 			ServicesChanged: []store.ServiceChange{},
 			CommandsRun:     cr,
+			Notes:           notes,
 		},
 		CreatedAt: s.timeNowFn().UTC(),
 	}
 	if err := s.store.SaveDiff(ctx, diff); err != nil {
 		return nil, err
 	}
+	s.publish(ctx, events.TypeDiffCreated, sb, map[string]any{
+		"diff_id":       diff.ID,
+		"from_snapshot": from,
+		"to_snapshot":   to,
+	})
 	return diff, nil
 }
 
+// RunOption configures a single RunCommand call.
+type RunOption func(*runOptions)
+
+type runOptions struct {
+	secretEnv  []string
+	approvalID string
+}
+
+// WithSecretEnv marks env keys whose values must be redacted from the stored
+// and returned command record.
+func WithSecretEnv(keys ...string) RunOption {
+	return func(o *runOptions) { o.secretEnv = append(o.secretEnv, keys...) }
+}
+
+// WithApproval marks the call as authorised by a granted approval. Commands the
+// policy flags as requiring approval are then executed if the approval is an
+// unused approved run_command approval for this sandbox and command; denied
+// commands still are not.
+func WithApproval(approvalID string) RunOption {
+	return func(o *runOptions) { o.approvalID = approvalID }
+}
+
 // RunCommand executes a command inside the sandbox via SSH.
 // The username and privateKeyPath are required for SSH auth. The service obtains
 // the VM IP from the sandbox record or discovers it via libvirt if missing.
-func (s *Service) RunCommand(ctx context.Context, sandboxID, username, privateKeyPath, command string, timeout time.Duration, env map[string]string) (*store.Command, error) {
+// Container sandboxes run the command with podman exec instead and ignore the
+// SSH credentials.
+// Secrets in the command, env and output are redacted before the record is
+// persisted; the placeholders are listed in Metadata.Redacted.
+//
+// The configured policy is evaluated before execution. Denied commands and
+// commands that require approval are not run; their record is still stored and
+// returned together with an error wrapping policy.ErrDenied or
+// policy.ErrApprovalRequired.
+func (s *Service) RunCommand(ctx context.Context, sandboxID, username, privateKeyPath, command string, timeout time.Duration, env map[string]string, opts ...RunOption) (*store.Command, error) {
 	if strings.TrimSpace(sandboxID) == "" {
 		return nil, fmt.Errorf("sandboxID is required")
 	}
-	if strings.TrimSpace(username) == "" {
-		return nil, fmt.Errorf("username is required")
-	}
-	if strings.TrimSpace(privateKeyPath) == "" {
-		return nil, fmt.Errorf("privateKeyPath is required")
-	}
 	if strings.TrimSpace(command) == "" {
 		return nil, fmt.Errorf("command is required")
 	}
 	if timeout <= 0 {
 		timeout = s.cfg.CommandTimeout
 	}
+	var ro runOptions
+	for _, o := range opts {
+		o(&ro)
+	}
 
 	sb, err := s.store.GetSandbox(ctx, sandboxID)
 	if err != nil {
 		return nil, err
 	}
-	ip := ""
-	if sb.IPAddress != nil && *sb.IPAddress != "" {
-		ip = *sb.IPAddress
-	} else {
-		ip, err = s.mgr.GetIPAddress(ctx, sb.SandboxName, s.cfg.IPDiscoveryTimeout)
-		if err != nil {
-			return nil, fmt.Errorf("discover ip: %w", err)
-		}
-		// Persist discovered IP for subsequent calls
-		if err := s.store.UpdateSandboxState(ctx, sb.ID, sb.State, &ip); err != nil {
-			return nil, fmt.Errorf("persist ip: %w", err)
-		}
+	run, err := s.commandRunner(ctx, sb, username, privateKeyPath, command, timeout, env)
+	if err != nil {
+		return nil, err
 	}
 
-	cmdID := fmt.Sprintf("CMD-%s", shortID())
+	cmdID := fmt.Sprintf("CMD-%s", id.Short())
 	now := s.timeNowFn().UTC()
 
-	// Encode environment for persistence.
+	decision := s.policy.Evaluate(policy.Input{
+		Command:   command,
+		AgentID:   sb.AgentID,
+		SourceVM:  sb.BaseImage,
+		SandboxID: sb.ID,
+		Labels:    sb.Labels,
+	})
+
+	var (
+		stdout, stderr string
+		code           int
+		runErr         error
+	)
+	switch decision.Action {
+	case policy.ActionDeny:
+		code = -1
+		runErr = fmt.Errorf("%w: %s", policy.ErrDenied, decisionSummary(decision))
+		stderr = runErr.Error()
+	case policy.ActionRequireApproval:
+		if ro.approvalID == "" {
+			code = -1
+			runErr = fmt.Errorf("%w: %s", policy.ErrApprovalRequired, decisionSummary(decision))
+			stderr = runErr.Error()
+			break
+		}
+		if err := s.verifyApproval(ctx, ro.approvalID, sb.ID, command); err != nil {
+			code = -1
+			runErr = err
+			stderr = runErr.Error()
+			break
+		}
+		stdout, stderr, code, runErr = run()
+	default:
+		stdout, stderr, code, runErr = run()
+	}
+
+	// Redact secrets before anything leaves the service.
+	rs := s.redactor.NewSession(env, ro.secretEnv)
 	var envJSON *string
 	if len(env) > 0 {
-		b, _ := json.Marshal(env)
+		b, _ := json.Marshal(rs.Env(env))
 		tmp := string(b)
 		envJSON = &tmp
 	}
 
-	stdout, stderr, code, runErr := s.ssh.Run(ctx, ip, username, privateKeyPath, commandWithEnv(command, env), timeout, env)
-
 	cmd := &store.Command{
 		ID:        cmdID,
 		SandboxID: sandboxID,
-		Command:   command,
+		Command:   rs.String(command),
 		EnvJSON:   envJSON,
-		Stdout:    stdout,
-		Stderr:    stderr,
+		Stdout:    rs.String(stdout),
+		Stderr:    rs.String(stderr),
 		ExitCode:  code,
 		StartedAt: now,
 		EndedAt:   s.timeNowFn().UTC(),
+		Metadata: &store.CommandExecRecord{
+			User:     username,
+			Timeout:  &timeout,
+			Redacted: rs.Redacted(),
+			Policy: &store.PolicyDecision{
+				Action: string(decision.Action),
+				Rule:   decision.Rule,
+				Reason: decision.Reason,
+			},
+			ApprovalID: ro.approvalID,
+		},
 	}
 	if err := s.store.SaveCommand(ctx, cmd); err != nil {
 		return nil, fmt.Errorf("save command: %w", err)
 	}
+	s.publish(ctx, events.TypeCommandExited, sb, map[string]any{
+		"command_id":  cmd.ID,
+		"exit_code":   cmd.ExitCode,
+		"duration_ms": cmd.EndedAt.Sub(cmd.StartedAt).Milliseconds(),
+		"policy":      string(decision.Action),
+	})
 
 	if runErr != nil {
-		return cmd, fmt.Errorf("ssh run: %w", runErr)
+		return cmd, runErr
 	}
 	return cmd, nil
 }
 
+// commandRunner returns a function that executes command in sb: through the
+// container runtime's exec for container sandboxes, over SSH otherwise. For
+// SSH it requires credentials and discovers and persists the IP if missing.
+func (s *Service) commandRunner(ctx context.Context, sb *store.Sandbox, username, privateKeyPath, command string, timeout time.Duration, env map[string]string) (func() (string, string, int, error), error) {
+	mgr, err := s.managerFor(sb)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Runtime == store.RuntimeContainer {
+		ex, ok := mgr.(commandExecer)
+		if !ok {
+			return nil, fmt.Errorf("container runtime cannot execute commands")
+		}
+		return func() (string, string, int, error) {
+			stdout, stderr, code, err := ex.ExecCommand(ctx, sb.SandboxName, command, env, timeout)
+			if err != nil {
+				err = fmt.Errorf("container exec: %w", err)
+			}
+			return stdout, stderr, code, err
+		}, nil
+	}
+
+	if strings.TrimSpace(username) == "" {
+		return nil, fmt.Errorf("username is required: %w", store.ErrInvalid)
+	}
+	if strings.TrimSpace(privateKeyPath) == "" {
+		return nil, fmt.Errorf("privateKeyPath is required: %w", store.ErrInvalid)
+	}
+	ip := ""
+	if sb.IPAddress != nil && *sb.IPAddress != "" {
+		ip = *sb.IPAddress
+	} else {
+		ip, err = mgr.GetIPAddress(ctx, sb.SandboxName, s.cfg.IPDiscoveryTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("discover ip: %w", err)
+		}
+		// Persist discovered IP for subsequent calls
+		if err := s.store.UpdateSandboxState(ctx, sb.ID, sb.State, &ip); err != nil {
+			return nil, fmt.Errorf("persist ip: %w", err)
+		}
+	}
+	return func() (string, string, int, error) {
+		stdout, stderr, code, err := s.ssh.Run(ctx, ip, username, privateKeyPath, commandWithEnv(command, env), timeout, env)
+		if err != nil {
+			err = fmt.Errorf("ssh run: %w", err)
+		}
+		return stdout, stderr, code, err
+	}, nil
+}
+
+// CommandDigest returns the digest an approval payload records for command
+// under "command_sha256". The payload itself only shows the redacted text.
+func CommandDigest(command string) string {
+	sum := sha256.Sum256([]byte(command))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyApproval consumes approvalID for running command in sandboxID. The
+// approval's payload must carry the digest of the same command.
+func (s *Service) verifyApproval(ctx context.Context, approvalID, sandboxID, command string) error {
+	if s.approvals == nil {
+		return fmt.Errorf("%w: approval %s cannot be verified", store.ErrConflict, approvalID)
+	}
+	a, err := s.approvals.Consume(ctx, approvalID, approval.OpRunCommand, sandboxID)
+	if err != nil {
+		return err
+	}
+	var payload struct {
+		CommandSHA256 string `json:"command_sha256"`
+	}
+	if a.PayloadJSON != nil {
+		_ = json.Unmarshal([]byte(*a.PayloadJSON), &payload)
+	}
+	if payload.CommandSHA256 != CommandDigest(command) {
+		return fmt.Errorf("%w: approval %s was granted for a different command", store.ErrConflict, approvalID)
+	}
+	return nil
+}
+
+// decisionSummary renders a policy decision for error messages.
+func decisionSummary(d policy.Decision) string {
+	switch {
+	case d.Rule != "" && d.Reason != "":
+		return fmt.Sprintf("rule %q: %s", d.Rule, d.Reason)
+	case d.Rule != "":
+		return fmt.Sprintf("rule %q", d.Rule)
+	default:
+		return "default action"
+	}
+}
+
 // SSHRunner executes commands on a remote host via SSH.
 type SSHRunner interface {
 	// Run executes command on user@addr using the provided private key file.
@@ -435,6 +1256,17 @@ func (r *DefaultSSHRunner) Run(ctx context.Context, addr, user, privateKeyPath,
 
 // Helpers
 
+// publish emits a lifecycle event scoped to sb.
+func (s *Service) publish(ctx context.Context, typ events.Type, sb *store.Sandbox, data map[string]any) {
+	s.events.Publish(ctx, events.Event{
+		Type:      typ,
+		SandboxID: sb.ID,
+		JobID:     sb.JobID,
+		Timestamp: s.timeNowFn().UTC(),
+		Data:      data,
+	})
+}
+
 func snapshotKindFromString(k string) store.SnapshotKind {
 	switch strings.ToUpper(k) {
 	case "EXTERNAL":
@@ -444,12 +1276,20 @@ func snapshotKindFromString(k string) store.SnapshotKind {
 	}
 }
 
-func shortID() string {
-	id := uuid.NewString()
-	if i := strings.IndexByte(id, '-'); i > 0 {
-		return id[:i]
+// ipOrNil returns nil for an unknown IP so the stored address is left unset.
+func ipOrNil(ip string) *string {
+	if ip == "" {
+		return nil
+	}
+	return &ip
+}
+
+func copyIntPtr(p *int) *int {
+	if p == nil {
+		return nil
 	}
-	return id
+	v := *p
+	return &v
 }
 
 func commandWithEnv(cmd string, env map[string]string) string {
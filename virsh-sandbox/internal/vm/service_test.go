@@ -0,0 +1,450 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"virsh-sandbox/internal/approval"
+	"virsh-sandbox/internal/events"
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/policy"
+	"virsh-sandbox/internal/store"
+)
+
+// memStore keeps sandboxes, snapshots, commands and templates in memory;
+// other Store methods are not used.
+type memStore struct {
+	store.Store
+	mu        sync.Mutex
+	sandboxes map[string]*store.Sandbox
+	snapshots []*store.Snapshot
+	commands  []*store.Command
+	templates map[string]*store.SandboxTemplate
+}
+
+func newMemStore(sandboxes ...*store.Sandbox) *memStore {
+	m := &memStore{sandboxes: make(map[string]*store.Sandbox), templates: make(map[string]*store.SandboxTemplate)}
+	for _, sb := range sandboxes {
+		m.sandboxes[sb.ID] = sb
+	}
+	return m
+}
+
+func (m *memStore) GetSandbox(_ context.Context, id string) (*store.Sandbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sb, ok := m.sandboxes[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cp := *sb
+	return &cp, nil
+}
+
+func (m *memStore) CreateSandbox(_ context.Context, sb *store.Sandbox) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sandboxes[sb.ID]; ok {
+		return store.ErrAlreadyExists
+	}
+	cp := *sb
+	m.sandboxes[sb.ID] = &cp
+	return nil
+}
+
+func (m *memStore) UpdateSandbox(_ context.Context, sb *store.Sandbox) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sandboxes[sb.ID]; !ok {
+		return store.ErrNotFound
+	}
+	cp := *sb
+	m.sandboxes[sb.ID] = &cp
+	return nil
+}
+
+func (m *memStore) UpdateSandboxState(_ context.Context, id string, state store.SandboxState, ip *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sb, ok := m.sandboxes[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	sb.State = state
+	if ip != nil {
+		sb.IPAddress = ip
+	}
+	return nil
+}
+
+func (m *memStore) ListSandboxes(_ context.Context, filter store.SandboxFilter, _ *store.ListOptions) ([]*store.Sandbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*store.Sandbox
+	for _, sb := range m.sandboxes {
+		if filter.AgentID != nil && sb.AgentID != *filter.AgentID {
+			continue
+		}
+		if filter.BaseImage != nil && sb.BaseImage != *filter.BaseImage {
+			continue
+		}
+		if filter.VMName != nil && sb.SandboxName != *filter.VMName {
+			continue
+		}
+		if filter.ParentID != nil && (sb.ParentID == nil || *sb.ParentID != *filter.ParentID) {
+			continue
+		}
+		cp := *sb
+		out = append(out, &cp)
+	}
+	return out, nil
+}
+
+// DeleteSandbox drops the sandbox; the real store soft-deletes it, which also
+// hides it from ListSandboxes.
+func (m *memStore) DeleteSandbox(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sandboxes[id]; !ok {
+		return store.ErrNotFound
+	}
+	delete(m.sandboxes, id)
+	return nil
+}
+
+func (m *memStore) CreateSnapshot(_ context.Context, sn *store.Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp := *sn
+	m.snapshots = append(m.snapshots, &cp)
+	return nil
+}
+
+func (m *memStore) GetSnapshotByName(_ context.Context, sandboxID, name string) (*store.Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sn := range m.snapshots {
+		if sn.SandboxID == sandboxID && sn.Name == name {
+			cp := *sn
+			return &cp, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (m *memStore) CreateTemplate(_ context.Context, t *store.SandboxTemplate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cur := range m.templates {
+		if cur.Name == t.Name {
+			return store.ErrAlreadyExists
+		}
+	}
+	t.Version = 1
+	cp := *t
+	m.templates[t.ID] = &cp
+	return nil
+}
+
+func (m *memStore) GetTemplate(_ context.Context, id string) (*store.SandboxTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.templates[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cp := *t
+	return &cp, nil
+}
+
+func (m *memStore) GetTemplateByName(_ context.Context, name string) (*store.SandboxTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.templates {
+		if t.Name == name {
+			cp := *t
+			return &cp, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (m *memStore) UpdateTemplate(_ context.Context, t *store.SandboxTemplate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.templates[t.ID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	if cur.Version != t.Version {
+		return store.ErrConflict
+	}
+	t.Version++
+	cp := *t
+	m.templates[t.ID] = &cp
+	return nil
+}
+
+func (m *memStore) SaveCommand(_ context.Context, cmd *store.Command) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, cmd)
+	return nil
+}
+
+// sshRecorder records the commands it is asked to run and exits with the
+// code set for each in codes.
+type sshRecorder struct {
+	ran   []string
+	codes map[string]int
+}
+
+func (r *sshRecorder) Run(_ context.Context, _, _, _, command string, _ time.Duration, _ map[string]string) (string, string, int, error) {
+	r.ran = append(r.ran, command)
+	return "ok", "", r.codes[command], nil
+}
+
+// lifecycleManager records power operations as "op name" and fails them
+// with err when it is set.
+type lifecycleManager struct {
+	libvirt.Manager
+	calls []string
+	err   error
+}
+
+func (m *lifecycleManager) record(op, name string) error {
+	m.calls = append(m.calls, op+" "+name)
+	return m.err
+}
+
+func (m *lifecycleManager) StartVM(_ context.Context, name string) error {
+	return m.record("start", name)
+}
+
+func (m *lifecycleManager) SuspendVM(_ context.Context, name string) error {
+	return m.record("suspend", name)
+}
+
+func (m *lifecycleManager) ResumeVM(_ context.Context, name string) error {
+	return m.record("resume", name)
+}
+
+func (m *lifecycleManager) HibernateVM(_ context.Context, name string) error {
+	return m.record("hibernate", name)
+}
+
+func (m *lifecycleManager) InjectSSHKey(_ context.Context, name, _, _ string, _ ...libvirt.InjectOption) error {
+	return m.record("inject", name)
+}
+
+// eventRecorder collects published events.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (r *eventRecorder) Publish(_ context.Context, ev events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// approvalsFunc adapts a function to ApprovalVerifier.
+type approvalsFunc func(id string, op approval.Operation, sandboxID string) (*store.Approval, error)
+
+func (f approvalsFunc) Consume(_ context.Context, id string, op approval.Operation, sandboxID string) (*store.Approval, error) {
+	return f(id, op, sandboxID)
+}
+
+func TestRunCommandApproval(t *testing.T) {
+	ip := "10.0.0.2"
+	sb := &store.Sandbox{ID: "SBX-1", SandboxName: "sbx-1", AgentID: "agent-1", IPAddress: &ip}
+	pol, err := policy.New(policy.Policy{Rules: []policy.Rule{{
+		Name:   "review",
+		Action: policy.ActionRequireApproval,
+		Match:  policy.Match{Command: []string{`^systemctl `}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"command":"systemctl restart app","command_sha256":"` + CommandDigest("systemctl restart app") + `"}`
+	granted := func(id string, op approval.Operation, sandboxID string) (*store.Approval, error) {
+		if id != "APR-1" || op != approval.OpRunCommand || sandboxID != "SBX-1" {
+			return nil, store.ErrConflict
+		}
+		return &store.Approval{ID: id, SandboxID: sandboxID, Status: store.ApprovalStatusApproved, PayloadJSON: &payload}, nil
+	}
+	// The displayed command alone does not authorise anything.
+	displayOnly := `{"command":"systemctl restart app"}`
+	undigested := func(id string, _ approval.Operation, sandboxID string) (*store.Approval, error) {
+		return &store.Approval{ID: id, SandboxID: sandboxID, Status: store.ApprovalStatusApproved, PayloadJSON: &displayOnly}, nil
+	}
+
+	cases := []struct {
+		name     string
+		verifier ApprovalVerifier
+		command  string
+		opts     []RunOption
+		wantErr  error
+		wantRun  bool
+	}{
+		{"allowed command", nil, "ls", nil, nil, true},
+		{"gated without approval", approvalsFunc(granted), "systemctl restart app", nil, policy.ErrApprovalRequired, false},
+		{"no verifier", nil, "systemctl restart app", []RunOption{WithApproval("APR-1")}, store.ErrConflict, false},
+		{"unknown approval", approvalsFunc(granted), "systemctl restart app", []RunOption{WithApproval("APR-2")}, store.ErrConflict, false},
+		{"different command", approvalsFunc(granted), "systemctl stop app", []RunOption{WithApproval("APR-1")}, store.ErrConflict, false},
+		{"payload without digest", approvalsFunc(undigested), "systemctl restart app", []RunOption{WithApproval("APR-1")}, store.ErrConflict, false},
+		{"approved", approvalsFunc(granted), "systemctl restart app", []RunOption{WithApproval("APR-1")}, nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ssh := &sshRecorder{}
+			st := newMemStore(sb)
+			opts := []Option{WithSSHRunner(ssh), WithPolicy(pol)}
+			if c.verifier != nil {
+				opts = append(opts, WithApprovalVerifier(c.verifier))
+			}
+			svc := NewService(nopManager{}, st, Config{}, opts...)
+
+			cmd, err := svc.RunCommand(context.Background(), "SBX-1", "user", "/key", c.command, 0, nil, c.opts...)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+			if ran := len(ssh.ran) == 1; ran != c.wantRun {
+				t.Errorf("command ran = %v, want %v", ran, c.wantRun)
+			}
+			if cmd == nil || len(st.commands) != 1 {
+				t.Fatalf("command record not stored")
+			}
+			if !c.wantRun && cmd.ExitCode != -1 {
+				t.Errorf("exit code = %d for a command that did not run", cmd.ExitCode)
+			}
+		})
+	}
+}
+
+func TestStartSandboxNeedsSeed(t *testing.T) {
+	ctx := context.Background()
+	seeded := &store.SandboxSpec{Mounts: []store.HostMount{{HostPath: "/srv/src", Tag: "src"}}}
+	st := newMemStore(
+		&store.Sandbox{ID: "SBX-1", SandboxName: "sbx-1", Spec: seeded},
+		&store.Sandbox{ID: "SBX-2", SandboxName: "sbx-2", Spec: &store.SandboxSpec{PostBootCommands: []string{"true"}}},
+		&store.Sandbox{ID: "SBX-3", SandboxName: "sbx-3", Spec: &store.SandboxSpec{RootDiskGB: 40}},
+	)
+	mgr := &lifecycleManager{}
+	svc := NewService(mgr, st, Config{})
+
+	if _, err := svc.StartSandbox(ctx, "SBX-1", false); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("start before key injection: err = %v, want ErrConflict", err)
+	}
+	if _, err := svc.StartSandbox(ctx, "SBX-3", false); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("start of resized root before key injection: err = %v, want ErrConflict", err)
+	}
+	if len(mgr.calls) != 0 {
+		t.Fatalf("called %v before the seed was written", mgr.calls)
+	}
+	if _, err := svc.StartSandbox(ctx, "SBX-2", false); err != nil {
+		t.Fatalf("sandbox without seeded settings: %v", err)
+	}
+
+	if err := svc.InjectSSHKey(ctx, "SBX-1", "user", "ssh-ed25519 AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if sb, _ := st.GetSandbox(ctx, "SBX-1"); sb.ProvisionedAt == nil {
+		t.Fatal("InjectSSHKey did not record ProvisionedAt")
+	}
+	if _, err := svc.StartSandbox(ctx, "SBX-1", false); err != nil {
+		t.Fatalf("start after key injection: %v", err)
+	}
+	if want := []string{"start sbx-2", "inject sbx-1", "start sbx-1"}; !slices.Equal(mgr.calls, want) {
+		t.Errorf("calls = %v, want %v", mgr.calls, want)
+	}
+}
+
+func TestPowerTransitions(t *testing.T) {
+	type op func(*Service, context.Context, string) (*store.Sandbox, error)
+	pause, hibernate, resume := (*Service).PauseSandbox, (*Service).HibernateSandbox, (*Service).ResumeSandbox
+
+	cases := []struct {
+		name     string
+		op       op
+		from     store.SandboxState
+		mgrErr   error
+		wantCall string // manager call; empty when rejected before reaching it
+		want     store.SandboxState
+		wantType events.Type
+		wantErr  error
+	}{
+		{"pause running", pause, store.SandboxStateRunning, nil, "suspend sbx-1", store.SandboxStatePaused, events.TypeSandboxPaused, nil},
+		{"pause paused", pause, store.SandboxStatePaused, nil, "", store.SandboxStatePaused, "", store.ErrConflict},
+		{"pause stopped", pause, store.SandboxStateStopped, nil, "", store.SandboxStateStopped, "", store.ErrConflict},
+		{"pause hibernated", pause, store.SandboxStateHibernated, nil, "", store.SandboxStateHibernated, "", store.ErrConflict},
+		{"hibernate running", hibernate, store.SandboxStateRunning, nil, "hibernate sbx-1", store.SandboxStateHibernated, events.TypeSandboxHibernated, nil},
+		{"hibernate paused", hibernate, store.SandboxStatePaused, nil, "hibernate sbx-1", store.SandboxStateHibernated, events.TypeSandboxHibernated, nil},
+		{"hibernate hibernated", hibernate, store.SandboxStateHibernated, nil, "", store.SandboxStateHibernated, "", store.ErrConflict},
+		{"hibernate created", hibernate, store.SandboxStateCreated, nil, "", store.SandboxStateCreated, "", store.ErrConflict},
+		{"resume paused", resume, store.SandboxStatePaused, nil, "resume sbx-1", store.SandboxStateRunning, events.TypeSandboxResumed, nil},
+		{"resume hibernated", resume, store.SandboxStateHibernated, nil, "start sbx-1", store.SandboxStateRunning, events.TypeSandboxResumed, nil},
+		{"resume running", resume, store.SandboxStateRunning, nil, "", store.SandboxStateRunning, "", store.ErrConflict},
+		{"resume destroyed", resume, store.SandboxStateDestroyed, nil, "", store.SandboxStateDestroyed, "", store.ErrConflict},
+		{"manager failure keeps state", pause, store.SandboxStateRunning, errors.New("boom"), "suspend sbx-1", store.SandboxStateRunning, "", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip := "10.0.0.2"
+			st := newMemStore(&store.Sandbox{ID: "SBX-1", SandboxName: "sbx-1", State: c.from, IPAddress: &ip})
+			mgr := &lifecycleManager{err: c.mgrErr}
+			rec := &eventRecorder{}
+			svc := NewService(mgr, st, Config{}, WithEventPublisher(rec))
+
+			sb, err := c.op(svc, context.Background(), "SBX-1")
+			switch {
+			case c.mgrErr != nil:
+				if !errors.Is(err, c.mgrErr) {
+					t.Fatalf("err = %v, want %v", err, c.mgrErr)
+				}
+			case !errors.Is(err, c.wantErr):
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			case err == nil && sb.State != c.want:
+				t.Errorf("returned state %s, want %s", sb.State, c.want)
+			}
+
+			var want []string
+			if c.wantCall != "" {
+				want = []string{c.wantCall}
+			}
+			if !slices.Equal(mgr.calls, want) {
+				t.Errorf("manager calls = %v, want %v", mgr.calls, want)
+			}
+			got, _ := st.GetSandbox(context.Background(), "SBX-1")
+			if got.State != c.want {
+				t.Errorf("stored state %s, want %s", got.State, c.want)
+			}
+			if got.IPAddress == nil || *got.IPAddress != ip {
+				t.Errorf("IP address not kept: %v", got.IPAddress)
+			}
+
+			if c.wantType == "" {
+				if len(rec.events) != 0 {
+					t.Errorf("published %d events for a rejected transition", len(rec.events))
+				}
+				return
+			}
+			if len(rec.events) != 1 || rec.events[0].Type != c.wantType || rec.events[0].Data["from"] != string(c.from) {
+				t.Errorf("events = %+v, want one %s from %s", rec.events, c.wantType, c.from)
+			}
+		})
+	}
+
+	svc := NewService(&lifecycleManager{}, newMemStore(), Config{})
+	if _, err := svc.PauseSandbox(context.Background(), "SBX-404"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("unknown sandbox: err = %v, want ErrNotFound", err)
+	}
+	if _, err := svc.ResumeSandbox(context.Background(), " "); err == nil {
+		t.Error("empty sandbox ID accepted")
+	}
+}
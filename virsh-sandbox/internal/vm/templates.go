@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"virsh-sandbox/internal/id"
+	"virsh-sandbox/internal/store"
+)
+
+// templateNameRe restricts template names to URL- and label-friendly slugs.
+var templateNameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,62}[a-z0-9])?$`)
+
+// CreateTemplate validates and persists a new sandbox template at version 1.
+func (s *Service) CreateTemplate(ctx context.Context, t *store.SandboxTemplate) (*store.SandboxTemplate, error) {
+	if err := validateTemplate(t); err != nil {
+		return nil, err
+	}
+	if err := s.checkMounts(t.Spec.Mounts); err != nil {
+		return nil, err
+	}
+	if t.Runtime != "" {
+		if err := s.checkRuntime(t.Runtime, t.BaseImageID, &t.Spec); err != nil {
+			return nil, err
+		}
+	}
+	t.ID = fmt.Sprintf("TPL-%s", id.Short())
+	if err := s.store.CreateTemplate(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTemplate returns a template by ID ("TPL-...") or by name.
+func (s *Service) GetTemplate(ctx context.Context, idOrName string) (*store.SandboxTemplate, error) {
+	if strings.HasPrefix(idOrName, "TPL-") {
+		return s.store.GetTemplate(ctx, idOrName)
+	}
+	return s.store.GetTemplateByName(ctx, idOrName)
+}
+
+// ListTemplates returns all templates.
+func (s *Service) ListTemplates(ctx context.Context, opts *store.ListOptions) ([]*store.SandboxTemplate, error) {
+	return s.store.ListTemplates(ctx, opts)
+}
+
+// UpdateTemplate replaces the template identified by idOrName with t and bumps
+// its version. If t.Version is non-zero it must match the stored version,
+// otherwise store.ErrConflict is returned.
+func (s *Service) UpdateTemplate(ctx context.Context, idOrName string, t *store.SandboxTemplate) (*store.SandboxTemplate, error) {
+	cur, err := s.GetTemplate(ctx, idOrName)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTemplate(t); err != nil {
+		return nil, err
+	}
+	if err := s.checkMounts(t.Spec.Mounts); err != nil {
+		return nil, err
+	}
+	if t.Runtime != "" {
+		if err := s.checkRuntime(t.Runtime, t.BaseImageID, &t.Spec); err != nil {
+			return nil, err
+		}
+	}
+	if t.Version != 0 && t.Version != cur.Version {
+		return nil, fmt.Errorf("template %s is at version %d, not %d: %w", cur.Name, cur.Version, t.Version, store.ErrConflict)
+	}
+	t.ID = cur.ID
+	t.Version = cur.Version
+	t.CreatedAt = cur.CreatedAt
+	if err := s.store.UpdateTemplate(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DeleteTemplate removes a template. Sandboxes created from it keep their
+// recorded template name, version and resolved spec.
+func (s *Service) DeleteTemplate(ctx context.Context, idOrName string) error {
+	t, err := s.GetTemplate(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+	return s.store.DeleteTemplate(ctx, t.ID)
+}
+
+func validateTemplate(t *store.SandboxTemplate) error {
+	if t == nil {
+		return fmt.Errorf("template is required: %w", store.ErrInvalid)
+	}
+	if !templateNameRe.MatchString(t.Name) {
+		return fmt.Errorf("template name %q must be a lowercase slug (a-z, 0-9, '.', '_', '-'): %w", t.Name, store.ErrInvalid)
+	}
+	if (strings.TrimSpace(t.SourceVM) == "") == (t.BaseImageID == "") {
+		return fmt.Errorf("template needs exactly one of source_vm or base_image_id: %w", store.ErrInvalid)
+	}
+	if t.CPU < 0 || t.MemoryMB < 0 {
+		return fmt.Errorf("template cpu and memory_mb must not be negative: %w", store.ErrInvalid)
+	}
+	if t.TTLSeconds != nil && *t.TTLSeconds <= 0 {
+		return fmt.Errorf("template ttl_seconds must be positive: %w", store.ErrInvalid)
+	}
+	switch strings.ToLower(t.Spec.KeyInjectMethod) {
+	case "", "virt-customize", "cloud-init":
+	default:
+		return fmt.Errorf("template key_inject_method %q must be virt-customize or cloud-init: %w", t.Spec.KeyInjectMethod, store.ErrInvalid)
+	}
+	if err := validateDisks(&t.Spec); err != nil {
+		return err
+	}
+	if err := validateCloudInit(t.Spec.CloudInit); err != nil {
+		return err
+	}
+	for i, c := range t.Spec.PostBootCommands {
+		if strings.TrimSpace(c) == "" {
+			return fmt.Errorf("template post_boot_commands[%d] is empty: %w", i, store.ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// mergeLabels returns base overlaid with override; override wins on conflicts.
+func mergeLabels(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	out := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range override {
+		out[k] = v
+	}
+	return out
+}
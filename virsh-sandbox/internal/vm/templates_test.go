@@ -0,0 +1,158 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"virsh-sandbox/internal/libvirt"
+	"virsh-sandbox/internal/store"
+)
+
+// cloneRecorder records CloneFromVM calls.
+type cloneRecorder struct {
+	libvirt.Manager
+	source, name, network string
+	cpu, memoryMB         int
+}
+
+func (c *cloneRecorder) CloneFromVM(_ context.Context, source, name string, cpu, memoryMB int, network string, _ ...libvirt.CloneOption) (libvirt.DomainRef, error) {
+	c.source, c.name, c.cpu, c.memoryMB, c.network = source, name, cpu, memoryMB, network
+	return libvirt.DomainRef{Name: name}, nil
+}
+
+func TestTemplateVersioning(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(nopManager{}, newMemStore(), Config{})
+
+	if _, err := svc.CreateTemplate(ctx, &store.SandboxTemplate{Name: "Bad Name", SourceVM: "golden"}); !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("invalid name: err = %v, want ErrInvalid", err)
+	}
+	if _, err := svc.CreateTemplate(ctx, &store.SandboxTemplate{Name: "both", SourceVM: "golden", BaseImageID: "IMG-1"}); !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("two sources: err = %v, want ErrInvalid", err)
+	}
+	badCloudInit := store.SandboxSpec{CloudInit: &store.CloudInitConfig{WriteFiles: []store.CloudInitFile{{Path: "relative"}}}}
+	if _, err := svc.CreateTemplate(ctx, &store.SandboxTemplate{Name: "cfg", SourceVM: "golden", Spec: badCloudInit}); !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("invalid cloud-init: err = %v, want ErrInvalid", err)
+	}
+
+	created, err := svc.CreateTemplate(ctx, &store.SandboxTemplate{Name: "web", SourceVM: "golden", CPU: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.ID, "TPL-") || created.Version != 1 {
+		t.Fatalf("created = %s v%d", created.ID, created.Version)
+	}
+
+	// An unversioned update always applies; a versioned one must match.
+	updated, err := svc.UpdateTemplate(ctx, "web", &store.SandboxTemplate{Name: "web", SourceVM: "golden", CPU: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID || updated.Version != 2 || updated.CPU != 4 {
+		t.Fatalf("updated = %s v%d cpu %d", updated.ID, updated.Version, updated.CPU)
+	}
+	if _, err := svc.UpdateTemplate(ctx, "web", &store.SandboxTemplate{Name: "web", SourceVM: "golden", Spec: badCloudInit}); !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("update with invalid cloud-init: err = %v, want ErrInvalid", err)
+	}
+	if _, err := svc.UpdateTemplate(ctx, created.ID, &store.SandboxTemplate{Name: "web", SourceVM: "golden", Version: 1}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale version: err = %v, want ErrConflict", err)
+	}
+	updated, err = svc.UpdateTemplate(ctx, created.ID, &store.SandboxTemplate{Name: "web", SourceVM: "golden", CPU: 8, Version: 2})
+	if err != nil || updated.Version != 3 {
+		t.Fatalf("matching version: v%d, %v", updated.Version, err)
+	}
+	got, err := svc.GetTemplate(ctx, "web")
+	if err != nil || got.Version != 3 || got.CPU != 8 {
+		t.Fatalf("GetTemplate = %+v, %v", got, err)
+	}
+	if _, err := svc.UpdateTemplate(ctx, "missing", &store.SandboxTemplate{Name: "missing", SourceVM: "golden"}); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("missing template: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCreateSandboxFromTemplate(t *testing.T) {
+	ctx := context.Background()
+	mgr := &cloneRecorder{}
+	st := newMemStore()
+	svc := NewService(mgr, st, Config{Network: "default", DefaultVCPUs: 1, DefaultMemoryMB: 512})
+
+	ttl := 3600
+	if _, err := svc.CreateTemplate(ctx, &store.SandboxTemplate{
+		Name:       "web",
+		SourceVM:   "golden-web",
+		CPU:        2,
+		MemoryMB:   4096,
+		Network:    "isolated",
+		TTLSeconds: &ttl,
+		Labels:     map[string]string{"env": "dev", "team": "web"},
+		Spec: store.SandboxSpec{
+			KeyInjectMethod:  "cloud-init",
+			PostBootCommands: []string{"systemctl start app"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := svc.CreateSandbox(ctx, "", "agent-1", "", 4, 0,
+		WithTemplate("web"), WithLabels(map[string]string{"env": "prod"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mgr.source != "golden-web" || mgr.cpu != 4 || mgr.memoryMB != 4096 || mgr.network != "isolated" {
+		t.Errorf("cloned %s with %d vCPUs, %d MB on %s", mgr.source, mgr.cpu, mgr.memoryMB, mgr.network)
+	}
+	if want := map[string]string{"env": "prod", "team": "web"}; !reflect.DeepEqual(sb.Labels, want) {
+		t.Errorf("labels = %v, want %v", sb.Labels, want)
+	}
+	if sb.TemplateName == nil || *sb.TemplateName != "web" || sb.TemplateVersion == nil || *sb.TemplateVersion != 1 {
+		t.Errorf("template provenance = %v v%v", sb.TemplateName, sb.TemplateVersion)
+	}
+	if sb.TTLSeconds == nil || *sb.TTLSeconds != ttl {
+		t.Errorf("ttl = %v, want %d", sb.TTLSeconds, ttl)
+	}
+	if sb.Spec == nil || sb.Spec.KeyInjectMethod != "cloud-init" || !reflect.DeepEqual(sb.Spec.PostBootCommands, []string{"systemctl start app"}) {
+		t.Errorf("spec = %+v", sb.Spec)
+	}
+
+	// The sandbox keeps the spec it was created with when the template changes.
+	if _, err := svc.UpdateTemplate(ctx, "web", &store.SandboxTemplate{Name: "web", SourceVM: "golden-web"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := st.GetSandbox(ctx, sb.ID)
+	if len(stored.Spec.PostBootCommands) != 1 || *stored.TemplateVersion != 1 {
+		t.Errorf("stored sandbox changed with its template: %+v", stored.Spec)
+	}
+
+	if _, err := svc.CreateSandbox(ctx, "", "agent-1", "", 0, 0, WithTemplate("missing")); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("missing template: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRunPostBootCommands(t *testing.T) {
+	ip := "10.0.0.2"
+	sb := &store.Sandbox{ID: "SBX-1", SandboxName: "sbx-1", IPAddress: &ip, Spec: &store.SandboxSpec{
+		PostBootCommands: []string{"apt-get update", "false", "never-run"},
+	}}
+	ssh := &sshRecorder{codes: map[string]int{commandWithEnv("false", nil): 1}}
+	st := newMemStore(sb, &store.Sandbox{ID: "SBX-2", SandboxName: "sbx-2", IPAddress: &ip})
+	svc := NewService(nopManager{}, st, Config{}, WithSSHRunner(ssh))
+
+	cmds, err := svc.RunPostBootCommands(context.Background(), "SBX-1", "user", "/key")
+	if err == nil || !strings.Contains(err.Error(), "post-boot command 2 exited with code 1") {
+		t.Fatalf("err = %v, want command 2 to fail", err)
+	}
+	if want := []string{commandWithEnv("apt-get update", nil), commandWithEnv("false", nil)}; !reflect.DeepEqual(ssh.ran, want) {
+		t.Errorf("ran %q, want the commands up to the failure", ssh.ran)
+	}
+	if len(cmds) != 2 || len(st.commands) != 2 {
+		t.Errorf("returned %d and stored %d command records, want 2", len(cmds), len(st.commands))
+	}
+
+	cmds, err = svc.RunPostBootCommands(context.Background(), "SBX-2", "user", "/key")
+	if err != nil || cmds != nil {
+		t.Errorf("no post-boot commands = %v, %v", cmds, err)
+	}
+}
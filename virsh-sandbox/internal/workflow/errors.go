@@ -29,17 +29,27 @@ var (
 	// ErrSanitizeFailed indicates filesystem sanitization failed.
 	ErrSanitizeFailed = errors.New("sanitize_failed")
 
+	// ErrSecretsFound indicates the secret scan found credentials in the
+	// filesystem of a clone configured to fail on them.
+	ErrSecretsFound = errors.New("secrets_found")
+
 	// ErrArchiveFailed indicates rootfs archive creation failed.
 	ErrArchiveFailed = errors.New("archive_failed")
 
 	// ErrImageBuildFailed indicates Podman image build failed.
 	ErrImageBuildFailed = errors.New("image_build_failed")
 
+	// ErrPushFailed indicates pushing the image to a registry failed.
+	ErrPushFailed = errors.New("push_failed")
+
 	// ErrContainerCreateFailed indicates container creation/start failed.
 	ErrContainerCreateFailed = errors.New("container_create_failed")
 
 	// ErrRollbackFailed indicates cleanup during rollback encountered errors.
 	ErrRollbackFailed = errors.New("rollback_failed")
+
+	// ErrInterrupted indicates the process running the workflow exited before it finished.
+	ErrInterrupted = errors.New("interrupted")
 )
 
 // WorkflowError wraps a stage error with additional context.
@@ -99,6 +109,7 @@ const (
 	StageSanitizeFS     = "sanitize_filesystem"
 	StageCreateArchive  = "create_archive"
 	StageBuildImage     = "build_image"
+	StagePushImage      = "push_image"
 	StageRunContainer   = "run_container"
 	StageCleanup        = "cleanup"
 )